@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"Facts/internal/db"
+	"Facts/internal/handlers"
+	"Facts/internal/models"
+)
+
+// ejecutarComando atiende los comandos de mantenimiento y devuelve el código de salida
+func ejecutarComando(args []string) int {
+	switch args[0] {
+	case "auditar-folios":
+		return comandoAuditarFolios(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "comando desconocido: %s\ncomandos disponibles: auditar-folios\n", args[0])
+		return 2
+	}
+}
+
+// comandoAuditarFolios exporta en CSV la auditoría de folios de un emisor (o de todos).
+// Sale con 3 si hubo hallazgos para poder usarlo en tareas programadas. Solo lee: no aplica
+// migraciones, las columnas que consulta las agrega el servidor al arrancar.
+func comandoAuditarFolios(args []string) int {
+	fs := flag.NewFlagSet("auditar-folios", flag.ContinueOnError)
+	rfc := fs.String("rfc", "", "RFC del emisor (vacío para todos)")
+	serie := fs.String("serie", "", "serie a auditar (vacío para todas)")
+	desde := fs.String("desde", "", "fecha inicial AAAA-MM-DD (por defecto el primer día del mes)")
+	hasta := fs.String("hasta", "", "fecha final AAAA-MM-DD, inclusiva (por defecto hoy)")
+	salida := fs.String("salida", "", "archivo CSV de salida (por defecto la salida estándar)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	filtro, err := handlers.FiltroAuditoriaDesdeTexto(*rfc, *serie, *desde, *hasta)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	db.InitDB()
+	auditoria, err := models.AuditarFolios(filtro)
+	if err != nil {
+		log.Printf("[FOLIOS] Error en la auditoría: %v", err)
+		return 1
+	}
+
+	var w io.Writer = os.Stdout
+	if *salida != "" {
+		archivo, err := os.Create(*salida)
+		if err != nil {
+			log.Printf("Error al crear %s: %v", *salida, err)
+			return 1
+		}
+		defer archivo.Close()
+		w = archivo
+	}
+	if err := auditoria.EscribirCSV(w); err != nil {
+		log.Printf("Error al escribir el CSV: %v", err)
+		return 1
+	}
+	log.Printf("[FOLIOS] Auditoría %s a %s: %d series, %d hallazgos", auditoria.Desde, auditoria.Hasta, len(auditoria.Series), len(auditoria.Hallazgos))
+	if len(auditoria.Hallazgos) > 0 {
+		return 3
+	}
+	return 0
+}
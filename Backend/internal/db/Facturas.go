@@ -18,8 +18,11 @@ func ObtenerUUIDyNoCertificado(numeroFolio string) (uuid string, noCertificado s
 	return
 }
 
-// GuardarFacturaTimbrada guarda el resultado del timbrado en la base de datos
-func GuardarFacturaTimbrada(db *sql.DB, resultado map[string]interface{}) error {
+// GuardarFacturaTimbrada guarda el resultado del timbrado en la base de datos; acepta una
+// conexión o una transacción
+func GuardarFacturaTimbrada(db interface {
+	Exec(string, ...interface{}) (sql.Result, error)
+}, resultado map[string]interface{}) error {
 	// Guarda XML, PDF, UUID, timbre y folio en la tabla facturas, y cada campo del timbre en columnas separadas
 	uuid, _ := resultado["uuid"].(string)
 	xmlStr, _ := resultado["xml"].(string)
@@ -63,3 +66,13 @@ func GuardarFacturaTimbrada(db *sql.DB, resultado map[string]interface{}) error
 	}
 	return nil
 }
+
+// ObtenerXMLTimbrado devuelve el XML timbrado guardado para un folio; vacío si no hay
+func ObtenerXMLTimbrado(numeroFolio string) (string, error) {
+	var xmlTimbrado sql.NullString
+	err := GetDB().QueryRow("SELECT xml FROM facturas WHERE numero_folio = ?", numeroFolio).Scan(&xmlTimbrado)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return xmlTimbrado.String, err
+}
@@ -0,0 +1,344 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"Facts/internal/secretos"
+	"Facts/internal/utils"
+)
+
+// Estados de un certificado CSD del emisor. Pendiente, activo y vencido salen de la vigencia;
+// revocado lo marca el emisor y ya no cambia.
+const (
+	CSDPendiente = "pendiente"
+	CSDActivo    = "activo"
+	CSDVencido   = "vencido"
+	CSDRevocado  = "revocado"
+)
+
+// formatoFechaCSD es el formato de las vigencias guardadas en certificados_csd (UTC)
+const formatoFechaCSD = "2006-01-02 15:04:05"
+
+// ErrSinCSDVigente indica que el emisor tiene certificados registrados pero ninguno sirve para sellar hoy
+var ErrSinCSDVigente = errors.New("el emisor no tiene un CSD vigente; registre uno nuevo")
+
+// CertificadoCSD es un CSD registrado de un emisor. La llave y la contraseña nunca salen al cliente.
+type CertificadoCSD struct {
+	ID            int64     `json:"id"`
+	IDUsuario     int       `json:"id_usuario"`
+	RFC           string    `json:"rfc"`
+	NoCertificado string    `json:"no_certificado"`
+	ValidoDesde   time.Time `json:"valido_desde"`
+	ValidoHasta   time.Time `json:"valido_hasta"`
+	Estado        string    `json:"estado"`
+	UltimoAviso   int       `json:"ultimo_aviso,omitempty"` // días antes del vencimiento del último aviso enviado
+	FechaCreacion string    `json:"fecha_creacion"`
+
+	RutaCer  string `json:"-"`
+	RutaKey  string `json:"-"`
+	ClaveCSD string `json:"-"` // sellada
+}
+
+// EstadoCSDPorVigencia calcula el estado de un certificado no revocado
+func EstadoCSDPorVigencia(desde, hasta, ahora time.Time) string {
+	switch {
+	case ahora.Before(desde):
+		return CSDPendiente
+	case !ahora.Before(hasta):
+		return CSDVencido
+	default:
+		return CSDActivo
+	}
+}
+
+// DiasRestantes son los días completos que faltan para que venza el certificado
+func (c *CertificadoCSD) DiasRestantes(ahora time.Time) int {
+	return int(c.ValidoHasta.Sub(ahora).Hours() / 24)
+}
+
+const columnasCertificadoCSD = `id, id_usuario, rfc, no_certificado, valido_desde, valido_hasta, estado, ultimo_aviso,
+	DATE_FORMAT(fecha_creacion, '%Y-%m-%d %H:%i:%s'), ruta_archivo_cer, ruta_archivo_key, clave_csd`
+
+type escaneable interface {
+	Scan(dest ...interface{}) error
+}
+
+// escanearCertificadoCSD lee un renglón con columnasCertificadoCSD y corrige el estado con la vigencia
+func escanearCertificadoCSD(fila escaneable, ahora time.Time) (CertificadoCSD, error) {
+	var c CertificadoCSD
+	var desde, hasta string
+	err := fila.Scan(&c.ID, &c.IDUsuario, &c.RFC, &c.NoCertificado, &desde, &hasta, &c.Estado, &c.UltimoAviso,
+		&c.FechaCreacion, &c.RutaCer, &c.RutaKey, &c.ClaveCSD)
+	if err != nil {
+		return c, err
+	}
+	c.ValidoDesde, _ = time.Parse(formatoFechaCSD, desde)
+	c.ValidoHasta, _ = time.Parse(formatoFechaCSD, hasta)
+	if c.Estado != CSDRevocado {
+		c.Estado = EstadoCSDPorVigencia(c.ValidoDesde, c.ValidoHasta, ahora)
+	}
+	return c, nil
+}
+
+// ejecutor es lo común entre *sql.DB y *sql.Tx
+type ejecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// registrarCertificadoCSD da de alta (o actualiza las rutas y la contraseña de) el CSD del .cer
+func registrarCertificadoCSD(ex ejecutor, usuarioID int, rfc string, cer []byte, rutaCer, rutaKey, claveSellada string) (string, error) {
+	cert, err := utils.LeerCertificadoCSD(cer)
+	if err != nil {
+		return "", fmt.Errorf("el archivo .cer no es un certificado válido: %w", err)
+	}
+	noCertificado := utils.NumeroCertificadoCSD(cert)
+	desde, hasta := cert.NotBefore.UTC(), cert.NotAfter.UTC()
+	_, err = ex.Exec(
+		`INSERT INTO certificados_csd
+		(id_usuario, rfc, no_certificado, ruta_archivo_cer, ruta_archivo_key, clave_csd, valido_desde, valido_hasta, estado)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE id_usuario = VALUES(id_usuario), ruta_archivo_cer = VALUES(ruta_archivo_cer),
+			ruta_archivo_key = VALUES(ruta_archivo_key), clave_csd = VALUES(clave_csd)`,
+		usuarioID, strings.ToUpper(rfc), noCertificado, rutaCer, rutaKey, claveSellada,
+		desde.Format(formatoFechaCSD), hasta.Format(formatoFechaCSD), EstadoCSDPorVigencia(desde, hasta, time.Now()),
+	)
+	if err != nil {
+		return "", fmt.Errorf("error al registrar el certificado %s: %w", noCertificado, err)
+	}
+	return noCertificado, nil
+}
+
+// RegistrarCertificadoCSD valida y guarda un CSD adicional del emisor sin tocar el de datos_fiscales.
+// Se aceptan certificados que aún no entran en vigor (quedan pendientes); los vencidos se rechazan.
+func RegistrarCertificadoCSD(usuarioID int, rfc string, cer, llave []byte, nombreCer, nombreKey, clave string) (*CertificadoCSD, error) {
+	cert, err := utils.LeerCertificadoCSD(cer)
+	if err != nil {
+		return nil, &utils.ErrorValidacionCSD{Codigo: utils.CSDCertificadoInvalido, Mensaje: "el archivo .cer no es un certificado válido: " + err.Error()}
+	}
+	ahora := time.Now()
+	if ahora.Before(cert.NotBefore) {
+		ahora = cert.NotBefore
+	}
+	if err := secretos.ValidarCSD(llave, cer, clave, rfc, ahora, secretos.CSDGuardado{}); err != nil {
+		return nil, err
+	}
+	id := secretos.IdentidadCSD{RFC: rfc, NoCertificado: utils.NumeroCertificadoCSD(cert)}
+	claveSellada, err := secretos.CifrarClaveCSD(clave, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Cada certificado en su directorio para no pisar los archivos de otro con el mismo nombre
+	dir := fmt.Sprintf("./certificados/%d/%s", usuarioID, id.NoCertificado)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error al crear el directorio del certificado: %w", err)
+	}
+	rutaCer := fmt.Sprintf("%s/%s", dir, nombreCer)
+	rutaKey := fmt.Sprintf("%s/%s", dir, nombreKey)
+	if err := utils.SaveFile(rutaCer, cer); err != nil {
+		return nil, fmt.Errorf("error al guardar archivo CER en disco: %w", err)
+	}
+	if err := secretos.GuardarLlaveCSD(rutaKey, llave, id); err != nil {
+		return nil, err
+	}
+
+	noCertificado, err := registrarCertificadoCSD(GetDB(), usuarioID, rfc, cer, rutaCer, rutaKey, claveSellada)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[CSD] Certificado %s registrado para %s (vigente del %s al %s)", noCertificado, strings.ToUpper(rfc),
+		cert.NotBefore.Format("2006-01-02"), cert.NotAfter.Format("2006-01-02"))
+	return ObtenerCertificadoCSDPorNumero(rfc, noCertificado)
+}
+
+// ObtenerCertificadoCSDPorNumero busca un certificado del emisor por su número
+func ObtenerCertificadoCSDPorNumero(rfc, noCertificado string) (*CertificadoCSD, error) {
+	fila := GetDB().QueryRow("SELECT "+columnasCertificadoCSD+" FROM certificados_csd WHERE rfc = ? AND no_certificado = ?",
+		strings.ToUpper(rfc), noCertificado)
+	c, err := escanearCertificadoCSD(fila, time.Now())
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error al obtener el certificado %s: %w", noCertificado, err)
+	}
+	return &c, nil
+}
+
+// ListarCertificadosCSD devuelve los certificados del emisor, el más reciente primero
+func ListarCertificadosCSD(rfc string) ([]CertificadoCSD, error) {
+	rows, err := GetDB().Query("SELECT "+columnasCertificadoCSD+" FROM certificados_csd WHERE rfc = ? ORDER BY valido_desde DESC",
+		strings.ToUpper(rfc))
+	if err != nil {
+		return nil, fmt.Errorf("error al listar certificados: %w", err)
+	}
+	defer rows.Close()
+
+	ahora := time.Now()
+	certificados := []CertificadoCSD{}
+	for rows.Next() {
+		c, err := escanearCertificadoCSD(rows, ahora)
+		if err != nil {
+			return nil, fmt.Errorf("error al leer certificado: %w", err)
+		}
+		certificados = append(certificados, c)
+	}
+	return certificados, rows.Err()
+}
+
+// CertificadoVigente elige el CSD con el que se sella: el no revocado que esté en vigor y haya
+// entrado en vigor más recientemente. Devuelve nil si el emisor no tiene certificados registrados
+// y ErrSinCSDVigente si los tiene pero ninguno sirve.
+func CertificadoVigente(rfc string, ahora time.Time) (*CertificadoCSD, error) {
+	momento := ahora.UTC().Format(formatoFechaCSD)
+	fila := GetDB().QueryRow("SELECT "+columnasCertificadoCSD+` FROM certificados_csd
+		WHERE rfc = ? AND estado <> ? AND valido_desde <= ? AND valido_hasta > ?
+		ORDER BY valido_desde DESC LIMIT 1`,
+		strings.ToUpper(rfc), CSDRevocado, momento, momento)
+	c, err := escanearCertificadoCSD(fila, ahora)
+	if err == nil {
+		return &c, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, fmt.Errorf("error al obtener el CSD vigente de %s: %w", rfc, err)
+	}
+
+	var registrados int
+	if err := GetDB().QueryRow("SELECT COUNT(*) FROM certificados_csd WHERE rfc = ?", strings.ToUpper(rfc)).Scan(&registrados); err != nil {
+		return nil, fmt.Errorf("error al obtener el CSD vigente de %s: %w", rfc, err)
+	}
+	if registrados > 0 {
+		return nil, ErrSinCSDVigente
+	}
+	return nil, nil
+}
+
+// RevocarCertificadoCSD marca como revocado un certificado del emisor; ya no se usa para sellar
+func RevocarCertificadoCSD(rfc string, id int64) error {
+	var existe int
+	if err := GetDB().QueryRow("SELECT COUNT(*) FROM certificados_csd WHERE id = ? AND rfc = ?", id, strings.ToUpper(rfc)).Scan(&existe); err != nil {
+		return fmt.Errorf("error al revocar el certificado %d: %w", id, err)
+	}
+	if existe == 0 {
+		return fmt.Errorf("no se encontró el certificado %d del emisor %s", id, strings.ToUpper(rfc))
+	}
+	if _, err := GetDB().Exec("UPDATE certificados_csd SET estado = ? WHERE id = ?", CSDRevocado, id); err != nil {
+		return fmt.Errorf("error al revocar el certificado %d: %w", id, err)
+	}
+	log.Printf("[CSD] Certificado %d de %s revocado", id, strings.ToUpper(rfc))
+	return nil
+}
+
+// ActualizarEstadosCSD guarda el estado que corresponde a la vigencia de los certificados no revocados
+func ActualizarEstadosCSD(ahora time.Time) error {
+	momento := ahora.UTC().Format(formatoFechaCSD)
+	_, err := GetDB().Exec(
+		`UPDATE certificados_csd SET estado = CASE
+			WHEN valido_desde > ? THEN ?
+			WHEN valido_hasta <= ? THEN ?
+			ELSE ? END
+		WHERE estado <> ?`,
+		momento, CSDPendiente, momento, CSDVencido, CSDActivo, CSDRevocado,
+	)
+	if err != nil {
+		return fmt.Errorf("error al actualizar el estado de los certificados: %w", err)
+	}
+	return nil
+}
+
+// CertificadosPorVencer devuelve los certificados activos que vencen dentro de los próximos días
+// y que no tienen ya un reemplazo registrado que venza después
+func CertificadosPorVencer(ahora time.Time, dias int) ([]CertificadoCSD, error) {
+	momento := ahora.UTC().Format(formatoFechaCSD)
+	limite := ahora.UTC().AddDate(0, 0, dias).Format(formatoFechaCSD)
+	rows, err := GetDB().Query("SELECT "+columnasCertificadoCSD+` FROM certificados_csd c
+		WHERE c.estado <> ? AND c.valido_desde <= ? AND c.valido_hasta > ? AND c.valido_hasta <= ?
+		AND NOT EXISTS (SELECT 1 FROM certificados_csd n
+			WHERE n.rfc = c.rfc AND n.estado <> ? AND n.valido_hasta > c.valido_hasta)`,
+		CSDRevocado, momento, momento, limite, CSDRevocado)
+	if err != nil {
+		return nil, fmt.Errorf("error al buscar certificados por vencer: %w", err)
+	}
+	defer rows.Close()
+
+	var certificados []CertificadoCSD
+	for rows.Next() {
+		c, err := escanearCertificadoCSD(rows, ahora)
+		if err != nil {
+			return nil, fmt.Errorf("error al leer certificado: %w", err)
+		}
+		certificados = append(certificados, c)
+	}
+	return certificados, rows.Err()
+}
+
+// MarcarAvisoCSD anota el último aviso de vencimiento enviado (en días antes del vencimiento)
+func MarcarAvisoCSD(id int64, dias int) error {
+	if _, err := GetDB().Exec("UPDATE certificados_csd SET ultimo_aviso = ? WHERE id = ?", dias, id); err != nil {
+		return fmt.Errorf("error al registrar el aviso del certificado %d: %w", id, err)
+	}
+	return nil
+}
+
+// MigrarCertificadosCSD registra en certificados_csd el CSD de datos_fiscales de los emisores que aún no lo tienen
+func MigrarCertificadosCSD() error {
+	conn := GetDB()
+	// Los números de certificado se guardaban como el hexadecimal de los dígitos ASCII del número de serie
+	corregidos, err := conn.Exec(`UPDATE certificados_csd SET no_certificado = CAST(UNHEX(no_certificado) AS CHAR)
+		WHERE no_certificado REGEXP '^(3[0-9]){20}$'`)
+	if err != nil {
+		return fmt.Errorf("error al corregir los números de certificado: %w", err)
+	}
+	if n, _ := corregidos.RowsAffected(); n > 0 {
+		log.Printf("[CSD] %d número(s) de certificado corregidos", n)
+	}
+
+	rows, err := conn.Query(
+		`SELECT d.id_usuario, d.rfc, d.ruta_archivo_cer, d.ruta_archivo_key, d.clave_csd FROM datos_fiscales d
+		WHERE COALESCE(d.ruta_archivo_cer, '') <> '' AND COALESCE(d.ruta_archivo_key, '') <> '' AND COALESCE(d.clave_csd, '') <> ''
+		AND NOT EXISTS (SELECT 1 FROM certificados_csd c WHERE c.rfc = d.rfc)`)
+	if err != nil {
+		return fmt.Errorf("error al consultar datos fiscales: %w", err)
+	}
+	type pendiente struct {
+		usuarioID                    int
+		rfc, rutaCer, rutaKey, clave string
+	}
+	var pendientes []pendiente
+	for rows.Next() {
+		var p pendiente
+		if err := rows.Scan(&p.usuarioID, &p.rfc, &p.rutaCer, &p.rutaKey, &p.clave); err != nil {
+			rows.Close()
+			return fmt.Errorf("error al leer datos fiscales: %w", err)
+		}
+		pendientes = append(pendientes, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error al leer datos fiscales: %w", err)
+	}
+
+	registrados := 0
+	for _, p := range pendientes {
+		cer, err := os.ReadFile(p.rutaCer)
+		if err != nil {
+			log.Printf("[CSD] Usuario %d: no se pudo leer %s: %v", p.usuarioID, p.rutaCer, err)
+			continue
+		}
+		if _, err := registrarCertificadoCSD(conn, p.usuarioID, p.rfc, cer, p.rutaCer, p.rutaKey, p.clave); err != nil {
+			log.Printf("[CSD] Usuario %d: %v", p.usuarioID, err)
+			continue
+		}
+		registrados++
+	}
+	if registrados > 0 {
+		log.Printf("[CSD] %d certificado(s) de datos_fiscales registrados en certificados_csd", registrados)
+	}
+	return nil
+}
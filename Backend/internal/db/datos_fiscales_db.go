@@ -2,10 +2,14 @@ package db
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
 	"time"
 
+	"Facts/internal/secretos"
 	"Facts/internal/utils"
 )
 
@@ -46,16 +50,56 @@ func GuardarDatosFiscales(
 		return 0, fmt.Errorf("error al verificar datos existentes: %w", err)
 	}
 
+	// Validar el CSD antes de guardar: lo que no venga en la solicitud se toma de lo ya registrado
+	var guardado secretos.CSDGuardado
+	if exists {
+		var rfcActual, rutaKeyActual, rutaCerActual, claveActual sql.NullString
+		err = db.QueryRow("SELECT rfc, ruta_archivo_key, ruta_archivo_cer, clave_csd FROM datos_fiscales WHERE id_usuario = ?", usuarioID).Scan(&rfcActual, &rutaKeyActual, &rutaCerActual, &claveActual)
+		if err != nil {
+			return 0, fmt.Errorf("error al obtener el CSD registrado: %w", err)
+		}
+		guardado = secretos.CSDGuardado{RFC: rfcActual.String, RutaKey: rutaKeyActual.String, RutaCer: rutaCerActual.String, Clave: claveActual.String}
+	}
+	if secretos.CambiaCSD(archivoCSDKey, archivoCSDCer, claveCSD, rfc, guardado) {
+		if err = secretos.ValidarCSD(archivoCSDKey, archivoCSDCer, claveCSD, rfc, time.Now(), guardado); err != nil {
+			log.Printf("GuardarDatosFiscales: CSD rechazado para usuario %d: %v", usuarioID, err)
+			return 0, err
+		}
+	}
+
+	// La llave y la contraseña se sellan con el certificado con el que quedan: el que se sube o el registrado
+	var id secretos.IdentidadCSD
+	if len(archivoCSDCer) > 0 {
+		id, err = secretos.IdentidadCertificado(rfc, archivoCSDCer)
+	} else if guardado.RutaCer != "" {
+		id, err = secretos.IdentidadArchivoCertificado(rfc, guardado.RutaCer)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// La contraseña se guarda sellada; vacía conserva la registrada
+	claveSellada, err := secretos.CifrarClaveCSD(claveCSD, id)
+	if err != nil {
+		return 0, err
+	}
+
 	now := time.Now().Format("2006-01-02 15:04:05")
 	var idDatosFiscales int64
 
-	// Guardar archivos en disco y obtener rutas
+	// Guardar archivos en disco y obtener rutas. Cada certificado va en su propio directorio
+	// (por número de certificado) para conservar los anteriores; una .key sola va junto a su .cer.
 	var rutaKey, rutaCer string
 	baseDir := fmt.Sprintf("./certificados/%d", usuarioID)
+	if len(archivoCSDCer) > 0 {
+		baseDir = fmt.Sprintf("%s/%s", baseDir, id.NoCertificado)
+	} else if len(archivoCSDCer) == 0 && guardado.RutaCer != "" {
+		baseDir = filepath.Dir(guardado.RutaCer)
+	}
 	utils.CreateDirectory(baseDir)
 	if len(archivoCSDKey) > 0 {
 		rutaKey = fmt.Sprintf("%s/%s", baseDir, nombreArchivoKey)
-		err := utils.SaveFile(rutaKey, archivoCSDKey)
+		err := secretos.GuardarLlaveCSD(rutaKey, archivoCSDKey, id)
 		if err != nil {
 			return 0, fmt.Errorf("error al guardar archivo KEY en disco: %w", err)
 		}
@@ -80,12 +124,14 @@ func GuardarDatosFiscales(
 		query := `
 			UPDATE datos_fiscales 
 			SET rfc = ?, razon_social = ?, direccion_fiscal = ?, 
-				codigo_postal = ?, regimen_fiscal = ?, clave_csd = ?,
-				serie_df = ?, fecha_actualizacion = ?, ruta_archivo_key = ?, ruta_archivo_cer = ?
+				codigo_postal = ?, regimen_fiscal = ?, clave_csd = COALESCE(NULLIF(?, ''), clave_csd),
+				serie_df = ?, fecha_actualizacion = ?,
+				ruta_archivo_key = COALESCE(NULLIF(?, ''), ruta_archivo_key),
+				ruta_archivo_cer = COALESCE(NULLIF(?, ''), ruta_archivo_cer)
 			WHERE id_usuario = ?
 		`
 		_, err = tx.Exec(query, rfc, razonSocial, direccionFiscal, codigoPostal,
-			regimenFiscal, claveCSD, serieDf, now, rutaKey, rutaCer, usuarioID)
+			regimenFiscal, claveSellada, serieDf, now, rutaKey, rutaCer, usuarioID)
 		if err != nil {
 			return 0, fmt.Errorf("error al actualizar datos básicos: %w", err)
 		}
@@ -101,7 +147,7 @@ func GuardarDatosFiscales(
 		`
 		result, err := tx.Exec(query,
 			usuarioID, rfc, razonSocial, direccionFiscal,
-			codigoPostal, regimenFiscal, claveCSD, serieDf,
+			codigoPostal, regimenFiscal, claveSellada, serieDf,
 			rutaKey, rutaCer,
 			now, now)
 		if err != nil {
@@ -113,6 +159,14 @@ func GuardarDatosFiscales(
 		}
 	}
 
+	// Registrar el CSD en el historial de certificados del emisor
+	if len(archivoCSDKey) > 0 || len(archivoCSDCer) > 0 || claveSellada != "" {
+		if err = registrarCSDDatosFiscales(tx, usuarioID, rfc, archivoCSDCer, guardado,
+			secretos.CSDGuardado{RutaKey: rutaKey, RutaCer: rutaCer, Clave: claveSellada}); err != nil {
+			return 0, err
+		}
+	}
+
 	// Actualiza el campo id_datos_fiscales en la tabla usuarios
 	_, err = tx.Exec("UPDATE usuarios SET id_datos_fiscales = ? WHERE id = ?", idDatosFiscales, usuarioID)
 	if err != nil {
@@ -127,6 +181,35 @@ func GuardarDatosFiscales(
 	return int(idDatosFiscales), nil
 }
 
+// registrarCSDDatosFiscales registra en certificados_csd el CSD que quedó en datos_fiscales,
+// completando lo que no se subió con lo que ya estaba guardado
+func registrarCSDDatosFiscales(tx *sql.Tx, usuarioID int, rfc string, cer []byte, anterior, nuevo secretos.CSDGuardado) error {
+	if nuevo.RutaCer == "" {
+		nuevo.RutaCer = anterior.RutaCer
+	}
+	if nuevo.RutaKey == "" {
+		nuevo.RutaKey = anterior.RutaKey
+	}
+	if nuevo.Clave == "" {
+		nuevo.Clave = anterior.Clave
+	}
+	if nuevo.RutaCer == "" || nuevo.RutaKey == "" || nuevo.Clave == "" {
+		return nil
+	}
+	if len(cer) == 0 {
+		var err error
+		if cer, err = os.ReadFile(nuevo.RutaCer); err != nil {
+			return fmt.Errorf("no se pudo leer el archivo .cer en %s: %w", nuevo.RutaCer, err)
+		}
+	}
+	noCertificado, err := registrarCertificadoCSD(tx, usuarioID, rfc, cer, nuevo.RutaCer, nuevo.RutaKey, nuevo.Clave)
+	if err != nil {
+		return err
+	}
+	log.Printf("[CSD] Certificado %s de datos fiscales registrado para el usuario %d", noCertificado, usuarioID)
+	return nil
+}
+
 // ObtenerDatosFiscales obtiene los datos fiscales de un usuario
 func ObtenerDatosFiscales(userID int) (map[string]interface{}, error) {
 	db, err := ConnectUserDB()
@@ -136,7 +219,7 @@ func ObtenerDatosFiscales(userID int) (map[string]interface{}, error) {
 	defer db.Close()
 
 	query := `
-	SELECT archivo_cer, archivo_key, archivo_cer_pem, archivo_key_pem, id, rfc, razon_social, direccion_fiscal, direccion, colonia, 
+	SELECT archivo_cer, archivo_key, archivo_cer_pem, id, rfc, razon_social, direccion_fiscal, direccion, colonia, 
 		   codigo_postal, ciudad, estado, regimen_fiscal, clave_csd, 
 		   serie_df, ruta_archivo_key, ruta_archivo_cer
 	FROM datos_fiscales
@@ -144,7 +227,7 @@ func ObtenerDatosFiscales(userID int) (map[string]interface{}, error) {
 `
 
 	var archivoCer, archivoKey []byte
-	var archivoCerPEM, archivoKeyPEM sql.NullString
+	var archivoCerPEM sql.NullString
 	var id int
 	var rfc, razonSocial string
 	var direccionFiscal, direccion, colonia, codigoPostal, ciudad, estado, regimenFiscal sql.NullString
@@ -152,7 +235,7 @@ func ObtenerDatosFiscales(userID int) (map[string]interface{}, error) {
 	var rutaArchivoKey, rutaArchivoCer sql.NullString
 
 	err = db.QueryRow(query, userID).Scan(
-		&archivoCer, &archivoKey, &archivoCerPEM, &archivoKeyPEM, &id, &rfc, &razonSocial, &direccionFiscal, &direccion, &colonia,
+		&archivoCer, &archivoKey, &archivoCerPEM, &id, &rfc, &razonSocial, &direccionFiscal, &direccion, &colonia,
 		&codigoPostal, &ciudad, &estado, &regimenFiscal, &claveCSD, &serieDf,
 		&rutaArchivoKey, &rutaArchivoCer,
 	)
@@ -164,21 +247,17 @@ func ObtenerDatosFiscales(userID int) (map[string]interface{}, error) {
 		return nil, fmt.Errorf("error al obtener datos fiscales: %w", err)
 	}
 
+	// La llave privada nunca sale de aquí; solo se informa si existe
 	datos := map[string]interface{}{
 		"id":              id,
 		"rfc":             rfc,
 		"razon_social":    razonSocial,
 		"archivo_cer":     archivoCer,
-		"archivo_key":     archivoKey,
 		"archivo_cer_pem": "",
-		"archivo_key_pem": "",
 	}
 	if archivoCerPEM.Valid {
 		datos["archivo_cer_pem"] = archivoCerPEM.String
 	}
-	if archivoKeyPEM.Valid {
-		datos["archivo_key_pem"] = archivoKeyPEM.String
-	}
 
 	if direccionFiscal.Valid {
 		datos["direccion_fiscal"] = direccionFiscal.String
@@ -215,6 +294,7 @@ func ObtenerDatosFiscales(userID int) (map[string]interface{}, error) {
 	} else {
 		datos["regimen_fiscal"] = ""
 	}
+	// clave_csd va sellada: solo sirve para firmar a través del paquete secretos
 	if claveCSD.Valid {
 		datos["clave_csd"] = claveCSD.String
 	}
@@ -244,26 +324,215 @@ func ObtenerDatosFiscales(userID int) (map[string]interface{}, error) {
 	return datos, nil
 }
 
-// ObtenerCertificadosCSD obtiene los archivos binarios de certificados directamente de la base de datos
-func ObtenerCertificadosCSD(userID int) ([]byte, []byte, error) {
+// ObtenerCertificadoCSD obtiene el certificado (.cer) del CSD directamente de la base de datos.
+// La llave privada no se expone: solo se usa sellada a través del paquete secretos.
+func ObtenerCertificadoCSD(userID int) ([]byte, error) {
 	db, err := ConnectUserDB()
 	if err != nil {
-		return nil, nil, fmt.Errorf("error al conectar a la base de datos: %w", err)
+		return nil, fmt.Errorf("error al conectar a la base de datos: %w", err)
 	}
 	defer db.Close()
 
-	var keyData, cerData []byte
+	var cerData []byte
 	err = db.QueryRow(
-		"SELECT archivo_key, archivo_cer FROM datos_fiscales WHERE id_usuario = ?",
+		"SELECT archivo_cer FROM datos_fiscales WHERE id_usuario = ?",
 		userID,
-	).Scan(&keyData, &cerData)
+	).Scan(&cerData)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, nil, fmt.Errorf("no se encontraron certificados para el usuario")
+			return nil, fmt.Errorf("no se encontraron certificados para el usuario")
+		}
+		return nil, fmt.Errorf("error al obtener certificados: %w", err)
+	}
+
+	return cerData, nil
+}
+
+// RecifrarSecretosCSD sella la contraseña y la llave privada que sigan en claro en datos_fiscales
+// y en ./certificados, vuelve a sellar ligados a su emisor y certificado los sobres que no lo estén
+// y reenvuelve con la llave maestra activa los sobres de llaves anteriores
+func RecifrarSecretosCSD() error {
+	conn := GetDB()
+	rows, err := conn.Query("SELECT id, rfc, clave_csd, ruta_archivo_key, ruta_archivo_cer, archivo_key, archivo_key_pem, archivo_cer FROM datos_fiscales")
+	if err != nil {
+		return fmt.Errorf("error al consultar datos fiscales: %w", err)
+	}
+	type registro struct {
+		id                                int
+		rfc, clave, rutaKey, rutaCer, pem sql.NullString
+		archivoKey, archivoCer            []byte
+	}
+	var registros []registro
+	for rows.Next() {
+		var r registro
+		if err := rows.Scan(&r.id, &r.rfc, &r.clave, &r.rutaKey, &r.rutaCer, &r.archivoKey, &r.pem, &r.archivoCer); err != nil {
+			rows.Close()
+			return fmt.Errorf("error al leer datos fiscales: %w", err)
 		}
-		return nil, nil, fmt.Errorf("error al obtener certificados: %w", err)
+		registros = append(registros, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error al leer datos fiscales: %w", err)
 	}
 
-	return keyData, cerData, nil
+	actualizados, archivos := 0, 0
+	for _, r := range registros {
+		// Sin certificado no hay identidad con la cual sellar; los sobres anteriores se siguen abriendo
+		var id secretos.IdentidadCSD
+		if len(r.archivoCer) > 0 {
+			id, err = secretos.IdentidadCertificado(r.rfc.String, r.archivoCer)
+		} else if r.rutaCer.String != "" {
+			id, err = secretos.IdentidadArchivoCertificado(r.rfc.String, r.rutaCer.String)
+		} else {
+			err = errors.New("no tiene certificado registrado")
+		}
+		if err != nil {
+			log.Printf("[SECRETOS] datos fiscales %d: no se recifra el CSD: %v", r.id, err)
+			continue
+		}
+
+		clave, cambioClave, err := secretos.RecifrarClaveCSD(r.clave.String, id)
+		if err != nil {
+			return fmt.Errorf("datos fiscales %d: %w", r.id, err)
+		}
+		archivoKey, cambioKey, err := secretos.RecifrarLlaveCSD(r.archivoKey, id)
+		if err != nil {
+			return fmt.Errorf("datos fiscales %d: %w", r.id, err)
+		}
+		pem, cambioPEM, err := secretos.RecifrarLlaveCSD([]byte(r.pem.String), id)
+		if err != nil {
+			return fmt.Errorf("datos fiscales %d: %w", r.id, err)
+		}
+		if cambioClave || cambioKey || cambioPEM {
+			_, err := conn.Exec("UPDATE datos_fiscales SET clave_csd = ?, archivo_key = ?, archivo_key_pem = ? WHERE id = ?",
+				nullSiVacio(clave, r.clave.Valid), archivoKey, nullSiVacio(string(pem), r.pem.Valid), r.id)
+			if err != nil {
+				return fmt.Errorf("error al recifrar datos fiscales %d: %w", r.id, err)
+			}
+			actualizados++
+		}
+
+		if r.rutaKey.String == "" {
+			continue
+		}
+		cambio, err := secretos.RecifrarArchivoCSD(r.rutaKey.String, id)
+		if errors.Is(err, os.ErrNotExist) {
+			log.Printf("[SECRETOS] datos fiscales %d: no existe el archivo %s", r.id, r.rutaKey.String)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("datos fiscales %d: %w", r.id, err)
+		}
+		if cambio {
+			archivos++
+		}
+	}
+
+	// Los certificados adicionales del emisor guardan su propia contraseña y su .key
+	pendientes, err := certificadosARecifrar(conn)
+	if err != nil {
+		return err
+	}
+	certificados, err := recifrarCertificadosCSD(conn, pendientes)
+	if err != nil {
+		return err
+	}
+	log.Printf("[SECRETOS] Recifrado de CSD: %d registro(s), %d certificado(s) y %d archivo(s) .key actualizados",
+		actualizados, certificados, archivos+recifrarArchivosCertificados(pendientes))
+	return nil
+}
+
+// certificadoARecifrar es un renglón de certificados_csd con la identidad de sus secretos
+type certificadoARecifrar struct {
+	id             int64
+	clave, rutaKey string
+	identidad      secretos.IdentidadCSD
+}
+
+// certificadosARecifrar lee certificados_csd; la identidad se toma del .cer para no depender del
+// número guardado en la tabla. Los que no tienen .cer legible solo se registran en el log.
+func certificadosARecifrar(conn *sql.DB) ([]certificadoARecifrar, error) {
+	rows, err := conn.Query("SELECT id, rfc, clave_csd, ruta_archivo_cer, ruta_archivo_key FROM certificados_csd")
+	if err != nil {
+		return nil, fmt.Errorf("error al consultar certificados: %w", err)
+	}
+	type renglon struct {
+		certificadoARecifrar
+		rfc, rutaCer string
+	}
+	var renglones []renglon
+	for rows.Next() {
+		var r renglon
+		if err := rows.Scan(&r.id, &r.rfc, &r.clave, &r.rutaCer, &r.rutaKey); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error al leer certificados: %w", err)
+		}
+		renglones = append(renglones, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error al leer certificados: %w", err)
+	}
+
+	var certificados []certificadoARecifrar
+	for _, r := range renglones {
+		id, err := secretos.IdentidadArchivoCertificado(r.rfc, r.rutaCer)
+		if err != nil {
+			log.Printf("[SECRETOS] certificado %d: no se recifra el CSD: %v", r.id, err)
+			continue
+		}
+		r.identidad = id
+		certificados = append(certificados, r.certificadoARecifrar)
+	}
+	return certificados, nil
+}
+
+// recifrarCertificadosCSD recifra las contraseñas de certificados_csd
+func recifrarCertificadosCSD(conn *sql.DB, certificados []certificadoARecifrar) (int, error) {
+	actualizados := 0
+	for _, c := range certificados {
+		nueva, cambio, err := secretos.RecifrarClaveCSD(c.clave, c.identidad)
+		if err != nil {
+			return 0, fmt.Errorf("certificado %d: %w", c.id, err)
+		}
+		if !cambio {
+			continue
+		}
+		if _, err := conn.Exec("UPDATE certificados_csd SET clave_csd = ? WHERE id = ?", nueva, c.id); err != nil {
+			return 0, fmt.Errorf("error al recifrar certificado %d: %w", c.id, err)
+		}
+		actualizados++
+	}
+	return actualizados, nil
+}
+
+// recifrarArchivosCertificados recifra los .key de certificados_csd; los que fallan solo se registran en el log
+func recifrarArchivosCertificados(certificados []certificadoARecifrar) int {
+	archivos := 0
+	recifrados := map[string]bool{}
+	for _, c := range certificados {
+		if c.rutaKey == "" || recifrados[c.rutaKey] {
+			continue
+		}
+		recifrados[c.rutaKey] = true
+		cambio, err := secretos.RecifrarArchivoCSD(c.rutaKey, c.identidad)
+		if err != nil {
+			log.Printf("[SECRETOS] %v", err)
+			continue
+		}
+		if cambio {
+			archivos++
+		}
+	}
+	return archivos
+}
+
+// nullSiVacio conserva el NULL original de una columna de texto
+func nullSiVacio(valor string, valido bool) interface{} {
+	if valor == "" && !valido {
+		return nil
+	}
+	return valor
 }
@@ -0,0 +1,496 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// migraciones contiene las tablas auxiliares que el backend necesita y que no forman parte del esquema original
+var migraciones = []struct {
+	nombre string
+	sql    string
+}{
+	{
+		nombre: "cfdi_relacionados",
+		sql: `CREATE TABLE IF NOT EXISTS cfdi_relacionados (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			id_historial_origen INT NOT NULL,
+			id_historial_relacionado INT NOT NULL,
+			uuid_origen VARCHAR(36) NOT NULL,
+			tipo_comprobante CHAR(1) NOT NULL DEFAULT 'E',
+			tipo_relacion VARCHAR(2) NOT NULL,
+			monto DECIMAL(18,2) NOT NULL DEFAULT 0,
+			fecha_creacion DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			INDEX idx_cfdi_relacionados_origen (id_historial_origen),
+			INDEX idx_cfdi_relacionados_relacionado (id_historial_relacionado)
+		)`,
+	},
+	{
+		nombre: "facturas_globales",
+		sql: `CREATE TABLE IF NOT EXISTS facturas_globales (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			id_usuario INT NOT NULL,
+			id_historial INT NOT NULL,
+			uuid VARCHAR(36) NOT NULL,
+			periodicidad VARCHAR(2) NOT NULL,
+			meses VARCHAR(2) NOT NULL,
+			anio SMALLINT NOT NULL,
+			fecha_inicio DATE NOT NULL,
+			fecha_fin DATE NOT NULL,
+			total DECIMAL(18,2) NOT NULL DEFAULT 0,
+			fecha_creacion DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE KEY uk_facturas_globales_periodo (id_usuario, periodicidad, meses, anio, fecha_inicio)
+		)`,
+	},
+	{
+		nombre: "tickets_factura_global",
+		sql: `CREATE TABLE IF NOT EXISTS tickets_factura_global (
+			clave_ticket VARCHAR(100) PRIMARY KEY,
+			id_factura_global INT NOT NULL,
+			fecha_creacion DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			INDEX idx_tickets_factura_global_factura (id_factura_global)
+		)`,
+	},
+	{
+		nombre: "timbrados",
+		sql: `CREATE TABLE IF NOT EXISTS timbrados (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			rfc_emisor VARCHAR(13) NOT NULL,
+			serie VARCHAR(25) NOT NULL DEFAULT '',
+			folio VARCHAR(40) NOT NULL,
+			hash_xml CHAR(64) NOT NULL,
+			xml_firmado MEDIUMTEXT NOT NULL,
+			estado VARCHAR(10) NOT NULL DEFAULT 'pendiente',
+			uuid VARCHAR(36) NULL,
+			xml_timbrado MEDIUMTEXT NULL,
+			intentos_fallidos INT NOT NULL DEFAULT 0,
+			ultimo_error TEXT NULL,
+			fecha_creacion DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			fecha_actualizacion DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+			UNIQUE KEY uk_timbrados_comprobante (rfc_emisor, serie, folio)
+		)`,
+	},
+	{
+		nombre: "trabajos_factura",
+		sql: `CREATE TABLE IF NOT EXISTS trabajos_factura (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			id_usuario INT NOT NULL,
+			numero_folio VARCHAR(40) NOT NULL DEFAULT '',
+			estatus CHAR(1) NOT NULL DEFAULT 'P',
+			datos MEDIUMTEXT NOT NULL,
+			plantilla MEDIUMBLOB NULL,
+			intentos INT NOT NULL DEFAULT 0,
+			log_error TEXT NULL,
+			uuid VARCHAR(36) NULL,
+			xml MEDIUMTEXT NULL,
+			pdf MEDIUMBLOB NULL,
+			proximo_intento DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			bloqueado_hasta DATETIME NULL,
+			fecha_creacion DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			fecha_actualizacion DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+			INDEX idx_trabajos_factura_cola (estatus, proximo_intento)
+		)`,
+	},
+	{
+		nombre: "trabajos_factura_eventos",
+		sql: `CREATE TABLE IF NOT EXISTS trabajos_factura_eventos (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			id_trabajo INT NOT NULL,
+			estatus CHAR(1) NOT NULL,
+			mensaje TEXT NULL,
+			fecha DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			INDEX idx_trabajos_factura_eventos_trabajo (id_trabajo)
+		)`,
+	},
+	{
+		nombre: "cancelaciones",
+		sql: `CREATE TABLE IF NOT EXISTS cancelaciones (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			id_historial INT NOT NULL,
+			id_usuario INT NOT NULL,
+			uuid VARCHAR(36) NOT NULL,
+			rfc_emisor VARCHAR(13) NOT NULL,
+			rfc_receptor VARCHAR(13) NOT NULL,
+			total DECIMAL(18,2) NOT NULL DEFAULT 0,
+			motivo VARCHAR(2) NOT NULL,
+			folio_sustitucion VARCHAR(36) NULL,
+			id_historial_sustitucion INT NULL,
+			estado VARCHAR(15) NOT NULL,
+			codigo_estatus VARCHAR(100) NULL,
+			estatus_sat VARCHAR(100) NULL,
+			acuse MEDIUMTEXT NULL,
+			fecha_solicitud DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			fecha_actualizacion DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+			INDEX idx_cancelaciones_historial (id_historial),
+			INDEX idx_cancelaciones_estado (estado)
+		)`,
+	},
+	{
+		nombre: "marca_emisor",
+		sql: `CREATE TABLE IF NOT EXISTS marca_emisor (
+			rfc_emisor VARCHAR(13) PRIMARY KEY,
+			tema VARCHAR(20) NOT NULL DEFAULT '',
+			color_primario VARCHAR(7) NOT NULL DEFAULT '',
+			color_secundario VARCHAR(7) NOT NULL DEFAULT '',
+			fuente VARCHAR(20) NOT NULL DEFAULT '',
+			fecha_actualizacion DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+		)`,
+	},
+	{
+		// Vigencias en UTC; la llave y la contraseña van selladas por el paquete secretos
+		nombre: "certificados_csd",
+		sql: `CREATE TABLE IF NOT EXISTS certificados_csd (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			id_usuario INT NOT NULL,
+			rfc VARCHAR(13) NOT NULL,
+			no_certificado VARCHAR(40) NOT NULL,
+			ruta_archivo_cer VARCHAR(255) NOT NULL,
+			ruta_archivo_key VARCHAR(255) NOT NULL,
+			clave_csd VARCHAR(512) NOT NULL,
+			valido_desde DATETIME NOT NULL,
+			valido_hasta DATETIME NOT NULL,
+			estado VARCHAR(10) NOT NULL DEFAULT 'activo',
+			ultimo_aviso SMALLINT NOT NULL DEFAULT 0,
+			fecha_creacion DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			fecha_actualizacion DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+			UNIQUE KEY uk_certificados_csd_numero (rfc, no_certificado),
+			INDEX idx_certificados_csd_vigencia (rfc, estado, valido_hasta)
+		)`,
+	},
+	{
+		// Series de folios por emisor; tipo_comprobante y sucursal vacíos aplican a todos
+		nombre: "folio_control",
+		sql: `CREATE TABLE IF NOT EXISTS folio_control (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			rfc_emisor VARCHAR(13) NOT NULL DEFAULT '',
+			serie VARCHAR(25) NOT NULL,
+			tipo_comprobante CHAR(1) NOT NULL DEFAULT '',
+			sucursal VARCHAR(50) NOT NULL DEFAULT '',
+			prefijo VARCHAR(10) NOT NULL DEFAULT '',
+			relleno TINYINT NOT NULL DEFAULT 0,
+			descripcion VARCHAR(100) NOT NULL DEFAULT '',
+			ultimo_folio BIGINT NOT NULL DEFAULT 0,
+			empresa_id INT NOT NULL DEFAULT 0,
+			activo TINYINT(1) NOT NULL DEFAULT 1,
+			fecha_creacion DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			fecha_actualizacion DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+			UNIQUE KEY uk_folio_control_serie (rfc_emisor, serie)
+		)`,
+	},
+	{
+		// Cada número que sale de una serie: reservado hasta que se registra el comprobante,
+		// usado, o anulado si no se emitió y ya no se pudo regresar
+		nombre: "folios_reservados",
+		sql: `CREATE TABLE IF NOT EXISTS folios_reservados (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			id_serie INT NOT NULL,
+			rfc_emisor VARCHAR(13) NOT NULL,
+			serie VARCHAR(25) NOT NULL,
+			numero BIGINT NOT NULL,
+			folio VARCHAR(40) NOT NULL,
+			estado VARCHAR(10) NOT NULL DEFAULT 'reservado',
+			id_historial INT NULL,
+			motivo VARCHAR(255) NULL,
+			fecha_creacion DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			fecha_actualizacion DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+			UNIQUE KEY uk_folios_reservados_numero (id_serie, numero),
+			INDEX idx_folios_reservados_folio (rfc_emisor, serie, folio)
+		)`,
+	},
+	{
+		// Retenciones y c_ObjetoImp de cada impuesto de optimus (crm_impuestos), que no se modifica
+		nombre: "impuestos_config",
+		sql: `CREATE TABLE IF NOT EXISTS impuestos_config (
+			idempresa INT NOT NULL,
+			idiva INT NOT NULL,
+			ret_isr DECIMAL(9,6) NOT NULL DEFAULT 0,
+			ret_iva DECIMAL(9,6) NOT NULL DEFAULT 0,
+			objeto_imp VARCHAR(2) NOT NULL DEFAULT '02',
+			fecha_actualizacion DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+			PRIMARY KEY (idempresa, idiva)
+		)`,
+	},
+	{
+		// Tickets que se están facturando; la llave primaria impide que dos solicitudes, aunque
+		// lleguen a instancias distintas o de usuarios distintos, facturen el mismo ticket del emisor
+		nombre: "tickets_apartados",
+		sql:    sqlTicketsApartados,
+	},
+}
+
+const sqlTicketsApartados = `CREATE TABLE IF NOT EXISTS tickets_apartados (
+			rfc_emisor VARCHAR(13) NOT NULL,
+			clave_ticket VARCHAR(100) NOT NULL,
+			fecha_apartado DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (rfc_emisor, clave_ticket)
+		)`
+
+// EjecutarMigraciones crea las tablas auxiliares si no existen y agrega las columnas faltantes
+func EjecutarMigraciones() error {
+	conn := GetDB()
+	for _, m := range migraciones {
+		if _, err := conn.Exec(m.sql); err != nil {
+			return fmt.Errorf("error en migración %s: %w", m.nombre, err)
+		}
+	}
+	log.Printf("Migraciones aplicadas: %d", len(migraciones))
+	if err := agregarColumnas(conn, columnasUsuario); err != nil {
+		return err
+	}
+	if err := migrarFolioControl(conn); err != nil {
+		return err
+	}
+	if err := migrarTicketsApartados(conn); err != nil {
+		return err
+	}
+	return ampliarColumnas(conn, columnasAmpliadas)
+}
+
+// migrarTicketsApartados cambia la tabla anterior, apartada por id_usuario, a la apartada por emisor.
+// Los apartados solo duran mientras se factura el ticket, así que la tabla se vuelve a crear vacía.
+func migrarTicketsApartados(conn *sql.DB) error {
+	anterior, err := existeColumna(conn, "tickets_apartados", "id_usuario")
+	if err != nil || !anterior {
+		return err
+	}
+	if _, err := conn.Exec("DROP TABLE tickets_apartados"); err != nil {
+		return fmt.Errorf("error al quitar la tabla tickets_apartados anterior: %w", err)
+	}
+	if _, err := conn.Exec(sqlTicketsApartados); err != nil {
+		return fmt.Errorf("error en migración tickets_apartados: %w", err)
+	}
+	log.Printf("Tabla tickets_apartados apartada por emisor")
+	return nil
+}
+
+// migrarFolioControl completa la tabla folio_control anterior: le agrega el id, asigna a cada serie
+// el RFC de la empresa (datos_fiscales) para que siga su numeración y agrega la llave única por emisor
+func migrarFolioControl(conn *sql.DB) error {
+	existe, err := existeColumna(conn, "folio_control", "id")
+	if err != nil {
+		return err
+	}
+	if !existe {
+		// La llave primaria anterior, si la hay, se reemplaza por el id
+		var primarias int
+		err := conn.QueryRow(
+			`SELECT COUNT(*) FROM information_schema.TABLE_CONSTRAINTS
+			WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'folio_control' AND CONSTRAINT_TYPE = 'PRIMARY KEY'`,
+		).Scan(&primarias)
+		if err != nil {
+			return fmt.Errorf("error al revisar la llave primaria de folio_control: %w", err)
+		}
+		alter := "ALTER TABLE folio_control ADD COLUMN id INT AUTO_INCREMENT PRIMARY KEY FIRST"
+		if primarias > 0 {
+			alter = "ALTER TABLE folio_control DROP PRIMARY KEY, ADD COLUMN id INT AUTO_INCREMENT PRIMARY KEY FIRST"
+		}
+		if _, err := conn.Exec(alter); err != nil {
+			return fmt.Errorf("error al agregar columna folio_control.id: %w", err)
+		}
+		log.Printf("Columna folio_control.id agregada")
+	}
+
+	// Las series anteriores formaban el folio como serie + número sin relleno
+	res, err := conn.Exec(
+		`UPDATE folio_control f
+		JOIN datos_fiscales d ON d.id = f.empresa_id
+		SET f.rfc_emisor = UPPER(TRIM(d.rfc)), f.prefijo = IF(f.prefijo = '', LEFT(f.serie, 10), f.prefijo)
+		WHERE f.rfc_emisor = '' AND f.empresa_id > 0 AND COALESCE(d.rfc, '') <> ''`,
+	)
+	if err != nil {
+		return fmt.Errorf("error al asignar el emisor de las series de folio_control: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("Series de folio_control asignadas a su emisor: %d", n)
+	}
+	var huerfanas int
+	if err := conn.QueryRow("SELECT COUNT(*) FROM folio_control WHERE rfc_emisor = ''").Scan(&huerfanas); err != nil {
+		return fmt.Errorf("error al revisar las series de folio_control: %w", err)
+	}
+	if huerfanas > 0 {
+		log.Printf("[FOLIOS] %d series de folio_control no tienen emisor (empresa_id sin datos fiscales); no se usarán", huerfanas)
+	}
+
+	// Las llaves anteriores solo se quitan cuando ya está la llave por emisor
+	creada, err := agregarLlaveUnica(conn, "folio_control", "uk_folio_control_serie", "rfc_emisor, serie")
+	if err != nil || !creada {
+		return err
+	}
+	return quitarLlavesUnicasSinEmisor(conn)
+}
+
+// quitarLlavesUnicasSinEmisor elimina las llaves únicas anteriores de folio_control que no incluyen
+// rfc_emisor (como serie + empresa_id): impedirían que dos emisores tengan la misma serie
+func quitarLlavesUnicasSinEmisor(conn *sql.DB) error {
+	rows, err := conn.Query(
+		`SELECT INDEX_NAME FROM information_schema.STATISTICS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'folio_control' AND NON_UNIQUE = 0
+			AND INDEX_NAME NOT IN ('PRIMARY', 'uk_folio_control_serie')
+		GROUP BY INDEX_NAME
+		HAVING SUM(COLUMN_NAME = 'rfc_emisor') = 0`,
+	)
+	if err != nil {
+		return fmt.Errorf("error al revisar los índices de folio_control: %w", err)
+	}
+	var indices []string
+	for rows.Next() {
+		var indice string
+		if err := rows.Scan(&indice); err != nil {
+			rows.Close()
+			return err
+		}
+		indices = append(indices, indice)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, indice := range indices {
+		if _, err := conn.Exec("ALTER TABLE folio_control DROP INDEX `" + indice + "`"); err != nil {
+			return fmt.Errorf("error al quitar el índice %s de folio_control: %w", indice, err)
+		}
+		log.Printf("Índice folio_control.%s quitado (no incluye rfc_emisor)", indice)
+	}
+	return nil
+}
+
+// agregarLlaveUnica crea el índice único si no existe y devuelve si quedó creado. Si hay filas
+// repetidas no se puede crear: se informa y se vuelve a intentar en el siguiente arranque.
+func agregarLlaveUnica(conn *sql.DB, tabla, indice, columnas string) (bool, error) {
+	var existe int
+	err := conn.QueryRow(
+		`SELECT COUNT(*) FROM information_schema.STATISTICS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND INDEX_NAME = ?`,
+		tabla, indice,
+	).Scan(&existe)
+	if err != nil {
+		return false, fmt.Errorf("error al revisar el índice %s: %w", indice, err)
+	}
+	if existe > 0 {
+		return true, nil
+	}
+	var repetidas int
+	err = conn.QueryRow(fmt.Sprintf(
+		"SELECT COUNT(*) FROM (SELECT 1 FROM %s GROUP BY %s HAVING COUNT(*) > 1) r", tabla, columnas,
+	)).Scan(&repetidas)
+	if err != nil {
+		return false, fmt.Errorf("error al revisar duplicados para %s: %w", indice, err)
+	}
+	if repetidas > 0 {
+		log.Printf("[MIGRACIONES] No se creó %s: hay %d combinaciones (%s) repetidas en %s", indice, repetidas, columnas, tabla)
+		return false, nil
+	}
+	if _, err := conn.Exec(fmt.Sprintf("ALTER TABLE %s ADD UNIQUE KEY %s (%s)", tabla, indice, columnas)); err != nil {
+		return false, fmt.Errorf("error al crear el índice %s: %w", indice, err)
+	}
+	log.Printf("Índice %s.%s creado", tabla, indice)
+	return true, nil
+}
+
+// columnaMigracion es una columna que el backend agrega a una tabla existente
+type columnaMigracion struct {
+	tabla      string
+	columna    string
+	definicion string
+}
+
+// columnasUsuario son columnas que el backend agrega a tablas existentes de la base Usuario
+var columnasUsuario = []columnaMigracion{
+	{"datos_fiscales", "pac_proveedor", "VARCHAR(50) NULL"},
+	{"datos_fiscales", "pac_usuario", "VARCHAR(100) NULL"},
+	{"datos_fiscales", "pac_contrasena", "VARCHAR(255) NULL"},
+	{"datos_fiscales", "pac_produccion", "TINYINT(1) NOT NULL DEFAULT 0"},
+	// Plazo de autofacturación: mes (con días de gracia), dias o libre
+	{"datos_fiscales", "autofactura_ventana", "VARCHAR(5) NOT NULL DEFAULT 'mes'"},
+	{"datos_fiscales", "autofactura_dias", "INT NOT NULL DEFAULT 0"},
+	{"historial_facturas", "uuid", "VARCHAR(36) NULL"},
+	{"historial_facturas", "xml_sha256", "CHAR(64) NULL"},
+	{"historial_facturas", "xml_clave", "VARCHAR(255) NULL"},
+	{"historial_facturas", "no_certificado", "VARCHAR(40) NULL"},
+	{"historial_facturas", "rfc_emisor", "VARCHAR(13) NULL"},
+	{"historial_facturas", "serie", "VARCHAR(25) NULL"},
+	// folio_control existía antes con solo serie, ultimo_folio y empresa_id; el id y la llave única
+	// por emisor los agrega migrarFolioControl
+	{"folio_control", "rfc_emisor", "VARCHAR(13) NOT NULL DEFAULT ''"},
+	{"folio_control", "tipo_comprobante", "CHAR(1) NOT NULL DEFAULT ''"},
+	{"folio_control", "sucursal", "VARCHAR(50) NOT NULL DEFAULT ''"},
+	{"folio_control", "prefijo", "VARCHAR(10) NOT NULL DEFAULT ''"},
+	{"folio_control", "relleno", "TINYINT NOT NULL DEFAULT 0"},
+	{"folio_control", "descripcion", "VARCHAR(100) NOT NULL DEFAULT ''"},
+	{"folio_control", "activo", "TINYINT(1) NOT NULL DEFAULT 1"},
+	{"trabajos_factura", "clave_ticket", "VARCHAR(100) NOT NULL DEFAULT ''"},
+}
+
+// columnasAmpliadas son columnas VARCHAR existentes que necesitan más espacio; la definición
+// se aplica solo si la longitud actual es menor
+var columnasAmpliadas = []columnaAmpliada{
+	// clave_csd guarda la contraseña sellada por el paquete secretos
+	{columnaMigracion{"datos_fiscales", "clave_csd", "VARCHAR(512) NULL"}, 512},
+	// pac_contrasena también se guarda sellada
+	{columnaMigracion{"datos_fiscales", "pac_contrasena", "VARCHAR(512) NULL"}, 512},
+}
+
+// columnaAmpliada es una columna VARCHAR con la longitud mínima que necesita el backend
+type columnaAmpliada struct {
+	columnaMigracion
+	longitud int
+}
+
+// agregarColumnas agrega las columnas que no existan (MySQL no soporta ADD COLUMN IF NOT EXISTS)
+func agregarColumnas(conn *sql.DB, columnas []columnaMigracion) error {
+	for _, c := range columnas {
+		existe, err := existeColumna(conn, c.tabla, c.columna)
+		if err != nil {
+			return err
+		}
+		if existe {
+			continue
+		}
+		if _, err := conn.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", c.tabla, c.columna, c.definicion)); err != nil {
+			return fmt.Errorf("error al agregar columna %s.%s: %w", c.tabla, c.columna, err)
+		}
+		log.Printf("Columna %s.%s agregada", c.tabla, c.columna)
+	}
+	return nil
+}
+
+// existeColumna indica si la tabla ya tiene la columna
+func existeColumna(conn *sql.DB, tabla, columna string) (bool, error) {
+	var existe int
+	err := conn.QueryRow(
+		`SELECT COUNT(*) FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?`,
+		tabla, columna,
+	).Scan(&existe)
+	if err != nil {
+		return false, fmt.Errorf("error al revisar columna %s.%s: %w", tabla, columna, err)
+	}
+	return existe > 0, nil
+}
+
+// ampliarColumnas agranda las columnas cuya longitud sea menor a la requerida
+func ampliarColumnas(conn *sql.DB, columnas []columnaAmpliada) error {
+	for _, c := range columnas {
+		var longitud sql.NullInt64
+		err := conn.QueryRow(
+			`SELECT CHARACTER_MAXIMUM_LENGTH FROM information_schema.COLUMNS
+			WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?`,
+			c.tabla, c.columna,
+		).Scan(&longitud)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error al revisar columna %s.%s: %w", c.tabla, c.columna, err)
+		}
+		if longitud.Valid && longitud.Int64 >= int64(c.longitud) {
+			continue
+		}
+		if _, err := conn.Exec(fmt.Sprintf("ALTER TABLE %s MODIFY COLUMN %s %s", c.tabla, c.columna, c.definicion)); err != nil {
+			return fmt.Errorf("error al ampliar columna %s.%s: %w", c.tabla, c.columna, err)
+		}
+		log.Printf("Columna %s.%s ampliada", c.tabla, c.columna)
+	}
+	return nil
+}
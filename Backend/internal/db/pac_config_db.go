@@ -0,0 +1,131 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"Facts/internal/pac"
+	"Facts/internal/secretos"
+)
+
+// configPACEntorno es la configuración de respaldo tomada de las variables de entorno
+func configPACEntorno() pac.Config {
+	produccion := strings.ToLower(os.Getenv("PAC_PRODUCCION"))
+	return pac.Config{
+		Proveedor:  os.Getenv("PAC_PROVEEDOR"),
+		Usuario:    os.Getenv("PAC_USER"),
+		Contrasena: os.Getenv("PAC_PASS"),
+		Produccion: produccion == "1" || produccion == "true" || produccion == "si",
+		URL:        os.Getenv("PAC_URL"),
+	}
+}
+
+// ObtenerConfigPAC devuelve el PAC configurado en los datos fiscales del emisor;
+// si el emisor no tiene credenciales se usan las variables de entorno PAC_*. La contraseña
+// guardada sigue sellada: solo pac.Nuevo la abre.
+func ObtenerConfigPAC(usuarioID int) (pac.Config, error) {
+	var rfc string
+	var proveedor, usuario, contrasena sql.NullString
+	var produccion bool
+	err := GetDB().QueryRow(
+		`SELECT rfc, pac_proveedor, pac_usuario, pac_contrasena, pac_produccion
+		FROM datos_fiscales WHERE id_usuario = ?`,
+		usuarioID,
+	).Scan(&rfc, &proveedor, &usuario, &contrasena, &produccion)
+	if err != nil && err != sql.ErrNoRows {
+		return pac.Config{}, fmt.Errorf("error al obtener configuración del PAC: %w", err)
+	}
+
+	cfg := configPACEntorno()
+	cfg.RFC = rfc
+	if usuario.String != "" && contrasena.String != "" {
+		cfg.Proveedor = proveedor.String
+		cfg.Usuario = usuario.String
+		cfg.Contrasena = contrasena.String
+		cfg.Produccion = produccion
+		cfg.URL = ""
+	}
+	if cfg.Proveedor == "" {
+		cfg.Proveedor = pac.ProveedorPorDefecto
+	}
+	return cfg, nil
+}
+
+// GuardarConfigPAC guarda el PAC del emisor con la contraseña sellada con su RFC; una contraseña
+// vacía conserva la actual
+func GuardarConfigPAC(usuarioID int, cfg pac.Config) error {
+	var rfc sql.NullString
+	err := GetDB().QueryRow("SELECT rfc FROM datos_fiscales WHERE id_usuario = ?", usuarioID).Scan(&rfc)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("el usuario %d no tiene datos fiscales registrados", usuarioID)
+	}
+	if err != nil {
+		return fmt.Errorf("error al guardar configuración del PAC: %w", err)
+	}
+	contrasena, err := secretos.SellarContrasenaPAC(cfg.Contrasena, rfc.String)
+	if err != nil {
+		return err
+	}
+
+	_, err = GetDB().Exec(
+		`UPDATE datos_fiscales
+		SET pac_proveedor = ?, pac_usuario = ?, pac_produccion = ?, pac_contrasena = COALESCE(NULLIF(?, ''), pac_contrasena)
+		WHERE id_usuario = ?`,
+		cfg.Proveedor, cfg.Usuario, cfg.Produccion, contrasena, usuarioID,
+	)
+	if err != nil {
+		return fmt.Errorf("error al guardar configuración del PAC: %w", err)
+	}
+	return nil
+}
+
+// RecifrarContrasenasPAC sella las contraseñas del PAC que sigan en claro en datos_fiscales y
+// reenvuelve con la llave maestra activa las selladas con llaves anteriores
+func RecifrarContrasenasPAC() error {
+	conn := GetDB()
+	rows, err := conn.Query("SELECT id, rfc, pac_contrasena FROM datos_fiscales WHERE COALESCE(pac_contrasena, '') <> ''")
+	if err != nil {
+		return fmt.Errorf("error al consultar datos fiscales: %w", err)
+	}
+	type registro struct {
+		id              int
+		rfc, contrasena sql.NullString
+	}
+	var registros []registro
+	for rows.Next() {
+		var r registro
+		if err := rows.Scan(&r.id, &r.rfc, &r.contrasena); err != nil {
+			rows.Close()
+			return fmt.Errorf("error al leer datos fiscales: %w", err)
+		}
+		registros = append(registros, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error al leer datos fiscales: %w", err)
+	}
+
+	actualizados := 0
+	for _, r := range registros {
+		if strings.TrimSpace(r.rfc.String) == "" {
+			log.Printf("[SECRETOS] datos fiscales %d: no se sella la contraseña del PAC: no tiene RFC", r.id)
+			continue
+		}
+		contrasena, cambio, err := secretos.RecifrarContrasenaPAC(r.contrasena.String, r.rfc.String)
+		if err != nil {
+			return fmt.Errorf("datos fiscales %d: %w", r.id, err)
+		}
+		if !cambio {
+			continue
+		}
+		if _, err := conn.Exec("UPDATE datos_fiscales SET pac_contrasena = ? WHERE id = ?", contrasena, r.id); err != nil {
+			return fmt.Errorf("error al recifrar la contraseña del PAC de datos fiscales %d: %w", r.id, err)
+		}
+		actualizados++
+	}
+	log.Printf("[SECRETOS] Recifrado de contraseñas del PAC: %d registro(s) actualizados", actualizados)
+	return nil
+}
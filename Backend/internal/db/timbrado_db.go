@@ -0,0 +1,89 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Estados del registro de idempotencia de timbrado
+const (
+	TimbradoPendiente  = "pendiente" // Se envió (o se va a enviar) al PAC y no hay respuesta confirmada
+	TimbradoCompletado = "timbrado"
+	TimbradoFallido    = "fallido" // El PAC lo rechazó; un nuevo intento puede usar otro XML
+)
+
+// RegistroTimbrado es la solicitud de timbrado de un comprobante (emisor+serie+folio)
+type RegistroTimbrado struct {
+	ID               int64
+	Estado           string
+	HashXML          string
+	XMLFirmado       string
+	UUID             string
+	XMLTimbrado      string
+	IntentosFallidos int
+}
+
+// ReservarTimbrado crea el registro del comprobante o devuelve el existente.
+// Un registro fallido se reinicia con el nuevo XML; uno pendiente conserva el XML original
+// y su hash, para que quien llama detecte si intenta timbrar otro contenido con el mismo folio.
+func ReservarTimbrado(rfcEmisor, serie, folio, hashXML string, xmlFirmado []byte) (*RegistroTimbrado, error) {
+	conn := GetDB()
+	// MySQL evalúa las asignaciones en orden, por eso estado va al final
+	_, err := conn.Exec(
+		`INSERT INTO timbrados (rfc_emisor, serie, folio, hash_xml, xml_firmado, estado)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+			hash_xml = IF(estado = ?, VALUES(hash_xml), hash_xml),
+			xml_firmado = IF(estado = ?, VALUES(xml_firmado), xml_firmado),
+			estado = IF(estado = ?, ?, estado)`,
+		rfcEmisor, serie, folio, hashXML, string(xmlFirmado), TimbradoPendiente,
+		TimbradoFallido, TimbradoFallido, TimbradoFallido, TimbradoPendiente,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error al registrar timbrado: %w", err)
+	}
+
+	var r RegistroTimbrado
+	var uuid, xmlTimbrado sql.NullString
+	err = conn.QueryRow(
+		`SELECT id, estado, hash_xml, xml_firmado, uuid, xml_timbrado, intentos_fallidos
+		FROM timbrados WHERE rfc_emisor = ? AND serie = ? AND folio = ?`,
+		rfcEmisor, serie, folio,
+	).Scan(&r.ID, &r.Estado, &r.HashXML, &r.XMLFirmado, &uuid, &xmlTimbrado, &r.IntentosFallidos)
+	if err != nil {
+		return nil, fmt.Errorf("error al consultar timbrado: %w", err)
+	}
+	r.UUID = uuid.String
+	r.XMLTimbrado = xmlTimbrado.String
+	return &r, nil
+}
+
+// RegistrarIntentoFallido cuenta un intento de timbrado sin éxito y guarda el error
+func RegistrarIntentoFallido(id int64, mensaje string) error {
+	_, err := GetDB().Exec(
+		"UPDATE timbrados SET intentos_fallidos = intentos_fallidos + 1, ultimo_error = ? WHERE id = ?",
+		mensaje, id,
+	)
+	return err
+}
+
+// MarcarTimbradoFallido libera el comprobante tras un rechazo definitivo del PAC
+func MarcarTimbradoFallido(id int64, mensaje string) error {
+	_, err := GetDB().Exec(
+		"UPDATE timbrados SET estado = ?, ultimo_error = ? WHERE id = ? AND estado = ?",
+		TimbradoFallido, mensaje, id, TimbradoPendiente,
+	)
+	return err
+}
+
+// CompletarTimbrado guarda el UUID y el XML timbrado del comprobante
+func CompletarTimbrado(id int64, uuid string, xmlTimbrado []byte) error {
+	_, err := GetDB().Exec(
+		"UPDATE timbrados SET estado = ?, uuid = ?, xml_timbrado = ?, ultimo_error = NULL WHERE id = ?",
+		TimbradoCompletado, uuid, string(xmlTimbrado), id,
+	)
+	if err != nil {
+		return fmt.Errorf("error al guardar timbrado: %w", err)
+	}
+	return nil
+}
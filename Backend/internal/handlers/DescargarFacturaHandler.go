@@ -4,22 +4,32 @@ import (
 	"archive/zip"
 	"bytes"
 	"encoding/json"
-	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
-	"strconv"
-	"time"
 
-	"Facts/internal/db"
 	"Facts/internal/models"
 	"Facts/internal/services"
 	"Facts/internal/utils"
 )
 
+// DescargarFacturaHandler entrega el ZIP de una factura del historial. El XML es el que timbró el PAC,
+// byte por byte desde el archivo; el PDF se genera a partir de ese XML (en formato ticket con ?formato=ticket
+// y como PDF/A-3 con el XML incrustado con ?pdfa=1).
 func DescargarFacturaHandler(w http.ResponseWriter, r *http.Request, facturaID int) {
+	anchoTicket, err := anchoTicketSolicitado(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	pdfa, err := pdfaSolicitado(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	factura, err := models.ObtenerFacturaPorID(facturaID)
 	if err != nil {
 		log.Printf("Error al obtener factura con ID %d: %v", facturaID, err)
@@ -27,22 +37,17 @@ func DescargarFacturaHandler(w http.ResponseWriter, r *http.Request, facturaID i
 		return
 	}
 
-	// Obtener serie_df desde datos fiscales
-	serieDF := ""
-	datosFiscales, err := db.ObtenerDatosFiscales(factura.IDUsuario)
-	if err == nil {
-		if s, ok := datosFiscales["serie_df"].(string); ok {
-			serieDF = s
-		}
+	xmlTimbrado, err := xmlArchivadoFactura(factura)
+	if errors.Is(err, errSinXMLTimbrado) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
 	}
-
-	// Si no hay NumeroFolio, generar uno automáticamente con la serie
-	if factura.NumeroFolio == "" {
-		folio, _ := models.GetFolioGenerator().GenerarFolioSimple(serieDF)
-		factura.NumeroFolio = folio
+	if err != nil {
+		log.Printf("[ARCHIVO] Error al leer el XML de la factura %d: %v", facturaID, err)
+		http.Error(w, "Error al obtener el XML timbrado de la factura", http.StatusInternalServerError)
+		return
 	}
 
-	// Siempre regenerar el ZIP en un archivo temporal, servirlo y eliminarlo
 	tmpFile, err := os.CreateTemp("", fmt.Sprintf("factura_%d_*.zip", factura.ID))
 	if err != nil {
 		log.Printf("Error al crear archivo temporal para factura: %v", err)
@@ -53,39 +58,70 @@ func DescargarFacturaHandler(w http.ResponseWriter, r *http.Request, facturaID i
 	tmpFile.Close()
 	defer os.Remove(tmpFilePath)
 
-	if err := regenerarFactura(factura, tmpFilePath, serieDF); err != nil {
-		log.Printf("Error al regenerar factura: %v", err)
-		utils.RespondWithError(w, "Error al regenerar la factura para descarga")
+	if err := empaquetarFactura(factura, xmlTimbrado, tmpFilePath, anchoTicket, pdfa); err != nil {
+		log.Printf("Error al empaquetar factura: %v", err)
+		utils.RespondWithError(w, "Error al preparar la factura para descarga")
 		return
 	}
 
+	w.Header().Set("X-CFDI-SHA256", factura.XMLSHA256)
 	servirArchivoFactura(w, r, tmpFilePath, fmt.Sprintf("factura_%d.zip", factura.ID))
 }
 
+// DescargarFacturaPorIDHandler atiende GET /api/descargar-factura/{id}
+func DescargarFacturaPorIDHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, MetodoNoPermitido, http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := idRuta(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	DescargarFacturaHandler(w, r, int(id))
+}
+
 func servirArchivoFactura(w http.ResponseWriter, r *http.Request, rutaArchivo, nombreArchivo string) {
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", nombreArchivo))
 	w.Header().Set("Content-Type", "application/zip")
 	http.ServeFile(w, r, rutaArchivo)
 }
 
-func regenerarFactura(factura *models.HistorialFactura, rutaArchivo, serieDF string) error {
+// empaquetarFactura arma el ZIP con el XML archivado, su PDF, el acuse de cancelación si lo hay y datos.json
+func empaquetarFactura(factura *models.HistorialFactura, xmlTimbrado []byte, rutaArchivo string, anchoTicket float64, pdfa bool) error {
 	buf := new(bytes.Buffer)
 	zipWriter := zip.NewWriter(buf)
 
-	xmlData, xmlFileName, err := generarXMLFacturaConNombre(factura, serieDF)
+	cancelacion, err := models.ObtenerUltimaCancelacion(factura.ID)
 	if err != nil {
-		return fmt.Errorf("error al generar XML: %v", err)
+		log.Printf("Error al consultar cancelación de la factura %d (no crítico): %v", factura.ID, err)
 	}
 
-	xmlFile, err := zipWriter.Create(xmlFileName)
+	ri, err := services.LeerRepresentacionImpresa(xmlTimbrado)
+	if err != nil {
+		return fmt.Errorf("error al leer el XML archivado: %v", err)
+	}
+
+	xmlFile, err := zipWriter.Create(ri.NombreArchivo("xml"))
 	if err != nil {
 		return fmt.Errorf("error al crear archivo XML en ZIP: %v", err)
 	}
-	if _, err = xmlFile.Write(xmlData); err != nil {
+	if _, err = xmlFile.Write(xmlTimbrado); err != nil {
 		return fmt.Errorf("error al escribir XML: %v", err)
 	}
 
-	pdfData, pdfFileName, err := generarPDFFacturaConNombre(factura, serieDF)
+	opciones := services.OpcionesPDF{
+		Observaciones: factura.Observaciones, Tema: temaPDFEmisor(ri.Emisor.Rfc), AnchoTicket: anchoTicket,
+		PDFA: pdfa, XMLCFDI: xmlTimbrado,
+	}
+	if cancelacion != nil {
+		opciones.EstadoCancelacion = cancelacion.Estado
+	}
+	if opciones.Logo, err = services.CargarLogoPlantilla("1"); err != nil {
+		opciones.Logo = nil
+	}
+	pdfBuffer, pdfFileName, err := services.GenerarPDF(ri, opciones)
 	if err != nil {
 		return fmt.Errorf("error al generar PDF: %v", err)
 	}
@@ -94,10 +130,21 @@ func regenerarFactura(factura *models.HistorialFactura, rutaArchivo, serieDF str
 	if err != nil {
 		return fmt.Errorf("error al crear archivo PDF en ZIP: %v", err)
 	}
-	if _, err = pdfFile.Write(pdfData); err != nil {
+	if _, err = pdfFile.Write(pdfBuffer.Bytes()); err != nil {
 		return fmt.Errorf("error al escribir PDF: %v", err)
 	}
 
+	// Acuse del SAT si la factura se canceló o está en proceso de cancelación
+	if cancelacion != nil && cancelacion.Acuse != "" && cancelacion.Estado != models.CancelacionRechazada {
+		acuseFile, err := zipWriter.Create(fmt.Sprintf("Acuse_cancelacion_%s.xml", cancelacion.UUID))
+		if err != nil {
+			return fmt.Errorf("error al crear acuse en ZIP: %v", err)
+		}
+		if _, err = acuseFile.Write([]byte(cancelacion.Acuse)); err != nil {
+			return fmt.Errorf("error al escribir acuse: %v", err)
+		}
+	}
+
 	jsonFile, err := zipWriter.Create("datos.json")
 	if err != nil {
 		return fmt.Errorf("error al crear archivo JSON en ZIP: %v", err)
@@ -126,148 +173,3 @@ func regenerarFactura(factura *models.HistorialFactura, rutaArchivo, serieDF str
 
 	return nil
 }
-
-func generarXMLFacturaConNombre(factura *models.HistorialFactura, serieDF string) ([]byte, string, error) {
-	empresa, err := obtenerEmpresaEmisoraParaFactura(factura)
-	if err != nil {
-		return nil, "", fmt.Errorf("error al obtener datos de empresa emisora: %v", err)
-	}
-
-	var fechaXML string
-	fechaParsed, err := time.Parse("2006-01-02 15:04:05", factura.FechaGeneracion)
-	if err != nil {
-		fechaXML = factura.FechaGeneracion
-	} else {
-		fechaXML = fechaParsed.Format(time.RFC3339)
-	}
-
-	folio := factura.NumeroFolio
-	if folio == "" {
-		folio = strconv.Itoa(factura.ID)
-	}
-
-	cfdi := models.CFDI{
-		XmlnsCfdi:         "http://www.sat.gob.mx/cfd/4",
-		Version:           "4.0",
-		Serie:             serieDF,
-		Folio:             folio,
-		Fecha:             fechaXML,
-		SubTotal:          fmt.Sprintf("%.2f", factura.Total/1.16),
-		Total:             fmt.Sprintf("%.2f", factura.Total),
-		Moneda:            "MXN",
-		LugarExpedicion:   empresa.CodigoPostal,
-		TipoDeComprobante: "I",
-		MetodoPago:        "PUE",
-		FormaPago:         "01",
-	}
-
-	cfdi.Emisor.RFC = empresa.RFC
-	cfdi.Emisor.Nombre = empresa.RazonSocial
-	cfdi.Emisor.RegimenFiscal = empresa.RegimenFiscal
-
-	cfdi.Receptor.RFC = factura.RFCReceptor
-	cfdi.Receptor.Nombre = factura.RazonSocialReceptor
-	cfdi.Receptor.UsoCFDI = factura.UsoCFDI
-
-	concepto := struct {
-		ClaveProdServ    string `xml:"ClaveProdServ,attr"`
-		NoIdentificacion string `xml:"NoIdentificacion,attr,omitempty"`
-		Cantidad         string `xml:"Cantidad,attr"`
-		ClaveUnidad      string `xml:"ClaveUnidad,attr"`
-		Unidad           string `xml:"Unidad,attr,omitempty"`
-		Descripcion      string `xml:"Descripcion,attr"`
-		ValorUnitario    string `xml:"ValorUnitario,attr"`
-		Importe          string `xml:"Importe,attr"`
-		Descuento        string `xml:"Descuento,attr,omitempty"`
-	}{
-		ClaveProdServ: "01010101",
-		Cantidad:      "1",
-		ClaveUnidad:   "ACT",
-		Descripcion:   fmt.Sprintf("Venta relacionada con ticket %s", factura.ClaveTicket),
-		ValorUnitario: fmt.Sprintf("%.2f", factura.Total/1.16),
-		Importe:       fmt.Sprintf("%.2f", factura.Total/1.16),
-		Descuento:     "0.00",
-	}
-
-	cfdi.Conceptos = append(cfdi.Conceptos, concepto)
-
-	cfdi.Impuestos.TotalImpuestosTrasladados = fmt.Sprintf("%.2f", factura.Total-(factura.Total/1.16))
-	traslado := struct {
-		Impuesto   string `xml:"Impuesto,attr"`
-		TipoFactor string `xml:"TipoFactor,attr"`
-		TasaOCuota string `xml:"TasaOCuota,attr"`
-		Importe    string `xml:"Importe,attr"`
-	}{
-		Impuesto:   "002",
-		TipoFactor: "Tasa",
-		TasaOCuota: "0.160000",
-		Importe:    fmt.Sprintf("%.2f", factura.Total-(factura.Total/1.16)),
-	}
-
-	cfdi.Impuestos.Traslados = append(cfdi.Impuestos.Traslados, traslado)
-
-	xmlBytes, err := xml.MarshalIndent(cfdi, "", "  ")
-	if err != nil {
-		return nil, "", fmt.Errorf("error al serializar XML: %v", err)
-	}
-
-	nombreArchivo := fmt.Sprintf("Factura_%s%s.xml", serieDF, folio)
-	return xmlBytes, nombreArchivo, nil
-}
-
-func generarPDFFacturaConNombre(factura *models.HistorialFactura, serieDF string) ([]byte, string, error) {
-	folio := factura.NumeroFolio
-	if folio == "" {
-		folio = strconv.Itoa(factura.ID)
-	}
-
-	facturaParaPDF := models.Factura{
-		ID:                  strconv.Itoa(factura.ID),
-		Serie:               serieDF,
-		NumeroFolio:         folio,
-		ReceptorRFC:         factura.RFCReceptor,
-		ReceptorRazonSocial: factura.RazonSocialReceptor,
-		ClaveTicket:         factura.ClaveTicket,
-		Total:               factura.Total,
-		UsoCFDI:             factura.UsoCFDI,
-		Subtotal:            factura.Total / 1.16,
-		Impuestos:           factura.Total - (factura.Total / 1.16),
-		Conceptos: []models.Concepto{
-			{
-				Descripcion:   fmt.Sprintf("Venta relacionada con ticket %s", factura.ClaveTicket),
-				Cantidad:      1,
-				ValorUnitario: factura.Total / 1.16,
-				Importe:       factura.Total / 1.16,
-			},
-		},
-	}
-
-	empresaEmisora, err := obtenerEmpresaEmisoraParaFactura(factura)
-	if err != nil {
-		return nil, "", fmt.Errorf("error al obtener empresa emisora: %v", err)
-	}
-
-	var logoBytes []byte
-	logoBytes, err = services.CargarLogoPlantilla("1")
-	if err != nil {
-		logoBytes = nil
-	}
-
-	pdfBuffer, nombreArchivo, err := services.GenerarPDF(facturaParaPDF, empresaEmisora, logoBytes)
-	if err != nil {
-		return nil, "", fmt.Errorf("error al generar PDF: %v", err)
-	}
-
-	return pdfBuffer.Bytes(), nombreArchivo, nil
-}
-
-func obtenerEmpresaEmisoraParaFactura(factura *models.HistorialFactura) (*models.Empresa, error) {
-	empresas, err := models.ObtenerEmpresasPorUsuario(factura.IDUsuario)
-	if err != nil {
-		return nil, fmt.Errorf("error al obtener empresas del usuario: %v", err)
-	}
-	if len(empresas) == 0 {
-		return nil, fmt.Errorf("no se encontraron empresas para el usuario ID %d", factura.IDUsuario)
-	}
-	return &empresas[0], nil
-}
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"Facts/internal/db"
+	"Facts/internal/models"
+	"Facts/internal/services"
+)
+
+// errSinXMLTimbrado indica que la factura del historial no tiene un CFDI timbrado que servir
+var errSinXMLTimbrado = errors.New("la factura no tiene un XML timbrado archivado")
+
+// xmlArchivadoFactura devuelve el XML timbrado de la factura tal cual se archivó. Las facturas
+// anteriores al archivo se archivan la primera vez a partir del XML timbrado guardado en facturas.
+func xmlArchivadoFactura(factura *models.HistorialFactura) ([]byte, error) {
+	if factura.XMLClave != "" {
+		return services.LeerXMLArchivado(factura.XMLClave, factura.XMLSHA256)
+	}
+
+	xmlTimbrado, err := db.ObtenerXMLTimbrado(factura.NumeroFolio)
+	if err != nil {
+		return nil, fmt.Errorf("error al obtener el XML timbrado: %w", err)
+	}
+	if xmlTimbrado == "" {
+		return nil, errSinXMLTimbrado
+	}
+	// El folio no basta para identificar el CFDI: se confirma que el receptor es el del historial
+	consulta, err := services.ConsultaDesdeXML([]byte(xmlTimbrado))
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(consulta.RFCReceptor, factura.RFCReceptor) {
+		return nil, fmt.Errorf("el XML timbrado del folio %s es de otro receptor (%s)", factura.NumeroFolio, consulta.RFCReceptor)
+	}
+	archivo, err := services.ArchivarXMLTimbrado([]byte(xmlTimbrado))
+	if err != nil {
+		return nil, err
+	}
+	if err := models.RegistrarXMLArchivado(int64(factura.ID), archivo.UUID, archivo.SHA256, archivo.Clave, archivo.NoCertificado); err != nil {
+		return nil, err
+	}
+	factura.UUID, factura.XMLSHA256, factura.XMLClave = archivo.UUID, archivo.SHA256, archivo.Clave
+	factura.NoCertificado = archivo.NoCertificado
+	return []byte(xmlTimbrado), nil
+}
+
+// uuidHistorial devuelve el UUID del CFDI timbrado de una factura del historial. Las facturas que
+// aún no están en el archivo se archivan primero, confirmando el receptor, para no depender del folio.
+func uuidHistorial(factura *models.HistorialFactura) (string, error) {
+	if factura.UUID != "" {
+		return factura.UUID, nil
+	}
+	if _, err := xmlArchivadoFactura(factura); err != nil {
+		return "", err
+	}
+	return factura.UUID, nil
+}
+
+// errOriginalCancelado indica que la factura original está cancelada o en cancelación y ya no admite
+// comprobantes relacionados
+var errOriginalCancelado = errors.New("la factura original está cancelada o en proceso de cancelación")
+
+// originalVigente rechaza relacionar un comprobante con una factura cancelada o en cancelación
+func originalVigente(original *models.HistorialFactura) error {
+	if original.Estado == models.EstadoHistorialCancelada || original.Estado == models.EstadoHistorialEnCancelacion {
+		return fmt.Errorf("factura %s: %w", original.NumeroFolio, errOriginalCancelado)
+	}
+	return nil
+}
+
+// aplicarReceptorOriginal copia del XML timbrado de la factura original el nombre, el código postal y
+// el régimen fiscal del receptor, que deben coincidir en los comprobantes relacionados. Los que el
+// XML no trae (CFDI 3.3) se quedan como vienen en la solicitud.
+func aplicarReceptorOriginal(factura *models.Factura, xmlOriginal []byte) error {
+	comprobante, err := services.LeerComprobante(xmlOriginal)
+	if err != nil {
+		return fmt.Errorf("error al leer el receptor de la factura original: %w", err)
+	}
+	receptor := comprobante.Receptor
+	if receptor.Nombre != "" {
+		factura.ReceptorRazonSocial = receptor.Nombre
+	}
+	if receptor.DomicilioFiscalReceptor != "" {
+		factura.ReceptorCodigoPostal = receptor.DomicilioFiscalReceptor
+	}
+	if receptor.RegimenFiscalReceptor != "" {
+		factura.RegimenFiscalReceptor = receptor.RegimenFiscalReceptor
+	}
+	return nil
+}
+
+// registrarComprobanteTimbrado archiva el XML timbrado, lo registra junto con el historial, el folio
+// y las relaciones dentro de tx y confirma la transacción; despues corre dentro de tx antes de
+// confirmar, con el id del historial. Si falla, el folio se marca como usado de todas formas: el
+// CFDI ya existe ante el SAT y su folio no se puede volver a emitir. Cuando el folio se reservó en
+// tx, ReservarFolio lo salta por estar en timbrados.
+func registrarComprobanteTimbrado(tx *sql.Tx, factura *models.Factura, xmlTimbrado []byte, relaciones []models.CFDIRelacionado, despues ...func(idHistorial int64) error) (int64, error) {
+	id, err := func() (int64, error) {
+		archivo, err := services.ArchivarXMLTimbrado(xmlTimbrado)
+		if err != nil {
+			return 0, fmt.Errorf("error al archivar el XML timbrado: %w", err)
+		}
+		id, err := models.RegistrarComprobanteTimbrado(tx, *factura, string(xmlTimbrado), models.XMLArchivado{
+			UUID:          archivo.UUID,
+			SHA256:        archivo.SHA256,
+			Clave:         archivo.Clave,
+			NoCertificado: archivo.NoCertificado,
+		}, relaciones)
+		if err != nil {
+			return 0, err
+		}
+		for _, f := range despues {
+			if err := f(id); err != nil {
+				return 0, err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, fmt.Errorf("error al confirmar el registro: %w", err)
+		}
+		log.Printf("[ARCHIVO] Factura %d: UUID %s en %s (SHA-256 %s, CSD %s)", id, archivo.UUID, archivo.Clave, archivo.SHA256, archivo.NoCertificado)
+		return id, nil
+	}()
+	if err != nil {
+		// Se libera la transacción antes de tocar el folio para no esperar sus propios bloqueos
+		tx.Rollback()
+		marcarFolioUsado(factura)
+		return 0, err
+	}
+	return id, nil
+}
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"Facts/internal/models"
+)
+
+// FiltroAuditoriaDesdeTexto arma el filtro de la auditoría con fechas YYYY-MM-DD; hasta es inclusivo.
+// Sin fechas se audita del primer día del mes en curso a hoy.
+func FiltroAuditoriaDesdeTexto(rfc, serie, desde, hasta string) (models.FiltroAuditoriaFolios, error) {
+	hoy := time.Now()
+	filtro := models.FiltroAuditoriaFolios{
+		RFCEmisor: strings.ToUpper(strings.TrimSpace(rfc)),
+		Serie:     strings.ToUpper(strings.TrimSpace(serie)),
+		Desde:     time.Date(hoy.Year(), hoy.Month(), 1, 0, 0, 0, 0, time.Local),
+		Hasta:     time.Date(hoy.Year(), hoy.Month(), hoy.Day(), 0, 0, 0, 0, time.Local).AddDate(0, 0, 1),
+	}
+	if desde != "" {
+		d, err := time.ParseInLocation("2006-01-02", desde, time.Local)
+		if err != nil {
+			return filtro, fmt.Errorf("fecha desde inválida, use AAAA-MM-DD")
+		}
+		filtro.Desde = d
+	}
+	if hasta != "" {
+		h, err := time.ParseInLocation("2006-01-02", hasta, time.Local)
+		if err != nil {
+			return filtro, fmt.Errorf("fecha hasta inválida, use AAAA-MM-DD")
+		}
+		filtro.Hasta = h.AddDate(0, 0, 1)
+	}
+	if !filtro.Hasta.After(filtro.Desde) {
+		return filtro, fmt.Errorf("la fecha desde debe ser anterior o igual a la fecha hasta")
+	}
+	return filtro, nil
+}
+
+// AuditoriaFoliosHandler revisa huecos, duplicados y folios sin timbrar del emisor {rfc}.
+// Parámetros: desde, hasta (AAAA-MM-DD), serie y formato=csv para descargar el reporte.
+func AuditoriaFoliosHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, MetodoNoPermitido, http.StatusMethodNotAllowed)
+		return
+	}
+	rfc := strings.ToUpper(strings.TrimSpace(r.PathValue("rfc")))
+	if rfc == "" {
+		http.Error(w, "Se requiere el RFC del emisor", http.StatusBadRequest)
+		return
+	}
+
+	q := r.URL.Query()
+	filtro, err := FiltroAuditoriaDesdeTexto(rfc, q.Get("serie"), q.Get("desde"), q.Get("hasta"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	auditoria, err := models.AuditarFolios(filtro)
+	if err != nil {
+		log.Printf("[FOLIOS] Error en la auditoría de %s: %v", rfc, err)
+		http.Error(w, "Error al auditar los folios", http.StatusInternalServerError)
+		return
+	}
+
+	if strings.EqualFold(q.Get("formato"), "csv") {
+		w.Header().Set(ContentTypeHeader, "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=auditoria_folios_%s_%s_%s.csv", rfc, auditoria.Desde, auditoria.Hasta))
+		if err := auditoria.EscribirCSV(w); err != nil {
+			log.Printf("[FOLIOS] Error al escribir el CSV de auditoría: %v", err)
+		}
+		return
+	}
+	w.Header().Set(ContentTypeHeader, ApplicationJSON)
+	json.NewEncoder(w).Encode(auditoria)
+}
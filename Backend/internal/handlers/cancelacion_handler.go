@@ -0,0 +1,356 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"Facts/internal/db"
+	"Facts/internal/models"
+	"Facts/internal/pac"
+	"Facts/internal/services"
+)
+
+// tipoRelacionSustitucion es el c_TipoRelacion del CFDI que sustituye a uno cancelado con motivo 01
+const tipoRelacionSustitucion = "04"
+
+// horaSeguimientoCancelaciones es la hora local en que se consulta al SAT las cancelaciones en proceso
+const horaSeguimientoCancelaciones = 3
+
+// CancelarFacturaRequest son los datos para cancelar una factura timbrada del historial
+type CancelarFacturaRequest struct {
+	IDUsuario        int    `json:"id_usuario"`
+	Motivo           string `json:"motivo"`            // c_MotivoCancelacion: 01, 02, 03 o 04
+	FolioSustitucion string `json:"folio_sustitucion"` // UUID del CFDI que sustituye al cancelado (motivo 01)
+	// Sustitucion reexpide la factura en el mismo paso (solo motivo 01): se timbra relacionada con
+	// tipo 04 y su UUID se usa como folio de sustitución
+	Sustitucion *models.Factura `json:"sustitucion,omitempty"`
+}
+
+// SustitucionFactura es la factura emitida para sustituir a la cancelada
+type SustitucionFactura struct {
+	IDHistorial int64  `json:"id_historial"`
+	NumeroFolio string `json:"numero_folio"`
+	UUID        string `json:"uuid"`
+}
+
+// facturaDelUsuario obtiene la factura idHistorial del historial solo si pertenece a idUsuario, que
+// es obligatorio; si no, responde el error y devuelve false
+func facturaDelUsuario(w http.ResponseWriter, idHistorial, idUsuario int) (*models.HistorialFactura, bool) {
+	if idUsuario <= 0 {
+		http.Error(w, "Se requiere id_usuario", http.StatusBadRequest)
+		return nil, false
+	}
+	factura, err := models.ObtenerFacturaPorID(idHistorial)
+	if err != nil {
+		http.Error(w, "Factura no encontrada", http.StatusNotFound)
+		return nil, false
+	}
+	if factura.IDUsuario != idUsuario {
+		http.Error(w, "La factura no pertenece al usuario", http.StatusForbidden)
+		return nil, false
+	}
+	return factura, true
+}
+
+// CancelarFacturaHandler cancela ante el SAT (vía el PAC del emisor) la factura {id} del historial
+func CancelarFacturaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, MetodoNoPermitido, http.StatusMethodNotAllowed)
+		return
+	}
+	idHistorial, err := idRuta(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req CancelarFacturaRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Error al procesar los datos: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	original, ok := facturaDelUsuario(w, int(idHistorial), req.IDUsuario)
+	if !ok {
+		return
+	}
+	ultima, err := models.ObtenerUltimaCancelacion(original.ID)
+	if err != nil {
+		log.Printf("[CANCELACION] %v", err)
+		http.Error(w, "Error al consultar cancelaciones previas", http.StatusInternalServerError)
+		return
+	}
+	if ultima != nil && (ultima.Cancelado() || ultima.Estado == models.CancelacionEnProceso) {
+		http.Error(w, fmt.Sprintf("La factura ya tiene una cancelación %s", ultima.Estado), http.StatusConflict)
+		return
+	}
+	uuidOriginal, err := uuidHistorial(original)
+	if errors.Is(err, errSinXMLTimbrado) {
+		http.Error(w, "La factura no está timbrada; no hay nada que cancelar", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("[CANCELACION] Error al obtener el UUID de la factura %d: %v", original.ID, err)
+		http.Error(w, "No se pudo obtener el UUID de la factura", http.StatusInternalServerError)
+		return
+	}
+
+	if req.Sustitucion != nil && req.Motivo == "" {
+		req.Motivo = models.MotivoCancelacionSustitucion
+	}
+	if req.Sustitucion != nil && (req.Motivo != models.MotivoCancelacionSustitucion || req.FolioSustitucion != "") {
+		http.Error(w, "La reexpedición solo aplica al motivo 01 y reemplaza a folio_sustitucion", http.StatusBadRequest)
+		return
+	}
+	if req.Sustitucion == nil {
+		if err := models.ValidarMotivoCancelacion(req.Motivo, req.FolioSustitucion); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	emisor := models.Factura{IdUsuario: original.IDUsuario}
+	if err := LlenarDatosEmisor(&emisor, emisor.IdUsuario); err != nil {
+		http.Error(w, "No hay datos fiscales del emisor", http.StatusBadRequest)
+		return
+	}
+	if err := aplicarCSDVigente(&emisor); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if emisor.KeyPath == "" || emisor.ClaveCSD == "" {
+		http.Error(w, "Faltan datos para la firma digital (archivo .key o clave CSD)", http.StatusBadRequest)
+		return
+	}
+	if _, err := os.Stat(emisor.KeyPath); err != nil {
+		http.Error(w, "El archivo .key no existe en la ruta proporcionada: "+emisor.KeyPath, http.StatusBadRequest)
+		return
+	}
+	solicitud, err := services.SolicitudCancelacionCSD(emisor, uuidOriginal, req.Motivo, req.FolioSustitucion)
+	if err != nil {
+		log.Printf("[CANCELACION] %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	proveedor, err := proveedorPACUsuario(original.IDUsuario)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// El SAT exige que el CFDI sustituto exista antes de cancelar con motivo 01
+	var sustitucion *SustitucionFactura
+	if req.Sustitucion != nil {
+		sustitucion, err = reexpedirFactura(original, uuidOriginal, *req.Sustitucion)
+		if err != nil {
+			log.Printf("[CANCELACION] Error al reexpedir la factura %s: %v", original.NumeroFolio, err)
+			http.Error(w, "Error al emitir la factura sustituta: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		solicitud.FolioSustitucion = sustitucion.UUID
+	}
+
+	resultado, err := proveedor.Cancelar(solicitud)
+	if err != nil {
+		log.Printf("[CANCELACION] Error al cancelar UUID %s: %v", uuidOriginal, err)
+		// Si ya se emitió la sustituta se informa para reintentar con su UUID como folio_sustitucion
+		w.Header().Set(ContentTypeHeader, ApplicationJSON)
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":       "Error al cancelar: " + err.Error(),
+			"sustitucion": sustitucion,
+		})
+		return
+	}
+
+	cancelacion := &models.Cancelacion{
+		IDHistorial:      original.ID,
+		IDUsuario:        original.IDUsuario,
+		UUID:             uuidOriginal,
+		RFCEmisor:        emisor.EmisorRFC,
+		RFCReceptor:      original.RFCReceptor,
+		Total:            original.Total,
+		Motivo:           solicitud.Motivo,
+		FolioSustitucion: solicitud.FolioSustitucion,
+		Estado:           models.EstadoCancelacionSAT("", resultado.EstatusCancelacion),
+		CodigoEstatus:    resultado.CodigoEstatus,
+		EstatusSAT:       resultado.EstatusCancelacion,
+		Acuse:            string(resultado.Acuse),
+	}
+	if sustitucion != nil {
+		cancelacion.IDHistorialSustitucion = int(sustitucion.IDHistorial)
+	}
+	if cancelacion.ID, err = models.RegistrarCancelacion(cancelacion); err != nil {
+		// El SAT ya recibió la solicitud: se responde con éxito y se deja rastro para conciliar
+		log.Printf("[CANCELACION] UUID %s cancelado (%s) pero no se pudo guardar: %v", uuidOriginal, resultado.EstatusCancelacion, err)
+	}
+	log.Printf("[CANCELACION] Factura %s (UUID %s) motivo %s: %s", original.NumeroFolio, uuidOriginal, solicitud.Motivo, cancelacion.Estado)
+
+	w.Header().Set(ContentTypeHeader, ApplicationJSON)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"cancelacion": cancelacion,
+		"sustitucion": sustitucion,
+	})
+}
+
+// reexpedirFactura timbra la factura que sustituye a la original, relacionada con tipo 04
+func reexpedirFactura(original *models.HistorialFactura, uuidOriginal string, factura models.Factura) (*SustitucionFactura, error) {
+	factura.IdUsuario = original.IDUsuario
+	factura.NumeroFolio = ""
+	factura.TipoRelacion = tipoRelacionSustitucion
+	factura.UUIDsRelacionados = []string{uuidOriginal}
+	if factura.ReceptorRFC == "" {
+		factura.ReceptorRFC = original.RFCReceptor
+		factura.ReceptorRazonSocial = original.RazonSocialReceptor
+	}
+	if factura.UsoCFDI == "" {
+		factura.UsoCFDI = original.UsoCFDI
+	}
+	if factura.ClaveTicket == "" {
+		factura.ClaveTicket = original.ClaveTicket
+	}
+	if factura.Observaciones == "" {
+		factura.Observaciones = fmt.Sprintf("Sustituye a la factura %s (UUID %s)", original.NumeroFolio, uuidOriginal)
+	}
+
+	if _, err := prepararFactura(&factura); err != nil {
+		return nil, err
+	}
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := asignarFolio(tx, &factura); err != nil {
+		return nil, err
+	}
+	xmlFirmado, err := firmarCFDI(factura)
+	if err != nil {
+		return nil, fmt.Errorf("error al generar XML firmado: %w", err)
+	}
+	xmlTimbrado, err := timbrarConPACConfigurado(factura.IdUsuario, xmlFirmado)
+	if err != nil {
+		return nil, fmt.Errorf("error al timbrar con PAC: %w", err)
+	}
+	timbre, err := services.ExtraerTimbreFiscalDigital(xmlTimbrado)
+	if err != nil {
+		return nil, fmt.Errorf("error extrayendo timbre fiscal: %w", err)
+	}
+
+	// CFDI, historial, archivo, folio y relación de sustitución se registran juntos
+	idHistorial, err := registrarComprobanteTimbrado(tx, &factura, xmlTimbrado, []models.CFDIRelacionado{{
+		IDHistorialOrigen: original.ID,
+		UUIDOrigen:        uuidOriginal,
+		TipoComprobante:   "I",
+		TipoRelacion:      tipoRelacionSustitucion,
+		Monto:             factura.Total,
+	}})
+	if err != nil {
+		return nil, fmt.Errorf("CFDI sustituto timbrado con UUID %s pero no se pudo registrar: %w", timbre.UUID, err)
+	}
+	log.Printf("[CANCELACION] Factura %s sustituye a %s (UUID %s)", factura.NumeroFolio, original.NumeroFolio, timbre.UUID)
+
+	return &SustitucionFactura{IDHistorial: idHistorial, NumeroFolio: factura.NumeroFolio, UUID: timbre.UUID}, nil
+}
+
+// CancelacionFacturaHandler devuelve la última cancelación de la factura {id} del historial de
+// ?id_usuario. Con ?actualizar=1 consulta al SAT (sin caché) si sigue en proceso; con ?acuse=1 descarga el acuse XML.
+func CancelacionFacturaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, MetodoNoPermitido, http.StatusMethodNotAllowed)
+		return
+	}
+	idHistorial, err := idRuta(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	idUsuario, _ := strconv.Atoi(r.URL.Query().Get("id_usuario"))
+	if _, ok := facturaDelUsuario(w, int(idHistorial), idUsuario); !ok {
+		return
+	}
+	cancelacion, err := models.ObtenerUltimaCancelacion(int(idHistorial))
+	if err != nil {
+		log.Printf("[CANCELACION] %v", err)
+		http.Error(w, "Error al consultar la cancelación", http.StatusInternalServerError)
+		return
+	}
+	if cancelacion == nil {
+		http.Error(w, "La factura no tiene solicitudes de cancelación", http.StatusNotFound)
+		return
+	}
+
+	if r.URL.Query().Get("acuse") == "1" {
+		if cancelacion.Acuse == "" {
+			http.Error(w, "El PAC no entregó acuse para esta cancelación", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=acuse_cancelacion_%s.xml", cancelacion.UUID))
+		w.Write([]byte(cancelacion.Acuse))
+		return
+	}
+
+	respuesta := map[string]interface{}{"cancelacion": cancelacion}
+	if r.URL.Query().Get("actualizar") == "1" && cancelacion.Estado == models.CancelacionEnProceso {
+		if err := actualizarCancelacion(cancelacion); err != nil {
+			respuesta["error_consulta"] = err.Error()
+		}
+	}
+	w.Header().Set(ContentTypeHeader, ApplicationJSON)
+	json.NewEncoder(w).Encode(respuesta)
+}
+
+// actualizarCancelacion consulta directamente al SAT el estado del CFDI y guarda el resultado si cambió
+func actualizarCancelacion(c *models.Cancelacion) error {
+	estado, err := services.ConsultaSAT().Actualizar(pac.ConsultaEstado{
+		RFCEmisor:   c.RFCEmisor,
+		RFCReceptor: c.RFCReceptor,
+		Total:       fmt.Sprintf("%.2f", c.Total),
+		UUID:        c.UUID,
+	})
+	if err != nil {
+		return err
+	}
+	nuevo := models.EstadoCancelacionSAT(estado.Estado, estado.EstatusCancelacion)
+	if nuevo == c.Estado && estado.EstatusCancelacion == c.EstatusSAT {
+		return nil
+	}
+	c.Estado = nuevo
+	c.CodigoEstatus = estado.CodigoEstatus
+	c.EstatusSAT = estado.EstatusCancelacion
+	if err := models.ActualizarEstadoCancelacion(c); err != nil {
+		return err
+	}
+	log.Printf("[CANCELACION] UUID %s: %s (%s)", c.UUID, c.Estado, c.EstatusSAT)
+	return nil
+}
+
+// IniciarSeguimientoCancelaciones consulta cada noche al SAT las cancelaciones que esperan la
+// respuesta del receptor hasta que la acepte, la rechace o venza el plazo
+func IniciarSeguimientoCancelaciones() {
+	for {
+		ahora := time.Now()
+		siguiente := time.Date(ahora.Year(), ahora.Month(), ahora.Day(), horaSeguimientoCancelaciones, 0, 0, 0, ahora.Location())
+		if !siguiente.After(ahora) {
+			siguiente = siguiente.AddDate(0, 0, 1)
+		}
+		time.Sleep(time.Until(siguiente))
+
+		cancelaciones, err := models.ObtenerCancelacionesEnProceso()
+		if err != nil {
+			log.Printf("[CANCELACION] %v", err)
+		}
+		for i := range cancelaciones {
+			if err := actualizarCancelacion(&cancelaciones[i]); err != nil {
+				log.Printf("[CANCELACION] UUID %s: %v", cancelaciones[i].UUID, err)
+			}
+		}
+		log.Printf("[CANCELACION] Seguimiento nocturno: %d cancelaciones en proceso revisadas", len(cancelaciones))
+	}
+}
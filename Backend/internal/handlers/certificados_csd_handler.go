@@ -0,0 +1,230 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"Facts/internal/db"
+	"Facts/internal/models"
+	"Facts/internal/services"
+	"Facts/internal/utils"
+)
+
+// diasAvisoCSD son los días antes del vencimiento en que se avisa que un CSD está por vencer
+var diasAvisoCSD = []int{30, 15, 5}
+
+// horaRevisionCSD es la hora local en que corre la revisión diaria de vencimientos
+const horaRevisionCSD = 7
+
+// aplicarCSDVigente toma el certificado con el que se debe sellar hoy. Si el emisor no tiene
+// certificados registrados se queda con el CSD de sus datos fiscales.
+func aplicarCSDVigente(factura *models.Factura) error {
+	if factura.EmisorRFC == "" {
+		return nil
+	}
+	csd, err := db.CertificadoVigente(factura.EmisorRFC, time.Now())
+	if err != nil {
+		return err
+	}
+	if csd == nil {
+		return nil
+	}
+	factura.CerPath, factura.CerBase64 = csd.RutaCer, ""
+	factura.KeyPath, factura.ClaveCSD = csd.RutaKey, csd.ClaveCSD
+	log.Printf("[CSD] %s sella con el certificado %s (vence %s)", factura.EmisorRFC, csd.NoCertificado, csd.ValidoHasta.Format("2006-01-02"))
+	return nil
+}
+
+// firmarCFDI genera el XML firmado con el CSD vigente del emisor
+func firmarCFDI(factura models.Factura) ([]byte, error) {
+	if err := aplicarCSDVigente(&factura); err != nil {
+		return nil, err
+	}
+	return services.ProcesarKeyYGenerarCFDI(factura, factura.KeyPath, factura.ClaveCSD)
+}
+
+// certificadoCSDRespuesta agrega al certificado los días que le quedan
+type certificadoCSDRespuesta struct {
+	db.CertificadoCSD
+	DiasRestantes int  `json:"dias_restantes"`
+	PorVencer     bool `json:"por_vencer"`
+	EnUso         bool `json:"en_uso"`
+}
+
+// CertificadosCSDHandler lista (GET) o registra (POST multipart con archivo_cer, archivo_key,
+// clave_csd e id_usuario) los CSD del emisor {rfc}
+func CertificadosCSDHandler(w http.ResponseWriter, r *http.Request) {
+	rfc := strings.ToUpper(strings.TrimSpace(r.PathValue("rfc")))
+	if rfc == "" {
+		http.Error(w, "Se requiere el RFC del emisor", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		responderCertificadosCSD(w, rfc)
+	case http.MethodPost:
+		if err := r.ParseMultipartForm(10 << 20); err != nil {
+			http.Error(w, "Error al procesar formulario", http.StatusBadRequest)
+			return
+		}
+		idUsuario, err := strconv.Atoi(r.FormValue("id_usuario"))
+		if err != nil || idUsuario <= 0 {
+			http.Error(w, "ID de usuario inválido o no proporcionado", http.StatusBadRequest)
+			return
+		}
+		cer, nombreCer, err := leerArchivoFormulario(r, "archivo_cer")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		llave, nombreKey, err := leerArchivoFormulario(r, "archivo_key")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		csd, err := db.RegistrarCertificadoCSD(idUsuario, rfc, cer, llave, nombreCer, nombreKey, r.FormValue("clave_csd"))
+		var errCSD *utils.ErrorValidacionCSD
+		if errors.As(err, &errCSD) {
+			w.Header().Set(ContentTypeHeader, ApplicationJSON)
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"status":  "error",
+				"codigo":  errCSD.Codigo,
+				"message": errCSD.Mensaje,
+			})
+			return
+		}
+		if err != nil {
+			log.Printf("[CSD] Error al registrar certificado de %s: %v", rfc, err)
+			http.Error(w, "Error al registrar el certificado", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set(ContentTypeHeader, ApplicationJSON)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(csd)
+	default:
+		http.Error(w, MetodoNoPermitido, http.StatusMethodNotAllowed)
+	}
+}
+
+// RevocarCertificadoCSDHandler marca como revocado el certificado {id} del emisor {rfc}
+func RevocarCertificadoCSDHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, MetodoNoPermitido, http.StatusMethodNotAllowed)
+		return
+	}
+	rfc := strings.ToUpper(strings.TrimSpace(r.PathValue("rfc")))
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if rfc == "" || err != nil || id <= 0 {
+		http.Error(w, "Se requiere el RFC del emisor y el ID del certificado", http.StatusBadRequest)
+		return
+	}
+	if err := db.RevocarCertificadoCSD(rfc, id); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	responderCertificadosCSD(w, rfc)
+}
+
+// responderCertificadosCSD devuelve los certificados del emisor marcando el que se usa para sellar
+func responderCertificadosCSD(w http.ResponseWriter, rfc string) {
+	certificados, err := db.ListarCertificadosCSD(rfc)
+	if err != nil {
+		log.Printf("[CSD] %v", err)
+		http.Error(w, "Error al obtener los certificados", http.StatusInternalServerError)
+		return
+	}
+	ahora := time.Now()
+	vigente, _ := db.CertificadoVigente(rfc, ahora)
+
+	respuesta := make([]certificadoCSDRespuesta, 0, len(certificados))
+	for _, c := range certificados {
+		dias := c.DiasRestantes(ahora)
+		respuesta = append(respuesta, certificadoCSDRespuesta{
+			CertificadoCSD: c,
+			DiasRestantes:  dias,
+			PorVencer:      c.Estado == db.CSDActivo && dias <= diasAvisoCSD[0],
+			EnUso:          vigente != nil && vigente.ID == c.ID,
+		})
+	}
+	w.Header().Set(ContentTypeHeader, ApplicationJSON)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"rfc":          rfc,
+		"certificados": respuesta,
+	})
+}
+
+// leerArchivoFormulario lee un archivo del formulario multipart
+func leerArchivoFormulario(r *http.Request, campo string) ([]byte, string, error) {
+	archivo, encabezado, err := r.FormFile(campo)
+	if err != nil {
+		return nil, "", errors.New("falta el archivo " + campo)
+	}
+	defer archivo.Close()
+	datos, err := io.ReadAll(archivo)
+	if err != nil {
+		return nil, "", errors.New("error al leer el archivo " + campo)
+	}
+	return datos, encabezado.Filename, nil
+}
+
+// IniciarRevisionCSD revisa cada mañana los vencimientos de los CSD: actualiza su estado y avisa
+// a 30, 15 y 5 días de que venza un certificado que todavía no tiene reemplazo
+func IniciarRevisionCSD() {
+	for {
+		ahora := time.Now()
+		siguiente := time.Date(ahora.Year(), ahora.Month(), ahora.Day(), horaRevisionCSD, 0, 0, 0, ahora.Location())
+		if !siguiente.After(ahora) {
+			siguiente = siguiente.AddDate(0, 0, 1)
+		}
+		time.Sleep(time.Until(siguiente))
+		revisarVencimientosCSD(time.Now())
+	}
+}
+
+// revisarVencimientosCSD emite un aviso por umbral: cada certificado avisa una vez a los 30, 15 y 5 días
+func revisarVencimientosCSD(ahora time.Time) {
+	if err := db.ActualizarEstadosCSD(ahora); err != nil {
+		log.Printf("[CSD] %v", err)
+	}
+	certificados, err := db.CertificadosPorVencer(ahora, diasAvisoCSD[0])
+	if err != nil {
+		log.Printf("[CSD] %v", err)
+		return
+	}
+	avisos := 0
+	for _, c := range certificados {
+		dias := c.DiasRestantes(ahora)
+		umbral := umbralAvisoCSD(dias)
+		if umbral == 0 || (c.UltimoAviso != 0 && c.UltimoAviso <= umbral) {
+			continue
+		}
+		log.Printf("[CSD] AVISO: el certificado %s de %s vence en %d día(s) (%s); registre el nuevo CSD",
+			c.NoCertificado, c.RFC, dias, c.ValidoHasta.Format("2006-01-02"))
+		if err := db.MarcarAvisoCSD(c.ID, umbral); err != nil {
+			log.Printf("[CSD] %v", err)
+			continue
+		}
+		avisos++
+	}
+	log.Printf("[CSD] Revisión de vencimientos: %d certificado(s) por vencer, %d aviso(s)", len(certificados), avisos)
+}
+
+// umbralAvisoCSD es el menor umbral de aviso que ya se alcanzó (0 si faltan más de 30 días)
+func umbralAvisoCSD(dias int) int {
+	umbral := 0
+	for _, d := range diasAvisoCSD {
+		if dias <= d {
+			umbral = d
+		}
+	}
+	return umbral
+}
@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"Facts/internal/db"
+	"Facts/internal/models"
+	"Facts/internal/pac"
+	"Facts/internal/services"
+)
+
+// Parámetros de la cola de timbrado
+const (
+	workersColaPorDefecto = 2
+	intentosMaximosCola   = 5
+	esperaInicialCola     = 30 * time.Second // Se duplica en cada reintento
+	bloqueoTrabajoCola    = 5 * time.Minute  // Si el proceso cae, el trabajo se retoma al vencer
+	sondeoCola            = 5 * time.Second
+)
+
+// despertarCola avisa a los workers que hay un trabajo nuevo sin esperar al siguiente sondeo
+var despertarCola = make(chan struct{}, 1)
+
+// avisosTrabajos notifica a los flujos SSE cada cambio de estatus de un trabajo
+var avisosTrabajos = struct {
+	sync.Mutex
+	suscriptores map[int64]map[chan struct{}]bool
+}{suscriptores: map[int64]map[chan struct{}]bool{}}
+
+// suscribirTrabajo devuelve un canal que recibe un aviso por cada cambio del trabajo
+func suscribirTrabajo(id int64) (chan struct{}, func()) {
+	canal := make(chan struct{}, 1)
+	avisosTrabajos.Lock()
+	if avisosTrabajos.suscriptores[id] == nil {
+		avisosTrabajos.suscriptores[id] = map[chan struct{}]bool{}
+	}
+	avisosTrabajos.suscriptores[id][canal] = true
+	avisosTrabajos.Unlock()
+
+	return canal, func() {
+		avisosTrabajos.Lock()
+		delete(avisosTrabajos.suscriptores[id], canal)
+		if len(avisosTrabajos.suscriptores[id]) == 0 {
+			delete(avisosTrabajos.suscriptores, id)
+		}
+		avisosTrabajos.Unlock()
+	}
+}
+
+func avisarTrabajo(id int64) {
+	avisosTrabajos.Lock()
+	defer avisosTrabajos.Unlock()
+	for canal := range avisosTrabajos.suscriptores[id] {
+		select {
+		case canal <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// IniciarColaFacturas arranca los workers de timbrado (COLA_FACTURAS_WORKERS, 2 por defecto).
+// Los trabajos viven en MySQL, así que los pendientes se retoman al reiniciar el proceso.
+func IniciarColaFacturas() {
+	workers := workersColaPorDefecto
+	if n, err := strconv.Atoi(os.Getenv("COLA_FACTURAS_WORKERS")); err == nil && n > 0 {
+		workers = n
+	}
+	log.Printf("[COLA] Iniciando %d workers de timbrado", workers)
+	for i := 1; i <= workers; i++ {
+		go workerColaFacturas(i)
+	}
+}
+
+func workerColaFacturas(numero int) {
+	for {
+		trabajo, err := models.TomarTrabajoFactura(bloqueoTrabajoCola)
+		if err != nil {
+			log.Printf("[COLA] Worker %d: %v", numero, err)
+		}
+		if trabajo == nil {
+			select {
+			case <-despertarCola:
+			case <-time.After(sondeoCola):
+			}
+			continue
+		}
+		avisarTrabajo(trabajo.ID)
+		procesarTrabajoFactura(trabajo)
+		avisarTrabajo(trabajo.ID)
+	}
+}
+
+// procesarTrabajoFactura sella, timbra y genera el PDF; las fallas transitorias se reprograman con backoff
+func procesarTrabajoFactura(trabajo *models.TrabajoFactura) {
+	factura := trabajo.Factura
+	log.Printf("[COLA] Trabajo %d (folio %s), intento %d", trabajo.ID, factura.NumeroFolio, trabajo.Intentos)
+
+	fallar := func(err error) {
+		log.Printf("[COLA] Trabajo %d fallido: %v", trabajo.ID, err)
+		if errBD := models.FallarTrabajoFactura(trabajo.ID, err.Error()); errBD != nil {
+			log.Printf("[COLA] %v", errBD)
+		}
+		liberarFolio(&factura, err.Error())
+	}
+	reintentar := func(err error) {
+		if trabajo.Intentos >= intentosMaximosCola {
+			fallar(fmt.Errorf("%v (sin éxito tras %d intentos)", err, trabajo.Intentos))
+			return
+		}
+		espera := esperaInicialCola << (trabajo.Intentos - 1)
+		log.Printf("[COLA] Trabajo %d: %v; reintento en %s", trabajo.ID, err, espera)
+		if errBD := models.ReprogramarTrabajoFactura(trabajo.ID, err.Error(), espera); errBD != nil {
+			log.Printf("[COLA] %v", errBD)
+		}
+	}
+
+	xmlFirmado, err := firmarCFDI(factura)
+	if err != nil {
+		fallar(fmt.Errorf("error al generar XML firmado CFDI: %w", err))
+		return
+	}
+	proveedor, err := proveedorPACUsuario(factura.IdUsuario)
+	if err != nil {
+		fallar(err)
+		return
+	}
+	// El timbrado es idempotente por emisor+serie+folio: un reintento no vuelve a timbrar
+	timbre, xmlTimbrado, err := services.TimbrarFactura(xmlFirmado, proveedor)
+	if err != nil {
+		if pac.EsTransitorio(err) {
+			reintentar(fmt.Errorf("error al timbrar: %w", err))
+		} else {
+			fallar(fmt.Errorf("error al timbrar: %w", err))
+		}
+		return
+	}
+	factura.Timbre = timbre
+
+	var pdfBuffer *bytes.Buffer
+	if len(trabajo.Plantilla) > 0 {
+		pdfBuffer, err = services.ProcesarPlantilla(factura, trabajo.Plantilla)
+	} else {
+		logoBytes, errLogo := services.CargarLogoPlantilla("1")
+		if errLogo != nil {
+			log.Printf("Error al cargar logo del admin: %v", errLogo)
+		}
+		pdfBuffer, _, err = services.GenerarPDFDesdeXML(xmlTimbrado, services.OpcionesPDF{Logo: logoBytes, Observaciones: factura.Observaciones, Tema: temaPDFEmisor(factura.EmisorRFC)})
+	}
+	if err != nil {
+		// El CFDI ya está timbrado; el siguiente intento solo regenera el PDF
+		reintentar(fmt.Errorf("CFDI timbrado (UUID %s) pero falló el PDF: %w", timbre.UUID, err))
+		return
+	}
+
+	// CFDI, historial, archivo, folio y trabajo generado se registran juntos; si falla, el siguiente
+	// intento recupera el CFDI ya timbrado en lugar de timbrar otro
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		reintentar(fmt.Errorf("CFDI timbrado (UUID %s) pero no se pudo registrar: %w", timbre.UUID, err))
+		return
+	}
+	_, err = registrarComprobanteTimbrado(tx, &factura, xmlTimbrado, nil, func(int64) error {
+		return models.CompletarTrabajoFactura(tx, trabajo.ID, timbre.UUID, xmlTimbrado, pdfBuffer.Bytes())
+	})
+	if err != nil {
+		reintentar(fmt.Errorf("CFDI timbrado (UUID %s) pero no se pudo registrar: %w", timbre.UUID, err))
+		return
+	}
+	log.Printf("[COLA] Trabajo %d generado con UUID %s", trabajo.ID, timbre.UUID)
+}
@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"Facts/internal/models"
+	"Facts/internal/services"
+)
+
+// intervaloEventos reenvía el estatus aunque no llegue aviso (trabajos tomados por otra instancia)
+const intervaloEventos = 3 * time.Second
+
+// EncolarFacturaHandler valida la factura y la deja pendiente de timbrar con su folio ya reservado.
+// Responde 202 con el id del trabajo para consultar su estatus.
+func EncolarFacturaHandler(optimusDB *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, MetodoNoPermitido, http.StatusMethodNotAllowed)
+			return
+		}
+		factura, plantillaBytes, err := procesarDatosFactura(r)
+		if err != nil {
+			log.Printf("Error al decodificar solicitud: %v", err)
+			http.Error(w, "Error al procesar los datos: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		// El ticket queda apartado hasta que el trabajo se guarda con su clave_ticket
+		liberarTicket, ok := verificarTicketFacturable(optimusDB, w, &factura)
+		if !ok {
+			return
+		}
+		defer liberarTicket()
+		if estatus, err := prepararFactura(&factura); err != nil {
+			http.Error(w, err.Error(), estatus)
+			return
+		}
+
+		id, err := models.EncolarFactura(&factura, plantillaBytes)
+		if err != nil {
+			log.Printf("[COLA] %v", err)
+			http.Error(w, "Error al encolar la factura", http.StatusInternalServerError)
+			return
+		}
+		select {
+		case despertarCola <- struct{}{}:
+		default:
+		}
+		log.Printf("[COLA] Factura %s encolada como trabajo %d", factura.NumeroFolio, id)
+
+		w.Header().Set(ContentTypeHeader, ApplicationJSON)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":           id,
+			"numero_folio": factura.NumeroFolio,
+			"estatus":      models.EstatusFacPendiente,
+		})
+	}
+}
+
+// idRuta lee el {id} de /api/facturas/{id}/...
+func idRuta(r *http.Request) (int64, error) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("id de factura inválido")
+	}
+	return id, nil
+}
+
+// estadoTrabajo es la respuesta de estatus de un trabajo de la cola
+func estadoTrabajo(t *models.TrabajoFactura) map[string]interface{} {
+	return map[string]interface{}{
+		"trabajo":             t,
+		"estatus_descripcion": models.EstatusFacDescripcion[t.Estatus],
+		"terminado":           t.Terminado(),
+	}
+}
+
+// EstadoFacturaHandler devuelve el estatus del trabajo con su historial de transiciones
+func EstadoFacturaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, MetodoNoPermitido, http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := idRuta(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	trabajo, err := models.ObtenerTrabajoFactura(id, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set(ContentTypeHeader, ApplicationJSON)
+	json.NewEncoder(w).Encode(estadoTrabajo(trabajo))
+}
+
+// EventosFacturaHandler transmite por Server-Sent Events cada cambio de estatus hasta que el
+// trabajo termina (generado o fallido) o el cliente se desconecta
+func EventosFacturaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, MetodoNoPermitido, http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := idRuta(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming no soportado", http.StatusInternalServerError)
+		return
+	}
+	// Suscribirse antes de la primera lectura para no perder un cambio intermedio
+	avisos, cancelar := suscribirTrabajo(id)
+	defer cancelar()
+
+	trabajo, err := models.ObtenerTrabajoFactura(id, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set(ContentTypeHeader, "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	ticker := time.NewTicker(intervaloEventos)
+	defer ticker.Stop()
+	ultimo := ""
+	for {
+		if firma := trabajo.Estatus + strconv.Itoa(trabajo.Intentos); firma != ultimo {
+			ultimo = firma
+			datos, _ := json.Marshal(estadoTrabajo(trabajo))
+			fmt.Fprintf(w, "event: estatus\ndata: %s\n\n", datos)
+		} else {
+			fmt.Fprint(w, ": ping\n\n")
+		}
+		flusher.Flush()
+		if trabajo.Terminado() {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-avisos:
+		case <-ticker.C:
+		}
+		if trabajo, err = models.ObtenerTrabajoFactura(id, false); err != nil {
+			log.Printf("[COLA] Error al consultar trabajo %d: %v", id, err)
+			return
+		}
+	}
+}
+
+// ArchivoFacturaHandler descarga el ZIP (PDF y XML timbrado) de un trabajo generado; ?formato=ticket cambia el PDF
+// por el ticket y ?pdfa=1 lo genera como PDF/A-3 con el XML incrustado
+func ArchivoFacturaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, MetodoNoPermitido, http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := idRuta(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	trabajo, err := models.ObtenerTrabajoFactura(id, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	anchoTicket, err := anchoTicketSolicitado(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	pdfa, err := pdfaSolicitado(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	xmlBytes, pdfBytes, err := models.ObtenerArchivosTrabajoFactura(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	factura := trabajo.Factura
+	// El PDF guardado es el de hoja; el ticket y el PDF/A se generan del XML timbrado
+	if anchoTicket > 0 || pdfa {
+		pdf, _, err := services.GenerarPDFDesdeXML(xmlBytes, services.OpcionesPDF{
+			Observaciones: factura.Observaciones, Tema: temaPDFEmisor(factura.EmisorRFC), AnchoTicket: anchoTicket, PDFA: pdfa,
+		})
+		if err != nil {
+			log.Printf("[COLA] Error al generar el PDF del trabajo %d: %v", id, err)
+			http.Error(w, "Error al generar el PDF", http.StatusInternalServerError)
+			return
+		}
+		pdfBytes = pdf.Bytes()
+	}
+	nombrePDF := GenerarNombreArchivoFactura(factura.Serie, factura.NumeroFolio, "pdf")
+	nombreXML := GenerarNombreArchivoFactura(factura.Serie, factura.NumeroFolio, "xml")
+	zipBuffer, err := services.CrearZIPConNombres(pdfBytes, xmlBytes, nombrePDF, nombreXML)
+	if err != nil {
+		log.Printf("Error al crear ZIP: %v", err)
+		http.Error(w, "Error al crear archivo ZIP", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=factura_%s.zip", factura.NumeroFolio))
+	w.Write(zipBuffer.Bytes())
+}
@@ -0,0 +1,247 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"Facts/internal/db"
+	"Facts/internal/models"
+	"Facts/internal/services"
+)
+
+// ComplementoPagoRequest registra un pago contra una o varias facturas PPD del historial
+type ComplementoPagoRequest struct {
+	IDUsuario             int         `json:"id_usuario"`
+	ReceptorCodigoPostal  string      `json:"receptor_codigo_postal"`
+	RegimenFiscalReceptor string      `json:"regimen_fiscal_receptor"`
+	Pago                  models.Pago `json:"pago"`
+}
+
+// completarDocumentosPago bloquea cada factura pagada dentro de tx y toma su saldo y parcialidad con el
+// bloqueo tomado; el UUID, la moneda y los impuestos salen de su XML timbrado archivado. Devuelve la
+// primera factura y su XML, de donde se toman los datos del receptor.
+func completarDocumentosPago(tx *sql.Tx, req *ComplementoPagoRequest) (*models.HistorialFactura, []byte, error) {
+	var primera *models.HistorialFactura
+	var xmlPrimera []byte
+	vistos := make(map[int]bool, len(req.Pago.Documentos))
+	for i := range req.Pago.Documentos {
+		d := &req.Pago.Documentos[i]
+		if vistos[d.IDHistorial] {
+			return nil, nil, fmt.Errorf("documento %d: la factura %d viene repetida en el pago", i+1, d.IDHistorial)
+		}
+		vistos[d.IDHistorial] = true
+		original, err := models.ObtenerFacturaPorID(d.IDHistorial)
+		if err != nil {
+			return nil, nil, fmt.Errorf("documento %d: %w", i+1, err)
+		}
+		if original.IDUsuario != req.IDUsuario {
+			return nil, nil, fmt.Errorf("documento %d: la factura %s no pertenece al usuario", i+1, original.NumeroFolio)
+		}
+		if err := originalVigente(original); err != nil {
+			return nil, nil, fmt.Errorf("documento %d: %w", i+1, err)
+		}
+		if primera != nil && !strings.EqualFold(primera.RFCReceptor, original.RFCReceptor) {
+			return nil, nil, fmt.Errorf("documento %d: todas las facturas deben ser del mismo receptor (%s)", i+1, primera.RFCReceptor)
+		}
+
+		xmlTimbrado, err := xmlArchivadoFactura(original)
+		if errors.Is(err, errSinXMLTimbrado) {
+			return nil, nil, fmt.Errorf("documento %d: la factura %s no está timbrada", i+1, original.NumeroFolio)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("documento %d: %w", i+1, err)
+		}
+		if primera == nil {
+			primera, xmlPrimera = original, xmlTimbrado
+		}
+		if err := services.DocumentoPagoDesdeXML(d, xmlTimbrado); err != nil {
+			return nil, nil, fmt.Errorf("documento %d: %w", i+1, err)
+		}
+		parcialidad, saldo, err := models.BloquearFacturaPagada(tx, original.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		d.Folio = original.NumeroFolio
+		d.NumParcialidad = parcialidad
+		d.ImpSaldoAnt = saldo
+		d.ImpSaldoInsoluto = saldo - d.ImpPagado
+	}
+	return primera, xmlPrimera, nil
+}
+
+// apartarDocumentosPago toma saldo y parcialidad de las facturas pagadas con el bloqueo tomado, valida
+// el pago y aparta sus montos; el bloqueo se libera antes de timbrar. Devuelve la primera factura, su
+// XML y las relaciones apartadas. Si falla ya respondió al cliente.
+func apartarDocumentosPago(w http.ResponseWriter, req *ComplementoPagoRequest) (*models.HistorialFactura, []byte, []models.CFDIRelacionado, bool) {
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		http.Error(w, "Error al iniciar la transacción", http.StatusInternalServerError)
+		return nil, nil, nil, false
+	}
+	defer tx.Rollback()
+	primera, xmlPrimera, err := completarDocumentosPago(tx, req)
+	if errors.Is(err, errOriginalCancelado) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return nil, nil, nil, false
+	}
+	if err != nil {
+		log.Printf("[REP] Documentos inválidos: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, nil, nil, false
+	}
+	if err := services.ValidarPago(req.Pago); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, nil, nil, false
+	}
+
+	relaciones := make([]models.CFDIRelacionado, 0, len(req.Pago.Documentos))
+	for _, d := range req.Pago.Documentos {
+		relaciones = append(relaciones, models.CFDIRelacionado{
+			IDHistorialOrigen: d.IDHistorial,
+			UUIDOrigen:        d.IdDocumento,
+			TipoComprobante:   "P",
+			Monto:             d.ImpPagado,
+		})
+	}
+	if err := models.ApartarRelacionesCFDI(tx, relaciones); err != nil {
+		log.Printf("[REP] %v", err)
+		http.Error(w, "Error al apartar el saldo de las facturas pagadas", http.StatusInternalServerError)
+		return nil, nil, nil, false
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error al apartar el saldo de las facturas pagadas", http.StatusInternalServerError)
+		return nil, nil, nil, false
+	}
+	return primera, xmlPrimera, relaciones, true
+}
+
+// ComplementoPagoHandler genera, sella y timbra un CFDI tipo "P" (REP 2.0) y registra el pago en el historial
+func ComplementoPagoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, MetodoNoPermitido, http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ComplementoPagoRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Error al procesar los datos: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.IDUsuario <= 0 {
+		http.Error(w, "Se requiere id_usuario", http.StatusBadRequest)
+		return
+	}
+	if len(req.Pago.FechaPago) == len("2006-01-02") {
+		req.Pago.FechaPago += "T12:00:00"
+	}
+
+	// Los montos se apartan contra el saldo de cada factura y el bloqueo se libera antes de timbrar;
+	// otro pago o egreso ve los montos apartados
+	receptor, xmlReceptor, relaciones, ok := apartarDocumentosPago(w, &req)
+	if !ok {
+		return
+	}
+	timbrado := false
+	defer func() {
+		if !timbrado {
+			if err := models.LiberarRelacionesCFDI(relaciones); err != nil {
+				log.Printf("[REP] %v", err)
+			}
+		}
+	}()
+
+	factura := models.Factura{
+		IdUsuario:             req.IDUsuario,
+		TipoComprobante:       "P",
+		ReceptorRFC:           receptor.RFCReceptor,
+		ReceptorRazonSocial:   receptor.RazonSocialReceptor,
+		ReceptorCodigoPostal:  req.ReceptorCodigoPostal,
+		RegimenFiscalReceptor: req.RegimenFiscalReceptor,
+		UsoCFDI:               "CP01",
+		Pagos:                 []models.Pago{req.Pago},
+	}
+	if err := LlenarDatosEmisor(&factura, factura.IdUsuario); err != nil {
+		http.Error(w, "No hay datos fiscales del emisor", http.StatusBadRequest)
+		return
+	}
+	if factura.RegimenFiscalReceptor != "" {
+		if codigo, err := ObtenerCodigoRegimenFiscal(factura.RegimenFiscalReceptor); err == nil {
+			factura.RegimenFiscalReceptor = codigo
+		}
+	}
+	if err := aplicarReceptorOriginal(&factura, xmlReceptor); err != nil {
+		log.Printf("[REP] %v", err)
+		http.Error(w, "No se pudo leer el receptor de la factura pagada", http.StatusInternalServerError)
+		return
+	}
+	if factura.KeyPath == "" || factura.ClaveCSD == "" {
+		http.Error(w, "Faltan datos para la firma digital (archivo .key o clave CSD)", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		http.Error(w, "Error al iniciar la transacción", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if err := factura.AsignarFolio(tx); err != nil {
+		log.Printf("[REP] Error al generar folio: %v", err)
+		http.Error(w, "Error al generar folio del complemento de pago", http.StatusInternalServerError)
+		return
+	}
+
+	xmlFirmado, err := firmarCFDI(factura)
+	if err != nil {
+		log.Printf("[REP] Error al generar XML firmado: %v", err)
+		http.Error(w, "Error al generar XML firmado del complemento de pago: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Timbrado con el PAC configurado para el emisor
+	xmlTimbrado, err := timbrarConPACConfigurado(factura.IdUsuario, xmlFirmado)
+	if errors.Is(err, errPACNoConfigurado) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		log.Printf("[REP] Error al timbrar: %v", err)
+		http.Error(w, "Error al timbrar con PAC: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	// Ya existe ante el SAT: los apartados se quedan aunque falle el registro
+	timbrado = true
+	timbre, err := services.ExtraerTimbreFiscalDigital(xmlTimbrado)
+	if err != nil {
+		http.Error(w, "Error extrayendo timbre fiscal: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	folios := make([]string, 0, len(req.Pago.Documentos))
+	for _, d := range req.Pago.Documentos {
+		folios = append(folios, d.Folio)
+	}
+	factura.Total = 0
+	factura.Observaciones = fmt.Sprintf("Complemento de pago aplicado a: %s", strings.Join(folios, ", "))
+	if _, err := registrarComprobanteTimbrado(tx, &factura, xmlTimbrado, relaciones); err != nil {
+		log.Printf("[REP] Complemento de pago %s timbrado (UUID %s) sin registrar: %v", factura.NumeroFolio, timbre.UUID, err)
+		http.Error(w, fmt.Sprintf("El complemento de pago se timbró con UUID %s pero no se pudo registrar: %v", timbre.UUID, err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(ContentTypeHeader, "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":     "success",
+		"uuid":       timbre.UUID,
+		"folio":      factura.NumeroFolio,
+		"xml":        string(xmlTimbrado),
+		"documentos": req.Pago.Documentos,
+	})
+	log.Printf("[REP] Complemento de pago %s timbrado (UUID %s)", factura.NumeroFolio, timbre.UUID)
+}
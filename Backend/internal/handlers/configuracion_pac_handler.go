@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"Facts/internal/db"
+	"Facts/internal/pac"
+)
+
+// ConfiguracionPACRequest son los datos del PAC que el emisor guarda junto a sus datos fiscales
+type ConfiguracionPACRequest struct {
+	IDUsuario  int    `json:"id_usuario"`
+	Proveedor  string `json:"proveedor"`
+	Usuario    string `json:"usuario"`
+	Contrasena string `json:"contrasena"` // Vacía conserva la contraseña guardada
+	Produccion bool   `json:"produccion"`
+}
+
+// ConfiguracionPACHandler consulta (GET) o guarda (POST) el PAC y ambiente del emisor
+func ConfiguracionPACHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		obtenerConfiguracionPAC(w, r)
+	case http.MethodPost:
+		guardarConfiguracionPAC(w, r)
+	default:
+		http.Error(w, MetodoNoPermitido, http.StatusMethodNotAllowed)
+	}
+}
+
+// obtenerConfiguracionPAC devuelve la configuración sin contraseña; con ?saldo=1 consulta los timbres disponibles
+func obtenerConfiguracionPAC(w http.ResponseWriter, r *http.Request) {
+	idUsuario, err := strconv.Atoi(r.URL.Query().Get("id_usuario"))
+	if err != nil || idUsuario <= 0 {
+		http.Error(w, "Se requiere id_usuario", http.StatusBadRequest)
+		return
+	}
+	cfg, err := db.ObtenerConfigPAC(idUsuario)
+	if err != nil {
+		log.Printf("[PAC] Error al obtener configuración: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	respuesta := map[string]interface{}{
+		"configuracion": cfg,
+		"configurado":   cfg.Usuario != "" && cfg.Contrasena != "",
+		"proveedores":   pac.Disponibles(),
+	}
+	if r.URL.Query().Get("saldo") == "1" {
+		proveedor, err := pac.Nuevo(cfg)
+		if err == nil {
+			var saldo int
+			if saldo, err = proveedor.Saldo(); err == nil {
+				respuesta["saldo"] = saldo
+			}
+		}
+		if err != nil {
+			respuesta["error_saldo"] = err.Error()
+		}
+	}
+
+	w.Header().Set(ContentTypeHeader, ApplicationJSON)
+	json.NewEncoder(w).Encode(respuesta)
+}
+
+// guardarConfiguracionPAC valida el proveedor y guarda las credenciales en datos_fiscales
+func guardarConfiguracionPAC(w http.ResponseWriter, r *http.Request) {
+	var req ConfiguracionPACRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Error al procesar los datos: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.IDUsuario <= 0 {
+		http.Error(w, "Se requiere id_usuario", http.StatusBadRequest)
+		return
+	}
+	req.Proveedor = strings.ToLower(strings.TrimSpace(req.Proveedor))
+	if req.Proveedor == "" {
+		req.Proveedor = pac.ProveedorPorDefecto
+	}
+	valido := false
+	for _, nombre := range pac.Disponibles() {
+		if nombre == req.Proveedor {
+			valido = true
+			break
+		}
+	}
+	if !valido {
+		http.Error(w, "Proveedor PAC no soportado: "+req.Proveedor, http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Usuario) == "" {
+		http.Error(w, "Se requiere el usuario del PAC", http.StatusBadRequest)
+		return
+	}
+
+	err := db.GuardarConfigPAC(req.IDUsuario, pac.Config{
+		Proveedor:  req.Proveedor,
+		Usuario:    strings.TrimSpace(req.Usuario),
+		Contrasena: req.Contrasena,
+		Produccion: req.Produccion,
+	})
+	if err != nil {
+		log.Printf("[PAC] Error al guardar configuración: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("[PAC] Usuario %d configurado con %s (producción: %t)", req.IDUsuario, req.Proveedor, req.Produccion)
+	w.Header().Set(ContentTypeHeader, ApplicationJSON)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  "success",
+		"message": "Configuración del PAC guardada",
+	})
+}
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"Facts/internal/models"
+	"Facts/internal/pac"
+	"Facts/internal/services"
+)
+
+// ConsultaSATRequest son los datos de la expresión impresa cuando no se envía el XML
+type ConsultaSATRequest struct {
+	RFCEmisor   string `json:"rfc_emisor"`
+	RFCReceptor string `json:"rfc_receptor"`
+	Total       string `json:"total"`
+	UUID        string `json:"uuid"`
+}
+
+// consultaFacturaHistorial arma la consulta de una factura emitida a partir de su XML timbrado
+// archivado; no se busca por folio porque el folio puede repetirse entre emisores
+func consultaFacturaHistorial(factura *models.HistorialFactura) (pac.ConsultaEstado, error) {
+	xmlTimbrado, err := xmlArchivadoFactura(factura)
+	if errors.Is(err, errSinXMLTimbrado) {
+		return pac.ConsultaEstado{}, fmt.Errorf("la factura %s no está timbrada", factura.NumeroFolio)
+	}
+	if err != nil {
+		return pac.ConsultaEstado{}, err
+	}
+	return services.ConsultaDesdeXML(xmlTimbrado)
+}
+
+// EstadoSATFacturaHandler consulta al SAT el estado de la factura {id} del historial.
+// Usa la caché salvo con ?actualizar=1.
+func EstadoSATFacturaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, MetodoNoPermitido, http.StatusMethodNotAllowed)
+		return
+	}
+	idHistorial, err := idRuta(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	factura, err := models.ObtenerFacturaPorID(int(idHistorial))
+	if err != nil {
+		http.Error(w, "Factura no encontrada", http.StatusNotFound)
+		return
+	}
+	consulta, err := consultaFacturaHistorial(factura)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	responderConsultaSAT(w, consulta, r.URL.Query().Get("actualizar") == "1")
+}
+
+// ConsultaSATHandler consulta al SAT el estado de cualquier CFDI: se envía el XML timbrado
+// (campo "xml" multipart o el cuerpo tal cual) o los datos re/rr/tt/id en JSON
+func ConsultaSATHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, MetodoNoPermitido, http.StatusMethodNotAllowed)
+		return
+	}
+
+	var consulta pac.ConsultaEstado
+	tipo := r.Header.Get("Content-Type")
+	switch {
+	case strings.HasPrefix(tipo, "application/json"):
+		var req ConsultaSATRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Error al procesar los datos: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.RFCEmisor == "" || req.RFCReceptor == "" || req.Total == "" || req.UUID == "" {
+			http.Error(w, "Se requieren rfc_emisor, rfc_receptor, total y uuid", http.StatusBadRequest)
+			return
+		}
+		consulta = pac.ConsultaEstado{RFCEmisor: req.RFCEmisor, RFCReceptor: req.RFCReceptor, Total: req.Total, UUID: req.UUID}
+	default:
+		xmlBytes, err := leerXMLSubido(w, r)
+		if err != nil {
+			http.Error(w, "Error al leer el XML: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if consulta, err = services.ConsultaDesdeXML(xmlBytes); err != nil {
+			http.Error(w, "XML inválido: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	responderConsultaSAT(w, consulta, r.URL.Query().Get("actualizar") == "1")
+}
+
+func responderConsultaSAT(w http.ResponseWriter, consulta pac.ConsultaEstado, actualizar bool) {
+	servicio := services.ConsultaSAT()
+	var estado *pac.EstadoCFDI
+	var err error
+	if actualizar {
+		estado, err = servicio.Actualizar(consulta)
+	} else {
+		estado, err = servicio.Consultar(consulta)
+	}
+	if err != nil {
+		log.Printf("[SAT] Error al consultar UUID %s: %v", consulta.UUID, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set(ContentTypeHeader, ApplicationJSON)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"uuid":              consulta.UUID,
+		"expresion_impresa": pac.ExpresionImpresa(consulta),
+		"estado":            estado,
+	})
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"Facts/internal/secretos"
 	"Facts/internal/utils"
 	"database/sql"
 	"io/ioutil"
@@ -45,10 +46,27 @@ func AltaDatosFiscalesHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		// La llave privada se guarda sellada en ambos formatos, ligada al emisor y a su certificado
+		id, err := secretos.IdentidadCertificado(r.FormValue("rfc"), cerBytes)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		keySellada, err := secretos.SellarLlaveCSD(keyBytes, id)
+		if err != nil {
+			http.Error(w, "Error cifrando la llave .key: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		keyPEMSellada, err := secretos.SellarLlaveCSD([]byte(keyPEM), id)
+		if err != nil {
+			http.Error(w, "Error cifrando la llave .key: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
 		// Ejemplo de SQL para guardar ambos formatos
 		// Asume que recibes también los demás campos requeridos (rfc, razon_social, etc.)
 		query := `INSERT INTO datos_fiscales (rfc, razon_social, archivo_cer, archivo_key, archivo_cer_pem, archivo_key_pem) VALUES (?, ?, ?, ?, ?, ?)`
-		_, err = db.Exec(query, r.FormValue("rfc"), r.FormValue("razon_social"), cerBytes, keyBytes, cerPEM, keyPEM)
+		_, err = db.Exec(query, r.FormValue("rfc"), r.FormValue("razon_social"), cerBytes, keySellada, cerPEM, string(keyPEMSellada))
 		if err != nil {
 			http.Error(w, "Error guardando en base de datos: "+err.Error(), http.StatusInternalServerError)
 			return
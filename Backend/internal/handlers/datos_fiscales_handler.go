@@ -2,12 +2,14 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strconv"
 
 	"Facts/internal/db"
+	"Facts/internal/utils"
 )
 
 // GetDatosFiscalesHandler maneja la solicitud GET para obtener datos fiscales
@@ -52,6 +54,11 @@ func GetDatosFiscalesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// La contraseña sellada no sale al cliente; solo se indica si está registrada
+	claveCSD, _ := datos["clave_csd"].(string)
+	datos["tiene_clave_csd"] = claveCSD != ""
+	delete(datos, "clave_csd")
+
 	// Responder con JSON
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(datos)
@@ -65,6 +72,9 @@ func UpdateDatosFiscalesHandler(w http.ResponseWriter, r *http.Request) {
 	// Depuración - imprimir todos los valores del formulario
 	fmt.Println("==== DATOS RECIBIDOS EN EL FORMULARIO ====")
 	for key, values := range r.Form {
+		if key == "clave_csd" {
+			continue // la contraseña del CSD no se escribe en el log
+		}
 		fmt.Printf("%s: %v\n", key, values)
 	}
 
@@ -191,6 +201,15 @@ func UpdateDatosFiscalesHandler(w http.ResponseWriter, r *http.Request) {
 		userID,
 		keyPath, // NUEVO argumento para la ruta .key
 	)
+	var errCSD *utils.ErrorValidacionCSD
+	if errors.As(err, &errCSD) {
+		utils.RespondWithJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+			"status":  "error",
+			"codigo":  errCSD.Codigo,
+			"message": errCSD.Mensaje,
+		})
+		return
+	}
 	if err != nil {
 		fmt.Printf("Error al guardar datos fiscales para usuario %d: %v\n", userID, err)
 		http.Error(w, "Error al guardar datos fiscales", http.StatusInternalServerError)
@@ -215,47 +234,24 @@ func DescargarCertificadoHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Obtener el tipo de certificado a descargar (key o cer)
+	// Obtener el tipo de certificado a descargar; la llave privada no se puede descargar
 	tipoArchivo := r.URL.Query().Get("tipo")
-	if tipoArchivo != "key" && tipoArchivo != "cer" {
-		http.Error(w, "Tipo de archivo inválido", http.StatusBadRequest)
+	if tipoArchivo == "key" {
+		http.Error(w, "La llave privada del CSD no se puede descargar", http.StatusForbidden)
 		return
 	}
-
-	// Obtener los archivos binarios
-	archivoKey, archivoCer, err := db.ObtenerCertificadosCSD(userID)
-	if err != nil {
-		http.Error(w, "Error al obtener certificados", http.StatusInternalServerError)
+	if tipoArchivo != "cer" {
+		http.Error(w, "Tipo de archivo inválido", http.StatusBadRequest)
 		return
 	}
 
-	// Obtener datos fiscales para los nombres de archivos
-	datos, err := db.ObtenerDatosFiscales(userID)
+	// Obtener el certificado
+	contenidoArchivo, err := db.ObtenerCertificadoCSD(userID)
 	if err != nil {
-		http.Error(w, "Error al obtener datos fiscales", http.StatusInternalServerError)
+		http.Error(w, "Error al obtener certificados", http.StatusInternalServerError)
 		return
 	}
-
-	var nombreArchivo string
-	var contenidoArchivo []byte
-
-	if tipoArchivo == "key" {
-		// Usar el nombre del archivo desde datos si está disponible
-		if datos["archivo_csd_key"] != nil {
-			nombreArchivo = "certificado.key" // O usar un nombre más específico
-		} else {
-			nombreArchivo = "certificado.key"
-		}
-		contenidoArchivo = archivoKey
-	} else {
-		// Usar el nombre del archivo desde datos si está disponible
-		if datos["archivo_csd_cer"] != nil {
-			nombreArchivo = "certificado.cer" // O usar un nombre más específico
-		} else {
-			nombreArchivo = "certificado.cer"
-		}
-		contenidoArchivo = archivoCer
-	}
+	nombreArchivo := "certificado.cer"
 
 	// Configurar los headers para la descarga
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", nombreArchivo))
@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"Facts/internal/models"
+)
+
+// verificarTicketFacturable aplica las reglas de autofacturación antes de facturar un ticket.
+// El ticket se aparta en la base de datos para que dos solicitudes simultáneas, aunque lleguen a
+// instancias distintas, no lo facturen dos veces. Si el ticket no es elegible responde con los
+// motivos y devuelve false; si lo es, devuelve la función que lo libera al terminar.
+func verificarTicketFacturable(optimusDB *sql.DB, w http.ResponseWriter, factura *models.Factura) (func(), bool) {
+	if factura.ClaveTicket == "" {
+		return func() {}, true
+	}
+	// El apartado es por emisor, el mismo que LlenarDatosEmisor pondrá en la factura
+	emisor := models.Factura{IdUsuario: factura.IdUsuario}
+	if err := LlenarDatosEmisor(&emisor, emisor.IdUsuario); err != nil {
+		log.Printf("[AUTOFACTURA] %v", err)
+		http.Error(w, "No hay datos fiscales del emisor", http.StatusBadRequest)
+		return nil, false
+	}
+	rfcEmisor := strings.ToUpper(strings.TrimSpace(emisor.EmisorRFC))
+	apartado, err := models.ApartarTicket(rfcEmisor, factura.ClaveTicket)
+	if err != nil {
+		log.Printf("[AUTOFACTURA] %v", err)
+		http.Error(w, "Error al verificar el ticket", http.StatusInternalServerError)
+		return nil, false
+	}
+	if !apartado {
+		responderTicketNoElegible(w, &models.ElegibilidadTicket{
+			ClaveTicket: factura.ClaveTicket,
+			Motivos: []models.MotivoTicket{{
+				Codigo:  models.TicketEnProceso,
+				Mensaje: "Este ticket ya tiene una factura en proceso; en unos minutos podrá descargarla",
+			}},
+		})
+		return nil, false
+	}
+	liberar := func() {
+		if err := models.LiberarTicket(rfcEmisor, factura.ClaveTicket); err != nil {
+			log.Printf("[AUTOFACTURA] %v", err)
+		}
+	}
+
+	elegibilidad, err := models.VerificarElegibilidadTicket(optimusDB, factura.ClaveTicket, factura.IdUsuario)
+	if err != nil {
+		liberar()
+		log.Printf("[AUTOFACTURA] %v", err)
+		http.Error(w, "Error al verificar el ticket", http.StatusInternalServerError)
+		return nil, false
+	}
+	if !elegibilidad.Elegible {
+		liberar()
+		log.Printf("[AUTOFACTURA] Ticket %s rechazado: %v", factura.ClaveTicket, elegibilidad.Motivos)
+		responderTicketNoElegible(w, elegibilidad)
+		return nil, false
+	}
+	return liberar, true
+}
+
+// responderTicketNoElegible devuelve los motivos en JSON: 400 si la clave es inválida, 404 si el
+// ticket no existe y 409 en otro caso
+func responderTicketNoElegible(w http.ResponseWriter, elegibilidad *models.ElegibilidadTicket) {
+	estatus := http.StatusConflict
+	switch {
+	case elegibilidad.Tiene(models.TicketClaveInvalida):
+		estatus = http.StatusBadRequest
+	case elegibilidad.Tiene(models.TicketNoEncontrado):
+		estatus = http.StatusNotFound
+	}
+	mensajes := make([]string, 0, len(elegibilidad.Motivos))
+	for _, m := range elegibilidad.Motivos {
+		mensajes = append(mensajes, m.Mensaje)
+	}
+	w.Header().Set(ContentTypeHeader, ApplicationJSON)
+	w.WriteHeader(estatus)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":        strings.Join(mensajes, ". "),
+		"elegibilidad": elegibilidad,
+	})
+}
+
+// ElegibilidadTicketHandler indica si el ticket ?clave_ticket= se puede autofacturar con el emisor
+// ?id_usuario= y, si no, los motivos para mostrarlos al cliente
+func ElegibilidadTicketHandler(optimusDB *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, MetodoNoPermitido, http.StatusMethodNotAllowed)
+			return
+		}
+		claveTicket := strings.TrimSpace(r.URL.Query().Get("clave_ticket"))
+		idUsuario, _ := strconv.Atoi(r.URL.Query().Get("id_usuario"))
+
+		elegibilidad, err := models.VerificarElegibilidadTicket(optimusDB, claveTicket, idUsuario)
+		if err != nil {
+			log.Printf("[AUTOFACTURA] %v", err)
+			http.Error(w, "Error al verificar el ticket", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set(ContentTypeHeader, ApplicationJSON)
+		json.NewEncoder(w).Encode(elegibilidad)
+	}
+}
+
+// ConfiguracionAutofacturaRequest es el plazo de autofacturación que guarda el emisor
+type ConfiguracionAutofacturaRequest struct {
+	IDUsuario int `json:"id_usuario"`
+	models.VentanaAutofactura
+}
+
+// ConfiguracionAutofacturaHandler consulta (GET) o guarda (POST) el plazo de autofacturación del emisor
+func ConfiguracionAutofacturaHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		idUsuario, err := strconv.Atoi(r.URL.Query().Get("id_usuario"))
+		if err != nil || idUsuario <= 0 {
+			http.Error(w, "Se requiere id_usuario", http.StatusBadRequest)
+			return
+		}
+		ventana, err := models.ObtenerVentanaAutofactura(idUsuario)
+		if err != nil {
+			log.Printf("[AUTOFACTURA] %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set(ContentTypeHeader, ApplicationJSON)
+		json.NewEncoder(w).Encode(ventana)
+	case http.MethodPost:
+		var req ConfiguracionAutofacturaRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Error al procesar los datos: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.IDUsuario <= 0 {
+			http.Error(w, "Se requiere id_usuario", http.StatusBadRequest)
+			return
+		}
+		req.Modo = strings.ToLower(strings.TrimSpace(req.Modo))
+		if err := models.ValidarVentanaAutofactura(&req.VentanaAutofactura); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := models.GuardarVentanaAutofactura(req.IDUsuario, req.VentanaAutofactura); err != nil {
+			log.Printf("[AUTOFACTURA] %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("[AUTOFACTURA] Usuario %d: plazo %s (%d días)", req.IDUsuario, req.Modo, req.Dias)
+		w.Header().Set(ContentTypeHeader, ApplicationJSON)
+		json.NewEncoder(w).Encode(req.VentanaAutofactura)
+	default:
+		http.Error(w, MetodoNoPermitido, http.StatusMethodNotAllowed)
+	}
+}
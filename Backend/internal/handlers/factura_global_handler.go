@@ -0,0 +1,268 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"Facts/internal/db"
+	"Facts/internal/models"
+	"Facts/internal/services"
+)
+
+// errSinTicketsGlobal indica que el periodo no tiene tickets pendientes de facturar
+var errSinTicketsGlobal = errors.New("no hay tickets sin facturar en el periodo")
+
+// FacturaGlobalRequest son los datos para emitir la factura global de un periodo
+type FacturaGlobalRequest struct {
+	IDUsuario    int    `json:"id_usuario"`
+	Periodicidad string `json:"periodicidad"`
+	Meses        string `json:"meses"`
+	Anio         string `json:"anio"`
+	FechaInicio  string `json:"fecha_inicio"` // Requeridas para periodicidad diaria, semanal o quincenal (AAAA-MM-DD)
+	FechaFin     string `json:"fecha_fin"`    // Inclusiva
+	FormaPago    string `json:"forma_pago"`
+}
+
+// ResultadoFacturaGlobal resume la factura global emitida
+type ResultadoFacturaGlobal struct {
+	IDFacturaGlobal int64   `json:"id_factura_global"`
+	Folio           string  `json:"folio"`
+	UUID            string  `json:"uuid"`
+	Tickets         int     `json:"tickets"`
+	Total           float64 `json:"total"`
+	XML             string  `json:"xml"`
+}
+
+// periodoFacturaGlobal devuelve el rango [desde, hasta) del periodo solicitado
+func periodoFacturaGlobal(req FacturaGlobalRequest, info models.InformacionGlobal) (time.Time, time.Time, error) {
+	if req.FechaInicio == "" && req.FechaFin == "" {
+		return models.PeriodoInformacionGlobal(info)
+	}
+	desde, err := time.ParseInLocation("2006-01-02", req.FechaInicio, time.Local)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("fecha_inicio inválida: %w", err)
+	}
+	fin, err := time.ParseInLocation("2006-01-02", req.FechaFin, time.Local)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("fecha_fin inválida: %w", err)
+	}
+	if fin.Before(desde) {
+		return time.Time{}, time.Time{}, fmt.Errorf("fecha_fin no puede ser anterior a fecha_inicio")
+	}
+	return desde, fin.AddDate(0, 0, 1), models.ValidarInformacionGlobal(info)
+}
+
+// conceptosFacturaGlobal arma un concepto por ticket (y tasa de IVA) como lo pide el SAT
+func conceptosFacturaGlobal(tickets []models.TicketGlobal) []models.Concepto {
+	conceptos := make([]models.Concepto, 0, len(tickets))
+	for _, t := range tickets {
+		conceptos = append(conceptos, models.Concepto{
+			NoIdentificacion: t.ClaveTicket,
+			ClaveProdServ:    models.ClaveProdServFacturaGlobal,
+			ClaveUnidad:      models.ClaveUnidadFacturaGlobal,
+			Descripcion:      models.DescripcionFacturaGlobal,
+			Cantidad:         1,
+			ValorUnitario:    t.Importe,
+			Importe:          t.Importe,
+			Descuento:        t.Descuento,
+			TasaIVA:          t.TasaIVA,
+		})
+	}
+	return conceptos
+}
+
+// emitirFacturaGlobal genera, sella y timbra la factura global del periodo y marca sus tickets
+func emitirFacturaGlobal(optimusDB *sql.DB, req FacturaGlobalRequest) (*ResultadoFacturaGlobal, error) {
+	info := models.InformacionGlobal{Periodicidad: req.Periodicidad, Meses: req.Meses, Anio: req.Anio}
+	desde, hasta, err := periodoFacturaGlobal(req, info)
+	if err != nil {
+		return nil, err
+	}
+	existe, err := models.ExisteFacturaGlobal(req.IDUsuario, info, desde)
+	if err != nil {
+		return nil, err
+	}
+	if existe {
+		return nil, fmt.Errorf("ya existe una factura global para el periodo %s/%s", info.Meses, info.Anio)
+	}
+
+	factura := models.Factura{
+		IdUsuario:             req.IDUsuario,
+		TipoComprobante:       "I",
+		ReceptorRFC:           models.RFCPublicoGeneral,
+		ReceptorRazonSocial:   models.NombrePublicoGeneral,
+		RegimenFiscalReceptor: models.RegimenPublicoGeneral,
+		UsoCFDI:               models.UsoCFDIPublicoGeneral,
+		MetodoPago:            "PUE",
+		FormaPago:             req.FormaPago,
+		InformacionGlobal:     &info,
+		Observaciones:         fmt.Sprintf("Factura global del %s al %s", desde.Format("2006-01-02"), hasta.AddDate(0, 0, -1).Format("2006-01-02")),
+	}
+	if err := LlenarDatosEmisor(&factura, factura.IdUsuario); err != nil {
+		return nil, fmt.Errorf("no hay datos fiscales del emisor: %w", err)
+	}
+
+	// Solo entran los tickets de la empresa del emisor
+	tickets, err := models.ObtenerTicketsSinFacturar(optimusDB, factura.EmisorRFC, desde, hasta)
+	if err != nil {
+		return nil, err
+	}
+	if len(tickets) == 0 {
+		return nil, errSinTicketsGlobal
+	}
+	factura.Conceptos = conceptosFacturaGlobal(tickets)
+
+	// En la factura global el domicilio del receptor es el lugar de expedición
+	factura.ReceptorCodigoPostal = factura.EmisorCodigoPostal
+	services.CalcularTotales(&factura)
+
+	// Folio, historial, archivo y tickets de la factura global se registran en la misma transacción
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if err := factura.AsignarFolio(tx); err != nil {
+		return nil, err
+	}
+	if factura.KeyPath == "" || factura.ClaveCSD == "" {
+		return nil, fmt.Errorf("faltan datos para la firma digital (archivo .key o clave CSD)")
+	}
+
+	xmlFirmado, err := firmarCFDI(factura)
+	if err != nil {
+		return nil, fmt.Errorf("error al generar XML firmado: %w", err)
+	}
+	xmlTimbrado, err := timbrarConPACConfigurado(factura.IdUsuario, xmlFirmado)
+	if err != nil {
+		return nil, fmt.Errorf("error al timbrar con PAC: %w", err)
+	}
+	timbre, err := services.ExtraerTimbreFiscalDigital(xmlTimbrado)
+	if err != nil {
+		return nil, fmt.Errorf("error extrayendo timbre fiscal: %w", err)
+	}
+
+	claves := make([]string, 0, len(tickets))
+	vistas := make(map[string]bool, len(tickets))
+	for _, t := range tickets {
+		if !vistas[t.ClaveTicket] {
+			vistas[t.ClaveTicket] = true
+			claves = append(claves, t.ClaveTicket)
+		}
+	}
+	anio, _ := strconv.Atoi(info.Anio)
+
+	var idGlobal int64
+	_, err = registrarComprobanteTimbrado(tx, &factura, xmlTimbrado, nil, func(idHistorial int64) error {
+		var err error
+		idGlobal, err = models.RegistrarFacturaGlobal(tx, models.FacturaGlobal{
+			IDUsuario:    factura.IdUsuario,
+			IDHistorial:  int(idHistorial),
+			UUID:         timbre.UUID,
+			Periodicidad: info.Periodicidad,
+			Meses:        info.Meses,
+			Anio:         anio,
+			FechaInicio:  desde.Format("2006-01-02"),
+			FechaFin:     hasta.AddDate(0, 0, -1).Format("2006-01-02"),
+			Total:        factura.Total,
+		}, claves)
+		return err
+	})
+	if err != nil {
+		// El CFDI ya está timbrado: se informa para conciliar manualmente el historial y los tickets
+		return nil, fmt.Errorf("factura global %s timbrada (UUID %s) pero no se pudo registrar: %w", factura.NumeroFolio, timbre.UUID, err)
+	}
+
+	log.Printf("[FACTURA_GLOBAL] Factura global %s timbrada (UUID %s) con %d tickets", factura.NumeroFolio, timbre.UUID, len(claves))
+	return &ResultadoFacturaGlobal{
+		IDFacturaGlobal: idGlobal,
+		Folio:           factura.NumeroFolio,
+		UUID:            timbre.UUID,
+		Tickets:         len(claves),
+		Total:           factura.Total,
+		XML:             string(xmlTimbrado),
+	}, nil
+}
+
+// FacturaGlobalHandler emite la factura global a público en general con los tickets no facturados del periodo
+func FacturaGlobalHandler(optimusDB *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, MetodoNoPermitido, http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req FacturaGlobalRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Error al procesar los datos: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.IDUsuario <= 0 {
+			http.Error(w, "Se requiere id_usuario", http.StatusBadRequest)
+			return
+		}
+
+		resultado, err := emitirFacturaGlobal(optimusDB, req)
+		if errors.Is(err, errSinTicketsGlobal) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("[FACTURA_GLOBAL] Error: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set(ContentTypeHeader, ApplicationJSON)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":  "success",
+			"factura": resultado,
+		})
+	}
+}
+
+// IniciarFacturaGlobalMensual emite cada mes la factura global del mes anterior para los usuarios de FACTURA_GLOBAL_USUARIOS
+func IniciarFacturaGlobalMensual(optimusDB *sql.DB) {
+	var usuarios []int
+	for _, id := range strings.Split(os.Getenv("FACTURA_GLOBAL_USUARIOS"), ",") {
+		if n, err := strconv.Atoi(strings.TrimSpace(id)); err == nil && n > 0 {
+			usuarios = append(usuarios, n)
+		}
+	}
+	if len(usuarios) == 0 {
+		log.Printf("[FACTURA_GLOBAL] FACTURA_GLOBAL_USUARIOS vacío; factura global automática desactivada")
+		return
+	}
+
+	ticker := time.NewTicker(1 * time.Hour)
+	defer ticker.Stop()
+	for {
+		// Se parte del día 1 para que el 31 de marzo no dé 3 de marzo en lugar de febrero
+		hoy := time.Now()
+		anterior := time.Date(hoy.Year(), hoy.Month(), 1, 0, 0, 0, 0, time.Local).AddDate(0, -1, 0)
+		for _, idUsuario := range usuarios {
+			info := models.InformacionGlobal{
+				Periodicidad: models.PeriodicidadMensual,
+				Meses:        fmt.Sprintf("%02d", int(anterior.Month())),
+				Anio:         strconv.Itoa(anterior.Year()),
+			}
+			desde, _, _ := models.PeriodoInformacionGlobal(info)
+			if existe, err := models.ExisteFacturaGlobal(idUsuario, info, desde); err != nil || existe {
+				continue
+			}
+			req := FacturaGlobalRequest{IDUsuario: idUsuario, Periodicidad: info.Periodicidad, Meses: info.Meses, Anio: info.Anio}
+			if _, err := emitirFacturaGlobal(optimusDB, req); err != nil && !errors.Is(err, errSinTicketsGlobal) {
+				log.Printf("[FACTURA_GLOBAL] Usuario %d, periodo %s/%s: %v", idUsuario, info.Meses, info.Anio, err)
+			}
+		}
+		<-ticker.C
+	}
+}
@@ -172,7 +172,6 @@ func mapearDatosFiscales(factura *models.Factura, datosFiscales map[string]inter
 	}
 	if claveCSD, ok := datosFiscales["clave_csd"].(string); ok && claveCSD != "" {
 		factura.ClaveCSD = claveCSD
-		log.Printf("DEBUG - ClaveCSD asignado: %s", claveCSD)
 	} else {
 		log.Printf("DEBUG - No se encontró clave_csd o está vacía en datos fiscales")
 	}
@@ -2,7 +2,9 @@ package handlers
 
 import (
 	"bytes"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -29,9 +31,9 @@ func GenerarNombreArchivoFactura(serieDF, numeroFolio, extension string) string
 }
 
 // obtenerConceptosDesdeVentas obtiene los productos desde la tabla ventas_det usando la serie
-// NOTA: Actualmente la tabla ventas_det no tiene columna 'serie', usando como fallback los productos más recientes
-func obtenerConceptosDesdeVentas(claveTicket string) ([]models.Concepto, error) {
-	log.Printf("🔍 BD_DEBUG - Iniciando búsqueda de conceptos para ticket: '%s'", claveTicket)
+// NOTA: Actualmente la tabla ventas_det no tiene columna 'serie', usando como fallback los productos más recientes.
+// Cada concepto recibe los impuestos y retenciones configurados para su producto según el RFC del receptor.
+func obtenerConceptosDesdeVentas(claveTicket, rfcReceptor string) ([]models.Concepto, error) {
 	database := db.GetDB()
 
 	// Primero intentar buscar por serie (cuando la columna exista)
@@ -52,22 +54,9 @@ func obtenerConceptosDesdeVentas(claveTicket string) ([]models.Concepto, error)
 		ORDER BY id
 	`
 
-	log.Printf("🔍 BD_DEBUG - Ejecutando query con serie: '%s'", claveTicket)
-
-	// Primero verificar si existen datos con esta serie
-	var count int
-	countQuery := "SELECT COUNT(*) FROM ventas_det WHERE serie = ?"
-	err := database.QueryRow(countQuery, claveTicket).Scan(&count)
-	if err != nil {
-		log.Printf("❌ BD_DEBUG - Error al contar registros: %v", err)
-	} else {
-		log.Printf("🔍 BD_DEBUG - Registros encontrados en ventas_det con serie '%s': %d", claveTicket, count)
-	}
-
 	rows, err := database.Query(query, claveTicket)
 	if err != nil {
-		log.Printf("❌ BD_DEBUG - Error en query con serie: %v", err)
-		log.Printf("🔄 BD_DEBUG - Intentando fallback: productos más recientes")
+		log.Printf("No se pudo consultar ventas_det por serie (%v); se usan los productos más recientes", err)
 
 		// Fallback: obtener los productos más recientes (últimos 10 minutos)
 		queryFallback := `
@@ -89,7 +78,6 @@ func obtenerConceptosDesdeVentas(claveTicket string) ([]models.Concepto, error)
 
 		rows, err = database.Query(queryFallback)
 		if err != nil {
-			log.Printf("❌ BD_DEBUG - Error en query fallback: %v", err)
 			return nil, fmt.Errorf("error al consultar ventas_det: %v", err)
 		}
 	}
@@ -98,10 +86,8 @@ func obtenerConceptosDesdeVentas(claveTicket string) ([]models.Concepto, error)
 	var conceptos []models.Concepto
 	// Usar mapa para deduplicar conceptos por descripción + clave SAT
 	conceptosUnicos := make(map[string]models.Concepto)
-	rowCount := 0
 
 	for rows.Next() {
-		rowCount++
 		var concepto models.Concepto
 		var id int
 		var claveProducto, claveSat, unidadSat string
@@ -120,7 +106,7 @@ func obtenerConceptosDesdeVentas(claveTicket string) ([]models.Concepto, error)
 			&iva,
 		)
 		if err != nil {
-			log.Printf("❌ BD_DEBUG - Error al escanear fila %d: %v", rowCount, err)
+			log.Printf("Error al leer un producto de ventas_det: %v", err)
 			continue
 		}
 
@@ -129,40 +115,37 @@ func obtenerConceptosDesdeVentas(claveTicket string) ([]models.Concepto, error)
 
 		// Solo agregar si no existe este concepto único
 		if _, existe := conceptosUnicos[claveUnica]; !existe {
-			log.Printf("✅ BD_DEBUG - Fila %d: ID=%d, ClaveProd='%s', Desc='%s', ClaveSAT='%s', UnidadSAT='%s', Cant=%.2f, Precio=%.2f, IVA=%.2f",
-				rowCount, id, claveProducto, concepto.Descripcion, claveSat, unidadSat, concepto.Cantidad, concepto.ValorUnitario, iva)
-
 			// Mapear campos usando los datos reales de la tabla
 			concepto.ClaveProdServ = claveProducto // Usar clave_producto como clave del producto/servicio
 			concepto.ClaveSAT = claveSat           // Usar clave_sat como clave SAT
 			concepto.ClaveUnidad = unidadSat       // Usar unidad_sat como clave de unidad
 			concepto.Importe = total               // El total ya viene calculado
 			concepto.Descuento = descuento         // Usar el descuento de la tabla
-			concepto.TasaIVA = iva                 // Usar el IVA real de la base de datos
-			concepto.TasaIEPS = 0.0                // Sin IEPS por defecto
+			concepto.TasaIVA = iva                 // IVA registrado en la venta si el producto no tiene impuesto configurado
 
 			conceptosUnicos[claveUnica] = concepto
-		} else {
-			log.Printf("⚠️ BD_DEBUG - Concepto duplicado ignorado: Desc='%s', Cant=%.2f, Precio=%.2f",
-				concepto.Descripcion, concepto.Cantidad, concepto.ValorUnitario)
 		}
 	}
 
+	impuestos, err := models.ImpuestosProductosTicket(claveTicket)
+	if err != nil {
+		return nil, err
+	}
+
 	// Convertir mapa a slice
 	for _, concepto := range conceptosUnicos {
+		if producto, ok := impuestos[concepto.ClaveProdServ]; ok {
+			producto.AplicarAConcepto(&concepto, rfcReceptor)
+		} else {
+			log.Printf("Producto %s sin impuesto configurado; se usa IVA %.2f", concepto.ClaveProdServ, concepto.TasaIVA)
+		}
 		conceptos = append(conceptos, concepto)
 	}
 
-	log.Printf("🔍 BD_DEBUG - Total filas procesadas: %d", rowCount)
-	log.Printf("🔍 BD_DEBUG - Conceptos únicos después de deduplicación: %d", len(conceptosUnicos))
-	log.Printf("🔍 BD_DEBUG - Total conceptos finales: %d", len(conceptos))
-
 	if len(conceptos) == 0 {
-		log.Printf("❌ BD_DEBUG - No se encontraron productos para la serie '%s'", claveTicket)
 		return nil, fmt.Errorf("no se encontraron productos para la serie %s", claveTicket)
 	}
 
-	log.Printf("✅ BD_DEBUG - Retornando %d conceptos para serie '%s'", len(conceptos), claveTicket)
 	return conceptos, nil
 }
 
@@ -227,7 +210,7 @@ func procesarMultipartForm(r *http.Request) (models.Factura, []byte, error) {
 
 		if factura.ClaveTicket != "" {
 			log.Printf("🔍 FLUJO REAL - Intentando obtener conceptos desde BD para ticket: '%s'", factura.ClaveTicket)
-			conceptosBD, err := obtenerConceptosDesdeVentas(factura.ClaveTicket)
+			conceptosBD, err := obtenerConceptosDesdeVentas(factura.ClaveTicket, factura.ReceptorRFC)
 			if err != nil {
 				log.Printf("❌ FLUJO REAL - Error al obtener conceptos desde BD: %v", err)
 				log.Printf("🔄 FLUJO REAL - Continuando sin conceptos")
@@ -366,10 +349,10 @@ func sanitizarJSONProblematico(jsonStr string) string {
 	return jsonStr
 }
 
-// manejarFolio genera o valida el folio de la factura
-func manejarFolio(factura *models.Factura) error {
+// manejarFolio reserva dentro de tx, la transacción que registrará la factura, o valida su folio
+func manejarFolio(tx *sql.Tx, factura *models.Factura) error {
 	if factura.NumeroFolio == "" {
-		err := factura.GenerarFolioAutomatico()
+		err := factura.AsignarFolio(tx)
 		if err != nil {
 			return fmt.Errorf("error al generar folio automático: %v", err)
 		}
@@ -396,62 +379,29 @@ func generarArchivos(factura models.Factura, plantillaBytes []byte) (*bytes.Buff
 		logoBytes = nil
 	}
 
-	// Generar PDF
+	// Generar XML
+	xmlBytes, err := services.GenerarXML(factura)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error al generar XML: %v", err)
+	}
+
+	// Generar PDF a partir del XML
 	if len(plantillaBytes) > 0 {
 		pdfBuffer, err = services.ProcesarPlantilla(factura, plantillaBytes)
 	} else {
 		// Usar el logo de plantillas cargado
-		pdfBuffer, _, err = services.GenerarPDF(factura, nil, logoBytes)
+		pdfBuffer, _, err = services.GenerarPDFDesdeXML(xmlBytes, services.OpcionesPDF{Logo: logoBytes, Observaciones: factura.Observaciones, Tema: temaPDFEmisor(factura.EmisorRFC)})
 	}
 	if err != nil {
 		return nil, nil, fmt.Errorf("error al generar PDF: %v", err)
 	}
 
-	// Generar XML
-	xmlBytes, err := services.GenerarXML(factura)
-	if err != nil {
-		return nil, nil, fmt.Errorf("error al generar XML: %v", err)
-	}
-
 	return pdfBuffer, xmlBytes, nil
 }
 
-// guardarEnHistorial guarda la factura en el historial
-func guardarEnHistorial(factura models.Factura) {
-	if factura.IdUsuario > 0 {
-		_, err := models.InsertarHistorialFactura(
-			factura.IdUsuario,
-			factura.ReceptorRFC,
-			factura.ReceptorRazonSocial,
-			factura.ClaveTicket,
-			factura.NumeroFolio,
-			factura.Total,
-			factura.UsoCFDI,
-			factura.Observaciones,
-		)
-
-		if err != nil {
-			log.Printf("Error al guardar en historial (no crítico): %v", err)
-		} else {
-			log.Printf("Factura guardada en historial con folio: %s", factura.NumeroFolio)
-		}
-	}
-}
-
-func GenerarFacturaHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
-		return
-	}
-
-	// Usar procesarDatosFactura para unificar validación y decodificación
-	factura, plantillaBytes, err := procesarDatosFactura(r)
-	if err != nil {
-		log.Printf("Error al decodificar solicitud: %v", err)
-		http.Error(w, "Error al procesar los datos: "+err.Error(), http.StatusBadRequest)
-		return
-	}
-
+// prepararFactura completa la factura recibida: datos de empresa y emisor, conceptos del ticket,
+// catálogos y totales. El folio no se reserva aquí para no consumirlo si la solicitud no procede. Devuelve el código HTTP que corresponde si la solicitud no procede.
+func prepararFactura(factura *models.Factura) (int, error) {
 	// --- Mapear datos de empresa si viene EmpresaID, IdEmpresa o EmpresaRFC ---
 	// Si tienes el ID (o RFC) de la empresa en la factura recibida
 	if factura.EmpresaID != nil {
@@ -478,36 +428,29 @@ func GenerarFacturaHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	if len(factura.Conceptos) == 0 && factura.ClaveTicket != "" {
-		conceptosBD, err := obtenerConceptosDesdeVentas(factura.ClaveTicket)
-		if err == nil {
-			factura.Conceptos = conceptosBD
+	// Los tickets incluidos en una factura global ya no se pueden autofacturar
+	if factura.ClaveTicket != "" {
+		if global, err := models.TicketEnFacturaGlobal(factura.ClaveTicket); err != nil {
+			log.Printf("Error al verificar ticket en factura global: %v", err)
+		} else if global {
+			return http.StatusConflict, errors.New("El ticket ya fue incluido en la factura global a público en general")
 		}
 	}
 
-	if factura.NumeroFolio == "" {
-		err := factura.GenerarFolioAutomatico()
-		if err != nil {
-			log.Printf("Error al generar folio automático: %v", err)
-			http.Error(w, "Error al generar folio de factura", http.StatusInternalServerError)
-			return
-		}
-	} else {
-		err := factura.ValidarFolio()
-		if err != nil {
-			log.Printf("Error al validar folio: %v", err)
-			http.Error(w, "Folio duplicado o inválido: "+err.Error(), http.StatusBadRequest)
-			return
+	if len(factura.Conceptos) == 0 && factura.ClaveTicket != "" {
+		conceptosBD, err := obtenerConceptosDesdeVentas(factura.ClaveTicket, factura.ReceptorRFC)
+		if err == nil {
+			factura.Conceptos = conceptosBD
 		}
 	}
 
 	if factura.IdUsuario > 0 {
-		err := LlenarDatosEmisor(&factura, factura.IdUsuario)
+		err := LlenarDatosEmisor(factura, factura.IdUsuario)
 		if err != nil {
 			log.Printf("INFO - No se llenaron datos del emisor: %v", err)
 		}
 		// Log de depuración para KeyPath y ClaveCSD
-		log.Printf("DEBUG - KeyPath: %s, ClaveCSD: %s", factura.KeyPath, factura.ClaveCSD)
+		log.Printf("DEBUG - KeyPath: %s, ClaveCSD registrada: %t", factura.KeyPath, factura.ClaveCSD != "")
 	}
 	if factura.RegimenFiscal != "" {
 		codigo, err := ObtenerCodigoRegimenFiscal(factura.RegimenFiscal)
@@ -529,68 +472,152 @@ func GenerarFacturaHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Cargar logo del usuario admin (ID=1)
-	logoBytes, err := services.CargarLogoPlantilla("1")
-	if err != nil {
-		log.Printf("Error al cargar logo del admin: %v", err)
-		logoBytes = nil
+	// Los totales del PDF deben coincidir con los del XML (traslados y retenciones)
+	services.CalcularTotales(factura)
+
+	if factura.KeyPath == "" || factura.ClaveCSD == "" {
+		log.Printf("Error: No se proporcionó la ruta al archivo .key o la clave CSD")
+		return http.StatusBadRequest, errors.New("Faltan datos para la firma digital (archivo .key o clave CSD)")
+	}
+	if _, err := os.Stat(factura.KeyPath); err != nil {
+		log.Printf("Error: El archivo .key no existe en la ruta proporcionada: %s", factura.KeyPath)
+		return http.StatusBadRequest, errors.New("El archivo .key no existe en la ruta proporcionada: " + factura.KeyPath)
 	}
 
-	var pdfBuffer *bytes.Buffer
-	if len(plantillaBytes) > 0 {
-		pdfBuffer, err = services.ProcesarPlantilla(factura, plantillaBytes)
+	// Un folio capturado a mano solo se valida; si no viene, se reserva al final (asignarFolio o la cola)
+	if factura.NumeroFolio != "" {
+		if err := factura.ValidarFolio(); err != nil {
+			log.Printf("Error al validar folio: %v", err)
+			return http.StatusBadRequest, errors.New("Folio duplicado o inválido: " + err.Error())
+		}
+	}
+	return 0, nil
+}
+
+// asignarFolio reserva dentro de tx el folio de la serie del emisor si la factura no trae uno. tx es
+// la transacción que registra la factura: si no se confirma, el folio regresa a la serie.
+func asignarFolio(tx *sql.Tx, factura *models.Factura) (int, error) {
+	if factura.NumeroFolio != "" {
+		return 0, nil
+	}
+	if err := factura.AsignarFolio(tx); err != nil {
+		log.Printf("Error al generar folio automático: %v", err)
+		return http.StatusInternalServerError, errors.New("Error al generar folio de factura")
+	}
+	return 0, nil
+}
+
+func GenerarFacturaHandler(optimusDB *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+			return
+		}
+
+		anchoTicket, err := anchoTicketSolicitado(r)
 		if err != nil {
-			log.Printf("Error al procesar plantilla: %v", err)
-			http.Error(w, "Error al procesar la plantilla", http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-	} else {
-		pdfBuffer, _, err = services.GenerarPDF(factura, nil, logoBytes)
+
+		// Usar procesarDatosFactura para unificar validación y decodificación
+		factura, plantillaBytes, err := procesarDatosFactura(r)
 		if err != nil {
-			log.Printf("Error al generar PDF: %v", err)
-			http.Error(w, "Error al generar la factura", http.StatusInternalServerError)
+			log.Printf("Error al decodificar solicitud: %v", err)
+			http.Error(w, "Error al procesar los datos: "+err.Error(), http.StatusBadRequest)
 			return
 		}
-	}
 
-	keyPath := factura.KeyPath
-	claveCSD := factura.ClaveCSD
-	if keyPath == "" || claveCSD == "" {
-		log.Printf("Error: No se proporcionó la ruta al archivo .key o la clave CSD")
-		http.Error(w, "Faltan datos para la firma digital (archivo .key o clave CSD)", http.StatusBadRequest)
-		return
-	}
+		liberarTicket, ok := verificarTicketFacturable(optimusDB, w, &factura)
+		if !ok {
+			return
+		}
+		defer liberarTicket()
 
-	if _, err := os.Stat(keyPath); err != nil {
-		log.Printf("Error: El archivo .key no existe en la ruta proporcionada: %s", keyPath)
-		http.Error(w, "El archivo .key no existe en la ruta proporcionada: "+keyPath, http.StatusBadRequest)
-		return
-	}
-	xmlBytes, err := services.ProcesarKeyYGenerarCFDI(factura, keyPath, claveCSD, "")
-	if err != nil {
-		log.Printf("Error al generar XML firmado CFDI: %v", err)
-		http.Error(w, "Error al generar XML firmado CFDI: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
+		if estatus, err := prepararFactura(&factura); err != nil {
+			http.Error(w, err.Error(), estatus)
+			return
+		}
+		// El folio se reserva en la transacción que registra la factura
+		tx, err := db.GetDB().Begin()
+		if err != nil {
+			http.Error(w, "Error al iniciar la transacción", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		if estatus, err := asignarFolio(tx, &factura); err != nil {
+			http.Error(w, err.Error(), estatus)
+			return
+		}
 
-	serieDF := factura.Serie
-	numeroFolio := factura.NumeroFolio
-	nombrePDF := GenerarNombreArchivoFactura(serieDF, numeroFolio, "pdf")
-	nombreXML := GenerarNombreArchivoFactura(serieDF, numeroFolio, "xml")
-	pdfBytes := pdfBuffer.Bytes()
+		// Cargar logo del usuario admin (ID=1)
+		logoBytes, err := services.CargarLogoPlantilla("1")
+		if err != nil {
+			log.Printf("Error al cargar logo del admin: %v", err)
+			logoBytes = nil
+		}
 
-	zipBuffer, err := services.CrearZIPConNombres(pdfBytes, xmlBytes, nombrePDF, nombreXML)
-	if err != nil {
-		log.Printf("Error al crear ZIP: %v", err)
-		http.Error(w, "Error al crear archivo ZIP", http.StatusInternalServerError)
-		return
-	}
+		xmlBytes, err := firmarCFDI(factura)
+		if err != nil {
+			log.Printf("Error al generar XML firmado CFDI: %v", err)
+			http.Error(w, "Error al generar XML firmado CFDI: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
 
-	w.Header().Set("Content-Type", "application/zip")
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=factura_%s.zip", numeroFolio))
-	_, err = w.Write(zipBuffer.Bytes())
-	if err != nil {
-		log.Printf("Error al enviar archivo ZIP: %v", err)
+		var pdfBuffer *bytes.Buffer
+		if len(plantillaBytes) > 0 {
+			pdfBuffer, err = services.ProcesarPlantilla(factura, plantillaBytes)
+			if err != nil {
+				log.Printf("Error al procesar plantilla: %v", err)
+				http.Error(w, "Error al procesar la plantilla", http.StatusInternalServerError)
+				return
+			}
+		} else {
+			pdfBuffer, _, err = services.GenerarPDFDesdeXML(xmlBytes, services.OpcionesPDF{
+				Logo: logoBytes, Observaciones: factura.Observaciones, Tema: temaPDFEmisor(factura.EmisorRFC), AnchoTicket: anchoTicket,
+			})
+			if err != nil {
+				log.Printf("Error al generar PDF: %v", err)
+				http.Error(w, "Error al generar la factura", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		serieDF := factura.Serie
+		numeroFolio := factura.NumeroFolio
+		nombrePDF := GenerarNombreArchivoFactura(serieDF, numeroFolio, "pdf")
+		nombreXML := GenerarNombreArchivoFactura(serieDF, numeroFolio, "xml")
+		pdfBytes := pdfBuffer.Bytes()
+
+		zipBuffer, err := services.CrearZIPConNombres(pdfBytes, xmlBytes, nombrePDF, nombreXML)
+		if err != nil {
+			log.Printf("Error al crear ZIP: %v", err)
+			http.Error(w, "Error al crear archivo ZIP", http.StatusInternalServerError)
+			return
+		}
+
+		// La factura de un ticket se registra en el historial, con su clave de ticket, en la misma
+		// transacción que cierra el folio y antes de entregarla, para que el ticket ya no se pueda
+		// volver a facturar
+		if factura.IdUsuario > 0 || factura.ClaveTicket != "" {
+			if _, err = models.RegistrarFacturaEmitida(tx, factura); err == nil {
+				err = tx.Commit()
+			}
+		} else {
+			err = usarFolioEntregado(tx, &factura)
+		}
+		if err != nil {
+			log.Printf("Error al guardar en historial: %v", err)
+			http.Error(w, "Error al registrar la factura", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=factura_%s.zip", numeroFolio))
+		_, err = w.Write(zipBuffer.Bytes())
+		if err != nil {
+			log.Printf("Error al enviar archivo ZIP: %v", err)
+		}
+		log.Printf("Factura generada exitosamente con folio: %s", numeroFolio)
 	}
-	log.Printf("Factura generada exitosamente con folio: %s", numeroFolio)
 }
@@ -22,6 +22,12 @@ func GenerarFacturaConInfoHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	anchoTicket, err := anchoTicketSolicitado(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	var factura models.Factura
 	var plantillaBytes []byte
 
@@ -95,7 +101,7 @@ func GenerarFacturaConInfoHandler(w http.ResponseWriter, r *http.Request) {
 
 		if factura.ClaveTicket != "" {
 			log.Printf("🔍 FLUJO REAL - Intentando obtener conceptos desde BD para ticket: '%s'", factura.ClaveTicket)
-			conceptosBD, err := obtenerConceptosDesdeVentas(factura.ClaveTicket)
+			conceptosBD, err := obtenerConceptosDesdeVentas(factura.ClaveTicket, factura.ReceptorRFC)
 			if err != nil {
 				log.Printf("❌ FLUJO REAL - Error al obtener conceptos desde BD: %v", err)
 				log.Printf("🔄 FLUJO REAL - Usando productos de ejemplo como fallback")
@@ -121,9 +127,30 @@ func GenerarFacturaConInfoHandler(w http.ResponseWriter, r *http.Request) {
 			i+1, concepto.ClaveProdServ, concepto.Descripcion, concepto.Cantidad, concepto.ValorUnitario, concepto.Importe)
 	}
 
-	// Generar folio automáticamente si no se proporcionó uno
+	// Llenar datos del emisor automáticamente desde los datos fiscales del usuario
+	if factura.IdUsuario > 0 {
+		err := LlenarDatosEmisor(&factura, factura.IdUsuario)
+		if err != nil {
+			log.Printf("INFO - No se llenaron datos del emisor: %v", err)
+			log.Printf("INFO - La factura se generará sin datos del emisor predefinidos")
+			// No devolvemos error, continuamos con los datos disponibles
+		} else {
+			log.Printf("SUCCESS - Datos del emisor llenados correctamente")
+		}
+	} else {
+		log.Printf("WARNING: No se encontró ID de usuario válido en la factura (IdUsuario=%d)", factura.IdUsuario)
+	}
+
+	// Reservar el folio de la serie del emisor si no se proporcionó uno, en la transacción que
+	// registra la factura
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		http.Error(w, "Error al iniciar la transacción", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
 	if factura.NumeroFolio == "" {
-		err := factura.GenerarFolioAutomatico()
+		err := factura.AsignarFolio(tx)
 		if err != nil {
 			log.Printf("Error al generar folio automático: %v", err)
 			http.Error(w, "Error al generar folio de factura", http.StatusInternalServerError)
@@ -140,20 +167,6 @@ func GenerarFacturaConInfoHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Llenar datos del emisor automáticamente desde los datos fiscales del usuario
-	if factura.IdUsuario > 0 {
-		err := LlenarDatosEmisor(&factura, factura.IdUsuario)
-		if err != nil {
-			log.Printf("INFO - No se llenaron datos del emisor: %v", err)
-			log.Printf("INFO - La factura se generará sin datos del emisor predefinidos")
-			// No devolvemos error, continuamos con los datos disponibles
-		} else {
-			log.Printf("SUCCESS - Datos del emisor llenados correctamente")
-		}
-	} else {
-		log.Printf("WARNING: No se encontró ID de usuario válido en la factura (IdUsuario=%d)", factura.IdUsuario)
-	}
-
 	// Convertir el ID del régimen fiscal al código del SAT
 	if factura.RegimenFiscal != "" {
 		codigo, err := ObtenerCodigoRegimenFiscal(factura.RegimenFiscal)
@@ -195,6 +208,21 @@ func GenerarFacturaConInfoHandler(w http.ResponseWriter, r *http.Request) {
 		logoBytes = nil
 	}
 
+	// Generar el XML firmado CFDI usando el flujo de generación de PEM en tiempo real
+	keyPath := factura.KeyPath   // Debe contener la ruta al archivo .key
+	claveCSD := factura.ClaveCSD // Debe contener la clave privada del CSD
+	if keyPath == "" || claveCSD == "" {
+		log.Printf("Error: No se proporcionó la ruta al archivo .key o la clave CSD")
+		http.Error(w, "Faltan datos para la firma digital (archivo .key o clave CSD)", http.StatusBadRequest)
+		return
+	}
+	xmlBytes, err := firmarCFDI(factura)
+	if err != nil {
+		log.Printf("Error al generar XML firmado CFDI: %v", err)
+		http.Error(w, "Error al generar XML firmado CFDI: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	// Procesar la plantilla si se proporcionó
 	var pdfBuffer *bytes.Buffer
 	var err2 error
@@ -207,17 +235,10 @@ func GenerarFacturaConInfoHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	} else {
-		// Obtener UUID y NoCertificado de la base de datos usando el folio generado
-		uuid, noCert, err := db.ObtenerUUIDyNoCertificado(factura.NumeroFolio)
-		if err != nil {
-			log.Printf("No se pudo obtener UUID o NoCertificado para el folio %s: %v", factura.NumeroFolio, err)
-			// Puedes decidir continuar, pero los campos estarán vacíos
-		}
-		factura.UUID = uuid
-		factura.NoCertificado = noCert
-
-		// Ahora sí, genera el PDF y los datos se mostrarán correctamente
-		pdfBuffer, _, err2 = services.GenerarPDF(factura, nil, logoBytes)
+		// El PDF se genera del XML firmado: muestra exactamente lo que se va a timbrar
+		pdfBuffer, _, err2 = services.GenerarPDFDesdeXML(xmlBytes, services.OpcionesPDF{
+			Logo: logoBytes, Observaciones: factura.Observaciones, Tema: temaPDFEmisor(factura.EmisorRFC), AnchoTicket: anchoTicket,
+		})
 		if err2 != nil {
 			log.Printf("Error al generar PDF: %v", err2)
 			http.Error(w, "Error al generar la factura", http.StatusInternalServerError)
@@ -225,21 +246,6 @@ func GenerarFacturaConInfoHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Generar el XML firmado CFDI usando el flujo de generación de PEM en tiempo real
-	keyPath := factura.KeyPath   // Debe contener la ruta al archivo .key
-	claveCSD := factura.ClaveCSD // Debe contener la clave privada del CSD
-	if keyPath == "" || claveCSD == "" {
-		log.Printf("Error: No se proporcionó la ruta al archivo .key o la clave CSD")
-		http.Error(w, "Faltan datos para la firma digital (archivo .key o clave CSD)", http.StatusBadRequest)
-		return
-	}
-	xmlBytes, err := services.ProcesarKeyYGenerarCFDI(factura, keyPath, claveCSD, "")
-	if err != nil {
-		log.Printf("Error al generar XML firmado CFDI: %v", err)
-		http.Error(w, "Error al generar XML firmado CFDI: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-
 	// Obtener los bytes del PDF y XML
 	pdfBytes := pdfBuffer.Bytes()
 	// xmlBytes ya es []byte
@@ -273,26 +279,20 @@ func GenerarFacturaConInfoHandler(w http.ResponseWriter, r *http.Request) {
 		"download_url":  fmt.Sprintf("/api/descargar-factura-zip?folio=%s", factura.NumeroFolio),
 	}
 
-	// Guardar automáticamente en el historial de facturas (DESPUÉS de generar todo)
+	// Guardar en el historial de facturas (DESPUÉS de generar todo) en la transacción del folio
 	if factura.IdUsuario > 0 { // Solo si tenemos un ID de usuario válido
-		_, err = models.InsertarHistorialFactura(
-			factura.IdUsuario, // Usar el ID del usuario que genera la factura
-			factura.ReceptorRFC,
-			factura.ReceptorRazonSocial,
-			factura.ClaveTicket,
-			factura.NumeroFolio, // Incluir el folio generado
-			factura.Total,
-			factura.UsoCFDI,
-			factura.Observaciones,
-		)
-
-		if err != nil {
-			log.Printf("Error al guardar en historial (no crítico): %v", err)
-			// No devolvemos error aquí porque la factura se generó correctamente
-		} else {
-			log.Printf("Factura guardada en historial con folio: %s", factura.NumeroFolio)
+		if _, err = models.RegistrarFacturaEmitida(tx, factura); err == nil { // También marca el folio como usado
+			err = tx.Commit()
 		}
+	} else {
+		err = usarFolioEntregado(tx, &factura)
+	}
+	if err != nil {
+		log.Printf("Error al guardar en historial: %v", err)
+		http.Error(w, "Error al registrar la factura", http.StatusInternalServerError)
+		return
 	}
+	log.Printf("Factura guardada con folio: %s", factura.NumeroFolio)
 
 	// Guardar el archivo ZIP temporalmente (opcional, para descarga posterior)
 	// Aquí podrías guardar el ZIP en un almacenamiento temporal si es necesario
@@ -7,10 +7,41 @@ import (
 	"Facts/internal/services"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
-	"os"
+	"time"
 )
 
+// errPACNoConfigurado indica que el emisor no tiene un PAC utilizable
+var errPACNoConfigurado = errors.New("PAC no configurado para el emisor")
+
+// timeoutPAC limita cada llamada al PAC; los reintentos los maneja services.TimbrarXML
+const timeoutPAC = 30 * time.Second
+
+// proveedorPACUsuario crea el PAC configurado en los datos fiscales del emisor
+func proveedorPACUsuario(idUsuario int) (pac.PACProvider, error) {
+	cfg, err := db.ObtenerConfigPAC(idUsuario)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Timeout = timeoutPAC
+	proveedor, err := pac.Nuevo(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errPACNoConfigurado, err)
+	}
+	return proveedor, nil
+}
+
+// timbrarConPACConfigurado timbra (de forma idempotente) un XML firmado con el PAC del emisor
+func timbrarConPACConfigurado(idUsuario int, xmlFirmado []byte) ([]byte, error) {
+	proveedor, err := proveedorPACUsuario(idUsuario)
+	if err != nil {
+		return nil, err
+	}
+	return services.TimbrarXML(xmlFirmado, proveedor)
+}
+
 // TimbrarFacturaHandler recibe una FacturaCFDI, timbra y retorna el resultado
 func TimbrarFacturaHandler(factura models.FacturaCFDI) (map[string]interface{}, error) {
 	// 1. Llenar datos fiscales del emisor
@@ -19,9 +50,15 @@ func TimbrarFacturaHandler(factura models.FacturaCFDI) (map[string]interface{},
 		return nil, err
 	}
 
-	// 2. Generar folio automático si no existe
+	// 2. Reservar el folio de la serie del emisor si no viene uno, en la transacción que guarda
+	// la factura timbrada
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
 	if factura.NumeroFolio == "" {
-		if err := factura.GenerarFolioAutomatico(); err != nil {
+		if err := factura.AsignarFolio(tx); err != nil {
 			return nil, err
 		}
 	}
@@ -30,25 +67,24 @@ func TimbrarFacturaHandler(factura models.FacturaCFDI) (map[string]interface{},
 	}
 
 	// 3. Generar XML CFDI usando el generador
-	xmlCFDI, err := services.ProcesarKeyYGenerarCFDI(factura, factura.KeyPath, factura.ClaveCSD, "")
+	xmlCFDI, err := firmarCFDI(factura)
 	if err != nil {
 		return nil, err
 	}
 
-	// 4. Timbrar el XML con el PAC y extraer el timbre fiscal digital usando la función integrada
-	timbre, xmlTimbrado, err := services.TimbrarFactura(
-		xmlCFDI,
-		factura.EmisorRFC,
-		factura.ClaveCSD,
-		"https://api.pac.com/timbrar",
-	)
+	// 4. Timbrar el XML con el PAC del emisor y extraer el timbre fiscal digital usando la función integrada
+	proveedor, err := proveedorPACUsuario(factura.IdUsuario)
+	if err != nil {
+		return nil, err
+	}
+	timbre, xmlTimbrado, err := services.TimbrarFactura(xmlCFDI, proveedor)
 	if err != nil {
 		return nil, err
 	}
 	factura.Timbre = timbre
 
 	// 6. Generar PDF usando el generador
-	pdfBuf, _, err := services.GenerarPDF(factura, nil, nil)
+	pdfBuf, _, err := services.GenerarPDFDesdeXML(xmlTimbrado, services.OpcionesPDF{Observaciones: factura.Observaciones, Tema: temaPDFEmisor(factura.EmisorRFC)})
 	if err != nil {
 		return nil, err
 	}
@@ -62,7 +98,10 @@ func TimbrarFacturaHandler(factura models.FacturaCFDI) (map[string]interface{},
 		"timbre": timbre,
 		"folio":  factura.NumeroFolio,
 	}
-	if err := db.GuardarFacturaTimbrada(db.GetDB(), resultado); err != nil {
+	if err := db.GuardarFacturaTimbrada(tx, resultado); err != nil {
+		return nil, err
+	}
+	if err := usarFolioEntregado(tx, &factura); err != nil {
 		return nil, err
 	}
 	return resultado, nil
@@ -83,7 +122,7 @@ func TimbrarCFDIHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 1. Generar XML firmado CFDI
-	xmlFirmado, err := services.ProcesarKeyYGenerarCFDI(factura, factura.KeyPath, factura.ClaveCSD, "")
+	xmlFirmado, err := firmarCFDI(factura)
 	if err != nil {
 		factura.LogError = "Error generando XML firmado: " + err.Error()
 		resultado := map[string]interface{}{
@@ -96,12 +135,10 @@ func TimbrarCFDIHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 2. Timbrar el XML con el PAC (configuración real)
-	pacURL := os.Getenv("PAC_URL")
-	pacUser := os.Getenv("PAC_USER")
-	pacPass := os.Getenv("PAC_PASS")
-	if pacURL == "" || pacUser == "" || pacPass == "" {
-		factura.LogError = "Configuración de PAC incompleta. Verifica las variables de entorno PAC_URL, PAC_USER y PAC_PASS."
+	// 2. Timbrar el XML con el PAC configurado para el emisor
+	proveedor, err := proveedorPACUsuario(factura.IdUsuario)
+	if err != nil {
+		factura.LogError = "Configuración de PAC incompleta: " + err.Error()
 		resultado := map[string]interface{}{
 			"error":     factura.LogError,
 			"folio":     factura.NumeroFolio,
@@ -111,7 +148,7 @@ func TimbrarCFDIHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, factura.LogError, http.StatusInternalServerError)
 		return
 	}
-	xmlTimbrado, err := pac.TimbrarConPAC(string(xmlFirmado), pacURL, pacUser, pacPass)
+	xmlTimbrado, err := services.TimbrarXML(xmlFirmado, proveedor)
 	if err != nil {
 		factura.LogError = "Error al timbrar con PAC: " + err.Error()
 		resultado := map[string]interface{}{
@@ -120,7 +157,13 @@ func TimbrarCFDIHandler(w http.ResponseWriter, r *http.Request) {
 			"log_error": factura.LogError,
 		}
 		db.GuardarFacturaTimbrada(db.GetDB(), resultado)
-		http.Error(w, factura.LogError, http.StatusInternalServerError)
+		estatus := http.StatusInternalServerError
+		if errors.Is(err, services.ErrTimbradoSinFolio) {
+			estatus = http.StatusBadRequest
+		} else if errors.Is(err, services.ErrTimbradoEnConflicto) {
+			estatus = http.StatusConflict
+		}
+		http.Error(w, factura.LogError, estatus)
 		return
 	}
 
@@ -141,14 +184,14 @@ func TimbrarCFDIHandler(w http.ResponseWriter, r *http.Request) {
 	factura.Timbre = &models.TimbreFiscalDigital{
 		UUID:             timbre.UUID,
 		FechaTimbrado:    timbre.FechaTimbrado,
-		RfcProvCertif:    timbre.NoCertificadoSAT, // Si el campo correcto es SelloSAT, ajústalo aquí
+		RfcProvCertif:    timbre.RfcProvCertif,
 		SelloCFD:         timbre.SelloCFD,
 		NoCertificadoSAT: timbre.NoCertificadoSAT,
 		SelloSAT:         timbre.SelloSAT,
 	}
 
 	// 4. Generar PDF con el timbre fiscal digital
-	pdfBuf, _, err := services.GenerarPDF(factura, nil, nil)
+	pdfBuf, _, err := services.GenerarPDFDesdeXML(xmlTimbrado, services.OpcionesPDF{Observaciones: factura.Observaciones, Tema: temaPDFEmisor(factura.EmisorRFC)})
 	if err != nil {
 		factura.LogError = "Error generando PDF: " + err.Error()
 		resultado := map[string]interface{}{
@@ -107,6 +107,19 @@ func handleCreateImpuesto(db *sql.DB, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if impuesto.RetISR < 0 || impuesto.RetISR > 100 || impuesto.RetIVA < 0 || impuesto.RetIVA > impuesto.IVA {
+		http.Error(w, "Retención ISR debe estar entre 0 y 100 y la retención de IVA no puede exceder el IVA", http.StatusBadRequest)
+		return
+	}
+
+	if impuesto.ObjetoImp == "" {
+		impuesto.ObjetoImp = "02"
+	}
+	if _, ok := models.ObjetosImpuesto[impuesto.ObjetoImp]; !ok {
+		http.Error(w, "objeto_imp debe ser 01, 02, 03 o 04", http.StatusBadRequest)
+		return
+	}
+
 	err := models.CreateImpuesto(db, &impuesto)
 	if err != nil {
 		log.Printf("Error al crear impuesto: %v", err)
@@ -169,6 +182,19 @@ func handleUpdateImpuesto(db *sql.DB, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if impuesto.RetISR < 0 || impuesto.RetISR > 100 || impuesto.RetIVA < 0 || impuesto.RetIVA > impuesto.IVA {
+		http.Error(w, "Retención ISR debe estar entre 0 y 100 y la retención de IVA no puede exceder el IVA", http.StatusBadRequest)
+		return
+	}
+
+	if impuesto.ObjetoImp == "" {
+		impuesto.ObjetoImp = "02"
+	}
+	if _, ok := models.ObjetosImpuesto[impuesto.ObjetoImp]; !ok {
+		http.Error(w, "objeto_imp debe ser 01, 02, 03 o 04", http.StatusBadRequest)
+		return
+	}
+
 	err := models.UpdateImpuesto(db, &impuesto)
 	if err != nil {
 		log.Printf("Error al actualizar impuesto: %v", err)
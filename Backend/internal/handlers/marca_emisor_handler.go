@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"Facts/internal/models"
+	"Facts/internal/services"
+)
+
+// marcaEmisor devuelve la marca registrada del RFC; si la consulta falla se usa la marca vacía (tema predeterminado)
+func marcaEmisor(rfc string) models.MarcaEmisor {
+	if rfc == "" {
+		return models.MarcaEmisor{}
+	}
+	marca, err := models.ObtenerMarcaEmisor(rfc)
+	if err != nil {
+		log.Printf("PDF_WARNING - %v", err)
+		return models.MarcaEmisor{RFC: rfc}
+	}
+	return *marca
+}
+
+// temaPDFEmisor es el tema del PDF con el que imprime el emisor
+func temaPDFEmisor(rfc string) *services.TemaPDF {
+	tema := services.TemaPDFDeMarca(marcaEmisor(rfc))
+	return &tema
+}
+
+// MarcaEmisorHandler consulta (GET) o guarda (PUT) el tema, colores y fuente del PDF del emisor {rfc}
+func MarcaEmisorHandler(w http.ResponseWriter, r *http.Request) {
+	rfc := strings.ToUpper(strings.TrimSpace(r.PathValue("rfc")))
+	if rfc == "" {
+		http.Error(w, "Se requiere el RFC del emisor", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		marca, err := models.ObtenerMarcaEmisor(rfc)
+		if err != nil {
+			log.Printf("Error al obtener marca del emisor: %v", err)
+			http.Error(w, "Error al obtener la marca del emisor", http.StatusInternalServerError)
+			return
+		}
+		responderMarcaEmisor(w, *marca)
+	case http.MethodPut:
+		var marca models.MarcaEmisor
+		if err := json.NewDecoder(r.Body).Decode(&marca); err != nil {
+			http.Error(w, "Error al procesar los datos: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		marca.RFC = rfc
+		marca.Tema = strings.ToLower(strings.TrimSpace(marca.Tema))
+		if err := services.ValidarMarcaEmisor(marca); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := models.GuardarMarcaEmisor(marca); err != nil {
+			log.Printf("Error al guardar marca del emisor: %v", err)
+			http.Error(w, "Error al guardar la marca del emisor", http.StatusInternalServerError)
+			return
+		}
+		responderMarcaEmisor(w, marca)
+	default:
+		http.Error(w, MetodoNoPermitido, http.StatusMethodNotAllowed)
+	}
+}
+
+// responderMarcaEmisor devuelve la marca junto con el tema que resulta de aplicarla
+func responderMarcaEmisor(w http.ResponseWriter, marca models.MarcaEmisor) {
+	w.Header().Set(ContentTypeHeader, ApplicationJSON)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"marca": marca,
+		"tema":  services.TemaPDFDeMarca(marca),
+	})
+}
+
+// TemasPDFHandler lista los temas del PDF y las fuentes que se pueden elegir
+func TemasPDFHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, MetodoNoPermitido, http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set(ContentTypeHeader, ApplicationJSON)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"temas":          services.TemasPDF(),
+		"fuentes":        services.FuentesPDF,
+		"predeterminado": services.TemaPDFPredeterminado,
+	})
+}
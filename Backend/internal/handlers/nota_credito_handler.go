@@ -0,0 +1,323 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+
+	"Facts/internal/db"
+	"Facts/internal/models"
+	"Facts/internal/services"
+)
+
+// Clave SAT usada por defecto para el concepto de una nota de crédito sin conceptos explícitos
+const (
+	claveProdServNotaCredito = "84111506" // Servicios de facturación
+	claveUnidadNotaCredito   = "ACT"      // Actividad
+	usoCFDINotaCredito       = "G02"      // Devoluciones, descuentos o bonificaciones
+)
+
+// NotaCreditoRequest son los datos para emitir un CFDI de egreso contra una factura del historial
+type NotaCreditoRequest struct {
+	IDHistorial           int               `json:"id_historial"`
+	IDUsuario             int               `json:"id_usuario"`
+	TipoRelacion          string            `json:"tipo_relacion"`
+	Monto                 float64           `json:"monto"` // Total con IVA; si es 0 y no hay conceptos se acredita el saldo completo
+	TasaIVA               float64           `json:"tasa_iva"`
+	Descripcion           string            `json:"descripcion"`
+	FormaPago             string            `json:"forma_pago"`
+	Conceptos             []models.Concepto `json:"conceptos"`
+	ReceptorCodigoPostal  string            `json:"receptor_codigo_postal"`
+	RegimenFiscalReceptor string            `json:"regimen_fiscal_receptor"`
+}
+
+// conceptosNotaCredito arma los conceptos del egreso: los explícitos o uno solo por el monto indicado
+func conceptosNotaCredito(req NotaCreditoRequest, saldo float64) []models.Concepto {
+	if len(req.Conceptos) > 0 {
+		return req.Conceptos
+	}
+
+	tasa := req.TasaIVA
+	if tasa == 0 {
+		tasa = 16
+	}
+	monto := req.Monto
+	if monto <= 0 {
+		monto = saldo
+	}
+	descripcion := req.Descripcion
+	if descripcion == "" {
+		descripcion = models.TiposRelacionNotaCredito[req.TipoRelacion]
+	}
+	base := math.Round(monto/(1+tasa/100)*100) / 100
+
+	return []models.Concepto{{
+		ClaveProdServ: claveProdServNotaCredito,
+		ClaveUnidad:   claveUnidadNotaCredito,
+		Descripcion:   descripcion,
+		Cantidad:      1,
+		ValorUnitario: base,
+		Importe:       base,
+		TasaIVA:       tasa,
+	}}
+}
+
+// apartarSaldoNotaCredito calcula el monto de la nota con la factura original bloqueada y lo aparta
+// contra su saldo. Devuelve el saldo previo y la relación apartada; si falla ya respondió al cliente.
+func apartarSaldoNotaCredito(w http.ResponseWriter, req NotaCreditoRequest, original *models.HistorialFactura, uuidOriginal string) (float64, []models.CFDIRelacionado, bool) {
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		http.Error(w, "Error al iniciar la transacción", http.StatusInternalServerError)
+		return 0, nil, false
+	}
+	defer tx.Rollback()
+	_, saldo, err := models.BloquearFacturaPagada(tx, original.ID)
+	if err != nil {
+		log.Printf("[NOTA_CREDITO] %v", err)
+		http.Error(w, "Error al consultar el saldo de la factura original", http.StatusInternalServerError)
+		return 0, nil, false
+	}
+	if saldo <= 0 {
+		http.Error(w, "La factura original no tiene saldo pendiente", http.StatusConflict)
+		return 0, nil, false
+	}
+
+	totales := models.Factura{Conceptos: conceptosNotaCredito(req, saldo)}
+	services.CalcularTotales(&totales)
+	montoNota := totales.Total
+	if montoNota <= 0 {
+		http.Error(w, "El monto de la nota de crédito debe ser mayor a cero", http.StatusBadRequest)
+		return 0, nil, false
+	}
+	if montoNota > saldo+0.01 {
+		http.Error(w, fmt.Sprintf("El monto de la nota de crédito (%.2f) excede el saldo pendiente (%.2f)", montoNota, saldo), http.StatusBadRequest)
+		return 0, nil, false
+	}
+
+	relaciones := []models.CFDIRelacionado{{
+		IDHistorialOrigen: original.ID,
+		UUIDOrigen:        uuidOriginal,
+		TipoComprobante:   "E",
+		TipoRelacion:      req.TipoRelacion,
+		Monto:             montoNota,
+	}}
+	if err := models.ApartarRelacionesCFDI(tx, relaciones); err != nil {
+		log.Printf("[NOTA_CREDITO] %v", err)
+		http.Error(w, "Error al apartar el saldo de la factura original", http.StatusInternalServerError)
+		return 0, nil, false
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error al apartar el saldo de la factura original", http.StatusInternalServerError)
+		return 0, nil, false
+	}
+	return saldo, relaciones, true
+}
+
+// GenerarNotaCreditoHandler emite un CFDI de egreso relacionado con una factura timbrada del historial
+func GenerarNotaCreditoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, MetodoNoPermitido, http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req NotaCreditoRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Error al procesar los datos: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.IDHistorial <= 0 {
+		http.Error(w, "Se requiere id_historial", http.StatusBadRequest)
+		return
+	}
+	if req.TipoRelacion == "" {
+		req.TipoRelacion = "01"
+	}
+	if _, ok := models.TiposRelacionNotaCredito[req.TipoRelacion]; !ok {
+		http.Error(w, "tipo_relacion inválido para nota de crédito (permitidos: 01, 03, 07)", http.StatusBadRequest)
+		return
+	}
+
+	original, ok := facturaDelUsuario(w, req.IDHistorial, req.IDUsuario)
+	if !ok {
+		return
+	}
+	if err := originalVigente(original); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	xmlOriginal, err := xmlArchivadoFactura(original)
+	if errors.Is(err, errSinXMLTimbrado) {
+		http.Error(w, "La factura original no está timbrada; no se puede relacionar", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("[NOTA_CREDITO] Error al obtener el XML de la factura %d: %v", original.ID, err)
+		http.Error(w, "No se pudo obtener el XML de la factura original", http.StatusInternalServerError)
+		return
+	}
+	uuidOriginal := original.UUID
+
+	factura := models.Factura{
+		IdUsuario:             req.IDUsuario,
+		TipoComprobante:       "E",
+		TipoRelacion:          req.TipoRelacion,
+		UUIDsRelacionados:     []string{uuidOriginal},
+		ReceptorRFC:           original.RFCReceptor,
+		ReceptorRazonSocial:   original.RazonSocialReceptor,
+		ReceptorCodigoPostal:  req.ReceptorCodigoPostal,
+		RegimenFiscalReceptor: req.RegimenFiscalReceptor,
+		ClaveTicket:           original.ClaveTicket,
+		UsoCFDI:               usoCFDINotaCredito,
+		MetodoPago:            "PUE",
+		FormaPago:             req.FormaPago,
+		Observaciones:         fmt.Sprintf("Nota de crédito (%s) de la factura %s", req.TipoRelacion, original.NumeroFolio),
+	}
+	if err := LlenarDatosEmisor(&factura, factura.IdUsuario); err != nil {
+		log.Printf("[NOTA_CREDITO] Error al llenar datos del emisor: %v", err)
+		http.Error(w, "No hay datos fiscales del emisor", http.StatusBadRequest)
+		return
+	}
+	if factura.RegimenFiscalReceptor != "" {
+		if codigo, err := ObtenerCodigoRegimenFiscal(factura.RegimenFiscalReceptor); err == nil {
+			factura.RegimenFiscalReceptor = codigo
+		}
+	}
+	if err := aplicarReceptorOriginal(&factura, xmlOriginal); err != nil {
+		log.Printf("[NOTA_CREDITO] %v", err)
+		http.Error(w, "No se pudo leer el receptor de la factura original", http.StatusInternalServerError)
+		return
+	}
+	if factura.KeyPath == "" || factura.ClaveCSD == "" {
+		http.Error(w, "Faltan datos para la firma digital (archivo .key o clave CSD)", http.StatusBadRequest)
+		return
+	}
+	if _, err := os.Stat(factura.KeyPath); err != nil {
+		http.Error(w, "El archivo .key no existe en la ruta proporcionada: "+factura.KeyPath, http.StatusBadRequest)
+		return
+	}
+
+	// El monto se aparta contra el saldo con la factura original bloqueada y se libera el bloqueo
+	// antes de timbrar; otro egreso o pago ve el monto apartado
+	saldo, relaciones, ok := apartarSaldoNotaCredito(w, req, original, uuidOriginal)
+	if !ok {
+		return
+	}
+	timbrado := false
+	defer func() {
+		if !timbrado {
+			if err := models.LiberarRelacionesCFDI(relaciones); err != nil {
+				log.Printf("[NOTA_CREDITO] %v", err)
+			}
+		}
+	}()
+	factura.Conceptos = conceptosNotaCredito(req, saldo)
+	services.CalcularTotales(&factura)
+	montoNota := relaciones[0].Monto
+
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		http.Error(w, "Error al iniciar la transacción", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if err := factura.AsignarFolio(tx); err != nil {
+		log.Printf("[NOTA_CREDITO] Error al generar folio: %v", err)
+		http.Error(w, "Error al generar folio de la nota de crédito", http.StatusInternalServerError)
+		return
+	}
+	xmlFirmado, err := firmarCFDI(factura)
+	if err != nil {
+		log.Printf("[NOTA_CREDITO] Error al generar XML firmado: %v", err)
+		http.Error(w, "Error al generar XML firmado CFDI: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	xmlTimbrado, err := timbrarConPACConfigurado(factura.IdUsuario, xmlFirmado)
+	if errors.Is(err, errPACNoConfigurado) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		log.Printf("[NOTA_CREDITO] Error al timbrar: %v", err)
+		http.Error(w, "Error al timbrar con PAC: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	// Ya existe ante el SAT: el apartado se queda aunque falle el registro
+	timbrado = true
+	timbre, err := services.ExtraerTimbreFiscalDigital(xmlTimbrado)
+	if err != nil {
+		http.Error(w, "Error extrayendo timbre fiscal: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Historial, archivo y relación con la factura original se registran juntos
+	if _, err := registrarComprobanteTimbrado(tx, &factura, xmlTimbrado, relaciones); err != nil {
+		log.Printf("[NOTA_CREDITO] Nota de crédito %s timbrada (UUID %s) sin registrar: %v", factura.NumeroFolio, timbre.UUID, err)
+		http.Error(w, fmt.Sprintf("La nota de crédito se timbró con UUID %s pero no se pudo registrar: %v", timbre.UUID, err), http.StatusInternalServerError)
+		return
+	}
+
+	logoBytes, err := services.CargarLogoPlantilla("1")
+	if err != nil {
+		logoBytes = nil
+	}
+	pdfBuffer, _, err := services.GenerarPDFDesdeXML(xmlTimbrado, services.OpcionesPDF{Logo: logoBytes, Observaciones: factura.Observaciones, Tema: temaPDFEmisor(factura.EmisorRFC)})
+	if err != nil {
+		log.Printf("[NOTA_CREDITO] Error al generar PDF: %v", err)
+		http.Error(w, "Error al generar el PDF de la nota de crédito", http.StatusInternalServerError)
+		return
+	}
+
+	nombrePDF := fmt.Sprintf("Nota de credito %s%s.pdf", factura.Serie, factura.NumeroFolio)
+	nombreXML := fmt.Sprintf("Nota de credito %s%s.xml", factura.Serie, factura.NumeroFolio)
+	zipBuffer, err := services.CrearZIPConNombres(pdfBuffer.Bytes(), xmlTimbrado, nombrePDF, nombreXML)
+	if err != nil {
+		log.Printf("[NOTA_CREDITO] Error al crear ZIP: %v", err)
+		http.Error(w, "Error al crear archivo ZIP", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=nota_credito_%s.zip", factura.NumeroFolio))
+	w.Header().Set("X-Saldo-Pendiente", strconv.FormatFloat(saldo-montoNota, 'f', 2, 64))
+	w.Write(zipBuffer.Bytes())
+	log.Printf("[NOTA_CREDITO] Nota de crédito %s (UUID %s) emitida contra factura %s por %.2f", factura.NumeroFolio, timbre.UUID, original.NumeroFolio, montoNota)
+}
+
+// RelacionesFacturaHandler devuelve el saldo pendiente y los comprobantes relacionados de una factura del
+// historial del usuario (?id_historial=&id_usuario=)
+func RelacionesFacturaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, MetodoNoPermitido, http.StatusMethodNotAllowed)
+		return
+	}
+	idHistorial, err := strconv.Atoi(r.URL.Query().Get("id_historial"))
+	if err != nil || idHistorial <= 0 {
+		http.Error(w, "id_historial inválido", http.StatusBadRequest)
+		return
+	}
+
+	idUsuario, _ := strconv.Atoi(r.URL.Query().Get("id_usuario"))
+	factura, ok := facturaDelUsuario(w, idHistorial, idUsuario)
+	if !ok {
+		return
+	}
+	relaciones, err := models.ObtenerRelacionesFactura(idHistorial)
+	if err != nil {
+		log.Printf("Error al obtener relaciones de la factura %d: %v", idHistorial, err)
+		http.Error(w, "Error al obtener los comprobantes relacionados", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(ContentTypeHeader, "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"factura":         factura,
+		"saldo_pendiente": factura.SaldoPendiente,
+		"relacionados":    relaciones,
+	})
+}
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"Facts/internal/models"
+)
+
+// liberarFolio regresa a su serie el folio reservado de un comprobante que no se emitió.
+// Si el folio ya se registró como usado no hace nada, por eso se puede diferir sin condiciones.
+func liberarFolio(factura *models.Factura, motivo string) {
+	if factura.NumeroFolio == "" || factura.EmisorRFC == "" {
+		return
+	}
+	if err := models.LiberarFolio(factura.EmisorRFC, factura.Serie, factura.NumeroFolio, motivo); err != nil {
+		log.Printf("[FOLIOS] %v", err)
+	}
+}
+
+// usarFolioEntregado marca dentro de tx, la transacción que reservó el folio, el folio de un
+// comprobante que se entrega sin guardarse en el historial y confirma tx
+func usarFolioEntregado(tx *sql.Tx, factura *models.Factura) error {
+	if err := models.UsarFolio(tx, factura.EmisorRFC, factura.Serie, factura.NumeroFolio, 0); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// marcarFolioUsado cierra el folio de un comprobante que se entrega sin guardarse en el historial
+func marcarFolioUsado(factura *models.Factura) {
+	if err := models.MarcarFolioUsado(factura.EmisorRFC, factura.Serie, factura.NumeroFolio); err != nil {
+		log.Printf("[FOLIOS] %v", err)
+	}
+}
+
+// SeriesFolioHandler lista (GET) o crea (POST) las series de folios del emisor {rfc}
+func SeriesFolioHandler(w http.ResponseWriter, r *http.Request) {
+	rfc := strings.ToUpper(strings.TrimSpace(r.PathValue("rfc")))
+	if rfc == "" {
+		http.Error(w, "Se requiere el RFC del emisor", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		responderSeriesFolio(w, rfc)
+	case http.MethodPost:
+		var serie models.FolioControl
+		if err := json.NewDecoder(r.Body).Decode(&serie); err != nil {
+			http.Error(w, "Error al procesar los datos: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		serie.RFCEmisor = rfc
+		if err := models.ValidarSerieFolio(&serie); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		creada, err := models.CrearSerieFolio(serie)
+		if errors.Is(err, models.ErrSerieExistente) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("[FOLIOS] %v", err)
+			http.Error(w, "Error al crear la serie", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set(ContentTypeHeader, ApplicationJSON)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(creada)
+	default:
+		http.Error(w, MetodoNoPermitido, http.StatusMethodNotAllowed)
+	}
+}
+
+// DesactivarSerieFolioHandler deja de asignar folios de la serie {id} del emisor {rfc}
+func DesactivarSerieFolioHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, MetodoNoPermitido, http.StatusMethodNotAllowed)
+		return
+	}
+	rfc := strings.ToUpper(strings.TrimSpace(r.PathValue("rfc")))
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if rfc == "" || err != nil || id <= 0 {
+		http.Error(w, "Se requiere el RFC del emisor y el ID de la serie", http.StatusBadRequest)
+		return
+	}
+	err = models.DesactivarSerieFolio(rfc, id)
+	if errors.Is(err, models.ErrSerieNoEncontrada) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("[FOLIOS] %v", err)
+		http.Error(w, "Error al desactivar la serie", http.StatusInternalServerError)
+		return
+	}
+	responderSeriesFolio(w, rfc)
+}
+
+// responderSeriesFolio devuelve las series del emisor con el siguiente folio que asignaría cada una
+func responderSeriesFolio(w http.ResponseWriter, rfc string) {
+	series, err := models.ListarSeriesFolio(rfc)
+	if err != nil {
+		log.Printf("[FOLIOS] %v", err)
+		http.Error(w, "Error al obtener las series", http.StatusInternalServerError)
+		return
+	}
+	respuesta := make([]map[string]interface{}, 0, len(series))
+	for _, s := range series {
+		respuesta = append(respuesta, map[string]interface{}{
+			"serie":           s,
+			"siguiente_folio": s.FormatearFolio(s.UltimoFolio + 1),
+		})
+	}
+	w.Header().Set(ContentTypeHeader, ApplicationJSON)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"rfc":    rfc,
+		"series": respuesta,
+	})
+}
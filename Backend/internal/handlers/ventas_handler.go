@@ -5,6 +5,9 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"strconv"
+
+	"Facts/internal/models"
 )
 
 // Constantes para reducir duplicación de literales
@@ -13,13 +16,14 @@ const (
 	ErrorProcesarDatos = "Error al procesar los datos"
 	ContentTypeHeader  = "Content-Type"
 	ApplicationJSON    = "application/json"
-	SerieMinLength     = 30
+	SerieMinLength     = models.LongitudMinimaClaveTicket
 	ErrorBuscarVentas  = "Error al buscar ventas"
 	ErrorBuscarPedido  = "Error al buscar pedido"
 	ErrorBaseDatos     = "Error de base de datos"
 )
 
-// VentasHandler maneja las peticiones de consulta de ventas
+// VentasHandler maneja las peticiones de consulta de ventas; con la lista de productos devuelve si el
+// ticket se puede autofacturar con el emisor ?id_usuario= para avisar al cliente antes de capturar sus datos
 func VentasHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
@@ -128,10 +132,16 @@ func VentasHandler(db *sql.DB) http.HandlerFunc {
 		}
 
 		log.Printf("🔍 RESUMEN: Total filas SQL=%d, Productos únicos=%d", len(productosUnicos), len(ventas))
+		idUsuario, _ := strconv.Atoi(r.URL.Query().Get("id_usuario"))
+		elegibilidad, err := models.VerificarElegibilidadTicket(db, serie, idUsuario)
+		if err != nil {
+			log.Printf("[AUTOFACTURA] %v", err)
+		}
 		w.Header().Set(ContentTypeHeader, ApplicationJSON)
 		json.NewEncoder(w).Encode(map[string]interface{}{
-			"ventas": ventas,
-			"total":  len(ventas),
+			"ventas":       ventas,
+			"total":        len(ventas),
+			"elegibilidad": elegibilidad,
 		})
 	}
 }
@@ -144,7 +154,7 @@ func DiagnosticoVentasHandler(db *sql.DB) http.HandlerFunc {
 			ErrorProcesarDatos = "Error al procesar los datos"
 			ContentTypeHeader  = "Content-Type"
 			ApplicationJSON    = "application/json"
-			SerieMinLength     = 30
+			SerieMinLength     = models.LongitudMinimaClaveTicket
 			ErrorBuscarVentas  = "Error al buscar ventas"
 		)
 
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"Facts/internal/services"
+)
+
+// maxXMLSubido limita el tamaño de un XML recibido (los CFDI con muchos conceptos rara vez pasan de 2 MB)
+const maxXMLSubido = 10 << 20
+
+// leerXMLSubido toma el XML del campo "xml" de un formulario multipart o, si no, del cuerpo tal cual
+func leerXMLSubido(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxXMLSubido)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		archivo, _, err := r.FormFile("xml")
+		if err != nil {
+			return nil, errors.New("se requiere el archivo xml")
+		}
+		defer archivo.Close()
+		return io.ReadAll(archivo)
+	}
+	xmlBytes, err := io.ReadAll(r.Body)
+	if err == nil && len(xmlBytes) == 0 {
+		err = errors.New("se requiere el XML del CFDI")
+	}
+	return xmlBytes, err
+}
+
+// VisorCFDIHandler recibe cualquier CFDI 4.0 o 3.3 (campo "xml" multipart o el cuerpo tal cual)
+// y responde con su representación impresa en PDF con la marca del emisor o el tema de ?tema=;
+// con ?formato=ticket la imprime para rollo térmico y con ?pdfa=1 genera PDF/A-3 con el XML incrustado
+func VisorCFDIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, MetodoNoPermitido, http.StatusMethodNotAllowed)
+		return
+	}
+	anchoTicket, err := anchoTicketSolicitado(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	pdfa, err := pdfaSolicitado(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	xmlBytes, err := leerXMLSubido(w, r)
+	if err != nil {
+		http.Error(w, "Error al leer el XML: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	ri, err := services.LeerRepresentacionImpresa(xmlBytes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// ?tema= cambia el tema registrado del emisor (útil para comparar temas)
+	marca := marcaEmisor(ri.Emisor.Rfc)
+	if tema := r.URL.Query().Get("tema"); tema != "" {
+		if _, ok := services.TemaPDFPorNombre(tema); !ok {
+			http.Error(w, fmt.Sprintf("tema desconocido %q", tema), http.StatusBadRequest)
+			return
+		}
+		marca.Tema = tema
+	}
+	tema := services.TemaPDFDeMarca(marca)
+	pdfBuffer, nombreArchivo, err := services.GenerarPDF(ri, services.OpcionesPDF{
+		Tema: &tema, AnchoTicket: anchoTicket, PDFA: pdfa, XMLCFDI: xmlBytes,
+	})
+	if err != nil {
+		log.Printf("[VISOR] Error al generar PDF del CFDI %s: %v", ri.UUID(), err)
+		http.Error(w, "Error al generar la representación impresa", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%s", nombreArchivo))
+	w.Write(pdfBuffer.Bytes())
+}
+
+// anchoTicketSolicitado lee ?formato=ticket (con ?ancho=58 para rollos angostos) y devuelve el ancho del
+// rollo en mm; 0 es la representación impresa en hoja
+func anchoTicketSolicitado(r *http.Request) (float64, error) {
+	switch formato := r.URL.Query().Get("formato"); formato {
+	case "", "hoja":
+		return 0, nil
+	case "ticket":
+	default:
+		return 0, fmt.Errorf("formato desconocido %q; use ticket u hoja", formato)
+	}
+	switch ancho := r.URL.Query().Get("ancho"); ancho {
+	case "", "80":
+		return services.AnchoTicket80, nil
+	case "58":
+		return services.AnchoTicket58, nil
+	default:
+		return 0, fmt.Errorf("ancho de ticket no soportado %q; use 80 o 58", ancho)
+	}
+}
+
+// pdfaSolicitado lee ?pdfa=1: el PDF sale como PDF/A-3b con el XML timbrado incrustado
+func pdfaSolicitado(r *http.Request) (bool, error) {
+	valor := r.URL.Query().Get("pdfa")
+	if valor == "" {
+		return false, nil
+	}
+	pdfa, err := strconv.ParseBool(valor)
+	if err != nil {
+		return false, fmt.Errorf("valor inválido de pdfa %q; use 1 o 0", valor)
+	}
+	return pdfa, nil
+}
@@ -0,0 +1,484 @@
+package models
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"Facts/internal/db"
+)
+
+// Tipos de hallazgo de la auditoría de folios
+const (
+	HallazgoFaltante     = "faltante"       // Números de la serie sin reserva ni comprobante
+	HallazgoDuplicado    = "duplicado"      // El mismo folio registrado más de una vez en el historial
+	HallazgoSinTimbrar   = "sin_timbrar"    // Folio reservado o usado que nunca se timbró
+	HallazgoFueraDeSerie = "fuera_de_serie" // CFDI timbrado con un folio que no salió de una serie del emisor
+	HallazgoSinUUID      = "sin_uuid"       // Factura del historial sin UUID registrado
+)
+
+// HallazgoFolio es una irregularidad encontrada en la numeración de un emisor
+type HallazgoFolio struct {
+	Tipo        string `json:"tipo"`
+	RFCEmisor   string `json:"rfc_emisor"`
+	Serie       string `json:"serie"`
+	Numero      int64  `json:"numero,omitempty"`
+	Folio       string `json:"folio"`
+	IDHistorial int64  `json:"id_historial,omitempty"`
+	UUID        string `json:"uuid,omitempty"`
+	Fecha       string `json:"fecha,omitempty"`
+	Detalle     string `json:"detalle"`
+}
+
+// ResumenSerieAuditoria cuenta los folios de una serie que salieron en el periodo
+type ResumenSerieAuditoria struct {
+	RFCEmisor   string `json:"rfc_emisor"`
+	Serie       string `json:"serie"`
+	UltimoFolio int64  `json:"ultimo_folio"`
+	Desde       int64  `json:"desde,omitempty"` // Primer y último número vistos en el periodo
+	Hasta       int64  `json:"hasta,omitempty"`
+	Reservados  int    `json:"reservados"`
+	Usados      int    `json:"usados"`
+	Anulados    int    `json:"anulados"`
+	Faltantes   int64  `json:"faltantes"`
+}
+
+// AuditoriaFolios es el resultado de revisar la numeración de uno o varios emisores en un periodo
+type AuditoriaFolios struct {
+	Desde     string                  `json:"desde"`
+	Hasta     string                  `json:"hasta"`
+	Series    []ResumenSerieAuditoria `json:"series"`
+	Hallazgos []HallazgoFolio         `json:"hallazgos"`
+}
+
+// FiltroAuditoriaFolios limita la auditoría a un emisor (o todos si va vacío), una serie y
+// un periodo [Desde, Hasta) por fecha de reserva, de registro o de timbrado
+type FiltroAuditoriaFolios struct {
+	RFCEmisor string
+	Serie     string
+	Desde     time.Time
+	Hasta     time.Time
+}
+
+// reservaAuditoria es un renglón de folios_reservados
+type reservaAuditoria struct {
+	numero      int64
+	folio       string
+	estado      string
+	idHistorial int64
+	motivo      string
+	fecha       string
+}
+
+// comprobanteAuditoria es una factura del historial o un CFDI timbrado
+type comprobanteAuditoria struct {
+	id    int64
+	serie string
+	folio string
+	uuid  string
+	fecha string
+}
+
+const formatoFechaAuditoria = "%Y-%m-%d %H:%i:%s"
+
+// AuditarFolios revisa por emisor y serie que la numeración no tenga huecos ni duplicados y
+// que cada CFDI timbrado haya salido de su serie
+func AuditarFolios(f FiltroAuditoriaFolios) (*AuditoriaFolios, error) {
+	if !f.Hasta.After(f.Desde) {
+		return nil, fmt.Errorf("el periodo de la auditoría es inválido")
+	}
+	emisores := []string{strings.ToUpper(strings.TrimSpace(f.RFCEmisor))}
+	if emisores[0] == "" {
+		var err error
+		if emisores, err = emisoresConSeries(); err != nil {
+			return nil, err
+		}
+	}
+
+	auditoria := &AuditoriaFolios{
+		Desde:     f.Desde.Format("2006-01-02"),
+		Hasta:     f.Hasta.AddDate(0, 0, -1).Format("2006-01-02"),
+		Series:    []ResumenSerieAuditoria{},
+		Hallazgos: []HallazgoFolio{},
+	}
+	for _, rfc := range emisores {
+		if err := auditarEmisor(auditoria, rfc, f); err != nil {
+			return nil, err
+		}
+	}
+	auditoria.ordenarHallazgos()
+	return auditoria, nil
+}
+
+// emisoresConSeries devuelve los RFC que tienen al menos una serie
+func emisoresConSeries() ([]string, error) {
+	rows, err := db.GetDB().Query("SELECT DISTINCT rfc_emisor FROM folio_control WHERE rfc_emisor <> '' ORDER BY rfc_emisor")
+	if err != nil {
+		return nil, fmt.Errorf("error al consultar los emisores con series: %w", err)
+	}
+	defer rows.Close()
+	var emisores []string
+	for rows.Next() {
+		var rfc string
+		if err := rows.Scan(&rfc); err != nil {
+			return nil, err
+		}
+		emisores = append(emisores, rfc)
+	}
+	return emisores, rows.Err()
+}
+
+func auditarEmisor(a *AuditoriaFolios, rfc string, f FiltroAuditoriaFolios) error {
+	desde := f.Desde.Format("2006-01-02 15:04:05")
+	hasta := f.Hasta.Format("2006-01-02 15:04:05")
+
+	series, err := ListarSeriesFolio(rfc)
+	if err != nil {
+		return err
+	}
+	porNombre := make(map[string]FolioControl, len(series))
+	for _, s := range series {
+		porNombre[s.Serie] = s
+	}
+
+	// El historial y los timbrados se leen desde el inicio del periodo sin límite superior: un
+	// folio reservado al final del periodo pudo timbrarse después
+	historial, err := historialAuditoria(rfc, desde)
+	if err != nil {
+		return err
+	}
+	timbrados, err := timbradosAuditoria(rfc, desde)
+	if err != nil {
+		return err
+	}
+	timbradoPorFolio := make(map[string]comprobanteAuditoria, len(timbrados))
+	for _, t := range timbrados {
+		timbradoPorFolio[t.serie+"|"+t.folio] = t
+	}
+	uuidHistorial := make(map[string]string, len(historial))
+	for _, h := range historial {
+		if h.uuid != "" {
+			uuidHistorial[h.serie+"|"+h.folio] = h.uuid
+		}
+	}
+
+	// El historial anterior a las series no guarda la serie: se atribuye por el prefijo del folio
+	for i, h := range historial {
+		if h.serie != "" {
+			continue
+		}
+		if s, ok := serieDeFolio(series, h.folio); ok {
+			historial[i].serie = s.Serie
+		}
+	}
+
+	for _, s := range series {
+		if f.Serie != "" && !strings.EqualFold(s.Serie, f.Serie) {
+			continue
+		}
+		if err := auditarSerie(a, s, f, desde, hasta, historial, timbradoPorFolio, uuidHistorial); err != nil {
+			return err
+		}
+	}
+
+	// Duplicados y facturas sin UUID del periodo
+	repetidos := map[string][]comprobanteAuditoria{}
+	var claves []string
+	for _, h := range historial {
+		if h.fecha >= hasta || (f.Serie != "" && !strings.EqualFold(h.serie, f.Serie)) {
+			continue
+		}
+		clave := h.serie + "|" + h.folio
+		if len(repetidos[clave]) == 0 {
+			claves = append(claves, clave)
+		}
+		repetidos[clave] = append(repetidos[clave], h)
+
+		if h.uuid == "" {
+			detalle := "la factura no tiene UUID registrado"
+			if t, ok := timbradoPorFolio[clave]; ok {
+				detalle = "timbrada con UUID " + t.uuid + " pero el UUID no se registró en el historial"
+			}
+			a.Hallazgos = append(a.Hallazgos, HallazgoFolio{
+				Tipo: HallazgoSinUUID, RFCEmisor: rfc, Serie: h.serie, Folio: h.folio,
+				IDHistorial: h.id, Fecha: h.fecha, Detalle: detalle,
+			})
+		}
+	}
+	for _, clave := range claves {
+		registros := repetidos[clave]
+		if len(registros) < 2 {
+			continue
+		}
+		ids := make([]string, 0, len(registros))
+		for _, r := range registros {
+			ids = append(ids, strconv.FormatInt(r.id, 10))
+		}
+		a.Hallazgos = append(a.Hallazgos, HallazgoFolio{
+			Tipo: HallazgoDuplicado, RFCEmisor: rfc, Serie: registros[0].serie, Folio: registros[0].folio,
+			IDHistorial: registros[0].id, UUID: registros[0].uuid, Fecha: registros[0].fecha,
+			Detalle: fmt.Sprintf("registrado %d veces en el historial (ids %s)", len(registros), strings.Join(ids, ", ")),
+		})
+	}
+
+	// CFDI timbrados en el periodo con un folio que no salió de una serie del emisor
+	for _, t := range timbrados {
+		if t.fecha >= hasta || (f.Serie != "" && !strings.EqualFold(t.serie, f.Serie)) {
+			continue
+		}
+		detalle := ""
+		s, ok := porNombre[t.serie]
+		numero, valido := int64(0), false
+		if ok {
+			numero, valido = numeroDeFolio(s, t.folio)
+		}
+		switch {
+		case !ok:
+			detalle = "la serie " + t.serie + " no está registrada para el emisor"
+		case !valido:
+			detalle = fmt.Sprintf("el folio no corresponde al formato de la serie (prefijo %q)", s.Prefijo)
+		case numero > s.UltimoFolio:
+			detalle = fmt.Sprintf("el número %d es mayor al último folio asignado de la serie (%d)", numero, s.UltimoFolio)
+		default:
+			var existe int
+			if err := db.GetDB().QueryRow(
+				"SELECT COUNT(*) FROM folios_reservados WHERE id_serie = ? AND numero = ?", s.ID, numero,
+			).Scan(&existe); err != nil {
+				return fmt.Errorf("error al consultar la reserva del folio %s%s: %w", t.serie, t.folio, err)
+			}
+			if existe == 0 {
+				detalle = "el folio no tiene reserva en la serie"
+			}
+		}
+		if detalle != "" {
+			a.Hallazgos = append(a.Hallazgos, HallazgoFolio{
+				Tipo: HallazgoFueraDeSerie, RFCEmisor: rfc, Serie: t.serie, Numero: numero, Folio: t.folio,
+				UUID: t.uuid, Fecha: t.fecha, Detalle: detalle,
+			})
+		}
+	}
+	return nil
+}
+
+// auditarSerie busca huecos en la numeración de la serie y folios que nunca se timbraron
+func auditarSerie(a *AuditoriaFolios, s FolioControl, f FiltroAuditoriaFolios, desde, hasta string,
+	historial []comprobanteAuditoria, timbrados map[string]comprobanteAuditoria, uuidHistorial map[string]string) error {
+	ultimo, err := ObtenerUltimoFolio(db.GetDB(), s.RFCEmisor, s.Serie)
+	if err != nil {
+		return err
+	}
+	resumen := ResumenSerieAuditoria{RFCEmisor: s.RFCEmisor, Serie: s.Serie, UltimoFolio: ultimo}
+
+	reservas, err := reservasAuditoria(s.ID, "fecha_creacion >= ? AND fecha_creacion < ?", desde, hasta)
+	if err != nil {
+		return err
+	}
+	// Números vistos en el periodo: reservas y facturas registradas de la serie
+	registrados := map[int64]bool{}
+	for _, h := range historial {
+		if h.serie != s.Serie || h.fecha >= hasta {
+			continue
+		}
+		if n, ok := numeroDeFolio(s, h.folio); ok && n <= ultimo {
+			registrados[n] = true
+		}
+	}
+	for _, r := range reservas {
+		registrados[r.numero] = true
+	}
+	for n := range registrados {
+		if resumen.Desde == 0 || n < resumen.Desde {
+			resumen.Desde = n
+		}
+		if n > resumen.Hasta {
+			resumen.Hasta = n
+		}
+	}
+
+	for _, r := range reservas {
+		switch r.estado {
+		case FolioReservado:
+			resumen.Reservados++
+		case FolioUsado:
+			resumen.Usados++
+		case FolioAnulado:
+			resumen.Anulados++
+			continue
+		}
+		clave := s.Serie + "|" + r.folio
+		if _, ok := timbrados[clave]; ok || uuidHistorial[clave] != "" {
+			continue
+		}
+		a.Hallazgos = append(a.Hallazgos, HallazgoFolio{
+			Tipo: HallazgoSinTimbrar, RFCEmisor: s.RFCEmisor, Serie: s.Serie, Numero: r.numero, Folio: r.folio,
+			IDHistorial: r.idHistorial, Fecha: r.fecha, Detalle: "folio " + r.estado + " sin CFDI timbrado",
+		})
+	}
+
+	// Los huecos se buscan entre el primer y el último número del periodo contra todas las
+	// reservas de ese tramo, aunque se hayan hecho fuera del periodo
+	if resumen.Hasta > 0 {
+		tramo, err := reservasAuditoria(s.ID, "numero BETWEEN ? AND ?", resumen.Desde, resumen.Hasta)
+		if err != nil {
+			return err
+		}
+		for _, r := range tramo {
+			registrados[r.numero] = true
+		}
+		for n := resumen.Desde; n <= resumen.Hasta; n++ {
+			if registrados[n] {
+				continue
+			}
+			inicio := n
+			for n+1 <= resumen.Hasta && !registrados[n+1] {
+				n++
+			}
+			resumen.Faltantes += n - inicio + 1
+			detalle := fmt.Sprintf("falta el número %d", inicio)
+			if n > inicio {
+				detalle = fmt.Sprintf("faltan %d números: del %s al %s", n-inicio+1, s.FormatearFolio(inicio), s.FormatearFolio(n))
+			}
+			a.Hallazgos = append(a.Hallazgos, HallazgoFolio{
+				Tipo: HallazgoFaltante, RFCEmisor: s.RFCEmisor, Serie: s.Serie, Numero: inicio,
+				Folio: s.FormatearFolio(inicio), Detalle: detalle,
+			})
+		}
+	}
+	a.Series = append(a.Series, resumen)
+	return nil
+}
+
+// reservasAuditoria lee las reservas de la serie que cumplen la condición, en orden de número
+func reservasAuditoria(idSerie int, condicion string, args ...interface{}) ([]reservaAuditoria, error) {
+	rows, err := db.GetDB().Query(
+		`SELECT numero, folio, estado, COALESCE(id_historial, 0), COALESCE(motivo, ''),
+			COALESCE(DATE_FORMAT(fecha_creacion, '`+formatoFechaAuditoria+`'), '')
+		FROM folios_reservados WHERE id_serie = ? AND `+condicion+` ORDER BY numero`,
+		append([]interface{}{idSerie}, args...)...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error al consultar los folios reservados: %w", err)
+	}
+	defer rows.Close()
+	var reservas []reservaAuditoria
+	for rows.Next() {
+		var r reservaAuditoria
+		if err := rows.Scan(&r.numero, &r.folio, &r.estado, &r.idHistorial, &r.motivo, &r.fecha); err != nil {
+			return nil, fmt.Errorf("error al leer folio reservado: %w", err)
+		}
+		reservas = append(reservas, r)
+	}
+	return reservas, rows.Err()
+}
+
+// historialAuditoria lee las facturas del emisor registradas desde la fecha dada. El historial
+// anterior a las series no guarda el RFC del emisor; se toma de los datos fiscales del usuario.
+func historialAuditoria(rfc, desde string) ([]comprobanteAuditoria, error) {
+	rows, err := db.GetDB().Query(
+		`SELECT h.id, COALESCE(h.serie, ''), COALESCE(h.folio, ''), COALESCE(h.uuid, ''),
+			COALESCE(DATE_FORMAT(h.fecha_generacion, '`+formatoFechaAuditoria+`'), '')
+		FROM historial_facturas h
+		WHERE COALESCE(h.rfc_emisor, (SELECT d.rfc FROM datos_fiscales d WHERE d.id_usuario = h.id_usuario LIMIT 1)) = ?
+			AND h.fecha_generacion >= ?
+		ORDER BY h.id`,
+		rfc, desde,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error al consultar el historial de %s: %w", rfc, err)
+	}
+	defer rows.Close()
+	var historial []comprobanteAuditoria
+	for rows.Next() {
+		var h comprobanteAuditoria
+		if err := rows.Scan(&h.id, &h.serie, &h.folio, &h.uuid, &h.fecha); err != nil {
+			return nil, fmt.Errorf("error al leer el historial: %w", err)
+		}
+		historial = append(historial, h)
+	}
+	return historial, rows.Err()
+}
+
+// timbradosAuditoria lee los CFDI del emisor timbrados desde la fecha dada
+func timbradosAuditoria(rfc, desde string) ([]comprobanteAuditoria, error) {
+	rows, err := db.GetDB().Query(
+		`SELECT id, serie, folio, COALESCE(uuid, ''),
+			COALESCE(DATE_FORMAT(fecha_actualizacion, '`+formatoFechaAuditoria+`'), '')
+		FROM timbrados WHERE rfc_emisor = ? AND estado = ? AND fecha_actualizacion >= ?
+		ORDER BY id`,
+		rfc, db.TimbradoCompletado, desde,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error al consultar los timbrados de %s: %w", rfc, err)
+	}
+	defer rows.Close()
+	var timbrados []comprobanteAuditoria
+	for rows.Next() {
+		var t comprobanteAuditoria
+		if err := rows.Scan(&t.id, &t.serie, &t.folio, &t.uuid, &t.fecha); err != nil {
+			return nil, fmt.Errorf("error al leer los timbrados: %w", err)
+		}
+		timbrados = append(timbrados, t)
+	}
+	return timbrados, rows.Err()
+}
+
+// numeroDeFolio extrae el número de un folio con el formato de la serie (prefijo + dígitos)
+func numeroDeFolio(s FolioControl, folio string) (int64, bool) {
+	digitos, ok := strings.CutPrefix(folio, s.Prefijo)
+	if !ok || digitos == "" || strings.TrimLeft(digitos, "0123456789") != "" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(digitos, 10, 64)
+	return n, err == nil && n > 0
+}
+
+// serieDeFolio busca la serie cuyo formato corresponde al folio; prefiere el prefijo más largo
+func serieDeFolio(series []FolioControl, folio string) (FolioControl, bool) {
+	var elegida FolioControl
+	encontrada := false
+	for _, s := range series {
+		if _, ok := numeroDeFolio(s, folio); ok && (!encontrada || len(s.Prefijo) > len(elegida.Prefijo)) {
+			elegida, encontrada = s, true
+		}
+	}
+	return elegida, encontrada
+}
+
+// ordenarHallazgos agrupa los hallazgos por emisor, serie y número
+func (a *AuditoriaFolios) ordenarHallazgos() {
+	sort.SliceStable(a.Hallazgos, func(i, j int) bool {
+		x, y := a.Hallazgos[i], a.Hallazgos[j]
+		if x.RFCEmisor != y.RFCEmisor {
+			return x.RFCEmisor < y.RFCEmisor
+		}
+		if x.Serie != y.Serie {
+			return x.Serie < y.Serie
+		}
+		if x.Numero != y.Numero {
+			return x.Numero < y.Numero
+		}
+		return x.Folio < y.Folio
+	})
+}
+
+// EscribirCSV exporta los hallazgos de la auditoría, uno por renglón
+func (a *AuditoriaFolios) EscribirCSV(w io.Writer) error {
+	csvW := csv.NewWriter(w)
+	csvW.Write([]string{"tipo", "rfc_emisor", "serie", "numero", "folio", "id_historial", "uuid", "fecha", "detalle"})
+	for _, h := range a.Hallazgos {
+		numero, idHistorial := "", ""
+		if h.Numero > 0 {
+			numero = strconv.FormatInt(h.Numero, 10)
+		}
+		if h.IDHistorial > 0 {
+			idHistorial = strconv.FormatInt(h.IDHistorial, 10)
+		}
+		csvW.Write([]string{h.Tipo, h.RFCEmisor, h.Serie, numero, h.Folio, idHistorial, h.UUID, h.Fecha, h.Detalle})
+	}
+	csvW.Flush()
+	return csvW.Error()
+}
@@ -0,0 +1,196 @@
+package models
+
+import (
+	"Facts/internal/db"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// MotivosCancelacion es el catálogo c_MotivoCancelacion del SAT
+var MotivosCancelacion = map[string]string{
+	"01": "Comprobante emitido con errores con relación",
+	"02": "Comprobante emitido con errores sin relación",
+	"03": "No se llevó a cabo la operación",
+	"04": "Operación nominativa relacionada en una factura global",
+}
+
+// MotivoCancelacionSustitucion exige el UUID del CFDI que sustituye al cancelado
+const MotivoCancelacionSustitucion = "01"
+
+// Estados de una solicitud de cancelación. Si el receptor debe aceptarla queda en proceso
+// hasta que la acepte, la rechace o venza su plazo (que equivale a aceptarla).
+const (
+	CancelacionEnProceso    = "en_proceso"
+	CancelacionCancelada    = "cancelada"
+	CancelacionRechazada    = "rechazada"
+	CancelacionPlazoVencido = "plazo_vencido"
+)
+
+// Valores de historial_facturas.estado que cambia la cancelación
+const (
+	EstadoHistorialGenerada      = "G"
+	EstadoHistorialEnCancelacion = "S"
+	EstadoHistorialCancelada     = "C"
+)
+
+// Cancelacion es una solicitud de cancelación de una factura del historial
+type Cancelacion struct {
+	ID                     int64   `json:"id"`
+	IDHistorial            int     `json:"id_historial"`
+	IDUsuario              int     `json:"id_usuario"`
+	UUID                   string  `json:"uuid"`
+	RFCEmisor              string  `json:"rfc_emisor"`
+	RFCReceptor            string  `json:"rfc_receptor"`
+	Total                  float64 `json:"total"`
+	Motivo                 string  `json:"motivo"`
+	FolioSustitucion       string  `json:"folio_sustitucion,omitempty"`
+	IDHistorialSustitucion int     `json:"id_historial_sustitucion,omitempty"`
+	Estado                 string  `json:"estado"`
+	CodigoEstatus          string  `json:"codigo_estatus,omitempty"`
+	EstatusSAT             string  `json:"estatus_sat,omitempty"`
+	Acuse                  string  `json:"-"`
+	FechaSolicitud         string  `json:"fecha_solicitud"`
+	FechaActualizacion     string  `json:"fecha_actualizacion"`
+}
+
+// Cancelado indica que el CFDI ya no está vigente ante el SAT
+func (c *Cancelacion) Cancelado() bool {
+	return c.Estado == CancelacionCancelada || c.Estado == CancelacionPlazoVencido
+}
+
+// ValidarMotivoCancelacion revisa el motivo y que el folio de sustitución venga solo con el motivo 01
+func ValidarMotivoCancelacion(motivo, folioSustitucion string) error {
+	if _, ok := MotivosCancelacion[motivo]; !ok {
+		return fmt.Errorf("motivo de cancelación inválido (permitidos: 01, 02, 03, 04)")
+	}
+	if motivo == MotivoCancelacionSustitucion && folioSustitucion == "" {
+		return fmt.Errorf("el motivo 01 requiere el folio fiscal (UUID) del CFDI que sustituye al cancelado")
+	}
+	if motivo != MotivoCancelacionSustitucion && folioSustitucion != "" {
+		return fmt.Errorf("el folio de sustitución solo aplica al motivo 01")
+	}
+	return nil
+}
+
+// EstadoCancelacionSAT traduce el estado y el estatus de cancelación que reporta el SAT
+func EstadoCancelacionSAT(estado, estatusCancelacion string) string {
+	estatus := strings.ToLower(estatusCancelacion)
+	switch {
+	case strings.Contains(estatus, "plazo vencido"):
+		return CancelacionPlazoVencido
+	case strings.EqualFold(estado, "Cancelado") || strings.HasPrefix(estatus, "cancelado"):
+		return CancelacionCancelada
+	case strings.Contains(estatus, "rechazada"):
+		return CancelacionRechazada
+	}
+	return CancelacionEnProceso
+}
+
+// estadoHistorialCancelacion es el estado que muestra el historial para cada estado de cancelación
+func estadoHistorialCancelacion(estado string) string {
+	switch estado {
+	case CancelacionCancelada, CancelacionPlazoVencido:
+		return EstadoHistorialCancelada
+	case CancelacionEnProceso:
+		return EstadoHistorialEnCancelacion
+	}
+	return EstadoHistorialGenerada
+}
+
+// RegistrarCancelacion guarda la respuesta del PAC y actualiza el estado de la factura en el historial
+func RegistrarCancelacion(c *Cancelacion) (int64, error) {
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return 0, fmt.Errorf("error al iniciar transacción: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		`INSERT INTO cancelaciones
+		(id_historial, id_usuario, uuid, rfc_emisor, rfc_receptor, total, motivo, folio_sustitucion,
+		id_historial_sustitucion, estado, codigo_estatus, estatus_sat, acuse)
+		VALUES (?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, 0), ?, ?, ?, ?)`,
+		c.IDHistorial, c.IDUsuario, c.UUID, c.RFCEmisor, c.RFCReceptor, c.Total, c.Motivo, c.FolioSustitucion,
+		c.IDHistorialSustitucion, c.Estado, c.CodigoEstatus, c.EstatusSAT, c.Acuse,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("error al registrar cancelación: %w", err)
+	}
+	if _, err := tx.Exec("UPDATE historial_facturas SET estado = ? WHERE id = ?", estadoHistorialCancelacion(c.Estado), c.IDHistorial); err != nil {
+		return 0, fmt.Errorf("error al actualizar estado del historial: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// ActualizarEstadoCancelacion guarda el estado consultado al SAT y lo refleja en el historial
+func ActualizarEstadoCancelacion(c *Cancelacion) error {
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return fmt.Errorf("error al iniciar transacción: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		"UPDATE cancelaciones SET estado = ?, codigo_estatus = ?, estatus_sat = ? WHERE id = ?",
+		c.Estado, c.CodigoEstatus, c.EstatusSAT, c.ID,
+	); err != nil {
+		return fmt.Errorf("error al actualizar cancelación: %w", err)
+	}
+	if _, err := tx.Exec("UPDATE historial_facturas SET estado = ? WHERE id = ?", estadoHistorialCancelacion(c.Estado), c.IDHistorial); err != nil {
+		return fmt.Errorf("error al actualizar estado del historial: %w", err)
+	}
+	return tx.Commit()
+}
+
+const selectCancelacion = `SELECT id, id_historial, id_usuario, uuid, rfc_emisor, rfc_receptor, total, motivo,
+	COALESCE(folio_sustitucion, ''), COALESCE(id_historial_sustitucion, 0), estado,
+	COALESCE(codigo_estatus, ''), COALESCE(estatus_sat, ''), COALESCE(acuse, ''),
+	DATE_FORMAT(fecha_solicitud, '%Y-%m-%d %H:%i:%s'), DATE_FORMAT(fecha_actualizacion, '%Y-%m-%d %H:%i:%s')
+	FROM cancelaciones`
+
+func escanearCancelacion(fila interface{ Scan(...interface{}) error }) (*Cancelacion, error) {
+	var c Cancelacion
+	err := fila.Scan(&c.ID, &c.IDHistorial, &c.IDUsuario, &c.UUID, &c.RFCEmisor, &c.RFCReceptor, &c.Total, &c.Motivo,
+		&c.FolioSustitucion, &c.IDHistorialSustitucion, &c.Estado, &c.CodigoEstatus, &c.EstatusSAT, &c.Acuse,
+		&c.FechaSolicitud, &c.FechaActualizacion)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// ObtenerUltimaCancelacion devuelve la solicitud de cancelación más reciente de la factura, o nil si no hay
+func ObtenerUltimaCancelacion(idHistorial int) (*Cancelacion, error) {
+	c, err := escanearCancelacion(db.GetDB().QueryRow(selectCancelacion+" WHERE id_historial = ? ORDER BY id DESC LIMIT 1", idHistorial))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error al consultar cancelación: %w", err)
+	}
+	return c, nil
+}
+
+// ObtenerCancelacionesEnProceso lista las solicitudes que esperan respuesta del receptor
+func ObtenerCancelacionesEnProceso() ([]Cancelacion, error) {
+	rows, err := db.GetDB().Query(selectCancelacion+" WHERE estado = ? ORDER BY id", CancelacionEnProceso)
+	if err != nil {
+		return nil, fmt.Errorf("error al consultar cancelaciones en proceso: %w", err)
+	}
+	defer rows.Close()
+
+	var cancelaciones []Cancelacion
+	for rows.Next() {
+		c, err := escanearCancelacion(rows)
+		if err != nil {
+			return nil, err
+		}
+		cancelaciones = append(cancelaciones, *c)
+	}
+	return cancelaciones, rows.Err()
+}
@@ -0,0 +1,215 @@
+package models
+
+import (
+	"Facts/internal/db"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Tipos de relación permitidos para notas de crédito (catálogo c_TipoRelacion)
+var TiposRelacionNotaCredito = map[string]string{
+	"01": "Nota de crédito de los documentos relacionados",
+	"03": "Devolución de mercancía sobre facturas o traslados previos",
+	"07": "CFDI por aplicación de anticipo",
+}
+
+// CFDIRelacionado representa la relación entre una factura del historial y un comprobante que la afecta
+type CFDIRelacionado struct {
+	ID                     int     `json:"id"`
+	IDHistorialOrigen      int     `json:"id_historial_origen"`
+	IDHistorialRelacionado int     `json:"id_historial_relacionado"`
+	UUIDOrigen             string  `json:"uuid_origen"`
+	TipoComprobante        string  `json:"tipo_comprobante"`
+	TipoRelacion           string  `json:"tipo_relacion"`
+	Monto                  float64 `json:"monto"`
+	FechaCreacion          string  `json:"fecha_creacion"`
+}
+
+// minutosRelacionApartada es lo que cuenta en el saldo una relación apartada (id_historial_relacionado
+// en 0) cuyo comprobante no se registró; una más vieja quedó de una solicitud que no terminó
+const minutosRelacionApartada = 10
+
+// relacionesAcreditadas son las notas de crédito y los pagos que reducen el saldo de la factura
+// origen: los registrados que no se cancelaron y los apartados mientras se timbran. Sus
+// parámetros los arma argsRelacionesAcreditadas.
+const relacionesAcreditadas = `FROM cfdi_relacionados r
+	LEFT JOIN historial_facturas h ON h.id = r.id_historial_relacionado
+	WHERE r.tipo_comprobante IN ('E', 'P') AND (
+		(r.id_historial_relacionado > 0 AND COALESCE(h.estado, '') <> ?)
+		OR (r.id_historial_relacionado = 0 AND r.fecha_creacion >= NOW() - INTERVAL ? MINUTE))`
+
+func argsRelacionesAcreditadas(resto ...interface{}) []interface{} {
+	return append([]interface{}{EstadoHistorialCancelada, minutosRelacionApartada}, resto...)
+}
+
+// RegistrarRelacionCFDI guarda la relación entre la factura original y el comprobante que la afecta
+func RegistrarRelacionCFDI(rel CFDIRelacionado) (int64, error) {
+	return insertarRelacionCFDI(db.GetDB(), rel)
+}
+
+func insertarRelacionCFDI(ejecutor interface {
+	Exec(string, ...interface{}) (sql.Result, error)
+}, rel CFDIRelacionado) (int64, error) {
+	result, err := ejecutor.Exec(
+		`INSERT INTO cfdi_relacionados
+		(id_historial_origen, id_historial_relacionado, uuid_origen, tipo_comprobante, tipo_relacion, monto)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		rel.IDHistorialOrigen, rel.IDHistorialRelacionado, rel.UUIDOrigen,
+		rel.TipoComprobante, rel.TipoRelacion, rel.Monto,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("error al registrar CFDI relacionado: %w", err)
+	}
+	return result.LastInsertId()
+}
+
+// ApartarRelacionesCFDI registra dentro de tx, con id_historial_relacionado en 0, las relaciones de
+// un comprobante que todavía se va a timbrar, y les asigna su ID. Así su monto cuenta en el saldo
+// sin tener bloqueada la factura origen durante el timbrado.
+func ApartarRelacionesCFDI(tx *sql.Tx, relaciones []CFDIRelacionado) error {
+	for i := range relaciones {
+		relaciones[i].IDHistorialRelacionado = 0
+		id, err := insertarRelacionCFDI(tx, relaciones[i])
+		if err != nil {
+			return err
+		}
+		relaciones[i].ID = int(id)
+	}
+	return nil
+}
+
+// LiberarRelacionesCFDI borra las relaciones apartadas de un comprobante que no se emitió; las ya
+// confirmadas no se tocan
+func LiberarRelacionesCFDI(relaciones []CFDIRelacionado) error {
+	for _, rel := range relaciones {
+		if rel.ID <= 0 {
+			continue
+		}
+		_, err := db.GetDB().Exec("DELETE FROM cfdi_relacionados WHERE id = ? AND id_historial_relacionado = 0", rel.ID)
+		if err != nil {
+			return fmt.Errorf("error al liberar la relación %d: %w", rel.ID, err)
+		}
+	}
+	return nil
+}
+
+// registrarRelacionCFDI liga la relación al comprobante idHistorial: confirma la apartada o
+// inserta una nueva
+func registrarRelacionCFDI(tx *sql.Tx, rel CFDIRelacionado, idHistorial int64) error {
+	rel.IDHistorialRelacionado = int(idHistorial)
+	if rel.ID <= 0 {
+		_, err := insertarRelacionCFDI(tx, rel)
+		return err
+	}
+	res, err := tx.Exec(
+		"UPDATE cfdi_relacionados SET id_historial_relacionado = ? WHERE id = ? AND id_historial_relacionado = 0",
+		idHistorial, rel.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("error al confirmar CFDI relacionado: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		// El apartado se liberó o venció; se registra de nuevo
+		_, err := insertarRelacionCFDI(tx, rel)
+		return err
+	}
+	return nil
+}
+
+// ObtenerRelacionesFactura lista los comprobantes relacionados con una factura del historial
+func ObtenerRelacionesFactura(idHistorial int) ([]CFDIRelacionado, error) {
+	rows, err := db.GetDB().Query(
+		`SELECT id, id_historial_origen, id_historial_relacionado, uuid_origen, tipo_comprobante, tipo_relacion, monto,
+		DATE_FORMAT(fecha_creacion, '%Y-%m-%d %H:%i:%s')
+		FROM cfdi_relacionados
+		WHERE id_historial_origen = ? AND id_historial_relacionado > 0
+		ORDER BY fecha_creacion`,
+		idHistorial,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error al consultar CFDI relacionados: %w", err)
+	}
+	defer rows.Close()
+
+	var relaciones []CFDIRelacionado
+	for rows.Next() {
+		var rel CFDIRelacionado
+		if err := rows.Scan(&rel.ID, &rel.IDHistorialOrigen, &rel.IDHistorialRelacionado, &rel.UUIDOrigen,
+			&rel.TipoComprobante, &rel.TipoRelacion, &rel.Monto, &rel.FechaCreacion); err != nil {
+			return nil, err
+		}
+		relaciones = append(relaciones, rel)
+	}
+	return relaciones, rows.Err()
+}
+
+// BloquearFacturaPagada bloquea la factura del historial dentro de tx (SELECT ... FOR UPDATE) y, con el
+// bloqueo tomado, devuelve la siguiente parcialidad y el saldo pendiente. Otro pago de la misma factura
+// espera a que tx termine, así dos complementos no toman la misma parcialidad ni el mismo saldo.
+func BloquearFacturaPagada(tx *sql.Tx, idHistorial int) (int, float64, error) {
+	var total float64
+	err := tx.QueryRow("SELECT total FROM historial_facturas WHERE id = ? FOR UPDATE", idHistorial).Scan(&total)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error al bloquear la factura %d: %w", idHistorial, err)
+	}
+	var pagos int
+	var acreditado float64
+	err = tx.QueryRow(
+		`SELECT COALESCE(SUM(r.tipo_comprobante = 'P'), 0), COALESCE(SUM(r.monto), 0)
+		`+relacionesAcreditadas+` AND r.id_historial_origen = ?`,
+		argsRelacionesAcreditadas(idHistorial)...,
+	).Scan(&pagos, &acreditado)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error al contar parcialidades: %w", err)
+	}
+	return pagos + 1, total - acreditado, nil
+}
+
+// completarSaldos asigna el saldo pendiente (total menos egresos y pagos relacionados) a cada factura del historial
+func completarSaldos(facturas []HistorialFactura) {
+	consultarSaldos(db.GetDB(), facturas)
+}
+
+func consultarSaldos(consultor interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}, facturas []HistorialFactura) {
+	if len(facturas) == 0 {
+		return
+	}
+	indices := make(map[int][]int, len(facturas))
+	ids := make([]interface{}, 0, len(facturas))
+	for i := range facturas {
+		facturas[i].SaldoPendiente = facturas[i].Total
+		if _, ok := indices[facturas[i].ID]; !ok {
+			ids = append(ids, facturas[i].ID)
+		}
+		indices[facturas[i].ID] = append(indices[facturas[i].ID], i)
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	rows, err := consultor.Query(
+		`SELECT r.id_historial_origen, COALESCE(SUM(r.monto), 0)
+		`+relacionesAcreditadas+` AND r.id_historial_origen IN (`+placeholders+`)
+		GROUP BY r.id_historial_origen`,
+		argsRelacionesAcreditadas(ids...)...,
+	)
+	if err != nil {
+		// La tabla puede no existir en instalaciones antiguas; el saldo queda igual al total
+		log.Printf("Error al consultar saldos del historial (no crítico): %v", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var acreditado float64
+		if err := rows.Scan(&id, &acreditado); err != nil {
+			continue
+		}
+		for _, i := range indices[id] {
+			facturas[i].SaldoPendiente = facturas[i].Total - acreditado
+		}
+	}
+}
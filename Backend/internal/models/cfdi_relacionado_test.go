@@ -0,0 +1,169 @@
+package models
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// consultaRegistrada es una consulta recibida por el driver de prueba
+type consultaRegistrada struct {
+	sql  string
+	args []driver.Value
+}
+
+// driverConsultas responde cada consulta con el siguiente resultado de la lista y registra lo recibido
+type driverConsultas struct {
+	mu         sync.Mutex
+	resultados [][][]driver.Value
+	consultas  []consultaRegistrada
+}
+
+type conexionConsultas struct{ d *driverConsultas }
+
+func (c conexionConsultas) Prepare(consulta string) (driver.Stmt, error) {
+	return sentenciaConsultas{c.d, consulta}, nil
+}
+func (c conexionConsultas) Close() error              { return nil }
+func (c conexionConsultas) Begin() (driver.Tx, error) { return c, nil }
+func (c conexionConsultas) Commit() error             { return nil }
+func (c conexionConsultas) Rollback() error           { return nil }
+
+type sentenciaConsultas struct {
+	d   *driverConsultas
+	sql string
+}
+
+func (s sentenciaConsultas) Close() error  { return nil }
+func (s sentenciaConsultas) NumInput() int { return -1 }
+func (s sentenciaConsultas) Exec([]driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(0), nil
+}
+func (s sentenciaConsultas) Query(args []driver.Value) (driver.Rows, error) {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	s.d.consultas = append(s.d.consultas, consultaRegistrada{s.sql, args})
+	if len(s.d.resultados) == 0 {
+		return &filasConsultas{}, nil
+	}
+	filas := s.d.resultados[0]
+	s.d.resultados = s.d.resultados[1:]
+	return &filasConsultas{filas: filas}, nil
+}
+
+type filasConsultas struct{ filas [][]driver.Value }
+
+func (f *filasConsultas) Columns() []string {
+	if len(f.filas) == 0 {
+		return nil
+	}
+	return make([]string, len(f.filas[0]))
+}
+func (f *filasConsultas) Close() error { return nil }
+func (f *filasConsultas) Next(dest []driver.Value) error {
+	if len(f.filas) == 0 {
+		return io.EOF
+	}
+	copy(dest, f.filas[0])
+	f.filas = f.filas[1:]
+	return nil
+}
+
+var registrarDriverConsultas sync.Once
+
+// abrirConsultas abre una base de datos de prueba que responde con resultados en orden
+func abrirConsultas(t *testing.T, resultados ...[][]driver.Value) (*sql.DB, *driverConsultas) {
+	t.Helper()
+	d := &driverConsultas{resultados: resultados}
+	registrarDriverConsultas.Do(func() { sql.Register("consultas", driverMux{}) })
+	muxActual.Lock()
+	muxActual.d = d
+	muxActual.Unlock()
+	conn, err := sql.Open("consultas", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetMaxOpenConns(1)
+	t.Cleanup(func() { conn.Close() })
+	return conn, d
+}
+
+// driverMux dirige las conexiones al driver de la prueba en curso (sql.Register solo se llama una vez)
+type driverMux struct{}
+
+var muxActual struct {
+	sync.Mutex
+	d *driverConsultas
+}
+
+func (driverMux) Open(string) (driver.Conn, error) {
+	muxActual.Lock()
+	defer muxActual.Unlock()
+	return conexionConsultas{muxActual.d}, nil
+}
+
+// verificarExcluyeCanceladas comprueba que la consulta de saldo solo cuente comprobantes vigentes y
+// apartados recientes
+func verificarExcluyeCanceladas(t *testing.T, c consultaRegistrada) {
+	t.Helper()
+	if !strings.Contains(c.sql, "LEFT JOIN historial_facturas h ON h.id = r.id_historial_relacionado") {
+		t.Errorf("la consulta no revisa el estado del comprobante relacionado:\n%s", c.sql)
+	}
+	if !strings.Contains(c.sql, "COALESCE(h.estado, '') <> ?") || len(c.args) < 2 || c.args[0] != EstadoHistorialCancelada {
+		t.Errorf("la consulta no excluye los comprobantes cancelados: %s %v", c.sql, c.args)
+	}
+	if !strings.Contains(c.sql, "r.id_historial_relacionado = 0 AND r.fecha_creacion >= NOW() - INTERVAL ? MINUTE") ||
+		len(c.args) < 2 || c.args[1] != int64(minutosRelacionApartada) {
+		t.Errorf("la consulta no cuenta los apartados vigentes: %s %v", c.sql, c.args)
+	}
+}
+
+func TestBloquearFacturaPagadaExcluyeCanceladas(t *testing.T) {
+	conn, d := abrirConsultas(t,
+		[][]driver.Value{{float64(1000)}},
+		[][]driver.Value{{int64(2), float64(350)}},
+	)
+	tx, err := conn.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	parcialidad, saldo, err := BloquearFacturaPagada(tx, 7)
+	if err != nil {
+		t.Fatalf("BloquearFacturaPagada: %v", err)
+	}
+	if parcialidad != 3 || saldo != 650 {
+		t.Errorf("parcialidad %d, saldo %.2f; se esperaba 3 y 650.00", parcialidad, saldo)
+	}
+	if len(d.consultas) != 2 {
+		t.Fatalf("se esperaban 2 consultas, hubo %d", len(d.consultas))
+	}
+	verificarExcluyeCanceladas(t, d.consultas[1])
+	if ultimo := d.consultas[1].args[len(d.consultas[1].args)-1]; ultimo != int64(7) {
+		t.Errorf("la consulta de saldo usa la factura %v, se esperaba 7", ultimo)
+	}
+}
+
+func TestConsultarSaldosExcluyeCanceladas(t *testing.T) {
+	conn, d := abrirConsultas(t, [][]driver.Value{{int64(1), float64(40)}})
+	facturas := []HistorialFactura{{ID: 1, Total: 100}, {ID: 2, Total: 80}, {ID: 1, Total: 100}}
+
+	consultarSaldos(conn, facturas)
+
+	for i, esperado := range []float64{60, 80, 60} {
+		if facturas[i].SaldoPendiente != esperado {
+			t.Errorf("factura %d: saldo %.2f, se esperaba %.2f", i, facturas[i].SaldoPendiente, esperado)
+		}
+	}
+	if len(d.consultas) != 1 {
+		t.Fatalf("se esperaba 1 consulta, hubo %d", len(d.consultas))
+	}
+	verificarExcluyeCanceladas(t, d.consultas[0])
+	if n := len(d.consultas[0].args); n != 4 {
+		t.Errorf("la consulta recibió %d parámetros, se esperaban 4 (estado, minutos y dos facturas)", n)
+	}
+}
@@ -0,0 +1,293 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"Facts/internal/db"
+)
+
+// LongitudMinimaClaveTicket es la longitud de la clave impresa en los tickets de Optimus
+const LongitudMinimaClaveTicket = 30
+
+// Modos del plazo de autofacturación del emisor
+const (
+	VentanaMismoMes = "mes"   // El mes de la compra más Dias de gracia del mes siguiente
+	VentanaDias     = "dias"  // Dias naturales contados desde la compra
+	VentanaLibre    = "libre" // Sin plazo
+)
+
+// Motivos por los que un ticket no se puede autofacturar
+const (
+	TicketClaveInvalida = "clave_invalida"
+	TicketNoEncontrado  = "no_encontrado"
+	TicketCancelado     = "cancelado"
+	TicketDevuelto      = "devuelto"
+	TicketFacturado     = "facturado"
+	TicketEnProceso     = "en_proceso"
+	TicketFacturaGlobal = "factura_global"
+	TicketFueraDePlazo  = "fuera_de_plazo"
+)
+
+// Fechas en el formato que ve el cliente del portal
+const (
+	formatoFechaCliente  = "02/01/2006"
+	formatoFechaTicketBD = "%d/%m/%Y"
+)
+
+// VentanaAutofactura es el plazo que da el emisor para facturar un ticket
+type VentanaAutofactura struct {
+	Modo string `json:"modo"`
+	Dias int    `json:"dias"`
+}
+
+// MotivoTicket explica al cliente por qué no puede facturar su ticket
+type MotivoTicket struct {
+	Codigo  string `json:"codigo"`
+	Mensaje string `json:"mensaje"`
+}
+
+// ElegibilidadTicket es el resultado de revisar si un ticket se puede autofacturar
+type ElegibilidadTicket struct {
+	ClaveTicket string         `json:"clave_ticket"`
+	Elegible    bool           `json:"elegible"`
+	FechaTicket string         `json:"fecha_ticket,omitempty"`
+	FechaLimite string         `json:"fecha_limite,omitempty"` // Último día para facturar
+	Motivos     []MotivoTicket `json:"motivos"`
+}
+
+// rechazar agrega un motivo y marca el ticket como no elegible
+func (e *ElegibilidadTicket) rechazar(codigo, mensaje string) {
+	e.Elegible = false
+	e.Motivos = append(e.Motivos, MotivoTicket{Codigo: codigo, Mensaje: mensaje})
+}
+
+// Tiene indica si el ticket se rechazó por el motivo indicado
+func (e *ElegibilidadTicket) Tiene(codigo string) bool {
+	for _, m := range e.Motivos {
+		if m.Codigo == codigo {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidarVentanaAutofactura normaliza el modo y revisa que los días tengan sentido
+func ValidarVentanaAutofactura(v *VentanaAutofactura) error {
+	switch v.Modo {
+	case "":
+		v.Modo = VentanaMismoMes
+	case VentanaMismoMes, VentanaLibre:
+	case VentanaDias:
+		if v.Dias < 1 {
+			return fmt.Errorf("el plazo en días debe ser de al menos 1 día")
+		}
+	default:
+		return fmt.Errorf("modo de plazo inválido: %s (use mes, dias o libre)", v.Modo)
+	}
+	if v.Dias < 0 || v.Dias > 366 {
+		return fmt.Errorf("los días del plazo deben estar entre 0 y 366")
+	}
+	return nil
+}
+
+// Limite devuelve el primer día en que el ticket comprado en fecha ya no se puede facturar
+func (v VentanaAutofactura) Limite(fecha time.Time) (time.Time, bool) {
+	dia := time.Date(fecha.Year(), fecha.Month(), fecha.Day(), 0, 0, 0, 0, time.Local)
+	switch v.Modo {
+	case VentanaDias:
+		return dia.AddDate(0, 0, v.Dias+1), true
+	case VentanaLibre:
+		return time.Time{}, false
+	default:
+		return time.Date(dia.Year(), dia.Month()+1, 1+v.Dias, 0, 0, 0, 0, time.Local), true
+	}
+}
+
+// ObtenerVentanaAutofactura lee el plazo configurado en los datos fiscales del emisor
+func ObtenerVentanaAutofactura(idUsuario int) (VentanaAutofactura, error) {
+	v := VentanaAutofactura{Modo: VentanaMismoMes}
+	if idUsuario <= 0 {
+		return v, nil
+	}
+	err := db.GetDB().QueryRow(
+		"SELECT autofactura_ventana, autofactura_dias FROM datos_fiscales WHERE id_usuario = ?",
+		idUsuario,
+	).Scan(&v.Modo, &v.Dias)
+	if err != nil && err != sql.ErrNoRows {
+		return v, fmt.Errorf("error al obtener el plazo de autofacturación: %w", err)
+	}
+	if v.Modo == "" {
+		v.Modo = VentanaMismoMes
+	}
+	return v, nil
+}
+
+// GuardarVentanaAutofactura guarda el plazo de autofacturación del emisor
+func GuardarVentanaAutofactura(idUsuario int, v VentanaAutofactura) error {
+	res, err := db.GetDB().Exec(
+		"UPDATE datos_fiscales SET autofactura_ventana = ?, autofactura_dias = ? WHERE id_usuario = ?",
+		v.Modo, v.Dias, idUsuario,
+	)
+	if err != nil {
+		return fmt.Errorf("error al guardar el plazo de autofacturación: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		var existe int
+		if err := db.GetDB().QueryRow("SELECT COUNT(*) FROM datos_fiscales WHERE id_usuario = ?", idUsuario).Scan(&existe); err != nil {
+			return fmt.Errorf("error al guardar el plazo de autofacturación: %w", err)
+		}
+		if existe == 0 {
+			return fmt.Errorf("el usuario %d no tiene datos fiscales registrados", idUsuario)
+		}
+	}
+	return nil
+}
+
+// VerificarElegibilidadTicket revisa si el ticket existe en Optimus, si sigue vigente (sin cancelar
+// ni devolver), si no tiene ya una factura o está en una factura global y si está dentro del plazo
+// de autofacturación del emisor idUsuario. Los motivos se acumulan para mostrarlos todos al cliente.
+func VerificarElegibilidadTicket(optimusDB *sql.DB, claveTicket string, idUsuario int) (*ElegibilidadTicket, error) {
+	e := &ElegibilidadTicket{ClaveTicket: claveTicket, Elegible: true, Motivos: []MotivoTicket{}}
+	if len(claveTicket) < LongitudMinimaClaveTicket {
+		e.rechazar(TicketClaveInvalida, fmt.Sprintf("La clave del ticket debe tener al menos %d caracteres; revísela en su ticket de compra", LongitudMinimaClaveTicket))
+		return e, nil
+	}
+
+	// El estatus de venta sale de la columna configurada del punto de venta; un ticket también
+	// queda devuelto cuando sus partidas se cancelaron con cantidades negativas
+	var fecha sql.NullTime
+	var estatus string
+	var cantidad float64
+	err := optimusDB.QueryRow(
+		`SELECT p.fecha, `+expresionEstatusPedido(optimusDB)+`, COALESCE(SUM(d.cantidad), 0)
+		FROM crm_pedidos p
+		LEFT JOIN crm_pedidos_det d ON p.id_pedido = d.id_pedido
+		WHERE p.clave_pedido = ?
+		GROUP BY p.id_pedido, p.fecha
+		ORDER BY p.id_pedido DESC
+		LIMIT 1`,
+		claveTicket,
+	).Scan(&fecha, &estatus, &cantidad)
+	if err == sql.ErrNoRows {
+		e.rechazar(TicketNoEncontrado, "No encontramos el ticket; verifique la clave impresa en su ticket de compra")
+		return e, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error al consultar el ticket en Optimus: %w", err)
+	}
+	if estatusCancelado(estatus) {
+		e.rechazar(TicketCancelado, "La venta de este ticket fue cancelada y no se puede facturar")
+	}
+	if estatusDevuelto(estatus) || cantidad <= 0 {
+		e.rechazar(TicketDevuelto, "Los productos de este ticket fueron devueltos y no se puede facturar")
+	}
+
+	if err := verificarFacturaTicket(e); err != nil {
+		return nil, err
+	}
+	global, err := TicketEnFacturaGlobal(claveTicket)
+	if err != nil {
+		return nil, err
+	}
+	if global {
+		e.rechazar(TicketFacturaGlobal, "Este ticket ya se incluyó en la factura global a público en general y no se puede facturar por separado")
+	}
+
+	if fecha.Valid {
+		// Optimus guarda la hora local; se toma solo el día de la compra
+		e.FechaTicket = fecha.Time.Format(formatoFechaCliente)
+		ventana, err := ObtenerVentanaAutofactura(idUsuario)
+		if err != nil {
+			return nil, err
+		}
+		if limite, ok := ventana.Limite(fecha.Time); ok {
+			ultimoDia := limite.AddDate(0, 0, -1).Format(formatoFechaCliente)
+			e.FechaLimite = ultimoDia
+			if !time.Now().Before(limite) {
+				e.rechazar(TicketFueraDePlazo, "El plazo para facturar este ticket venció el "+ultimoDia)
+			}
+		}
+	}
+	return e, nil
+}
+
+// minutosApartadoTicket es lo más que dura apartado un ticket; un apartado más viejo quedó de una
+// solicitud que no terminó (la instancia se detuvo) y se descarta
+const minutosApartadoTicket = 10
+
+// ApartarTicket aparta el ticket del emisor rfcEmisor mientras se factura. Devuelve false si otra
+// solicitud, de cualquier usuario del emisor, ya lo tiene apartado.
+func ApartarTicket(rfcEmisor, claveTicket string) (bool, error) {
+	conn := db.GetDB()
+	_, err := conn.Exec(
+		`DELETE FROM tickets_apartados
+		WHERE rfc_emisor = ? AND clave_ticket = ? AND fecha_apartado < NOW() - INTERVAL ? MINUTE`,
+		rfcEmisor, claveTicket, minutosApartadoTicket,
+	)
+	if err != nil {
+		return false, fmt.Errorf("error al descartar el apartado vencido del ticket %s: %w", claveTicket, err)
+	}
+	// La llave primaria (rfc_emisor, clave_ticket) hace que solo una inserción gane
+	res, err := conn.Exec(
+		"INSERT IGNORE INTO tickets_apartados (rfc_emisor, clave_ticket) VALUES (?, ?)",
+		rfcEmisor, claveTicket,
+	)
+	if err != nil {
+		return false, fmt.Errorf("error al apartar el ticket %s: %w", claveTicket, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("error al apartar el ticket %s: %w", claveTicket, err)
+	}
+	return n == 1, nil
+}
+
+// LiberarTicket quita el apartado del ticket del emisor
+func LiberarTicket(rfcEmisor, claveTicket string) error {
+	_, err := db.GetDB().Exec(
+		"DELETE FROM tickets_apartados WHERE rfc_emisor = ? AND clave_ticket = ?",
+		rfcEmisor, claveTicket,
+	)
+	if err != nil {
+		return fmt.Errorf("error al liberar el ticket %s: %w", claveTicket, err)
+	}
+	return nil
+}
+
+// verificarFacturaTicket rechaza el ticket si ya tiene una factura vigente o una en la cola de timbrado
+func verificarFacturaTicket(e *ElegibilidadTicket) error {
+	var folio, fecha string
+	err := db.GetDB().QueryRow(
+		`SELECT COALESCE(folio, ''), COALESCE(DATE_FORMAT(fecha_generacion, '`+formatoFechaTicketBD+`'), '')
+		FROM historial_facturas
+		WHERE clave_ticket = ? AND COALESCE(estado, '') <> ?
+		ORDER BY id DESC
+		LIMIT 1`,
+		e.ClaveTicket, EstadoHistorialCancelada,
+	).Scan(&folio, &fecha)
+	if err == nil {
+		e.rechazar(TicketFacturado, fmt.Sprintf("Este ticket ya se facturó el %s con el folio %s", fecha, folio))
+		return nil
+	}
+	if err != sql.ErrNoRows {
+		return fmt.Errorf("error al consultar facturas del ticket: %w", err)
+	}
+
+	// Un trabajo generado cuenta hasta que se cancela la factura que timbró
+	var enCola int
+	err = db.GetDB().QueryRow(
+		`SELECT COUNT(*) FROM trabajos_factura t
+		WHERE t.clave_ticket = ? AND (t.estatus IN (?, ?) OR (t.estatus = ? AND NOT EXISTS (
+			SELECT 1 FROM historial_facturas h WHERE h.uuid = t.uuid AND h.estado = ?)))`,
+		e.ClaveTicket, EstatusFacPendiente, EstatusFacTimbrando, EstatusFacGenerado, EstadoHistorialCancelada,
+	).Scan(&enCola)
+	if err != nil {
+		return fmt.Errorf("error al consultar la cola de timbrado: %w", err)
+	}
+	if enCola > 0 {
+		e.rechazar(TicketEnProceso, "Este ticket ya tiene una factura en proceso; en unos minutos podrá descargarla")
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVentanaAutofacturaLimite(t *testing.T) {
+	dia := func(anio int, mes time.Month, d int) time.Time {
+		return time.Date(anio, mes, d, 0, 0, 0, 0, time.Local)
+	}
+	compra := time.Date(2025, time.March, 15, 22, 30, 0, 0, time.Local)
+
+	casos := []struct {
+		nombre   string
+		ventana  VentanaAutofactura
+		fecha    time.Time
+		limite   time.Time
+		conPlazo bool
+	}{
+		{"mes sin gracia", VentanaAutofactura{Modo: VentanaMismoMes}, compra, dia(2025, time.April, 1), true},
+		{"mes con gracia", VentanaAutofactura{Modo: VentanaMismoMes, Dias: 5}, compra, dia(2025, time.April, 6), true},
+		{"mes en diciembre", VentanaAutofactura{Modo: VentanaMismoMes, Dias: 3}, time.Date(2025, time.December, 31, 23, 59, 0, 0, time.Local), dia(2026, time.January, 4), true},
+		{"modo vacío es mes", VentanaAutofactura{}, compra, dia(2025, time.April, 1), true},
+		{"días desde la compra", VentanaAutofactura{Modo: VentanaDias, Dias: 3}, compra, dia(2025, time.March, 19), true},
+		{"días cruzando el mes", VentanaAutofactura{Modo: VentanaDias, Dias: 30}, compra, dia(2025, time.April, 15), true},
+		{"libre", VentanaAutofactura{Modo: VentanaLibre, Dias: 10}, compra, time.Time{}, false},
+	}
+	for _, c := range casos {
+		t.Run(c.nombre, func(t *testing.T) {
+			limite, conPlazo := c.ventana.Limite(c.fecha)
+			if conPlazo != c.conPlazo {
+				t.Fatalf("con plazo %v, se esperaba %v", conPlazo, c.conPlazo)
+			}
+			if !limite.Equal(c.limite) {
+				t.Errorf("límite %s, se esperaba %s", limite.Format(time.DateOnly), c.limite.Format(time.DateOnly))
+			}
+		})
+	}
+}
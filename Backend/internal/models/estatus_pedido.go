@@ -0,0 +1,110 @@
+package models
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Optimus es del punto de venta y el backend no le agrega columnas: la columna de crm_pedidos
+// donde el punto de venta guarda el estatus de la venta y los valores que significan cancelada o
+// devuelta se configuran con OPTIMUS_COLUMNA_ESTATUS, OPTIMUS_ESTATUS_CANCELADO y
+// OPTIMUS_ESTATUS_DEVUELTO (listas separadas por comas). Sin configuración solo se reconoce la
+// devolución por partidas con cantidades negativas.
+var estatusPedidos struct {
+	once       sync.Once
+	columna    string
+	cancelados []string
+	devueltos  []string
+}
+
+// identificadorColumna evita que el nombre configurado se use para inyectar SQL
+var identificadorColumna = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// cargarEstatusPedidos lee la configuración una vez y revisa que la columna exista en crm_pedidos
+func cargarEstatusPedidos(optimusDB *sql.DB) {
+	estatusPedidos.once.Do(func() {
+		columna := strings.TrimSpace(os.Getenv("OPTIMUS_COLUMNA_ESTATUS"))
+		if columna == "" {
+			log.Printf("[TICKETS] OPTIMUS_COLUMNA_ESTATUS vacío; no se revisa el estatus de venta de los tickets")
+			return
+		}
+		if !identificadorColumna.MatchString(columna) {
+			log.Printf("[TICKETS] OPTIMUS_COLUMNA_ESTATUS inválido (%q); no se revisa el estatus de venta", columna)
+			return
+		}
+		var existe int
+		err := optimusDB.QueryRow(
+			`SELECT COUNT(*) FROM information_schema.COLUMNS
+			WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'crm_pedidos' AND COLUMN_NAME = ?`,
+			columna,
+		).Scan(&existe)
+		if err != nil || existe == 0 {
+			log.Printf("[TICKETS] crm_pedidos.%s no existe (%v); no se revisa el estatus de venta", columna, err)
+			return
+		}
+		estatusPedidos.columna = columna
+		estatusPedidos.cancelados = listaEstatus(os.Getenv("OPTIMUS_ESTATUS_CANCELADO"))
+		estatusPedidos.devueltos = listaEstatus(os.Getenv("OPTIMUS_ESTATUS_DEVUELTO"))
+	})
+}
+
+// listaEstatus separa los valores configurados
+func listaEstatus(valor string) []string {
+	var lista []string
+	for _, v := range strings.Split(valor, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			lista = append(lista, v)
+		}
+	}
+	return lista
+}
+
+// expresionEstatusPedido es la expresión SQL con el estatus del pedido p, o una cadena vacía sin configuración
+func expresionEstatusPedido(optimusDB *sql.DB) string {
+	cargarEstatusPedidos(optimusDB)
+	if estatusPedidos.columna == "" {
+		return "''"
+	}
+	return "COALESCE(CAST(p." + estatusPedidos.columna + " AS CHAR), '')"
+}
+
+// filtroPedidosVigentes es la condición SQL que excluye los pedidos p cancelados o devueltos
+func filtroPedidosVigentes(optimusDB *sql.DB) (string, []interface{}) {
+	expresion := expresionEstatusPedido(optimusDB)
+	var args []interface{}
+	for _, v := range append(append([]string{}, estatusPedidos.cancelados...), estatusPedidos.devueltos...) {
+		args = append(args, v)
+	}
+	if len(args) == 0 {
+		return "1 = 1", nil
+	}
+	return expresion + " NOT IN (" + strings.TrimSuffix(strings.Repeat("?,", len(args)), ",") + ")", args
+}
+
+// estatusCancelado indica si el estatus del pedido es uno de los configurados como venta cancelada
+func estatusCancelado(estatus string) bool {
+	return contieneEstatus(estatusPedidos.cancelados, estatus)
+}
+
+// estatusDevuelto indica si el estatus del pedido es uno de los configurados como venta devuelta
+func estatusDevuelto(estatus string) bool {
+	return contieneEstatus(estatusPedidos.devueltos, estatus)
+}
+
+// contieneEstatus compara el estatus con cada valor configurado, igual que el NOT IN de MySQL
+func contieneEstatus(lista []string, estatus string) bool {
+	estatus = strings.TrimSpace(estatus)
+	if estatus == "" {
+		return false
+	}
+	for _, v := range lista {
+		if strings.EqualFold(v, estatus) {
+			return true
+		}
+	}
+	return false
+}
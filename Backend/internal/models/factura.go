@@ -1,7 +1,7 @@
 package models
 
 import (
-	"encoding/xml"
+	"database/sql"
 	"fmt"
 	"log"
 	"time"
@@ -29,10 +29,14 @@ type Factura struct {
 	ClienteDireccion   string     `json:"cliente_direccion"`
 	UsoCFDI            string     `json:"uso_cfdi"`
 	ClaveTicket        string     `json:"clave_ticket"`
-	Serie              string     `json:"serie,omitempty"` // Serie para datos fiscales (serie_df)
+	Serie              string     `json:"serie,omitempty"`    // Serie para datos fiscales (serie_df)
+	Sucursal           string     `json:"sucursal,omitempty"` // Sucursal que emite; elige la serie de folios
 	FechaEmision       string     `json:"fecha_emision"`
 	Subtotal           float64    `json:"subtotal"`
 	Impuestos          float64    `json:"impuestos"`
+	RetencionISR       float64    `json:"retencion_isr,omitempty"`
+	RetencionIVA       float64    `json:"retencion_iva,omitempty"`
+	ImpuestosRetenidos float64    `json:"impuestos_retenidos,omitempty"`
 	Total              float64    `json:"total"`
 	Observaciones      string     `json:"observaciones"`
 	Conceptos          []Concepto `json:"conceptos"`
@@ -92,171 +96,30 @@ type Factura struct {
 	CerBase64 string `json:"cer_base64,omitempty"` // Certificado en base64 (opcional, para frontend)
 	Timbre    *TimbreFiscalDigital
 
+	// Tipo de comprobante, CFDI relacionados (notas de crédito) y pagos (REP)
+	TipoComprobante   string   `json:"tipo_comprobante,omitempty"`   // I: ingreso (por defecto), E: egreso, P: pago
+	TipoRelacion      string   `json:"tipo_relacion,omitempty"`      // c_TipoRelacion: 01, 03, 07...
+	UUIDsRelacionados []string `json:"uuids_relacionados,omitempty"` // UUID de los CFDI que se relacionan
+	Pagos             []Pago   `json:"pagos,omitempty"`              // Solo para TipoComprobante P
+
+	// Solo para la factura global a público en general
+	InformacionGlobal *InformacionGlobal `json:"informacion_global,omitempty"`
+
 	// Estado de la generación/timbrado de la factura
 	EstatusFac string `json:"estatus_fac"` // F: fallo, P: pendiente, T: timbrando, G: generado
 	LogError   string `json:"log_error"`   // Mensaje de error si ocurre
-}
-
-// Configuración del PAC y CSD para timbrado
-type PACConfig struct {
-	UsuarioPAC string // RFC del emisor (usuario PAC)
-	ClavePAC   string // Clave del PAC
-	Produccion bool   // Modo producción
-	CerPath    string // Ruta al .cer
-	KeyPath    string // Ruta al .key
-	ClaveCSD   string // Contraseña del CSD
-	Endpoint   string // URL del PAC
-}
-
-// Proceso principal de timbrado CFDI
-func (f *Factura) TimbrarCFDI(pac PACConfig) error {
-	// 1. Generar el XML CFDI (solo estructura, no firmado)
-	xmlCFDI, err := f.GenerarXMLCFDI()
-	if err != nil {
-		f.LogError = "Error generando XML: " + err.Error()
-		return err
-	}
-
-	// 2. Firmar el XML CFDI (usar CSD)
-	signedXML, err := FirmarXMLCFDI(xmlCFDI, pac.CerPath, pac.KeyPath, pac.ClaveCSD)
-	if err != nil {
-		f.LogError = "Error firmando XML: " + err.Error()
-		return err
-	}
-
-	// 3. Enviar el XML firmado al PAC
-	timbradoXML, err := EnviarXMLAlPAC(signedXML, pac)
-	if err != nil {
-		f.LogError = "Error enviando al PAC: " + err.Error()
-		return err
-	}
-
-	// 4. Extraer el timbre fiscal digital del XML timbrado
-	timbre, err := ExtraerTimbreFiscal(timbradoXML)
-	if err != nil {
-		f.LogError = "Error extrayendo timbre fiscal: " + err.Error()
-		return err
-	}
-	f.Timbre = timbre
-	f.EstatusFac = "T" // Timbrado exitoso
-	return nil
-}
-
-// Genera el XML CFDI a partir de la estructura Factura
-func (f *Factura) GenerarXMLCFDI() (string, error) {
-	cfdi := CFDI{
-		XmlnsCfdi:         "http://www.sat.gob.mx/cfd/4",
-		Version:           "4.0",
-		Serie:             f.Serie,
-		Folio:             f.NumeroFolio,
-		Fecha:             f.FechaEmision,
-		SubTotal:          fmt.Sprintf("%.2f", f.Subtotal),
-		Total:             fmt.Sprintf("%.2f", f.Total),
-		Moneda:            f.Moneda,
-		TipoCambio:        fmt.Sprintf("%.2f", f.TipoCambio),
-		LugarExpedicion:   f.LugarExpedicion,
-		TipoDeComprobante: "I",
-		MetodoPago:        f.MetodoPago,
-		FormaPago:         f.FormaPago,
-		CondicionesPago:   f.CondicionesPago,
-		Descuento:         fmt.Sprintf("%.2f", f.Descuento),
-		ClaveTicket:       f.ClaveTicket,
-		Emisor: struct {
-			RFC           string `xml:"Rfc,attr"`
-			Nombre        string `xml:"Nombre,attr"`
-			RegimenFiscal string `xml:"RegimenFiscal,attr"`
-		}{
-			RFC:           f.EmisorRFC,
-			Nombre:        f.EmisorRazonSocial,
-			RegimenFiscal: f.EmisorRegimenFiscal,
-		},
-		Receptor: struct {
-			RFC                   string `xml:"Rfc,attr"`
-			Nombre                string `xml:"Nombre,attr"`
-			UsoCFDI               string `xml:"UsoCFDI,attr"`
-			DomicilioFiscal       string `xml:"DomicilioFiscal,attr,omitempty"`
-			RegimenFiscalReceptor string `xml:"RegimenFiscalReceptor,attr,omitempty"`
-		}{
-			RFC:                   f.ReceptorRFC,
-			Nombre:                f.ReceptorRazonSocial,
-			UsoCFDI:               f.UsoCFDI,
-			DomicilioFiscal:       f.ReceptorCodigoPostal,
-			RegimenFiscalReceptor: f.RegimenFiscalReceptor,
-		},
-	}
-	// Conceptos
-	for _, c := range f.Conceptos {
-		cfdi.Conceptos = append(cfdi.Conceptos, struct {
-			ClaveProdServ    string `xml:"ClaveProdServ,attr"`
-			NoIdentificacion string `xml:"NoIdentificacion,attr,omitempty"`
-			Cantidad         string `xml:"Cantidad,attr"`
-			ClaveUnidad      string `xml:"ClaveUnidad,attr"`
-			Unidad           string `xml:"Unidad,attr,omitempty"`
-			Descripcion      string `xml:"Descripcion,attr"`
-			ValorUnitario    string `xml:"ValorUnitario,attr"`
-			Importe          string `xml:"Importe,attr"`
-			Descuento        string `xml:"Descuento,attr,omitempty"`
-		}{
-			ClaveProdServ:    c.ClaveProdServ,
-			NoIdentificacion: "",
-			Cantidad:         fmt.Sprintf("%.2f", c.Cantidad),
-			ClaveUnidad:      c.ClaveUnidad,
-			Unidad:           "",
-			Descripcion:      c.Descripcion,
-			ValorUnitario:    fmt.Sprintf("%.2f", c.ValorUnitario),
-			Importe:          fmt.Sprintf("%.2f", c.Importe),
-			Descuento:        fmt.Sprintf("%.2f", c.Descuento),
-		})
-	}
-	output, err := xml.MarshalIndent(cfdi, "", "  ")
-	if err != nil {
-		return "", err
-	}
-	return string(output), nil
-}
-
-// Firmar el XML CFDI usando el CSD (.cer, .key, clave)
-func FirmarXMLCFDI(xmlCFDI, cerPath, keyPath, claveCSD string) (string, error) {
-	// Aquí deberías implementar la firma digital del XML usando el CSD
-	// Puedes usar una librería externa o llamar a un ejecutable que firme el XML
-	// Por ahora, se retorna el XML sin firmar (solo para ejemplo)
-	return xmlCFDI, nil
-}
 
-// Enviar el XML firmado al PAC y recibir el XML timbrado
-func EnviarXMLAlPAC(xmlFirmado string, pac PACConfig) (string, error) {
-	// Implementa el envío HTTP POST al endpoint del PAC
-	// El cuerpo debe incluir el XML firmado y los datos de autenticación
-	// Ejemplo genérico:
-	/*
-		resp, err := http.Post(pac.Endpoint, "application/xml", strings.NewReader(xmlFirmado))
-		if err != nil {
-			return "", err
-		}
-		defer resp.Body.Close()
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return "", err
-		}
-		return string(body), nil
-	*/
-	return xmlFirmado, nil // Solo ejemplo, aquí deberías poner la respuesta real del PAC
+	// Estado de la cancelación ante el SAT (vacío si no se ha solicitado); el PDF lo muestra como marca
+	EstadoCancelacion string `json:"estado_cancelacion,omitempty"`
 }
 
-// Extraer el timbre fiscal digital del XML timbrado
-func ExtraerTimbreFiscal(xmlTimbrado string) (*TimbreFiscalDigital, error) {
-	// Aquí deberías parsear el XML timbrado y extraer el nodo TimbreFiscalDigital
-	// Ejemplo genérico:
-	var tfd TimbreFiscalDigital
-	// ...parsear xmlTimbrado y llenar tfd...
-	tfd.UUID = "EJEMPLO-UUID"
-	tfd.FechaTimbrado = time.Now().Format("2006-01-02T15:04:05")
-	tfd.RfcProvCertif = "LSO1306189R5"
-	tfd.SelloCFD = "EJEMPLO-SELLO-CFD"
-	tfd.NoCertificadoSAT = "EJEMPLO-CERT-SAT"
-	tfd.SelloSAT = "EJEMPLO-SELLO-SAT"
-	return &tfd, nil
-}
+// Valores de EstatusFac
+const (
+	EstatusFacFallo     = "F"
+	EstatusFacPendiente = "P"
+	EstatusFacTimbrando = "T"
+	EstatusFacGenerado  = "G"
+)
 
 type TimbreFiscalDigital struct {
 	UUID             string
@@ -273,91 +136,78 @@ type Concepto struct {
 	Importe       float64 `json:"importe"`
 
 	// Campos adicionales para la tabla detallada
-	ClaveProdServ string  `json:"clave_prod_serv,omitempty"` // Clave del producto/servicio
-	ClaveSAT      string  `json:"clave_sat,omitempty"`       // Clave SAT del producto
-	ClaveUnidad   string  `json:"clave_unidad,omitempty"`    // Clave SAT de la unidad
-	TasaIVA       float64 `json:"tasa_iva,omitempty"`        // Tasa de IVA en porcentaje (16.0)
-	TasaIEPS      float64 `json:"tasa_ieps,omitempty"`       // Tasa de IEPS en porcentaje (50.0)
-	Descuento     float64 `json:"descuento,omitempty"`       // Descuento aplicado
+	ClaveProdServ    string  `json:"clave_prod_serv,omitempty"`   // Clave del producto/servicio
+	ClaveSAT         string  `json:"clave_sat,omitempty"`         // Clave SAT del producto
+	ClaveUnidad      string  `json:"clave_unidad,omitempty"`      // Clave SAT de la unidad
+	TasaIVA          float64 `json:"tasa_iva,omitempty"`          // Tasa de IVA en porcentaje (16.0)
+	TasaIEPS         float64 `json:"tasa_ieps,omitempty"`         // Tasa de IEPS en porcentaje (50.0)
+	Descuento        float64 `json:"descuento,omitempty"`         // Descuento aplicado
+	TasaRetISR       float64 `json:"tasa_ret_isr,omitempty"`      // Retención de ISR en porcentaje (10.0)
+	TasaRetIVA       float64 `json:"tasa_ret_iva,omitempty"`      // Retención de IVA en porcentaje (10.666667 = dos terceras partes)
+	TipoIVA          string  `json:"tipo_iva,omitempty"`          // "Tasa" (default) o "Exento"
+	TipoIEPS         string  `json:"tipo_ieps,omitempty"`         // "Tasa" (porcentaje) o "Cuota" (importe por unidad)
+	ObjetoImp        string  `json:"objeto_imp,omitempty"`        // c_ObjetoImp; vacío equivale a "02" (sí objeto de impuesto)
+	NoIdentificacion string  `json:"no_identificacion,omitempty"` // En la factura global, la clave del ticket
+
+	IEPS []IEPSConcepto `json:"ieps,omitempty"` // Todos los IEPS del concepto; si está vacío se usa TasaIEPS/TipoIEPS
 }
 
-// CFDI representa la estructura del Comprobante Fiscal Digital
-type CFDI struct {
-	XMLName           xml.Name `xml:"cfdi:Comprobante"`
-	XmlnsCfdi         string   `xml:"xmlns:cfdi,attr"`
-	Version           string   `xml:"Version,attr"`
-	Serie             string   `xml:"Serie,attr"`
-	Folio             string   `xml:"Folio,attr"`
-	Fecha             string   `xml:"Fecha,attr"`
-	SubTotal          string   `xml:"SubTotal,attr"`
-	Total             string   `xml:"Total,attr"`
-	Moneda            string   `xml:"Moneda,attr"`
-	TipoCambio        string   `xml:"TipoCambio,attr,omitempty"`
-	LugarExpedicion   string   `xml:"LugarExpedicion,attr"`
-	TipoDeComprobante string   `xml:"TipoDeComprobante,attr"`
-	MetodoPago        string   `xml:"MetodoPago,attr"`
-	FormaPago         string   `xml:"FormaPago,attr"`
-	CondicionesPago   string   `xml:"CondicionesDePago,attr,omitempty"`
-	Descuento         string   `xml:"Descuento,attr,omitempty"`
-	ClaveTicket       string   `xml:"ClaveTicket,attr,omitempty"`
-	Emisor            struct {
-		RFC           string `xml:"Rfc,attr"`
-		Nombre        string `xml:"Nombre,attr"`
-		RegimenFiscal string `xml:"RegimenFiscal,attr"`
-	} `xml:"cfdi:Emisor"`
-	Receptor struct {
-		RFC                   string `xml:"Rfc,attr"`
-		Nombre                string `xml:"Nombre,attr"`
-		UsoCFDI               string `xml:"UsoCFDI,attr"`
-		DomicilioFiscal       string `xml:"DomicilioFiscal,attr,omitempty"`
-		RegimenFiscalReceptor string `xml:"RegimenFiscalReceptor,attr,omitempty"`
-	} `xml:"cfdi:Receptor"`
-	Conceptos []struct {
-		ClaveProdServ    string `xml:"ClaveProdServ,attr"`
-		NoIdentificacion string `xml:"NoIdentificacion,attr,omitempty"`
-		Cantidad         string `xml:"Cantidad,attr"`
-		ClaveUnidad      string `xml:"ClaveUnidad,attr"`
-		Unidad           string `xml:"Unidad,attr,omitempty"`
-		Descripcion      string `xml:"Descripcion,attr"`
-		ValorUnitario    string `xml:"ValorUnitario,attr"`
-		Importe          string `xml:"Importe,attr"`
-		Descuento        string `xml:"Descuento,attr,omitempty"`
-	} `xml:"cfdi:Conceptos>cfdi:Concepto"`
-	Impuestos struct {
-		TotalImpuestosTrasladados string `xml:"TotalImpuestosTrasladados,attr,omitempty"`
-		Traslados                 []struct {
-			Impuesto   string `xml:"Impuesto,attr"`
-			TipoFactor string `xml:"TipoFactor,attr"`
-			TasaOCuota string `xml:"TasaOCuota,attr"`
-			Importe    string `xml:"Importe,attr"`
-		} `xml:"cfdi:Traslados>cfdi:Traslado"`
-	} `xml:"cfdi:Impuestos,omitempty"`
+// IEPSConcepto es uno de los IEPS trasladados en un concepto
+type IEPSConcepto struct {
+	Tasa float64 `json:"tasa"` // Porcentaje, o importe por unidad si Tipo es "Cuota"
+	Tipo string  `json:"tipo"` // "Tasa" o "Cuota"
 }
 
-// GenerarFolioAutomatico genera automáticamente el folio para la factura SIN usar base de datos
-func (f *Factura) GenerarFolioAutomatico() error {
-	// Usar serie por defecto "F" si no se especifica
-	serie := "F"
+// TrasladosIEPS devuelve los IEPS del concepto, incluido el campo simple TasaIEPS cuando no hay lista
+func (c Concepto) TrasladosIEPS() []IEPSConcepto {
+	if len(c.IEPS) > 0 {
+		return c.IEPS
+	}
+	if c.TasaIEPS > 0 {
+		return []IEPSConcepto{{Tasa: c.TasaIEPS, Tipo: c.TipoIEPS}}
+	}
+	return nil
+}
+
+// SolicitudFolio indica la serie que corresponde a la factura según su emisor, tipo y sucursal
+func (f *Factura) SolicitudFolio() SolicitudFolio {
+	return SolicitudFolio{RFCEmisor: f.EmisorRFC, TipoComprobante: f.TipoComprobante, Sucursal: f.Sucursal, Serie: f.Serie}
+}
+
+// AplicarFolio pone en la factura la serie y el folio reservados
+func (f *Factura) AplicarFolio(folio *FolioAsignado) {
+	f.Serie = folio.Serie
+	f.NumeroFolio = folio.Folio
+}
 
-	// Usar el nuevo generador simple que NO depende de la base de datos
-	folioGen := GetFolioGenerator()
-	folioGenerado, err := folioGen.GenerarFolioSimple(serie)
+// AsignarFolio reserva dentro de tx el siguiente folio de la serie del emisor. tx es la transacción
+// que después registra el comprobante: si no se confirma, el folio regresa a la serie.
+func (f *Factura) AsignarFolio(tx *sql.Tx) error {
+	folio, err := ReservarFolio(tx, f.SolicitudFolio())
 	if err != nil {
-		return fmt.Errorf("error al generar folio: %v", err)
+		return fmt.Errorf("error al generar folio: %w", err)
 	}
-
-	f.NumeroFolio = folioGenerado
-	log.Printf("Folio generado automáticamente (sin BD): %s", folioGenerado)
+	f.AplicarFolio(folio)
+	log.Printf("[FOLIOS] Folio %s%s reservado para %s", f.Serie, f.NumeroFolio, f.EmisorRFC)
 	return nil
 }
 
-// ValidarFolio verifica que el folio de la factura esté presente (no verifica BD)
+// ValidarFolio verifica que el folio de la factura esté presente y que no se haya registrado
+// antes para el mismo emisor y serie (los folios capturados a mano no pasan por folio_control)
 func (f *Factura) ValidarFolio() error {
 	if f.NumeroFolio == "" {
 		return fmt.Errorf("número de folio requerido")
 	}
 
-	// Ya no validamos en BD porque cada folio generado es único por diseño
+	if f.EmisorRFC != "" {
+		unico, err := ValidarFolioUnico(f.EmisorRFC, f.Serie, f.NumeroFolio)
+		if err != nil {
+			return err
+		}
+		if !unico {
+			return fmt.Errorf("el folio %s de la serie %q ya fue emitido", f.NumeroFolio, f.Serie)
+		}
+	}
 	log.Printf("Folio válido: %s", f.NumeroFolio)
 	return nil
 }
@@ -0,0 +1,275 @@
+package models
+
+import (
+	"Facts/internal/db"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Datos del receptor que exige el SAT en la factura global
+const (
+	RFCPublicoGeneral           = "XAXX010101000"
+	NombrePublicoGeneral        = "PUBLICO EN GENERAL"
+	RegimenPublicoGeneral       = "616" // Sin obligaciones fiscales
+	UsoCFDIPublicoGeneral       = "S01" // Sin efectos fiscales
+	ClaveProdServFacturaGlobal  = "01010101"
+	ClaveUnidadFacturaGlobal    = "ACT"
+	DescripcionFacturaGlobal    = "Venta"
+	PeriodicidadMensual         = "04"
+	PeriodicidadBimestral       = "05"
+	primerBimestreFacturaGlobal = 13
+)
+
+// PeriodicidadesGlobal es el catálogo c_Periodicidad
+var PeriodicidadesGlobal = map[string]string{
+	"01": "Diario",
+	"02": "Semanal",
+	"03": "Quincenal",
+	"04": "Mensual",
+	"05": "Bimestral",
+}
+
+// InformacionGlobal es el nodo cfdi:InformacionGlobal de la factura a público en general
+type InformacionGlobal struct {
+	Periodicidad string `json:"periodicidad"`
+	Meses        string `json:"meses"` // 01-12 o 13-18 para bimestres
+	Anio         string `json:"anio"`
+}
+
+// TicketGlobal agrupa los importes de un ticket de Optimus por tasa de IVA
+type TicketGlobal struct {
+	IDPedido    int     `json:"id_pedido"`
+	ClaveTicket string  `json:"clave_ticket"`
+	Fecha       string  `json:"fecha"`
+	TasaIVA     float64 `json:"tasa_iva"`
+	Importe     float64 `json:"importe"`
+	Descuento   float64 `json:"descuento"`
+}
+
+// FacturaGlobal es el registro de una factura global emitida
+type FacturaGlobal struct {
+	ID           int     `json:"id"`
+	IDUsuario    int     `json:"id_usuario"`
+	IDHistorial  int     `json:"id_historial"`
+	UUID         string  `json:"uuid"`
+	Periodicidad string  `json:"periodicidad"`
+	Meses        string  `json:"meses"`
+	Anio         int     `json:"anio"`
+	FechaInicio  string  `json:"fecha_inicio"`
+	FechaFin     string  `json:"fecha_fin"`
+	Total        float64 `json:"total"`
+}
+
+// ValidarInformacionGlobal revisa periodicidad, meses y año contra los catálogos del SAT
+func ValidarInformacionGlobal(info InformacionGlobal) error {
+	if _, ok := PeriodicidadesGlobal[info.Periodicidad]; !ok {
+		return fmt.Errorf("periodicidad inválida: %s", info.Periodicidad)
+	}
+	mes, err := strconv.Atoi(info.Meses)
+	if err != nil || len(info.Meses) != 2 {
+		return fmt.Errorf("meses inválido: %s", info.Meses)
+	}
+	if info.Periodicidad == PeriodicidadBimestral {
+		if mes < primerBimestreFacturaGlobal || mes > 18 {
+			return fmt.Errorf("para periodicidad bimestral meses debe estar entre 13 y 18")
+		}
+	} else if mes < 1 || mes > 12 {
+		return fmt.Errorf("meses debe estar entre 01 y 12")
+	}
+	if anio, err := strconv.Atoi(info.Anio); err != nil || anio < 2022 {
+		return fmt.Errorf("año inválido: %s", info.Anio)
+	}
+	return nil
+}
+
+// PeriodoInformacionGlobal devuelve el rango [desde, hasta) del mes o bimestre indicado
+func PeriodoInformacionGlobal(info InformacionGlobal) (time.Time, time.Time, error) {
+	if err := ValidarInformacionGlobal(info); err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	mes, _ := strconv.Atoi(info.Meses)
+	anio, _ := strconv.Atoi(info.Anio)
+
+	switch info.Periodicidad {
+	case PeriodicidadMensual:
+		desde := time.Date(anio, time.Month(mes), 1, 0, 0, 0, 0, time.Local)
+		return desde, desde.AddDate(0, 1, 0), nil
+	case PeriodicidadBimestral:
+		desde := time.Date(anio, time.Month((mes-primerBimestreFacturaGlobal)*2+1), 1, 0, 0, 0, 0, time.Local)
+		return desde, desde.AddDate(0, 2, 0), nil
+	}
+	return time.Time{}, time.Time{}, fmt.Errorf("la periodicidad %s requiere fecha_inicio y fecha_fin", info.Periodicidad)
+}
+
+// IDEmpresaOptimus devuelve el idempresa de Optimus registrado para el RFC en adm_empresas_rfc
+func IDEmpresaOptimus(optimusDB *sql.DB, rfc string) (int, error) {
+	var idEmpresa int
+	err := optimusDB.QueryRow("SELECT idempresa FROM adm_empresas_rfc WHERE rfc = ? LIMIT 1", strings.ToUpper(rfc)).Scan(&idEmpresa)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("el RFC %s no tiene empresa registrada en Optimus", rfc)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error al consultar la empresa del RFC %s: %w", rfc, err)
+	}
+	return idEmpresa, nil
+}
+
+// ObtenerTicketsSinFacturar lista los tickets de la empresa del emisor en el periodo que no están cancelados ni
+// devueltos, no tienen factura ni están en una factura global y no se están facturando
+func ObtenerTicketsSinFacturar(optimusDB *sql.DB, rfcEmisor string, desde, hasta time.Time) ([]TicketGlobal, error) {
+	idEmpresa, err := IDEmpresaOptimus(optimusDB, rfcEmisor)
+	if err != nil {
+		return nil, err
+	}
+	vigentes, argsVigentes := filtroPedidosVigentes(optimusDB)
+	args := append([]interface{}{idEmpresa, desde, hasta}, argsVigentes...)
+	// Las partidas devueltas se registran con cantidades negativas; un grupo sin importe neto no se factura
+	rows, err := optimusDB.Query(
+		`SELECT p.id_pedido, p.clave_pedido, DATE_FORMAT(p.fecha, '%Y-%m-%d'),
+			COALESCE(d.iva, 16), SUM(d.cantidad * d.precio), COALESCE(SUM(d.descuento), 0)
+		FROM crm_pedidos p
+		JOIN crm_pedidos_det d ON p.id_pedido = d.id_pedido
+		WHERE p.idempresa = ? AND p.fecha >= ? AND p.fecha < ? AND `+vigentes+`
+		GROUP BY p.id_pedido, p.clave_pedido, p.fecha, d.iva
+		HAVING SUM(d.cantidad) > 0
+		ORDER BY p.fecha, p.id_pedido`,
+		args...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error al consultar tickets del periodo: %w", err)
+	}
+	defer rows.Close()
+
+	var tickets []TicketGlobal
+	claves := map[string]bool{}
+	for rows.Next() {
+		var t TicketGlobal
+		if err := rows.Scan(&t.IDPedido, &t.ClaveTicket, &t.Fecha, &t.TasaIVA, &t.Importe, &t.Descuento); err != nil {
+			return nil, fmt.Errorf("error al leer ticket: %w", err)
+		}
+		tickets = append(tickets, t)
+		claves[t.ClaveTicket] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(tickets) == 0 {
+		return nil, nil
+	}
+
+	libres, err := ticketsLibres(claves)
+	if err != nil {
+		return nil, err
+	}
+	pendientes := tickets[:0]
+	for _, t := range tickets {
+		if libres[t.ClaveTicket] {
+			pendientes = append(pendientes, t)
+		}
+	}
+	return pendientes, nil
+}
+
+// loteTicketsLibres es cuántas claves se revisan por consulta, para no rebasar el límite de
+// parámetros de MySQL en periodos con muchos tickets
+const loteTicketsLibres = 1000
+
+// ticketsLibres indica cuáles de las claves no están en el historial ni en una factura global, ni
+// en la cola de timbrado, ni apartadas por una solicitud en curso
+func ticketsLibres(claves map[string]bool) (map[string]bool, error) {
+	lista := make([]interface{}, 0, len(claves))
+	for clave := range claves {
+		lista = append(lista, clave)
+	}
+	libres := make(map[string]bool, len(lista))
+	for inicio := 0; inicio < len(lista); inicio += loteTicketsLibres {
+		lote := lista[inicio:min(inicio+loteTicketsLibres, len(lista))]
+		candidatas := "SELECT ? AS clave" + strings.Repeat(" UNION ALL SELECT ?", len(lote)-1)
+		args := append(append([]interface{}{}, lote...), EstatusFacPendiente, EstatusFacTimbrando, EstatusFacGenerado, minutosApartadoTicket)
+		rows, err := db.GetDB().Query(
+			`SELECT c.clave FROM (`+candidatas+`) c
+			WHERE NOT EXISTS (SELECT 1 FROM historial_facturas h WHERE h.clave_ticket = c.clave)
+			AND NOT EXISTS (SELECT 1 FROM tickets_factura_global g WHERE g.clave_ticket = c.clave)
+			AND NOT EXISTS (SELECT 1 FROM trabajos_factura t WHERE t.clave_ticket = c.clave AND t.estatus IN (?, ?, ?))
+			AND NOT EXISTS (SELECT 1 FROM tickets_apartados a
+				WHERE a.clave_ticket = c.clave AND a.fecha_apartado >= NOW() - INTERVAL ? MINUTE)`,
+			args...,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("error al consultar tickets facturados: %w", err)
+		}
+		for rows.Next() {
+			var clave string
+			if err := rows.Scan(&clave); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			libres[clave] = true
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return libres, nil
+}
+
+// TicketEnFacturaGlobal indica si el ticket ya se declaró en una factura global
+func TicketEnFacturaGlobal(claveTicket string) (bool, error) {
+	var existe int
+	err := db.GetDB().QueryRow(
+		"SELECT COUNT(*) FROM tickets_factura_global WHERE clave_ticket = ?",
+		claveTicket,
+	).Scan(&existe)
+	if err != nil {
+		return false, fmt.Errorf("error al consultar ticket en factura global: %w", err)
+	}
+	return existe > 0, nil
+}
+
+// ExisteFacturaGlobal indica si el usuario ya emitió la factura global del periodo
+func ExisteFacturaGlobal(idUsuario int, info InformacionGlobal, desde time.Time) (bool, error) {
+	var existe int
+	err := db.GetDB().QueryRow(
+		`SELECT COUNT(*) FROM facturas_globales
+		WHERE id_usuario = ? AND periodicidad = ? AND meses = ? AND anio = ? AND fecha_inicio = ?`,
+		idUsuario, info.Periodicidad, info.Meses, info.Anio, desde.Format("2006-01-02"),
+	).Scan(&existe)
+	if err != nil {
+		return false, fmt.Errorf("error al consultar facturas globales: %w", err)
+	}
+	return existe > 0, nil
+}
+
+// RegistrarFacturaGlobal guarda dentro de tx la factura global y marca sus tickets para que ya no se
+// puedan autofacturar; no confirma la transacción
+func RegistrarFacturaGlobal(tx *sql.Tx, fg FacturaGlobal, tickets []string) (int64, error) {
+	result, err := tx.Exec(
+		`INSERT INTO facturas_globales
+		(id_usuario, id_historial, uuid, periodicidad, meses, anio, fecha_inicio, fecha_fin, total)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		fg.IDUsuario, fg.IDHistorial, fg.UUID, fg.Periodicidad, fg.Meses, fg.Anio, fg.FechaInicio, fg.FechaFin, fg.Total,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("error al registrar factura global: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	stmt, err := tx.Prepare("INSERT INTO tickets_factura_global (clave_ticket, id_factura_global) VALUES (?, ?)")
+	if err != nil {
+		return 0, fmt.Errorf("error al preparar tickets de la factura global: %w", err)
+	}
+	defer stmt.Close()
+	for _, clave := range tickets {
+		if _, err := stmt.Exec(clave, id); err != nil {
+			return 0, fmt.Errorf("error al marcar ticket %s: %w", clave, err)
+		}
+	}
+	return id, nil
+}
@@ -2,16 +2,45 @@ package models
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
+	"strings"
 
 	"Facts/internal/db"
 )
 
-// FolioControl representa el control de folios para facturas
+// Estados de un folio tomado de una serie
+const (
+	FolioReservado = "reservado" // Asignado a un comprobante que todavía no se registra
+	FolioUsado     = "usado"
+	FolioAnulado   = "anulado" // No se emitió y ya no se pudo devolver a la serie
+)
+
+// Valores por defecto de la serie que se crea cuando el emisor no tiene ninguna
+const (
+	seriePorDefecto   = "F"
+	rellenoPorDefecto = 6
+	rellenoMaximo     = 20
+)
+
+// Errores de la administración de series
+var (
+	ErrSerieNoEncontrada = errors.New("serie de folios no encontrada")
+	ErrSerieExistente    = errors.New("la serie ya existe para el emisor")
+)
+
+// FolioControl es una serie de folios de un emisor. Una serie con tipo de comprobante o
+// sucursal vacíos aplica a todos; el folio se forma con el prefijo y el número con relleno de ceros.
 type FolioControl struct {
 	ID                 int    `json:"id"`
+	RFCEmisor          string `json:"rfc_emisor"`
 	Serie              string `json:"serie"`
+	TipoComprobante    string `json:"tipo_comprobante"`
+	Sucursal           string `json:"sucursal"`
+	Prefijo            string `json:"prefijo"`
+	Relleno            int    `json:"relleno"`
+	Descripcion        string `json:"descripcion"`
 	UltimoFolio        int64  `json:"ultimo_folio"`
 	EmpresaID          int    `json:"empresa_id"`
 	FechaCreacion      string `json:"fecha_creacion"`
@@ -19,85 +48,402 @@ type FolioControl struct {
 	Activo             bool   `json:"activo"`
 }
 
-// GenerarFolio genera el siguiente número de folio para una serie y empresa específica
-func GenerarFolio(db *sql.DB, serie string, empresaID int) (string, error) {
-	// Usar la función almacenada para obtener el siguiente folio de manera atómica
-	var nuevoFolio int64
+// FormatearFolio arma el folio del número dado con el prefijo y el relleno de la serie
+func (s FolioControl) FormatearFolio(numero int64) string {
+	return fmt.Sprintf("%s%0*d", s.Prefijo, s.Relleno, numero)
+}
+
+// SolicitudFolio indica para qué comprobante se pide el folio. Serie es una preferencia:
+// se usa solo si es una serie activa que aplica al tipo y a la sucursal.
+type SolicitudFolio struct {
+	RFCEmisor       string
+	TipoComprobante string
+	Sucursal        string
+	Serie           string
+}
+
+// FolioAsignado es el folio reservado para un comprobante
+type FolioAsignado struct {
+	ID     int64
+	Serie  string
+	Numero int64
+	Folio  string
+}
+
+const columnasFolioControl = `id, COALESCE(rfc_emisor, ''), serie, COALESCE(tipo_comprobante, ''), COALESCE(sucursal, ''),
+	COALESCE(prefijo, ''), COALESCE(relleno, 0), COALESCE(descripcion, ''), ultimo_folio, COALESCE(empresa_id, 0),
+	COALESCE(CAST(fecha_creacion AS CHAR), ''), COALESCE(CAST(fecha_actualizacion AS CHAR), ''), activo`
+
+func escanearFolioControl(fila interface{ Scan(...interface{}) error }) (*FolioControl, error) {
+	var s FolioControl
+	err := fila.Scan(&s.ID, &s.RFCEmisor, &s.Serie, &s.TipoComprobante, &s.Sucursal, &s.Prefijo, &s.Relleno,
+		&s.Descripcion, &s.UltimoFolio, &s.EmpresaID, &s.FechaCreacion, &s.FechaActualizacion, &s.Activo)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// ReservarFolio toma el siguiente folio de la serie que corresponde a la solicitud dentro de tx.
+// La fila de la serie queda bloqueada hasta el commit, así dos comprobantes no reciben el mismo
+// número y, si la transacción se revierte, el número no se pierde. tx debe ser la transacción que
+// registra el comprobante.
+func ReservarFolio(tx *sql.Tx, s SolicitudFolio) (*FolioAsignado, error) {
+	s.RFCEmisor = strings.ToUpper(strings.TrimSpace(s.RFCEmisor))
+	if s.RFCEmisor == "" {
+		return nil, fmt.Errorf("se requiere el RFC del emisor para asignar el folio")
+	}
+	if s.TipoComprobante == "" {
+		s.TipoComprobante = "I"
+	}
 
-	query := "SELECT obtener_siguiente_folio(?, ?)"
-	err := db.QueryRow(query, serie, empresaID).Scan(&nuevoFolio)
+	serie, err := elegirSerie(tx, s)
+	if err != nil {
+		return nil, err
+	}
+	numero, err := siguienteNumeroLibre(tx, serie, s.RFCEmisor)
 	if err != nil {
-		log.Printf("Error al generar folio: %v", err)
-		return "", fmt.Errorf("error al generar folio: %v", err)
+		return nil, err
 	}
+	if _, err := tx.Exec("UPDATE folio_control SET ultimo_folio = ? WHERE id = ?", numero, serie.ID); err != nil {
+		return nil, fmt.Errorf("error al avanzar la serie %s: %w", serie.Serie, err)
+	}
+	folio := serie.FormatearFolio(numero)
+	res, err := tx.Exec(
+		`INSERT INTO folios_reservados (id_serie, rfc_emisor, serie, numero, folio, estado)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		serie.ID, s.RFCEmisor, serie.Serie, numero, folio, FolioReservado,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error al reservar el folio %s%s: %w", serie.Serie, folio, err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return &FolioAsignado{ID: id, Serie: serie.Serie, Numero: numero, Folio: folio}, nil
+}
 
-	// Si el folio es 0, significa que no existe la serie para esa empresa
-	if nuevoFolio == 0 {
-		// Crear nuevo registro para la serie y empresa
-		_, err = db.Exec(
-			"INSERT INTO folio_control (serie, ultimo_folio, empresa_id) VALUES (?, 1, ?)",
-			serie, empresaID,
-		)
+// siguienteNumeroLibre devuelve el número que sigue en la serie bloqueada saltando los que ya se
+// enviaron al PAC: la transacción que los reservó se revirtió después de timbrar (el registro
+// falló) y el número ya no se puede volver a usar. Cada número saltado queda en folios_reservados.
+func siguienteNumeroLibre(tx *sql.Tx, serie *FolioControl, rfcEmisor string) (int64, error) {
+	numero := serie.UltimoFolio + 1
+	for {
+		folio := serie.FormatearFolio(numero)
+		var estadoTimbrado string
+		err := tx.QueryRow(
+			"SELECT estado FROM timbrados WHERE rfc_emisor = ? AND serie = ? AND folio = ? AND estado <> ?",
+			rfcEmisor, serie.Serie, folio, db.TimbradoFallido,
+		).Scan(&estadoTimbrado)
+		if err == sql.ErrNoRows {
+			return numero, nil
+		}
 		if err != nil {
-			return "", fmt.Errorf("error al crear serie de folios: %v", err)
+			return 0, fmt.Errorf("error al consultar el timbrado del folio %s%s: %w", serie.Serie, folio, err)
+		}
+
+		estado, motivo := FolioUsado, "timbrado sin registrar el comprobante"
+		if estadoTimbrado != db.TimbradoCompletado {
+			estado, motivo = FolioAnulado, "enviado al PAC sin respuesta"
+		}
+		if _, err := tx.Exec(
+			`INSERT INTO folios_reservados (id_serie, rfc_emisor, serie, numero, folio, estado, motivo)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			serie.ID, rfcEmisor, serie.Serie, numero, folio, estado, motivo,
+		); err != nil {
+			return 0, fmt.Errorf("error al saltar el folio %s%s: %w", serie.Serie, folio, err)
 		}
-		nuevoFolio = 1
+		log.Printf("[FOLIOS] Folio %s%s de %s saltado: %s", serie.Serie, folio, rfcEmisor, motivo)
+		numero++
+	}
+}
+
+// elegirSerie bloquea la serie activa que mejor aplica: la preferida, luego la del mismo tipo
+// de comprobante y sucursal, y al final las generales. Si el emisor no tiene series crea una.
+func elegirSerie(tx *sql.Tx, s SolicitudFolio) (*FolioControl, error) {
+	serie, err := escanearFolioControl(tx.QueryRow(
+		`SELECT `+columnasFolioControl+` FROM folio_control
+		WHERE rfc_emisor = ? AND activo = 1
+			AND COALESCE(tipo_comprobante, '') IN ('', ?) AND COALESCE(sucursal, '') IN ('', ?)
+		ORDER BY serie = ? DESC, COALESCE(tipo_comprobante, '') = ? DESC, COALESCE(sucursal, '') = ? DESC, id
+		LIMIT 1 FOR UPDATE`,
+		s.RFCEmisor, s.TipoComprobante, s.Sucursal, s.Serie, s.TipoComprobante, s.Sucursal,
+	))
+	if err == nil {
+		return serie, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, fmt.Errorf("error al consultar las series de %s: %w", s.RFCEmisor, err)
+	}
+
+	var existentes int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM folio_control WHERE rfc_emisor = ?", s.RFCEmisor).Scan(&existentes); err != nil {
+		return nil, fmt.Errorf("error al consultar las series de %s: %w", s.RFCEmisor, err)
+	}
+	if existentes > 0 {
+		return nil, fmt.Errorf("el emisor %s no tiene una serie activa para comprobantes %s en la sucursal %q", s.RFCEmisor, s.TipoComprobante, s.Sucursal)
 	}
 
-	// Formatear el folio con la serie
-	folioCompleto := fmt.Sprintf("%s%d", serie, nuevoFolio)
+	// Igual que antes, el primer comprobante del emisor abre su serie: la de sus datos fiscales o F
+	nombre := strings.TrimSpace(s.Serie)
+	if nombre == "" || nombre == "undefined" || nombre == "null" {
+		nombre = seriePorDefecto
+	}
+	nueva := FolioControl{RFCEmisor: s.RFCEmisor, Serie: nombre, Prefijo: strings.ToUpper(nombre), Relleno: rellenoPorDefecto}
+	if ValidarSerieFolio(&nueva) != nil {
+		nueva = FolioControl{RFCEmisor: s.RFCEmisor, Serie: seriePorDefecto, Prefijo: seriePorDefecto, Relleno: rellenoPorDefecto}
+	}
+	if err := insertarSerie(tx, &nueva); err != nil {
+		return nil, err
+	}
+	log.Printf("[FOLIOS] Serie %s creada automáticamente para %s", nueva.Serie, s.RFCEmisor)
+	return escanearFolioControl(tx.QueryRow("SELECT "+columnasFolioControl+" FROM folio_control WHERE id = ? FOR UPDATE", nueva.ID))
+}
+
+func insertarSerie(tx *sql.Tx, s *FolioControl) error {
+	res, err := tx.Exec(
+		`INSERT INTO folio_control (rfc_emisor, serie, tipo_comprobante, sucursal, prefijo, relleno, descripcion, ultimo_folio, empresa_id, activo)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, 1)`,
+		s.RFCEmisor, s.Serie, s.TipoComprobante, s.Sucursal, s.Prefijo, s.Relleno, s.Descripcion, s.UltimoFolio, s.EmpresaID,
+	)
+	if err != nil {
+		return fmt.Errorf("error al crear la serie %s: %w", s.Serie, err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	s.ID = int(id)
+	return nil
+}
+
+// UsarFolio marca como usado el folio reservado del comprobante registrado en idHistorial.
+// Va en la misma transacción que guarda el comprobante; un folio sin reserva (capturado a mano) se ignora.
+func UsarFolio(tx *sql.Tx, rfcEmisor, serie, folio string, idHistorial int64) error {
+	_, err := tx.Exec(
+		`UPDATE folios_reservados SET estado = ?, id_historial = NULLIF(?, 0), motivo = NULL
+		WHERE rfc_emisor = ? AND serie = ? AND folio = ? AND estado = ?`,
+		FolioUsado, idHistorial, strings.ToUpper(rfcEmisor), serie, folio, FolioReservado,
+	)
+	if err != nil {
+		return fmt.Errorf("error al marcar el folio %s%s como usado: %w", serie, folio, err)
+	}
+	return nil
+}
 
-	log.Printf("Folio generado: %s para empresa %d", folioCompleto, empresaID)
-	return folioCompleto, nil
+// MarcarFolioUsado marca el folio como usado cuando el comprobante se entrega sin guardarse en el historial
+func MarcarFolioUsado(rfcEmisor, serie, folio string) error {
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return fmt.Errorf("error al iniciar transacción: %w", err)
+	}
+	defer tx.Rollback()
+	if err := UsarFolio(tx, rfcEmisor, serie, folio, 0); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-// GenerarFolioConPadding genera un folio con padding de ceros
-func GenerarFolioConPadding(serie string, empresaID int, padding int) (string, error) {
-	// Conectar a la base de datos Usuario donde está la tabla folio_control
-	userDB, err := db.ConnectUserDB()
+// LiberarFolio regresa a la serie un folio reservado cuyo comprobante no se emitió. Si ya se
+// tomaron folios posteriores no se puede regresar y queda anulado con el motivo. Los folios usados,
+// y los que se enviaron al PAC sin un rechazo definitivo, no se tocan.
+func LiberarFolio(rfcEmisor, serie, folio, motivo string) error {
+	rfcEmisor = strings.ToUpper(rfcEmisor)
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return fmt.Errorf("error al iniciar transacción: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Se bloquea primero la serie, en el mismo orden que ReservarFolio
+	var idSerie int64
+	err = tx.QueryRow(
+		"SELECT id_serie FROM folios_reservados WHERE rfc_emisor = ? AND serie = ? AND folio = ? AND estado = ?",
+		rfcEmisor, serie, folio, FolioReservado,
+	).Scan(&idSerie)
+	if err == sql.ErrNoRows {
+		return nil
+	}
 	if err != nil {
-		return "", fmt.Errorf("error al conectar a la base de datos: %v", err)
+		return fmt.Errorf("error al consultar el folio %s%s: %w", serie, folio, err)
+	}
+	var ultimo int64
+	if err := tx.QueryRow("SELECT ultimo_folio FROM folio_control WHERE id = ? FOR UPDATE", idSerie).Scan(&ultimo); err != nil {
+		return fmt.Errorf("error al bloquear la serie %s: %w", serie, err)
+	}
+	var id, numero int64
+	err = tx.QueryRow(
+		"SELECT id, numero FROM folios_reservados WHERE rfc_emisor = ? AND serie = ? AND folio = ? AND estado = ? FOR UPDATE",
+		rfcEmisor, serie, folio, FolioReservado,
+	).Scan(&id, &numero)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error al consultar el folio %s%s: %w", serie, folio, err)
+	}
+
+	var estadoTimbrado string
+	err = tx.QueryRow(
+		"SELECT estado FROM timbrados WHERE rfc_emisor = ? AND serie = ? AND folio = ?",
+		rfcEmisor, serie, folio,
+	).Scan(&estadoTimbrado)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("error al consultar el timbrado del folio %s%s: %w", serie, folio, err)
+	}
+	if err == nil && estadoTimbrado != db.TimbradoFallido {
+		log.Printf("[FOLIOS] El folio %s%s de %s está %s en el PAC; se conserva reservado", serie, folio, rfcEmisor, estadoTimbrado)
+		return nil
 	}
-	defer userDB.Close()
 
-	// Usar la función almacenada para obtener el siguiente folio
-	var nuevoFolio int64
+	if numero == ultimo {
+		if _, err := tx.Exec("UPDATE folio_control SET ultimo_folio = ultimo_folio - 1 WHERE id = ?", idSerie); err != nil {
+			return fmt.Errorf("error al regresar el folio %s%s: %w", serie, folio, err)
+		}
+		if _, err := tx.Exec("DELETE FROM folios_reservados WHERE id = ?", id); err != nil {
+			return fmt.Errorf("error al regresar el folio %s%s: %w", serie, folio, err)
+		}
+		log.Printf("[FOLIOS] Folio %s%s de %s regresado a la serie: %s", serie, folio, rfcEmisor, motivo)
+	} else {
+		if _, err := tx.Exec(
+			"UPDATE folios_reservados SET estado = ?, motivo = ? WHERE id = ?",
+			FolioAnulado, recortar(motivo, 255), id,
+		); err != nil {
+			return fmt.Errorf("error al anular el folio %s%s: %w", serie, folio, err)
+		}
+		log.Printf("[FOLIOS] Folio %s%s de %s anulado: %s", serie, folio, rfcEmisor, motivo)
+	}
+	return tx.Commit()
+}
+
+// recortar limita el texto a n caracteres para que quepa en la columna
+func recortar(texto string, n int) string {
+	if r := []rune(texto); len(r) > n {
+		return string(r[:n])
+	}
+	return texto
+}
 
-	query := "SELECT obtener_siguiente_folio(?, ?)"
-	err = userDB.QueryRow(query, serie, empresaID).Scan(&nuevoFolio)
+// ListarSeriesFolio devuelve las series del emisor, activas e inactivas
+func ListarSeriesFolio(rfcEmisor string) ([]FolioControl, error) {
+	rows, err := db.GetDB().Query(
+		"SELECT "+columnasFolioControl+" FROM folio_control WHERE rfc_emisor = ? ORDER BY activo DESC, serie",
+		strings.ToUpper(rfcEmisor),
+	)
 	if err != nil {
-		log.Printf("Error al generar folio: %v", err)
-		return "", fmt.Errorf("error al generar folio: %v", err)
+		return nil, fmt.Errorf("error al consultar las series de %s: %w", rfcEmisor, err)
 	}
+	defer rows.Close()
 
-	// Si el folio es 0, crear nuevo registro
-	if nuevoFolio == 0 {
-		_, err = userDB.Exec(
-			"INSERT INTO folio_control (serie, ultimo_folio, empresa_id) VALUES (?, 1, ?)",
-			serie, empresaID,
-		)
+	series := []FolioControl{}
+	for rows.Next() {
+		s, err := escanearFolioControl(rows)
 		if err != nil {
-			return "", fmt.Errorf("error al crear serie de folios: %v", err)
+			return nil, fmt.Errorf("error al leer serie: %w", err)
 		}
-		nuevoFolio = 1
+		series = append(series, *s)
 	}
+	return series, rows.Err()
+}
 
-	// Formatear con padding de ceros
-	formato := fmt.Sprintf("%%s%%0%dd", padding)
-	folioCompleto := fmt.Sprintf(formato, serie, nuevoFolio)
+// ValidarSerieFolio revisa los datos de una serie nueva y normaliza sus textos
+func ValidarSerieFolio(s *FolioControl) error {
+	s.RFCEmisor = strings.ToUpper(strings.TrimSpace(s.RFCEmisor))
+	s.Serie = strings.ToUpper(strings.TrimSpace(s.Serie))
+	s.TipoComprobante = strings.ToUpper(strings.TrimSpace(s.TipoComprobante))
+	s.Sucursal = strings.TrimSpace(s.Sucursal)
+	s.Prefijo = strings.TrimSpace(s.Prefijo)
+	switch {
+	case s.RFCEmisor == "":
+		return fmt.Errorf("se requiere el RFC del emisor")
+	case s.Serie == "" || len(s.Serie) > 25:
+		return fmt.Errorf("la serie es obligatoria y admite hasta 25 caracteres")
+	case len(s.TipoComprobante) > 1 || s.TipoComprobante != "" && !strings.Contains("IEPTN", s.TipoComprobante):
+		return fmt.Errorf("tipo de comprobante inválido: %s (I, E, P, T, N o vacío para todos)", s.TipoComprobante)
+	case len(s.Sucursal) > 50:
+		return fmt.Errorf("la sucursal admite hasta 50 caracteres")
+	case len(s.Prefijo) > 10:
+		return fmt.Errorf("el prefijo admite hasta 10 caracteres")
+	case s.Relleno < 0 || s.Relleno > rellenoMaximo:
+		return fmt.Errorf("el relleno debe estar entre 0 y %d dígitos", rellenoMaximo)
+	case s.UltimoFolio < 0:
+		return fmt.Errorf("el folio inicial no puede ser negativo")
+	}
+	// El folio del CFDI admite hasta 40 caracteres
+	if len(s.FormatearFolio(s.UltimoFolio+1)) > 40 {
+		return fmt.Errorf("el prefijo y el relleno producen folios de más de 40 caracteres")
+	}
+	return nil
+}
 
-	log.Printf("Folio generado con padding: %s para empresa %d", folioCompleto, empresaID)
-	return folioCompleto, nil
+// CrearSerieFolio registra una serie nueva; UltimoFolio permite continuar una numeración previa
+func CrearSerieFolio(s FolioControl) (*FolioControl, error) {
+	if err := ValidarSerieFolio(&s); err != nil {
+		return nil, err
+	}
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return nil, fmt.Errorf("error al iniciar transacción: %w", err)
+	}
+	defer tx.Rollback()
+
+	var existe int
+	if err := tx.QueryRow(
+		"SELECT COUNT(*) FROM folio_control WHERE rfc_emisor = ? AND serie = ? FOR UPDATE",
+		s.RFCEmisor, s.Serie,
+	).Scan(&existe); err != nil {
+		return nil, fmt.Errorf("error al consultar la serie %s: %w", s.Serie, err)
+	}
+	if existe > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrSerieExistente, s.Serie)
+	}
+	if err := insertarSerie(tx, &s); err != nil {
+		return nil, err
+	}
+	creada, err := escanearFolioControl(tx.QueryRow("SELECT "+columnasFolioControl+" FROM folio_control WHERE id = ?", s.ID))
+	if err != nil {
+		return nil, fmt.Errorf("error al consultar la serie %s: %w", s.Serie, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	log.Printf("[FOLIOS] Serie %s creada para %s (tipo %q, sucursal %q)", s.Serie, s.RFCEmisor, s.TipoComprobante, s.Sucursal)
+	return creada, nil
 }
 
-// ObtenerUltimoFolio obtiene el último folio usado para una serie y empresa
-func ObtenerUltimoFolio(db *sql.DB, serie string, empresaID int) (int64, error) {
+// DesactivarSerieFolio deja de asignar folios de la serie {id}; los ya emitidos no cambian
+func DesactivarSerieFolio(rfcEmisor string, id int64) error {
+	res, err := db.GetDB().Exec(
+		"UPDATE folio_control SET activo = 0 WHERE id = ? AND rfc_emisor = ?",
+		id, strings.ToUpper(rfcEmisor),
+	)
+	if err != nil {
+		return fmt.Errorf("error al desactivar la serie: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		var existe int
+		if err := db.GetDB().QueryRow(
+			"SELECT COUNT(*) FROM folio_control WHERE id = ? AND rfc_emisor = ?", id, strings.ToUpper(rfcEmisor),
+		).Scan(&existe); err != nil {
+			return fmt.Errorf("error al consultar la serie: %w", err)
+		}
+		if existe == 0 {
+			return ErrSerieNoEncontrada
+		}
+	}
+	log.Printf("[FOLIOS] Serie %d de %s desactivada", id, rfcEmisor)
+	return nil
+}
+
+// ObtenerUltimoFolio obtiene el último número asignado de una serie del emisor
+func ObtenerUltimoFolio(db *sql.DB, rfcEmisor, serie string) (int64, error) {
 	var ultimoFolio int64
 
 	query := `SELECT ultimo_folio FROM folio_control 
-			  WHERE serie = ? AND empresa_id = ? AND activo = TRUE`
+			  WHERE rfc_emisor = ? AND serie = ?`
 
-	err := db.QueryRow(query, serie, empresaID).Scan(&ultimoFolio)
+	err := db.QueryRow(query, strings.ToUpper(rfcEmisor), serie).Scan(&ultimoFolio)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return 0, nil // No existe la serie, empezará desde 1
@@ -108,38 +454,17 @@ func ObtenerUltimoFolio(db *sql.DB, serie string, empresaID int) (int64, error)
 	return ultimoFolio, nil
 }
 
-// ValidarFolioUnico verifica que un folio no esté duplicado
-func ValidarFolioUnico(folio string, empresaID int) (bool, error) {
-	userDB, err := db.ConnectUserDB()
-	if err != nil {
-		return false, fmt.Errorf("error al conectar a la base de datos: %v", err)
-	}
-	defer userDB.Close()
-
+// ValidarFolioUnico verifica que el folio de la serie no esté ya registrado en el historial del emisor
+func ValidarFolioUnico(rfcEmisor, serie, folio string) (bool, error) {
 	var count int
 
 	query := `SELECT COUNT(*) FROM historial_facturas 
-			  WHERE numero_folio = ? AND id_empresa = ?`
+			  WHERE rfc_emisor = ? AND COALESCE(serie, '') = ? AND folio = ?`
 
-	err = userDB.QueryRow(query, folio, empresaID).Scan(&count)
+	err := db.GetDB().QueryRow(query, strings.ToUpper(rfcEmisor), serie, folio).Scan(&count)
 	if err != nil {
 		return false, fmt.Errorf("error al validar folio único: %v", err)
 	}
 
 	return count == 0, nil
 }
-
-// CrearSerieEmpresa crea una nueva serie de folios para una empresa
-func CrearSerieEmpresa(db *sql.DB, serie string, empresaID int) error {
-	query := `INSERT INTO folio_control (serie, ultimo_folio, empresa_id) 
-			  VALUES (?, 0, ?) 
-			  ON DUPLICATE KEY UPDATE activo = TRUE`
-
-	_, err := db.Exec(query, serie, empresaID)
-	if err != nil {
-		return fmt.Errorf("error al crear serie de empresa: %v", err)
-	}
-
-	log.Printf("Serie %s creada para empresa %d", serie, empresaID)
-	return nil
-}
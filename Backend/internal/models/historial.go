@@ -19,18 +19,86 @@ type HistorialFactura struct {
 	FechaGeneracion     string  `json:"fecha_generacion"`
 	Estado              string  `json:"estado"`
 	Observaciones       string  `json:"observaciones"`
+	SaldoPendiente      float64 `json:"saldo_pendiente"` // Total menos notas de crédito y pagos relacionados
+
+	// XML timbrado archivado: UUID, huella SHA-256 y clave en el archivo (vacíos si no se ha archivado)
+	UUID      string `json:"uuid,omitempty"`
+	XMLSHA256 string `json:"xml_sha256,omitempty"`
+	XMLClave  string `json:"xml_clave,omitempty"`
+	// NoCertificado es el CSD con el que se selló (se consulta en certificados_csd)
+	NoCertificado string `json:"no_certificado,omitempty"`
 }
 
 // InsertarHistorialFactura inserta una nueva entrada en el historial de facturas
 func InsertarHistorialFactura(idUsuario int, rfcReceptor string, razonSocialReceptor string,
 	claveTicket string, numeroFolio string, total float64, usoCFDI string, observaciones string) (int64, error) {
-	dbConn := db.GetDB()
+	return insertarHistorialFactura(db.GetDB(), idUsuario, rfcReceptor, razonSocialReceptor, claveTicket,
+		"", "", numeroFolio, total, usoCFDI, observaciones)
+}
 
-	result, err := dbConn.Exec(
+// RegistrarFacturaEmitida guarda la factura en el historial y marca su folio como usado dentro de tx,
+// la transacción que reservó el folio. El llamador confirma tx; si algo falla no queda ni el
+// registro ni el folio usado.
+func RegistrarFacturaEmitida(tx *sql.Tx, f Factura) (int64, error) {
+	id, err := insertarHistorialFactura(tx, f.IdUsuario, f.ReceptorRFC, f.ReceptorRazonSocial, f.ClaveTicket,
+		f.EmisorRFC, f.Serie, f.NumeroFolio, f.Total, f.UsoCFDI, f.Observaciones)
+	if err != nil {
+		return 0, err
+	}
+	if err := UsarFolio(tx, f.EmisorRFC, f.Serie, f.NumeroFolio, id); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// XMLArchivado identifica el XML timbrado guardado en el archivo de CFDI
+type XMLArchivado struct {
+	UUID          string
+	SHA256        string
+	Clave         string
+	NoCertificado string
+}
+
+// RegistrarComprobanteTimbrado guarda dentro de tx un comprobante ya timbrado y archivado: el XML en
+// facturas, el historial ligado a su archivo, el folio usado y las relaciones con las facturas que
+// afecta (IDHistorialRelacionado se llena con el nuevo registro). El llamador confirma tx; si algo
+// falla no queda nada registrado.
+func RegistrarComprobanteTimbrado(tx *sql.Tx, f Factura, xmlTimbrado string, archivo XMLArchivado, relaciones []CFDIRelacionado) (int64, error) {
+	if err := db.GuardarFacturaTimbrada(tx, map[string]interface{}{
+		"uuid":  archivo.UUID,
+		"xml":   xmlTimbrado,
+		"folio": f.NumeroFolio,
+	}); err != nil {
+		return 0, fmt.Errorf("error al guardar el CFDI timbrado %s: %w", archivo.UUID, err)
+	}
+	id, err := RegistrarFacturaEmitida(tx, f)
+	if err != nil {
+		return 0, fmt.Errorf("error al guardar en historial: %w", err)
+	}
+	if _, err := tx.Exec(
+		`UPDATE historial_facturas SET uuid = ?, xml_sha256 = ?, xml_clave = ?, no_certificado = NULLIF(?, '')
+		WHERE id = ?`,
+		archivo.UUID, archivo.SHA256, archivo.Clave, archivo.NoCertificado, id,
+	); err != nil {
+		return 0, fmt.Errorf("error al registrar XML archivado: %w", err)
+	}
+	for _, rel := range relaciones {
+		if err := registrarRelacionCFDI(tx, rel, id); err != nil {
+			return 0, err
+		}
+	}
+	return id, nil
+}
+
+func insertarHistorialFactura(ejecutor interface {
+	Exec(string, ...interface{}) (sql.Result, error)
+}, idUsuario int, rfcReceptor, razonSocialReceptor, claveTicket, rfcEmisor, serie, numeroFolio string,
+	total float64, usoCFDI, observaciones string) (int64, error) {
+	result, err := ejecutor.Exec(
 		`INSERT INTO historial_facturas 
-		(id_usuario, rfc_receptor, razon_social_receptor, clave_ticket, folio, total, uso_cfdi, observaciones) 
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
-		idUsuario, rfcReceptor, razonSocialReceptor, claveTicket, numeroFolio, total, usoCFDI, observaciones,
+		(id_usuario, rfc_receptor, razon_social_receptor, clave_ticket, rfc_emisor, serie, folio, total, uso_cfdi, observaciones) 
+		VALUES (?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, ''), ?, ?, ?, ?)`,
+		idUsuario, rfcReceptor, razonSocialReceptor, claveTicket, rfcEmisor, serie, numeroFolio, total, usoCFDI, observaciones,
 	)
 
 	if err != nil {
@@ -45,6 +113,36 @@ func InsertarHistorialFactura(idUsuario int, rfcReceptor string, razonSocialRece
 	return id, nil
 }
 
+// RegistrarXMLArchivado anota en el historial el XML timbrado archivado y el certificado que lo selló.
+// El registro es de una sola vez: si la factura ya tiene un XML archivado solo se acepta el mismo.
+func RegistrarXMLArchivado(idHistorial int64, uuid, huella, clave, noCertificado string) error {
+	dbConn := db.GetDB()
+	result, err := dbConn.Exec(
+		`UPDATE historial_facturas SET uuid = ?, xml_sha256 = ?, xml_clave = ?, no_certificado = NULLIF(?, '')
+		WHERE id = ? AND xml_sha256 IS NULL`,
+		uuid, huella, clave, noCertificado, idHistorial,
+	)
+	if err != nil {
+		return fmt.Errorf("error al registrar XML archivado: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		return nil
+	}
+
+	var registrada sql.NullString
+	err = dbConn.QueryRow("SELECT xml_sha256 FROM historial_facturas WHERE id = ?", idHistorial).Scan(&registrada)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("no se encontró la factura con ID %d", idHistorial)
+	}
+	if err != nil {
+		return fmt.Errorf("error al registrar XML archivado: %w", err)
+	}
+	if registrada.String != huella {
+		return fmt.Errorf("la factura %d ya tiene archivado otro XML (SHA-256 %s)", idHistorial, registrada.String)
+	}
+	return nil
+}
+
 // ObtenerHistorialFacturasPorUsuario obtiene todas las facturas generadas por un usuario
 func ObtenerHistorialFacturasPorUsuario(idUsuario int) ([]HistorialFactura, error) {
 	dbConn := db.GetDB()
@@ -91,6 +189,7 @@ func ObtenerHistorialFacturasPorUsuario(idUsuario int) ([]HistorialFactura, erro
 		facturas = append(facturas, factura)
 	}
 
+	completarSaldos(facturas)
 	return facturas, nil
 }
 
@@ -104,7 +203,8 @@ func ObtenerFacturaPorID(id int) (*HistorialFactura, error) {
 		`SELECT id, id_usuario, rfc_receptor, razon_social_receptor, 
 		clave_ticket, folio AS numero_folio, total, uso_cfdi, 
 		DATE_FORMAT(fecha_generacion, '%Y-%m-%d %H:%i:%s') as fecha_generacion, 
-		estado, observaciones 
+		estado, observaciones,
+		COALESCE(uuid, ''), COALESCE(xml_sha256, ''), COALESCE(xml_clave, ''), COALESCE(no_certificado, '')
 		FROM historial_facturas 
 		WHERE id = ?`,
 		id,
@@ -120,6 +220,10 @@ func ObtenerFacturaPorID(id int) (*HistorialFactura, error) {
 		&factura.FechaGeneracion,
 		&factura.Estado,
 		&factura.Observaciones,
+		&factura.UUID,
+		&factura.XMLSHA256,
+		&factura.XMLClave,
+		&factura.NoCertificado,
 	)
 
 	if err != nil {
@@ -129,6 +233,10 @@ func ObtenerFacturaPorID(id int) (*HistorialFactura, error) {
 		return nil, err
 	}
 
+	saldo := []HistorialFactura{factura}
+	completarSaldos(saldo)
+	factura.SaldoPendiente = saldo[0].SaldoPendiente
+
 	return &factura, nil
 }
 
@@ -202,6 +310,7 @@ func BuscarHistorialFacturas(idUsuario int, folio, rfcReceptor, razonSocial stri
 		facturas = append(facturas, factura)
 	}
 
+	completarSaldos(facturas)
 	fmt.Printf("Búsqueda completada: %d facturas encontradas\n", len(facturas))
 	return facturas, nil
 }
@@ -264,6 +373,7 @@ func ObtenerHistorialFacturasPorUsuarioConPaginacion(idUsuario, pagina, limite i
 		facturas = append(facturas, factura)
 	}
 
+	completarSaldos(facturas)
 	return facturas, totalFacturas, nil
 }
 
@@ -348,5 +458,6 @@ func BuscarHistorialFacturasConPaginacion(idUsuario int, folio, rfcReceptor, raz
 		facturas = append(facturas, factura)
 	}
 
+	completarSaldos(facturas)
 	return facturas, totalFacturas, nil
 }
@@ -4,6 +4,9 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"strings"
+
+	"Facts/internal/db"
 )
 
 // Impuesto representa un impuesto en la base de datos
@@ -19,6 +22,12 @@ type Impuesto struct {
 	TipoIEPS3   string  `json:"tipo_ieps3"`
 	IVA         float64 `json:"iva"`
 	TipoIVA     string  `json:"tipo_iva"`
+	// Retenciones (porcentaje) que aplican cuando el receptor es persona moral; junto con
+	// ObjetoImp se guardan en impuestos_config de la base del servicio, no en optimus
+	RetISR float64 `json:"ret_isr"`
+	RetIVA float64 `json:"ret_iva"`
+	// Clave c_ObjetoImp de los productos con este impuesto (01, 02, 03 o 04)
+	ObjetoImp string `json:"objeto_imp"`
 }
 
 // Producto representa un producto con información de impuestos
@@ -41,6 +50,142 @@ type ProductoConImpuesto struct {
 	TipoIEPS3      string  `json:"tipo_ieps3"`
 	IVA            float64 `json:"iva"`
 	TipoIVA        string  `json:"tipo_iva"`
+	RetISR         float64 `json:"ret_isr"`
+	RetIVA         float64 `json:"ret_iva"`
+	ObjetoImp      string  `json:"objeto_imp"`
+}
+
+// ObjetosImpuesto son las claves c_ObjetoImp que se pueden configurar en un impuesto
+var ObjetosImpuesto = map[string]string{
+	"01": "No objeto de impuesto",
+	"02": "Sí objeto de impuesto",
+	"03": "Sí objeto del impuesto y no obligado al desglose",
+	"04": "Sí objeto del impuesto y no causa impuesto",
+}
+
+// AplicarImpuestos asigna al concepto el IVA, los IEPS configurados y el objeto de impuesto
+func (i Impuesto) AplicarImpuestos(c *Concepto) {
+	c.ObjetoImp = i.ObjetoImp
+	c.TasaIVA = i.IVA
+	c.TipoIVA = i.TipoIVA
+	c.IEPS = nil
+	for _, ieps := range []IEPSConcepto{
+		{Tasa: i.IEPS1, Tipo: i.TipoIEPS1},
+		{Tasa: i.IEPS2, Tipo: i.TipoIEPS2},
+		{Tasa: i.IEPS3, Tipo: i.TipoIEPS3},
+	} {
+		if ieps.Tasa > 0 {
+			c.IEPS = append(c.IEPS, ieps)
+		}
+	}
+	// TasaIEPS y TipoIEPS conservan el primero para quien solo lee un IEPS
+	c.TasaIEPS, c.TipoIEPS = 0, ""
+	if len(c.IEPS) > 0 {
+		c.TasaIEPS, c.TipoIEPS = c.IEPS[0].Tasa, c.IEPS[0].Tipo
+	}
+}
+
+// AplicarRetenciones asigna al concepto las tasas de retención del impuesto; solo las personas morales (RFC de 12 caracteres) retienen
+func (i Impuesto) AplicarRetenciones(c *Concepto, rfcReceptor string) {
+	if len(strings.TrimSpace(rfcReceptor)) != 12 {
+		c.TasaRetISR = 0
+		c.TasaRetIVA = 0
+		return
+	}
+	c.TasaRetISR = i.RetISR
+	c.TasaRetIVA = i.RetIVA
+}
+
+// Impuesto devuelve la configuración de impuestos del producto
+func (p ProductoConImpuesto) Impuesto() Impuesto {
+	return Impuesto{
+		IDIVA:       p.IDIVA,
+		IDEmpresa:   p.IDEmpresa,
+		Descripcion: p.DescripcionImp,
+		IEPS1:       p.IEPS1,
+		TipoIEPS1:   p.TipoIEPS1,
+		IEPS2:       p.IEPS2,
+		TipoIEPS2:   p.TipoIEPS2,
+		IEPS3:       p.IEPS3,
+		TipoIEPS3:   p.TipoIEPS3,
+		IVA:         p.IVA,
+		TipoIVA:     p.TipoIVA,
+		RetISR:      p.RetISR,
+		RetIVA:      p.RetIVA,
+		ObjetoImp:   p.ObjetoImp,
+	}
+}
+
+// AplicarAConcepto asigna al concepto los impuestos y retenciones configurados para el producto
+func (p ProductoConImpuesto) AplicarAConcepto(c *Concepto, rfcReceptor string) {
+	imp := p.Impuesto()
+	imp.AplicarImpuestos(c)
+	imp.AplicarRetenciones(c, rfcReceptor)
+}
+
+// configImpuesto son las retenciones y el objeto de impuesto de un idiva; viven en la base del
+// servicio porque crm_impuestos pertenece a optimus
+type configImpuesto struct {
+	RetISR    float64
+	RetIVA    float64
+	ObjetoImp string
+}
+
+// objetoImpPorDefecto es el c_ObjetoImp de un impuesto sin configuración propia
+const objetoImpPorDefecto = "02"
+
+// configImpuestosEmpresa lee la configuración de todos los impuestos de la empresa
+func configImpuestosEmpresa(idEmpresa int) (map[int]configImpuesto, error) {
+	rows, err := db.GetDB().Query(
+		"SELECT idiva, ret_isr, ret_iva, objeto_imp FROM impuestos_config WHERE idempresa = ?", idEmpresa)
+	if err != nil {
+		return nil, fmt.Errorf("error al obtener configuración de impuestos: %w", err)
+	}
+	defer rows.Close()
+
+	config := make(map[int]configImpuesto)
+	for rows.Next() {
+		var idIVA int
+		var c configImpuesto
+		if err := rows.Scan(&idIVA, &c.RetISR, &c.RetIVA, &c.ObjetoImp); err != nil {
+			return nil, fmt.Errorf("error al leer configuración de impuestos: %w", err)
+		}
+		config[idIVA] = c
+	}
+	return config, rows.Err()
+}
+
+// aplicarConfig asigna al impuesto su configuración o los valores por defecto si no tiene
+func (i *Impuesto) aplicarConfig(config map[int]configImpuesto) {
+	c, ok := config[i.IDIVA]
+	if !ok {
+		c = configImpuesto{ObjetoImp: objetoImpPorDefecto}
+	}
+	i.RetISR, i.RetIVA, i.ObjetoImp = c.RetISR, c.RetIVA, c.ObjetoImp
+}
+
+// aplicarConfig asigna al producto la configuración de su impuesto
+func (p *ProductoConImpuesto) aplicarConfig(config map[int]configImpuesto) {
+	imp := p.Impuesto()
+	imp.aplicarConfig(config)
+	p.RetISR, p.RetIVA, p.ObjetoImp = imp.RetISR, imp.RetIVA, imp.ObjetoImp
+}
+
+// guardarConfigImpuesto crea o reemplaza la configuración del impuesto
+func guardarConfigImpuesto(i *Impuesto) error {
+	objetoImp := i.ObjetoImp
+	if objetoImp == "" {
+		objetoImp = objetoImpPorDefecto
+	}
+	_, err := db.GetDB().Exec(
+		`INSERT INTO impuestos_config (idempresa, idiva, ret_isr, ret_iva, objeto_imp) VALUES (?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE ret_isr = VALUES(ret_isr), ret_iva = VALUES(ret_iva), objeto_imp = VALUES(objeto_imp)`,
+		i.IDEmpresa, i.IDIVA, i.RetISR, i.RetIVA, objetoImp,
+	)
+	if err != nil {
+		return fmt.Errorf("error al guardar configuración del impuesto %d: %w", i.IDIVA, err)
+	}
+	return nil
 }
 
 // GetImpuestosByEmpresa obtiene todos los impuestos de una empresa
@@ -52,6 +197,11 @@ func GetImpuestosByEmpresa(db *sql.DB, idEmpresa int) ([]Impuesto, error) {
 		ORDER BY descripcion
 	`
 
+	config, err := configImpuestosEmpresa(idEmpresa)
+	if err != nil {
+		return nil, err
+	}
+
 	rows, err := db.Query(query, idEmpresa)
 	if err != nil {
 		log.Printf("Error al obtener impuestos: %v", err)
@@ -79,13 +229,15 @@ func GetImpuestosByEmpresa(db *sql.DB, idEmpresa int) ([]Impuesto, error) {
 			log.Printf("Error al escanear impuesto: %v", err)
 			continue
 		}
+		impuesto.aplicarConfig(config)
 		impuestos = append(impuestos, impuesto)
 	}
 
 	return impuestos, nil
 }
 
-// GetProductosConImpuestos obtiene productos con información de impuestos
+// GetProductosConImpuestos obtiene productos con información de impuestos; un producto sin
+// impuesto configurado queda con IVA 16% y sin IEPS
 func GetProductosConImpuestos(db *sql.DB, idEmpresa int) ([]ProductoConImpuesto, error) {
 	query := `
 		SELECT 
@@ -96,10 +248,10 @@ func GetProductosConImpuestos(db *sql.DB, idEmpresa int) ([]ProductoConImpuesto,
 			p.clave,
 			COALESCE(p.sat_clave, '') as sat_clave,
 			COALESCE(p.sat_medida, '') as sat_medida,
-			COALESCE(i.idiva, 1) as idiva,  -- Usar 1 como valor por defecto para indicar configuración válida
+			COALESCE(i.idiva, 0) as idiva,
 			COALESCE(i.descripcion, 'Configuración automática') as descripcion_impuesto,
-			COALESCE(i.ieps1, 50.0) as ieps1,  -- Valor por defecto de IEPS
-			COALESCE(i.tipo_ieps1, 'Tasa') as tipo_ieps1,
+			COALESCE(i.ieps1, 0) as ieps1,
+			COALESCE(i.tipo_ieps1, '') as tipo_ieps1,
 			COALESCE(i.ieps2, 0) as ieps2,
 			COALESCE(i.tipo_ieps2, '') as tipo_ieps2,
 			COALESCE(i.ieps3, 0) as ieps3,
@@ -107,11 +259,16 @@ func GetProductosConImpuestos(db *sql.DB, idEmpresa int) ([]ProductoConImpuesto,
 			COALESCE(i.iva, 16.0) as iva,  -- Valor por defecto de IVA
 			COALESCE(i.tipo_iva, 'Tasa') as tipo_iva
 		FROM crm_productos p
-		LEFT JOIN crm_impuestos i ON p.idempresa = i.idempresa
+		LEFT JOIN crm_impuestos i ON p.idiva = i.idiva AND p.idempresa = i.idempresa
 		WHERE p.idempresa = ?
 		ORDER BY p.descripcion
 	`
 
+	config, err := configImpuestosEmpresa(idEmpresa)
+	if err != nil {
+		return nil, err
+	}
+
 	rows, err := db.Query(query, idEmpresa)
 	if err != nil {
 		log.Printf("Error al obtener productos con impuestos: %v", err)
@@ -145,12 +302,53 @@ func GetProductosConImpuestos(db *sql.DB, idEmpresa int) ([]ProductoConImpuesto,
 			log.Printf("Error al escanear producto: %v", err)
 			continue
 		}
+		producto.aplicarConfig(config)
 		productos = append(productos, producto)
 	}
 
 	return productos, nil
 }
 
+// ImpuestosProductosTicket obtiene el impuesto configurado de cada producto del ticket, por clave
+// de producto; los productos sin impuesto en crm_impuestos no se incluyen
+func ImpuestosProductosTicket(claveTicket string) (map[string]ProductoConImpuesto, error) {
+	rows, err := db.GetDB().Query(
+		`SELECT DISTINCT pr.idproducto, pr.idempresa, pr.clave, imp.idiva, imp.descripcion,
+			COALESCE(imp.ieps1, 0), COALESCE(imp.tipo_ieps1, ''), COALESCE(imp.ieps2, 0), COALESCE(imp.tipo_ieps2, ''),
+			COALESCE(imp.ieps3, 0), COALESCE(imp.tipo_ieps3, ''), COALESCE(imp.iva, 0), COALESCE(imp.tipo_iva, 'Tasa')
+		FROM optimus.crm_pedidos p
+		JOIN optimus.crm_pedidos_det d ON p.id_pedido = d.id_pedido
+		JOIN optimus.crm_productos pr ON d.idproducto = pr.idproducto
+		JOIN optimus.crm_impuestos imp ON pr.idiva = imp.idiva AND pr.idempresa = imp.idempresa
+		WHERE p.clave_pedido = ?`,
+		claveTicket,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error al obtener impuestos de los productos del ticket: %w", err)
+	}
+	defer rows.Close()
+
+	productos := make(map[string]ProductoConImpuesto)
+	configs := make(map[int]map[int]configImpuesto)
+	for rows.Next() {
+		var p ProductoConImpuesto
+		if err := rows.Scan(&p.IDProducto, &p.IDEmpresa, &p.Clave, &p.IDIVA, &p.DescripcionImp,
+			&p.IEPS1, &p.TipoIEPS1, &p.IEPS2, &p.TipoIEPS2, &p.IEPS3, &p.TipoIEPS3, &p.IVA, &p.TipoIVA); err != nil {
+			return nil, fmt.Errorf("error al leer impuesto del producto: %w", err)
+		}
+		config, ok := configs[p.IDEmpresa]
+		if !ok {
+			if config, err = configImpuestosEmpresa(p.IDEmpresa); err != nil {
+				return nil, err
+			}
+			configs[p.IDEmpresa] = config
+		}
+		p.aplicarConfig(config)
+		productos[p.Clave] = p
+	}
+	return productos, rows.Err()
+}
+
 // GetImpuestoByID obtiene un impuesto específico por su ID
 func GetImpuestoByID(db *sql.DB, idIVA int) (*Impuesto, error) {
 	query := `
@@ -182,6 +380,12 @@ func GetImpuestoByID(db *sql.DB, idIVA int) (*Impuesto, error) {
 		return nil, fmt.Errorf("error al obtener impuesto: %w", err)
 	}
 
+	config, err := configImpuestosEmpresa(impuesto.IDEmpresa)
+	if err != nil {
+		return nil, err
+	}
+	impuesto.aplicarConfig(config)
+
 	return &impuesto, nil
 }
 
@@ -214,7 +418,7 @@ func CreateImpuesto(db *sql.DB, impuesto *Impuesto) error {
 	}
 
 	impuesto.IDIVA = int(id)
-	return nil
+	return guardarConfigImpuesto(impuesto)
 }
 
 // UpdateImpuesto actualiza un impuesto existente
@@ -248,10 +452,18 @@ func UpdateImpuesto(db *sql.DB, impuesto *Impuesto) error {
 	}
 
 	if rowsAffected == 0 {
-		return fmt.Errorf("impuesto no encontrado o no autorizado")
+		// MySQL reporta 0 filas si los valores no cambiaron; solo es error si el impuesto no existe
+		var existe int
+		if err := db.QueryRow("SELECT COUNT(*) FROM crm_impuestos WHERE idiva = ? AND idempresa = ?",
+			impuesto.IDIVA, impuesto.IDEmpresa).Scan(&existe); err != nil {
+			return fmt.Errorf("error al verificar actualización: %w", err)
+		}
+		if existe == 0 {
+			return fmt.Errorf("impuesto no encontrado o no autorizado")
+		}
 	}
 
-	return nil
+	return guardarConfigImpuesto(impuesto)
 }
 
 // DeleteImpuesto elimina un impuesto (eliminación física)
@@ -276,5 +488,15 @@ func DeleteImpuesto(db *sql.DB, idIVA, idEmpresa int) error {
 		return fmt.Errorf("impuesto no encontrado o no autorizado")
 	}
 
+	if err := borrarConfigImpuesto(idIVA, idEmpresa); err != nil {
+		log.Printf("Error al eliminar configuración del impuesto %d: %v", idIVA, err)
+	}
+
 	return nil
 }
+
+// borrarConfigImpuesto elimina la configuración de un impuesto borrado
+func borrarConfigImpuesto(idIVA, idEmpresa int) error {
+	_, err := db.GetDB().Exec("DELETE FROM impuestos_config WHERE idiva = ? AND idempresa = ?", idIVA, idEmpresa)
+	return err
+}
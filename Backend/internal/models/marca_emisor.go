@@ -0,0 +1,48 @@
+package models
+
+import (
+	"Facts/internal/db"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// MarcaEmisor es la configuración visual del PDF de un emisor: tema, colores (#RRGGBB) y fuente.
+// Un campo vacío usa el valor del tema.
+type MarcaEmisor struct {
+	RFC                string `json:"rfc"`
+	Tema               string `json:"tema"`
+	ColorPrimario      string `json:"color_primario,omitempty"`
+	ColorSecundario    string `json:"color_secundario,omitempty"`
+	Fuente             string `json:"fuente,omitempty"`
+	FechaActualizacion string `json:"fecha_actualizacion,omitempty"`
+}
+
+// ObtenerMarcaEmisor devuelve la marca registrada para el RFC; sin registro devuelve una marca vacía
+func ObtenerMarcaEmisor(rfc string) (*MarcaEmisor, error) {
+	m := MarcaEmisor{RFC: strings.ToUpper(rfc)}
+	err := db.GetDB().QueryRow(
+		"SELECT tema, color_primario, color_secundario, fuente, fecha_actualizacion FROM marca_emisor WHERE rfc_emisor = ?", m.RFC,
+	).Scan(&m.Tema, &m.ColorPrimario, &m.ColorSecundario, &m.Fuente, &m.FechaActualizacion)
+	if err == sql.ErrNoRows {
+		return &m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error al obtener la marca del emisor %s: %w", m.RFC, err)
+	}
+	return &m, nil
+}
+
+// GuardarMarcaEmisor crea o reemplaza la marca del emisor
+func GuardarMarcaEmisor(m MarcaEmisor) error {
+	_, err := db.GetDB().Exec(
+		`INSERT INTO marca_emisor (rfc_emisor, tema, color_primario, color_secundario, fuente) VALUES (?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE tema = VALUES(tema), color_primario = VALUES(color_primario),
+			color_secundario = VALUES(color_secundario), fuente = VALUES(fuente)`,
+		strings.ToUpper(m.RFC), m.Tema, m.ColorPrimario, m.ColorSecundario, m.Fuente,
+	)
+	if err != nil {
+		return fmt.Errorf("error al guardar la marca del emisor %s: %w", m.RFC, err)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package models
+
+// Pago representa un pago recibido que se ampara con el complemento de recepción de pagos 2.0
+type Pago struct {
+	FechaPago    string          `json:"fecha_pago"`    // AAAA-MM-DDThh:mm:ss
+	FormaDePagoP string          `json:"forma_pago"`    // c_FormaPago (no puede ser 99)
+	MonedaP      string          `json:"moneda"`        // c_Moneda del pago
+	TipoCambioP  float64         `json:"tipo_cambio"`   // Requerido cuando MonedaP no es MXN
+	Monto        float64         `json:"monto"`         // Si es 0 se calcula con la suma de los documentos
+	NumOperacion string          `json:"num_operacion"` // Referencia bancaria (opcional)
+	Documentos   []DocumentoPago `json:"documentos"`
+}
+
+// DocumentoPago es una factura PPD a la que se aplica (total o parcialmente) un pago
+type DocumentoPago struct {
+	IDHistorial      int     `json:"id_historial"`
+	IdDocumento      string  `json:"id_documento"` // UUID de la factura pagada
+	Serie            string  `json:"serie,omitempty"`
+	Folio            string  `json:"folio,omitempty"`
+	MonedaDR         string  `json:"moneda_dr"`
+	EquivalenciaDR   float64 `json:"equivalencia_dr"` // Unidades de MonedaDR por cada unidad de MonedaP
+	NumParcialidad   int     `json:"num_parcialidad"`
+	ImpSaldoAnt      float64 `json:"imp_saldo_ant"`
+	ImpPagado        float64 `json:"imp_pagado"`
+	ImpSaldoInsoluto float64 `json:"imp_saldo_insoluto"`
+	ObjetoImpDR      string  `json:"objeto_imp_dr"`
+
+	// Datos del CFDI pagado para desglosar sus impuestos en proporción al pago; se toman de su XML timbrado
+	MetodoPago string              `json:"metodo_pago,omitempty"`
+	TotalDR    float64             `json:"total_dr,omitempty"`
+	Impuestos  []ImpuestoDocumento `json:"impuestos,omitempty"`
+}
+
+// ImpuestoDocumento es un traslado o retención del documento pagado, acumulado por impuesto, tipo de
+// factor y tasa o cuota
+type ImpuestoDocumento struct {
+	Retencion  bool    `json:"retencion"`
+	Impuesto   string  `json:"impuesto"`               // c_Impuesto: 001 ISR, 002 IVA, 003 IEPS
+	TipoFactor string  `json:"tipo_factor"`            // Tasa, Cuota o Exento
+	TasaOCuota string  `json:"tasa_o_cuota,omitempty"` // Como viene en el XML; vacía si es Exento
+	Base       float64 `json:"base"`
+	Importe    float64 `json:"importe"`
+}
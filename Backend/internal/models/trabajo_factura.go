@@ -0,0 +1,252 @@
+package models
+
+import (
+	"Facts/internal/db"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// EstatusFacDescripcion es el texto de cada EstatusFac para mostrar en la UI
+var EstatusFacDescripcion = map[string]string{
+	EstatusFacPendiente: "Pendiente",
+	EstatusFacTimbrando: "Timbrando",
+	EstatusFacGenerado:  "Generada",
+	EstatusFacFallo:     "Fallida",
+}
+
+// TrabajoFactura es una solicitud de factura en la cola de timbrado
+type TrabajoFactura struct {
+	ID                 int64                  `json:"id"`
+	IdUsuario          int                    `json:"id_usuario"`
+	NumeroFolio        string                 `json:"numero_folio"`
+	Estatus            string                 `json:"estatus"`
+	Intentos           int                    `json:"intentos"`
+	LogError           string                 `json:"log_error,omitempty"`
+	UUID               string                 `json:"uuid,omitempty"`
+	FechaCreacion      string                 `json:"fecha_creacion"`
+	FechaActualizacion string                 `json:"fecha_actualizacion"`
+	Eventos            []EventoTrabajoFactura `json:"eventos,omitempty"`
+
+	Factura   Factura `json:"-"`
+	Plantilla []byte  `json:"-"`
+}
+
+// EventoTrabajoFactura es una transición de estatus de un trabajo
+type EventoTrabajoFactura struct {
+	Estatus string `json:"estatus"`
+	Mensaje string `json:"mensaje,omitempty"`
+	Fecha   string `json:"fecha"`
+}
+
+// Terminado indica que el trabajo ya no cambiará de estatus
+func (t *TrabajoFactura) Terminado() bool {
+	return t.Estatus == EstatusFacGenerado || t.Estatus == EstatusFacFallo
+}
+
+// registrarEventoTrabajo guarda la transición en el historial del trabajo
+func registrarEventoTrabajo(ejecutor interface {
+	Exec(string, ...interface{}) (sql.Result, error)
+}, id int64, estatus, mensaje string) error {
+	_, err := ejecutor.Exec(
+		"INSERT INTO trabajos_factura_eventos (id_trabajo, estatus, mensaje) VALUES (?, ?, ?)",
+		id, estatus, mensaje,
+	)
+	return err
+}
+
+// EncolarFactura guarda la factura ya preparada como trabajo pendiente. Si no trae folio, lo
+// reserva en la misma transacción: si el trabajo no se guarda, el folio no se consume.
+func EncolarFactura(factura *Factura, plantilla []byte) (int64, error) {
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return 0, fmt.Errorf("error al iniciar transacción: %w", err)
+	}
+	defer tx.Rollback()
+
+	reservada := *factura
+	if reservada.NumeroFolio == "" {
+		folio, err := ReservarFolio(tx, reservada.SolicitudFolio())
+		if err != nil {
+			return 0, err
+		}
+		reservada.AplicarFolio(folio)
+	}
+	// La fecha de emisión se fija al encolar: cada reintento firma el mismo XML y el timbrado
+	// lo reconoce como el mismo comprobante
+	if reservada.FechaEmision == "" {
+		reservada.FechaEmision = time.Now().Format("2006-01-02T15:04:05")
+	}
+	datos, err := json.Marshal(reservada)
+	if err != nil {
+		return 0, fmt.Errorf("error al serializar factura: %w", err)
+	}
+
+	res, err := tx.Exec(
+		"INSERT INTO trabajos_factura (id_usuario, numero_folio, clave_ticket, estatus, datos, plantilla) VALUES (?, ?, ?, ?, ?, ?)",
+		reservada.IdUsuario, reservada.NumeroFolio, reservada.ClaveTicket, EstatusFacPendiente, string(datos), plantilla,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("error al encolar factura: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if err := registrarEventoTrabajo(tx, id, EstatusFacPendiente, "Factura encolada"); err != nil {
+		return 0, fmt.Errorf("error al registrar evento: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	*factura = reservada
+	return id, nil
+}
+
+// TomarTrabajoFactura reserva el siguiente trabajo listo y lo pasa a timbrando. También retoma
+// los trabajos que quedaron timbrando cuando venció su bloqueo (proceso reiniciado o caído).
+// Devuelve nil si no hay trabajos.
+func TomarTrabajoFactura(bloqueo time.Duration) (*TrabajoFactura, error) {
+	conn := db.GetDB()
+	rows, err := conn.Query(
+		`SELECT id FROM trabajos_factura
+		WHERE (estatus = ? AND proximo_intento <= NOW()) OR (estatus = ? AND bloqueado_hasta < NOW())
+		ORDER BY id LIMIT 5`,
+		EstatusFacPendiente, EstatusFacTimbrando,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error al consultar la cola: %w", err)
+	}
+	var candidatos []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err == nil {
+			candidatos = append(candidatos, id)
+		}
+	}
+	rows.Close()
+
+	// Otro worker pudo ganar el trabajo: solo se toma si la actualización afecta la fila
+	for _, id := range candidatos {
+		res, err := conn.Exec(
+			`UPDATE trabajos_factura
+			SET estatus = ?, intentos = intentos + 1, bloqueado_hasta = DATE_ADD(NOW(), INTERVAL ? SECOND)
+			WHERE id = ? AND ((estatus = ? AND proximo_intento <= NOW()) OR (estatus = ? AND bloqueado_hasta < NOW()))`,
+			EstatusFacTimbrando, int(bloqueo.Seconds()), id, EstatusFacPendiente, EstatusFacTimbrando,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("error al reservar trabajo %d: %w", id, err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		trabajo, err := ObtenerTrabajoFactura(id, false)
+		if err != nil {
+			return nil, err
+		}
+		registrarEventoTrabajo(conn, id, EstatusFacTimbrando, fmt.Sprintf("Intento %d", trabajo.Intentos))
+		return trabajo, nil
+	}
+	return nil, nil
+}
+
+// ObtenerTrabajoFactura consulta un trabajo; con eventos incluye su historial de estatus
+func ObtenerTrabajoFactura(id int64, eventos bool) (*TrabajoFactura, error) {
+	conn := db.GetDB()
+	var t TrabajoFactura
+	var datos string
+	var logError, uuid sql.NullString
+	err := conn.QueryRow(
+		`SELECT id, id_usuario, numero_folio, estatus, datos, plantilla, intentos, log_error, uuid, fecha_creacion, fecha_actualizacion
+		FROM trabajos_factura WHERE id = ?`,
+		id,
+	).Scan(&t.ID, &t.IdUsuario, &t.NumeroFolio, &t.Estatus, &datos, &t.Plantilla, &t.Intentos, &logError, &uuid, &t.FechaCreacion, &t.FechaActualizacion)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("no existe el trabajo %d", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error al obtener trabajo: %w", err)
+	}
+	t.LogError = logError.String
+	t.UUID = uuid.String
+	if err := json.Unmarshal([]byte(datos), &t.Factura); err != nil {
+		return nil, fmt.Errorf("datos de factura inválidos en trabajo %d: %w", id, err)
+	}
+
+	if !eventos {
+		return &t, nil
+	}
+	rows, err := conn.Query(
+		"SELECT estatus, COALESCE(mensaje, ''), fecha FROM trabajos_factura_eventos WHERE id_trabajo = ? ORDER BY id",
+		id,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error al obtener eventos: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e EventoTrabajoFactura
+		if err := rows.Scan(&e.Estatus, &e.Mensaje, &e.Fecha); err != nil {
+			return nil, err
+		}
+		t.Eventos = append(t.Eventos, e)
+	}
+	return &t, nil
+}
+
+// ReprogramarTrabajoFactura regresa el trabajo a pendiente para reintentarlo después de espera
+func ReprogramarTrabajoFactura(id int64, mensaje string, espera time.Duration) error {
+	_, err := db.GetDB().Exec(
+		`UPDATE trabajos_factura
+		SET estatus = ?, log_error = ?, bloqueado_hasta = NULL, proximo_intento = DATE_ADD(NOW(), INTERVAL ? SECOND)
+		WHERE id = ?`,
+		EstatusFacPendiente, mensaje, int(espera.Seconds()), id,
+	)
+	if err != nil {
+		return fmt.Errorf("error al reprogramar trabajo: %w", err)
+	}
+	return registrarEventoTrabajo(db.GetDB(), id, EstatusFacPendiente, "Reintento programado: "+mensaje)
+}
+
+// FallarTrabajoFactura marca el trabajo como fallido sin más reintentos
+func FallarTrabajoFactura(id int64, mensaje string) error {
+	_, err := db.GetDB().Exec(
+		"UPDATE trabajos_factura SET estatus = ?, log_error = ?, bloqueado_hasta = NULL WHERE id = ?",
+		EstatusFacFallo, mensaje, id,
+	)
+	if err != nil {
+		return fmt.Errorf("error al marcar trabajo fallido: %w", err)
+	}
+	return registrarEventoTrabajo(db.GetDB(), id, EstatusFacFallo, mensaje)
+}
+
+// CompletarTrabajoFactura guarda el CFDI timbrado y su PDF y marca el trabajo como generado dentro
+// de tx, la transacción que registra el comprobante en el historial
+func CompletarTrabajoFactura(tx *sql.Tx, id int64, uuid string, xmlTimbrado, pdf []byte) error {
+	_, err := tx.Exec(
+		"UPDATE trabajos_factura SET estatus = ?, uuid = ?, xml = ?, pdf = ?, log_error = NULL, bloqueado_hasta = NULL WHERE id = ?",
+		EstatusFacGenerado, uuid, string(xmlTimbrado), pdf, id,
+	)
+	if err != nil {
+		return fmt.Errorf("error al completar trabajo: %w", err)
+	}
+	return registrarEventoTrabajo(tx, id, EstatusFacGenerado, "UUID "+uuid)
+}
+
+// ObtenerArchivosTrabajoFactura devuelve el XML timbrado y el PDF de un trabajo generado
+func ObtenerArchivosTrabajoFactura(id int64) ([]byte, []byte, error) {
+	var xmlTimbrado sql.NullString
+	var pdf []byte
+	err := db.GetDB().QueryRow(
+		"SELECT xml, pdf FROM trabajos_factura WHERE id = ? AND estatus = ?",
+		id, EstatusFacGenerado,
+	).Scan(&xmlTimbrado, &pdf)
+	if err == sql.ErrNoRows {
+		return nil, nil, fmt.Errorf("el trabajo %d no existe o aún no está generado", id)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("error al obtener archivos: %w", err)
+	}
+	return []byte(xmlTimbrado.String), pdf, nil
+}
@@ -0,0 +1,126 @@
+package pac
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// CSD de pruebas publicado por el SAT (EKU9003173C9)
+const (
+	cerPrueba   = "../../certificados/ABC123456DE7_cer.cer"
+	keyPrueba   = "../../certificados/ABC123456DE7_key.key"
+	clavePrueba = "12345678a"
+)
+
+// solicitudPrueba arma una cancelación con el .cer y el .key tal como los emite el SAT
+func solicitudPrueba(t *testing.T) (SolicitudCancelacion, *x509.Certificate) {
+	t.Helper()
+	cer, err := os.ReadFile(cerPrueba)
+	if err != nil {
+		t.Fatalf("no se pudo leer el .cer de prueba: %v", err)
+	}
+	key, err := os.ReadFile(keyPrueba)
+	if err != nil {
+		t.Fatalf("no se pudo leer el .key de prueba: %v", err)
+	}
+	cert, err := x509.ParseCertificate(cer)
+	if err != nil {
+		t.Fatalf(".cer de prueba inválido: %v", err)
+	}
+	return SolicitudCancelacion{
+		RFCEmisor:    "EKU9003173C9",
+		UUID:         "5FB2822E-396D-4725-8521-CDC4BDD20CCF",
+		Motivo:       "02",
+		Certificado:  cer,
+		LlaveCifrada: key,
+		ClaveLlave:   clavePrueba,
+	}, cert
+}
+
+// servidorCaptura responde con respuesta y guarda el cuerpo de la última solicitud
+func servidorCaptura(t *testing.T, respuesta string) (*httptest.Server, *[]byte) {
+	t.Helper()
+	var cuerpo []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cuerpo, _ = io.ReadAll(r.Body)
+		io.WriteString(w, respuesta)
+	}))
+	t.Cleanup(ts.Close)
+	return ts, &cuerpo
+}
+
+// TestCancelarSolucionFactibleEnviaCSDOriginal revisa que el .key viaje como lo emitió el SAT (cifrado)
+func TestCancelarSolucionFactibleEnviaCSDOriginal(t *testing.T) {
+	solicitud, _ := solicitudPrueba(t)
+	ts, cuerpo := servidorCaptura(t, `{"status":"201","estatusCancelacion":"Cancelado sin aceptación"}`)
+	proveedor, err := Nuevo(Config{Proveedor: "solucion_factible", Usuario: "u", Contrasena: "p", URL: ts.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := proveedor.Cancelar(solicitud); err != nil {
+		t.Fatalf("error al cancelar: %v", err)
+	}
+
+	var payload map[string]interface{}
+	if err := json.Unmarshal(*cuerpo, &payload); err != nil {
+		t.Fatalf("solicitud inválida: %v", err)
+	}
+	if payload["key"] != base64.StdEncoding.EncodeToString(solicitud.LlaveCifrada) {
+		t.Errorf("el .key enviado no es el archivo original del SAT")
+	}
+	if payload["cer"] != base64.StdEncoding.EncodeToString(solicitud.Certificado) {
+		t.Errorf("el .cer enviado no es el archivo original del SAT")
+	}
+	if bytes.Contains(*cuerpo, []byte("PRIVATE KEY")) {
+		t.Errorf("la solicitud incluye una llave PEM")
+	}
+}
+
+// TestCancelarFinkokCifraLlave revisa que el .key viaje como PEM cifrado con la contraseña de Finkok
+func TestCancelarFinkokCifraLlave(t *testing.T) {
+	solicitud, cert := solicitudPrueba(t)
+	ts, cuerpo := servidorCaptura(t, `<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/"><soap:Body>`+
+		`<cancelResponse><cancelResult><Folios><Folio><EstatusUUID>201</EstatusUUID></Folio></Folios></cancelResult></cancelResponse>`+
+		`</soap:Body></soap:Envelope>`)
+	const contrasenaFinkok = "contrasena-finkok"
+	proveedor, err := Nuevo(Config{Proveedor: "finkok", Usuario: "u", Contrasena: contrasenaFinkok, URL: ts.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := proveedor.Cancelar(solicitud); err != nil {
+		t.Fatalf("error al cancelar: %v", err)
+	}
+
+	llave := valoresXML(*cuerpo, "key")["key"]
+	pemLlave, err := base64.StdEncoding.DecodeString(llave)
+	if err != nil {
+		t.Fatalf("fk:key no es base64: %v", err)
+	}
+	bloque, _ := pem.Decode(pemLlave)
+	if bloque == nil || !x509.IsEncryptedPEMBlock(bloque) {
+		t.Fatalf("fk:key no es un PEM cifrado: %q", pemLlave)
+	}
+	if _, err := x509.DecryptPEMBlock(bloque, []byte("otra")); err == nil {
+		t.Errorf("la llave se abrió con una contraseña distinta a la de Finkok")
+	}
+	der, err := x509.DecryptPEMBlock(bloque, []byte(contrasenaFinkok))
+	if err != nil {
+		t.Fatalf("la llave no se abre con la contraseña de Finkok: %v", err)
+	}
+	privada, err := x509.ParsePKCS1PrivateKey(der)
+	if err != nil {
+		t.Fatalf("llave PKCS#1 inválida: %v", err)
+	}
+	if !cert.PublicKey.(*rsa.PublicKey).Equal(&privada.PublicKey) {
+		t.Errorf("la llave enviada no corresponde al certificado")
+	}
+}
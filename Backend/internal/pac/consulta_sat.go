@@ -0,0 +1,131 @@
+package pac
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// URLConsultaSAT es el servicio público del SAT para verificar el estado de un CFDI
+const URLConsultaSAT = "https://consultaqr.facturaelectronica.sat.gob.mx/ConsultaCFDIService.svc"
+
+const accionConsultaSAT = "http://tempuri.org/IConsultaCFDIService/Consulta"
+
+// maxEstadosEnCache limita la caché; al llenarse se descartan los vencidos y, si no basta, el más
+// próximo a vencer
+const maxEstadosEnCache = 10000
+
+// ConsultaCFDIService es el cliente de la operación SOAP Consulta del SAT. No requiere credenciales;
+// las respuestas satisfactorias se guardan en caché durante ttl.
+type ConsultaCFDIService struct {
+	url     string
+	ttl     time.Duration
+	cliente *http.Client
+
+	mu          sync.Mutex
+	cache       map[string]estadoEnCache
+	maxEntradas int
+}
+
+type estadoEnCache struct {
+	estado EstadoCFDI
+	vence  time.Time
+}
+
+// NuevoConsultaCFDIService crea el cliente; url vacía usa el servicio del SAT y ttl 0 desactiva la caché
+func NuevoConsultaCFDIService(url string, ttl time.Duration) *ConsultaCFDIService {
+	if url == "" {
+		url = URLConsultaSAT
+	}
+	return &ConsultaCFDIService{
+		url:         url,
+		ttl:         ttl,
+		cliente:     &http.Client{Timeout: 30 * time.Second},
+		cache:       map[string]estadoEnCache{},
+		maxEntradas: maxEstadosEnCache,
+	}
+}
+
+// ExpresionImpresa arma la expresión re/rr/tt/id que el SAT usa para identificar el CFDI
+func ExpresionImpresa(consulta ConsultaEstado) string {
+	total := consulta.Total
+	if valor, err := strconv.ParseFloat(total, 64); err == nil {
+		total = strconv.FormatFloat(valor, 'f', 6, 64)
+	}
+	return fmt.Sprintf("?re=%s&rr=%s&tt=%s&id=%s",
+		consulta.RFCEmisor, consulta.RFCReceptor, total, strings.ToUpper(consulta.UUID))
+}
+
+// Consultar devuelve el estado del CFDI, de la caché si aún no vence
+func (c *ConsultaCFDIService) Consultar(consulta ConsultaEstado) (*EstadoCFDI, error) {
+	clave := ExpresionImpresa(consulta)
+	c.mu.Lock()
+	guardado, ok := c.cache[clave]
+	vigente := ok && time.Now().Before(guardado.vence)
+	if ok && !vigente {
+		delete(c.cache, clave)
+	}
+	c.mu.Unlock()
+	if vigente {
+		estado := guardado.estado
+		return &estado, nil
+	}
+	return c.Actualizar(consulta)
+}
+
+// Actualizar consulta al SAT sin usar la caché y guarda la respuesta
+func (c *ConsultaCFDIService) Actualizar(consulta ConsultaEstado) (*EstadoCFDI, error) {
+	clave := ExpresionImpresa(consulta)
+	sobre := `<soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/" xmlns:tem="http://tempuri.org/">` +
+		`<soapenv:Header/><soapenv:Body><tem:Consulta><tem:expresionImpresa>` + escaparXML(clave) +
+		`</tem:expresionImpresa></tem:Consulta></soapenv:Body></soapenv:Envelope>`
+
+	respuesta, err := postSOAP(c.cliente, c.url, accionConsultaSAT, []byte(sobre))
+	if err != nil {
+		return nil, fmt.Errorf("error al consultar al SAT: %w", err)
+	}
+	valores := valoresXML(respuesta, "CodigoEstatus", "Estado", "EsCancelable", "EstatusCancelacion", "ValidacionEFOS")
+	if valores["CodigoEstatus"] == "" {
+		return nil, fmt.Errorf("respuesta inválida del servicio de consulta del SAT")
+	}
+	estado := EstadoCFDI{
+		CodigoEstatus:      valores["CodigoEstatus"],
+		Estado:             valores["Estado"],
+		EsCancelable:       valores["EsCancelable"],
+		EstatusCancelacion: valores["EstatusCancelacion"],
+		ValidacionEFOS:     valores["ValidacionEFOS"],
+	}
+
+	// "N - 602" puede ser un CFDI recién timbrado que el SAT aún no recibe: solo se guardan respuestas "S"
+	if c.ttl > 0 && strings.HasPrefix(estado.CodigoEstatus, "S") {
+		c.mu.Lock()
+		c.guardar(clave, estadoEnCache{estado: estado, vence: time.Now().Add(c.ttl)})
+		c.mu.Unlock()
+	}
+	return &estado, nil
+}
+
+// guardar agrega el estado a la caché sin pasar de maxEntradas; se llama con mu tomado
+func (c *ConsultaCFDIService) guardar(clave string, guardado estadoEnCache) {
+	if _, existe := c.cache[clave]; !existe && len(c.cache) >= c.maxEntradas {
+		ahora := time.Now()
+		for k, v := range c.cache {
+			if !ahora.Before(v.vence) {
+				delete(c.cache, k)
+			}
+		}
+		for len(c.cache) >= c.maxEntradas {
+			var proxima string
+			for k, v := range c.cache {
+				if proxima == "" || v.vence.Before(c.cache[proxima].vence) {
+					proxima = k
+				}
+			}
+			delete(c.cache, proxima)
+		}
+	}
+	c.cache[clave] = guardado
+}
@@ -0,0 +1,218 @@
+package pac
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// respuestaConsultaSAT arma una ConsultaResponse con los prefijos que usa el servicio del SAT
+func respuestaConsultaSAT(codigo, estado, esCancelable, estatusCancelacion string) string {
+	return `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>` +
+		`<ConsultaResponse xmlns="http://tempuri.org/"><ConsultaResult xmlns:a="http://schemas.datacontract.org/2004/07/Sat.Cfdi.Negocio.ConsultaCfdi.Servicio" xmlns:i="http://www.w3.org/2001/XMLSchema-instance">` +
+		`<a:CodigoEstatus>` + codigo + `</a:CodigoEstatus>` +
+		`<a:EsCancelable>` + esCancelable + `</a:EsCancelable>` +
+		`<a:Estado>` + estado + `</a:Estado>` +
+		`<a:EstatusCancelacion>` + estatusCancelacion + `</a:EstatusCancelacion>` +
+		`<a:ValidacionEFOS>200</a:ValidacionEFOS>` +
+		`</ConsultaResult></ConsultaResponse></s:Body></s:Envelope>`
+}
+
+// servicioSAT sustituye al servicio de consulta del SAT: valida la operación SOAP, guarda la
+// expresión impresa recibida y contesta con lo que devuelva responder
+type servicioSAT struct {
+	mu        sync.Mutex
+	llamadas  int
+	expresion string
+	responder func(w http.ResponseWriter)
+}
+
+// nuevoServicioSAT levanta el servicio sustituto y un cliente con caché apuntando a él
+func nuevoServicioSAT(t *testing.T, responder func(w http.ResponseWriter)) (*servicioSAT, *ConsultaCFDIService) {
+	t.Helper()
+	s := &servicioSAT{responder: responder}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("SOAPAction") != accionConsultaSAT {
+			t.Errorf("SOAPAction = %q, se esperaba %q", r.Header.Get("SOAPAction"), accionConsultaSAT)
+		}
+		cuerpo, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		s.llamadas++
+		s.expresion = valoresXML(cuerpo, "expresionImpresa")["expresionImpresa"]
+		responder := s.responder
+		s.mu.Unlock()
+		responder(w)
+	}))
+	t.Cleanup(ts.Close)
+	return s, NuevoConsultaCFDIService(ts.URL, time.Minute)
+}
+
+// responderCon fija la respuesta del servicio para las siguientes llamadas
+func (s *servicioSAT) responderCon(responder func(w http.ResponseWriter)) {
+	s.mu.Lock()
+	s.responder = responder
+	s.mu.Unlock()
+}
+
+// totalLlamadas cuenta las solicitudes que llegaron al servicio
+func (s *servicioSAT) totalLlamadas() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.llamadas
+}
+
+// responderXML contesta siempre con el mismo sobre
+func responderXML(cuerpo string) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+		io.WriteString(w, cuerpo)
+	}
+}
+
+// consultaPrueba identifica un CFDI con total sin ceros a la derecha y UUID en minúsculas
+var consultaPrueba = ConsultaEstado{
+	RFCEmisor:   "EKU9003173C9",
+	RFCReceptor: "URE180429TM6",
+	Total:       "116.5",
+	UUID:        "5fb2822e-396d-4725-8521-cdc4bdd20ccf",
+}
+
+// TestExpresionImpresa revisa el formato que espera el SAT: total a 6 decimales y UUID en mayúsculas
+func TestExpresionImpresa(t *testing.T) {
+	esperada := "?re=EKU9003173C9&rr=URE180429TM6&tt=116.500000&id=5FB2822E-396D-4725-8521-CDC4BDD20CCF"
+	if expresion := ExpresionImpresa(consultaPrueba); expresion != esperada {
+		t.Errorf("ExpresionImpresa = %q, se esperaba %q", expresion, esperada)
+	}
+}
+
+// TestConsultarVigenteUsaCache revisa que la respuesta satisfactoria se guarde y que Actualizar la ignore
+func TestConsultarVigenteUsaCache(t *testing.T) {
+	s, cliente := nuevoServicioSAT(t, responderXML(respuestaConsultaSAT(
+		"S - Comprobante obtenido satisfactoriamente.", "Vigente", "Cancelable sin aceptación", "")))
+
+	estado, err := cliente.Consultar(consultaPrueba)
+	if err != nil {
+		t.Fatalf("error al consultar: %v", err)
+	}
+	if estado.Estado != "Vigente" || estado.EsCancelable != "Cancelable sin aceptación" || estado.ValidacionEFOS != "200" {
+		t.Errorf("estado inesperado: %+v", estado)
+	}
+	if s.expresion != ExpresionImpresa(consultaPrueba) {
+		t.Errorf("expresión enviada %q, se esperaba %q", s.expresion, ExpresionImpresa(consultaPrueba))
+	}
+
+	if _, err := cliente.Consultar(consultaPrueba); err != nil {
+		t.Fatalf("error en la segunda consulta: %v", err)
+	}
+	if n := s.totalLlamadas(); n != 1 {
+		t.Errorf("la segunda consulta debía salir de la caché; llamadas al SAT: %d", n)
+	}
+
+	s.responderCon(responderXML(respuestaConsultaSAT(
+		"S - Comprobante obtenido satisfactoriamente.", "Cancelado", "Cancelable sin aceptación", "Cancelado sin aceptación")))
+	estado, err = cliente.Actualizar(consultaPrueba)
+	if err != nil || estado.Estado != "Cancelado" || s.totalLlamadas() != 2 {
+		t.Fatalf("Actualizar debía consultar al SAT: %+v, %v, llamadas %d", estado, err, s.totalLlamadas())
+	}
+	if estado, err = cliente.Consultar(consultaPrueba); err != nil || estado.Estado != "Cancelado" {
+		t.Errorf("la caché no se actualizó: %+v, %v", estado, err)
+	}
+}
+
+// TestConsultarNoEncontradoNoSeGuarda revisa que un "N - 602" se vuelva a consultar
+func TestConsultarNoEncontradoNoSeGuarda(t *testing.T) {
+	s, cliente := nuevoServicioSAT(t, responderXML(respuestaConsultaSAT(
+		"N - 602: Comprobante no encontrado.", "No Encontrado", "", "")))
+
+	for i := 0; i < 2; i++ {
+		estado, err := cliente.Consultar(consultaPrueba)
+		if err != nil || estado.Estado != "No Encontrado" {
+			t.Fatalf("consulta %d: %+v, %v", i+1, estado, err)
+		}
+	}
+	if n := s.totalLlamadas(); n != 2 {
+		t.Errorf("el \"N - 602\" no debía guardarse en caché; llamadas al SAT: %d", n)
+	}
+}
+
+// TestConsultarErrores revisa que las fallas del servicio lleguen como error y no se guarden
+func TestConsultarErrores(t *testing.T) {
+	casos := []struct {
+		nombre      string
+		responder   func(w http.ResponseWriter)
+		transitorio bool
+		contiene    string
+	}{
+		{"soap fault", func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault>`+
+				`<faultcode>s:Client</faultcode><faultstring>Expresión impresa inválida</faultstring></s:Fault></s:Body></s:Envelope>`)
+		}, false, "Expresión impresa inválida"},
+		{"servicio caido", func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, "Service Unavailable")
+		}, true, "503"},
+		{"respuesta vacia", responderXML(`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>` +
+			`<ConsultaResponse xmlns="http://tempuri.org/"><ConsultaResult/></ConsultaResponse></s:Body></s:Envelope>`), false, "respuesta inválida"},
+		{"no es xml", responderXML("<html>mantenimiento"), false, "respuesta inválida"},
+	}
+	for _, c := range casos {
+		t.Run(c.nombre, func(t *testing.T) {
+			s, cliente := nuevoServicioSAT(t, c.responder)
+			_, err := cliente.Consultar(consultaPrueba)
+			if err == nil || !strings.Contains(err.Error(), c.contiene) {
+				t.Fatalf("se esperaba un error con %q, se obtuvo %v", c.contiene, err)
+			}
+			if errors.Is(err, ErrPACNoDisponible) != c.transitorio {
+				t.Errorf("errors.Is(%v, ErrPACNoDisponible) = %t", err, !c.transitorio)
+			}
+			if _, err := cliente.Consultar(consultaPrueba); err == nil || s.totalLlamadas() != 2 {
+				t.Errorf("el error no debía guardarse en caché (llamadas %d, err %v)", s.totalLlamadas(), err)
+			}
+		})
+	}
+}
+
+// TestCacheDescartaVencidosYSeLimita revisa que un estado vencido se quite al leerlo y que la caché
+// no pase de su límite
+func TestCacheDescartaVencidosYSeLimita(t *testing.T) {
+	s, cliente := nuevoServicioSAT(t, responderXML(respuestaConsultaSAT(
+		"N - 602: Comprobante no encontrado.", "No Encontrado", "", "")))
+	clave := ExpresionImpresa(consultaPrueba)
+	cliente.cache[clave] = estadoEnCache{estado: EstadoCFDI{Estado: "Vigente"}, vence: time.Now().Add(-time.Second)}
+	if estado, err := cliente.Consultar(consultaPrueba); err != nil || estado.Estado != "No Encontrado" || s.totalLlamadas() != 1 {
+		t.Fatalf("el estado vencido no debía usarse: %+v, %v", estado, err)
+	}
+	if _, ok := cliente.cache[clave]; ok {
+		t.Errorf("el estado vencido sigue en la caché")
+	}
+
+	s.responderCon(responderXML(respuestaConsultaSAT(
+		"S - Comprobante obtenido satisfactoriamente.", "Vigente", "Cancelable sin aceptación", "")))
+	cliente.maxEntradas = 2
+	uuids := []string{
+		"00000000-0000-0000-0000-000000000001",
+		"00000000-0000-0000-0000-000000000002",
+		"00000000-0000-0000-0000-000000000003",
+	}
+	for _, uuid := range uuids {
+		consulta := consultaPrueba
+		consulta.UUID = uuid
+		if _, err := cliente.Consultar(consulta); err != nil {
+			t.Fatalf("error al consultar %s: %v", uuid, err)
+		}
+	}
+	if n := len(cliente.cache); n != 2 {
+		t.Fatalf("la caché tiene %d estados, el límite es 2", n)
+	}
+	primera := consultaPrueba
+	primera.UUID = uuids[0]
+	if _, ok := cliente.cache[ExpresionImpresa(primera)]; ok {
+		t.Errorf("se debía descartar el estado más próximo a vencer")
+	}
+}
@@ -0,0 +1,158 @@
+package pac
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"Facts/internal/secretos"
+)
+
+// URLs base de los servicios SOAP de Finkok
+const (
+	urlFinkokPruebas    = "https://demo-facturacion.finkok.com/servicios/soap"
+	urlFinkokProduccion = "https://facturacion.finkok.com/servicios/soap"
+)
+
+func init() {
+	Registrar("finkok", func(cfg Config) (PACProvider, error) {
+		return &finkok{cfg: cfg, url: urlBase(cfg, urlFinkokProduccion, urlFinkokPruebas), cliente: clientePara(cfg)}, nil
+	})
+}
+
+// finkok implementa los servicios SOAP (stamp, cancel y registration) de Finkok
+type finkok struct {
+	cfg     Config
+	url     string
+	cliente *http.Client
+}
+
+func (f *finkok) Nombre() string { return "finkok" }
+
+// sobre arma el Envelope SOAP con la operación y sus parámetros ya serializados
+func (f *finkok) sobre(espacio, operacion, parametros string) []byte {
+	return []byte(fmt.Sprintf(
+		`<soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/" xmlns:fk="%s" xmlns:apps="apps.services.soap.core.views">`+
+			`<soapenv:Header/><soapenv:Body><fk:%s>%s</fk:%s></soapenv:Body></soapenv:Envelope>`,
+		espacio, operacion, parametros, operacion,
+	))
+}
+
+func (f *finkok) credenciales() string {
+	return "<fk:username>" + escaparXML(f.cfg.Usuario) + "</fk:username><fk:password>" + escaparXML(f.cfg.Contrasena) + "</fk:password>"
+}
+
+// llamarStamp invoca una operación de stamp.wsdl (stamp o stamped) y devuelve el XML timbrado
+func (f *finkok) llamarStamp(operacion string, xmlFirmado []byte) ([]byte, error) {
+	const espacio = "http://facturacion.finkok.com/stamp"
+	parametros := "<fk:xml>" + base64.StdEncoding.EncodeToString(xmlFirmado) + "</fk:xml>" + f.credenciales()
+
+	respuesta, err := postSOAP(f.cliente, f.url+"/stamp.wsdl", espacio+"/"+operacion, f.sobre(espacio, operacion, parametros))
+	if err != nil {
+		return nil, err
+	}
+	valores := valoresXML(respuesta, "xml", "CodigoError", "MensajeIncidencia")
+	if valores["xml"] != "" {
+		return []byte(valores["xml"]), nil
+	}
+	if valores["CodigoError"] == codigoTimbreDuplicado {
+		return nil, fmt.Errorf("%w: %s", ErrTimbreDuplicado, valores["MensajeIncidencia"])
+	}
+	if valores["MensajeIncidencia"] != "" {
+		return nil, fmt.Errorf("Error PAC %s: %s", valores["CodigoError"], valores["MensajeIncidencia"])
+	}
+	return nil, errors.New("No se recibió XML timbrado del PAC")
+}
+
+func (f *finkok) Timbrar(xmlFirmado []byte) ([]byte, error) {
+	return f.llamarStamp("stamp", xmlFirmado)
+}
+
+// Recuperar usa la operación stamped, que devuelve el XML de un CFDI timbrado previamente
+func (f *finkok) Recuperar(xmlFirmado []byte) ([]byte, error) {
+	return f.llamarStamp("stamped", xmlFirmado)
+}
+
+// llaveCancelacion convierte el .key del SAT al formato que pide Finkok: PEM cifrado con la contraseña
+// de la cuenta de Finkok, de modo que la llave nunca viaja descifrada
+func (f *finkok) llaveCancelacion(solicitud SolicitudCancelacion) (string, error) {
+	llave, err := secretos.LlavePEMCifrada(solicitud.LlaveCifrada, solicitud.ClaveLlave, f.cfg.Contrasena)
+	if err != nil {
+		return "", fmt.Errorf("error al cifrar la llave para Finkok: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(llave), nil
+}
+
+func (f *finkok) Cancelar(solicitud SolicitudCancelacion) (*ResultadoCancelacion, error) {
+	const espacio = "http://facturacion.finkok.com/cancel"
+	llave, err := f.llaveCancelacion(solicitud)
+	if err != nil {
+		return nil, err
+	}
+	parametros := fmt.Sprintf(
+		`<fk:UUIDS><apps:UUID UUID="%s" Motivo="%s" FolioSustitucion="%s"/></fk:UUIDS>%s`+
+			`<fk:taxpayer_id>%s</fk:taxpayer_id><fk:cer>%s</fk:cer><fk:key>%s</fk:key><fk:store_pending>false</fk:store_pending>`,
+		escaparXML(solicitud.UUID), escaparXML(solicitud.Motivo), escaparXML(solicitud.FolioSustitucion), f.credenciales(),
+		escaparXML(solicitud.RFCEmisor),
+		base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: solicitud.Certificado})),
+		llave,
+	)
+
+	respuesta, err := postSOAP(f.cliente, f.url+"/cancel.wsdl", espacio+"/cancel", f.sobre(espacio, "cancel", parametros))
+	if err != nil {
+		return nil, err
+	}
+	valores := valoresXML(respuesta, "EstatusUUID", "EstatusCancelacion", "Acuse", "CodEstatus")
+	if valores["EstatusUUID"] == "" {
+		return nil, fmt.Errorf("Error PAC: %s", valores["CodEstatus"])
+	}
+	return &ResultadoCancelacion{
+		UUID:               solicitud.UUID,
+		CodigoEstatus:      valores["EstatusUUID"],
+		EstatusCancelacion: valores["EstatusCancelacion"],
+		Acuse:              []byte(valores["Acuse"]),
+	}, nil
+}
+
+func (f *finkok) ConsultarEstado(consulta ConsultaEstado) (*EstadoCFDI, error) {
+	const espacio = "http://facturacion.finkok.com/cancel"
+	parametros := f.credenciales() + fmt.Sprintf(
+		"<fk:taxpayer_id>%s</fk:taxpayer_id><fk:rtaxpayer_id>%s</fk:rtaxpayer_id><fk:uuid>%s</fk:uuid><fk:total>%s</fk:total>",
+		escaparXML(consulta.RFCEmisor), escaparXML(consulta.RFCReceptor), escaparXML(consulta.UUID), escaparXML(consulta.Total),
+	)
+
+	respuesta, err := postSOAP(f.cliente, f.url+"/cancel.wsdl", espacio+"/get_sat_status", f.sobre(espacio, "get_sat_status", parametros))
+	if err != nil {
+		return nil, err
+	}
+	valores := valoresXML(respuesta, "CodigoEstatus", "Estado", "EsCancelable", "EstatusCancelacion", "error")
+	if valores["Estado"] == "" && valores["error"] != "" {
+		return nil, errors.New("Error PAC: " + valores["error"])
+	}
+	return &EstadoCFDI{
+		CodigoEstatus:      valores["CodigoEstatus"],
+		Estado:             valores["Estado"],
+		EsCancelable:       valores["EsCancelable"],
+		EstatusCancelacion: valores["EstatusCancelacion"],
+	}, nil
+}
+
+func (f *finkok) Saldo() (int, error) {
+	const espacio = "http://facturacion.finkok.com/registration"
+	parametros := "<fk:reseller_username>" + escaparXML(f.cfg.Usuario) + "</fk:reseller_username>" +
+		"<fk:reseller_password>" + escaparXML(f.cfg.Contrasena) + "</fk:reseller_password>" +
+		"<fk:taxpayer_id>" + escaparXML(f.cfg.RFC) + "</fk:taxpayer_id>"
+
+	respuesta, err := postSOAP(f.cliente, f.url+"/registration.wsdl", espacio+"/get", f.sobre(espacio, "get", parametros))
+	if err != nil {
+		return 0, err
+	}
+	valores := valoresXML(respuesta, "credit", "message")
+	if valores["credit"] == "" {
+		return 0, fmt.Errorf("Error PAC: %s", valores["message"])
+	}
+	return strconv.Atoi(valores["credit"])
+}
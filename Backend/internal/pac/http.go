@@ -0,0 +1,131 @@
+package pac
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// clienteHTTP es compartido por todos los proveedores; el SAT puede tardar en responder cancelaciones
+var clienteHTTP = &http.Client{Timeout: 90 * time.Second}
+
+// clientePara devuelve el cliente compartido o uno con el timeout de la configuración
+func clientePara(cfg Config) *http.Client {
+	if cfg.Timeout <= 0 {
+		return clienteHTTP
+	}
+	return &http.Client{Timeout: cfg.Timeout}
+}
+
+// postJSON envía un payload JSON y decodifica la respuesta en destino
+func postJSON(cliente *http.Client, url string, payload, destino interface{}) error {
+	cuerpo, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := cliente.Post(url, "application/json", bytes.NewReader(cuerpo))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrPACNoDisponible, err)
+	}
+	defer resp.Body.Close()
+
+	respuesta, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrPACNoDisponible, err)
+	}
+	if err := errorHTTP(resp.StatusCode, respuesta); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(respuesta, destino); err != nil {
+		return fmt.Errorf("respuesta inválida del PAC: %w", err)
+	}
+	return nil
+}
+
+// postSOAP envía un sobre SOAP 1.1 y devuelve el cuerpo de la respuesta; los SOAP Fault se regresan como error
+func postSOAP(cliente *http.Client, url, accion string, sobre []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(sobre))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	req.Header.Set("SOAPAction", accion)
+
+	resp, err := cliente.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrPACNoDisponible, err)
+	}
+	defer resp.Body.Close()
+
+	respuesta, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrPACNoDisponible, err)
+	}
+	if falla := valoresXML(respuesta, "faultstring")["faultstring"]; falla != "" {
+		return nil, fmt.Errorf("Error PAC: %s", falla)
+	}
+	if err := errorHTTP(resp.StatusCode, respuesta); err != nil {
+		return nil, err
+	}
+	return respuesta, nil
+}
+
+// errorHTTP convierte un estatus distinto de 200 en error; los 5xx se consideran transitorios
+func errorHTTP(estatus int, respuesta []byte) error {
+	if estatus == http.StatusOK {
+		return nil
+	}
+	detalle := strings.TrimSpace(string(respuesta))
+	if estatus >= 500 || estatus == http.StatusTooManyRequests {
+		return fmt.Errorf("%w (HTTP %d): %s", ErrPACNoDisponible, estatus, detalle)
+	}
+	return fmt.Errorf("Error PAC (HTTP %d): %s", estatus, detalle)
+}
+
+// valoresXML devuelve el texto del primer elemento con cada nombre local, sin importar el prefijo
+func valoresXML(documento []byte, nombres ...string) map[string]string {
+	buscados := make(map[string]bool, len(nombres))
+	for _, n := range nombres {
+		buscados[n] = true
+	}
+	valores := make(map[string]string, len(nombres))
+
+	decoder := xml.NewDecoder(bytes.NewReader(documento))
+	var actual string
+	var texto strings.Builder
+	for {
+		tok, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if _, visto := valores[t.Name.Local]; buscados[t.Name.Local] && !visto && actual == "" {
+				actual = t.Name.Local
+				texto.Reset()
+			}
+		case xml.CharData:
+			if actual != "" {
+				texto.Write(t)
+			}
+		case xml.EndElement:
+			if t.Name.Local == actual {
+				valores[actual] = strings.TrimSpace(texto.String())
+				actual = ""
+			}
+		}
+	}
+	return valores
+}
+
+// escaparXML escapa un valor para insertarlo en un sobre SOAP
+func escaparXML(valor string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(valor))
+	return buf.String()
+}
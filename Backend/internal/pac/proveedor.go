@@ -0,0 +1,162 @@
+package pac
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"Facts/internal/secretos"
+)
+
+// ProveedorPorDefecto se usa cuando el emisor no tiene un PAC configurado
+const ProveedorPorDefecto = "solucion_factible"
+
+// codigoTimbreDuplicado es el código del SAT para un CFDI que ya fue timbrado
+const codigoTimbreDuplicado = "307"
+
+var (
+	// ErrProveedorDesconocido indica que no hay un PAC registrado con ese nombre
+	ErrProveedorDesconocido = errors.New("proveedor PAC no registrado")
+	// ErrCredencialesIncompletas indica que faltan usuario o contraseña del PAC
+	ErrCredencialesIncompletas = errors.New("configuración de PAC incompleta: se requieren usuario y contraseña")
+	// ErrPACNoDisponible indica una falla de red, timeout o error 5xx; la solicitud puede reintentarse
+	ErrPACNoDisponible = errors.New("PAC no disponible")
+	// ErrTimbreDuplicado indica que el PAC ya timbró ese XML (código 307 del SAT)
+	ErrTimbreDuplicado = errors.New("el CFDI contiene un timbre previamente")
+)
+
+// PACProvider es la interfaz común de los proveedores autorizados de certificación
+type PACProvider interface {
+	Nombre() string
+	// Timbrar envía el CFDI sellado y devuelve el XML con el TimbreFiscalDigital
+	Timbrar(xmlFirmado []byte) ([]byte, error)
+	Cancelar(solicitud SolicitudCancelacion) (*ResultadoCancelacion, error)
+	ConsultarEstado(consulta ConsultaEstado) (*EstadoCFDI, error)
+	// Saldo devuelve los timbres disponibles en la cuenta
+	Saldo() (int, error)
+}
+
+// Recuperador lo implementan los PAC que pueden devolver el XML timbrado previamente
+// para un CFDI que ya habían timbrado (respuesta perdida o reenvío con código 307)
+type Recuperador interface {
+	Recuperar(xmlFirmado []byte) ([]byte, error)
+}
+
+// EsTransitorio indica si el error justifica reintentar la misma solicitud
+func EsTransitorio(err error) bool {
+	return errors.Is(err, ErrPACNoDisponible)
+}
+
+// Config son las credenciales y el ambiente de un PAC para un emisor
+type Config struct {
+	Proveedor  string        `json:"proveedor"`
+	RFC        string        `json:"rfc"` // RFC del emisor; algunos PAC lo piden para cancelar o consultar saldo
+	Usuario    string        `json:"usuario"`
+	Contrasena string        `json:"-"`
+	Produccion bool          `json:"produccion"`
+	URL        string        `json:"url,omitempty"` // Opcional; reemplaza la URL base del proveedor
+	Timeout    time.Duration `json:"-"`             // Opcional; por defecto 90 segundos
+}
+
+// SolicitudCancelacion son los datos para cancelar un CFDI ante el SAT a través del PAC
+type SolicitudCancelacion struct {
+	RFCEmisor        string
+	UUID             string
+	Motivo           string // c_MotivoCancelacion: 01, 02, 03 o 04
+	FolioSustitucion string // Solo con motivo 01
+	Certificado      []byte // .cer del CSD (DER)
+	// El .key original del SAT, cifrado con ClaveLlave; la llave descifrada nunca sale del backend
+	LlaveCifrada []byte
+	ClaveLlave   string
+}
+
+// ResultadoCancelacion es la respuesta del PAC a una solicitud de cancelación
+type ResultadoCancelacion struct {
+	UUID               string `json:"uuid"`
+	CodigoEstatus      string `json:"codigo_estatus"`
+	EstatusCancelacion string `json:"estatus_cancelacion"`
+	Acuse              []byte `json:"acuse,omitempty"`
+}
+
+// ConsultaEstado son los datos de la expresión impresa para consultar un CFDI en el SAT
+type ConsultaEstado struct {
+	RFCEmisor   string
+	RFCReceptor string
+	Total       string
+	UUID        string
+}
+
+// EstadoCFDI es el estado de un CFDI según el SAT
+type EstadoCFDI struct {
+	CodigoEstatus      string `json:"codigo_estatus"`
+	Estado             string `json:"estado"` // Vigente, Cancelado o No Encontrado
+	EsCancelable       string `json:"es_cancelable"`
+	EstatusCancelacion string `json:"estatus_cancelacion"`
+	ValidacionEFOS     string `json:"validacion_efos,omitempty"` // Solo la consulta directa al SAT
+}
+
+// Fabrica crea un proveedor a partir de su configuración
+type Fabrica func(cfg Config) (PACProvider, error)
+
+var (
+	registroMu sync.RWMutex
+	registro   = map[string]Fabrica{}
+)
+
+// Registrar da de alta un proveedor; las implementaciones se registran en su init
+func Registrar(nombre string, fabrica Fabrica) {
+	registroMu.Lock()
+	defer registroMu.Unlock()
+	registro[strings.ToLower(nombre)] = fabrica
+}
+
+// Disponibles lista los proveedores registrados
+func Disponibles() []string {
+	registroMu.RLock()
+	defer registroMu.RUnlock()
+	nombres := make([]string, 0, len(registro))
+	for nombre := range registro {
+		nombres = append(nombres, nombre)
+	}
+	sort.Strings(nombres)
+	return nombres
+}
+
+// Nuevo crea el proveedor indicado en la configuración; abre la contraseña si viene sellada
+func Nuevo(cfg Config) (PACProvider, error) {
+	nombre := strings.ToLower(strings.TrimSpace(cfg.Proveedor))
+	if nombre == "" {
+		nombre = ProveedorPorDefecto
+	}
+	registroMu.RLock()
+	fabrica, ok := registro[nombre]
+	registroMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrProveedorDesconocido, nombre)
+	}
+	if cfg.Usuario == "" || cfg.Contrasena == "" {
+		return nil, ErrCredencialesIncompletas
+	}
+	// La contraseña guardada llega sellada y solo se abre para el cliente del proveedor
+	contrasena, err := secretos.AbrirContrasenaPAC(cfg.Contrasena, cfg.RFC)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Contrasena = contrasena
+	cfg.Proveedor = nombre
+	return fabrica(cfg)
+}
+
+// urlBase elige la URL configurada o la del ambiente (producción o pruebas)
+func urlBase(cfg Config, produccion, pruebas string) string {
+	if cfg.URL != "" {
+		return strings.TrimSuffix(cfg.URL, "/")
+	}
+	if cfg.Produccion {
+		return produccion
+	}
+	return pruebas
+}
@@ -0,0 +1,333 @@
+package simulado
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	"Facts/internal/pac"
+)
+
+// ServeHTTP atiende las rutas REST de Solución Factible, los servicios SOAP de Finkok, la consulta
+// de estado del SAT (ConsultaCFDIService.svc) y /simulacion para programar fallas (POST) o quitarlas (DELETE)
+func (s *Servidor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/simulacion") {
+		s.manejarSimulacion(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sim := s.tomarSimulacion()
+	if sim != nil && !esperar(w, r, sim) {
+		return
+	}
+
+	cuerpo, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Para perder la respuesta se atiende la solicitud contra un recorder y luego se corta la conexión
+	destino := w
+	if sim != nil && sim.PerderRespuesta {
+		destino = httptest.NewRecorder()
+		defer colgar(w)
+	}
+
+	ruta := r.URL.Path[strings.LastIndex(r.URL.Path, "/"):]
+	switch ruta {
+	case "/timbrado", "/cancelacion", "/consulta", "/creditos":
+		s.atenderREST(destino, ruta, cuerpo, sim)
+	case "/stamp.wsdl", "/cancel.wsdl", "/registration.wsdl":
+		s.atenderSOAP(destino, r.Header.Get("SOAPAction"), cuerpo, sim)
+	case "/ConsultaCFDIService.svc":
+		s.atenderConsultaSAT(destino, cuerpo, sim)
+	default:
+		http.NotFound(destino, r)
+	}
+}
+
+// colgar cierra la conexión sin enviar respuesta
+func colgar(w http.ResponseWriter) {
+	if hj, ok := w.(http.Hijacker); ok {
+		if conn, _, err := hj.Hijack(); err == nil {
+			conn.Close()
+		}
+	}
+}
+
+// esperar aplica el retraso o el corte de conexión; devuelve false si ya no se debe responder
+func esperar(w http.ResponseWriter, r *http.Request, sim *Simulacion) bool {
+	if sim.Retraso > 0 {
+		select {
+		case <-time.After(sim.Retraso):
+		case <-r.Context().Done():
+			return false
+		}
+	}
+	if sim.Colgar {
+		colgar(w)
+		return false
+	}
+	return true
+}
+
+func (s *Servidor) manejarSimulacion(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		var sim Simulacion
+		if err := json.NewDecoder(r.Body).Decode(&sim); err != nil {
+			http.Error(w, "Simulación inválida: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.Simular(&sim)
+	case http.MethodDelete:
+		s.Simular(nil)
+	default:
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "success"})
+}
+
+// solicitudREST reúne los campos que envía el cliente de Solución Factible
+type solicitudREST struct {
+	Usuario     string `json:"usuario"`
+	Password    string `json:"password"`
+	CFDI        string `json:"cfdi"`
+	RFCEmisor   string `json:"rfcEmisor"`
+	RFCReceptor string `json:"rfcReceptor"`
+	UUID        string `json:"uuid"`
+}
+
+func (s *Servidor) atenderREST(w http.ResponseWriter, ruta string, cuerpo []byte, sim *Simulacion) {
+	var sol solicitudREST
+	var errPAC *errorPAC
+	respuesta := map[string]interface{}{"status": "200"}
+
+	if err := json.Unmarshal(cuerpo, &sol); err != nil {
+		errPAC = &errorPAC{codigo: CodigoXMLInvalido, mensaje: err.Error()}
+	} else if !s.credencialesValidas(sol.Usuario, sol.Password) {
+		errPAC = nuevoErrorPAC(CodigoAutenticacion)
+	} else if sim != nil && sim.CodigoError != "" {
+		errPAC = nuevoErrorPAC(sim.CodigoError)
+	}
+
+	if errPAC == nil {
+		switch ruta {
+		case "/timbrado":
+			xmlFirmado, err := base64.StdEncoding.DecodeString(sol.CFDI)
+			if err != nil {
+				errPAC = &errorPAC{codigo: CodigoXMLInvalido, mensaje: "cfdi no está en base64"}
+				break
+			}
+			xmlTimbrado, errTimbrado := s.timbrar(xmlFirmado)
+			if errTimbrado != nil && errTimbrado.codigo == CodigoTimbreDuplicado {
+				// Como Solución Factible, el duplicado se responde con 307 y el CFDI timbrado antes
+				xmlTimbrado, _ = s.recuperar(xmlFirmado)
+				respuesta["status"] = CodigoTimbreDuplicado
+				respuesta["mensaje"] = errTimbrado.Error()
+			} else {
+				errPAC = errTimbrado
+			}
+			if errPAC == nil {
+				respuesta["cfdi"] = base64.StdEncoding.EncodeToString(xmlTimbrado)
+			}
+		case "/cancelacion":
+			if errPAC = s.cancelar(sol.RFCEmisor, sol.UUID); errPAC == nil {
+				respuesta["status"] = "201"
+				respuesta["estatusCancelacion"] = "Cancelado sin aceptación"
+				respuesta["acuse"] = base64.StdEncoding.EncodeToString(acuseCancelacion(sol.RFCEmisor, sol.UUID))
+			}
+		case "/consulta":
+			estado := s.consultar(sol.UUID)
+			respuesta["codigoEstatus"] = estado.CodigoEstatus
+			respuesta["estado"] = estado.Estado
+			respuesta["esCancelable"] = estado.EsCancelable
+			respuesta["estatusCancelacion"] = estado.EstatusCancelacion
+		case "/creditos":
+			respuesta["creditos"] = s.saldo()
+		}
+	}
+
+	if errPAC != nil {
+		// El cliente de cancelación reconoce el error porque no viene status
+		respuesta = map[string]interface{}{"mensaje": errPAC.Error()}
+		if ruta != "/cancelacion" {
+			respuesta["status"] = errPAC.codigo
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(respuesta)
+}
+
+func (s *Servidor) atenderSOAP(w http.ResponseWriter, accion string, cuerpo []byte, sim *Simulacion) {
+	valores, atributos := leerSOAP(cuerpo)
+	usuario, contrasena := valores["username"], valores["password"]
+	if strings.HasSuffix(accion, "/get") {
+		usuario, contrasena = valores["reseller_username"], valores["reseller_password"]
+	}
+
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	if !s.credencialesValidas(usuario, contrasena) {
+		escribirFault(w, nuevoErrorPAC(CodigoAutenticacion))
+		return
+	}
+	var errSimulado *errorPAC
+	if sim != nil && sim.CodigoError != "" {
+		errSimulado = nuevoErrorPAC(sim.CodigoError)
+	}
+
+	var resultado string
+	switch {
+	case strings.HasSuffix(accion, "/stamp"), strings.HasSuffix(accion, "/stamped"):
+		operacion := accion[strings.LastIndex(accion, "/")+1:]
+		var xmlTimbrado []byte
+		errPAC := errSimulado
+		if errPAC == nil {
+			xmlFirmado, err := base64.StdEncoding.DecodeString(valores["xml"])
+			switch {
+			case err != nil:
+				errPAC = &errorPAC{codigo: CodigoXMLInvalido, mensaje: "xml no está en base64"}
+			case operacion == "stamped":
+				xmlTimbrado, errPAC = s.recuperar(xmlFirmado)
+			default:
+				xmlTimbrado, errPAC = s.timbrar(xmlFirmado)
+			}
+		}
+		if errPAC != nil {
+			resultado = fmt.Sprintf("<Incidencias><Incidencia><CodigoError>%s</CodigoError><MensajeIncidencia>%s</MensajeIncidencia></Incidencia></Incidencias>",
+				escapar(errPAC.codigo), escapar(errPAC.mensaje))
+		} else {
+			resultado = "<xml>" + escapar(string(xmlTimbrado)) + "</xml>"
+		}
+		escribirSOAP(w, operacion, resultado)
+
+	case strings.HasSuffix(accion, "/cancel"):
+		uuid := atributos["UUID"]
+		errPAC := errSimulado
+		if errPAC == nil {
+			errPAC = s.cancelar(valores["taxpayer_id"], uuid)
+		}
+		if errPAC != nil {
+			resultado = "<CodEstatus>" + escapar(errPAC.Error()) + "</CodEstatus>"
+		} else {
+			resultado = fmt.Sprintf("<Folios><Folio><EstatusUUID>201</EstatusUUID><EstatusCancelacion>Cancelado sin aceptación</EstatusCancelacion><UUID>%s</UUID></Folio></Folios><Acuse>%s</Acuse>",
+				escapar(uuid), escapar(string(acuseCancelacion(valores["taxpayer_id"], uuid))))
+		}
+		escribirSOAP(w, "cancel", resultado)
+
+	case strings.HasSuffix(accion, "/get_sat_status"):
+		if errSimulado != nil {
+			escribirSOAP(w, "get_sat_status", "<error>"+escapar(errSimulado.Error())+"</error>")
+			return
+		}
+		estado := s.consultar(valores["uuid"])
+		escribirSOAP(w, "get_sat_status", fmt.Sprintf(
+			"<sat><CodigoEstatus>%s</CodigoEstatus><Estado>%s</Estado><EsCancelable>%s</EsCancelable><EstatusCancelacion>%s</EstatusCancelacion></sat>",
+			escapar(estado.CodigoEstatus), escapar(estado.Estado), escapar(estado.EsCancelable), escapar(estado.EstatusCancelacion)))
+
+	case strings.HasSuffix(accion, "/get"):
+		if errSimulado != nil {
+			escribirSOAP(w, "get", "<message>"+escapar(errSimulado.Error())+"</message>")
+			return
+		}
+		escribirSOAP(w, "get", fmt.Sprintf("<users><ResellerUser><credit>%d</credit><taxpayer_id>%s</taxpayer_id></ResellerUser></users>",
+			s.saldo(), escapar(valores["taxpayer_id"])))
+
+	default:
+		escribirFault(w, &errorPAC{codigo: "Client", mensaje: "SOAPAction no soportada: " + accion})
+	}
+}
+
+// atenderConsultaSAT responde la operación Consulta del SAT a partir de la expresión impresa
+func (s *Servidor) atenderConsultaSAT(w http.ResponseWriter, cuerpo []byte, sim *Simulacion) {
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	if sim != nil && sim.CodigoError != "" {
+		escribirFault(w, nuevoErrorPAC(sim.CodigoError))
+		return
+	}
+	valores, _ := leerSOAP(cuerpo)
+	expresion, err := url.ParseQuery(strings.TrimPrefix(strings.TrimSpace(valores["expresionImpresa"]), "?"))
+	if err != nil {
+		expresion = url.Values{}
+	}
+	estado := pac.EstadoCFDI{CodigoEstatus: "N - 601: La expresión impresa proporcionada no es válida.", Estado: "No Encontrado"}
+	if expresion.Get("id") != "" {
+		estado = s.consultarExpresion(expresion.Get("re"), expresion.Get("rr"), expresion.Get("tt"), expresion.Get("id"))
+	}
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>`+
+		`<ConsultaResponse xmlns="http://tempuri.org/"><ConsultaResult xmlns:a="http://schemas.datacontract.org/2004/07/Sat.Cfdi.Negocio.ConsultaCfdi.Servicio">`+
+		`<a:CodigoEstatus>%s</a:CodigoEstatus><a:EsCancelable>%s</a:EsCancelable><a:Estado>%s</a:Estado>`+
+		`<a:EstatusCancelacion>%s</a:EstatusCancelacion><a:ValidacionEFOS>%s</a:ValidacionEFOS>`+
+		`</ConsultaResult></ConsultaResponse></s:Body></s:Envelope>`,
+		escapar(estado.CodigoEstatus), escapar(estado.EsCancelable), escapar(estado.Estado),
+		escapar(estado.EstatusCancelacion), escapar(estado.ValidacionEFOS))
+}
+
+// leerSOAP devuelve el texto de cada elemento y los atributos de todos los elementos por nombre local
+func leerSOAP(sobre []byte) (map[string]string, map[string]string) {
+	valores := map[string]string{}
+	atributos := map[string]string{}
+	decoder := xml.NewDecoder(bytes.NewReader(sobre))
+	var actual string
+	for {
+		tok, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			actual = t.Name.Local
+			for _, a := range t.Attr {
+				atributos[a.Name.Local] = a.Value
+			}
+		case xml.CharData:
+			if actual != "" {
+				valores[actual] += string(t)
+			}
+		case xml.EndElement:
+			actual = ""
+		}
+	}
+	return valores, atributos
+}
+
+func escribirSOAP(w http.ResponseWriter, operacion, resultado string) {
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><senv:Envelope xmlns:senv="http://schemas.xmlsoap.org/soap/envelope/" xmlns:tns="apps.services.soap.core.views">`+
+		`<senv:Body><tns:%sResponse><tns:%sResult>%s</tns:%sResult></tns:%sResponse></senv:Body></senv:Envelope>`,
+		operacion, operacion, resultado, operacion, operacion)
+}
+
+func escribirFault(w http.ResponseWriter, errPAC *errorPAC) {
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><senv:Envelope xmlns:senv="http://schemas.xmlsoap.org/soap/envelope/">`+
+		`<senv:Body><senv:Fault><faultcode>senv:Client</faultcode><faultstring>%s</faultstring></senv:Fault></senv:Body></senv:Envelope>`,
+		escapar(errPAC.Error()))
+}
+
+// acuseCancelacion es un acuse mínimo con la estructura del que entrega el SAT
+func acuseCancelacion(rfcEmisor, uuid string) []byte {
+	return []byte(fmt.Sprintf(
+		`<Acuse xmlns="http://cancelacfd.sat.gob.mx" Fecha="%s" RfcEmisor="%s"><Folios><UUID>%s</UUID><EstatusUUID>201</EstatusUUID></Folios></Acuse>`,
+		time.Now().Format("2006-01-02T15:04:05"), escapar(rfcEmisor), escapar(uuid)))
+}
+
+func escapar(valor string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(valor))
+	return buf.String()
+}
@@ -0,0 +1,350 @@
+// Package simulado es un PAC falso que habla los mismos protocolos que el paquete pac
+// (REST de Solución Factible y SOAP de Finkok). Valida el sello del CFDI contra el
+// certificado incluido y devuelve el XML con un TimbreFiscalDigital firmado con un
+// certificado SAT de prueba generado al iniciar. Sirve para pruebas con httptest y
+// para demostrar el timbrado en local sin gastar timbres.
+package simulado
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"math"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"Facts/internal/pac"
+	"Facts/internal/services"
+)
+
+// RfcProvCertif es el RFC del PAC de pruebas del SAT que aparece en los timbres
+const RfcProvCertif = "SPR190613I52"
+
+// Códigos de error que devuelve el simulador, tomados de la matriz de errores del SAT
+const (
+	CodigoXMLInvalido     = "301"
+	CodigoSelloInvalido   = "302"
+	CodigoTimbreDuplicado = "307"
+	CodigoSinCreditos     = "401"
+	CodigoUUIDNoExiste    = "205"
+	CodigoNoTimbrado      = "603"
+	CodigoAutenticacion   = "AUTH"
+)
+
+var mensajesError = map[string]string{
+	CodigoXMLInvalido:     "XML mal formado",
+	CodigoSelloInvalido:   "Sello mal formado o inválido",
+	CodigoTimbreDuplicado: "El CFDI contiene un timbre previamente",
+	CodigoSinCreditos:     "No hay timbres disponibles",
+	CodigoUUIDNoExiste:    "UUID no existe",
+	CodigoNoTimbrado:      "El CFDI no ha sido timbrado",
+	CodigoAutenticacion:   "Usuario o contraseña inválidos",
+}
+
+// Simulacion altera las siguientes respuestas del servidor
+type Simulacion struct {
+	CodigoError string        `json:"codigo_error,omitempty"` // Se devuelve este código en lugar de atender la solicitud
+	Retraso     time.Duration `json:"retraso,omitempty"`      // Espera antes de responder; mayor al timeout del cliente simula un timeout
+	Colgar      bool          `json:"colgar,omitempty"`       // Cierra la conexión sin responder
+	// PerderRespuesta atiende la solicitud (timbra) y después cierra la conexión sin responder
+	PerderRespuesta bool `json:"perder_respuesta,omitempty"`
+	Veces           int  `json:"veces,omitempty"` // Solicitudes afectadas; 0 aplica a todas
+}
+
+// registro es un CFDI timbrado por el simulador
+type registro struct {
+	xml         []byte
+	rfcEmisor   string
+	rfcReceptor string
+	total       string
+	cancelado   bool
+}
+
+// Servidor es el PAC simulado; implementa http.Handler
+type Servidor struct {
+	// Usuario y Contrasena vacíos aceptan cualquier credencial
+	Usuario    string
+	Contrasena string
+
+	llaveSAT         *rsa.PrivateKey
+	certificadoSAT   *x509.Certificate
+	noCertificadoSAT string
+
+	mu         sync.Mutex
+	simulacion *Simulacion
+	creditos   int
+	porUUID    map[string]*registro
+	porSello   map[string]string // Sello del CFDI -> UUID, para detectar duplicados
+}
+
+// Nuevo crea un servidor con un certificado SAT de prueba recién generado
+func Nuevo() (*Servidor, error) {
+	llave, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("error generando llave SAT de prueba: %w", err)
+	}
+	// El número de certificado del SAT son 20 dígitos, guardados como ASCII en el número de serie
+	noCertificado := fmt.Sprintf("3000100000%010d", time.Now().UnixNano()%1e10)
+	serie := new(big.Int).SetBytes([]byte(noCertificado))
+	plantilla := &x509.Certificate{
+		SerialNumber: serie,
+		Subject:      pkix.Name{CommonName: "SAT PAC SIMULADO", Organization: []string{"Servicio de Administración Tributaria"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(4, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, plantilla, plantilla, &llave.PublicKey, llave)
+	if err != nil {
+		return nil, fmt.Errorf("error generando certificado SAT de prueba: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &Servidor{
+		llaveSAT:         llave,
+		certificadoSAT:   cert,
+		noCertificadoSAT: noCertificado,
+		creditos:         1000,
+		porUUID:          map[string]*registro{},
+		porSello:         map[string]string{},
+	}, nil
+}
+
+// IniciarPrueba levanta el simulador en un httptest.Server; el llamador debe cerrar el servidor
+func IniciarPrueba() (*Servidor, *httptest.Server, error) {
+	s, err := Nuevo()
+	if err != nil {
+		return nil, nil, err
+	}
+	return s, httptest.NewServer(s), nil
+}
+
+// Escuchar levanta el simulador en addr (modo local para demostraciones)
+func Escuchar(addr string) error {
+	s, err := Nuevo()
+	if err != nil {
+		return err
+	}
+	log.Printf("[PAC_SIMULADO] Escuchando en %s; configura PAC_URL=http://localhost%s con cualquier PAC_USER y PAC_PASS"+
+		" y SAT_CONSULTA_URL=http://localhost%s/ConsultaCFDIService.svc", addr, addr, addr)
+	return http.ListenAndServe(addr, s)
+}
+
+// Config devuelve la configuración para usar el simulador con el dialecto del proveedor indicado
+func (s *Servidor) Config(proveedor, url string) pac.Config {
+	usuario, contrasena := s.Usuario, s.Contrasena
+	if usuario == "" {
+		usuario, contrasena = "simulado", "simulado"
+	}
+	return pac.Config{Proveedor: proveedor, Usuario: usuario, Contrasena: contrasena, URL: url}
+}
+
+// ConsultaSAT devuelve un cliente de consulta del SAT que apunta al simulador en url (sin caché)
+func (s *Servidor) ConsultaSAT(url string) *pac.ConsultaCFDIService {
+	return pac.NuevoConsultaCFDIService(url+"/ConsultaCFDIService.svc", 0)
+}
+
+// CertificadoSAT es el certificado con el que se firman los SelloSAT
+func (s *Servidor) CertificadoSAT() *x509.Certificate {
+	return s.certificadoSAT
+}
+
+// Simular programa una falla para las siguientes solicitudes; nil la quita
+func (s *Servidor) Simular(sim *Simulacion) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.simulacion = sim
+}
+
+// tomarSimulacion devuelve la simulación vigente y descuenta una aplicación
+func (s *Servidor) tomarSimulacion() *Simulacion {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sim := s.simulacion
+	if sim == nil {
+		return nil
+	}
+	if sim.Veces > 0 {
+		sim.Veces--
+		if sim.Veces == 0 {
+			s.simulacion = nil
+		}
+	}
+	copia := *sim
+	return &copia
+}
+
+// credencialesValidas revisa usuario y contraseña cuando el servidor los tiene configurados
+func (s *Servidor) credencialesValidas(usuario, contrasena string) bool {
+	return s.Usuario == "" || (usuario == s.Usuario && contrasena == s.Contrasena)
+}
+
+// errorPAC es una respuesta de error con código del SAT
+type errorPAC struct {
+	codigo  string
+	mensaje string
+}
+
+func (e *errorPAC) Error() string { return e.codigo + " - " + e.mensaje }
+
+func nuevoErrorPAC(codigo string) *errorPAC {
+	mensaje, ok := mensajesError[codigo]
+	if !ok {
+		mensaje = "Error simulado"
+	}
+	return &errorPAC{codigo: codigo, mensaje: mensaje}
+}
+
+// timbrar valida el CFDI sellado y le agrega el TimbreFiscalDigital
+func (s *Servidor) timbrar(xmlFirmado []byte) ([]byte, *errorPAC) {
+	comprobante, err := services.LeerComprobante(xmlFirmado)
+	if err != nil {
+		return nil, &errorPAC{codigo: CodigoXMLInvalido, mensaje: err.Error()}
+	}
+	if err := services.VerificarSello(comprobante); err != nil {
+		return nil, &errorPAC{codigo: CodigoSelloInvalido, mensaje: err.Error()}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, duplicado := s.porSello[comprobante.Sello]; duplicado {
+		return nil, nuevoErrorPAC(CodigoTimbreDuplicado)
+	}
+	if s.creditos <= 0 {
+		return nil, nuevoErrorPAC(CodigoSinCreditos)
+	}
+
+	timbre := services.TimbreFiscalDigital{
+		Version:          "1.1",
+		UUID:             nuevoUUID(),
+		FechaTimbrado:    time.Now().Format("2006-01-02T15:04:05"),
+		RfcProvCertif:    RfcProvCertif,
+		SelloCFD:         comprobante.Sello,
+		NoCertificadoSAT: s.noCertificadoSAT,
+	}
+	hash := sha256.Sum256([]byte(services.GenerarCadenaOriginalTFD(timbre)))
+	firma, err := rsa.SignPKCS1v15(rand.Reader, s.llaveSAT, crypto.SHA256, hash[:])
+	if err != nil {
+		return nil, &errorPAC{codigo: "500", mensaje: err.Error()}
+	}
+	timbre.SelloSAT = base64.StdEncoding.EncodeToString(firma)
+
+	xmlTimbrado := insertarTimbre(xmlFirmado, timbre)
+	s.creditos--
+	s.porSello[comprobante.Sello] = timbre.UUID
+	s.porUUID[timbre.UUID] = &registro{
+		xml:         xmlTimbrado,
+		rfcEmisor:   comprobante.Emisor.Rfc,
+		rfcReceptor: comprobante.Receptor.Rfc,
+		total:       comprobante.Total,
+	}
+	log.Printf("[PAC_SIMULADO] CFDI %s%s timbrado con UUID %s", comprobante.Serie, comprobante.Folio, timbre.UUID)
+	return xmlTimbrado, nil
+}
+
+// recuperar devuelve el XML timbrado antes para el mismo CFDI sellado
+func (s *Servidor) recuperar(xmlFirmado []byte) ([]byte, *errorPAC) {
+	comprobante, err := services.LeerComprobante(xmlFirmado)
+	if err != nil {
+		return nil, &errorPAC{codigo: CodigoXMLInvalido, mensaje: err.Error()}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uuid, ok := s.porSello[comprobante.Sello]
+	if !ok {
+		return nil, nuevoErrorPAC(CodigoNoTimbrado)
+	}
+	return s.porUUID[uuid].xml, nil
+}
+
+// cancelar marca el UUID como cancelado
+func (s *Servidor) cancelar(rfcEmisor, uuid string) *errorPAC {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reg, ok := s.porUUID[strings.ToUpper(uuid)]
+	if !ok || !strings.EqualFold(reg.rfcEmisor, rfcEmisor) {
+		return nuevoErrorPAC(CodigoUUIDNoExiste)
+	}
+	reg.cancelado = true
+	return nil
+}
+
+// consultar devuelve el estado como lo reportaría el servicio de consulta del SAT
+func (s *Servidor) consultar(uuid string) pac.EstadoCFDI {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reg, ok := s.porUUID[strings.ToUpper(uuid)]
+	switch {
+	case !ok:
+		return pac.EstadoCFDI{CodigoEstatus: "N - 602: Comprobante no encontrado.", Estado: "No Encontrado"}
+	case reg.cancelado:
+		return pac.EstadoCFDI{CodigoEstatus: "S - Comprobante obtenido satisfactoriamente.", Estado: "Cancelado", EsCancelable: "No cancelable", EstatusCancelacion: "Cancelado sin aceptación"}
+	default:
+		return pac.EstadoCFDI{CodigoEstatus: "S - Comprobante obtenido satisfactoriamente.", Estado: "Vigente", EsCancelable: "Cancelable sin aceptación"}
+	}
+}
+
+// consultarExpresion atiende la consulta del SAT: el CFDI solo se encuentra si emisor, receptor y total coinciden
+func (s *Servidor) consultarExpresion(re, rr, tt, uuid string) pac.EstadoCFDI {
+	noEncontrado := pac.EstadoCFDI{CodigoEstatus: "N - 602: Comprobante no encontrado.", Estado: "No Encontrado"}
+	s.mu.Lock()
+	reg, ok := s.porUUID[strings.ToUpper(uuid)]
+	s.mu.Unlock()
+	if !ok || !strings.EqualFold(reg.rfcEmisor, re) || !strings.EqualFold(reg.rfcReceptor, rr) {
+		return noEncontrado
+	}
+	total, err1 := strconv.ParseFloat(tt, 64)
+	esperado, err2 := strconv.ParseFloat(reg.total, 64)
+	if err1 != nil || err2 != nil || math.Abs(total-esperado) > 0.005 {
+		return noEncontrado
+	}
+	estado := s.consultar(uuid)
+	estado.ValidacionEFOS = "200"
+	return estado
+}
+
+func (s *Servidor) saldo() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.creditos
+}
+
+// insertarTimbre agrega el TimbreFiscalDigital dentro de cfdi:Complemento
+func insertarTimbre(xmlFirmado []byte, timbre services.TimbreFiscalDigital) []byte {
+	tfd := fmt.Sprintf(
+		`<tfd:TimbreFiscalDigital xmlns:tfd="http://www.sat.gob.mx/TimbreFiscalDigital" `+
+			`xsi:schemaLocation="http://www.sat.gob.mx/TimbreFiscalDigital http://www.sat.gob.mx/sitio_internet/cfd/TimbreFiscalDigital/TimbreFiscalDigitalv11.xsd" `+
+			`Version="%s" UUID="%s" FechaTimbrado="%s" RfcProvCertif="%s" SelloCFD="%s" NoCertificadoSAT="%s" SelloSAT="%s"/>`,
+		timbre.Version, timbre.UUID, timbre.FechaTimbrado, timbre.RfcProvCertif, timbre.SelloCFD, timbre.NoCertificadoSAT, timbre.SelloSAT,
+	)
+	xmlTexto := string(xmlFirmado)
+	if i := strings.LastIndex(xmlTexto, "</cfdi:Complemento>"); i >= 0 {
+		return []byte(xmlTexto[:i] + tfd + xmlTexto[i:])
+	}
+	i := strings.LastIndex(xmlTexto, "</cfdi:Comprobante>")
+	if i < 0 {
+		return xmlFirmado
+	}
+	return []byte(xmlTexto[:i] + "<cfdi:Complemento>" + tfd + "</cfdi:Complemento>" + xmlTexto[i:])
+}
+
+// nuevoUUID genera un UUID versión 4 en mayúsculas, como los que asigna el SAT
+func nuevoUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return strings.ToUpper(fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]))
+}
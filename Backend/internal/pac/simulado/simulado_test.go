@@ -0,0 +1,200 @@
+package simulado
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"Facts/internal/models"
+	"Facts/internal/pac"
+	"Facts/internal/services"
+)
+
+// CSD de pruebas publicado por el SAT (EKU9003173C9)
+const (
+	cerPrueba   = "../../../certificados/ABC123456DE7_cer.cer"
+	keyPrueba   = "../../../certificados/ABC123456DE7_key.key"
+	clavePrueba = "12345678a"
+)
+
+// proveedores son los dialectos que habla el simulador
+var proveedores = []string{"solucion_factible", "finkok"}
+
+// cfdiSellado sella con el CSD de pruebas un CFDI con el folio indicado
+func cfdiSellado(t *testing.T, folio string) []byte {
+	t.Helper()
+	factura := models.Factura{
+		CerPath:               cerPrueba,
+		Serie:                 "A",
+		NumeroFolio:           folio,
+		FechaEmision:          time.Now().Add(-time.Minute).Format("2006-01-02T15:04:05"),
+		FormaPago:             "01",
+		MetodoPago:            "PUE",
+		Moneda:                "MXN",
+		EmisorRFC:             "EKU9003173C9",
+		EmisorRazonSocial:     "ESCUELA KEMPER URGATE",
+		EmisorRegimenFiscal:   "601",
+		EmisorCodigoPostal:    "42501",
+		ReceptorRFC:           "URE180429TM6",
+		ReceptorRazonSocial:   "UNIVERSIDAD ROBOTICA ESPAÑOLA",
+		ReceptorCodigoPostal:  "86991",
+		RegimenFiscalReceptor: "601",
+		UsoCFDI:               "G01",
+		Conceptos: []models.Concepto{{
+			ClaveProdServ: "01010101",
+			ClaveUnidad:   "H87",
+			Descripcion:   "Producto de prueba",
+			Cantidad:      1,
+			ValorUnitario: 100,
+			TasaIVA:       16,
+		}},
+	}
+	services.CalcularTotales(&factura)
+	xmlSellado, err := services.ProcesarKeyYGenerarCFDI(factura, keyPrueba, clavePrueba)
+	if err != nil {
+		t.Fatalf("error al sellar el CFDI de prueba: %v", err)
+	}
+	return xmlSellado
+}
+
+// nuevoProveedor levanta un simulador y crea el cliente del proveedor apuntando a él
+func nuevoProveedor(t *testing.T, nombre string, timeout time.Duration) (*Servidor, pac.PACProvider) {
+	t.Helper()
+	s, ts, err := IniciarPrueba()
+	if err != nil {
+		t.Fatalf("error al iniciar el simulador: %v", err)
+	}
+	t.Cleanup(ts.Close)
+	cfg := s.Config(nombre, ts.URL)
+	cfg.RFC = "EKU9003173C9"
+	cfg.Timeout = timeout
+	proveedor, err := pac.Nuevo(cfg)
+	if err != nil {
+		t.Fatalf("error al crear el proveedor %s: %v", nombre, err)
+	}
+	return s, proveedor
+}
+
+// TestTimbrarCicloCompleto timbra, detecta el duplicado, recupera, consulta y cancela con cada dialecto
+func TestTimbrarCicloCompleto(t *testing.T) {
+	for _, nombre := range proveedores {
+		t.Run(nombre, func(t *testing.T) {
+			s, proveedor := nuevoProveedor(t, nombre, 0)
+			xmlSellado := cfdiSellado(t, "1")
+
+			xmlTimbrado, err := proveedor.Timbrar(xmlSellado)
+			if err != nil {
+				t.Fatalf("error al timbrar: %v", err)
+			}
+			timbre, err := services.ExtraerTimbreFiscalDigital(xmlTimbrado)
+			if err != nil {
+				t.Fatalf("el XML timbrado no tiene TimbreFiscalDigital: %v", err)
+			}
+			if timbre.RfcProvCertif != RfcProvCertif || timbre.NoCertificadoSAT == "" || timbre.SelloCFD == "" {
+				t.Fatalf("timbre incompleto: %+v", timbre)
+			}
+
+			// El SelloSAT se verifica con el certificado del simulador sobre la cadena original del TFD
+			firma, err := base64.StdEncoding.DecodeString(timbre.SelloSAT)
+			if err != nil {
+				t.Fatalf("SelloSAT no es base64: %v", err)
+			}
+			digesto := sha256.Sum256([]byte(services.GenerarCadenaOriginalTFD(*timbre)))
+			publica := s.CertificadoSAT().PublicKey.(*rsa.PublicKey)
+			if err := rsa.VerifyPKCS1v15(publica, crypto.SHA256, digesto[:], firma); err != nil {
+				t.Fatalf("SelloSAT inválido: %v", err)
+			}
+
+			if _, err := proveedor.Timbrar(xmlSellado); !errors.Is(err, pac.ErrTimbreDuplicado) {
+				t.Errorf("el segundo timbrado debía ser duplicado, se obtuvo %v", err)
+			}
+			recuperado, err := proveedor.(pac.Recuperador).Recuperar(xmlSellado)
+			if err != nil || string(recuperado) != string(xmlTimbrado) {
+				t.Errorf("Recuperar devolvió otro XML (err %v)", err)
+			}
+
+			consulta := pac.ConsultaEstado{RFCEmisor: "EKU9003173C9", RFCReceptor: "URE180429TM6", Total: "116.00", UUID: timbre.UUID}
+			estado, err := proveedor.ConsultarEstado(consulta)
+			if err != nil || estado.Estado != "Vigente" {
+				t.Fatalf("estado antes de cancelar: %+v, %v", estado, err)
+			}
+			emisor := models.Factura{EmisorRFC: "EKU9003173C9", CerPath: cerPrueba, KeyPath: keyPrueba, ClaveCSD: clavePrueba}
+			solicitud, err := services.SolicitudCancelacionCSD(emisor, timbre.UUID, "02", "")
+			if err != nil {
+				t.Fatalf("error al armar la solicitud de cancelación: %v", err)
+			}
+			resultado, err := proveedor.Cancelar(solicitud)
+			if err != nil || resultado.CodigoEstatus != "201" || len(resultado.Acuse) == 0 {
+				t.Fatalf("cancelación: %+v, %v", resultado, err)
+			}
+			if estado, err = proveedor.ConsultarEstado(consulta); err != nil || estado.Estado != "Cancelado" {
+				t.Errorf("estado después de cancelar: %+v, %v", estado, err)
+			}
+
+			saldo, err := proveedor.Saldo()
+			if err != nil || saldo != 999 {
+				t.Errorf("Saldo = %d, %v; se esperaba 999", saldo, err)
+			}
+		})
+	}
+}
+
+// TestTimbrarSelloInvalido rechaza un CFDI alterado después de sellarlo
+func TestTimbrarSelloInvalido(t *testing.T) {
+	for _, nombre := range proveedores {
+		t.Run(nombre, func(t *testing.T) {
+			_, proveedor := nuevoProveedor(t, nombre, 0)
+			alterado := strings.Replace(string(cfdiSellado(t, "2")), `Descripcion="Producto de prueba"`, `Descripcion="Producto alterado"`, 1)
+			_, err := proveedor.Timbrar([]byte(alterado))
+			if err == nil || pac.EsTransitorio(err) || !strings.Contains(err.Error(), CodigoSelloInvalido) {
+				t.Fatalf("se esperaba el error %s, se obtuvo %v", CodigoSelloInvalido, err)
+			}
+		})
+	}
+}
+
+// TestTimbrarFallasSimuladas revisa cómo llegan al cliente los errores del PAC y las fallas de red
+func TestTimbrarFallasSimuladas(t *testing.T) {
+	casos := []struct {
+		nombre      string
+		simulacion  Simulacion
+		transitorio bool
+		codigo      string
+	}{
+		{"sin creditos", Simulacion{CodigoError: CodigoSinCreditos, Veces: 1}, false, CodigoSinCreditos},
+		{"timeout", Simulacion{Retraso: time.Second, Veces: 1}, true, ""},
+		{"conexion cortada", Simulacion{Colgar: true, Veces: 1}, true, ""},
+	}
+	for _, nombre := range proveedores {
+		for i, c := range casos {
+			t.Run(nombre+"/"+c.nombre, func(t *testing.T) {
+				s, proveedor := nuevoProveedor(t, nombre, 300*time.Millisecond)
+				xmlSellado := cfdiSellado(t, strconv.Itoa(3+i))
+				sim := c.simulacion
+				s.Simular(&sim)
+
+				_, err := proveedor.Timbrar(xmlSellado)
+				if err == nil {
+					t.Fatalf("se esperaba error")
+				}
+				if pac.EsTransitorio(err) != c.transitorio {
+					t.Errorf("EsTransitorio(%v) = %t, se esperaba %t", err, !c.transitorio, c.transitorio)
+				}
+				if c.codigo != "" && !strings.Contains(err.Error(), c.codigo) {
+					t.Errorf("el error %v no tiene el código %s", err, c.codigo)
+				}
+
+				// La falla solo afecta una solicitud; la siguiente se timbra
+				if _, err := proveedor.Timbrar(xmlSellado); err != nil && !errors.Is(err, pac.ErrTimbreDuplicado) {
+					t.Errorf("el reintento falló: %v", err)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package pac
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// URLs base del API REST de Solución Factible
+const (
+	urlSolucionFactiblePruebas    = "https://demo-facturacion.solucionfactible.com/ws/rest"
+	urlSolucionFactibleProduccion = "https://solucionfactible.com/ws/rest"
+)
+
+func init() {
+	Registrar("solucion_factible", func(cfg Config) (PACProvider, error) {
+		return &solucionFactible{
+			cfg:     cfg,
+			url:     urlBase(cfg, urlSolucionFactibleProduccion, urlSolucionFactiblePruebas),
+			cliente: clientePara(cfg),
+		}, nil
+	})
+}
+
+// solucionFactible implementa el API REST (JSON) de Solución Factible
+type solucionFactible struct {
+	cfg     Config
+	url     string
+	cliente *http.Client
+}
+
+// respuestaSolucionFactible reúne los campos que devuelven las operaciones del API
+type respuestaSolucionFactible struct {
+	Status             string `json:"status"`
+	Mensaje            string `json:"mensaje"`
+	CFDI               string `json:"cfdi"`
+	Acuse              string `json:"acuse"`
+	EstatusCancelacion string `json:"estatusCancelacion"`
+	CodigoEstatus      string `json:"codigoEstatus"`
+	Estado             string `json:"estado"`
+	EsCancelable       string `json:"esCancelable"`
+	Creditos           int    `json:"creditos"`
+}
+
+func (s *solucionFactible) Nombre() string { return "solucion_factible" }
+
+func (s *solucionFactible) credenciales() map[string]interface{} {
+	return map[string]interface{}{
+		"usuario":  s.cfg.Usuario,
+		"password": s.cfg.Contrasena,
+	}
+}
+
+// solicitarTimbrado envía el CFDI a /timbrado; el mismo llamado sirve para recuperar un timbre previo
+func (s *solucionFactible) solicitarTimbrado(xmlFirmado []byte) (*respuestaSolucionFactible, error) {
+	payload := s.credenciales()
+	payload["produccion"] = "NO"
+	if s.cfg.Produccion {
+		payload["produccion"] = "SI"
+	}
+	payload["cfdi"] = base64.StdEncoding.EncodeToString(xmlFirmado)
+
+	var res respuestaSolucionFactible
+	if err := postJSON(s.cliente, s.url+"/timbrado", payload, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (s *solucionFactible) Timbrar(xmlFirmado []byte) ([]byte, error) {
+	res, err := s.solicitarTimbrado(xmlFirmado)
+	if err != nil {
+		return nil, err
+	}
+	if res.Status == codigoTimbreDuplicado {
+		return nil, fmt.Errorf("%w: %s", ErrTimbreDuplicado, res.Mensaje)
+	}
+	if res.CFDI == "" {
+		if res.Mensaje != "" {
+			return nil, errors.New("Error PAC: " + res.Mensaje)
+		}
+		return nil, errors.New("No se recibió XML timbrado del PAC")
+	}
+	return base64.StdEncoding.DecodeString(res.CFDI)
+}
+
+// Recuperar reenvía el CFDI: ante un duplicado Solución Factible responde 307 junto con el CFDI timbrado antes
+func (s *solucionFactible) Recuperar(xmlFirmado []byte) ([]byte, error) {
+	res, err := s.solicitarTimbrado(xmlFirmado)
+	if err != nil {
+		return nil, err
+	}
+	if res.CFDI == "" {
+		return nil, fmt.Errorf("el PAC no devolvió el CFDI timbrado previamente: %s", res.Mensaje)
+	}
+	return base64.StdEncoding.DecodeString(res.CFDI)
+}
+
+func (s *solucionFactible) Cancelar(solicitud SolicitudCancelacion) (*ResultadoCancelacion, error) {
+	payload := s.credenciales()
+	payload["rfcEmisor"] = solicitud.RFCEmisor
+	payload["uuid"] = solicitud.UUID
+	payload["motivo"] = solicitud.Motivo
+	payload["folioSustitucion"] = solicitud.FolioSustitucion
+	// Solución Factible recibe el CSD como lo emitió el SAT y lo abre con su contraseña
+	payload["cer"] = base64.StdEncoding.EncodeToString(solicitud.Certificado)
+	payload["key"] = base64.StdEncoding.EncodeToString(solicitud.LlaveCifrada)
+	payload["passwordCSD"] = solicitud.ClaveLlave
+
+	var res respuestaSolucionFactible
+	if err := postJSON(s.cliente, s.url+"/cancelacion", payload, &res); err != nil {
+		return nil, err
+	}
+	if res.Status == "" {
+		return nil, errors.New("Error PAC: " + res.Mensaje)
+	}
+	acuse, _ := base64.StdEncoding.DecodeString(res.Acuse)
+	return &ResultadoCancelacion{
+		UUID:               solicitud.UUID,
+		CodigoEstatus:      res.Status,
+		EstatusCancelacion: res.EstatusCancelacion,
+		Acuse:              acuse,
+	}, nil
+}
+
+func (s *solucionFactible) ConsultarEstado(consulta ConsultaEstado) (*EstadoCFDI, error) {
+	payload := s.credenciales()
+	payload["rfcEmisor"] = consulta.RFCEmisor
+	payload["rfcReceptor"] = consulta.RFCReceptor
+	payload["total"] = consulta.Total
+	payload["uuid"] = consulta.UUID
+
+	var res respuestaSolucionFactible
+	if err := postJSON(s.cliente, s.url+"/consulta", payload, &res); err != nil {
+		return nil, err
+	}
+	return &EstadoCFDI{
+		CodigoEstatus:      res.CodigoEstatus,
+		Estado:             res.Estado,
+		EsCancelable:       res.EsCancelable,
+		EstatusCancelacion: res.EstatusCancelacion,
+	}, nil
+}
+
+func (s *solucionFactible) Saldo() (int, error) {
+	var res respuestaSolucionFactible
+	if err := postJSON(s.cliente, s.url+"/creditos", s.credenciales(), &res); err != nil {
+		return 0, err
+	}
+	return res.Creditos, nil
+}
@@ -0,0 +1,335 @@
+package secretos
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"Facts/internal/utils"
+)
+
+// Tipos de secreto del CSD; el contexto del sobre es el tipo más la IdentidadCSD. Los sobres
+// anteriores se sellaron solo con el tipo y se aceptan hasta que RecifrarSecretosCSD los vuelve a sellar.
+const (
+	contextoLlaveCSD = "csd/key"
+	contextoClaveCSD = "csd/clave"
+)
+
+// IdentidadCSD es el emisor (su RFC) y el número del certificado al que pertenecen la llave y la
+// contraseña. Va en el contexto del sobre: un sobre copiado a otro emisor o a otro certificado no abre.
+type IdentidadCSD struct {
+	RFC           string
+	NoCertificado string
+}
+
+// IdentidadCertificado arma la identidad con el contenido del .cer
+func IdentidadCertificado(rfc string, cer []byte) (IdentidadCSD, error) {
+	cert, err := utils.LeerCertificadoCSD(cer)
+	if err != nil {
+		return IdentidadCSD{}, fmt.Errorf("el archivo .cer no es un certificado válido: %w", err)
+	}
+	return IdentidadCSD{RFC: rfc, NoCertificado: utils.NumeroCertificadoCSD(cert)}, nil
+}
+
+// IdentidadArchivoCertificado arma la identidad con el .cer guardado en disco
+func IdentidadArchivoCertificado(rfc, rutaCer string) (IdentidadCSD, error) {
+	cer, err := os.ReadFile(rutaCer)
+	if err != nil {
+		return IdentidadCSD{}, fmt.Errorf("no se pudo leer el archivo .cer en %s: %w", rutaCer, err)
+	}
+	return IdentidadCertificado(rfc, cer)
+}
+
+// contexto arma el contexto del sobre para el tipo de secreto ("csd/key" o "csd/clave")
+func (id IdentidadCSD) contexto(tipo string) (string, error) {
+	rfc := strings.ToUpper(strings.TrimSpace(id.RFC))
+	if rfc == "" || id.NoCertificado == "" {
+		return "", errors.New("se requieren el RFC del emisor y el número de certificado para sellar el CSD")
+	}
+	return tipo + ":" + rfc + ":" + id.NoCertificado, nil
+}
+
+// CSDGuardado son la llave y la contraseña ya registradas de un emisor; se usan para
+// completar la validación cuando solo se sube una parte del CSD
+type CSDGuardado struct {
+	RFC     string // RFC con el que se sellaron
+	RutaKey string
+	RutaCer string
+	Clave   string // contraseña sellada (o en claro si aún no se migra)
+}
+
+// GuardarLlaveCSD sella el archivo .key y lo escribe en la ruta con permisos 0600
+func GuardarLlaveCSD(ruta string, llave []byte, id IdentidadCSD) error {
+	sellada, err := SellarLlaveCSD(llave, id)
+	if err != nil {
+		return err
+	}
+	return escribirArchivo(ruta, sellada)
+}
+
+// SellarLlaveCSD sella el contenido de un .key para guardarlo en la base de datos
+func SellarLlaveCSD(llave []byte, id IdentidadCSD) ([]byte, error) {
+	if len(llave) == 0 || EsSobre(llave) {
+		return llave, nil
+	}
+	contexto, err := id.contexto(contextoLlaveCSD)
+	if err != nil {
+		return nil, err
+	}
+	sobre, err := Sellar(contexto, llave)
+	if err != nil {
+		return nil, fmt.Errorf("error al cifrar la llave del CSD: %w", err)
+	}
+	return []byte(sobre), nil
+}
+
+// CifrarClaveCSD sella la contraseña del CSD para guardarla en datos_fiscales
+func CifrarClaveCSD(clave string, id IdentidadCSD) (string, error) {
+	if clave == "" || EsSobre([]byte(clave)) {
+		return clave, nil
+	}
+	contexto, err := id.contexto(contextoClaveCSD)
+	if err != nil {
+		return "", err
+	}
+	sobre, err := Sellar(contexto, []byte(clave))
+	if err != nil {
+		return "", fmt.Errorf("error al cifrar la contraseña del CSD: %w", err)
+	}
+	return sobre, nil
+}
+
+// LlavePrivadaCSD abre el .key guardado y su contraseña y devuelve la llave privada lista para firmar.
+// Acepta valores en claro de antes de la migración.
+func LlavePrivadaCSD(rutaKey, clave string, id IdentidadCSD) (*rsa.PrivateKey, error) {
+	llave, err := leerLlaveCSD(rutaKey, id)
+	if err != nil {
+		return nil, err
+	}
+	claro, err := abrirClaveCSD(clave, id)
+	if err != nil {
+		return nil, err
+	}
+	privada, err := utils.DescifrarLlaveCSD(llave, claro)
+	if err != nil {
+		return nil, fmt.Errorf("error descifrando la llave privada del CSD: %w", err)
+	}
+	return privada, nil
+}
+
+// ArchivoLlaveCSD devuelve el .key tal como lo emitió el SAT (cifrado con su contraseña) y la
+// contraseña abierta, para los PAC que reciben el CSD original en lugar de la llave descifrada
+func ArchivoLlaveCSD(rutaKey, clave string, id IdentidadCSD) ([]byte, string, error) {
+	llave, err := leerLlaveCSD(rutaKey, id)
+	if err != nil {
+		return nil, "", err
+	}
+	claro, err := abrirClaveCSD(clave, id)
+	if err != nil {
+		return nil, "", err
+	}
+	return llave, claro, nil
+}
+
+// LlaveCorrespondeCertificado indica si el .key guardado abre con su contraseña y corresponde al
+// certificado; la llave descifrada no sale de este paquete
+func LlaveCorrespondeCertificado(rutaKey, clave string, cert *x509.Certificate, id IdentidadCSD) (bool, error) {
+	privada, err := LlavePrivadaCSD(rutaKey, clave, id)
+	if err != nil {
+		return false, err
+	}
+	publica, ok := cert.PublicKey.(*rsa.PublicKey)
+	return ok && publica.Equal(&privada.PublicKey), nil
+}
+
+// LlavePEMCifrada convierte el .key del SAT (cifrado con clave) en un PEM PKCS#1 cifrado con
+// contrasena, para los PAC que lo piden así; la llave descifrada no sale de este paquete
+func LlavePEMCifrada(llaveCifrada []byte, clave, contrasena string) ([]byte, error) {
+	privada, err := utils.DescifrarLlaveCSD(llaveCifrada, clave)
+	if err != nil {
+		return nil, fmt.Errorf("error al abrir la llave del CSD: %w", err)
+	}
+	bloque, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(privada), []byte(contrasena), x509.PEMCipher3DES)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(bloque), nil
+}
+
+// CambiaCSD indica si la solicitud cambia algo que debe seguir correspondiendo con el CSD: la llave,
+// el certificado, la contraseña o, si ya hay un CSD registrado, el RFC del emisor
+func CambiaCSD(llave, cer []byte, clave, rfc string, guardado CSDGuardado) bool {
+	if len(llave) > 0 || len(cer) > 0 {
+		return true
+	}
+	if guardado.RutaKey == "" && guardado.RutaCer == "" {
+		return false
+	}
+	return clave != "" || !strings.EqualFold(strings.TrimSpace(rfc), strings.TrimSpace(guardado.RFC))
+}
+
+// ValidarCSD valida el CSD que se va a guardar; lo que no venga en la solicitud
+// (llave, certificado o contraseña) se toma de lo ya registrado
+func ValidarCSD(llave, cer []byte, clave, rfc string, ahora time.Time, guardado CSDGuardado) error {
+	var err error
+	if (len(llave) == 0 && guardado.RutaKey != "") || clave == "" {
+		// Lo guardado se selló con la identidad del certificado guardado
+		var id IdentidadCSD
+		if guardado.RutaCer != "" {
+			if id, err = IdentidadArchivoCertificado(guardado.RFC, guardado.RutaCer); err != nil {
+				return err
+			}
+		}
+		if len(llave) == 0 && guardado.RutaKey != "" {
+			if llave, err = leerLlaveCSD(guardado.RutaKey, id); err != nil {
+				return err
+			}
+		}
+		if clave == "" {
+			if clave, err = abrirClaveCSD(guardado.Clave, id); err != nil {
+				return err
+			}
+		}
+	}
+	if len(cer) == 0 && guardado.RutaCer != "" {
+		if cer, err = os.ReadFile(guardado.RutaCer); err != nil {
+			return fmt.Errorf("no se pudo leer el archivo .cer en %s: %w", guardado.RutaCer, err)
+		}
+	}
+	return utils.ValidarCSD(cer, llave, clave, rfc, ahora)
+}
+
+// RecifrarClaveCSD sella una contraseña en claro, vuelve a sellar con su identidad un sobre anterior
+// a IdentidadCSD o reenvuelve un sobre con la llave maestra activa. Devuelve false si no hubo cambios.
+func RecifrarClaveCSD(valor string, id IdentidadCSD) (string, bool, error) {
+	if valor == "" {
+		return valor, false, nil
+	}
+	if EsSobre([]byte(valor)) {
+		return recifrarSobre(contextoClaveCSD, valor, id)
+	}
+	sobre, err := CifrarClaveCSD(valor, id)
+	return sobre, err == nil, err
+}
+
+// RecifrarLlaveCSD hace lo mismo que RecifrarClaveCSD con el contenido de un .key
+func RecifrarLlaveCSD(datos []byte, id IdentidadCSD) ([]byte, bool, error) {
+	if len(datos) == 0 {
+		return datos, false, nil
+	}
+	if EsSobre(datos) {
+		sobre, cambio, err := recifrarSobre(contextoLlaveCSD, string(datos), id)
+		return []byte(sobre), cambio, err
+	}
+	sellada, err := SellarLlaveCSD(datos, id)
+	return sellada, err == nil, err
+}
+
+// RecifrarArchivoCSD recifra en su lugar un .key guardado en disco
+func RecifrarArchivoCSD(ruta string, id IdentidadCSD) (bool, error) {
+	datos, err := os.ReadFile(ruta)
+	if err != nil {
+		return false, fmt.Errorf("no se pudo leer el archivo .key en %s: %w", ruta, err)
+	}
+	nuevos, cambio, err := RecifrarLlaveCSD(datos, id)
+	if err != nil || !cambio {
+		return false, err
+	}
+	if err := escribirArchivo(ruta, nuevos); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// recifrarSobre reenvuelve un sobre sellado con la identidad; uno sellado con el contexto anterior
+// (sin identidad) se abre y se vuelve a sellar con ella
+func recifrarSobre(tipo, sobre string, id IdentidadCSD) (string, bool, error) {
+	contexto, err := id.contexto(tipo)
+	if err != nil {
+		return "", false, err
+	}
+	nuevo, cambio, err := Reenvolver(contexto, sobre)
+	if err == nil {
+		return nuevo, cambio, nil
+	}
+	datos, errAnterior := Abrir(tipo, sobre)
+	if errAnterior != nil {
+		return "", false, err
+	}
+	nuevo, err = Sellar(contexto, datos)
+	return nuevo, err == nil, err
+}
+
+// abrirSobreCSD abre un sobre de la identidad; los sellados antes de ligarlos al certificado
+// se siguen aceptando con el contexto anterior
+func abrirSobreCSD(tipo, sobre string, id IdentidadCSD) ([]byte, error) {
+	contexto, err := id.contexto(tipo)
+	if err != nil {
+		return nil, err
+	}
+	datos, err := Abrir(contexto, sobre)
+	if err == nil {
+		return datos, nil
+	}
+	if anterior, errAnterior := Abrir(tipo, sobre); errAnterior == nil {
+		return anterior, nil
+	}
+	return nil, err
+}
+
+func leerLlaveCSD(ruta string, id IdentidadCSD) ([]byte, error) {
+	datos, err := os.ReadFile(ruta)
+	if err != nil {
+		return nil, fmt.Errorf("no se pudo leer el archivo .key en %s: %w", ruta, err)
+	}
+	if !EsSobre(datos) {
+		return datos, nil
+	}
+	llave, err := abrirSobreCSD(contextoLlaveCSD, string(datos), id)
+	if err != nil {
+		return nil, fmt.Errorf("error al abrir la llave del CSD en %s: %w", ruta, err)
+	}
+	return llave, nil
+}
+
+func abrirClaveCSD(clave string, id IdentidadCSD) (string, error) {
+	if !EsSobre([]byte(clave)) {
+		return clave, nil
+	}
+	claro, err := abrirSobreCSD(contextoClaveCSD, clave, id)
+	if err != nil {
+		return "", fmt.Errorf("error al abrir la contraseña del CSD: %w", err)
+	}
+	return string(claro), nil
+}
+
+// escribirArchivo reemplaza el archivo de forma atómica para no dejar un .key a medias
+func escribirArchivo(ruta string, datos []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(ruta), ".key-*")
+	if err != nil {
+		return fmt.Errorf("error al guardar la llave del CSD: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error al guardar la llave del CSD: %w", err)
+	}
+	if _, err := tmp.Write(datos); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error al guardar la llave del CSD: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error al guardar la llave del CSD: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), ruta); err != nil {
+		return fmt.Errorf("error al guardar la llave del CSD: %w", err)
+	}
+	return nil
+}
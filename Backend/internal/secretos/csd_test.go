@@ -0,0 +1,151 @@
+package secretos
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"Facts/internal/utils"
+)
+
+func TestMain(m *testing.M) {
+	llave := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", tamLlave)))
+	os.Setenv("SECRETOS_LLAVES_MAESTRAS", "prueba:"+llave)
+	os.Exit(m.Run())
+}
+
+var identidadPrueba = IdentidadCSD{RFC: "EKU9003173C9", NoCertificado: "30001000000400002434"}
+
+// TestClaveCSDLigadaAIdentidad revisa que un sobre solo abra con el emisor y el certificado con que se selló
+func TestClaveCSDLigadaAIdentidad(t *testing.T) {
+	sobre, err := CifrarClaveCSD("12345678a", identidadPrueba)
+	if err != nil {
+		t.Fatalf("error al sellar: %v", err)
+	}
+	if clave, err := abrirClaveCSD(sobre, IdentidadCSD{RFC: "eku9003173c9", NoCertificado: identidadPrueba.NoCertificado}); err != nil || clave != "12345678a" {
+		t.Fatalf("no abrió con su identidad: %q, %v", clave, err)
+	}
+	for _, otra := range []IdentidadCSD{
+		{RFC: "URE180429TM6", NoCertificado: identidadPrueba.NoCertificado},
+		{RFC: identidadPrueba.RFC, NoCertificado: "30001000000400002495"},
+	} {
+		if _, err := abrirClaveCSD(sobre, otra); err == nil {
+			t.Errorf("el sobre abrió con %+v", otra)
+		}
+		if _, _, err := RecifrarClaveCSD(sobre, otra); err == nil {
+			t.Errorf("la rotación aceptó el sobre con %+v", otra)
+		}
+	}
+	if _, err := CifrarClaveCSD("12345678a", IdentidadCSD{RFC: identidadPrueba.RFC}); err == nil {
+		t.Errorf("se selló sin número de certificado")
+	}
+}
+
+// TestRecifrarSobreAnterior revisa que un sobre sellado sin identidad se siga abriendo y que la
+// rotación lo vuelva a sellar ligado a su certificado
+func TestRecifrarSobreAnterior(t *testing.T) {
+	anterior, err := Sellar(contextoClaveCSD, []byte("12345678a"))
+	if err != nil {
+		t.Fatalf("error al sellar: %v", err)
+	}
+	if clave, err := abrirClaveCSD(anterior, identidadPrueba); err != nil || clave != "12345678a" {
+		t.Fatalf("el sobre anterior no abrió: %q, %v", clave, err)
+	}
+
+	nuevo, cambio, err := RecifrarClaveCSD(anterior, identidadPrueba)
+	if err != nil || !cambio {
+		t.Fatalf("RecifrarClaveCSD = %t, %v; se esperaba un cambio", cambio, err)
+	}
+	if _, err := Abrir(contextoClaveCSD, nuevo); err == nil {
+		t.Errorf("el sobre recifrado sigue abriendo sin identidad")
+	}
+	if clave, err := abrirClaveCSD(nuevo, identidadPrueba); err != nil || clave != "12345678a" {
+		t.Fatalf("el sobre recifrado no abrió: %q, %v", clave, err)
+	}
+	if _, cambio, err := RecifrarClaveCSD(nuevo, identidadPrueba); err != nil || cambio {
+		t.Errorf("la segunda rotación cambió el sobre (%t, %v)", cambio, err)
+	}
+}
+
+func TestCambiaCSD(t *testing.T) {
+	guardado := CSDGuardado{RFC: "EKU9003173C9", RutaKey: "llave.key", RutaCer: "cert.cer", Clave: "sobre"}
+	casos := []struct {
+		nombre   string
+		llave    []byte
+		cer      []byte
+		clave    string
+		rfc      string
+		guardado CSDGuardado
+		cambia   bool
+	}{
+		{"sin cambios", nil, nil, "", "EKU9003173C9", guardado, false},
+		{"RFC en minúsculas", nil, nil, "", "eku9003173c9", guardado, false},
+		{"nueva llave", []byte("llave"), nil, "", "EKU9003173C9", guardado, true},
+		{"nuevo certificado", nil, []byte("cer"), "", "EKU9003173C9", guardado, true},
+		{"nueva contraseña", nil, nil, "otra", "EKU9003173C9", guardado, true},
+		{"nuevo RFC", nil, nil, "", "URE180429TM6", guardado, true},
+		{"contraseña sin CSD registrado", nil, nil, "otra", "EKU9003173C9", CSDGuardado{}, false},
+		{"archivos sin CSD registrado", []byte("llave"), []byte("cer"), "", "EKU9003173C9", CSDGuardado{}, true},
+	}
+	for _, c := range casos {
+		if cambia := CambiaCSD(c.llave, c.cer, c.clave, c.rfc, c.guardado); cambia != c.cambia {
+			t.Errorf("%s: CambiaCSD = %t, se esperaba %t", c.nombre, cambia, c.cambia)
+		}
+	}
+}
+
+// TestValidarCSDContraGuardado revisa que lo que cambia se valide contra la llave, el certificado y
+// la contraseña ya registrados (sellados)
+func TestValidarCSDContraGuardado(t *testing.T) {
+	cer, err := os.ReadFile("../../certificados/ABC123456DE7_cer.cer")
+	if err != nil {
+		t.Fatalf("no se pudo leer el certificado de prueba: %v", err)
+	}
+	llave, err := os.ReadFile("../../certificados/ABC123456DE7_key.key")
+	if err != nil {
+		t.Fatalf("no se pudo leer la llave de prueba: %v", err)
+	}
+	dir := t.TempDir()
+	guardado := CSDGuardado{RFC: identidadPrueba.RFC, RutaKey: filepath.Join(dir, "csd.key"), RutaCer: filepath.Join(dir, "csd.cer")}
+	if err := os.WriteFile(guardado.RutaCer, cer, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := GuardarLlaveCSD(guardado.RutaKey, llave, identidadPrueba); err != nil {
+		t.Fatalf("error al guardar la llave: %v", err)
+	}
+	if guardado.Clave, err = CifrarClaveCSD("12345678a", identidadPrueba); err != nil {
+		t.Fatalf("error al sellar la contraseña: %v", err)
+	}
+
+	vigente := time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)
+	casos := []struct {
+		nombre string
+		llave  []byte
+		cer    []byte
+		clave  string
+		rfc    string
+		codigo string // Vacío si el CSD es válido
+	}{
+		{"contraseña correcta", nil, nil, "12345678a", identidadPrueba.RFC, ""},
+		{"contraseña incorrecta", nil, nil, "incorrecta", identidadPrueba.RFC, utils.CSDContrasenaInvalida},
+		{"llave con la contraseña registrada", llave, nil, "", identidadPrueba.RFC, ""},
+		{"certificado con la llave registrada", nil, cer, "", identidadPrueba.RFC, ""},
+		{"RFC distinto del certificado", nil, nil, "", "URE180429TM6", utils.CSDRFCNoCoincide},
+	}
+	for _, c := range casos {
+		err := ValidarCSD(c.llave, c.cer, c.clave, c.rfc, vigente, guardado)
+		var errCSD *utils.ErrorValidacionCSD
+		switch {
+		case c.codigo == "" && err != nil:
+			t.Errorf("%s: se esperaba un CSD válido: %v", c.nombre, err)
+		case c.codigo != "" && !errors.As(err, &errCSD):
+			t.Errorf("%s: se esperaba el error %s, se obtuvo %v", c.nombre, c.codigo, err)
+		case c.codigo != "" && errCSD.Codigo != c.codigo:
+			t.Errorf("%s: código %s, se esperaba %s", c.nombre, errCSD.Codigo, c.codigo)
+		}
+	}
+}
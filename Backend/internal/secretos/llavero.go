@@ -0,0 +1,300 @@
+// Package secretos cifra en reposo la llave privada y la contraseña de los CSD.
+// Cada valor se sella con una llave de datos AES-256-GCM propia, y esa llave de datos se
+// envuelve con una llave maestra identificada por un ID para poder rotarla.
+package secretos
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// prefijoSobre identifica un valor sellado: sobre1:<id llave maestra>:<llave de datos envuelta>:<datos cifrados>
+	prefijoSobre = "sobre1:"
+	// tamLlave es el tamaño de las llaves maestras y de datos (AES-256)
+	tamLlave = 32
+	// archivoLlavesPorDefecto se crea con una llave nueva si no hay llaves maestras configuradas
+	archivoLlavesPorDefecto = "./secretos/llaves_maestras.txt"
+)
+
+// ErrSobreInvalido indica que el valor no tiene el formato de un sobre
+var ErrSobreInvalido = errors.New("sobre cifrado inválido")
+
+// llavero contiene las llaves maestras por ID y la que se usa para sellar
+type llavero struct {
+	llaves map[string][]byte
+	activa string
+}
+
+var (
+	llaveroGlobal *llavero
+	errLlavero    error
+	cargaLlavero  sync.Once
+)
+
+// Inicializar carga las llaves maestras; conviene llamarla al arrancar para detectar
+// errores de configuración antes de atender solicitudes
+func Inicializar() error {
+	_, err := obtenerLlavero()
+	return err
+}
+
+// LlaveActiva devuelve el ID de la llave maestra con la que se sellan los valores nuevos
+func LlaveActiva() (string, error) {
+	l, err := obtenerLlavero()
+	if err != nil {
+		return "", err
+	}
+	return l.activa, nil
+}
+
+func obtenerLlavero() (*llavero, error) {
+	cargaLlavero.Do(func() {
+		llaveroGlobal, errLlavero = cargarLlavero()
+	})
+	return llaveroGlobal, errLlavero
+}
+
+// cargarLlavero lee las llaves de SECRETOS_LLAVES_MAESTRAS o del archivo SECRETOS_ARCHIVO_LLAVES.
+// Cada entrada es "id:base64" separada por comas o saltos de línea; la activa es
+// SECRETOS_LLAVE_ACTIVA o, si no se indica, la última de la lista.
+func cargarLlavero() (*llavero, error) {
+	texto := os.Getenv("SECRETOS_LLAVES_MAESTRAS")
+	origen := "SECRETOS_LLAVES_MAESTRAS"
+	if strings.TrimSpace(texto) == "" {
+		ruta := os.Getenv("SECRETOS_ARCHIVO_LLAVES")
+		if ruta == "" {
+			ruta = archivoLlavesPorDefecto
+		}
+		origen = ruta
+		contenido, err := os.ReadFile(ruta)
+		if errors.Is(err, os.ErrNotExist) {
+			contenido, err = crearArchivoLlaves(ruta)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error al leer las llaves maestras de %s: %w", ruta, err)
+		}
+		texto = string(contenido)
+	}
+
+	var entradas []string
+	for _, linea := range strings.Split(texto, "\n") {
+		if linea = strings.TrimSpace(linea); strings.HasPrefix(linea, "#") {
+			continue
+		}
+		entradas = append(entradas, strings.Split(linea, ",")...)
+	}
+
+	l := &llavero{llaves: map[string][]byte{}}
+	for _, entrada := range entradas {
+		if entrada = strings.TrimSpace(entrada); entrada == "" {
+			continue
+		}
+		id, valor, ok := strings.Cut(entrada, ":")
+		id = strings.TrimSpace(id)
+		if !ok || id == "" {
+			return nil, fmt.Errorf("llave maestra con formato inválido en %s (se espera id:base64)", origen)
+		}
+		llave, err := base64.StdEncoding.DecodeString(strings.TrimSpace(valor))
+		if err != nil || len(llave) != tamLlave {
+			return nil, fmt.Errorf("la llave maestra %q en %s debe ser de %d bytes en base64", id, origen, tamLlave)
+		}
+		if _, repetida := l.llaves[id]; repetida {
+			return nil, fmt.Errorf("la llave maestra %q está repetida en %s", id, origen)
+		}
+		l.llaves[id] = llave
+		l.activa = id
+	}
+	if len(l.llaves) == 0 {
+		return nil, fmt.Errorf("no hay llaves maestras en %s", origen)
+	}
+	if activa := os.Getenv("SECRETOS_LLAVE_ACTIVA"); activa != "" {
+		if _, ok := l.llaves[activa]; !ok {
+			return nil, fmt.Errorf("la llave activa %q no está entre las llaves maestras de %s", activa, origen)
+		}
+		l.activa = activa
+	}
+	log.Printf("[SECRETOS] %d llave(s) maestra(s) cargada(s) de %s, activa: %s", len(l.llaves), origen, l.activa)
+	return l, nil
+}
+
+// crearArchivoLlaves genera una llave maestra nueva y la guarda con permisos 0600
+func crearArchivoLlaves(ruta string) ([]byte, error) {
+	llave := make([]byte, tamLlave)
+	if _, err := rand.Read(llave); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(ruta), 0700); err != nil {
+		return nil, err
+	}
+	contenido := []byte(fmt.Sprintf("# Llaves maestras de los CSD: id:base64, la última es la activa\n%s:%s\n",
+		time.Now().Format("20060102"), base64.StdEncoding.EncodeToString(llave)))
+	f, err := os.OpenFile(ruta, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(contenido); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	log.Printf("[SECRETOS] No había llaves maestras configuradas; se generó %s. Respáldalo: sin él no se pueden abrir los CSD guardados", ruta)
+	return contenido, nil
+}
+
+// EsSobre indica si el valor ya está sellado
+func EsSobre(valor []byte) bool {
+	return strings.HasPrefix(string(valor), prefijoSobre)
+}
+
+// Sellar cifra los datos con una llave de datos nueva envuelta con la llave maestra activa.
+// El contexto se autentica junto con los datos, así un sobre no sirve en otro lugar.
+func Sellar(contexto string, datos []byte) (string, error) {
+	l, err := obtenerLlavero()
+	if err != nil {
+		return "", err
+	}
+	llaveDatos := make([]byte, tamLlave)
+	if _, err := rand.Read(llaveDatos); err != nil {
+		return "", fmt.Errorf("error al generar la llave de datos: %w", err)
+	}
+	envuelta, err := cifrarGCM(l.llaves[l.activa], llaveDatos, aadLlaveDatos(l.activa))
+	if err != nil {
+		return "", err
+	}
+	cifrado, err := cifrarGCM(llaveDatos, datos, []byte(contexto))
+	if err != nil {
+		return "", err
+	}
+	return prefijoSobre + l.activa + ":" + base64.StdEncoding.EncodeToString(envuelta) + ":" +
+		base64.StdEncoding.EncodeToString(cifrado), nil
+}
+
+// Abrir descifra un sobre sellado con el mismo contexto
+func Abrir(contexto, sobre string) ([]byte, error) {
+	l, err := obtenerLlavero()
+	if err != nil {
+		return nil, err
+	}
+	id, envuelta, cifrado, err := partirSobre(sobre)
+	if err != nil {
+		return nil, err
+	}
+	llaveDatos, err := l.desenvolver(id, envuelta)
+	if err != nil {
+		return nil, err
+	}
+	datos, err := descifrarGCM(llaveDatos, cifrado, []byte(contexto))
+	if err != nil {
+		return nil, fmt.Errorf("no se pudo abrir el sobre (%s): %w", contexto, err)
+	}
+	return datos, nil
+}
+
+// Reenvolver vuelve a envolver la llave de datos con la llave maestra activa sin tocar los
+// datos cifrados. El sobre debe abrir con el contexto, así la rotación no da por buena una
+// copia de otro lugar. Devuelve false si el sobre ya usaba la llave activa.
+func Reenvolver(contexto, sobre string) (string, bool, error) {
+	l, err := obtenerLlavero()
+	if err != nil {
+		return "", false, err
+	}
+	id, envuelta, cifrado, err := partirSobre(sobre)
+	if err != nil {
+		return "", false, err
+	}
+	llaveDatos, err := l.desenvolver(id, envuelta)
+	if err != nil {
+		return "", false, err
+	}
+	if _, err := descifrarGCM(llaveDatos, cifrado, []byte(contexto)); err != nil {
+		return "", false, fmt.Errorf("no se pudo abrir el sobre (%s): %w", contexto, err)
+	}
+	if id == l.activa {
+		return sobre, false, nil
+	}
+	nueva, err := cifrarGCM(l.llaves[l.activa], llaveDatos, aadLlaveDatos(l.activa))
+	if err != nil {
+		return "", false, err
+	}
+	return prefijoSobre + l.activa + ":" + base64.StdEncoding.EncodeToString(nueva) + ":" +
+		base64.StdEncoding.EncodeToString(cifrado), true, nil
+}
+
+func (l *llavero) desenvolver(id string, envuelta []byte) ([]byte, error) {
+	maestra, ok := l.llaves[id]
+	if !ok {
+		return nil, fmt.Errorf("el sobre usa la llave maestra %q, que no está configurada", id)
+	}
+	llaveDatos, err := descifrarGCM(maestra, envuelta, aadLlaveDatos(id))
+	if err != nil {
+		return nil, fmt.Errorf("no se pudo desenvolver la llave de datos con la llave maestra %q: %w", id, err)
+	}
+	return llaveDatos, nil
+}
+
+// aadLlaveDatos liga la llave de datos envuelta al ID de su llave maestra
+func aadLlaveDatos(id string) []byte {
+	return []byte("secretos/llave-datos:" + id)
+}
+
+func partirSobre(sobre string) (id string, envuelta, cifrado []byte, err error) {
+	if !strings.HasPrefix(sobre, prefijoSobre) {
+		return "", nil, nil, ErrSobreInvalido
+	}
+	partes := strings.Split(strings.TrimSpace(sobre[len(prefijoSobre):]), ":")
+	if len(partes) != 3 || partes[0] == "" {
+		return "", nil, nil, ErrSobreInvalido
+	}
+	if envuelta, err = base64.StdEncoding.DecodeString(partes[1]); err != nil {
+		return "", nil, nil, ErrSobreInvalido
+	}
+	if cifrado, err = base64.StdEncoding.DecodeString(partes[2]); err != nil {
+		return "", nil, nil, ErrSobreInvalido
+	}
+	return partes[0], envuelta, cifrado, nil
+}
+
+// cifrarGCM devuelve nonce + texto cifrado
+func cifrarGCM(llave, datos, aad []byte) ([]byte, error) {
+	gcm, err := nuevoGCM(llave)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("error al generar el nonce: %w", err)
+	}
+	return gcm.Seal(nonce, nonce, datos, aad), nil
+}
+
+func descifrarGCM(llave, datos, aad []byte) ([]byte, error) {
+	gcm, err := nuevoGCM(llave)
+	if err != nil {
+		return nil, err
+	}
+	if len(datos) < gcm.NonceSize() {
+		return nil, ErrSobreInvalido
+	}
+	return gcm.Open(nil, datos[:gcm.NonceSize()], datos[gcm.NonceSize():], aad)
+}
+
+func nuevoGCM(llave []byte) (cipher.AEAD, error) {
+	bloque, err := aes.NewCipher(llave)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(bloque)
+}
@@ -0,0 +1,69 @@
+package secretos
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// contextoContrasenaPAC es el tipo de secreto de la contraseña del PAC; el contexto del sobre
+// lleva además el RFC del emisor
+const contextoContrasenaPAC = "pac/contrasena"
+
+func contextoPAC(rfc string) (string, error) {
+	rfc = strings.ToUpper(strings.TrimSpace(rfc))
+	if rfc == "" {
+		return "", errors.New("se requiere el RFC del emisor para sellar la contraseña del PAC")
+	}
+	return contextoContrasenaPAC + ":" + rfc, nil
+}
+
+// SellarContrasenaPAC sella la contraseña del PAC del emisor para guardarla en datos_fiscales
+func SellarContrasenaPAC(contrasena, rfc string) (string, error) {
+	if contrasena == "" || EsSobre([]byte(contrasena)) {
+		return contrasena, nil
+	}
+	contexto, err := contextoPAC(rfc)
+	if err != nil {
+		return "", err
+	}
+	sobre, err := Sellar(contexto, []byte(contrasena))
+	if err != nil {
+		return "", fmt.Errorf("error al cifrar la contraseña del PAC: %w", err)
+	}
+	return sobre, nil
+}
+
+// AbrirContrasenaPAC abre la contraseña sellada del PAC del emisor. Las contraseñas en claro (de
+// las variables de entorno o anteriores a la migración) se devuelven tal cual.
+func AbrirContrasenaPAC(contrasena, rfc string) (string, error) {
+	if !EsSobre([]byte(contrasena)) {
+		return contrasena, nil
+	}
+	contexto, err := contextoPAC(rfc)
+	if err != nil {
+		return "", err
+	}
+	claro, err := Abrir(contexto, contrasena)
+	if err != nil {
+		return "", fmt.Errorf("error al abrir la contraseña del PAC: %w", err)
+	}
+	return string(claro), nil
+}
+
+// RecifrarContrasenaPAC sella una contraseña en claro o reenvuelve un sobre con la llave maestra
+// activa. Devuelve false si no hubo cambios.
+func RecifrarContrasenaPAC(valor, rfc string) (string, bool, error) {
+	if valor == "" {
+		return valor, false, nil
+	}
+	if !EsSobre([]byte(valor)) {
+		sobre, err := SellarContrasenaPAC(valor, rfc)
+		return sobre, err == nil, err
+	}
+	contexto, err := contextoPAC(rfc)
+	if err != nil {
+		return "", false, err
+	}
+	return Reenvolver(contexto, valor)
+}
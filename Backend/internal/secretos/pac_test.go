@@ -0,0 +1,26 @@
+package secretos
+
+import "testing"
+
+// TestContrasenaPACLigadaAlEmisor revisa que la contraseña sellada solo abra con el RFC del emisor
+func TestContrasenaPACLigadaAlEmisor(t *testing.T) {
+	sobre, err := SellarContrasenaPAC("secreto-pac", "EKU9003173C9")
+	if err != nil {
+		t.Fatalf("error al sellar: %v", err)
+	}
+	if !EsSobre([]byte(sobre)) {
+		t.Fatalf("la contraseña no quedó sellada: %q", sobre)
+	}
+	if claro, err := AbrirContrasenaPAC(sobre, "eku9003173c9"); err != nil || claro != "secreto-pac" {
+		t.Fatalf("no abrió con su emisor: %q, %v", claro, err)
+	}
+	if _, err := AbrirContrasenaPAC(sobre, "URE180429TM6"); err == nil {
+		t.Fatal("la contraseña abrió con otro emisor")
+	}
+	if claro, err := AbrirContrasenaPAC("en-claro", ""); err != nil || claro != "en-claro" {
+		t.Fatalf("una contraseña en claro debe pasar tal cual: %q, %v", claro, err)
+	}
+	if otra, cambio, err := RecifrarContrasenaPAC(sobre, "EKU9003173C9"); err != nil || cambio || otra != sobre {
+		t.Fatalf("un sobre con la llave activa no debe cambiar: %v, %v", cambio, err)
+	}
+}
@@ -0,0 +1,121 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// dirArchivoCFDI es el directorio por defecto del archivo de CFDI timbrados
+const dirArchivoCFDI = "./archivo/cfdi"
+
+// ArchivoCFDI identifica un XML timbrado guardado en el archivo
+type ArchivoCFDI struct {
+	UUID   string `json:"uuid"`
+	SHA256 string `json:"sha256"`
+	Clave  string `json:"clave"`
+	// NoCertificado es el CSD con el que el emisor selló el CFDI
+	NoCertificado string `json:"no_certificado,omitempty"`
+}
+
+// ErrArchivoAlterado indica que el XML guardado ya no corresponde a la huella registrada
+var ErrArchivoAlterado = errors.New("el XML archivado no corresponde a su huella SHA-256")
+
+// directorioArchivoCFDI devuelve la raíz del archivo (CFDI_ARCHIVO_DIR o ./archivo/cfdi)
+func directorioArchivoCFDI() string {
+	if dir := os.Getenv("CFDI_ARCHIVO_DIR"); dir != "" {
+		return dir
+	}
+	return dirArchivoCFDI
+}
+
+// HuellaXML devuelve el SHA-256 en hexadecimal de los bytes del XML
+func HuellaXML(xmlCFDI []byte) string {
+	suma := sha256.Sum256(xmlCFDI)
+	return hex.EncodeToString(suma[:])
+}
+
+// ArchivarXMLTimbrado guarda el XML timbrado tal cual lo devolvió el PAC bajo RFC/AAAA/MM/UUID.xml.
+// El archivo nunca se sobrescribe: si ya existe con la misma huella se devuelve el registro existente
+// y si la huella es distinta se rechaza.
+func ArchivarXMLTimbrado(xmlTimbrado []byte) (ArchivoCFDI, error) {
+	var archivo ArchivoCFDI
+	ri, err := LeerRepresentacionImpresa(xmlTimbrado)
+	if err != nil {
+		return archivo, err
+	}
+	uuid := ri.UUID()
+	if uuid == "" {
+		return archivo, errors.New("el XML no tiene TimbreFiscalDigital; solo se archivan CFDI timbrados")
+	}
+
+	periodo := "0000/00"
+	if len(ri.Fecha) >= 7 {
+		periodo = ri.Fecha[:4] + "/" + ri.Fecha[5:7]
+	}
+	archivo = ArchivoCFDI{
+		UUID:          uuid,
+		SHA256:        HuellaXML(xmlTimbrado),
+		Clave:         fmt.Sprintf("%s/%s/%s.xml", strings.ToUpper(ri.Emisor.Rfc), periodo, uuid),
+		NoCertificado: ri.NoCertificado,
+	}
+
+	ruta := filepath.Join(directorioArchivoCFDI(), filepath.FromSlash(archivo.Clave))
+	if err := os.MkdirAll(filepath.Dir(ruta), 0755); err != nil {
+		return archivo, fmt.Errorf("error al crear el directorio del archivo: %w", err)
+	}
+
+	// Se escribe en un temporal y se enlaza al nombre final: el enlace falla si ya existe,
+	// así nunca queda un XML a medias ni se reemplaza uno guardado
+	tmp, err := os.CreateTemp(filepath.Dir(ruta), ".tmp-*")
+	if err != nil {
+		return archivo, fmt.Errorf("error al crear archivo temporal: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(xmlTimbrado); err != nil {
+		tmp.Close()
+		return archivo, fmt.Errorf("error al escribir el XML: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return archivo, fmt.Errorf("error al escribir el XML: %w", err)
+	}
+	tmp.Close()
+	if err := os.Chmod(tmp.Name(), 0444); err != nil {
+		return archivo, fmt.Errorf("error al proteger el XML: %w", err)
+	}
+
+	if err := os.Link(tmp.Name(), ruta); err != nil {
+		if !errors.Is(err, os.ErrExist) {
+			return archivo, fmt.Errorf("error al archivar el XML: %w", err)
+		}
+		existente, errLeer := os.ReadFile(ruta)
+		if errLeer != nil {
+			return archivo, fmt.Errorf("error al leer el XML archivado: %w", errLeer)
+		}
+		if !bytes.Equal(existente, xmlTimbrado) {
+			return archivo, fmt.Errorf("el UUID %s ya está archivado con un XML distinto", uuid)
+		}
+	}
+	return archivo, nil
+}
+
+// LeerXMLArchivado devuelve el XML guardado con la clave indicada después de comprobar su huella
+func LeerXMLArchivado(clave, huella string) ([]byte, error) {
+	if clave == "" || strings.Contains(clave, "..") {
+		return nil, fmt.Errorf("clave de archivo inválida: %q", clave)
+	}
+	xmlCFDI, err := os.ReadFile(filepath.Join(directorioArchivoCFDI(), filepath.FromSlash(clave)))
+	if err != nil {
+		return nil, fmt.Errorf("error al leer el XML archivado: %w", err)
+	}
+	if !strings.EqualFold(HuellaXML(xmlCFDI), huella) {
+		return nil, fmt.Errorf("%s: %w", clave, ErrArchivoAlterado)
+	}
+	return xmlCFDI, nil
+}
@@ -0,0 +1,287 @@
+package services
+
+import (
+	"strings"
+)
+
+// Construcción nativa de la cadena original siguiendo las reglas de los XSLT del SAT
+// (cadenaoriginal_4_0.xslt y cadenaoriginal_TFD_1_1.xslt): los atributos se
+// recorren en el orden del anexo 20, cada valor se normaliza con normalize-space
+// y se antepone un "|"; la cadena completa inicia con "||" y termina con "||".
+
+type cadenaBuilder struct {
+	sb strings.Builder
+}
+
+// normalizarEspacios replica normalize-space(): colapsa cualquier secuencia de
+// espacios, tabuladores o saltos de línea en un solo espacio y recorta extremos
+func normalizarEspacios(valor string) string {
+	return strings.Join(strings.Fields(valor), " ")
+}
+
+// requerido agrega el valor aunque venga vacío (plantilla "Requerido" del SAT)
+func (c *cadenaBuilder) requerido(valor string) {
+	c.sb.WriteString("|")
+	c.sb.WriteString(normalizarEspacios(valor))
+}
+
+// opcional agrega el valor solo si el atributo existe (plantilla "Opcional" del SAT).
+// Como el XML se genera con omitempty, un valor vacío equivale a un atributo ausente.
+func (c *cadenaBuilder) opcional(valor string) {
+	if valor == "" {
+		return
+	}
+	c.requerido(valor)
+}
+
+func (c *cadenaBuilder) cerrar() string {
+	return "|" + c.sb.String() + "||"
+}
+
+// GenerarCadenaOriginal construye la cadena original CFDI 4.0 directamente desde la estructura del comprobante
+func GenerarCadenaOriginal(comprobante CFDIComprobante) string {
+	var c cadenaBuilder
+
+	c.requerido(comprobante.Version)
+	c.opcional(comprobante.Serie)
+	c.opcional(comprobante.Folio)
+	c.requerido(comprobante.Fecha)
+	c.opcional(comprobante.FormaPago)
+	c.requerido(comprobante.NoCertificado)
+	c.opcional(comprobante.CondicionesDePago)
+	c.requerido(comprobante.SubTotal)
+	c.opcional(comprobante.Descuento)
+	c.requerido(comprobante.Moneda)
+	c.opcional(comprobante.TipoCambio)
+	c.requerido(comprobante.Total)
+	c.requerido(comprobante.TipoDeComprobante)
+	c.requerido(comprobante.Exportacion)
+	c.opcional(comprobante.MetodoPago)
+	c.requerido(comprobante.LugarExpedicion)
+	c.opcional(comprobante.Confirmacion)
+
+	// InformacionGlobal
+	if g := comprobante.InformacionGlobal; g != nil {
+		c.requerido(g.Periodicidad)
+		c.requerido(g.Meses)
+		c.requerido(g.Anio)
+	}
+
+	// CfdiRelacionados
+	if comprobante.CfdiRelacionados != nil {
+		c.requerido(comprobante.CfdiRelacionados.TipoRelacion)
+		for _, r := range comprobante.CfdiRelacionados.CfdiRelacionado {
+			c.requerido(r.UUID)
+		}
+	}
+
+	// Emisor
+	c.requerido(comprobante.Emisor.Rfc)
+	c.requerido(comprobante.Emisor.Nombre)
+	c.requerido(comprobante.Emisor.RegimenFiscal)
+	c.opcional(comprobante.Emisor.FacAtrAdquirente)
+
+	// Receptor
+	c.requerido(comprobante.Receptor.Rfc)
+	c.requerido(comprobante.Receptor.Nombre)
+	c.requerido(comprobante.Receptor.DomicilioFiscalReceptor)
+	c.opcional(comprobante.Receptor.ResidenciaFiscal)
+	c.opcional(comprobante.Receptor.NumRegIdTrib)
+	c.requerido(comprobante.Receptor.RegimenFiscalReceptor)
+	c.requerido(comprobante.Receptor.UsoCFDI)
+
+	// Conceptos
+	for _, concepto := range comprobante.Conceptos.Concepto {
+		agregarConcepto(&c, concepto)
+	}
+
+	// Impuestos del comprobante: primero retenciones y luego traslados
+	if imp := comprobante.Impuestos; imp != nil {
+		if imp.Retenciones != nil {
+			for _, r := range imp.Retenciones.Retencion {
+				c.requerido(r.Impuesto)
+				c.requerido(r.Importe)
+			}
+		}
+		c.opcional(imp.TotalImpuestosRetenidos)
+		if imp.Traslados != nil {
+			for _, t := range imp.Traslados.Traslado {
+				c.requerido(t.Base)
+				c.requerido(t.Impuesto)
+				c.requerido(t.TipoFactor)
+				c.opcional(t.TasaOCuota)
+				c.opcional(t.Importe)
+			}
+		}
+		c.opcional(imp.TotalImpuestosTrasladados)
+	}
+
+	// Complementos
+	if comprobante.Complemento != nil && comprobante.Complemento.Pagos != nil {
+		agregarPagos20(&c, comprobante.Complemento.Pagos)
+	}
+
+	return c.cerrar()
+}
+
+// agregarConcepto sigue la plantilla cfdi:Concepto: atributos, impuestos, a cuenta de terceros,
+// información aduanera, cuenta predial y partes
+func agregarConcepto(c *cadenaBuilder, concepto CFDIConcepto) {
+	c.requerido(concepto.ClaveProdServ)
+	c.opcional(concepto.NoIdentificacion)
+	c.requerido(concepto.Cantidad)
+	c.requerido(concepto.ClaveUnidad)
+	c.opcional(concepto.Unidad)
+	c.requerido(concepto.Descripcion)
+	c.requerido(concepto.ValorUnitario)
+	c.requerido(concepto.Importe)
+	c.opcional(concepto.Descuento)
+	c.requerido(concepto.ObjetoImp)
+
+	if imp := concepto.Impuestos; imp != nil {
+		if imp.Traslados != nil {
+			for _, t := range imp.Traslados.Traslado {
+				c.requerido(t.Base)
+				c.requerido(t.Impuesto)
+				c.requerido(t.TipoFactor)
+				c.opcional(t.TasaOCuota)
+				c.opcional(t.Importe)
+			}
+		}
+		if imp.Retenciones != nil {
+			for _, r := range imp.Retenciones.Retencion {
+				c.requerido(r.Base)
+				c.requerido(r.Impuesto)
+				c.requerido(r.TipoFactor)
+				c.requerido(r.TasaOCuota)
+				c.requerido(r.Importe)
+			}
+		}
+	}
+	if t := concepto.ACuentaTerceros; t != nil {
+		c.requerido(t.RfcACuentaTerceros)
+		c.requerido(t.NombreACuentaTerceros)
+		c.requerido(t.RegimenFiscalACuentaTerceros)
+		c.requerido(t.DomicilioFiscalACuentaTerceros)
+	}
+	for _, a := range concepto.InformacionAduanera {
+		c.requerido(a.NumeroPedimento)
+	}
+	for _, p := range concepto.CuentaPredial {
+		c.requerido(p.Numero)
+	}
+	for _, p := range concepto.Parte {
+		c.requerido(p.ClaveProdServ)
+		c.opcional(p.NoIdentificacion)
+		c.requerido(p.Cantidad)
+		c.opcional(p.Unidad)
+		c.requerido(p.Descripcion)
+		c.opcional(p.ValorUnitario)
+		c.opcional(p.Importe)
+		for _, a := range p.InformacionAduanera {
+			c.requerido(a.NumeroPedimento)
+		}
+	}
+}
+
+// agregarPagos20 sigue el orden de pagos20.xslt del SAT
+func agregarPagos20(c *cadenaBuilder, pagos *Pagos20) {
+	c.requerido(pagos.Version)
+
+	t := pagos.Totales
+	c.opcional(t.TotalRetencionesIVA)
+	c.opcional(t.TotalRetencionesISR)
+	c.opcional(t.TotalRetencionesIEPS)
+	c.opcional(t.TotalTrasladosBaseIVA16)
+	c.opcional(t.TotalTrasladosImpuestoIVA16)
+	c.opcional(t.TotalTrasladosBaseIVA8)
+	c.opcional(t.TotalTrasladosImpuestoIVA8)
+	c.opcional(t.TotalTrasladosBaseIVA0)
+	c.opcional(t.TotalTrasladosImpuestoIVA0)
+	c.opcional(t.TotalTrasladosBaseIVAExento)
+	c.requerido(t.MontoTotalPagos)
+
+	for _, p := range pagos.Pago {
+		c.requerido(p.FechaPago)
+		c.requerido(p.FormaDePagoP)
+		c.requerido(p.MonedaP)
+		c.opcional(p.TipoCambioP)
+		c.requerido(p.Monto)
+		c.opcional(p.NumOperacion)
+		c.opcional(p.RfcEmisorCtaOrd)
+		c.opcional(p.NomBancoOrdExt)
+		c.opcional(p.CtaOrdenante)
+		c.opcional(p.RfcEmisorCtaBen)
+		c.opcional(p.CtaBeneficiario)
+		c.opcional(p.TipoCadPago)
+		c.opcional(p.CertPago)
+		c.opcional(p.CadPago)
+		c.opcional(p.SelloPago)
+
+		for _, d := range p.DoctoRelacionado {
+			c.requerido(d.IdDocumento)
+			c.opcional(d.Serie)
+			c.opcional(d.Folio)
+			c.requerido(d.MonedaDR)
+			c.opcional(d.EquivalenciaDR)
+			c.requerido(d.NumParcialidad)
+			c.requerido(d.ImpSaldoAnt)
+			c.requerido(d.ImpPagado)
+			c.requerido(d.ImpSaldoInsoluto)
+			c.requerido(d.ObjetoImpDR)
+			if imp := d.ImpuestosDR; imp != nil {
+				if imp.RetencionesDR != nil {
+					for _, r := range imp.RetencionesDR.RetencionDR {
+						c.requerido(r.BaseDR)
+						c.requerido(r.ImpuestoDR)
+						c.requerido(r.TipoFactorDR)
+						c.requerido(r.TasaOCuotaDR)
+						c.requerido(r.ImporteDR)
+					}
+				}
+				if imp.TrasladosDR != nil {
+					for _, tr := range imp.TrasladosDR.TrasladoDR {
+						c.requerido(tr.BaseDR)
+						c.requerido(tr.ImpuestoDR)
+						c.requerido(tr.TipoFactorDR)
+						c.opcional(tr.TasaOCuotaDR)
+						c.opcional(tr.ImporteDR)
+					}
+				}
+			}
+		}
+
+		if imp := p.ImpuestosP; imp != nil {
+			if imp.RetencionesP != nil {
+				for _, r := range imp.RetencionesP.RetencionP {
+					c.requerido(r.ImpuestoP)
+					c.requerido(r.ImporteP)
+				}
+			}
+			if imp.TrasladosP != nil {
+				for _, tr := range imp.TrasladosP.TrasladoP {
+					c.requerido(tr.BaseP)
+					c.requerido(tr.ImpuestoP)
+					c.requerido(tr.TipoFactorP)
+					c.opcional(tr.TasaOCuotaP)
+					c.opcional(tr.ImporteP)
+				}
+			}
+		}
+	}
+}
+
+// GenerarCadenaOriginalTFD construye la cadena original del complemento TimbreFiscalDigital 1.1
+func GenerarCadenaOriginalTFD(timbre TimbreFiscalDigital) string {
+	var c cadenaBuilder
+
+	c.requerido(ifEmpty(timbre.Version, "1.1"))
+	c.requerido(timbre.UUID)
+	c.requerido(timbre.FechaTimbrado)
+	c.requerido(timbre.RfcProvCertif)
+	c.opcional(timbre.Leyenda)
+	c.requerido(timbre.SelloCFD)
+	c.requerido(timbre.NoCertificadoSAT)
+
+	return c.cerrar()
+}
@@ -0,0 +1,381 @@
+package services
+
+import "testing"
+
+// Las cadenas esperadas se armaron aplicando cadenaoriginal_4_0.xslt, pagos20.xslt y
+// cadenaoriginal_TFD_1_1.xslt del SAT a los comprobantes de cada caso
+
+var (
+	emisorPrueba = CFDIEmisor{
+		Rfc:           "EKU9003173C9",
+		Nombre:        "ESCUELA KEMPER URGATE",
+		RegimenFiscal: "601",
+	}
+	receptorPrueba = CFDIReceptor{
+		Rfc:                     "URE180429TM6",
+		Nombre:                  "UNIVERSIDAD ROBOTICA ESPAÑOLA",
+		DomicilioFiscalReceptor: "86991",
+		RegimenFiscalReceptor:   "601",
+		UsoCFDI:                 "G01",
+	}
+)
+
+func trasladoIVA16(base, importe string) CFDIConceptoTraslado {
+	return CFDIConceptoTraslado{Base: base, Impuesto: "002", TipoFactor: "Tasa", TasaOCuota: "0.160000", Importe: importe}
+}
+
+func TestGenerarCadenaOriginal(t *testing.T) {
+	casos := []struct {
+		nombre      string
+		comprobante CFDIComprobante
+		esperada    string
+	}{
+		{
+			nombre: "ingreso con IVA y espacios a normalizar",
+			comprobante: CFDIComprobante{
+				Version:           "4.0",
+				Serie:             "A",
+				Folio:             "123",
+				Fecha:             "2023-06-01T12:00:00",
+				FormaPago:         "01",
+				NoCertificado:     "30001000000400002434",
+				SubTotal:          "100.00",
+				Moneda:            "MXN",
+				Total:             "116.00",
+				TipoDeComprobante: "I",
+				Exportacion:       "01",
+				MetodoPago:        "PUE",
+				LugarExpedicion:   "42501",
+				Emisor:            emisorPrueba,
+				Receptor:          receptorPrueba,
+				Conceptos: CFDIConceptos{Concepto: []CFDIConcepto{{
+					ClaveProdServ:    "01010101",
+					NoIdentificacion: "SKU1",
+					Cantidad:         "1.00",
+					ClaveUnidad:      "H87",
+					Descripcion:      "  Producto   de\tprueba\n",
+					ValorUnitario:    "100.00",
+					Importe:          "100.00",
+					ObjetoImp:        "02",
+					Impuestos: &CFDIConceptoImpuestos{
+						Traslados: &CFDIConceptoTraslados{Traslado: []CFDIConceptoTraslado{trasladoIVA16("100.00", "16.00")}},
+					},
+				}}},
+				Impuestos: &CFDIImpuestos{
+					TotalImpuestosTrasladados: "16.00",
+					Traslados: &CFDITraslados{Traslado: []CFDITraslado{
+						{Base: "100.00", Impuesto: "002", TipoFactor: "Tasa", TasaOCuota: "0.160000", Importe: "16.00"},
+					}},
+				},
+			},
+			esperada: "||4.0|A|123|2023-06-01T12:00:00|01|30001000000400002434|100.00|MXN|116.00|I|01|PUE|42501" +
+				"|EKU9003173C9|ESCUELA KEMPER URGATE|601" +
+				"|URE180429TM6|UNIVERSIDAD ROBOTICA ESPAÑOLA|86991|601|G01" +
+				"|01010101|SKU1|1.00|H87|Producto de prueba|100.00|100.00|02|100.00|002|Tasa|0.160000|16.00" +
+				"|100.00|002|Tasa|0.160000|16.00|16.00||",
+		},
+		{
+			nombre: "receptor extranjero con retenciones, exento y confirmación",
+			comprobante: CFDIComprobante{
+				Version:           "4.0",
+				Folio:             "77",
+				Fecha:             "2023-06-01T12:00:00",
+				FormaPago:         "03",
+				NoCertificado:     "30001000000400002434",
+				CondicionesDePago: "CONTADO",
+				SubTotal:          "1200.00",
+				Descuento:         "50.00",
+				Moneda:            "USD",
+				TipoCambio:        "17.500000",
+				Total:             "1105.67",
+				TipoDeComprobante: "I",
+				Exportacion:       "02",
+				MetodoPago:        "PPD",
+				LugarExpedicion:   "42501",
+				Confirmacion:      "ECVH1",
+				Emisor: CFDIEmisor{
+					Rfc:              "EKU9003173C9",
+					Nombre:           "ESCUELA KEMPER URGATE",
+					RegimenFiscal:    "601",
+					FacAtrAdquirente: "0123456789",
+				},
+				Receptor: CFDIReceptor{
+					Rfc:                     "XEXX010101000",
+					Nombre:                  "ACME INC",
+					DomicilioFiscalReceptor: "42501",
+					ResidenciaFiscal:        "USA",
+					NumRegIdTrib:            "123456789",
+					RegimenFiscalReceptor:   "616",
+					UsoCFDI:                 "S01",
+				},
+				Conceptos: CFDIConceptos{Concepto: []CFDIConcepto{
+					{
+						ClaveProdServ: "84111506",
+						Cantidad:      "1",
+						ClaveUnidad:   "E48",
+						Unidad:        "Servicio",
+						Descripcion:   "Honorarios",
+						ValorUnitario: "1000.00",
+						Importe:       "1000.00",
+						Descuento:     "50.00",
+						ObjetoImp:     "02",
+						Impuestos: &CFDIConceptoImpuestos{
+							Traslados: &CFDIConceptoTraslados{Traslado: []CFDIConceptoTraslado{trasladoIVA16("950.00", "152.00")}},
+							Retenciones: &CFDIConceptoRetenciones{Retencion: []CFDIConceptoRetencion{
+								{Base: "950.00", Impuesto: "001", TipoFactor: "Tasa", TasaOCuota: "0.100000", Importe: "95.00"},
+								{Base: "950.00", Impuesto: "002", TipoFactor: "Tasa", TasaOCuota: "0.106667", Importe: "101.33"},
+							}},
+						},
+					},
+					{
+						ClaveProdServ: "01010101",
+						Cantidad:      "2",
+						ClaveUnidad:   "H87",
+						Descripcion:   "Libro",
+						ValorUnitario: "100.00",
+						Importe:       "200.00",
+						ObjetoImp:     "02",
+						Impuestos: &CFDIConceptoImpuestos{
+							Traslados: &CFDIConceptoTraslados{Traslado: []CFDIConceptoTraslado{
+								{Base: "200.00", Impuesto: "002", TipoFactor: "Exento"},
+							}},
+						},
+					},
+				}},
+				Impuestos: &CFDIImpuestos{
+					TotalImpuestosRetenidos:   "196.33",
+					TotalImpuestosTrasladados: "152.00",
+					Retenciones: &CFDIRetenciones{Retencion: []CFDIRetencion{
+						{Impuesto: "001", Importe: "95.00"},
+						{Impuesto: "002", Importe: "101.33"},
+					}},
+					Traslados: &CFDITraslados{Traslado: []CFDITraslado{
+						{Base: "950.00", Impuesto: "002", TipoFactor: "Tasa", TasaOCuota: "0.160000", Importe: "152.00"},
+						{Base: "200.00", Impuesto: "002", TipoFactor: "Exento"},
+					}},
+				},
+			},
+			esperada: "||4.0|77|2023-06-01T12:00:00|03|30001000000400002434|CONTADO|1200.00|50.00|USD|17.500000|1105.67|I|02|PPD|42501|ECVH1" +
+				"|EKU9003173C9|ESCUELA KEMPER URGATE|601|0123456789" +
+				"|XEXX010101000|ACME INC|42501|USA|123456789|616|S01" +
+				"|84111506|1|E48|Servicio|Honorarios|1000.00|1000.00|50.00|02" +
+				"|950.00|002|Tasa|0.160000|152.00" +
+				"|950.00|001|Tasa|0.100000|95.00|950.00|002|Tasa|0.106667|101.33" +
+				"|01010101|2|H87|Libro|100.00|200.00|02|200.00|002|Exento" +
+				"|001|95.00|002|101.33|196.33" +
+				"|950.00|002|Tasa|0.160000|152.00|200.00|002|Exento|152.00||",
+		},
+		{
+			nombre: "global con relacionados, terceros, aduana, predial y partes",
+			comprobante: CFDIComprobante{
+				Version:           "4.0",
+				Serie:             "G",
+				Folio:             "1",
+				Fecha:             "2023-06-01T12:00:00",
+				FormaPago:         "01",
+				NoCertificado:     "30001000000400002434",
+				SubTotal:          "10.00",
+				Moneda:            "MXN",
+				Total:             "10.00",
+				TipoDeComprobante: "I",
+				Exportacion:       "01",
+				MetodoPago:        "PUE",
+				LugarExpedicion:   "42501",
+				InformacionGlobal: &CFDIInformacionGlobal{Periodicidad: "01", Meses: "06", Anio: "2023"},
+				CfdiRelacionados: &CFDIRelacionados{
+					TipoRelacion: "04",
+					CfdiRelacionado: []CFDIRelacionadoUUID{
+						{UUID: "5FB2822E-396D-4725-8521-CDC4BDD20CCF"},
+						{UUID: "6A3E1B2C-0F4D-4E5A-9B8C-7D6E5F4A3B2C"},
+					},
+				},
+				Emisor: emisorPrueba,
+				Receptor: CFDIReceptor{
+					Rfc:                     "XAXX010101000",
+					Nombre:                  "PUBLICO EN GENERAL",
+					DomicilioFiscalReceptor: "42501",
+					RegimenFiscalReceptor:   "616",
+					UsoCFDI:                 "S01",
+				},
+				Conceptos: CFDIConceptos{Concepto: []CFDIConcepto{{
+					ClaveProdServ: "01010101",
+					Cantidad:      "1",
+					ClaveUnidad:   "ACT",
+					Descripcion:   "Venta",
+					ValorUnitario: "10.00",
+					Importe:       "10.00",
+					ObjetoImp:     "01",
+					ACuentaTerceros: &CFDIACuentaTerceros{
+						RfcACuentaTerceros:             "CACX7605101P8",
+						NombreACuentaTerceros:          "XOCHILT CASAS CHAVEZ",
+						RegimenFiscalACuentaTerceros:   "612",
+						DomicilioFiscalACuentaTerceros: "10740",
+					},
+					InformacionAduanera: []CFDIInformacionAduanera{{NumeroPedimento: "21  47  3807  8003832"}},
+					CuentaPredial:       []CFDICuentaPredial{{Numero: "15956011002"}},
+					Parte: []CFDIParte{{
+						ClaveProdServ:       "25173108",
+						Cantidad:            "1",
+						Descripcion:         "Pieza",
+						ValorUnitario:       "5.00",
+						Importe:             "5.00",
+						InformacionAduanera: []CFDIInformacionAduanera{{NumeroPedimento: "21  47  3807  8003833"}},
+					}},
+				}}},
+			},
+			esperada: "||4.0|G|1|2023-06-01T12:00:00|01|30001000000400002434|10.00|MXN|10.00|I|01|PUE|42501" +
+				"|01|06|2023|04|5FB2822E-396D-4725-8521-CDC4BDD20CCF|6A3E1B2C-0F4D-4E5A-9B8C-7D6E5F4A3B2C" +
+				"|EKU9003173C9|ESCUELA KEMPER URGATE|601" +
+				"|XAXX010101000|PUBLICO EN GENERAL|42501|616|S01" +
+				"|01010101|1|ACT|Venta|10.00|10.00|01" +
+				"|CACX7605101P8|XOCHILT CASAS CHAVEZ|612|10740" +
+				"|21 47 3807 8003832|15956011002" +
+				"|25173108|1|Pieza|5.00|5.00|21 47 3807 8003833||",
+		},
+		{
+			nombre: "recepción de pagos con retenciones y cuentas bancarias",
+			comprobante: CFDIComprobante{
+				Version:           "4.0",
+				Serie:             "P",
+				Folio:             "10",
+				Fecha:             "2023-06-15T12:00:00",
+				NoCertificado:     "30001000000400002434",
+				SubTotal:          "0",
+				Moneda:            "XXX",
+				Total:             "0",
+				TipoDeComprobante: "P",
+				Exportacion:       "01",
+				LugarExpedicion:   "42501",
+				Emisor:            emisorPrueba,
+				Receptor: CFDIReceptor{
+					Rfc:                     "URE180429TM6",
+					Nombre:                  "UNIVERSIDAD ROBOTICA ESPAÑOLA",
+					DomicilioFiscalReceptor: "86991",
+					RegimenFiscalReceptor:   "601",
+					UsoCFDI:                 "CP01",
+				},
+				Conceptos: CFDIConceptos{Concepto: []CFDIConcepto{{
+					ClaveProdServ: "84111506",
+					Cantidad:      "1",
+					ClaveUnidad:   "ACT",
+					Descripcion:   "Pago",
+					ValorUnitario: "0",
+					Importe:       "0",
+					ObjetoImp:     "01",
+				}}},
+				Complemento: &CFDIComplemento{Pagos: &Pagos20{
+					Version: "2.0",
+					Totales: Pagos20Totales{
+						TotalRetencionesIVA:         "10.67",
+						TotalRetencionesISR:         "10.00",
+						TotalTrasladosBaseIVA16:     "100.00",
+						TotalTrasladosImpuestoIVA16: "16.00",
+						MontoTotalPagos:             "95.33",
+					},
+					Pago: []Pago20{{
+						FechaPago:       "2023-06-15T10:00:00",
+						FormaDePagoP:    "03",
+						MonedaP:         "MXN",
+						TipoCambioP:     "1",
+						Monto:           "95.33",
+						NumOperacion:    "OP-1",
+						RfcEmisorCtaOrd: "BSM970519DU8",
+						CtaOrdenante:    "1234567890",
+						RfcEmisorCtaBen: "BBA830831LJ2",
+						CtaBeneficiario: "0987654321",
+						DoctoRelacionado: []Pago20DoctoRelacionado{{
+							IdDocumento:      "5FB2822E-396D-4725-8521-CDC4BDD20CCF",
+							Serie:            "A",
+							Folio:            "5",
+							MonedaDR:         "MXN",
+							EquivalenciaDR:   "1",
+							NumParcialidad:   "1",
+							ImpSaldoAnt:      "95.33",
+							ImpPagado:        "95.33",
+							ImpSaldoInsoluto: "0.00",
+							ObjetoImpDR:      "02",
+							ImpuestosDR: &Pago20ImpuestosDR{
+								RetencionesDR: &Pago20RetencionesDR{RetencionDR: []Pago20RetencionDR{
+									{BaseDR: "100.00", ImpuestoDR: "001", TipoFactorDR: "Tasa", TasaOCuotaDR: "0.100000", ImporteDR: "10.00"},
+									{BaseDR: "100.00", ImpuestoDR: "002", TipoFactorDR: "Tasa", TasaOCuotaDR: "0.106667", ImporteDR: "10.67"},
+								}},
+								TrasladosDR: &Pago20TrasladosDR{TrasladoDR: []Pago20TrasladoDR{
+									{BaseDR: "100.00", ImpuestoDR: "002", TipoFactorDR: "Tasa", TasaOCuotaDR: "0.160000", ImporteDR: "16.00"},
+								}},
+							},
+						}},
+						ImpuestosP: &Pago20ImpuestosP{
+							RetencionesP: &Pago20RetencionesP{RetencionP: []Pago20RetencionP{
+								{ImpuestoP: "001", ImporteP: "10.00"},
+								{ImpuestoP: "002", ImporteP: "10.67"},
+							}},
+							TrasladosP: &Pago20TrasladosP{TrasladoP: []Pago20TrasladoP{
+								{BaseP: "100.00", ImpuestoP: "002", TipoFactorP: "Tasa", TasaOCuotaP: "0.160000", ImporteP: "16.00"},
+							}},
+						},
+					}},
+				}},
+			},
+			esperada: "||4.0|P|10|2023-06-15T12:00:00|30001000000400002434|0|XXX|0|P|01|42501" +
+				"|EKU9003173C9|ESCUELA KEMPER URGATE|601" +
+				"|URE180429TM6|UNIVERSIDAD ROBOTICA ESPAÑOLA|86991|601|CP01" +
+				"|84111506|1|ACT|Pago|0|0|01" +
+				"|2.0|10.67|10.00|100.00|16.00|95.33" +
+				"|2023-06-15T10:00:00|03|MXN|1|95.33|OP-1|BSM970519DU8|1234567890|BBA830831LJ2|0987654321" +
+				"|5FB2822E-396D-4725-8521-CDC4BDD20CCF|A|5|MXN|1|1|95.33|95.33|0.00|02" +
+				"|100.00|001|Tasa|0.100000|10.00|100.00|002|Tasa|0.106667|10.67" +
+				"|100.00|002|Tasa|0.160000|16.00" +
+				"|001|10.00|002|10.67" +
+				"|100.00|002|Tasa|0.160000|16.00||",
+		},
+	}
+
+	for _, caso := range casos {
+		t.Run(caso.nombre, func(t *testing.T) {
+			if obtenida := GenerarCadenaOriginal(caso.comprobante); obtenida != caso.esperada {
+				t.Errorf("cadena original distinta\nobtenida: %s\nesperada: %s", obtenida, caso.esperada)
+			}
+		})
+	}
+}
+
+func TestGenerarCadenaOriginalTFD(t *testing.T) {
+	casos := []struct {
+		nombre   string
+		timbre   TimbreFiscalDigital
+		esperada string
+	}{
+		{
+			nombre: "sin leyenda y versión por omisión",
+			timbre: TimbreFiscalDigital{
+				UUID:             "5FB2822E-396D-4725-8521-CDC4BDD20CCF",
+				FechaTimbrado:    "2023-06-01T12:00:05",
+				RfcProvCertif:    "SPR190613I52",
+				SelloCFD:         "aBc+/=",
+				NoCertificadoSAT: "30001000000400002495",
+			},
+			esperada: "||1.1|5FB2822E-396D-4725-8521-CDC4BDD20CCF|2023-06-01T12:00:05|SPR190613I52|aBc+/=|30001000000400002495||",
+		},
+		{
+			nombre: "con leyenda",
+			timbre: TimbreFiscalDigital{
+				Version:          "1.1",
+				UUID:             "5FB2822E-396D-4725-8521-CDC4BDD20CCF",
+				FechaTimbrado:    "2023-06-01T12:00:05",
+				RfcProvCertif:    "SPR190613I52",
+				Leyenda:          "Leyenda  del   PAC",
+				SelloCFD:         "aBc+/=",
+				NoCertificadoSAT: "30001000000400002495",
+			},
+			esperada: "||1.1|5FB2822E-396D-4725-8521-CDC4BDD20CCF|2023-06-01T12:00:05|SPR190613I52|Leyenda del PAC|aBc+/=|30001000000400002495||",
+		},
+	}
+
+	for _, caso := range casos {
+		t.Run(caso.nombre, func(t *testing.T) {
+			if obtenida := GenerarCadenaOriginalTFD(caso.timbre); obtenida != caso.esperada {
+				t.Errorf("cadena del timbre distinta\nobtenida: %s\nesperada: %s", obtenida, caso.esperada)
+			}
+		})
+	}
+}
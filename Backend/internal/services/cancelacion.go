@@ -0,0 +1,60 @@
+package services
+
+import (
+	"Facts/internal/models"
+	"Facts/internal/pac"
+	"Facts/internal/secretos"
+	"Facts/internal/utils"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// SolicitudCancelacionCSD arma la solicitud de cancelación con el CSD del emisor. Se envían el .cer y el
+// .key original (cifrado) con su contraseña; secretos confirma que la llave corresponde al certificado
+// sin entregarla descifrada.
+func SolicitudCancelacionCSD(emisor models.Factura, uuid, motivo, folioSustitucion string) (pac.SolicitudCancelacion, error) {
+	var solicitud pac.SolicitudCancelacion
+	if emisor.Certificado == "" {
+		if err := asignarCertificadoCFDI(&emisor); err != nil {
+			return solicitud, fmt.Errorf("error obteniendo certificado: %w", err)
+		}
+	}
+	cerDER, err := base64.StdEncoding.DecodeString(emisor.Certificado)
+	if err != nil {
+		return solicitud, fmt.Errorf("certificado del CSD inválido: %w", err)
+	}
+	if bloque, _ := pem.Decode(cerDER); bloque != nil {
+		cerDER = bloque.Bytes
+	}
+	cert, err := x509.ParseCertificate(cerDER)
+	if err != nil {
+		return solicitud, fmt.Errorf("no se pudo parsear el certificado: %w", err)
+	}
+
+	id := secretos.IdentidadCSD{RFC: emisor.EmisorRFC, NoCertificado: utils.NumeroCertificadoCSD(cert)}
+	llaveCifrada, clave, err := secretos.ArchivoLlaveCSD(emisor.KeyPath, emisor.ClaveCSD, id)
+	if err != nil {
+		return solicitud, err
+	}
+	corresponde, err := secretos.LlaveCorrespondeCertificado(emisor.KeyPath, emisor.ClaveCSD, cert, id)
+	if err != nil {
+		return solicitud, err
+	}
+	if !corresponde {
+		return solicitud, errors.New("la llave privada no corresponde al certificado del CSD")
+	}
+
+	solicitud = pac.SolicitudCancelacion{
+		RFCEmisor:        emisor.EmisorRFC,
+		UUID:             uuid,
+		Motivo:           motivo,
+		FolioSustitucion: folioSustitucion,
+		Certificado:      cert.Raw,
+		LlaveCifrada:     llaveCifrada,
+		ClaveLlave:       clave,
+	}
+	return solicitud, nil
+}
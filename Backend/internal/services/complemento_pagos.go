@@ -0,0 +1,525 @@
+package services
+
+import (
+	"Facts/internal/models"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Complemento para recepción de pagos 2.0 (REP): comprobante tipo "P" con el nodo pago20:Pagos
+
+const (
+	namespacePagos20      = "http://www.sat.gob.mx/Pagos20"
+	schemaLocationPagos20 = "http://www.sat.gob.mx/Pagos20 http://www.sat.gob.mx/sitio_internet/cfd/Pagos/Pagos20.xsd"
+)
+
+type CFDIComplemento struct {
+	Pagos *Pagos20 `xml:"pago20:Pagos,omitempty"`
+}
+
+type Pagos20 struct {
+	Version string         `xml:"Version,attr"`
+	Totales Pagos20Totales `xml:"pago20:Totales"`
+	Pago    []Pago20       `xml:"pago20:Pago"`
+}
+
+type Pagos20Totales struct {
+	TotalRetencionesIVA         string `xml:"TotalRetencionesIVA,attr,omitempty"`
+	TotalRetencionesISR         string `xml:"TotalRetencionesISR,attr,omitempty"`
+	TotalRetencionesIEPS        string `xml:"TotalRetencionesIEPS,attr,omitempty"`
+	TotalTrasladosBaseIVA16     string `xml:"TotalTrasladosBaseIVA16,attr,omitempty"`
+	TotalTrasladosImpuestoIVA16 string `xml:"TotalTrasladosImpuestoIVA16,attr,omitempty"`
+	TotalTrasladosBaseIVA8      string `xml:"TotalTrasladosBaseIVA8,attr,omitempty"`
+	TotalTrasladosImpuestoIVA8  string `xml:"TotalTrasladosImpuestoIVA8,attr,omitempty"`
+	TotalTrasladosBaseIVA0      string `xml:"TotalTrasladosBaseIVA0,attr,omitempty"`
+	TotalTrasladosImpuestoIVA0  string `xml:"TotalTrasladosImpuestoIVA0,attr,omitempty"`
+	TotalTrasladosBaseIVAExento string `xml:"TotalTrasladosBaseIVAExento,attr,omitempty"`
+	MontoTotalPagos             string `xml:"MontoTotalPagos,attr"`
+}
+
+type Pago20 struct {
+	FechaPago        string                   `xml:"FechaPago,attr"`
+	FormaDePagoP     string                   `xml:"FormaDePagoP,attr"`
+	MonedaP          string                   `xml:"MonedaP,attr"`
+	TipoCambioP      string                   `xml:"TipoCambioP,attr,omitempty"`
+	Monto            string                   `xml:"Monto,attr"`
+	NumOperacion     string                   `xml:"NumOperacion,attr,omitempty"`
+	RfcEmisorCtaOrd  string                   `xml:"RfcEmisorCtaOrd,attr,omitempty"`
+	NomBancoOrdExt   string                   `xml:"NomBancoOrdExt,attr,omitempty"`
+	CtaOrdenante     string                   `xml:"CtaOrdenante,attr,omitempty"`
+	RfcEmisorCtaBen  string                   `xml:"RfcEmisorCtaBen,attr,omitempty"`
+	CtaBeneficiario  string                   `xml:"CtaBeneficiario,attr,omitempty"`
+	TipoCadPago      string                   `xml:"TipoCadPago,attr,omitempty"`
+	CertPago         string                   `xml:"CertPago,attr,omitempty"`
+	CadPago          string                   `xml:"CadPago,attr,omitempty"`
+	SelloPago        string                   `xml:"SelloPago,attr,omitempty"`
+	DoctoRelacionado []Pago20DoctoRelacionado `xml:"pago20:DoctoRelacionado"`
+	ImpuestosP       *Pago20ImpuestosP        `xml:"pago20:ImpuestosP,omitempty"`
+}
+
+type Pago20DoctoRelacionado struct {
+	IdDocumento      string             `xml:"IdDocumento,attr"`
+	Serie            string             `xml:"Serie,attr,omitempty"`
+	Folio            string             `xml:"Folio,attr,omitempty"`
+	MonedaDR         string             `xml:"MonedaDR,attr"`
+	EquivalenciaDR   string             `xml:"EquivalenciaDR,attr,omitempty"`
+	NumParcialidad   string             `xml:"NumParcialidad,attr"`
+	ImpSaldoAnt      string             `xml:"ImpSaldoAnt,attr"`
+	ImpPagado        string             `xml:"ImpPagado,attr"`
+	ImpSaldoInsoluto string             `xml:"ImpSaldoInsoluto,attr"`
+	ObjetoImpDR      string             `xml:"ObjetoImpDR,attr"`
+	ImpuestosDR      *Pago20ImpuestosDR `xml:"pago20:ImpuestosDR,omitempty"`
+}
+
+type Pago20ImpuestosDR struct {
+	RetencionesDR *Pago20RetencionesDR `xml:"pago20:RetencionesDR,omitempty"`
+	TrasladosDR   *Pago20TrasladosDR   `xml:"pago20:TrasladosDR,omitempty"`
+}
+
+type Pago20RetencionesDR struct {
+	RetencionDR []Pago20RetencionDR `xml:"pago20:RetencionDR"`
+}
+
+type Pago20RetencionDR struct {
+	BaseDR       string `xml:"BaseDR,attr"`
+	ImpuestoDR   string `xml:"ImpuestoDR,attr"`
+	TipoFactorDR string `xml:"TipoFactorDR,attr"`
+	TasaOCuotaDR string `xml:"TasaOCuotaDR,attr"`
+	ImporteDR    string `xml:"ImporteDR,attr"`
+}
+
+type Pago20TrasladosDR struct {
+	TrasladoDR []Pago20TrasladoDR `xml:"pago20:TrasladoDR"`
+}
+
+type Pago20TrasladoDR struct {
+	BaseDR       string `xml:"BaseDR,attr"`
+	ImpuestoDR   string `xml:"ImpuestoDR,attr"`
+	TipoFactorDR string `xml:"TipoFactorDR,attr"`
+	TasaOCuotaDR string `xml:"TasaOCuotaDR,attr,omitempty"`
+	ImporteDR    string `xml:"ImporteDR,attr,omitempty"`
+}
+
+type Pago20ImpuestosP struct {
+	RetencionesP *Pago20RetencionesP `xml:"pago20:RetencionesP,omitempty"`
+	TrasladosP   *Pago20TrasladosP   `xml:"pago20:TrasladosP,omitempty"`
+}
+
+type Pago20RetencionesP struct {
+	RetencionP []Pago20RetencionP `xml:"pago20:RetencionP"`
+}
+
+type Pago20RetencionP struct {
+	ImpuestoP string `xml:"ImpuestoP,attr"`
+	ImporteP  string `xml:"ImporteP,attr"`
+}
+
+type Pago20TrasladosP struct {
+	TrasladoP []Pago20TrasladoP `xml:"pago20:TrasladoP"`
+}
+
+type Pago20TrasladoP struct {
+	BaseP       string `xml:"BaseP,attr"`
+	ImpuestoP   string `xml:"ImpuestoP,attr"`
+	TipoFactorP string `xml:"TipoFactorP,attr"`
+	TasaOCuotaP string `xml:"TasaOCuotaP,attr,omitempty"`
+	ImporteP    string `xml:"ImporteP,attr,omitempty"`
+}
+
+func redondear(valor float64, decimales int) float64 {
+	p := math.Pow(10, float64(decimales))
+	return math.Round(valor*p) / p
+}
+
+// formatDecimal da formato con hasta "decimales" posiciones, sin ceros sobrantes (TipoCambioP, EquivalenciaDR)
+func formatDecimal(valor float64, decimales int) string {
+	s := strconv.FormatFloat(redondear(valor, decimales), 'f', decimales, 64)
+	s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	if s == "" || s == "-0" {
+		return "0"
+	}
+	return s
+}
+
+// acumuladoTraslado agrupa bases e importes por impuesto, tipo de factor y tasa
+type acumuladoTraslado struct {
+	impuesto   string
+	tipoFactor string
+	tasa       float64
+	base       float64
+	importe    float64
+}
+
+func claveTraslado(impuesto, tipoFactor string, tasa float64) string {
+	return fmt.Sprintf("%s|%s|%.6f", impuesto, tipoFactor, tasa)
+}
+
+// ValidarPago revisa las reglas del SAT que no dependen de la base de datos
+func ValidarPago(pago models.Pago) error {
+	if pago.FechaPago == "" {
+		return fmt.Errorf("la fecha de pago es requerida")
+	}
+	if pago.FormaDePagoP == "" || pago.FormaDePagoP == "99" {
+		return fmt.Errorf("la forma de pago es requerida y no puede ser 99 (por definir)")
+	}
+	monedaP := ifEmpty(pago.MonedaP, "MXN")
+	if monedaP == "XXX" {
+		return fmt.Errorf("la moneda del pago no puede ser XXX")
+	}
+	if monedaP != "MXN" && pago.TipoCambioP <= 0 {
+		return fmt.Errorf("el tipo de cambio es requerido cuando la moneda del pago es %s", monedaP)
+	}
+	if len(pago.Documentos) == 0 {
+		return fmt.Errorf("el pago debe aplicarse al menos a un documento")
+	}
+	var sumaPagado float64
+	for i, d := range pago.Documentos {
+		if d.IdDocumento == "" {
+			return fmt.Errorf("documento %d: falta el UUID del documento relacionado", i+1)
+		}
+		if d.ImpPagado <= 0 {
+			return fmt.Errorf("documento %d: el importe pagado debe ser mayor a cero", i+1)
+		}
+		if d.ImpPagado > d.ImpSaldoAnt+0.01 {
+			return fmt.Errorf("documento %d: el importe pagado (%.2f) excede el saldo anterior (%.2f)", i+1, d.ImpPagado, d.ImpSaldoAnt)
+		}
+		if d.MetodoPago != "" && d.MetodoPago != "PPD" {
+			return fmt.Errorf("documento %d: el complemento de pago solo aplica a facturas PPD (método %s)", i+1, d.MetodoPago)
+		}
+		if d.ObjetoImpDR == "02" && len(d.Impuestos) == 0 {
+			return fmt.Errorf("documento %d: ObjetoImpDR 02 requiere los impuestos del documento pagado", i+1)
+		}
+		if ifEmpty(d.MonedaDR, "MXN") != monedaP && d.EquivalenciaDR <= 0 {
+			return fmt.Errorf("documento %d: la equivalencia es requerida cuando la moneda del documento difiere de la del pago", i+1)
+		}
+		sumaPagado += d.ImpPagado / equivalenciaDocumento(d, monedaP)
+	}
+	if pago.Monto > 0 && pago.Monto+0.01 < redondear(sumaPagado, 2) {
+		return fmt.Errorf("el monto del pago (%.2f) es menor a la suma de los importes pagados (%.2f)", pago.Monto, sumaPagado)
+	}
+	return nil
+}
+
+func equivalenciaDocumento(d models.DocumentoPago, monedaP string) float64 {
+	if ifEmpty(d.MonedaDR, "MXN") == monedaP || d.EquivalenciaDR <= 0 {
+		return 1
+	}
+	return d.EquivalenciaDR
+}
+
+// DocumentoPagoDesdeXML completa el documento pagado con los datos de su CFDI timbrado: UUID, serie,
+// moneda, total y los impuestos de sus conceptos acumulados por impuesto, tipo de factor y tasa. Solo
+// se aceptan facturas de ingreso con método de pago PPD.
+func DocumentoPagoDesdeXML(d *models.DocumentoPago, xmlTimbrado []byte) error {
+	ri, err := LeerRepresentacionImpresa(xmlTimbrado)
+	if err != nil {
+		return err
+	}
+	if ri.Timbre == nil || ri.Timbre.UUID == "" {
+		return fmt.Errorf("el CFDI no está timbrado")
+	}
+	if ri.TipoDeComprobante != "I" {
+		return fmt.Errorf("el CFDI %s es de tipo %s; solo se reciben pagos de facturas de ingreso", ri.Timbre.UUID, ri.TipoDeComprobante)
+	}
+	if ri.MetodoPago != "PPD" {
+		return fmt.Errorf("el CFDI %s tiene método de pago %s; el complemento de pago solo aplica a facturas PPD", ri.Timbre.UUID, ifEmpty(ri.MetodoPago, "sin definir"))
+	}
+	total, err := strconv.ParseFloat(ri.Total, 64)
+	if err != nil || total <= 0 {
+		return fmt.Errorf("el CFDI %s tiene un total inválido: %q", ri.Timbre.UUID, ri.Total)
+	}
+
+	d.IdDocumento = strings.ToUpper(ri.Timbre.UUID)
+	d.Serie = ri.Serie
+	d.MonedaDR = ifEmpty(ri.Moneda, "MXN")
+	d.MetodoPago = ri.MetodoPago
+	d.TotalDR = total
+	d.Impuestos = nil
+
+	indices := map[string]int{}
+	acumular := func(retencion bool, imp ImpuestoImpreso) error {
+		base, err := strconv.ParseFloat(imp.Base, 64)
+		if err != nil {
+			return fmt.Errorf("el CFDI %s tiene una base de impuesto inválida: %q", ri.Timbre.UUID, imp.Base)
+		}
+		importe, _ := strconv.ParseFloat(imp.Importe, 64)
+		clave := fmt.Sprintf("%t|%s|%s|%s", retencion, imp.Impuesto, imp.TipoFactor, imp.TasaOCuota)
+		i, ok := indices[clave]
+		if !ok {
+			i = len(d.Impuestos)
+			indices[clave] = i
+			d.Impuestos = append(d.Impuestos, models.ImpuestoDocumento{
+				Retencion:  retencion,
+				Impuesto:   imp.Impuesto,
+				TipoFactor: imp.TipoFactor,
+				TasaOCuota: imp.TasaOCuota,
+			})
+		}
+		d.Impuestos[i].Base += base
+		d.Impuestos[i].Importe += importe
+		return nil
+	}
+	for _, c := range ri.Conceptos {
+		for _, t := range c.Traslados {
+			if err := acumular(false, t); err != nil {
+				return err
+			}
+		}
+		for _, r := range c.Retenciones {
+			if err := acumular(true, r); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Sin impuestos desglosados el documento no es objeto de impuesto para el pago
+	d.ObjetoImpDR = "01"
+	if len(d.Impuestos) > 0 {
+		d.ObjetoImpDR = "02"
+	}
+	return nil
+}
+
+// proporcionPagada es la parte del documento que cubre el pago; los impuestos se desglosan en esa proporción
+func proporcionPagada(d models.DocumentoPago) float64 {
+	if d.TotalDR <= 0 {
+		return 1
+	}
+	return d.ImpPagado / d.TotalDR
+}
+
+// construirPagos20 arma el nodo pago20:Pagos con desglose de impuestos por documento, por pago y totales en MXN
+func construirPagos20(pagos []models.Pago) *Pagos20 {
+	complemento := &Pagos20{Version: "2.0"}
+	totales := map[string]*acumuladoTraslado{}
+	retencionesTotales := map[string]float64{}
+	var montoTotal float64
+
+	for _, p := range pagos {
+		monedaP := ifEmpty(p.MonedaP, "MXN")
+		tipoCambio := 1.0
+		if monedaP != "MXN" && p.TipoCambioP > 0 {
+			tipoCambio = p.TipoCambioP
+		}
+
+		nodo := Pago20{
+			FechaPago:    p.FechaPago,
+			FormaDePagoP: p.FormaDePagoP,
+			MonedaP:      monedaP,
+			TipoCambioP:  formatDecimal(tipoCambio, 6),
+			NumOperacion: p.NumOperacion,
+		}
+
+		trasladosP := map[string]*acumuladoTraslado{}
+		var ordenP []string
+		retencionesP := map[string]float64{}
+		var ordenRetP []string
+		var montoDocs float64
+
+		for _, d := range p.Documentos {
+			monedaDR := ifEmpty(d.MonedaDR, "MXN")
+			equivalencia := equivalenciaDocumento(d, monedaP)
+			saldoInsoluto := redondear(d.ImpSaldoAnt-d.ImpPagado, 2)
+			docto := Pago20DoctoRelacionado{
+				IdDocumento:      strings.ToUpper(d.IdDocumento),
+				Serie:            d.Serie,
+				Folio:            d.Folio,
+				MonedaDR:         monedaDR,
+				EquivalenciaDR:   formatDecimal(equivalencia, 10),
+				NumParcialidad:   strconv.Itoa(max(d.NumParcialidad, 1)),
+				ImpSaldoAnt:      formatFloat(d.ImpSaldoAnt),
+				ImpPagado:        formatFloat(d.ImpPagado),
+				ImpSaldoInsoluto: formatFloat(saldoInsoluto),
+				ObjetoImpDR:      ifEmpty(d.ObjetoImpDR, "01"),
+			}
+			montoDocs += d.ImpPagado / equivalencia
+
+			if docto.ObjetoImpDR == "02" && len(d.Impuestos) > 0 {
+				proporcion := proporcionPagada(d)
+				impuestosDR := &Pago20ImpuestosDR{}
+				for _, imp := range d.Impuestos {
+					base := redondear(imp.Base*proporcion, 2)
+					importe := redondear(imp.Importe*proporcion, 2)
+					if imp.Retencion {
+						if impuestosDR.RetencionesDR == nil {
+							impuestosDR.RetencionesDR = &Pago20RetencionesDR{}
+						}
+						impuestosDR.RetencionesDR.RetencionDR = append(impuestosDR.RetencionesDR.RetencionDR, Pago20RetencionDR{
+							BaseDR:       formatFloat(base),
+							ImpuestoDR:   imp.Impuesto,
+							TipoFactorDR: imp.TipoFactor,
+							TasaOCuotaDR: imp.TasaOCuota,
+							ImporteDR:    formatFloat(importe),
+						})
+						if _, ok := retencionesP[imp.Impuesto]; !ok {
+							ordenRetP = append(ordenRetP, imp.Impuesto)
+						}
+						retencionesP[imp.Impuesto] += importe / equivalencia
+						continue
+					}
+
+					traslado := Pago20TrasladoDR{
+						BaseDR:       formatFloat(base),
+						ImpuestoDR:   imp.Impuesto,
+						TipoFactorDR: imp.TipoFactor,
+					}
+					var tasa float64
+					if imp.TipoFactor != "Exento" {
+						tasa, _ = strconv.ParseFloat(imp.TasaOCuota, 64)
+						traslado.TasaOCuotaDR = imp.TasaOCuota
+						traslado.ImporteDR = formatFloat(importe)
+					} else {
+						importe = 0
+					}
+					if impuestosDR.TrasladosDR == nil {
+						impuestosDR.TrasladosDR = &Pago20TrasladosDR{}
+					}
+					impuestosDR.TrasladosDR.TrasladoDR = append(impuestosDR.TrasladosDR.TrasladoDR, traslado)
+
+					clave := claveTraslado(imp.Impuesto, imp.TipoFactor, tasa)
+					acum, ok := trasladosP[clave]
+					if !ok {
+						acum = &acumuladoTraslado{impuesto: imp.Impuesto, tipoFactor: imp.TipoFactor, tasa: tasa}
+						trasladosP[clave] = acum
+						ordenP = append(ordenP, clave)
+					}
+					acum.base += base / equivalencia
+					acum.importe += importe / equivalencia
+				}
+				docto.ImpuestosDR = impuestosDR
+			}
+			nodo.DoctoRelacionado = append(nodo.DoctoRelacionado, docto)
+		}
+
+		monto := p.Monto
+		if monto <= 0 {
+			monto = montoDocs
+		}
+		nodo.Monto = formatFloat(monto)
+		montoTotal += redondear(monto, 2) * tipoCambio
+
+		impuestosP := &Pago20ImpuestosP{}
+		if len(ordenRetP) > 0 {
+			retenciones := &Pago20RetencionesP{}
+			for _, impuesto := range ordenRetP {
+				importe := redondear(retencionesP[impuesto], 2)
+				retenciones.RetencionP = append(retenciones.RetencionP, Pago20RetencionP{
+					ImpuestoP: impuesto,
+					ImporteP:  formatFloat(importe),
+				})
+				retencionesTotales[impuesto] += importe * tipoCambio
+			}
+			impuestosP.RetencionesP = retenciones
+		}
+		if len(ordenP) > 0 {
+			traslados := &Pago20TrasladosP{}
+			for _, clave := range ordenP {
+				acum := trasladosP[clave]
+				traslado := Pago20TrasladoP{
+					BaseP:       formatFloat(acum.base),
+					ImpuestoP:   acum.impuesto,
+					TipoFactorP: acum.tipoFactor,
+				}
+				if acum.tipoFactor != "Exento" {
+					traslado.TasaOCuotaP = fmt.Sprintf("%.6f", acum.tasa)
+					traslado.ImporteP = formatFloat(acum.importe)
+				}
+				traslados.TrasladoP = append(traslados.TrasladoP, traslado)
+
+				total, ok := totales[clave]
+				if !ok {
+					total = &acumuladoTraslado{impuesto: acum.impuesto, tipoFactor: acum.tipoFactor, tasa: acum.tasa}
+					totales[clave] = total
+				}
+				total.base += redondear(acum.base, 2) * tipoCambio
+				total.importe += redondear(acum.importe, 2) * tipoCambio
+			}
+			impuestosP.TrasladosP = traslados
+		}
+		if impuestosP.RetencionesP != nil || impuestosP.TrasladosP != nil {
+			nodo.ImpuestosP = impuestosP
+		}
+
+		complemento.Pago = append(complemento.Pago, nodo)
+	}
+
+	complemento.Totales.MontoTotalPagos = formatFloat(montoTotal)
+	if v, ok := retencionesTotales["001"]; ok {
+		complemento.Totales.TotalRetencionesISR = formatFloat(v)
+	}
+	if v, ok := retencionesTotales["002"]; ok {
+		complemento.Totales.TotalRetencionesIVA = formatFloat(v)
+	}
+	if v, ok := retencionesTotales["003"]; ok {
+		complemento.Totales.TotalRetencionesIEPS = formatFloat(v)
+	}
+	claves := make([]string, 0, len(totales))
+	for clave := range totales {
+		claves = append(claves, clave)
+	}
+	sort.Strings(claves)
+	for _, clave := range claves {
+		t := totales[clave]
+		if t.impuesto != "002" {
+			continue
+		}
+		switch {
+		case t.tipoFactor == "Exento":
+			complemento.Totales.TotalTrasladosBaseIVAExento = formatFloat(t.base)
+		case t.tasa == 0.16:
+			complemento.Totales.TotalTrasladosBaseIVA16 = formatFloat(t.base)
+			complemento.Totales.TotalTrasladosImpuestoIVA16 = formatFloat(t.importe)
+		case t.tasa == 0.08:
+			complemento.Totales.TotalTrasladosBaseIVA8 = formatFloat(t.base)
+			complemento.Totales.TotalTrasladosImpuestoIVA8 = formatFloat(t.importe)
+		case t.tasa == 0:
+			complemento.Totales.TotalTrasladosBaseIVA0 = formatFloat(t.base)
+			complemento.Totales.TotalTrasladosImpuestoIVA0 = formatFloat(t.importe)
+		}
+	}
+	return complemento
+}
+
+// construirComprobantePago arma el CFDI tipo "P": importes en cero, moneda XXX, un solo concepto fijo y el complemento de pagos
+func construirComprobantePago(factura models.Factura, serie string) CFDIComprobante {
+	receptor := safeReceptor(factura)
+	receptor.UsoCFDI = "CP01"
+
+	return CFDIComprobante{
+		XMLNS:             "http://www.sat.gob.mx/cfd/4",
+		XMLNSXSI:          "http://www.w3.org/2001/XMLSchema-instance",
+		XMLNSPago20:       namespacePagos20,
+		XSISchemaLocation: "http://www.sat.gob.mx/cfd/4 http://www.sat.gob.mx/sitio_internet/cfd/4/cfdv40.xsd " + schemaLocationPagos20,
+		Version:           "4.0",
+		Serie:             serie,
+		Folio:             factura.NumeroFolio,
+		Fecha:             factura.FechaEmision,
+		NoCertificado:     factura.NoCertificado,
+		Certificado:       factura.Certificado,
+		SubTotal:          "0",
+		Moneda:            "XXX",
+		Total:             "0",
+		TipoDeComprobante: "P",
+		Exportacion:       "01",
+		LugarExpedicion:   factura.EmisorCodigoPostal,
+		Emisor: CFDIEmisor{
+			Rfc:           factura.EmisorRFC,
+			Nombre:        factura.EmisorRazonSocial,
+			RegimenFiscal: factura.EmisorRegimenFiscal,
+		},
+		Receptor: receptor,
+		Conceptos: CFDIConceptos{Concepto: []CFDIConcepto{{
+			ClaveProdServ: "84111506",
+			Cantidad:      "1",
+			ClaveUnidad:   "ACT",
+			Descripcion:   "Pago",
+			ValorUnitario: "0",
+			Importe:       "0",
+			ObjetoImp:     "01",
+		}}},
+		Complemento: &CFDIComplemento{Pagos: construirPagos20(factura.Pagos)},
+	}
+}
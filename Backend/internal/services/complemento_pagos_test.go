@@ -0,0 +1,111 @@
+package services
+
+import (
+	"strings"
+	"testing"
+
+	"Facts/internal/models"
+)
+
+// facturaPPDPrueba tiene un concepto con IVA 16%, IEPS 8% y retención de ISR 10% y otro exento de IVA;
+// total 1500 + 160 + 80 - 100 = 1640
+const facturaPPDPrueba = `<?xml version="1.0" encoding="UTF-8"?>
+<cfdi:Comprobante xmlns:cfdi="http://www.sat.gob.mx/cfd/4" xmlns:tfd="http://www.sat.gob.mx/TimbreFiscalDigital"
+ Version="4.0" Serie="A" Folio="5" Fecha="2023-06-01T12:00:00" NoCertificado="30001000000400002434"
+ SubTotal="1500.00" Moneda="MXN" Total="1640.00" TipoDeComprobante="I" Exportacion="01" MetodoPago="PPD"
+ FormaPago="99" LugarExpedicion="42501">
+ <cfdi:Emisor Rfc="EKU9003173C9" Nombre="ESCUELA KEMPER URGATE" RegimenFiscal="601"/>
+ <cfdi:Receptor Rfc="URE180429TM6" Nombre="UNIVERSIDAD ROBOTICA ESPAÑOLA" DomicilioFiscalReceptor="86991" RegimenFiscalReceptor="601" UsoCFDI="G01"/>
+ <cfdi:Conceptos>
+  <cfdi:Concepto ClaveProdServ="50202306" Cantidad="1" ClaveUnidad="H87" Descripcion="Refresco" ValorUnitario="1000.00" Importe="1000.00" ObjetoImp="02">
+   <cfdi:Impuestos>
+    <cfdi:Traslados>
+     <cfdi:Traslado Base="1000.00" Impuesto="002" TipoFactor="Tasa" TasaOCuota="0.160000" Importe="160.00"/>
+     <cfdi:Traslado Base="1000.00" Impuesto="003" TipoFactor="Tasa" TasaOCuota="0.080000" Importe="80.00"/>
+    </cfdi:Traslados>
+    <cfdi:Retenciones>
+     <cfdi:Retencion Base="1000.00" Impuesto="001" TipoFactor="Tasa" TasaOCuota="0.100000" Importe="100.00"/>
+    </cfdi:Retenciones>
+   </cfdi:Impuestos>
+  </cfdi:Concepto>
+  <cfdi:Concepto ClaveProdServ="55101500" Cantidad="1" ClaveUnidad="H87" Descripcion="Libro" ValorUnitario="500.00" Importe="500.00" ObjetoImp="02">
+   <cfdi:Impuestos>
+    <cfdi:Traslados>
+     <cfdi:Traslado Base="500.00" Impuesto="002" TipoFactor="Exento"/>
+    </cfdi:Traslados>
+   </cfdi:Impuestos>
+  </cfdi:Concepto>
+ </cfdi:Conceptos>
+ <cfdi:Complemento>
+  <tfd:TimbreFiscalDigital Version="1.1" UUID="5fb2822e-396d-4725-8521-cdc4bdd20ccf" FechaTimbrado="2023-06-01T12:00:05"
+   RfcProvCertif="SPR190613I52" SelloCFD="abc" NoCertificadoSAT="30001000000400002495" SelloSAT="def"/>
+ </cfdi:Complemento>
+</cfdi:Comprobante>`
+
+func TestDocumentoPagoDesdeXMLRechazaPUE(t *testing.T) {
+	xmlPUE := strings.Replace(facturaPPDPrueba, `MetodoPago="PPD"`, `MetodoPago="PUE"`, 1)
+	var d models.DocumentoPago
+	err := DocumentoPagoDesdeXML(&d, []byte(xmlPUE))
+	if err == nil || !strings.Contains(err.Error(), "PPD") {
+		t.Fatalf("se esperaba rechazo de la factura PUE, se obtuvo %v", err)
+	}
+}
+
+// TestConstruirPagos20Proporcional paga la mitad de la factura: cada impuesto del documento se
+// desglosa al 50% y se acumula por pago y en los totales
+func TestConstruirPagos20Proporcional(t *testing.T) {
+	d := models.DocumentoPago{IDHistorial: 1, Folio: "5", ImpSaldoAnt: 1640, ImpPagado: 820}
+	if err := DocumentoPagoDesdeXML(&d, []byte(facturaPPDPrueba)); err != nil {
+		t.Fatalf("error al leer la factura pagada: %v", err)
+	}
+	if d.IdDocumento != "5FB2822E-396D-4725-8521-CDC4BDD20CCF" || d.ObjetoImpDR != "02" || d.TotalDR != 1640 {
+		t.Fatalf("documento mal completado: %+v", d)
+	}
+	pago := models.Pago{FechaPago: "2023-06-15T10:00:00", FormaDePagoP: "03", Documentos: []models.DocumentoPago{d}}
+	if err := ValidarPago(pago); err != nil {
+		t.Fatalf("pago inválido: %v", err)
+	}
+
+	pagos := construirPagos20([]models.Pago{pago})
+	docto := pagos.Pago[0].DoctoRelacionado[0]
+	if docto.ImpuestosDR == nil || docto.ImpuestosDR.RetencionesDR == nil || docto.ImpuestosDR.TrasladosDR == nil {
+		t.Fatalf("faltan impuestos del documento: %+v", docto.ImpuestosDR)
+	}
+
+	retenciones := docto.ImpuestosDR.RetencionesDR.RetencionDR
+	esperadaRet := Pago20RetencionDR{BaseDR: "500.00", ImpuestoDR: "001", TipoFactorDR: "Tasa", TasaOCuotaDR: "0.100000", ImporteDR: "50.00"}
+	if len(retenciones) != 1 || retenciones[0] != esperadaRet {
+		t.Errorf("RetencionesDR = %+v, se esperaba %+v", retenciones, esperadaRet)
+	}
+
+	esperadosTras := []Pago20TrasladoDR{
+		{BaseDR: "500.00", ImpuestoDR: "002", TipoFactorDR: "Tasa", TasaOCuotaDR: "0.160000", ImporteDR: "80.00"},
+		{BaseDR: "500.00", ImpuestoDR: "003", TipoFactorDR: "Tasa", TasaOCuotaDR: "0.080000", ImporteDR: "40.00"},
+		{BaseDR: "250.00", ImpuestoDR: "002", TipoFactorDR: "Exento"},
+	}
+	traslados := docto.ImpuestosDR.TrasladosDR.TrasladoDR
+	if len(traslados) != len(esperadosTras) {
+		t.Fatalf("TrasladosDR = %+v", traslados)
+	}
+	for i := range esperadosTras {
+		if traslados[i] != esperadosTras[i] {
+			t.Errorf("TrasladoDR %d = %+v, se esperaba %+v", i, traslados[i], esperadosTras[i])
+		}
+	}
+
+	impP := pagos.Pago[0].ImpuestosP
+	if impP == nil || impP.RetencionesP == nil || len(impP.RetencionesP.RetencionP) != 1 ||
+		impP.RetencionesP.RetencionP[0] != (Pago20RetencionP{ImpuestoP: "001", ImporteP: "50.00"}) {
+		t.Errorf("RetencionesP = %+v", impP)
+	}
+	if impP == nil || impP.TrasladosP == nil || len(impP.TrasladosP.TrasladoP) != 3 {
+		t.Fatalf("TrasladosP = %+v", impP)
+	}
+
+	tot := pagos.Totales
+	if tot.MontoTotalPagos != "820.00" || tot.TotalRetencionesISR != "50.00" || tot.TotalRetencionesIVA != "" ||
+		tot.TotalTrasladosBaseIVA16 != "500.00" || tot.TotalTrasladosImpuestoIVA16 != "80.00" ||
+		tot.TotalTrasladosBaseIVAExento != "250.00" {
+		t.Errorf("Totales = %+v", tot)
+	}
+}
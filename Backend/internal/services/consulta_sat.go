@@ -0,0 +1,52 @@
+package services
+
+import (
+	"Facts/internal/pac"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// ttlConsultaSAT es la vigencia por defecto de la caché de consultas al SAT
+const ttlConsultaSAT = time.Hour
+
+var consultaSAT struct {
+	once     sync.Once
+	servicio *pac.ConsultaCFDIService
+}
+
+// ConsultaSAT devuelve el cliente de consulta de estado del SAT configurado con
+// SAT_CONSULTA_URL (por defecto el servicio del SAT) y SAT_CONSULTA_TTL (ej. 30m; 0 sin caché)
+func ConsultaSAT() *pac.ConsultaCFDIService {
+	consultaSAT.once.Do(func() {
+		ttl := ttlConsultaSAT
+		if valor := os.Getenv("SAT_CONSULTA_TTL"); valor != "" {
+			if d, err := time.ParseDuration(valor); err == nil && d >= 0 {
+				ttl = d
+			} else {
+				log.Printf("[SAT] SAT_CONSULTA_TTL inválido (%q); se usa %s", valor, ttl)
+			}
+		}
+		consultaSAT.servicio = pac.NuevoConsultaCFDIService(os.Getenv("SAT_CONSULTA_URL"), ttl)
+	})
+	return consultaSAT.servicio
+}
+
+// ConsultaDesdeXML toma del CFDI timbrado los datos de la expresión impresa (emisor, receptor, total y UUID)
+func ConsultaDesdeXML(xmlTimbrado []byte) (pac.ConsultaEstado, error) {
+	ri, err := LeerRepresentacionImpresa(xmlTimbrado)
+	if err != nil {
+		return pac.ConsultaEstado{}, err
+	}
+	if ri.Timbre == nil {
+		return pac.ConsultaEstado{}, errors.New("el XML no tiene TimbreFiscalDigital; solo se pueden consultar CFDI timbrados")
+	}
+	return pac.ConsultaEstado{
+		RFCEmisor:   ri.Emisor.Rfc,
+		RFCReceptor: ri.Receptor.Rfc,
+		Total:       ri.Total,
+		UUID:        ri.Timbre.UUID,
+	}, nil
+}
@@ -0,0 +1,233 @@
+package services
+
+import (
+	"Facts/internal/models"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Claves del catálogo c_Impuesto
+const (
+	impuestoISR  = "001"
+	impuestoIVA  = "002"
+	impuestoIEPS = "003"
+)
+
+// Valores del catálogo c_TipoFactor
+const (
+	factorTasa   = "Tasa"
+	factorCuota  = "Cuota"
+	factorExento = "Exento"
+)
+
+// objetoImpuestoConImpuestos es la clave c_ObjetoImp que exige el nodo de impuestos del concepto
+const objetoImpuestoConImpuestos = "02"
+
+// tasaOCuota formatea el atributo TasaOCuota: la tasa llega como fracción y la cuota como importe por unidad
+func tasaOCuota(tipoFactor string, valor float64) string {
+	switch tipoFactor {
+	case factorExento:
+		return ""
+	case factorCuota:
+		return fmt.Sprintf("%.6f", valor)
+	default:
+		return formatTasa(valor * 100)
+	}
+}
+
+// importeTraslado formatea el atributo Importe; los traslados exentos no lo llevan
+func importeTraslado(tipoFactor string, importe float64) string {
+	if tipoFactor == factorExento {
+		return ""
+	}
+	return formatFloat(importe)
+}
+
+// acumuladorImpuestos arma los impuestos de cada concepto y los agrupa para el nodo cfdi:Impuestos del comprobante.
+// Los importes se redondean a 2 decimales por concepto para que la suma del comprobante coincida con sus conceptos.
+type acumuladorImpuestos struct {
+	traslados        map[string]*acumuladoTraslado
+	ordenTraslados   []string
+	retenciones      map[string]float64
+	totalTrasladados float64
+	totalRetenidos   float64
+	hayTraslados     bool
+	hayGravados      bool // Algún traslado distinto de Exento; sin ellos no va TotalImpuestosTrasladados
+	hayRetenciones   bool
+}
+
+func (a *acumuladorImpuestos) agregarTraslado(impuesto, tipoFactor string, tasa, base, importe float64) {
+	if a.traslados == nil {
+		a.traslados = map[string]*acumuladoTraslado{}
+	}
+	clave := claveTraslado(impuesto, tipoFactor, tasa)
+	acum, ok := a.traslados[clave]
+	if !ok {
+		acum = &acumuladoTraslado{impuesto: impuesto, tipoFactor: tipoFactor, tasa: tasa}
+		a.traslados[clave] = acum
+		a.ordenTraslados = append(a.ordenTraslados, clave)
+	}
+	acum.base += base
+	acum.importe += importe
+	a.totalTrasladados += importe
+	a.hayTraslados = true
+	if tipoFactor != factorExento {
+		a.hayGravados = true
+	}
+}
+
+func (a *acumuladorImpuestos) agregarRetencion(impuesto string, importe float64) {
+	if a.retenciones == nil {
+		a.retenciones = map[string]float64{}
+	}
+	a.retenciones[impuesto] += importe
+	a.totalRetenidos += importe
+	a.hayRetenciones = true
+}
+
+// agregarConcepto calcula traslados y retenciones del concepto sobre su base (importe menos descuento).
+// Devuelve la clave ObjetoImp del concepto; solo "02" lleva nodo de impuestos.
+func (a *acumuladorImpuestos) agregarConcepto(c models.Concepto, base float64) (string, *CFDIConceptoImpuestos) {
+	objetoImp := ifEmpty(c.ObjetoImp, objetoImpuestoConImpuestos)
+	if objetoImp != objetoImpuestoConImpuestos {
+		return objetoImp, nil
+	}
+	base = redondear(base, 2)
+	impuestos := &CFDIConceptoImpuestos{}
+
+	// Los IEPS se calculan primero porque forman parte de la base del IVA
+	var traslados []CFDIConceptoTraslado
+	baseIVA := base
+	for _, ieps := range c.TrasladosIEPS() {
+		if ieps.Tasa <= 0 {
+			continue
+		}
+		factor, baseIEPS, valor := factorTasa, base, ieps.Tasa/100
+		if strings.EqualFold(ieps.Tipo, factorCuota) {
+			factor, baseIEPS, valor = factorCuota, c.Cantidad, ieps.Tasa
+		}
+		importeIEPS := redondear(baseIEPS*valor, 2)
+		traslados = append(traslados, CFDIConceptoTraslado{
+			Base:       formatFloat(baseIEPS),
+			Impuesto:   impuestoIEPS,
+			TipoFactor: factor,
+			TasaOCuota: tasaOCuota(factor, valor),
+			Importe:    formatFloat(importeIEPS),
+		})
+		a.agregarTraslado(impuestoIEPS, factor, valor, baseIEPS, importeIEPS)
+		baseIVA = redondear(baseIVA+importeIEPS, 2)
+	}
+
+	factorIVA, tasaIVA := factorTasa, c.TasaIVA/100
+	if strings.EqualFold(c.TipoIVA, factorExento) {
+		factorIVA, tasaIVA = factorExento, 0
+	}
+	importeIVA := redondear(baseIVA*tasaIVA, 2)
+	traslados = append(traslados, CFDIConceptoTraslado{
+		Base:       formatFloat(baseIVA),
+		Impuesto:   impuestoIVA,
+		TipoFactor: factorIVA,
+		TasaOCuota: tasaOCuota(factorIVA, tasaIVA),
+		Importe:    importeTraslado(factorIVA, importeIVA),
+	})
+	a.agregarTraslado(impuestoIVA, factorIVA, tasaIVA, baseIVA, importeIVA)
+	impuestos.Traslados = &CFDIConceptoTraslados{Traslado: traslados}
+
+	var retenciones []CFDIConceptoRetencion
+	for _, r := range []struct {
+		impuesto string
+		tasa     float64
+	}{
+		{impuestoISR, c.TasaRetISR},
+		{impuestoIVA, c.TasaRetIVA},
+	} {
+		if r.tasa <= 0 {
+			continue
+		}
+		importe := redondear(base*r.tasa/100, 2)
+		retenciones = append(retenciones, CFDIConceptoRetencion{
+			Base:       formatFloat(base),
+			Impuesto:   r.impuesto,
+			TipoFactor: "Tasa",
+			TasaOCuota: formatTasa(r.tasa),
+			Importe:    formatFloat(importe),
+		})
+		a.agregarRetencion(r.impuesto, importe)
+	}
+	if len(retenciones) > 0 {
+		impuestos.Retenciones = &CFDIConceptoRetenciones{Retencion: retenciones}
+	}
+
+	return objetoImp, impuestos
+}
+
+// nodo construye cfdi:Impuestos del comprobante; nil si ningún concepto tiene impuestos
+func (a *acumuladorImpuestos) nodo() *CFDIImpuestos {
+	if !a.hayTraslados && !a.hayRetenciones {
+		return nil
+	}
+	nodo := &CFDIImpuestos{}
+
+	if a.hayRetenciones {
+		impuestos := make([]string, 0, len(a.retenciones))
+		for impuesto := range a.retenciones {
+			impuestos = append(impuestos, impuesto)
+		}
+		sort.Strings(impuestos)
+		nodo.Retenciones = &CFDIRetenciones{}
+		for _, impuesto := range impuestos {
+			nodo.Retenciones.Retencion = append(nodo.Retenciones.Retencion, CFDIRetencion{
+				Impuesto: impuesto,
+				Importe:  formatFloat(a.retenciones[impuesto]),
+			})
+		}
+		nodo.TotalImpuestosRetenidos = formatFloat(a.totalRetenidos)
+	}
+
+	if a.hayTraslados {
+		nodo.Traslados = &CFDITraslados{}
+		for _, clave := range a.ordenTraslados {
+			t := a.traslados[clave]
+			nodo.Traslados.Traslado = append(nodo.Traslados.Traslado, CFDITraslado{
+				Base:       formatFloat(t.base),
+				Impuesto:   t.impuesto,
+				TipoFactor: t.tipoFactor,
+				TasaOCuota: tasaOCuota(t.tipoFactor, t.tasa),
+				Importe:    importeTraslado(t.tipoFactor, t.importe),
+			})
+		}
+		if a.hayGravados {
+			nodo.TotalImpuestosTrasladados = formatFloat(a.totalTrasladados)
+		}
+	}
+
+	return nodo
+}
+
+// CalcularTotales asigna a la factura los mismos totales que llevará su CFDI (traslados, retenciones y total)
+func CalcularTotales(factura *models.Factura) {
+	if len(factura.Conceptos) == 0 {
+		return
+	}
+	impuestos := &acumuladorImpuestos{}
+	var subtotal, descuento float64
+	for _, c := range factura.Conceptos {
+		importe := c.Cantidad * c.ValorUnitario
+		subtotal += importe
+		if c.Descuento > 0 {
+			descuento += c.Descuento
+		}
+		impuestos.agregarConcepto(c, importe-c.Descuento)
+	}
+	if factura.Descuento > 0 {
+		descuento += factura.Descuento
+	}
+
+	factura.Subtotal = redondear(subtotal, 2)
+	factura.Impuestos = redondear(impuestos.totalTrasladados, 2)
+	factura.RetencionISR = redondear(impuestos.retenciones[impuestoISR], 2)
+	factura.RetencionIVA = redondear(impuestos.retenciones[impuestoIVA], 2)
+	factura.ImpuestosRetenidos = redondear(impuestos.totalRetenidos, 2)
+	factura.Total = redondear(subtotal-descuento+impuestos.totalTrasladados-impuestos.totalRetenidos, 2)
+}
@@ -0,0 +1,152 @@
+package services
+
+import (
+	"reflect"
+	"testing"
+
+	"Facts/internal/models"
+)
+
+func TestImpuestosConcepto(t *testing.T) {
+	casos := []struct {
+		nombre      string
+		concepto    models.Concepto
+		traslados   []CFDIConceptoTraslado // Del concepto; también se esperan en el comprobante
+		retenciones []CFDIConceptoRetencion
+		totalTras   string // TotalImpuestosTrasladados del comprobante
+		impuestos   float64
+		total       float64
+	}{
+		{
+			nombre:   "IEPS tasa dentro de la base del IVA",
+			concepto: models.Concepto{Cantidad: 1, ValorUnitario: 1000, TasaIVA: 16, TasaIEPS: 8},
+			traslados: []CFDIConceptoTraslado{
+				{Base: "1000.00", Impuesto: impuestoIEPS, TipoFactor: factorTasa, TasaOCuota: "0.080000", Importe: "80.00"},
+				{Base: "1080.00", Impuesto: impuestoIVA, TipoFactor: factorTasa, TasaOCuota: "0.160000", Importe: "172.80"},
+			},
+			totalTras: "252.80",
+			impuestos: 252.80,
+			total:     1252.80,
+		},
+		{
+			nombre:   "IEPS cuota sobre la cantidad",
+			concepto: models.Concepto{Cantidad: 4, ValorUnitario: 100, TasaIVA: 16, TasaIEPS: 2.5, TipoIEPS: "Cuota"},
+			traslados: []CFDIConceptoTraslado{
+				{Base: "4.00", Impuesto: impuestoIEPS, TipoFactor: factorCuota, TasaOCuota: "2.500000", Importe: "10.00"},
+				{Base: "410.00", Impuesto: impuestoIVA, TipoFactor: factorTasa, TasaOCuota: "0.160000", Importe: "65.60"},
+			},
+			totalTras: "75.60",
+			impuestos: 75.60,
+			total:     475.60,
+		},
+		{
+			nombre:   "IVA exento sin tasa ni importe",
+			concepto: models.Concepto{Cantidad: 2, ValorUnitario: 250, TipoIVA: "Exento"},
+			traslados: []CFDIConceptoTraslado{
+				{Base: "500.00", Impuesto: impuestoIVA, TipoFactor: factorExento},
+			},
+			total: 500,
+		},
+		{
+			nombre:   "retenciones de ISR e IVA",
+			concepto: models.Concepto{Cantidad: 1, ValorUnitario: 1000, TasaIVA: 16, TasaRetISR: 10, TasaRetIVA: 10.666667},
+			traslados: []CFDIConceptoTraslado{
+				{Base: "1000.00", Impuesto: impuestoIVA, TipoFactor: factorTasa, TasaOCuota: "0.160000", Importe: "160.00"},
+			},
+			retenciones: []CFDIConceptoRetencion{
+				{Base: "1000.00", Impuesto: impuestoISR, TipoFactor: "Tasa", TasaOCuota: "0.100000", Importe: "100.00"},
+				{Base: "1000.00", Impuesto: impuestoIVA, TipoFactor: "Tasa", TasaOCuota: "0.106667", Importe: "106.67"},
+			},
+			totalTras: "160.00",
+			impuestos: 160,
+			total:     953.33,
+		},
+		{
+			nombre:   "no objeto de impuesto",
+			concepto: models.Concepto{Cantidad: 3, ValorUnitario: 10, TasaIVA: 16, ObjetoImp: "01"},
+			total:    30,
+		},
+	}
+
+	for _, c := range casos {
+		t.Run(c.nombre, func(t *testing.T) {
+			acum := &acumuladorImpuestos{}
+			objetoImp, impuestos := acum.agregarConcepto(c.concepto, c.concepto.Cantidad*c.concepto.ValorUnitario)
+
+			if c.traslados == nil {
+				if objetoImp == objetoImpuestoConImpuestos || impuestos != nil || acum.nodo() != nil {
+					t.Fatalf("el concepto no objeto de impuesto llevó impuestos: %s %+v", objetoImp, impuestos)
+				}
+			} else {
+				if objetoImp != objetoImpuestoConImpuestos || impuestos == nil {
+					t.Fatalf("ObjetoImp %s sin nodo de impuestos", objetoImp)
+				}
+				if !reflect.DeepEqual(impuestos.Traslados.Traslado, c.traslados) {
+					t.Errorf("traslados del concepto:\n%+v\nse esperaba\n%+v", impuestos.Traslados.Traslado, c.traslados)
+				}
+				var retenciones []CFDIConceptoRetencion
+				if impuestos.Retenciones != nil {
+					retenciones = impuestos.Retenciones.Retencion
+				}
+				if !reflect.DeepEqual(retenciones, c.retenciones) {
+					t.Errorf("retenciones del concepto:\n%+v\nse esperaba\n%+v", retenciones, c.retenciones)
+				}
+
+				nodo := acum.nodo()
+				if nodo.TotalImpuestosTrasladados != c.totalTras {
+					t.Errorf("TotalImpuestosTrasladados %q, se esperaba %q", nodo.TotalImpuestosTrasladados, c.totalTras)
+				}
+				if len(nodo.Traslados.Traslado) != len(c.traslados) {
+					t.Fatalf("el comprobante tiene %d traslados, se esperaban %d", len(nodo.Traslados.Traslado), len(c.traslados))
+				}
+				for i, tr := range c.traslados {
+					if got := CFDITraslado(tr); nodo.Traslados.Traslado[i] != got {
+						t.Errorf("traslado %d del comprobante %+v, se esperaba %+v", i, nodo.Traslados.Traslado[i], got)
+					}
+				}
+			}
+
+			factura := models.Factura{Conceptos: []models.Concepto{c.concepto}}
+			CalcularTotales(&factura)
+			if factura.Impuestos != c.impuestos || factura.Total != c.total {
+				t.Errorf("impuestos %.2f y total %.2f, se esperaban %.2f y %.2f", factura.Impuestos, factura.Total, c.impuestos, c.total)
+			}
+		})
+	}
+}
+
+// TestCalcularTotalesVariosConceptos revisa que los traslados iguales se agrupen en el comprobante
+// y que el total sume los conceptos con su descuento
+func TestCalcularTotalesVariosConceptos(t *testing.T) {
+	factura := models.Factura{Conceptos: []models.Concepto{
+		{Cantidad: 1, ValorUnitario: 1000, TasaIVA: 16, TasaIEPS: 8, TasaRetISR: 10},
+		{Cantidad: 2, ValorUnitario: 150, Descuento: 100, TasaIVA: 16},
+		{Cantidad: 1, ValorUnitario: 500, TipoIVA: "Exento"},
+	}}
+	CalcularTotales(&factura)
+
+	// IEPS 80; IVA (1080 + 200) * 16% = 204.80; ISR 100
+	if factura.Subtotal != 1800 || factura.Impuestos != 284.80 || factura.RetencionISR != 100 {
+		t.Errorf("subtotal %.2f, impuestos %.2f, ISR %.2f", factura.Subtotal, factura.Impuestos, factura.RetencionISR)
+	}
+	if factura.Total != 1884.80 {
+		t.Errorf("total %.2f, se esperaba 1884.80", factura.Total)
+	}
+
+	acum := &acumuladorImpuestos{}
+	for _, c := range factura.Conceptos {
+		acum.agregarConcepto(c, c.Cantidad*c.ValorUnitario-c.Descuento)
+	}
+	esperados := []CFDITraslado{
+		{Base: "1000.00", Impuesto: impuestoIEPS, TipoFactor: factorTasa, TasaOCuota: "0.080000", Importe: "80.00"},
+		{Base: "1280.00", Impuesto: impuestoIVA, TipoFactor: factorTasa, TasaOCuota: "0.160000", Importe: "204.80"},
+		{Base: "500.00", Impuesto: impuestoIVA, TipoFactor: factorExento},
+	}
+	nodo := acum.nodo()
+	if !reflect.DeepEqual(nodo.Traslados.Traslado, esperados) {
+		t.Errorf("traslados del comprobante:\n%+v\nse esperaba\n%+v", nodo.Traslados.Traslado, esperados)
+	}
+	if nodo.TotalImpuestosTrasladados != "284.80" || nodo.TotalImpuestosRetenidos != "100.00" {
+		t.Errorf("totales del nodo: trasladados %q, retenidos %q", nodo.TotalImpuestosTrasladados, nodo.TotalImpuestosRetenidos)
+	}
+}
@@ -0,0 +1,85 @@
+package services
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+)
+
+// nombresConPrefijo entrega los tokens con el prefijo dentro del nombre local ("cfdi:Emisor"),
+// que es como están declaradas las etiquetas de CFDIComprobante
+type nombresConPrefijo struct {
+	decoder *xml.Decoder
+}
+
+func (n nombresConPrefijo) Token() (xml.Token, error) {
+	tok, err := n.decoder.RawToken()
+	if err != nil {
+		return nil, err
+	}
+	switch t := tok.(type) {
+	case xml.StartElement:
+		t.Name = unirPrefijo(t.Name)
+		return t, nil
+	case xml.EndElement:
+		t.Name = unirPrefijo(t.Name)
+		return t, nil
+	case xml.CharData:
+		return t.Copy(), nil
+	}
+	return tok, nil
+}
+
+func unirPrefijo(nombre xml.Name) xml.Name {
+	if nombre.Space == "" {
+		return nombre
+	}
+	return xml.Name{Local: nombre.Space + ":" + nombre.Local}
+}
+
+// LeerComprobante convierte un XML CFDI 4.0 a la misma estructura que usa el generador
+func LeerComprobante(xmlCFDI []byte) (*CFDIComprobante, error) {
+	var comprobante CFDIComprobante
+	decoder := xml.NewTokenDecoder(nombresConPrefijo{decoder: xml.NewDecoder(bytes.NewReader(xmlCFDI))})
+	if err := decoder.Decode(&comprobante); err != nil {
+		return nil, fmt.Errorf("XML CFDI inválido: %w", err)
+	}
+	if comprobante.Version == "" {
+		return nil, errors.New("XML CFDI inválido: falta el atributo Version")
+	}
+	return &comprobante, nil
+}
+
+// VerificarSello valida el Sello del comprobante contra la cadena original y el certificado incluido
+func VerificarSello(comprobante *CFDIComprobante) error {
+	if comprobante.Sello == "" || comprobante.Certificado == "" {
+		return errors.New("el comprobante no tiene sello o certificado")
+	}
+	certDER, err := base64.StdEncoding.DecodeString(comprobante.Certificado)
+	if err != nil {
+		return fmt.Errorf("certificado mal codificado: %w", err)
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return fmt.Errorf("certificado inválido: %w", err)
+	}
+	llave, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("el certificado no contiene una llave RSA")
+	}
+	firma, err := base64.StdEncoding.DecodeString(comprobante.Sello)
+	if err != nil {
+		return fmt.Errorf("sello mal codificado: %w", err)
+	}
+	hash := sha256.Sum256([]byte(GenerarCadenaOriginal(*comprobante)))
+	if err := rsa.VerifyPKCS1v15(llave, crypto.SHA256, hash[:], firma); err != nil {
+		return errors.New("el sello no corresponde a la cadena original")
+	}
+	return nil
+}
@@ -0,0 +1,526 @@
+package services
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/md5"
+	"embed"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/phpdave11/gofpdf"
+)
+
+// FuentePDFA es la familia TrueType que se incrusta en los PDF/A: las fuentes estándar de PDF (Arial,
+// Helvetica...) no llevan el archivo de la fuente y PDF/A exige incrustarlo
+const FuentePDFA = "DejaVuSansCondensed"
+
+// NamespaceXMPCFDI es el espacio de nombres de los datos del CFDI en los metadatos XMP del PDF/A
+const NamespaceXMPCFDI = "urn:facts:cfdi:xmp:1.0/"
+
+const (
+	autorPDF  = "Sistema de Facturación"
+	tituloPDF = "Factura Electrónica"
+)
+
+//go:embed fuentes/*.ttf
+var fuentesPDFA embed.FS
+
+var archivosFuentePDFA = map[string]string{
+	"":  "fuentes/DejaVuSansCondensed.ttf",
+	"B": "fuentes/DejaVuSansCondensed-Bold.ttf",
+	"I": "fuentes/DejaVuSansCondensed-Oblique.ttf",
+}
+
+// usarFuentesPDFA registra FuentePDFA con los estilos que usa la representación impresa
+func usarFuentesPDFA(pdf *gofpdf.Fpdf) error {
+	for estilo, archivo := range archivosFuentePDFA {
+		datos, err := fuentesPDFA.ReadFile(archivo)
+		if err != nil {
+			return fmt.Errorf("error al leer la fuente del PDF/A: %w", err)
+		}
+		pdf.AddUTF8FontFromBytes(FuentePDFA, estilo, datos)
+	}
+	return pdf.Error()
+}
+
+// sinTraduccion es el traductor de texto de las fuentes UTF-8, que reciben el texto tal cual
+func sinTraduccion(texto string) string {
+	return texto
+}
+
+// partirLineas parte el texto al ancho indicado con la fuente actual; con las fuentes UTF-8
+// se mide por carácter y no por byte para no cortar una letra acentuada a la mitad
+func partirLineas(pdf *gofpdf.Fpdf, texto string, ancho float64, utf8 bool) []string {
+	if utf8 {
+		return pdf.SplitText(texto, ancho)
+	}
+	var lineas []string
+	for _, l := range pdf.SplitLines([]byte(texto), ancho) {
+		lineas = append(lineas, string(l))
+	}
+	return lineas
+}
+
+// terminarPDF escribe el documento y, si se pidió PDF/A, lo convierte incrustando el XML del CFDI
+func terminarPDF(pdf *gofpdf.Fpdf, ri *RepresentacionImpresa, opciones OpcionesPDF) (*bytes.Buffer, error) {
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		return nil, err
+	}
+	if !opciones.PDFA {
+		return &buf, nil
+	}
+	pdfa, err := convertirPDFA3(buf.Bytes(), ri, opciones.XMLCFDI, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if err := ValidarPDFA3(pdfa); err != nil {
+		return nil, err
+	}
+	return bytes.NewBuffer(pdfa), nil
+}
+
+// convertirPDFA3 reescribe el PDF de gofpdf como PDF/A-3b: encabezado binario, metadatos XMP con los datos
+// del CFDI, OutputIntent sRGB, el XML incrustado como archivo asociado (AFRelationship Source) e /ID en el
+// trailer. Del catálogo original solo se conserva /Pages; la representación impresa no usa marcadores ni acciones.
+func convertirPDFA3(original []byte, ri *RepresentacionImpresa, xmlCFDI []byte, fecha time.Time) ([]byte, error) {
+	if len(xmlCFDI) == 0 {
+		return nil, errors.New("el PDF/A-3 requiere el XML del CFDI para incrustarlo")
+	}
+	objetos, trailer, err := leerObjetosPDF(original)
+	if err != nil {
+		return nil, fmt.Errorf("error al leer el PDF para convertirlo a PDF/A: %w", err)
+	}
+	raiz, info := referenciaPDF(trailer, "Root"), referenciaPDF(trailer, "Info")
+	paginas := referenciaPDF(objetos[raiz], "Pages")
+	if raiz == 0 || info == 0 || paginas == 0 {
+		return nil, errors.New("el PDF no tiene catálogo, páginas o diccionario Info")
+	}
+
+	n := 0
+	for num := range objetos {
+		n = max(n, num)
+	}
+	metadatos, perfil, archivo, especificacion := n+1, n+2, n+3, n+4
+	n += 4
+
+	fecha = fecha.Truncate(time.Second)
+	asunto := "CFDI " + ri.UUID()
+	if ri.UUID() == "" {
+		asunto = "CFDI sin timbre fiscal digital"
+	}
+	nombreXML := ri.NombreArchivo("xml")
+
+	objetos[info] = []byte(fmt.Sprintf("<< /Title %s /Author %s /Subject %s /Producer %s /CreationDate %s /ModDate %s >>",
+		textoPDF(tituloPDF), textoPDF(autorPDF), textoPDF(asunto), textoPDF(autorPDF), fechaPDFA(fecha), fechaPDFA(fecha)))
+	objetos[metadatos] = streamPDF("/Type /Metadata /Subtype /XML", []byte(metadatosXMP(ri, asunto, fecha)), false)
+	objetos[perfil] = streamPDF("/N 3", perfilSRGB(), true)
+	objetos[archivo] = streamPDF(fmt.Sprintf("/Type /EmbeddedFile /Subtype /text#2Fxml /Params << /ModDate %s /Size %d /CheckSum <%x> >>",
+		fechaPDFA(fecha), len(xmlCFDI), md5.Sum(xmlCFDI)), xmlCFDI, true)
+	objetos[especificacion] = []byte(fmt.Sprintf("<< /Type /Filespec /F %s /UF %s /EF << /F %d 0 R /UF %d 0 R >> /Desc %s /AFRelationship /Source >>",
+		textoPDF(nombreXML), textoPDF(nombreXML), archivo, archivo, textoPDF("CFDI timbrado")))
+	objetos[raiz] = []byte(fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R /Metadata %d 0 R"+
+		" /OutputIntents [<< /Type /OutputIntent /S /GTS_PDFA1 /OutputConditionIdentifier (sRGB IEC61966-2.1) /Info (sRGB IEC61966-2.1) /DestOutputProfile %d 0 R >>]"+
+		" /AF [%d 0 R] /Names << /EmbeddedFiles << /Names [%s %d 0 R] >> >> >>",
+		paginas, metadatos, perfil, especificacion, textoPDF(nombreXML), especificacion))
+
+	// El comentario binario después de la versión es obligatorio en PDF/A
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n")
+	posiciones := make([]int, n+1)
+	for num := 1; num <= n; num++ {
+		cuerpo, ok := objetos[num]
+		if !ok {
+			continue
+		}
+		posiciones[num] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n", num)
+		buf.Write(cuerpo)
+		buf.WriteString("\nendobj\n")
+	}
+	h := md5.New()
+	h.Write(buf.Bytes())
+	h.Write(xmlCFDI)
+	id := h.Sum(nil)
+	inicioXref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", n+1)
+	for num := 1; num <= n; num++ {
+		if posiciones[num] == 0 {
+			buf.WriteString("0000000000 65535 f \n")
+			continue
+		}
+		fmt.Fprintf(&buf, "%010d 00000 n \n", posiciones[num])
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root %d 0 R /Info %d 0 R /ID [<%x> <%x>] >>\nstartxref\n%d\n%%%%EOF\n",
+		n+1, raiz, info, id, id, inicioXref)
+	return buf.Bytes(), nil
+}
+
+var reStartXref = regexp.MustCompile(`startxref\s+(\d+)\s+%%EOF\s*$`)
+
+// leerObjetosPDF devuelve el cuerpo de cada objeto indirecto (sin "n 0 obj" ni "endobj") y el diccionario del
+// trailer. Solo entiende tablas xref clásicas, que son las que escriben gofpdf y convertirPDFA3.
+func leerObjetosPDF(pdf []byte) (map[int][]byte, []byte, error) {
+	m := reStartXref.FindSubmatch(pdf)
+	if m == nil {
+		return nil, nil, errors.New("no se encontró startxref")
+	}
+	inicioXref, _ := strconv.Atoi(string(m[1]))
+	if inicioXref >= len(pdf) || !bytes.HasPrefix(pdf[inicioXref:], []byte("xref")) {
+		return nil, nil, errors.New("no se encontró la tabla xref")
+	}
+	lineas := strings.Split(string(pdf[inicioXref:]), "\n")
+	var primero, total int
+	if len(lineas) < 2 {
+		return nil, nil, errors.New("tabla xref incompleta")
+	}
+	if _, err := fmt.Sscanf(lineas[1], "%d %d", &primero, &total); err != nil || primero != 0 || len(lineas) < total+3 {
+		return nil, nil, errors.New("tabla xref inválida")
+	}
+
+	posiciones := map[int]int{}
+	for num := 1; num < total; num++ {
+		campos := strings.Fields(lineas[2+num])
+		if len(campos) != 3 || campos[2] != "n" {
+			continue
+		}
+		pos, err := strconv.Atoi(campos[0])
+		if err != nil || pos >= inicioXref {
+			return nil, nil, fmt.Errorf("posición inválida del objeto %d", num)
+		}
+		posiciones[num] = pos
+	}
+	trailer := strings.Join(lineas[total+2:], "\n")
+	trailer, _, _ = strings.Cut(trailer, "startxref")
+	if !strings.HasPrefix(strings.TrimSpace(trailer), "trailer") {
+		return nil, nil, errors.New("no se encontró el trailer")
+	}
+
+	// Cada objeto termina donde empieza el siguiente (en orden de posición) o donde empieza la tabla xref
+	numeros := make([]int, 0, len(posiciones))
+	for num := range posiciones {
+		numeros = append(numeros, num)
+	}
+	sort.Slice(numeros, func(i, j int) bool { return posiciones[numeros[i]] < posiciones[numeros[j]] })
+	objetos := make(map[int][]byte, len(numeros))
+	for i, num := range numeros {
+		fin := inicioXref
+		if i+1 < len(numeros) {
+			fin = posiciones[numeros[i+1]]
+		}
+		cuerpo := bytes.TrimSpace(pdf[posiciones[num]:fin])
+		encabezado := fmt.Sprintf("%d 0 obj", num)
+		if !bytes.HasPrefix(cuerpo, []byte(encabezado)) || !bytes.HasSuffix(cuerpo, []byte("endobj")) {
+			return nil, nil, fmt.Errorf("el objeto %d no está donde indica la tabla xref", num)
+		}
+		objetos[num] = bytes.TrimSpace(cuerpo[len(encabezado) : len(cuerpo)-len("endobj")])
+	}
+	return objetos, []byte(trailer), nil
+}
+
+// referenciaPDF devuelve el número de objeto de "/clave n 0 R" en el diccionario; 0 si no está
+func referenciaPDF(diccionario []byte, clave string) int {
+	m := regexp.MustCompile(`/` + clave + `\s+(\d+)\s+0\s+R`).FindSubmatch(diccionario)
+	if m == nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(string(m[1]))
+	return n
+}
+
+// streamPDF arma un objeto stream con las entradas de diccionario indicadas y /Length
+func streamPDF(entradas string, datos []byte, comprimir bool) []byte {
+	if comprimir {
+		var z bytes.Buffer
+		w := zlib.NewWriter(&z)
+		w.Write(datos)
+		w.Close()
+		datos = z.Bytes()
+		entradas += " /Filter /FlateDecode"
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<< %s /Length %d >>\nstream\n", entradas, len(datos))
+	buf.Write(datos)
+	buf.WriteString("\nendstream")
+	return buf.Bytes()
+}
+
+// datosStreamPDF separa el diccionario y los datos de un objeto stream; datos es nil si no es stream
+func datosStreamPDF(cuerpo []byte) (diccionario, datos []byte) {
+	i := bytes.Index(cuerpo, []byte("stream"))
+	fin := bytes.LastIndex(cuerpo, []byte("endstream"))
+	if i < 0 || fin < i {
+		return cuerpo, nil
+	}
+	datos = cuerpo[i+len("stream") : fin]
+	datos = bytes.TrimPrefix(bytes.TrimPrefix(datos, []byte("\r")), []byte("\n"))
+	datos = bytes.TrimSuffix(bytes.TrimSuffix(datos, []byte("\n")), []byte("\r"))
+	return cuerpo[:i], datos
+}
+
+// textoPDF codifica una cadena de texto de PDF en UTF-16BE con BOM para conservar los acentos
+func textoPDF(texto string) string {
+	var b strings.Builder
+	b.WriteString("<FEFF")
+	for _, u := range utf16.Encode([]rune(texto)) {
+		fmt.Fprintf(&b, "%04X", u)
+	}
+	b.WriteString(">")
+	return b.String()
+}
+
+// fechaPDFA escribe una fecha de PDF con zona horaria, equivalente a la fecha XMP de metadatosXMP
+func fechaPDFA(fecha time.Time) string {
+	_, segundos := fecha.Zone()
+	if segundos == 0 {
+		return "(D:" + fecha.Format("20060102150405") + "Z)"
+	}
+	signo := "+"
+	if segundos < 0 {
+		signo, segundos = "-", -segundos
+	}
+	return fmt.Sprintf("(D:%s%s%02d'%02d')", fecha.Format("20060102150405"), signo, segundos/3600, segundos/60%60)
+}
+
+// escaparXML escapa un valor para escribirlo dentro de un elemento XMP
+func escaparXML(valor string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(valor))
+	return b.String()
+}
+
+// propiedadesXMPCFDI son los datos del CFDI que se escriben en el XMP, con su descripción para el esquema de extensión
+var propiedadesXMPCFDI = []struct {
+	nombre, descripcion string
+	valor               func(ri *RepresentacionImpresa) string
+}{
+	{"UUID", "Folio fiscal del timbre fiscal digital", (*RepresentacionImpresa).UUID},
+	{"RfcEmisor", "RFC del emisor", func(ri *RepresentacionImpresa) string { return ri.Emisor.Rfc }},
+	{"RfcReceptor", "RFC del receptor", func(ri *RepresentacionImpresa) string { return ri.Receptor.Rfc }},
+	{"Total", "Total del comprobante", func(ri *RepresentacionImpresa) string { return ri.Total }},
+	{"Moneda", "Clave de la moneda del total", func(ri *RepresentacionImpresa) string { return ri.Moneda }},
+}
+
+// metadatosXMP arma el paquete XMP del PDF/A-3b: identificación PDF/A, los mismos datos que el diccionario
+// Info y los datos del CFDI. Las propiedades propias deben declararse con un esquema de extensión PDF/A.
+func metadatosXMP(ri *RepresentacionImpresa, asunto string, fecha time.Time) string {
+	var b strings.Builder
+	b.WriteString("<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	b.WriteString("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">\n<rdf:RDF xmlns:rdf=\"http://www.w3.org/1999/02/22-rdf-syntax-ns#\">\n")
+	b.WriteString(" <rdf:Description rdf:about=\"\" xmlns:pdfaid=\"http://www.aiim.org/pdfa/ns/id/\">\n")
+	b.WriteString("  <pdfaid:part>3</pdfaid:part>\n  <pdfaid:conformance>B</pdfaid:conformance>\n </rdf:Description>\n")
+	fmt.Fprintf(&b, " <rdf:Description rdf:about=\"\" xmlns:dc=\"http://purl.org/dc/elements/1.1/\">\n"+
+		"  <dc:format>application/pdf</dc:format>\n"+
+		"  <dc:title><rdf:Alt><rdf:li xml:lang=\"x-default\">%s</rdf:li></rdf:Alt></dc:title>\n"+
+		"  <dc:creator><rdf:Seq><rdf:li>%s</rdf:li></rdf:Seq></dc:creator>\n"+
+		"  <dc:description><rdf:Alt><rdf:li xml:lang=\"x-default\">%s</rdf:li></rdf:Alt></dc:description>\n"+
+		" </rdf:Description>\n", escaparXML(tituloPDF), escaparXML(autorPDF), escaparXML(asunto))
+	fecha3339 := fecha.Format(time.RFC3339)
+	fmt.Fprintf(&b, " <rdf:Description rdf:about=\"\" xmlns:xmp=\"http://ns.adobe.com/xap/1.0/\">\n"+
+		"  <xmp:CreateDate>%s</xmp:CreateDate>\n  <xmp:ModifyDate>%s</xmp:ModifyDate>\n  <xmp:MetadataDate>%s</xmp:MetadataDate>\n"+
+		" </rdf:Description>\n", fecha3339, fecha3339, fecha3339)
+	fmt.Fprintf(&b, " <rdf:Description rdf:about=\"\" xmlns:pdf=\"http://ns.adobe.com/pdf/1.3/\">\n"+
+		"  <pdf:Producer>%s</pdf:Producer>\n </rdf:Description>\n", escaparXML(autorPDF))
+
+	fmt.Fprintf(&b, " <rdf:Description rdf:about=\"\" xmlns:cfdi=\"%s\">\n", NamespaceXMPCFDI)
+	for _, p := range propiedadesXMPCFDI {
+		fmt.Fprintf(&b, "  <cfdi:%s>%s</cfdi:%s>\n", p.nombre, escaparXML(p.valor(ri)), p.nombre)
+	}
+	b.WriteString(" </rdf:Description>\n")
+
+	b.WriteString(" <rdf:Description rdf:about=\"\" xmlns:pdfaExtension=\"http://www.aiim.org/pdfa/ns/extension/\"" +
+		" xmlns:pdfaSchema=\"http://www.aiim.org/pdfa/ns/schema#\" xmlns:pdfaProperty=\"http://www.aiim.org/pdfa/ns/property#\">\n")
+	b.WriteString("  <pdfaExtension:schemas><rdf:Bag><rdf:li rdf:parseType=\"Resource\">\n")
+	fmt.Fprintf(&b, "   <pdfaSchema:schema>Datos del CFDI</pdfaSchema:schema>\n"+
+		"   <pdfaSchema:namespaceURI>%s</pdfaSchema:namespaceURI>\n   <pdfaSchema:prefix>cfdi</pdfaSchema:prefix>\n", NamespaceXMPCFDI)
+	b.WriteString("   <pdfaSchema:property><rdf:Seq>\n")
+	for _, p := range propiedadesXMPCFDI {
+		fmt.Fprintf(&b, "    <rdf:li rdf:parseType=\"Resource\"><pdfaProperty:name>%s</pdfaProperty:name>"+
+			"<pdfaProperty:valueType>Text</pdfaProperty:valueType><pdfaProperty:category>external</pdfaProperty:category>"+
+			"<pdfaProperty:description>%s</pdfaProperty:description></rdf:li>\n", p.nombre, escaparXML(p.descripcion))
+	}
+	b.WriteString("   </rdf:Seq></pdfaSchema:property>\n  </rdf:li></rdf:Bag></pdfaExtension:schemas>\n </rdf:Description>\n")
+	b.WriteString("</rdf:RDF>\n</x:xmpmeta>\n<?xpacket end=\"w\"?>")
+	return b.String()
+}
+
+// perfilSRGB arma un perfil ICC v2 de monitor con los primarios sRGB (adaptados a D50) y gamma 2.2;
+// es el perfil de destino del OutputIntent, que PDF/A exige para interpretar los colores RGB
+func perfilSRGB() []byte {
+	xyz := func(x, y, z float64) []byte {
+		b := []byte("XYZ \x00\x00\x00\x00")
+		for _, v := range []float64{x, y, z} {
+			b = binary.BigEndian.AppendUint32(b, uint32(int32(math.Round(v*65536))))
+		}
+		return b
+	}
+	descripcion := "sRGB IEC61966-2.1"
+	desc := binary.BigEndian.AppendUint32([]byte("desc\x00\x00\x00\x00"), uint32(len(descripcion)+1))
+	desc = append(desc, descripcion...)
+	desc = append(desc, 0)
+	desc = append(desc, make([]byte, 4+4+2+1+67)...) // sin descripción Unicode ni ScriptCode
+	curva := []byte("curv\x00\x00\x00\x00\x00\x00\x00\x01\x02\x33")
+
+	etiquetas := []struct {
+		firma string
+		datos []byte
+	}{
+		{"desc", desc},
+		{"cprt", []byte("text\x00\x00\x00\x00Public domain\x00")},
+		{"wtpt", xyz(0.9642, 1, 0.8249)},
+		{"rXYZ", xyz(0.4361, 0.2225, 0.0139)},
+		{"gXYZ", xyz(0.3851, 0.7169, 0.0971)},
+		{"bXYZ", xyz(0.1431, 0.0606, 0.7141)},
+		{"rTRC", curva},
+		{"gTRC", curva},
+		{"bTRC", curva},
+	}
+	inicio := 128 + 4 + 12*len(etiquetas)
+	tabla := binary.BigEndian.AppendUint32(nil, uint32(len(etiquetas)))
+	var datos []byte
+	for _, e := range etiquetas {
+		for len(datos)%4 != 0 {
+			datos = append(datos, 0)
+		}
+		tabla = append(tabla, e.firma...)
+		tabla = binary.BigEndian.AppendUint32(tabla, uint32(inicio+len(datos)))
+		tabla = binary.BigEndian.AppendUint32(tabla, uint32(len(e.datos)))
+		datos = append(datos, e.datos...)
+	}
+	for len(datos)%4 != 0 {
+		datos = append(datos, 0)
+	}
+
+	encabezado := make([]byte, 128)
+	binary.BigEndian.PutUint32(encabezado[0:], uint32(inicio+len(datos)))
+	binary.BigEndian.PutUint32(encabezado[8:], 0x02100000)
+	copy(encabezado[12:], "mntrRGB XYZ ")
+	for i, v := range []uint16{2026, 1, 1, 0, 0, 0} {
+		binary.BigEndian.PutUint16(encabezado[24+2*i:], v)
+	}
+	copy(encabezado[36:], "acsp")
+	copy(encabezado[68:], xyz(0.9642, 1, 0.8249)[8:])
+	return append(append(encabezado, tabla...), datos...)
+}
+
+var (
+	reEncabezadoPDFA = regexp.MustCompile(`^%PDF-1\.[4-7]\r?\n%`)
+	reIDTrailer      = regexp.MustCompile(`/ID\s*\[\s*<[0-9A-Fa-f]+>\s*<[0-9A-Fa-f]+>\s*\]`)
+	reTipoFuente     = regexp.MustCompile(`/Type\s*/Font[\s/>]`)
+	reArchivoFuente  = regexp.MustCompile(`/FontFile[23]?\s+\d+\s+0\s+R`)
+	reAF             = regexp.MustCompile(`/AF\s*\[([^\]]*)\]`)
+	reRefsPDF        = regexp.MustCompile(`(\d+)\s+0\s+R`)
+)
+
+// comentarioBinario indica si el comentario empieza con al menos 4 bytes mayores a 127
+func comentarioBinario(comentario []byte) bool {
+	if len(comentario) < 4 {
+		return false
+	}
+	for _, b := range comentario[:4] {
+		if b <= 127 {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidarPDFA3 revisa que el PDF tenga las estructuras que exige PDF/A-3b y que lleve el XML del CFDI como
+// archivo asociado: encabezado binario, /ID, XMP con pdfaid 3/B, OutputIntent con perfil ICC, fuentes
+// incrustadas, sin cifrado ni JavaScript, y /AF con un text/xml de relación Source. No sustituye a un
+// validador completo (no revisa, por ejemplo, los operadores del contenido de las páginas).
+func ValidarPDFA3(pdf []byte) error {
+	var faltas []string
+	falta := func(formato string, args ...interface{}) {
+		faltas = append(faltas, fmt.Sprintf(formato, args...))
+	}
+
+	if !reEncabezadoPDFA.Match(pdf) || !comentarioBinario(pdf[bytes.IndexByte(pdf, '\n')+2:]) {
+		falta("sin comentario binario después de %%PDF-1.x")
+	}
+	objetos, trailer, err := leerObjetosPDF(pdf)
+	if err != nil {
+		return fmt.Errorf("el PDF no cumple PDF/A-3b: %w", err)
+	}
+	if !reIDTrailer.Match(trailer) {
+		falta("sin /ID en el trailer")
+	}
+	if bytes.Contains(trailer, []byte("/Encrypt")) {
+		falta("cifrado")
+	}
+	catalogo, ok := objetos[referenciaPDF(trailer, "Root")]
+	if !ok {
+		return errors.New("el PDF no cumple PDF/A-3b: no tiene catálogo")
+	}
+
+	// Metadatos XMP sin comprimir con la identificación PDF/A-3b
+	diccionario, xmp := datosStreamPDF(objetos[referenciaPDF(catalogo, "Metadata")])
+	switch {
+	case xmp == nil || !bytes.Contains(diccionario, []byte("/Type /Metadata")):
+		falta("sin metadatos XMP en el catálogo")
+	case bytes.Contains(diccionario, []byte("/Filter")):
+		falta("metadatos XMP comprimidos")
+	case !regexp.MustCompile(`pdfaid:part(>|=")3`).Match(xmp) || !regexp.MustCompile(`pdfaid:conformance(>|=")B`).Match(xmp):
+		falta("sin pdfaid part 3 conformance B en el XMP")
+	}
+
+	// OutputIntent PDF/A con perfil ICC de destino
+	if !bytes.Contains(catalogo, []byte("/OutputIntents")) || !bytes.Contains(catalogo, []byte("/GTS_PDFA1")) {
+		falta("sin OutputIntent GTS_PDFA1")
+	} else if _, icc := datosStreamPDF(objetos[referenciaPDF(catalogo, "DestOutputProfile")]); icc == nil {
+		falta("OutputIntent sin perfil ICC (DestOutputProfile)")
+	}
+
+	// Archivo asociado: el XML del CFDI como fuente del documento
+	asociado := false
+	if m := reAF.FindSubmatch(catalogo); m != nil {
+		for _, ref := range reRefsPDF.FindAllSubmatch(m[1], -1) {
+			num, _ := strconv.Atoi(string(ref[1]))
+			especificacion := objetos[num]
+			if !bytes.Contains(especificacion, []byte("/AFRelationship /Source")) {
+				continue
+			}
+			archivo, datos := datosStreamPDF(objetos[referenciaPDF(especificacion, "F")])
+			if datos != nil && bytes.Contains(archivo, []byte("/Type /EmbeddedFile")) && bytes.Contains(archivo, []byte("/Subtype /text#2Fxml")) {
+				asociado = true
+			}
+		}
+	}
+	if !asociado {
+		falta("sin /AF con el XML incrustado (text/xml, AFRelationship Source)")
+	}
+	if !bytes.Contains(catalogo, []byte("/EmbeddedFiles")) {
+		falta("sin árbol de nombres EmbeddedFiles")
+	}
+
+	// Fuentes incrustadas y sin JavaScript
+	for num, cuerpo := range objetos {
+		diccionario, _ := datosStreamPDF(cuerpo)
+		if bytes.Contains(diccionario, []byte("/JavaScript")) {
+			falta("objeto %d: JavaScript no permitido", num)
+		}
+		if !reTipoFuente.Match(diccionario) || bytes.Contains(diccionario, []byte("/Subtype /Type0")) {
+			continue
+		}
+		descriptor, ok := objetos[referenciaPDF(diccionario, "FontDescriptor")]
+		if !ok || !reArchivoFuente.Match(descriptor) {
+			falta("objeto %d: fuente sin incrustar", num)
+		}
+	}
+
+	if len(faltas) > 0 {
+		sort.Strings(faltas)
+		return fmt.Errorf("el PDF no cumple PDF/A-3b: %s", strings.Join(faltas, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package services
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/xml"
+	"io"
+	"strconv"
+	"testing"
+)
+
+// objetoDeCatalogo devuelve el objeto al que apunta "/clave n 0 R" dentro del diccionario
+func objetoDeCatalogo(t *testing.T, objetos map[int][]byte, diccionario []byte, clave string) []byte {
+	t.Helper()
+	objeto, ok := objetos[referenciaPDF(diccionario, clave)]
+	if !ok {
+		t.Fatalf("no se encontró el objeto de /%s en %s", clave, diccionario)
+	}
+	return objeto
+}
+
+// datosDescomprimidos devuelve los datos de un stream, descomprimidos si usa FlateDecode
+func datosDescomprimidos(t *testing.T, objeto []byte) ([]byte, []byte) {
+	t.Helper()
+	diccionario, datos := datosStreamPDF(objeto)
+	if datos == nil {
+		t.Fatalf("el objeto no es un stream: %s", objeto)
+	}
+	if !bytes.Contains(diccionario, []byte("/FlateDecode")) {
+		return diccionario, datos
+	}
+	r, err := zlib.NewReader(bytes.NewReader(datos))
+	if err != nil {
+		t.Fatalf("stream FlateDecode inválido: %v", err)
+	}
+	defer r.Close()
+	plano, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("stream FlateDecode inválido: %v", err)
+	}
+	return diccionario, plano
+}
+
+// TestGenerarPDFA3DesdeXMLTimbrado genera la representación impresa PDF/A-3b de un CFDI timbrado y revisa
+// el XML incrustado, los metadatos XMP y el OutputIntent
+func TestGenerarPDFA3DesdeXMLTimbrado(t *testing.T) {
+	xmlTimbrado := []byte(facturaPPDPrueba)
+	buf, nombre, err := GenerarPDFDesdeXML(xmlTimbrado, OpcionesPDF{PDFA: true})
+	if err != nil {
+		t.Fatalf("error al generar el PDF/A-3: %v", err)
+	}
+	if nombre != "Factura_A5.pdf" {
+		t.Errorf("nombre = %q, se esperaba Factura_A5.pdf", nombre)
+	}
+	pdf := buf.Bytes()
+	if err := ValidarPDFA3(pdf); err != nil {
+		t.Fatalf("el PDF generado no pasa la validación: %v", err)
+	}
+	objetos, trailer, err := leerObjetosPDF(pdf)
+	if err != nil {
+		t.Fatalf("error al leer el PDF: %v", err)
+	}
+	catalogo := objetoDeCatalogo(t, objetos, trailer, "Root")
+
+	t.Run("archivo incrustado", func(t *testing.T) {
+		m := reAF.FindSubmatch(catalogo)
+		if m == nil {
+			t.Fatalf("el catálogo no tiene /AF: %s", catalogo)
+		}
+		refs := reRefsPDF.FindAllSubmatch(m[1], -1)
+		if len(refs) != 1 {
+			t.Fatalf("/AF debía tener un archivo asociado: %s", m[0])
+		}
+		num, _ := strconv.Atoi(string(refs[0][1]))
+		especificacion := objetos[num]
+		for _, esperado := range []string{"/Type /Filespec", "/AFRelationship /Source", "/F " + textoPDF("Factura_A5.xml")} {
+			if !bytes.Contains(especificacion, []byte(esperado)) {
+				t.Errorf("la especificación del archivo no tiene %s: %s", esperado, especificacion)
+			}
+		}
+		if !bytes.Contains(catalogo, []byte("/EmbeddedFiles << /Names ["+textoPDF("Factura_A5.xml"))) {
+			t.Errorf("el archivo no está en el árbol EmbeddedFiles: %s", catalogo)
+		}
+
+		diccionario, datos := datosDescomprimidos(t, objetoDeCatalogo(t, objetos, especificacion, "F"))
+		if !bytes.Contains(diccionario, []byte("/Type /EmbeddedFile /Subtype /text#2Fxml")) {
+			t.Errorf("el archivo no está marcado como text/xml: %s", diccionario)
+		}
+		if !bytes.Equal(datos, xmlTimbrado) {
+			t.Errorf("el XML incrustado no es el XML timbrado")
+		}
+		if !bytes.Contains(diccionario, []byte("/Size "+strconv.Itoa(len(xmlTimbrado)))) {
+			t.Errorf("/Size no corresponde al XML: %s", diccionario)
+		}
+	})
+
+	t.Run("metadatos XMP", func(t *testing.T) {
+		diccionario, xmp := datosStreamPDF(objetoDeCatalogo(t, objetos, catalogo, "Metadata"))
+		if bytes.Contains(diccionario, []byte("/Filter")) {
+			t.Errorf("el XMP debe ir sin comprimir: %s", diccionario)
+		}
+		// El paquete debe ser XML bien formado para que un lector de XMP lo acepte
+		decoder := xml.NewDecoder(bytes.NewReader(xmp))
+		for {
+			if _, err := decoder.Token(); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("XMP mal formado: %v", err)
+			}
+		}
+		for _, esperado := range []string{
+			"<pdfaid:part>3</pdfaid:part>",
+			"<pdfaid:conformance>B</pdfaid:conformance>",
+			"<cfdi:UUID>5FB2822E-396D-4725-8521-CDC4BDD20CCF</cfdi:UUID>",
+			"<cfdi:RfcEmisor>EKU9003173C9</cfdi:RfcEmisor>",
+			"<cfdi:RfcReceptor>URE180429TM6</cfdi:RfcReceptor>",
+			"<cfdi:Total>1640.00</cfdi:Total>",
+			"<pdfaSchema:namespaceURI>" + NamespaceXMPCFDI + "</pdfaSchema:namespaceURI>",
+			"CFDI 5FB2822E-396D-4725-8521-CDC4BDD20CCF",
+		} {
+			if !bytes.Contains(xmp, []byte(esperado)) {
+				t.Errorf("el XMP no tiene %s", esperado)
+			}
+		}
+		// El diccionario Info debe coincidir con el XMP
+		info := objetoDeCatalogo(t, objetos, trailer, "Info")
+		if !bytes.Contains(info, []byte("/Subject "+textoPDF("CFDI 5FB2822E-396D-4725-8521-CDC4BDD20CCF"))) {
+			t.Errorf("/Subject del Info no coincide con el XMP: %s", info)
+		}
+	})
+
+	t.Run("OutputIntent", func(t *testing.T) {
+		for _, esperado := range []string{"/Type /OutputIntent", "/S /GTS_PDFA1", "/OutputConditionIdentifier (sRGB IEC61966-2.1)"} {
+			if !bytes.Contains(catalogo, []byte(esperado)) {
+				t.Errorf("el OutputIntent no tiene %s: %s", esperado, catalogo)
+			}
+		}
+		diccionario, icc := datosDescomprimidos(t, objetoDeCatalogo(t, objetos, catalogo, "DestOutputProfile"))
+		if !bytes.Contains(diccionario, []byte("/N 3")) {
+			t.Errorf("el perfil debe tener 3 componentes: %s", diccionario)
+		}
+		if len(icc) < 132 || string(icc[36:40]) != "acsp" || string(icc[12:20]) != "mntrRGB " {
+			t.Fatalf("el perfil de destino no es un perfil ICC RGB de monitor")
+		}
+		if tamano := binary.BigEndian.Uint32(icc[0:]); int(tamano) != len(icc) {
+			t.Errorf("el encabezado ICC declara %d bytes y el perfil tiene %d", tamano, len(icc))
+		}
+	})
+}
+
+// TestValidarPDFA3RechazaPDFSinConvertir revisa que el PDF normal de gofpdf no pase como PDF/A-3b
+func TestValidarPDFA3RechazaPDFSinConvertir(t *testing.T) {
+	buf, _, err := GenerarPDFDesdeXML([]byte(facturaPPDPrueba), OpcionesPDF{})
+	if err != nil {
+		t.Fatalf("error al generar el PDF: %v", err)
+	}
+	if err := ValidarPDFA3(buf.Bytes()); err == nil {
+		t.Fatalf("un PDF sin XMP, OutputIntent ni XML incrustado pasó la validación")
+	}
+}
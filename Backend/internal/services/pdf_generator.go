@@ -4,65 +4,38 @@ import (
 	"bytes"
 	"fmt"
 	"log"
-	"os"
-	"path/filepath"
+	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
-	"Facts/internal/db"
 	"Facts/internal/models"
 
 	"github.com/phpdave11/gofpdf"
 )
 
-func splitTextSafely(pdf *gofpdf.Fpdf, texto string, ancho float64) []string {
-	// Dividir texto manualmente para evitar problemas con SplitText
-	if len(texto) <= 80 {
-		return []string{texto}
-	}
-
-	var lineas []string
-	palabras := strings.Fields(texto)
-	lineaActual := ""
-	longitudMaxima := 80
-
-	for _, palabra := range palabras {
-		testLinea := lineaActual
-		if testLinea != "" {
-			testLinea += " "
-		}
-		testLinea += palabra
-
-		// Si la línea se vuelve muy larga, guardar la anterior y empezar nueva
-		if len(testLinea) > longitudMaxima {
-			if lineaActual != "" {
-				lineas = append(lineas, lineaActual)
-			}
-			lineaActual = palabra
-		} else {
-			lineaActual = testLinea
-		}
-	}
-
-	if lineaActual != "" {
-		lineas = append(lineas, lineaActual)
-	}
-
-	return lineas
+// usoCFDICatalogo son las descripciones de c_UsoCFDI que se muestran en la factura
+var usoCFDICatalogo = map[string]string{
+	"G01":  "Adquisición de mercancías",
+	"G02":  "Devoluciones, descuentos o bonificaciones",
+	"G03":  "Gastos en general",
+	"I01":  "Construcciones",
+	"I02":  "Mobiliario y equipo de oficina por inversiones",
+	"I03":  "Equipo de transporte",
+	"I04":  "Equipo de cómputo y accesorios",
+	"I08":  "Otra maquinaria y equipo",
+	"D01":  "Honorarios médicos, dentales y gastos hospitalarios",
+	"D02":  "Gastos médicos por incapacidad o discapacidad",
+	"D10":  "Pagos por servicios educativos (colegiaturas)",
+	"S01":  "Sin efectos fiscales",
+	"CP01": "Pagos",
+	"CN01": "Nómina",
+	"P01":  "Por definir",
 }
 
 // Función auxiliar para obtener la descripción del uso de CFDI
 func obtenerDescripcionUsoCfdi(clave string) string {
-	descripciones := map[string]string{
-		"G01": "Adquisición de mercancías",
-		"G02": "Devoluciones, descuentos o bonificaciones",
-		"G03": "Gastos en general",
-		"I01": "Construcciones",
-		"D01": "Honorarios médicos",
-		"P01": "Por definir",
-	}
-	if desc, ok := descripciones[clave]; ok {
+	if desc, ok := usoCFDICatalogo[clave]; ok {
 		return desc
 	}
 	return clave
@@ -76,625 +49,671 @@ func obtenerDescripcionRegimenFiscalPDF(clave string) string {
 	return clave
 }
 
-// Modificada para incluir nombre de archivo con serie_df y folio sin ceros a la izquierda
-func GenerarPDF(factura models.Factura, empresa *models.Empresa, logoBytes []byte) (*bytes.Buffer, string, error) {
-	pdf := gofpdf.New("P", "mm", "A4", "")
-	pdf.SetAuthor("Sistema de Facturación", true)
-	pdf.SetTitle("Factura Electrónica", true)
-	pdf.AddPage()
-	pdf.SetMargins(10, 10, 10)
-
-	tr := pdf.UnicodeTranslatorFromDescriptor("")
-
-	// ========== HEADER LIMPIO ==========
-	// Agregar logo si está disponible (posición izquierda)
-	if len(logoBytes) > 0 {
-		tmpDir := os.TempDir()
-		tmpfileName := filepath.Join(tmpDir, fmt.Sprintf("logo-%d.png", time.Now().UnixNano()))
-		err := os.WriteFile(tmpfileName, logoBytes, 0644)
-		if err == nil {
-			defer os.Remove(tmpfileName)
-			pdf.Image(tmpfileName, 10, 10, 30, 30, false, "", 0, "")
-		}
+// Descripciones de catálogos del SAT que aparecen en la representación impresa
+var (
+	tiposComprobantePDF = map[string]string{"I": "Ingreso", "E": "Egreso", "T": "Traslado", "N": "Nómina", "P": "Pago"}
+	titulosComprobante  = map[string]string{"I": "FACTURA", "E": "NOTA DE CRÉDITO", "T": "TRASLADO", "N": "RECIBO DE NÓMINA", "P": "RECIBO ELECTRÓNICO DE PAGO"}
+	metodosPagoPDF      = map[string]string{"PUE": "Pago en una sola exhibición", "PPD": "Pago en parcialidades o diferido"}
+	formasPagoPDF       = map[string]string{
+		"01": "Efectivo", "02": "Cheque nominativo", "03": "Transferencia electrónica de fondos",
+		"04": "Tarjeta de crédito", "05": "Monedero electrónico", "06": "Dinero electrónico",
+		"08": "Vales de despensa", "12": "Dación en pago", "13": "Pago por subrogación",
+		"14": "Pago por consignación", "15": "Condonación", "17": "Compensación", "23": "Novación",
+		"24": "Confusión", "25": "Remisión de deuda", "26": "Prescripción o caducidad",
+		"27": "A satisfacción del acreedor", "28": "Tarjeta de débito", "29": "Tarjeta de servicios",
+		"30": "Aplicación de anticipos", "31": "Intermediario pagos", "99": "Por definir",
+	}
+	exportacionPDF     = map[string]string{"01": "No aplica", "02": "Definitiva", "03": "Temporal", "04": "Definitiva con clave distinta a A1"}
+	impuestosPDF       = map[string]string{"001": "ISR", "002": "IVA", "003": "IEPS"}
+	tiposRelacionPDF   = map[string]string{"01": "Nota de crédito", "02": "Nota de débito", "03": "Devolución de mercancía", "04": "Sustitución de los CFDI previos", "05": "Traslados de mercancías facturados previamente", "06": "Factura generada por traslados previos", "07": "Aplicación de anticipo"}
+	periodicidadesPDF  = map[string]string{"01": "Diario", "02": "Semanal", "03": "Quincenal", "04": "Mensual", "05": "Bimestral"}
+	descripcionVacia   = "-"
+	leyendaImpresaCFDI = "Este documento es una representación impresa de un CFDI"
+)
+
+// conDescripcion devuelve "clave - descripción" según el catálogo, o solo la clave si no está
+func conDescripcion(clave string, catalogo map[string]string) string {
+	if clave == "" {
+		return descripcionVacia
 	}
+	if desc, ok := catalogo[clave]; ok {
+		return clave + " - " + desc
+	}
+	return clave
+}
 
-	// === OBTENER SERIE_DF DEL USUARIO (idUsuario de la factura) ===
-	serieDF := ""
-	idUsuario := 1
-	if factura.EmpresaID != nil {
-		if id, ok := factura.EmpresaID.(int); ok {
-			idUsuario = id
-		}
+// moneda da formato $1,234.56 a un importe del XML
+func moneda(valor string) string {
+	n := importeXML(valor)
+	signo := ""
+	if n < 0 {
+		signo, n = "-", -n
+	}
+	entero, decimales, _ := strings.Cut(strconv.FormatFloat(n, 'f', 2, 64), ".")
+	var miles []string
+	for len(entero) > 3 {
+		miles = append([]string{entero[len(entero)-3:]}, miles...)
+		entero = entero[:len(entero)-3]
+	}
+	miles = append([]string{entero}, miles...)
+	return signo + "$" + strings.Join(miles, ",") + "." + decimales
+}
+
+// cantidad muestra la cantidad sin ceros de más (2.000000 -> 2)
+func cantidad(valor string) string {
+	if n, err := strconv.ParseFloat(valor, 64); err == nil {
+		return strconv.FormatFloat(n, 'f', -1, 64)
 	}
-	datosFiscales, err := db.ObtenerDatosFiscales(idUsuario)
-	if err == nil {
-		if s, ok := datosFiscales["serie_df"].(string); ok {
-			serieDF = s
-		}
+	return valor
+}
+
+// nombreImpuesto arma la etiqueta de un impuesto: "IVA 16%", "IEPS cuota 0.5", "IVA exento"
+func nombreImpuesto(i ImpuestoImpreso) string {
+	nombre, ok := impuestosPDF[i.Impuesto]
+	if !ok {
+		nombre = i.Impuesto
+	}
+	switch i.TipoFactor {
+	case "Exento":
+		return nombre + " exento"
+	case "Cuota":
+		return nombre + " cuota " + cantidad(i.TasaOCuota)
 	}
+	if i.TasaOCuota == "" {
+		return nombre
+	}
+	return nombre + " " + strconv.FormatFloat(importeXML(i.TasaOCuota)*100, 'f', -1, 64) + "%"
+}
 
-	// === OBTENER FOLIO COMO INT (sin ceros a la izquierda) ===
-	folioInt := 0
-	if factura.NumeroFolio != "" {
-		folioInt, _ = strconv.Atoi(factura.NumeroFolio)
+// fechaPDF muestra la fecha del XML (AAAA-MM-DDTHH:MM:SS) como DD/MM/AAAA HH:MM:SS
+func fechaPDF(fecha string) string {
+	if t, err := time.Parse("2006-01-02T15:04:05", fecha); err == nil {
+		return t.Format("02/01/2006 15:04:05")
 	}
+	return fecha
+}
 
-	// === GENERAR NOMBRE DE ARCHIVO ===
-	nombreArchivo := fmt.Sprintf("Factura_%s%d.pdf", serieDF, folioInt)
+// OpcionesPDF son los datos de la representación impresa que no vienen en el XML
+type OpcionesPDF struct {
+	Logo              []byte
+	Observaciones     string
+	EstadoCancelacion string   // estado de models.Cancelacion; se marca en cada página
+	Tema              *TemaPDF // nil usa el tema predeterminado
+	AnchoTicket       float64  // ancho del rollo térmico en mm (80 o 58); 0 imprime en hoja A4
+	PDFA              bool     // genera PDF/A-3b con XMLCFDI incrustado; usa FuentePDFA en lugar de la fuente del tema
+	XMLCFDI           []byte   // XML timbrado que se incrusta en el PDF/A
+}
 
-	y := 45.0
-	pdf.SetTextColor(0, 0, 0)
+// GenerarPDFDesdeXML lee el CFDI y genera su representación impresa
+func GenerarPDFDesdeXML(xmlCFDI []byte, opciones OpcionesPDF) (*bytes.Buffer, string, error) {
+	ri, err := LeerRepresentacionImpresa(xmlCFDI)
+	if err != nil {
+		return nil, "", err
+	}
+	if opciones.PDFA && len(opciones.XMLCFDI) == 0 {
+		opciones.XMLCFDI = xmlCFDI
+	}
+	return GenerarPDF(ri, opciones)
+}
 
-	// ========== DATOS ESENCIALES DE LA FACTURA (COLUMNA IZQUIERDA) ==========
-	pdf.SetFont("Arial", "B", 8) // Negrita para las etiquetas
-
-	// RFC emisor
-	if factura.EmisorRFC != "" {
-		pdf.SetXY(10, y)
-		pdf.SetTextColor(0, 0, 0)
-		pdf.Cell(40, 4, tr("RFC emisor:"))
-		pdf.SetFont("Arial", "", 8) // Normal para los datos
-		pdf.SetTextColor(64, 64, 64)
-		pdf.Cell(70, 4, tr(factura.EmisorRFC))
-		y += 4
-	}
-
-	// Nombre emisor
-	if factura.EmisorRazonSocial != "" {
-		pdf.SetXY(10, y)
-		pdf.SetFont("Arial", "B", 8) // Negrita para la etiqueta
-		pdf.SetTextColor(0, 0, 0)
-		pdf.Cell(40, 4, tr("Nombre emisor:"))
-		pdf.SetFont("Arial", "", 8) // Normal para los datos
-		pdf.SetTextColor(64, 64, 64)
-		lineas := splitTextSafely(pdf, tr(factura.EmisorRazonSocial), 70)
-		pdf.Cell(70, 4, tr(lineas[0]))
-		y += 4
-		for i := 1; i < len(lineas); i++ {
-			pdf.SetXY(50, y)
-			pdf.SetFont("Arial", "", 8) // Normal para los datos
-			pdf.SetTextColor(64, 64, 64)
-			pdf.Cell(70, 4, tr(lineas[i]))
-			y += 4
-		}
+// documentoPDF agrupa el documento, el tema y la posición vertical mientras se dibuja la representación impresa
+type documentoPDF struct {
+	pdf  *gofpdf.Fpdf
+	tr   func(string) string
+	tema TemaPDF
+	y    float64
+	utf8 bool // fuentes UTF-8 incrustadas (PDF/A)
+}
+
+const (
+	margenPDF      = 10.0
+	anchoUtilPDF   = 190.0
+	limiteInferior = 280.0
+)
+
+// espacio agrega una página si lo que sigue no cabe en la actual
+func (d *documentoPDF) espacio(alto float64) {
+	if d.y+alto > limiteInferior {
+		d.nuevaPagina()
 	}
+}
 
-	// Folio
-	folio := ""
-	if factura.NumeroFolio != "" {
-		folio = factura.NumeroFolio
-	} else if factura.Serie != "" {
-		folio = factura.Serie
-	}
-	if folio != "" {
-		pdf.SetXY(10, y)
-		pdf.SetFont("Arial", "B", 8) // Negrita para la etiqueta
-		pdf.SetTextColor(0, 0, 0)
-		pdf.Cell(40, 4, tr("Folio:"))
-		pdf.SetFont("Arial", "", 8) // Normal para los datos
-		pdf.SetTextColor(64, 64, 64)
-		pdf.Cell(70, 4, tr(folio))
-		y += 4
-	}
-
-	// RFC receptor
-	receptorRFC := ""
-	if factura.ReceptorRFC != "" {
-		receptorRFC = factura.ReceptorRFC
-	} else if factura.ClienteRFC != "" {
-		receptorRFC = factura.ClienteRFC
-	}
-	if receptorRFC != "" {
-		pdf.SetXY(10, y)
-		pdf.SetFont("Arial", "B", 8) // Negrita para la etiqueta
-		pdf.SetTextColor(0, 0, 0)
-		pdf.Cell(40, 4, tr("RFC receptor:"))
-		pdf.SetFont("Arial", "", 8) // Normal para los datos
-		pdf.SetTextColor(64, 64, 64)
-		pdf.Cell(70, 4, tr(receptorRFC))
-		y += 4
-	}
-
-	// Nombre receptor
-	receptorRazon := ""
-	if factura.ReceptorRazonSocial != "" {
-		receptorRazon = factura.ReceptorRazonSocial
-	} else if factura.ClienteRazonSocial != "" {
-		receptorRazon = factura.ClienteRazonSocial
-	}
-	if receptorRazon != "" {
-		pdf.SetXY(10, y)
-		pdf.SetFont("Arial", "B", 8) // Negrita para la etiqueta
-		pdf.SetTextColor(0, 0, 0)
-		pdf.Cell(40, 4, tr("Nombre receptor:"))
-		pdf.SetFont("Arial", "", 8) // Normal para los datos
-		pdf.SetTextColor(64, 64, 64)
-		lineas := splitTextSafely(pdf, tr(receptorRazon), 70)
-		pdf.Cell(70, 4, tr(lineas[0]))
-		y += 4
-		for i := 1; i < len(lineas); i++ {
-			pdf.SetXY(50, y)
-			pdf.SetFont("Arial", "", 8) // Normal para los datos
-			pdf.SetTextColor(64, 64, 64)
-			pdf.Cell(70, 4, tr(lineas[i]))
-			y += 4
-		}
+func (d *documentoPDF) nuevaPagina() {
+	d.pdf.AddPage()
+	d.y = 15
+}
+
+// fuente aplica la fuente del tema con el estilo ("", "B", "I") y tamaño indicados
+func (d *documentoPDF) fuente(estilo string, tamano float64) {
+	d.pdf.SetFont(d.tema.Fuente, estilo, tamano)
+}
+
+func (d *documentoPDF) colorTexto(c ColorPDF) {
+	d.pdf.SetTextColor(c.R, c.G, c.B)
+}
+
+func (d *documentoPDF) colorRelleno(c ColorPDF) {
+	d.pdf.SetFillColor(c.R, c.G, c.B)
+}
+
+// lineas parte el texto al ancho indicado (en mm) con la fuente actual
+func (d *documentoPDF) lineas(texto string, ancho float64) []string {
+	lineas := partirLineas(d.pdf, d.tr(texto), ancho, d.utf8)
+	if len(lineas) == 0 {
+		lineas = []string{""}
 	}
+	return lineas
+}
 
-	// Código postal del receptor (etiqueta en una sola línea, con acento)
-	cpReceptor := ""
-	if factura.CodigoPostal != "" {
-		cpReceptor = factura.CodigoPostal
-	} else if factura.ReceptorCodigoPostal != "" {
-		cpReceptor = factura.ReceptorCodigoPostal
-	}
-	if cpReceptor != "" {
-		pdf.SetXY(10, y)
-		pdf.SetFont("Arial", "B", 8)
-		pdf.SetTextColor(0, 0, 0)
-		pdf.Cell(40, 4, tr("Código postal del receptor:"))
-		pdf.SetFont("Arial", "", 8)
-		pdf.SetTextColor(64, 64, 64)
-		pdf.SetXY(50, y)
-		pdf.Cell(70, 4, cpReceptor)
-		y += 4
-	}
-
-	// Régimen fiscal receptor
-	regimenReceptor := ""
-	if factura.RegimenFiscalReceptor != "" {
-		regimenReceptor = factura.RegimenFiscalReceptor
-	} else if factura.RegimenFiscal != "" {
-		regimenReceptor = factura.RegimenFiscal
-	}
-	if regimenReceptor != "" {
-		pdf.SetXY(10, y)
-		pdf.SetFont("Arial", "B", 8) // Negrita para la etiqueta
-		pdf.SetTextColor(0, 0, 0)
-		pdf.Cell(40, 4, tr("Régimen fiscal"))
-		y += 4
-		pdf.SetXY(10, y)
-		pdf.SetFont("Arial", "B", 8) // Negrita para la etiqueta
-		pdf.Cell(40, 4, tr("receptor:"))
-		pdf.SetFont("Arial", "", 8) // Normal para los datos
-		pdf.SetTextColor(64, 64, 64)
-		regimenDesc := obtenerDescripcionRegimenFiscalPDF(regimenReceptor)
-		pdf.Cell(70, 4, tr(regimenDesc))
-		y += 4
-	}
-
-	// Uso CFDI
-	pdf.SetXY(10, y)
-	pdf.SetFont("Arial", "B", 8) // Negrita para la etiqueta
-	pdf.SetTextColor(0, 0, 0)
-	pdf.Cell(40, 4, tr("Uso CFDI:"))
-	pdf.SetFont("Arial", "", 8) // Normal para los datos
-	pdf.SetTextColor(64, 64, 64)
-	var usoCfdiTexto string
-	if factura.UsoCFDI != "" {
-		usoCfdiDesc := obtenerDescripcionUsoCfdi(factura.UsoCFDI)
-		usoCfdiTexto = usoCfdiDesc
-	} else {
-		usoCfdiTexto = "Gastos en general"
-	}
-	pdf.Cell(70, 4, tr(usoCfdiTexto))
-	y += 4
-
-	// ========== INFORMACIÓN FISCAL (COLUMNA DERECHA) ==========
-	yFiscal := 45.0
-
-	// Folio fiscal
-	// Folio fiscal (UUID del timbre)
-	pdf.SetXY(110, yFiscal)
-	pdf.SetFont("Arial", "B", 8)
-	pdf.SetTextColor(0, 0, 0)
-	pdf.Cell(50, 4, tr("Folio fiscal:"))
-	pdf.SetFont("Arial", "", 8)
-	pdf.SetTextColor(64, 64, 64)
-	pdf.Cell(80, 4, tr(factura.UUID))
-	yFiscal += 4
-
-	// Etiqueta y valor de No. de serie del CSD en varias líneas si es necesario
-	leftX := 110.0
-	labelWidth := 50.0
-	lineHeight := 4.0
-
-	noSerie := factura.NoCertificado
-	splitByLength := func(text string, length int) []string {
-		var out []string
-		for len(text) > length {
-			out = append(out, text[:length])
-			text = text[length:]
+// campo escribe "etiqueta: valor" en x,y y devuelve la y siguiente; el valor se parte en varias líneas si no cabe
+func (d *documentoPDF) campo(x, y, anchoEtiqueta, anchoValor float64, etiqueta, valor string) float64 {
+	if valor == "" {
+		return y
+	}
+	alto := d.tema.TamanoTexto / 2
+	d.pdf.SetXY(x, y)
+	d.fuente("B", d.tema.TamanoTexto)
+	d.pdf.SetTextColor(0, 0, 0)
+	d.pdf.Cell(anchoEtiqueta, alto, d.tr(etiqueta))
+	d.fuente("", d.tema.TamanoTexto)
+	d.colorTexto(d.tema.ColorTexto)
+	for _, linea := range d.lineas(valor, anchoValor) {
+		d.pdf.SetXY(x+anchoEtiqueta, y)
+		d.pdf.Cell(anchoValor, alto, linea)
+		y += alto
+	}
+	return y
+}
+
+// titulo escribe el encabezado de una sección
+func (d *documentoPDF) titulo(texto string) {
+	d.espacio(12)
+	d.fuente("B", d.tema.TamanoSeccion)
+	d.colorTexto(d.tema.ColorPrimario)
+	d.pdf.SetXY(margenPDF, d.y)
+	d.pdf.Cell(anchoUtilPDF, 6, d.tr(texto))
+	if d.tema.LineaSeccion {
+		d.pdf.SetDrawColor(d.tema.ColorPrimario.R, d.tema.ColorPrimario.G, d.tema.ColorPrimario.B)
+		d.pdf.SetLineWidth(0.4)
+		d.pdf.Line(margenPDF, d.y+6, margenPDF+anchoUtilPDF, d.y+6)
+		d.pdf.SetLineWidth(0.2)
+		d.pdf.SetDrawColor(0, 0, 0)
+	}
+	d.y += 7
+}
+
+// columnaPDF es una columna de tablaPDF
+type columnaPDF struct {
+	encabezado string
+	ancho      float64
+	alineacion string
+}
+
+// tablaPDF dibuja renglones de alto variable con el estilo del tema. Al cambiar de página repite
+// el encabezado, y un renglón que no cabe en una página completa continúa en la siguiente.
+type tablaPDF struct {
+	d         *documentoPDF
+	columnas  []columnaPDF
+	renglones int
+}
+
+func (t *tablaPDF) altoEncabezado() float64 {
+	return t.d.tema.AltoLinea + 3
+}
+
+// encabezado dibuja los títulos de las columnas en la posición actual
+func (t *tablaPDF) encabezado() {
+	d := t.d
+	d.fuente("B", d.tema.TamanoTabla)
+	d.colorRelleno(d.tema.ColorPrimario)
+	d.pdf.SetTextColor(255, 255, 255)
+	d.pdf.SetDrawColor(0, 0, 0)
+	x := margenPDF
+	for _, c := range t.columnas {
+		d.pdf.SetXY(x, d.y)
+		d.pdf.CellFormat(c.ancho, t.altoEncabezado(), d.tr(c.encabezado), d.tema.BordesTabla, 0, "C", true, 0, "")
+		x += c.ancho
+	}
+	d.y += t.altoEncabezado()
+}
+
+// renglon agrega un renglón; cada celda se parte en líneas al ancho de su columna
+func (t *tablaPDF) renglon(celdas ...string) {
+	d := t.d
+	d.fuente("", d.tema.TamanoTabla)
+	lineas := make([][]string, len(t.columnas))
+	total := 1
+	for i, c := range t.columnas {
+		lineas[i] = d.lineas(celdas[i], c.ancho-2)
+		total = max(total, len(lineas[i]))
+	}
+
+	linea := d.tema.AltoLinea
+	relleno := d.tema.RenglonesAlternos && t.renglones%2 == 0
+	t.renglones++
+	for inicio := 0; inicio < total; {
+		restantes := total - inicio
+		caben := int((limiteInferior - d.y - 3) / linea)
+		// Lo que falta del renglón pasa entero a la página siguiente si ahí cabe; solo se parte si es más alto que una página
+		altoPagina := limiteInferior - 15 - t.altoEncabezado() - 3
+		if caben < restantes && (caben < 1 || float64(restantes)*linea <= altoPagina) {
+			d.nuevaPagina()
+			t.encabezado()
+			d.fuente("", d.tema.TamanoTabla)
+			continue
 		}
-		if len(text) > 0 {
-			out = append(out, text)
+		tramo := min(caben, restantes)
+		alto := float64(tramo)*linea + 3
+
+		d.colorTexto(d.tema.ColorTexto)
+		d.colorRelleno(d.tema.ColorSecundario)
+		x := margenPDF
+		for i, c := range t.columnas {
+			d.pdf.SetXY(x, d.y)
+			d.pdf.CellFormat(c.ancho, alto, "", d.tema.BordesTabla, 0, "", relleno, 0, "")
+			for k := inicio; k < inicio+tramo && k < len(lineas[i]); k++ {
+				d.pdf.SetXY(x+1, d.y+1.5+float64(k-inicio)*linea)
+				d.pdf.CellFormat(c.ancho-2, linea, lineas[i][k], "", 0, c.alineacion, false, 0, "")
+			}
+			x += c.ancho
 		}
-		return out
-	}
-	lines := splitByLength(noSerie, 22)
-	if len(lines) > 0 {
-		// Imprime la etiqueta solo en la primera línea
-		pdf.SetXY(leftX, yFiscal)
-		pdf.SetFont("Arial", "B", 8)
-		pdf.SetTextColor(0, 0, 0)
-		pdf.Cell(labelWidth, lineHeight, "No. de serie del CSD:")
-
-		// Imprime el valor, que puede ocupar varias líneas
-		pdf.SetFont("Arial", "", 8)
-		pdf.SetTextColor(64, 64, 64)
-		pdf.SetXY(leftX+labelWidth, yFiscal)
-		pdf.Cell(80, lineHeight, lines[0])
-
-		for i := 1; i < len(lines); i++ {
-			pdf.SetXY(leftX+labelWidth, yFiscal+float64(i)*lineHeight)
-			pdf.Cell(80, lineHeight, lines[i])
+		d.y += alto
+		inicio += tramo
+	}
+}
+
+// GenerarPDF dibuja la representación impresa del CFDI. Todo lo impreso sale del modelo leído del XML;
+// no se consulta la base de datos.
+func GenerarPDF(ri *RepresentacionImpresa, opciones OpcionesPDF) (*bytes.Buffer, string, error) {
+	if opciones.AnchoTicket > 0 {
+		return GenerarTicketPDF(ri, opciones)
+	}
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	pdf.SetAuthor(autorPDF, true)
+	pdf.SetTitle(tituloPDF, true)
+	pdf.SetMargins(margenPDF, margenPDF, margenPDF)
+	pdf.SetAutoPageBreak(false, margenPDF)
+
+	tema := temasPDF[TemaPDFPredeterminado]
+	if opciones.Tema != nil {
+		tema = *opciones.Tema
+	}
+	d := &documentoPDF{pdf: pdf, tr: pdf.UnicodeTranslatorFromDescriptor(""), tema: tema}
+	if opciones.PDFA {
+		if err := usarFuentesPDFA(pdf); err != nil {
+			return nil, "", err
 		}
-		// Ahora, actualiza yFiscal para dejar espacio después de todas las líneas
-		yFiscal += float64(len(lines)) * lineHeight
-	} else {
-		log.Printf("PDF_WARNING - No se pudo mostrar el número de serie del CSD: valor vacío")
-		yFiscal += lineHeight
-	}
-
-	// === DATOS DE TIMBRADO FISCAL DIGITAL ===
-	if factura.Timbre != nil {
-		pdf.SetXY(110, yFiscal)
-		pdf.SetFont("Arial", "B", 8)
-		pdf.SetTextColor(0, 0, 0)
-		pdf.Cell(50, 4, tr("Datos de timbrado fiscal"))
-		yFiscal += 4
-
-		pdf.SetFont("Arial", "", 8)
-		pdf.SetTextColor(64, 64, 64)
-
-		pdf.SetXY(110, yFiscal)
-		pdf.Cell(50, 4, "UUID:")
-		pdf.Cell(80, 4, factura.Timbre.UUID)
-		yFiscal += 4
-
-		pdf.SetXY(110, yFiscal)
-		pdf.Cell(50, 4, "Fecha timbrado:")
-		pdf.Cell(80, 4, factura.Timbre.FechaTimbrado)
-		yFiscal += 4
-
-		pdf.SetXY(110, yFiscal)
-		pdf.Cell(50, 4, "RFC Proveedor Certif.:")
-		pdf.Cell(80, 4, factura.Timbre.RfcProvCertif)
-		yFiscal += 4
-
-		pdf.SetXY(110, yFiscal)
-		pdf.Cell(50, 4, "No. Certificado SAT:")
-		pdf.Cell(80, 4, factura.Timbre.NoCertificadoSAT)
-		yFiscal += 4
-
-		pdf.SetXY(110, yFiscal)
-		pdf.Cell(50, 4, "Sello CFD:")
-		pdf.SetXY(160, yFiscal)
-		pdf.MultiCell(130, 4, factura.Timbre.SelloCFD, "", "", false)
-		yFiscal += 8
-
-		pdf.SetXY(110, yFiscal)
-		pdf.Cell(50, 4, "Sello SAT:")
-		pdf.SetXY(160, yFiscal)
-		pdf.MultiCell(130, 4, factura.Timbre.SelloSAT, "", "", false)
-		yFiscal += 8
-	}
-
-	// ---- Etiqueta en dos líneas y formato con 'T' ----
-	pdf.SetXY(110, yFiscal)
-	pdf.SetFont("Arial", "B", 8)
-	pdf.SetTextColor(0, 0, 0)
-	pdf.Cell(50, 4, tr("Código postal, fecha y hora"))
-	yFiscal += 4
-	pdf.SetXY(110, yFiscal)
-	pdf.Cell(50, 4, tr("de emisión:"))
-
-	// Valor en la segunda columna
-	pdf.SetFont("Arial", "", 8)
-	pdf.SetTextColor(64, 64, 64)
-	pdf.SetXY(160, yFiscal)
-	codigoPostalEmisor := ""
-	if factura.EmisorCodigoPostal != "" {
-		codigoPostalEmisor = factura.EmisorCodigoPostal
-	}
-	fechaEmision := ""
-	if factura.FechaEmision != "" {
-		t, err := time.Parse(time.RFC3339, factura.FechaEmision)
-		if err == nil {
-			fechaEmision = t.Format("02/01/2006T15:04:05") // <-- Separador T aquí
-		} else {
-			fechaEmision = factura.FechaEmision
+		d.tema.Fuente, d.tr, d.utf8 = FuentePDFA, sinTraduccion, true
+	}
+	pdf.AliasNbPages("")
+	pdf.SetFooterFunc(func() {
+		d.fuente("", 7)
+		d.colorTexto(d.tema.ColorTexto)
+		d.pdf.SetXY(margenPDF, 287)
+		d.pdf.CellFormat(anchoUtilPDF, 4, d.tr(fmt.Sprintf("Página %d de {nb}", d.pdf.PageNo())), "", 0, "R", false, 0, "")
+	})
+	pdf.AddPage()
+
+	dibujarEncabezado(d, ri, opciones.Logo)
+	dibujarDatosGenerales(d, ri)
+	dibujarRelacionados(d, ri)
+	dibujarConceptos(d, ri)
+	dibujarTotales(d, ri)
+	dibujarPagos(d, ri)
+	if opciones.Observaciones != "" {
+		d.titulo("OBSERVACIONES")
+		d.fuente("", d.tema.TamanoTexto+1)
+		d.colorTexto(d.tema.ColorTexto)
+		alto := (d.tema.TamanoTexto + 1) / 2
+		for _, linea := range d.lineas(opciones.Observaciones, anchoUtilPDF) {
+			d.espacio(alto)
+			d.pdf.SetXY(margenPDF, d.y)
+			d.pdf.Cell(anchoUtilPDF, alto, linea)
+			d.y += alto
 		}
-	} else {
-		fechaEmision = time.Now().Format("02/01/2006T15:04:05") // <-- Separador T aquí
-	}
-	var datosEmision string
-	if codigoPostalEmisor != "" && fechaEmision != "" {
-		datosEmision = fmt.Sprintf("CP: %s | %s", codigoPostalEmisor, fechaEmision)
-	} else if codigoPostalEmisor != "" {
-		datosEmision = fmt.Sprintf("CP: %s", codigoPostalEmisor)
-	} else if fechaEmision != "" {
-		datosEmision = fechaEmision
-	} else {
-		datosEmision = "-"
-	}
-	pdf.Cell(80, 4, tr(datosEmision))
-	yFiscal += 4
-
-	// Efecto de comprobante
-	pdf.SetXY(110, yFiscal)
-	pdf.SetFont("Arial", "B", 8) // Negrita para la etiqueta
-	pdf.SetTextColor(0, 0, 0)
-	pdf.Cell(50, 4, tr("Efecto de comprobante:"))
-	pdf.SetFont("Arial", "", 8) // Normal para los datos
-	pdf.SetTextColor(64, 64, 64)
-	pdf.Cell(80, 4, tr("Ingreso"))
-	yFiscal += 4
-
-	// Régimen fiscal (del emisor)
-	pdf.SetXY(110, yFiscal)
-	pdf.SetFont("Arial", "B", 8) // Negrita para la etiqueta
-	pdf.SetTextColor(0, 0, 0)
-	pdf.Cell(50, 4, tr("Régimen fiscal:"))
-	pdf.SetFont("Arial", "", 8) // Normal para los datos
-	pdf.SetTextColor(64, 64, 64)
-	regimenFiscalTexto := ""
-	if factura.EmisorRegimenFiscal != "" {
-		regimenFiscalTexto = obtenerDescripcionRegimenFiscalPDF(factura.EmisorRegimenFiscal)
-	} else {
-		regimenFiscalTexto = "General de Ley Personas Morales"
 	}
-	pdf.Cell(80, 4, tr(regimenFiscalTexto))
-	yFiscal += 4
+	dibujarTimbre(d, ri)
 
-	// Ajustar Y para continuar después de ambas columnas
-	if yFiscal > y {
-		y = yFiscal
+	marcarEstadoCancelacion(d, opciones.EstadoCancelacion)
+
+	pdfBuffer, err := terminarPDF(pdf, ri, opciones)
+	if err != nil {
+		return nil, "", fmt.Errorf("error al generar PDF: %w", err)
 	}
+	return pdfBuffer, ri.NombreArchivo("pdf"), nil
+}
 
-	y += 2 // Espacio adicional reducido
+// dibujarEncabezado pone el logo, el tipo de comprobante, serie y folio
+func dibujarEncabezado(d *documentoPDF, ri *RepresentacionImpresa, logo []byte) {
+	if len(logo) > 0 {
+		tipo := strings.TrimPrefix(http.DetectContentType(logo), "image/")
+		if tipo == "png" || tipo == "jpeg" || tipo == "gif" {
+			opciones := gofpdf.ImageOptions{ImageType: tipo}
+			d.pdf.RegisterImageOptionsReader("logo", opciones, bytes.NewReader(logo))
+			if d.pdf.Ok() {
+				d.pdf.ImageOptions("logo", margenPDF, margenPDF, 30, 30, false, opciones, 0, "")
+			} else {
+				log.Printf("PDF_WARNING - Logo inválido: %v", d.pdf.Error())
+				d.pdf.ClearError()
+			}
+		}
+	}
 
-	// Sin línea divisoria antes de la tabla
+	titulo, ok := titulosComprobante[ri.TipoDeComprobante]
+	if !ok {
+		titulo = "COMPROBANTE FISCAL DIGITAL"
+	}
+	d.fuente("B", d.tema.TamanoTitulo)
+	d.colorTexto(d.tema.ColorPrimario)
+	d.pdf.SetXY(90, 12)
+	d.pdf.CellFormat(110, 7, d.tr(titulo), "", 0, "R", false, 0, "")
 
-	// ========== TABLA DE PRODUCTOS MEJORADA ==========
-	log.Printf("PDF_DEBUG - Generando tabla de conceptos")
-	log.Printf("PDF_DEBUG - Total conceptos en factura: %d", len(factura.Conceptos))
+	d.fuente("", d.tema.TamanoTexto+1)
+	d.colorTexto(d.tema.ColorTexto)
+	if ri.Serie != "" || ri.Folio != "" {
+		d.pdf.SetXY(90, 20)
+		d.pdf.CellFormat(110, 5, d.tr("Serie y folio: "+strings.TrimSpace(ri.Serie+" "+ri.Folio)), "", 0, "R", false, 0, "")
+	}
+	d.pdf.SetXY(90, 25)
+	d.pdf.CellFormat(110, 5, d.tr("CFDI versión "+ri.Version), "", 0, "R", false, 0, "")
+	d.y = 45
+}
 
-	// Deduplicar conceptos
-	conceptosUnicos := make(map[string]models.Concepto)
-	for _, concepto := range factura.Conceptos {
-		claveUnica := fmt.Sprintf("%s_%.2f_%.2f", concepto.Descripcion, concepto.Cantidad, concepto.ValorUnitario)
-		if _, existe := conceptosUnicos[claveUnica]; !existe {
-			conceptosUnicos[claveUnica] = concepto
-		}
+// dibujarDatosGenerales escribe emisor y receptor a la izquierda y los datos fiscales a la derecha
+func dibujarDatosGenerales(d *documentoPDF, ri *RepresentacionImpresa) {
+	y := d.y
+	y = d.campo(10, y, 35, 60, "RFC emisor:", ri.Emisor.Rfc)
+	y = d.campo(10, y, 35, 60, "Nombre emisor:", ri.Emisor.Nombre)
+	y = d.campo(10, y, 35, 60, "Régimen fiscal:", conDescripcion(ri.Emisor.RegimenFiscal, regimenFiscalDescripciones))
+	y += 2
+	y = d.campo(10, y, 35, 60, "RFC receptor:", ri.Receptor.Rfc)
+	y = d.campo(10, y, 35, 60, "Nombre receptor:", ri.Receptor.Nombre)
+	y = d.campo(10, y, 35, 60, "Domicilio fiscal:", ri.Receptor.DomicilioFiscal)
+	if ri.Receptor.RegimenFiscal != "" {
+		y = d.campo(10, y, 35, 60, "Régimen receptor:", conDescripcion(ri.Receptor.RegimenFiscal, regimenFiscalDescripciones))
+	}
+	y = d.campo(10, y, 35, 60, "Residencia fiscal:", ri.Receptor.ResidenciaFiscal)
+	y = d.campo(10, y, 35, 60, "NumRegIdTrib:", ri.Receptor.NumRegIdTrib)
+	y = d.campo(10, y, 35, 60, "Uso CFDI:", conDescripcion(ri.Receptor.UsoCFDI, usoCFDICatalogo))
+
+	folioFiscal := ri.UUID()
+	if folioFiscal == "" {
+		folioFiscal = "Sin timbrar"
+	}
+	yFiscal := d.y
+	yFiscal = d.campo(110, yFiscal, 38, 52, "Folio fiscal:", folioFiscal)
+	yFiscal = d.campo(110, yFiscal, 38, 52, "No. de serie del CSD:", ri.NoCertificado)
+	yFiscal = d.campo(110, yFiscal, 38, 52, "Lugar de expedición:", ri.LugarExpedicion)
+	yFiscal = d.campo(110, yFiscal, 38, 52, "Fecha de emisión:", fechaPDF(ri.Fecha))
+	yFiscal = d.campo(110, yFiscal, 38, 52, "Efecto de comprobante:", conDescripcion(ri.TipoDeComprobante, tiposComprobantePDF))
+	yFiscal = d.campo(110, yFiscal, 38, 52, "Exportación:", conDescripcionOpcional(ri.Exportacion, exportacionPDF))
+	yFiscal = d.campo(110, yFiscal, 38, 52, "Método de pago:", conDescripcionOpcional(ri.MetodoPago, metodosPagoPDF))
+	yFiscal = d.campo(110, yFiscal, 38, 52, "Forma de pago:", conDescripcionOpcional(ri.FormaPago, formasPagoPDF))
+	monedaTexto := ri.Moneda
+	if ri.TipoCambio != "" && ri.Moneda != "MXN" && ri.Moneda != "XXX" {
+		monedaTexto += " (tipo de cambio " + ri.TipoCambio + ")"
+	}
+	yFiscal = d.campo(110, yFiscal, 38, 52, "Moneda:", monedaTexto)
+	yFiscal = d.campo(110, yFiscal, 38, 52, "Condiciones de pago:", ri.CondicionesDePago)
+
+	d.y = max(y, yFiscal) + 4
+}
+
+// conDescripcionOpcional es conDescripcion para atributos opcionales: vacío no se imprime
+func conDescripcionOpcional(clave string, catalogo map[string]string) string {
+	if clave == "" {
+		return ""
+	}
+	return conDescripcion(clave, catalogo)
+}
+
+// dibujarRelacionados escribe la información global y los CFDI relacionados
+func dibujarRelacionados(d *documentoPDF, ri *RepresentacionImpresa) {
+	if ri.InformacionGlobal != nil {
+		d.espacio(8)
+		d.y = d.campo(10, d.y, 40, 150, "Información global:", fmt.Sprintf("Periodicidad %s, meses %s, año %s",
+			conDescripcion(ri.InformacionGlobal.Periodicidad, periodicidadesPDF), ri.InformacionGlobal.Meses, ri.InformacionGlobal.Anio))
+		d.y += 2
+	}
+	for _, r := range ri.Relacionados {
+		d.espacio(8 + 4*float64(len(r.UUIDs)))
+		d.y = d.campo(10, d.y, 40, 150, "CFDI relacionados:", conDescripcion(r.TipoRelacion, tiposRelacionPDF))
+		d.y = d.campo(10, d.y, 40, 150, "UUID:", strings.Join(r.UUIDs, "\n"))
+		d.y += 2
 	}
+}
 
-	conceptosParaPDF := make([]models.Concepto, 0, len(conceptosUnicos))
-	for _, concepto := range conceptosUnicos {
-		conceptosParaPDF = append(conceptosParaPDF, concepto)
-	}
-
-	// Verificar espacio para la tabla - filas con altura fija
-	spaceNeeded := float64(len(conceptosParaPDF)*8) + 20 // Altura fija por fila
-	spaceAvailable := 280 - y
-	if spaceNeeded > spaceAvailable {
-		pdf.AddPage()
-		y = 20
-	}
-
-	// Título de la tabla
-	pdf.SetFont("Arial", "B", 12)
-	pdf.SetTextColor(30, 80, 150)
-	pdf.SetXY(15, y)
-	pdf.Cell(180, 8, tr("DETALLE DE PRODUCTOS"))
-	y += 12
-
-	// NUEVOS anchos de columna, quitando IEPS y el viejo IVA (%)
-	colWidths := []float64{
-		18, // Clave Prod/Ser
-		62, // Producto
-		13, // Clave SAT
-		16, // Unidad SAT
-		15, // Cantidad
-		15, // Precio
-		16, // IVA ($)
-		20, // TOTAL
-	}
-
-	headers := []string{
-		"Clave Prod/Ser", "Producto", "Clave SAT", "Unidad SAT",
-		"Cantidad", "Precio", "IVA ($)", "TOTAL",
-	}
-
-	// Encabezados
-	pdf.SetFont("Arial", "B", 7)
-	pdf.SetFillColor(60, 120, 180)
-	pdf.SetTextColor(255, 255, 255)
-	pdf.SetDrawColor(0, 0, 0)
-	x := 15.0
-	for i, header := range headers {
-		pdf.SetXY(x, y)
-		pdf.CellFormat(colWidths[i], 8, tr(header), "1", 0, "C", true, 0, "")
-		x += colWidths[i]
-	}
-	y += 8
-
-	// Configurar para el contenido de la tabla
-	pdf.SetFont("Arial", "", 7)
-	pdf.SetTextColor(40, 40, 40)
-	pdf.SetFillColor(248, 248, 248)
-	pdf.SetDrawColor(0, 0, 0)
-
-	// Dibujar filas de la tabla
-	for i, concepto := range conceptosParaPDF {
-		fillColor := i%2 == 0
-
-		// Verificar si necesitamos una nueva página
-		if y > 265 {
-			pdf.AddPage()
-			y = 20
-			// Redibujar encabezados en la nueva página
-			pdf.SetFont("Arial", "B", 7)
-			pdf.SetFillColor(60, 120, 180)
-			pdf.SetTextColor(255, 255, 255)
-			pdf.SetDrawColor(0, 0, 0)
-			x = 15.0
-			for j, header := range headers {
-				pdf.SetXY(x, y)
-				pdf.CellFormat(colWidths[j], 8, tr(header), "1", 0, "C", true, 0, "")
-				x += colWidths[j]
+// dibujarConceptos dibuja la tabla de conceptos con sus impuestos tal como vienen en el XML
+func dibujarConceptos(d *documentoPDF, ri *RepresentacionImpresa) {
+	tabla := &tablaPDF{d: d, columnas: []columnaPDF{
+		{"Clave Prod/Serv", 20, "C"}, {"Descripción", 66, "L"}, {"Unidad", 16, "C"}, {"Cantidad", 16, "C"},
+		{"Valor unitario", 22, "R"}, {"Impuestos", 26, "L"}, {"Importe", 24, "R"},
+	}}
+	d.espacio(30)
+	d.titulo("CONCEPTOS")
+	tabla.encabezado()
+
+	for _, c := range ri.Conceptos {
+		descripcion := c.Descripcion
+		if c.NoIdentificacion != "" {
+			descripcion = c.NoIdentificacion + " - " + descripcion
+		}
+		if importeXML(c.Descuento) > 0 {
+			descripcion += "\nDescuento: " + moneda(c.Descuento)
+		}
+		if c.ObjetoImp != "" && c.ObjetoImp != "02" {
+			descripcion += "\nObjeto de impuesto: " + c.ObjetoImp
+		}
+		var impuestos []string
+		for _, t := range c.Traslados {
+			if t.TipoFactor == "Exento" {
+				impuestos = append(impuestos, nombreImpuesto(t))
+				continue
 			}
-			y += 8
-			pdf.SetFont("Arial", "", 7)
-			pdf.SetTextColor(40, 40, 40)
-			pdf.SetFillColor(248, 248, 248)
-			pdf.SetDrawColor(0, 0, 0)
+			impuestos = append(impuestos, nombreImpuesto(t)+": "+moneda(t.Importe))
 		}
-
-		// Calcular altura de la fila basada en el texto más largo
-		maxLines := 1
-		descripcionLines := splitTextSafely(pdf, tr(concepto.Descripcion), colWidths[1]-4)
-		if len(descripcionLines) > maxLines {
-			maxLines = len(descripcionLines)
+		for _, r := range c.Retenciones {
+			impuestos = append(impuestos, "Ret. "+nombreImpuesto(r)+": "+moneda(r.Importe))
 		}
-
-		rowHeight := float64(maxLines) * 3.5
-		if rowHeight < 10 {
-			rowHeight = 10
+		unidad := c.ClaveUnidad
+		if c.Unidad != "" {
+			unidad += "\n" + c.Unidad
 		}
+		tabla.renglon(c.ClaveProdServ, descripcion, unidad, cantidad(c.Cantidad),
+			moneda(c.ValorUnitario), strings.Join(impuestos, "\n"), moneda(c.Importe))
+	}
+	d.y += 4
+}
 
-		x = 15.0
-		pdf.SetXY(x, y)
-		pdf.CellFormat(colWidths[0], rowHeight, concepto.ClaveProdServ, "1", 0, "C", fillColor, 0, "")
-		x += colWidths[0]
-
-		// Producto (descripción multilínea igual que antes)
-		pdf.SetXY(x, y)
-		pdf.CellFormat(colWidths[1], rowHeight, "", "1", 0, "L", fillColor, 0, "")
-		for j, line := range splitTextSafely(pdf, tr(concepto.Descripcion), colWidths[1]-4) {
-			lineY := y + float64(j)*3.5 + 2.5
-			pdf.SetXY(x+2, lineY)
-			pdf.Cell(colWidths[1]-4, 3.5, line)
+// dibujarTotales escribe subtotal, descuento, impuestos del comprobante y total
+func dibujarTotales(d *documentoPDF, ri *RepresentacionImpresa) {
+	type renglon struct{ etiqueta, importe string }
+	renglones := []renglon{{"SUBTOTAL:", moneda(ri.SubTotal)}}
+	if importeXML(ri.Descuento) > 0 {
+		renglones = append(renglones, renglon{"DESCUENTO:", "-" + moneda(ri.Descuento)})
+	}
+	for _, t := range ri.Traslados {
+		if t.TipoFactor == "Exento" {
+			continue
 		}
-		x += colWidths[1]
+		renglones = append(renglones, renglon{strings.ToUpper(nombreImpuesto(t)) + ":", moneda(t.Importe)})
+	}
+	for _, r := range ri.Retenciones {
+		renglones = append(renglones, renglon{"RETENCIÓN " + strings.ToUpper(nombreImpuesto(r)) + ":", "-" + moneda(r.Importe)})
+	}
+
+	d.espacio(float64(len(renglones))*6 + 10)
+	d.fuente("B", d.tema.TamanoTexto+2)
+	d.pdf.SetTextColor(0, 0, 0)
+	for _, r := range renglones {
+		d.pdf.SetXY(margenPDF, d.y)
+		d.pdf.CellFormat(155, 6, d.tr(r.etiqueta), "", 0, "R", false, 0, "")
+		d.pdf.CellFormat(35, 6, r.importe, "", 0, "R", false, 0, "")
+		d.y += 6
+	}
+	d.fuente("B", d.tema.TamanoTexto+4)
+	d.colorTexto(d.tema.ColorPrimario)
+	d.pdf.SetXY(margenPDF, d.y)
+	d.pdf.CellFormat(155, 8, d.tr("TOTAL:"), "", 0, "R", false, 0, "")
+	d.pdf.CellFormat(35, 8, moneda(ri.Total)+" "+ri.Moneda, "", 0, "R", false, 0, "")
+	d.y += 9
+	if ri.TipoDeComprobante != "P" && ri.TipoDeComprobante != "T" {
+		d.y = d.campo(margenPDF, d.y, 30, anchoUtilPDF-30, "Importe con letra:", ImporteEnLetras(importeXML(ri.Total), ri.Moneda))
+	}
+	d.y += 3
+}
 
-		claveSAT := concepto.ClaveSAT
-		if claveSAT == "" || claveSAT == "0" {
-			claveSAT = "N/A"
+// dibujarPagos dibuja el complemento de recepción de pagos con sus documentos relacionados
+func dibujarPagos(d *documentoPDF, ri *RepresentacionImpresa) {
+	if len(ri.Pagos) == 0 {
+		return
+	}
+	d.titulo("COMPLEMENTO DE RECEPCIÓN DE PAGOS")
+	columnas := []columnaPDF{
+		{"Documento relacionado", 62, "C"}, {"Serie y folio", 24, "C"}, {"Parcialidad", 16, "C"},
+		{"Saldo anterior", 28, "R"}, {"Importe pagado", 30, "R"}, {"Saldo insoluto", 30, "R"},
+	}
+	for _, p := range ri.Pagos {
+		d.espacio(24)
+		monto := moneda(p.Monto) + " " + p.Moneda
+		if p.TipoCambio != "" && p.Moneda != "MXN" {
+			monto += " (tipo de cambio " + p.TipoCambio + ")"
+		}
+		d.y = d.campo(10, d.y, 30, 65, "Fecha de pago:", fechaPDF(p.FechaPago))
+		d.y = d.campo(10, d.y, 30, 65, "Forma de pago:", conDescripcion(p.FormaDePago, formasPagoPDF))
+		d.y = d.campo(10, d.y, 30, 65, "Monto:", monto)
+		d.y = d.campo(10, d.y, 30, 65, "No. operación:", p.NumOperacion)
+		d.y += 1
+
+		tabla := &tablaPDF{d: d, columnas: columnas}
+		tabla.encabezado()
+		for _, doc := range p.Documentos {
+			tabla.renglon(strings.ToUpper(doc.IdDocumento), strings.TrimSpace(doc.Serie+" "+doc.Folio), doc.NumParcialidad,
+				moneda(doc.ImpSaldoAnt), moneda(doc.ImpPagado), moneda(doc.ImpSaldoInsoluto))
 		}
-		pdf.SetXY(x, y)
-		pdf.CellFormat(colWidths[2], rowHeight, claveSAT, "1", 0, "C", fillColor, 0, "")
-		x += colWidths[2]
+		d.y += 4
+	}
+}
 
-		unidadSAT := concepto.ClaveUnidad
-		if unidadSAT == "" || unidadSAT == "0" {
-			unidadSAT = "PZA"
+// dibujarTimbre escribe los datos del timbre fiscal digital y los sellos
+func dibujarTimbre(d *documentoPDF, ri *RepresentacionImpresa) {
+	if ri.Timbre == nil {
+		d.espacio(8)
+		d.fuente("I", d.tema.TamanoTexto)
+		d.pdf.SetTextColor(200, 30, 30)
+		d.pdf.SetXY(margenPDF, d.y)
+		d.pdf.Cell(anchoUtilPDF, 5, d.tr("Comprobante sin timbre fiscal digital: no tiene validez fiscal"))
+		d.y += 6
+		return
+	}
+	d.y += 2
+	d.titulo("DATOS DEL TIMBRE FISCAL DIGITAL")
+
+	// El QR va a la izquierda (el SAT pide al menos 2.75 cm por lado) y los datos del timbre a su derecha
+	const ladoQR, xTexto = 35.0, margenPDF + 40
+	anchoTexto := anchoUtilPDF - 40
+	d.espacio(ladoQR + 2)
+	pagina, yQR := d.pdf.PageNo(), d.y
+	if modulos, err := ri.CodigoQRVerificacion(); err != nil {
+		log.Printf("PDF_WARNING - %v", err)
+	} else if len(modulos) > 0 {
+		dibujarQR(d.pdf, modulos, margenPDF, yQR, ladoQR)
+	}
+
+	d.y = d.campo(xTexto, d.y, 38, anchoTexto-38, "Folio fiscal (UUID):", ri.UUID())
+	d.y = d.campo(xTexto, d.y, 38, anchoTexto-38, "Fecha de certificación:", fechaPDF(ri.Timbre.FechaTimbrado))
+	d.y = d.campo(xTexto, d.y, 38, anchoTexto-38, "RFC del PAC:", ri.Timbre.RfcProvCertif)
+	d.y = d.campo(xTexto, d.y, 38, anchoTexto-38, "No. certificado SAT:", ri.Timbre.NoCertificadoSAT)
+	d.y = d.campo(xTexto, d.y, 38, anchoTexto-38, "No. certificado emisor:", ri.NoCertificado)
+	d.y += 2
+
+	selloEmisor := ri.Sello
+	if selloEmisor == "" {
+		selloEmisor = ri.Timbre.SelloCFD
+	}
+	for _, sello := range []struct{ etiqueta, valor string }{
+		{"Sello digital del emisor:", selloEmisor},
+		{"Sello digital del SAT:", ri.Timbre.SelloSAT},
+		{"Cadena original del complemento de certificación digital del SAT:", ri.CadenaOriginalTimbre()},
+	} {
+		// Junto al QR los textos van en la columna derecha; debajo de él ocupan todo el ancho
+		x, ancho := margenPDF, anchoUtilPDF
+		if d.pdf.PageNo() == pagina && d.y < yQR+ladoQR+2 {
+			x, ancho = xTexto, anchoTexto
 		}
-		pdf.SetXY(x, y)
-		pdf.CellFormat(colWidths[3], rowHeight, unidadSAT, "1", 0, "C", fillColor, 0, "")
-		x += colWidths[3]
-
-		pdf.SetXY(x, y)
-		pdf.CellFormat(colWidths[4], rowHeight, fmt.Sprintf("%.0f", concepto.Cantidad), "1", 0, "C", fillColor, 0, "")
-		x += colWidths[4]
-
-		pdf.SetXY(x, y)
-		pdf.CellFormat(colWidths[5], rowHeight, fmt.Sprintf("$%.2f", concepto.ValorUnitario), "1", 0, "C", fillColor, 0, "")
-		x += colWidths[5]
-
-		// IVA ($) SOLO IMPORTE
-		importeConcepto := concepto.Cantidad * concepto.ValorUnitario
-		importeIVA := importeConcepto * (concepto.TasaIVA / 100)
-		pdf.SetXY(x, y)
-		pdf.CellFormat(colWidths[6], rowHeight, fmt.Sprintf("$%.2f", importeIVA), "1", 0, "C", fillColor, 0, "")
-		x += colWidths[6]
-
-		// TOTAL
-		pdf.SetXY(x, y)
-		pdf.CellFormat(colWidths[7], rowHeight, fmt.Sprintf("$%.2f", importeConcepto), "1", 0, "C", fillColor, 0, "")
-
-		y += rowHeight
-	}
-
-	// Verificar espacio para el total
-	if y > 260 {
-		pdf.AddPage()
-		y = 20
-	}
-
-	// Calcular subtotal e impuestos
-	subtotal := 0.0
-	totalIVA := 0.0
-	totalIEPS := 0.0
-
-	for _, concepto := range conceptosParaPDF {
-		importeConcepto := concepto.Cantidad * concepto.ValorUnitario
-		subtotal += importeConcepto
-		totalIVA += importeConcepto * (concepto.TasaIVA / 100)
-		totalIEPS += importeConcepto * (concepto.TasaIEPS / 100)
-	}
-
-	// Mostrar desglose de totales
-	y += 10
-	pdf.SetFont("Arial", "B", 10)
-	pdf.SetTextColor(0, 0, 0) // Texto negro
-
-	// SUBTOTAL
-	pdf.SetXY(15, y)
-	pdf.CellFormat(150, 6, tr("SUBTOTAL:"), "0", 0, "R", false, 0, "")
-	pdf.CellFormat(30, 6, fmt.Sprintf("$%.2f", subtotal), "0", 1, "R", false, 0, "")
-	y += 6
-
-	// IVA (16%)
-	pdf.SetXY(15, y)
-	pdf.CellFormat(150, 6, tr("IVA (16%):"), "0", 0, "R", false, 0, "")
-	pdf.CellFormat(30, 6, fmt.Sprintf("$%.2f", totalIVA), "0", 1, "R", false, 0, "")
-	y += 6
-
-	// TOTAL (usando el valor original de la factura)
-	pdf.SetFont("Arial", "B", 12)
-	pdf.SetXY(15, y)
-	pdf.CellFormat(150, 8, tr("TOTAL:"), "0", 0, "R", false, 0, "")
-	pdf.CellFormat(30, 8, fmt.Sprintf("$%.2f", factura.Total), "0", 1, "R", false, 0, "")
-
-	// Información adicional si existe
-	if factura.Observaciones != "" {
-		// Calcular el espacio necesario para las observaciones
-		observaciones := factura.Observaciones
-		lineWidth := 170.0
-		lines := splitTextSafely(pdf, tr(observaciones), lineWidth)
-		spaceNeededForObservaciones := float64(len(lines)*5) + 20 // 5mm por línea + título + margen
-
-		// Verificar si hay suficiente espacio en la página actual
-		currentY := y + 30
-		if currentY+spaceNeededForObservaciones > 280 { // Si no cabe en la página actual
-			pdf.AddPage()
-			currentY = 20
+		d.fuente("", 6)
+		lineas := d.lineas(sello.valor, ancho)
+		d.espacio(5 + 3*float64(len(lineas)))
+		d.fuente("B", 7)
+		d.pdf.SetTextColor(0, 0, 0)
+		d.pdf.SetXY(x, d.y)
+		d.pdf.Cell(ancho, 4, d.tr(sello.etiqueta))
+		d.y += 4
+		d.fuente("", 6)
+		d.colorTexto(d.tema.ColorTexto)
+		for _, linea := range lineas {
+			d.pdf.SetXY(x, d.y)
+			d.pdf.Cell(ancho, 3, linea)
+			d.y += 3
 		}
+		d.y += 1
+	}
+	if d.pdf.PageNo() == pagina && d.y < yQR+ladoQR+2 {
+		d.y = yQR + ladoQR + 2
+	}
+	d.espacio(6)
+	d.fuente("I", 7)
+	d.colorTexto(d.tema.ColorTexto)
+	d.pdf.SetXY(margenPDF, d.y)
+	d.pdf.CellFormat(anchoUtilPDF, 5, d.tr(leyendaImpresaCFDI+" "+ri.Version), "", 0, "C", false, 0, "")
+	d.y += 6
+}
 
-		y = currentY
-		pdf.SetFont("Arial", "B", 10)
-		pdf.SetXY(10, y)
-		pdf.CellFormat(180, 6, tr("OBSERVACIONES:"), "", 0, "L", false, 0, "")
-		y += 8
-
-		pdf.SetFont("Arial", "", 9)
-		for _, line := range lines {
-			pdf.SetXY(10, y)
-			pdf.CellFormat(180, 5, line, "", 0, "L", false, 0, "")
-			y += 5
+// dibujarQR dibuja el código QR en un cuadrado de lado mm; cada tramo de módulos negros de un renglón es un rectángulo
+func dibujarQR(pdf *gofpdf.Fpdf, modulos [][]bool, x, y, lado float64) {
+	modulo := lado / float64(len(modulos))
+	pdf.SetFillColor(0, 0, 0)
+	for fila, renglon := range modulos {
+		for inicio := 0; inicio < len(renglon); inicio++ {
+			if !renglon[inicio] {
+				continue
+			}
+			fin := inicio
+			for fin+1 < len(renglon) && renglon[fin+1] {
+				fin++
+			}
+			pdf.Rect(x+float64(inicio)*modulo, y+float64(fila)*modulo, float64(fin-inicio+1)*modulo, modulo, "F")
+			inicio = fin
 		}
 	}
+	pdf.SetFillColor(255, 255, 255)
+}
 
-	// Guardar el PDF en un buffer
-	var pdfBuffer bytes.Buffer
-	err = pdf.Output(&pdfBuffer)
-	if err != nil {
-		return nil, "", fmt.Errorf("error al generar PDF: %w", err)
+// marcarEstadoCancelacion sobreimprime en cada página que el CFDI está cancelado o en proceso de cancelación
+func marcarEstadoCancelacion(d *documentoPDF, estado string) {
+	leyenda, tamano := "", 54.0
+	switch estado {
+	case models.CancelacionCancelada, models.CancelacionPlazoVencido:
+		leyenda = "CANCELADA"
+	case models.CancelacionEnProceso:
+		leyenda, tamano = "CANCELACIÓN EN PROCESO", 36
+	default:
+		return
+	}
+	pdf := d.pdf
+	for pagina := 1; pagina <= pdf.PageCount(); pagina++ {
+		pdf.SetPage(pagina)
+		d.fuente("B", tamano)
+		pdf.SetTextColor(200, 30, 30)
+		pdf.SetAlpha(0.25, "Normal")
+		pdf.TransformBegin()
+		pdf.TransformRotate(45, 105, 148)
+		pdf.SetXY(5, 140)
+		pdf.CellFormat(200, 16, d.tr(leyenda), "", 0, "C", false, 0, "")
+		pdf.TransformEnd()
+		pdf.SetAlpha(1, "Normal")
 	}
-
-	// Regresa el buffer y el nombre de archivo sugerido
-	return &pdfBuffer, nombreArchivo, nil
+	pdf.SetTextColor(0, 0, 0)
 }
 
 // CargarLogoDesdeBaseDatos carga el logo de un usuario desde la base de datos
@@ -0,0 +1,168 @@
+package services
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"Facts/internal/models"
+)
+
+// TemaPDFPredeterminado es el tema que se usa cuando el emisor no eligió otro
+const TemaPDFPredeterminado = "clasico"
+
+// ColorPDF es un color RGB; en JSON y en la base se guarda como #RRGGBB
+type ColorPDF struct {
+	R, G, B int
+}
+
+// ColorHex lee un color #RRGGBB
+func ColorHex(hex string) (ColorPDF, error) {
+	valor := strings.TrimPrefix(strings.TrimSpace(hex), "#")
+	if len(valor) != 6 {
+		return ColorPDF{}, fmt.Errorf("color inválido %q: se espera #RRGGBB", hex)
+	}
+	n, err := strconv.ParseUint(valor, 16, 32)
+	if err != nil {
+		return ColorPDF{}, fmt.Errorf("color inválido %q: se espera #RRGGBB", hex)
+	}
+	return ColorPDF{int(n >> 16), int(n >> 8 & 0xff), int(n & 0xff)}, nil
+}
+
+// Hex devuelve el color como #RRGGBB
+func (c ColorPDF) Hex() string {
+	return fmt.Sprintf("#%02X%02X%02X", c.R, c.G, c.B)
+}
+
+func (c ColorPDF) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(c.Hex())), nil
+}
+
+// TemaPDF describe la presentación de la representación impresa; el contenido siempre sale del XML
+type TemaPDF struct {
+	Nombre            string   `json:"nombre"`
+	Fuente            string   `json:"fuente"`
+	ColorPrimario     ColorPDF `json:"color_primario"`   // títulos y encabezados de tabla
+	ColorSecundario   ColorPDF `json:"color_secundario"` // renglones alternos de las tablas
+	ColorTexto        ColorPDF `json:"color_texto"`
+	TamanoTitulo      float64  `json:"tamano_titulo"`
+	TamanoSeccion     float64  `json:"tamano_seccion"`
+	TamanoTexto       float64  `json:"tamano_texto"`
+	TamanoTabla       float64  `json:"tamano_tabla"`
+	AltoLinea         float64  `json:"alto_linea"`   // mm por línea de texto en las tablas
+	BordesTabla       string   `json:"bordes_tabla"` // bordes de gofpdf: "1" todos, "B" solo el inferior
+	RenglonesAlternos bool     `json:"renglones_alternos"`
+	LineaSeccion      bool     `json:"linea_seccion"` // subraya los títulos de sección
+}
+
+// FuentesPDF son las fuentes estándar de PDF que no requieren incrustar archivos
+var FuentesPDF = []string{"Arial", "Helvetica", "Times", "Courier"}
+
+var temasPDF = map[string]TemaPDF{
+	"clasico": {
+		Nombre:            "clasico",
+		Fuente:            "Arial",
+		ColorPrimario:     ColorPDF{30, 80, 150},
+		ColorSecundario:   ColorPDF{248, 248, 248},
+		ColorTexto:        ColorPDF{64, 64, 64},
+		TamanoTitulo:      14,
+		TamanoSeccion:     10,
+		TamanoTexto:       8,
+		TamanoTabla:       7,
+		AltoLinea:         3.5,
+		BordesTabla:       "1",
+		RenglonesAlternos: true,
+	},
+	"compacto": {
+		Nombre:          "compacto",
+		Fuente:          "Arial",
+		ColorPrimario:   ColorPDF{60, 60, 60},
+		ColorSecundario: ColorPDF{240, 240, 240},
+		ColorTexto:      ColorPDF{40, 40, 40},
+		TamanoTitulo:    12,
+		TamanoSeccion:   9,
+		TamanoTexto:     7,
+		TamanoTabla:     6,
+		AltoLinea:       2.8,
+		BordesTabla:     "1",
+	},
+	"moderno": {
+		Nombre:            "moderno",
+		Fuente:            "Helvetica",
+		ColorPrimario:     ColorPDF{0, 128, 128},
+		ColorSecundario:   ColorPDF{232, 244, 244},
+		ColorTexto:        ColorPDF{50, 50, 50},
+		TamanoTitulo:      16,
+		TamanoSeccion:     10,
+		TamanoTexto:       8,
+		TamanoTabla:       7,
+		AltoLinea:         4,
+		BordesTabla:       "B",
+		RenglonesAlternos: true,
+		LineaSeccion:      true,
+	},
+}
+
+// TemasPDF devuelve los temas disponibles ordenados por nombre
+func TemasPDF() []TemaPDF {
+	temas := make([]TemaPDF, 0, len(temasPDF))
+	for _, t := range temasPDF {
+		temas = append(temas, t)
+	}
+	sort.Slice(temas, func(i, j int) bool { return temas[i].Nombre < temas[j].Nombre })
+	return temas
+}
+
+// TemaPDFPorNombre devuelve el tema con ese nombre; ok es false si no existe
+func TemaPDFPorNombre(nombre string) (TemaPDF, bool) {
+	t, ok := temasPDF[strings.ToLower(strings.TrimSpace(nombre))]
+	return t, ok
+}
+
+// ValidarMarcaEmisor revisa que el tema, los colores y la fuente de la marca se puedan usar
+func ValidarMarcaEmisor(m models.MarcaEmisor) error {
+	if _, ok := TemaPDFPorNombre(m.Tema); m.Tema != "" && !ok {
+		return fmt.Errorf("tema desconocido %q", m.Tema)
+	}
+	for _, c := range []string{m.ColorPrimario, m.ColorSecundario} {
+		if c == "" {
+			continue
+		}
+		if _, err := ColorHex(c); err != nil {
+			return err
+		}
+	}
+	if m.Fuente != "" && fuentePDF(m.Fuente) == "" {
+		return fmt.Errorf("fuente no disponible %q; use una de %s", m.Fuente, strings.Join(FuentesPDF, ", "))
+	}
+	return nil
+}
+
+// TemaPDFDeMarca arma el tema elegido por el emisor con sus colores y fuente
+func TemaPDFDeMarca(m models.MarcaEmisor) TemaPDF {
+	tema, ok := TemaPDFPorNombre(m.Tema)
+	if !ok {
+		tema = temasPDF[TemaPDFPredeterminado]
+	}
+	if c, err := ColorHex(m.ColorPrimario); err == nil {
+		tema.ColorPrimario = c
+	}
+	if c, err := ColorHex(m.ColorSecundario); err == nil {
+		tema.ColorSecundario = c
+	}
+	if f := fuentePDF(m.Fuente); f != "" {
+		tema.Fuente = f
+	}
+	return tema
+}
+
+// fuentePDF normaliza el nombre de una fuente estándar; vacío si no es una de FuentesPDF
+func fuentePDF(nombre string) string {
+	for _, f := range FuentesPDF {
+		if strings.EqualFold(f, strings.TrimSpace(nombre)) {
+			return f
+		}
+	}
+	return ""
+}
@@ -0,0 +1,334 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"Facts/internal/models"
+
+	"github.com/phpdave11/gofpdf"
+)
+
+// Anchos de rollo térmico soportados, en mm
+const (
+	AnchoTicket80 = 80.0
+	AnchoTicket58 = 58.0
+)
+
+const (
+	margenTicket = 3.0
+	// largoMaximoTicket es el largo de página con el que se mide el ticket; un PDF no admite páginas más largas
+	largoMaximoTicket = 5000.0
+	ladoQRTicket      = 30.0
+)
+
+// ticketPDF es el equivalente de documentoPDF para un rollo térmico: una sola columna y página del largo del contenido
+type ticketPDF struct {
+	pdf    *gofpdf.Fpdf
+	tr     func(string) string
+	fuente string
+	ancho  float64 // ancho útil
+	largo  float64
+	texto  float64 // tamaño de la letra normal
+	y      float64
+	utf8   bool // fuentes UTF-8 incrustadas (PDF/A)
+}
+
+// GenerarTicketPDF dibuja la representación impresa del CFDI en un rollo de 80 o 58 mm con el mismo
+// contenido fiscal que GenerarPDF: emisor, receptor, conceptos, impuestos, totales, timbre y QR
+func GenerarTicketPDF(ri *RepresentacionImpresa, opciones OpcionesPDF) (*bytes.Buffer, string, error) {
+	if opciones.AnchoTicket != AnchoTicket80 && opciones.AnchoTicket != AnchoTicket58 {
+		return nil, "", fmt.Errorf("ancho de ticket no soportado: %v mm (use 80 o 58)", opciones.AnchoTicket)
+	}
+	// Se dibuja primero en un rollo muy largo para medir el contenido y después en uno de ese largo exacto
+	t, err := dibujarTicket(ri, opciones, largoMaximoTicket)
+	if err == nil && t.pdf.PageCount() == 1 {
+		t, err = dibujarTicket(ri, opciones, t.y+margenTicket+1)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	buf, err := terminarPDF(t.pdf, ri, opciones)
+	if err != nil {
+		return nil, "", fmt.Errorf("error al generar el ticket PDF: %w", err)
+	}
+	return buf, ri.NombreArchivo("pdf"), nil
+}
+
+func dibujarTicket(ri *RepresentacionImpresa, opciones OpcionesPDF, largo float64) (*ticketPDF, error) {
+	pdf := gofpdf.NewCustom(&gofpdf.InitType{
+		UnitStr: "mm",
+		Size:    gofpdf.SizeType{Wd: opciones.AnchoTicket, Ht: largo},
+	})
+	pdf.SetAuthor(autorPDF, true)
+	pdf.SetTitle(tituloPDF, true)
+	pdf.SetMargins(margenTicket, margenTicket, margenTicket)
+	pdf.SetAutoPageBreak(false, 0)
+	pdf.SetCellMargin(0)
+	pdf.AddPage()
+
+	t := &ticketPDF{
+		pdf:    pdf,
+		tr:     pdf.UnicodeTranslatorFromDescriptor(""),
+		fuente: "Arial",
+		ancho:  opciones.AnchoTicket - 2*margenTicket,
+		largo:  largo,
+		texto:  8,
+		y:      margenTicket,
+	}
+	if opciones.AnchoTicket == AnchoTicket58 {
+		t.texto = 7
+	}
+	if opciones.Tema != nil && opciones.Tema.Fuente != "" {
+		t.fuente = opciones.Tema.Fuente
+	}
+	if opciones.PDFA {
+		if err := usarFuentesPDFA(pdf); err != nil {
+			return nil, err
+		}
+		t.fuente, t.tr, t.utf8 = FuentePDFA, sinTraduccion, true
+	}
+
+	t.encabezado(ri, opciones)
+	t.conceptos(ri)
+	t.totales(ri)
+	t.pagos(ri)
+	if opciones.Observaciones != "" {
+		t.separador()
+		t.renglon(opciones.Observaciones, "", t.texto-1, "L")
+	}
+	t.timbre(ri)
+	return t, nil
+}
+
+// espacio pasa a otra página si lo que sigue no cabe (solo ocurre con tickets más largos que largoMaximoTicket)
+func (t *ticketPDF) espacio(alto float64) {
+	if t.y+alto > t.largo-margenTicket {
+		t.pdf.AddPage()
+		t.y = margenTicket
+	}
+}
+
+func (t *ticketPDF) alto(tamano float64) float64 {
+	return tamano * 0.45
+}
+
+// renglon escribe el texto partido al ancho del rollo
+func (t *ticketPDF) renglon(texto, estilo string, tamano float64, alineacion string) {
+	if texto == "" {
+		return
+	}
+	t.pdf.SetFont(t.fuente, estilo, tamano)
+	for _, l := range partirLineas(t.pdf, t.tr(texto), t.ancho, t.utf8) {
+		t.espacio(t.alto(tamano))
+		t.pdf.SetXY(margenTicket, t.y)
+		t.pdf.CellFormat(t.ancho, t.alto(tamano), l, "", 0, alineacion, false, 0, "")
+		t.y += t.alto(tamano)
+	}
+}
+
+// campo escribe "Etiqueta: valor" como un solo párrafo
+func (t *ticketPDF) campo(etiqueta, valor string) {
+	if valor == "" {
+		return
+	}
+	t.renglon(etiqueta+" "+valor, "", t.texto-1, "L")
+}
+
+// importe escribe la etiqueta a la izquierda y el importe alineado a la derecha en el mismo renglón
+func (t *ticketPDF) importe(etiqueta, valor, estilo string, tamano float64) {
+	t.pdf.SetFont(t.fuente, estilo, tamano)
+	anchoValor := t.pdf.GetStringWidth(valor) + 1
+	lineas := partirLineas(t.pdf, t.tr(etiqueta), t.ancho-anchoValor, t.utf8)
+	for i, l := range lineas {
+		t.espacio(t.alto(tamano))
+		t.pdf.SetXY(margenTicket, t.y)
+		t.pdf.CellFormat(t.ancho-anchoValor, t.alto(tamano), l, "", 0, "L", false, 0, "")
+		if i == len(lineas)-1 {
+			t.pdf.CellFormat(anchoValor, t.alto(tamano), valor, "", 0, "R", false, 0, "")
+		}
+		t.y += t.alto(tamano)
+	}
+}
+
+// separador dibuja una línea punteada a todo el ancho
+func (t *ticketPDF) separador() {
+	t.espacio(3)
+	t.y += 1
+	t.pdf.SetDrawColor(0, 0, 0)
+	t.pdf.SetLineWidth(0.2)
+	t.pdf.SetDashPattern([]float64{0.8, 0.8}, 0)
+	t.pdf.Line(margenTicket, t.y, margenTicket+t.ancho, t.y)
+	t.pdf.SetDashPattern([]float64{}, 0)
+	t.y += 1.5
+}
+
+func (t *ticketPDF) encabezado(ri *RepresentacionImpresa, opciones OpcionesPDF) {
+	if len(opciones.Logo) > 0 {
+		tipo := strings.TrimPrefix(http.DetectContentType(opciones.Logo), "image/")
+		if tipo == "png" || tipo == "jpeg" || tipo == "gif" {
+			opcionesImagen := gofpdf.ImageOptions{ImageType: tipo}
+			t.pdf.RegisterImageOptionsReader("logo", opcionesImagen, bytes.NewReader(opciones.Logo))
+			if t.pdf.Ok() {
+				lado := t.ancho / 2.5
+				t.pdf.ImageOptions("logo", margenTicket+(t.ancho-lado)/2, t.y, lado, 0, false, opcionesImagen, 0, "")
+				info := t.pdf.GetImageInfo("logo")
+				t.y += info.Height()*lado/info.Width() + 2
+			} else {
+				log.Printf("PDF_WARNING - Logo inválido: %v", t.pdf.Error())
+				t.pdf.ClearError()
+			}
+		}
+	}
+
+	switch opciones.EstadoCancelacion {
+	case models.CancelacionCancelada, models.CancelacionPlazoVencido:
+		t.renglon("*** CFDI CANCELADO ***", "B", t.texto+2, "C")
+	case models.CancelacionEnProceso:
+		t.renglon("*** CANCELACIÓN EN PROCESO ***", "B", t.texto+1, "C")
+	}
+
+	t.renglon(ri.Emisor.Nombre, "B", t.texto+1, "C")
+	t.renglon("RFC: "+ri.Emisor.Rfc, "", t.texto, "C")
+	t.renglon(conDescripcionOpcional(ri.Emisor.RegimenFiscal, regimenFiscalDescripciones), "", t.texto-1, "C")
+	if ri.LugarExpedicion != "" {
+		t.renglon("Lugar de expedición: "+ri.LugarExpedicion, "", t.texto-1, "C")
+	}
+	t.separador()
+
+	titulo, ok := titulosComprobante[ri.TipoDeComprobante]
+	if !ok {
+		titulo = "COMPROBANTE FISCAL DIGITAL"
+	}
+	t.renglon(titulo, "B", t.texto+1, "C")
+	if ri.Serie != "" || ri.Folio != "" {
+		t.renglon("Serie y folio: "+strings.TrimSpace(ri.Serie+" "+ri.Folio), "", t.texto, "C")
+	}
+	t.renglon("Fecha: "+fechaPDF(ri.Fecha), "", t.texto, "C")
+	t.renglon("CFDI versión "+ri.Version+" - "+conDescripcion(ri.TipoDeComprobante, tiposComprobantePDF), "", t.texto-1, "C")
+	if ri.InformacionGlobal != nil {
+		t.renglon(fmt.Sprintf("Información global: %s, meses %s, año %s",
+			conDescripcion(ri.InformacionGlobal.Periodicidad, periodicidadesPDF), ri.InformacionGlobal.Meses, ri.InformacionGlobal.Anio), "", t.texto-1, "C")
+	}
+	t.separador()
+
+	t.renglon("RECEPTOR", "B", t.texto, "L")
+	t.campo("Nombre:", ri.Receptor.Nombre)
+	t.campo("RFC:", ri.Receptor.Rfc)
+	t.campo("Domicilio fiscal:", ri.Receptor.DomicilioFiscal)
+	t.campo("Régimen:", conDescripcionOpcional(ri.Receptor.RegimenFiscal, regimenFiscalDescripciones))
+	t.campo("Uso CFDI:", conDescripcion(ri.Receptor.UsoCFDI, usoCFDICatalogo))
+	for _, r := range ri.Relacionados {
+		t.campo("CFDI relacionados:", conDescripcion(r.TipoRelacion, tiposRelacionPDF))
+		for _, uuid := range r.UUIDs {
+			t.renglon(uuid, "", t.texto-1, "L")
+		}
+	}
+	t.separador()
+}
+
+func (t *ticketPDF) conceptos(ri *RepresentacionImpresa) {
+	for _, c := range ri.Conceptos {
+		descripcion := c.Descripcion
+		if c.NoIdentificacion != "" {
+			descripcion = c.NoIdentificacion + " - " + descripcion
+		}
+		t.renglon(descripcion, "B", t.texto, "L")
+		unidad := c.ClaveUnidad
+		if c.Unidad != "" {
+			unidad += " " + c.Unidad
+		}
+		t.importe(fmt.Sprintf("%s %s x %s", cantidad(c.Cantidad), unidad, moneda(c.ValorUnitario)), moneda(c.Importe), "", t.texto)
+		t.renglon("Clave: "+c.ClaveProdServ, "", t.texto-1.5, "L")
+		if importeXML(c.Descuento) > 0 {
+			t.importe("Descuento", "-"+moneda(c.Descuento), "", t.texto-1)
+		}
+		for _, tr := range c.Traslados {
+			if tr.TipoFactor == "Exento" {
+				t.renglon(nombreImpuesto(tr), "", t.texto-1.5, "L")
+				continue
+			}
+			t.importe(nombreImpuesto(tr), moneda(tr.Importe), "", t.texto-1.5)
+		}
+		for _, r := range c.Retenciones {
+			t.importe("Ret. "+nombreImpuesto(r), "-"+moneda(r.Importe), "", t.texto-1.5)
+		}
+		t.y += 1
+	}
+	t.separador()
+}
+
+func (t *ticketPDF) totales(ri *RepresentacionImpresa) {
+	t.importe("SUBTOTAL", moneda(ri.SubTotal), "", t.texto)
+	if importeXML(ri.Descuento) > 0 {
+		t.importe("DESCUENTO", "-"+moneda(ri.Descuento), "", t.texto)
+	}
+	for _, tr := range ri.Traslados {
+		if tr.TipoFactor == "Exento" {
+			continue
+		}
+		t.importe(strings.ToUpper(nombreImpuesto(tr)), moneda(tr.Importe), "", t.texto)
+	}
+	for _, r := range ri.Retenciones {
+		t.importe("RETENCIÓN "+strings.ToUpper(nombreImpuesto(r)), "-"+moneda(r.Importe), "", t.texto)
+	}
+	t.importe("TOTAL", moneda(ri.Total)+" "+ri.Moneda, "B", t.texto+2)
+	if ri.TipoDeComprobante != "P" && ri.TipoDeComprobante != "T" {
+		t.renglon(ImporteEnLetras(importeXML(ri.Total), ri.Moneda), "", t.texto-1, "L")
+	}
+	t.y += 1
+	t.campo("Método de pago:", conDescripcionOpcional(ri.MetodoPago, metodosPagoPDF))
+	t.campo("Forma de pago:", conDescripcionOpcional(ri.FormaPago, formasPagoPDF))
+	if ri.TipoCambio != "" && ri.Moneda != "MXN" && ri.Moneda != "XXX" {
+		t.campo("Tipo de cambio:", ri.TipoCambio)
+	}
+	t.campo("Condiciones de pago:", ri.CondicionesDePago)
+}
+
+func (t *ticketPDF) pagos(ri *RepresentacionImpresa) {
+	for _, p := range ri.Pagos {
+		t.separador()
+		t.renglon("PAGO "+fechaPDF(p.FechaPago), "B", t.texto, "L")
+		t.campo("Forma de pago:", conDescripcion(p.FormaDePago, formasPagoPDF))
+		t.importe("Monto", moneda(p.Monto)+" "+p.Moneda, "", t.texto)
+		for _, doc := range p.Documentos {
+			t.renglon(strings.ToUpper(doc.IdDocumento), "", t.texto-1.5, "L")
+			t.importe(fmt.Sprintf("Parcialidad %s, saldo anterior %s", doc.NumParcialidad, moneda(doc.ImpSaldoAnt)), moneda(doc.ImpPagado), "", t.texto-1)
+		}
+	}
+}
+
+// timbre imprime los datos del timbre, los sellos recortados a los últimos 8 caracteres (los mismos que
+// lleva el QR) y el código QR de verificación
+func (t *ticketPDF) timbre(ri *RepresentacionImpresa) {
+	t.separador()
+	if ri.Timbre == nil {
+		t.renglon("Comprobante sin timbre fiscal digital: no tiene validez fiscal", "I", t.texto-1, "C")
+		return
+	}
+	t.renglon("Folio fiscal (UUID)", "B", t.texto-1, "C")
+	t.renglon(ri.UUID(), "", t.texto-1, "C")
+	t.campo("Fecha de certificación:", fechaPDF(ri.Timbre.FechaTimbrado))
+	t.campo("RFC del PAC:", ri.Timbre.RfcProvCertif)
+	t.campo("No. certificado SAT:", ri.Timbre.NoCertificadoSAT)
+	t.campo("No. certificado emisor:", ri.NoCertificado)
+	selloEmisor := ri.Sello
+	if selloEmisor == "" {
+		selloEmisor = ri.Timbre.SelloCFD
+	}
+	t.campo("Sello del emisor:", "..."+ultimosCaracteres(selloEmisor, 8))
+	t.campo("Sello del SAT:", "..."+ultimosCaracteres(ri.Timbre.SelloSAT, 8))
+
+	if modulos, err := ri.CodigoQRVerificacion(); err != nil {
+		log.Printf("PDF_WARNING - %v", err)
+	} else if len(modulos) > 0 {
+		t.y += 2
+		t.espacio(ladoQRTicket + 2)
+		dibujarQR(t.pdf, modulos, margenTicket+(t.ancho-ladoQRTicket)/2, t.y, ladoQRTicket)
+		t.y += ladoQRTicket + 2
+	}
+	t.renglon(leyendaImpresaCFDI+" "+ri.Version, "I", t.texto-1.5, "C")
+}
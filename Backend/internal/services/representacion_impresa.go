@@ -0,0 +1,381 @@
+package services
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Espacios de nombres del Comprobante que acepta LeerRepresentacionImpresa
+const (
+	NamespaceCFDI33 = "http://www.sat.gob.mx/cfd/3"
+	NamespaceCFDI40 = "http://www.sat.gob.mx/cfd/4"
+)
+
+// RepresentacionImpresa es todo lo que muestra el PDF de un CFDI y se toma únicamente de su XML.
+// Los importes se guardan como vienen en el XML para no perder decimales.
+type RepresentacionImpresa struct {
+	Version           string
+	Serie             string
+	Folio             string
+	Fecha             string
+	Sello             string
+	NoCertificado     string
+	Certificado       string
+	FormaPago         string
+	MetodoPago        string
+	CondicionesDePago string
+	Moneda            string
+	TipoCambio        string
+	TipoDeComprobante string
+	Exportacion       string
+	LugarExpedicion   string
+	SubTotal          string
+	Descuento         string
+	Total             string
+
+	InformacionGlobal *CFDIInformacionGlobal
+	Relacionados      []RelacionImpresa
+	Emisor            EmisorImpreso
+	Receptor          ReceptorImpreso
+	Conceptos         []ConceptoImpreso
+
+	TotalImpuestosTrasladados string
+	TotalImpuestosRetenidos   string
+	Traslados                 []ImpuestoImpreso
+	Retenciones               []ImpuestoImpreso
+
+	// Complementos: pagos (REP 1.0 o 2.0), timbre y el nombre de cualquier otro complemento presente
+	Pagos        []PagoImpreso
+	Timbre       *TimbreFiscalDigital
+	Complementos []string
+}
+
+// RelacionImpresa es un nodo CfdiRelacionados
+type RelacionImpresa struct {
+	TipoRelacion string
+	UUIDs        []string
+}
+
+// EmisorImpreso son los datos del emisor del CFDI
+type EmisorImpreso struct {
+	Rfc           string
+	Nombre        string
+	RegimenFiscal string
+}
+
+// ReceptorImpreso son los datos del receptor del CFDI (DomicilioFiscal y RegimenFiscal solo existen en 4.0)
+type ReceptorImpreso struct {
+	Rfc              string
+	Nombre           string
+	DomicilioFiscal  string
+	RegimenFiscal    string
+	UsoCFDI          string
+	ResidenciaFiscal string
+	NumRegIdTrib     string
+}
+
+// ConceptoImpreso es un concepto con sus impuestos
+type ConceptoImpreso struct {
+	ClaveProdServ    string
+	NoIdentificacion string
+	Cantidad         string
+	ClaveUnidad      string
+	Unidad           string
+	Descripcion      string
+	ValorUnitario    string
+	Importe          string
+	Descuento        string
+	ObjetoImp        string
+	Traslados        []ImpuestoImpreso
+	Retenciones      []ImpuestoImpreso
+}
+
+// ImpuestoImpreso es un traslado o retención, del concepto o del comprobante
+type ImpuestoImpreso struct {
+	Base       string
+	Impuesto   string
+	TipoFactor string
+	TasaOCuota string
+	Importe    string
+}
+
+// PagoImpreso es un nodo Pago del complemento de recepción de pagos
+type PagoImpreso struct {
+	FechaPago    string
+	FormaDePago  string
+	Moneda       string
+	TipoCambio   string
+	Monto        string
+	NumOperacion string
+	Documentos   []DocumentoPagoImpreso
+}
+
+// DocumentoPagoImpreso es un DoctoRelacionado de un pago
+type DocumentoPagoImpreso struct {
+	IdDocumento      string
+	Serie            string
+	Folio            string
+	MonedaDR         string
+	EquivalenciaDR   string
+	NumParcialidad   string
+	ImpSaldoAnt      string
+	ImpPagado        string
+	ImpSaldoInsoluto string
+}
+
+// Estructuras de lectura: las etiquetas usan solo el nombre local, así se lee igual cfdi:, cfd: o
+// cualquier otro prefijo que declare el XML
+type comprobanteXML struct {
+	XMLName           xml.Name `xml:"Comprobante"`
+	Version           string   `xml:"Version,attr"`
+	Serie             string   `xml:"Serie,attr"`
+	Folio             string   `xml:"Folio,attr"`
+	Fecha             string   `xml:"Fecha,attr"`
+	Sello             string   `xml:"Sello,attr"`
+	FormaPago         string   `xml:"FormaPago,attr"`
+	NoCertificado     string   `xml:"NoCertificado,attr"`
+	Certificado       string   `xml:"Certificado,attr"`
+	CondicionesDePago string   `xml:"CondicionesDePago,attr"`
+	SubTotal          string   `xml:"SubTotal,attr"`
+	Descuento         string   `xml:"Descuento,attr"`
+	Moneda            string   `xml:"Moneda,attr"`
+	TipoCambio        string   `xml:"TipoCambio,attr"`
+	Total             string   `xml:"Total,attr"`
+	TipoDeComprobante string   `xml:"TipoDeComprobante,attr"`
+	Exportacion       string   `xml:"Exportacion,attr"`
+	MetodoPago        string   `xml:"MetodoPago,attr"`
+	LugarExpedicion   string   `xml:"LugarExpedicion,attr"`
+	InformacionGlobal *struct {
+		Periodicidad string `xml:"Periodicidad,attr"`
+		Meses        string `xml:"Meses,attr"`
+		Anio         string `xml:"Año,attr"`
+	} `xml:"InformacionGlobal"`
+	CfdiRelacionados []struct {
+		TipoRelacion    string `xml:"TipoRelacion,attr"`
+		CfdiRelacionado []struct {
+			UUID string `xml:"UUID,attr"`
+		} `xml:"CfdiRelacionado"`
+	} `xml:"CfdiRelacionados"`
+	Emisor struct {
+		Rfc           string `xml:"Rfc,attr"`
+		Nombre        string `xml:"Nombre,attr"`
+		RegimenFiscal string `xml:"RegimenFiscal,attr"`
+	} `xml:"Emisor"`
+	Receptor struct {
+		Rfc                     string `xml:"Rfc,attr"`
+		Nombre                  string `xml:"Nombre,attr"`
+		DomicilioFiscalReceptor string `xml:"DomicilioFiscalReceptor,attr"`
+		RegimenFiscalReceptor   string `xml:"RegimenFiscalReceptor,attr"`
+		UsoCFDI                 string `xml:"UsoCFDI,attr"`
+		ResidenciaFiscal        string `xml:"ResidenciaFiscal,attr"`
+		NumRegIdTrib            string `xml:"NumRegIdTrib,attr"`
+	} `xml:"Receptor"`
+	Conceptos []struct {
+		ClaveProdServ    string       `xml:"ClaveProdServ,attr"`
+		NoIdentificacion string       `xml:"NoIdentificacion,attr"`
+		Cantidad         string       `xml:"Cantidad,attr"`
+		ClaveUnidad      string       `xml:"ClaveUnidad,attr"`
+		Unidad           string       `xml:"Unidad,attr"`
+		Descripcion      string       `xml:"Descripcion,attr"`
+		ValorUnitario    string       `xml:"ValorUnitario,attr"`
+		Importe          string       `xml:"Importe,attr"`
+		Descuento        string       `xml:"Descuento,attr"`
+		ObjetoImp        string       `xml:"ObjetoImp,attr"`
+		Impuestos        impuestosXML `xml:"Impuestos"`
+	} `xml:"Conceptos>Concepto"`
+	Impuestos struct {
+		TotalImpuestosRetenidos   string `xml:"TotalImpuestosRetenidos,attr"`
+		TotalImpuestosTrasladados string `xml:"TotalImpuestosTrasladados,attr"`
+		impuestosXML
+	} `xml:"Impuestos"`
+	Complemento []struct {
+		Elementos []struct {
+			XMLName xml.Name
+			Pago    []struct {
+				FechaPago        string `xml:"FechaPago,attr"`
+				FormaDePagoP     string `xml:"FormaDePagoP,attr"`
+				MonedaP          string `xml:"MonedaP,attr"`
+				TipoCambioP      string `xml:"TipoCambioP,attr"`
+				Monto            string `xml:"Monto,attr"`
+				NumOperacion     string `xml:"NumOperacion,attr"`
+				DoctoRelacionado []struct {
+					IdDocumento      string `xml:"IdDocumento,attr"`
+					Serie            string `xml:"Serie,attr"`
+					Folio            string `xml:"Folio,attr"`
+					MonedaDR         string `xml:"MonedaDR,attr"`
+					EquivalenciaDR   string `xml:"EquivalenciaDR,attr"`
+					NumParcialidad   string `xml:"NumParcialidad,attr"`
+					ImpSaldoAnt      string `xml:"ImpSaldoAnt,attr"`
+					ImpPagado        string `xml:"ImpPagado,attr"`
+					ImpSaldoInsoluto string `xml:"ImpSaldoInsoluto,attr"`
+				} `xml:"DoctoRelacionado"`
+			} `xml:"Pago"`
+		} `xml:",any"`
+	} `xml:"Complemento"`
+}
+
+type impuestosXML struct {
+	Traslados   []impuestoXML `xml:"Traslados>Traslado"`
+	Retenciones []impuestoXML `xml:"Retenciones>Retencion"`
+}
+
+type impuestoXML struct {
+	Base       string `xml:"Base,attr"`
+	Impuesto   string `xml:"Impuesto,attr"`
+	TipoFactor string `xml:"TipoFactor,attr"`
+	TasaOCuota string `xml:"TasaOCuota,attr"`
+	Importe    string `xml:"Importe,attr"`
+}
+
+func (i impuestoXML) impreso() ImpuestoImpreso {
+	return ImpuestoImpreso(i)
+}
+
+func impuestosImpresos(lista []impuestoXML) []ImpuestoImpreso {
+	var impresos []ImpuestoImpreso
+	for _, i := range lista {
+		impresos = append(impresos, i.impreso())
+	}
+	return impresos
+}
+
+// LeerRepresentacionImpresa lee un CFDI 4.0 o 3.3 (propio o de terceros, timbrado o no) y arma
+// el modelo de su representación impresa
+func LeerRepresentacionImpresa(xmlCFDI []byte) (*RepresentacionImpresa, error) {
+	var c comprobanteXML
+	if err := xml.NewDecoder(bytes.NewReader(xmlCFDI)).Decode(&c); err != nil {
+		return nil, fmt.Errorf("XML CFDI inválido: %w", err)
+	}
+	switch {
+	case c.XMLName.Space == NamespaceCFDI40 && c.Version == "4.0":
+	case c.XMLName.Space == NamespaceCFDI33 && c.Version == "3.3":
+	default:
+		return nil, fmt.Errorf("XML CFDI inválido: versión %q con espacio de nombres %q no soportada", c.Version, c.XMLName.Space)
+	}
+
+	ri := &RepresentacionImpresa{
+		Version:           c.Version,
+		Serie:             c.Serie,
+		Folio:             c.Folio,
+		Fecha:             c.Fecha,
+		Sello:             c.Sello,
+		NoCertificado:     c.NoCertificado,
+		Certificado:       c.Certificado,
+		FormaPago:         c.FormaPago,
+		MetodoPago:        c.MetodoPago,
+		CondicionesDePago: c.CondicionesDePago,
+		Moneda:            c.Moneda,
+		TipoCambio:        c.TipoCambio,
+		TipoDeComprobante: c.TipoDeComprobante,
+		Exportacion:       c.Exportacion,
+		LugarExpedicion:   c.LugarExpedicion,
+		SubTotal:          c.SubTotal,
+		Descuento:         c.Descuento,
+		Total:             c.Total,
+		Emisor:            EmisorImpreso(c.Emisor),
+		Receptor: ReceptorImpreso{
+			Rfc:              c.Receptor.Rfc,
+			Nombre:           c.Receptor.Nombre,
+			DomicilioFiscal:  c.Receptor.DomicilioFiscalReceptor,
+			RegimenFiscal:    c.Receptor.RegimenFiscalReceptor,
+			UsoCFDI:          c.Receptor.UsoCFDI,
+			ResidenciaFiscal: c.Receptor.ResidenciaFiscal,
+			NumRegIdTrib:     c.Receptor.NumRegIdTrib,
+		},
+		TotalImpuestosTrasladados: c.Impuestos.TotalImpuestosTrasladados,
+		TotalImpuestosRetenidos:   c.Impuestos.TotalImpuestosRetenidos,
+		Traslados:                 impuestosImpresos(c.Impuestos.Traslados),
+		Retenciones:               impuestosImpresos(c.Impuestos.Retenciones),
+	}
+	if c.InformacionGlobal != nil {
+		ri.InformacionGlobal = &CFDIInformacionGlobal{
+			Periodicidad: c.InformacionGlobal.Periodicidad,
+			Meses:        c.InformacionGlobal.Meses,
+			Anio:         c.InformacionGlobal.Anio,
+		}
+	}
+	for _, r := range c.CfdiRelacionados {
+		relacion := RelacionImpresa{TipoRelacion: r.TipoRelacion}
+		for _, u := range r.CfdiRelacionado {
+			relacion.UUIDs = append(relacion.UUIDs, u.UUID)
+		}
+		ri.Relacionados = append(ri.Relacionados, relacion)
+	}
+	for _, cp := range c.Conceptos {
+		ri.Conceptos = append(ri.Conceptos, ConceptoImpreso{
+			ClaveProdServ:    cp.ClaveProdServ,
+			NoIdentificacion: cp.NoIdentificacion,
+			Cantidad:         cp.Cantidad,
+			ClaveUnidad:      cp.ClaveUnidad,
+			Unidad:           cp.Unidad,
+			Descripcion:      cp.Descripcion,
+			ValorUnitario:    cp.ValorUnitario,
+			Importe:          cp.Importe,
+			Descuento:        cp.Descuento,
+			ObjetoImp:        cp.ObjetoImp,
+			Traslados:        impuestosImpresos(cp.Impuestos.Traslados),
+			Retenciones:      impuestosImpresos(cp.Impuestos.Retenciones),
+		})
+	}
+
+	if len(ri.Conceptos) == 0 {
+		return nil, errors.New("XML CFDI inválido: no tiene conceptos")
+	}
+
+	for _, complemento := range c.Complemento {
+		for _, e := range complemento.Elementos {
+			ri.Complementos = append(ri.Complementos, e.XMLName.Local)
+			if e.XMLName.Local != "Pagos" {
+				continue
+			}
+			for _, p := range e.Pago {
+				pago := PagoImpreso{
+					FechaPago:    p.FechaPago,
+					FormaDePago:  p.FormaDePagoP,
+					Moneda:       p.MonedaP,
+					TipoCambio:   p.TipoCambioP,
+					Monto:        p.Monto,
+					NumOperacion: p.NumOperacion,
+				}
+				for _, d := range p.DoctoRelacionado {
+					pago.Documentos = append(pago.Documentos, DocumentoPagoImpreso(d))
+				}
+				ri.Pagos = append(ri.Pagos, pago)
+			}
+		}
+	}
+	if timbre, err := ExtraerTimbreFiscalDigital(xmlCFDI); err == nil {
+		ri.Timbre = timbre
+	}
+	return ri, nil
+}
+
+// UUID devuelve el folio fiscal del timbre; vacío si el CFDI no está timbrado
+func (ri *RepresentacionImpresa) UUID() string {
+	if ri.Timbre == nil {
+		return ""
+	}
+	return strings.ToUpper(ri.Timbre.UUID)
+}
+
+// NombreArchivo sugiere el nombre del archivo con serie y folio (o el UUID si no tiene folio)
+func (ri *RepresentacionImpresa) NombreArchivo(extension string) string {
+	identificador := ri.Serie + ri.Folio
+	if ri.Folio == "" {
+		identificador = ri.UUID()
+	}
+	if identificador == "" {
+		identificador = "sin_folio"
+	}
+	return fmt.Sprintf("Factura_%s.%s", identificador, extension)
+}
+
+// importeXML convierte un importe del XML; los atributos vacíos u opcionales valen 0
+func importeXML(valor string) float64 {
+	n, _ := strconv.ParseFloat(strings.TrimSpace(valor), 64)
+	return n
+}
@@ -0,0 +1,155 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// URLVerificacionCFDI es el servicio del SAT al que apunta el código QR de la representación impresa
+const URLVerificacionCFDI = "https://verificacfdi.facturaelectronica.sat.gob.mx/default.aspx"
+
+// URLVerificacion arma la URL del código QR según el anexo 20: id, re, rr, tt y los
+// últimos 8 caracteres del sello del emisor. Vacía si el CFDI no está timbrado.
+func (ri *RepresentacionImpresa) URLVerificacion() string {
+	uuid := ri.UUID()
+	if uuid == "" {
+		return ""
+	}
+	sello := ri.Sello
+	if sello == "" && ri.Timbre != nil {
+		sello = ri.Timbre.SelloCFD
+	}
+	// El & es válido en un RFC pero separa los parámetros de la URL
+	rfcURL := strings.NewReplacer("&", "%26").Replace
+	return fmt.Sprintf("%s?id=%s&re=%s&rr=%s&tt=%s&fe=%s", URLVerificacionCFDI,
+		uuid, rfcURL(ri.Emisor.Rfc), rfcURL(ri.Receptor.Rfc), totalVerificacion(ri.Total), ultimosCaracteres(sello, 8))
+}
+
+// ultimosCaracteres devuelve los últimos n caracteres del texto (los sellos son base64, un byte por carácter)
+func ultimosCaracteres(texto string, n int) string {
+	if len(texto) <= n {
+		return texto
+	}
+	return texto[len(texto)-n:]
+}
+
+// totalVerificacion da formato al total del QR: hasta 6 decimales y sin ceros no significativos
+func totalVerificacion(total string) string {
+	t := strings.TrimRight(strconv.FormatFloat(importeXML(total), 'f', 6, 64), "0")
+	if strings.HasSuffix(t, ".") {
+		t += "0"
+	}
+	return t
+}
+
+// CadenaOriginalTimbre es la cadena original del complemento de certificación digital del SAT
+func (ri *RepresentacionImpresa) CadenaOriginalTimbre() string {
+	if ri.Timbre == nil {
+		return ""
+	}
+	return GenerarCadenaOriginalTFD(*ri.Timbre)
+}
+
+// CodigoQRVerificacion devuelve los módulos del código QR de verificación (true = negro),
+// sin la zona de silencio. Nil si el CFDI no está timbrado.
+func (ri *RepresentacionImpresa) CodigoQRVerificacion() ([][]bool, error) {
+	url := ri.URLVerificacion()
+	if url == "" {
+		return nil, nil
+	}
+	qr, err := qrcode.New(url, qrcode.Medium)
+	if err != nil {
+		return nil, fmt.Errorf("error al generar el código QR: %w", err)
+	}
+	qr.DisableBorder = true
+	return qr.Bitmap(), nil
+}
+
+// monedaEnLetras es el nombre en singular y plural de la moneda y la abreviatura que cierra el importe
+type monedaEnLetras struct {
+	singular, plural, abreviatura string
+}
+
+var monedasEnLetras = map[string]monedaEnLetras{
+	"MXN": {"PESO", "PESOS", "M.N."},
+	"USD": {"DÓLAR", "DÓLARES", "USD"},
+	"EUR": {"EURO", "EUROS", "EUR"},
+}
+
+var (
+	unidadesLetras = []string{"", "UN", "DOS", "TRES", "CUATRO", "CINCO", "SEIS", "SIETE", "OCHO", "NUEVE",
+		"DIEZ", "ONCE", "DOCE", "TRECE", "CATORCE", "QUINCE", "DIECISÉIS", "DIECISIETE", "DIECIOCHO", "DIECINUEVE",
+		"VEINTE", "VEINTIÚN", "VEINTIDÓS", "VEINTITRÉS", "VEINTICUATRO", "VEINTICINCO", "VEINTISÉIS", "VEINTISIETE", "VEINTIOCHO", "VEINTINUEVE"}
+	decenasLetras  = []string{"", "", "", "TREINTA", "CUARENTA", "CINCUENTA", "SESENTA", "SETENTA", "OCHENTA", "NOVENTA"}
+	centenasLetras = []string{"", "CIENTO", "DOSCIENTOS", "TRESCIENTOS", "CUATROCIENTOS", "QUINIENTOS", "SEISCIENTOS", "SETECIENTOS", "OCHOCIENTOS", "NOVECIENTOS"}
+)
+
+// ImporteEnLetras escribe el importe como se imprime en el CFDI: "MIL DOSCIENTOS PESOS 50/100 M.N."
+func ImporteEnLetras(importe float64, claveMoneda string) string {
+	centavos := int64(math.Round(math.Abs(importe) * 100))
+	entero := centavos / 100
+	letras := numeroEnLetras(entero)
+
+	m, ok := monedasEnLetras[strings.ToUpper(claveMoneda)]
+	if !ok {
+		return fmt.Sprintf("%s %02d/100 %s", letras, centavos%100, strings.ToUpper(claveMoneda))
+	}
+	nombre := m.plural
+	if entero == 1 {
+		nombre = m.singular
+	} else if entero >= 1000000 && entero%1000000 == 0 {
+		nombre = "DE " + m.plural
+	}
+	return fmt.Sprintf("%s %s %02d/100 %s", letras, nombre, centavos%100, m.abreviatura)
+}
+
+// numeroEnLetras escribe un entero no negativo en español con el "UN" apocopado (VEINTIÚN MIL, UN MILLÓN)
+func numeroEnLetras(n int64) string {
+	if n == 0 {
+		return "CERO"
+	}
+	var partes []string
+	if millones := n / 1000000; millones > 0 {
+		if millones == 1 {
+			partes = append(partes, "UN MILLÓN")
+		} else {
+			partes = append(partes, numeroEnLetras(millones)+" MILLONES")
+		}
+	}
+	if miles := n / 1000 % 1000; miles > 0 {
+		if miles == 1 {
+			partes = append(partes, "MIL")
+		} else {
+			partes = append(partes, centenasEnLetras(int(miles))+" MIL")
+		}
+	}
+	if resto := n % 1000; resto > 0 {
+		partes = append(partes, centenasEnLetras(int(resto)))
+	}
+	return strings.Join(partes, " ")
+}
+
+// centenasEnLetras escribe un número de 1 a 999
+func centenasEnLetras(n int) string {
+	if n == 100 {
+		return "CIEN"
+	}
+	var partes []string
+	if c := n / 100; c > 0 {
+		partes = append(partes, centenasLetras[c])
+	}
+	switch d := n % 100; {
+	case d == 0:
+	case d < 30:
+		partes = append(partes, unidadesLetras[d])
+	case d%10 == 0:
+		partes = append(partes, decenasLetras[d/10])
+	default:
+		partes = append(partes, decenasLetras[d/10]+" Y "+unidadesLetras[d%10])
+	}
+	return strings.Join(partes, " ")
+}
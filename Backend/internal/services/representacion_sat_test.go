@@ -0,0 +1,70 @@
+package services
+
+import "testing"
+
+func TestImporteEnLetras(t *testing.T) {
+	casos := []struct {
+		importe float64
+		moneda  string
+		letras  string
+	}{
+		{0, "MXN", "CERO PESOS 00/100 M.N."},
+		{0.5, "MXN", "CERO PESOS 50/100 M.N."},
+		{1, "MXN", "UN PESO 00/100 M.N."},
+		{1.99, "MXN", "UN PESO 99/100 M.N."},
+		{21, "MXN", "VEINTIÚN PESOS 00/100 M.N."},
+		{100, "MXN", "CIEN PESOS 00/100 M.N."},
+		{101.01, "MXN", "CIENTO UN PESOS 01/100 M.N."},
+		{1200.5, "MXN", "MIL DOSCIENTOS PESOS 50/100 M.N."},
+		{21345.678, "MXN", "VEINTIÚN MIL TRESCIENTOS CUARENTA Y CINCO PESOS 68/100 M.N."},
+		{1000000, "MXN", "UN MILLÓN DE PESOS 00/100 M.N."},
+		{2000000.1, "MXN", "DOS MILLONES DE PESOS 10/100 M.N."},
+		{1000001, "MXN", "UN MILLÓN UN PESOS 00/100 M.N."},
+		{1, "usd", "UN DÓLAR 00/100 USD"},
+		{15.25, "JPY", "QUINCE 25/100 JPY"},
+	}
+	for _, c := range casos {
+		if letras := ImporteEnLetras(c.importe, c.moneda); letras != c.letras {
+			t.Errorf("ImporteEnLetras(%v, %s) = %q, se esperaba %q", c.importe, c.moneda, letras, c.letras)
+		}
+	}
+}
+
+func TestURLVerificacion(t *testing.T) {
+	const sello = "Q2FkZW5hT3JpZ2luYWxTZWxsYWRh+/12AbCdEf=="
+	base := func() *RepresentacionImpresa {
+		return &RepresentacionImpresa{
+			Total:    "1160.50",
+			Sello:    sello,
+			Emisor:   EmisorImpreso{Rfc: "EKU9003173C9"},
+			Receptor: ReceptorImpreso{Rfc: "URE180429TM6"},
+			Timbre:   &TimbreFiscalDigital{UUID: "5fb2822e-396d-4725-8521-cdc4bdd20ccf", SelloCFD: "SelloDelTimbre12345678"},
+		}
+	}
+	const prefijo = URLVerificacionCFDI + "?id=5FB2822E-396D-4725-8521-CDC4BDD20CCF"
+
+	casos := []struct {
+		nombre  string
+		cambiar func(*RepresentacionImpresa)
+		url     string
+	}{
+		{"fe son los últimos 8 caracteres del sello", func(*RepresentacionImpresa) {},
+			prefijo + "&re=EKU9003173C9&rr=URE180429TM6&tt=1160.5&fe=AbCdEf=="},
+		{"sin sello se usa el del timbre", func(ri *RepresentacionImpresa) { ri.Sello = "" },
+			prefijo + "&re=EKU9003173C9&rr=URE180429TM6&tt=1160.5&fe=12345678"},
+		{"total entero", func(ri *RepresentacionImpresa) { ri.Total = "1000000" },
+			prefijo + "&re=EKU9003173C9&rr=URE180429TM6&tt=1000000.0&fe=AbCdEf=="},
+		{"total con seis decimales", func(ri *RepresentacionImpresa) { ri.Total = "0.123456" },
+			prefijo + "&re=EKU9003173C9&rr=URE180429TM6&tt=0.123456&fe=AbCdEf=="},
+		{"RFC con &", func(ri *RepresentacionImpresa) { ri.Receptor.Rfc = "A&A010101AAA" },
+			prefijo + "&re=EKU9003173C9&rr=A%26A010101AAA&tt=1160.5&fe=AbCdEf=="},
+		{"sin timbre", func(ri *RepresentacionImpresa) { ri.Timbre = nil }, ""},
+	}
+	for _, c := range casos {
+		ri := base()
+		c.cambiar(ri)
+		if url := ri.URLVerificacion(); url != c.url {
+			t.Errorf("%s:\n%s\nse esperaba\n%s", c.nombre, url, c.url)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package services
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"testing"
+
+	"Facts/internal/models"
+	"Facts/internal/utils"
+)
+
+// CSD de pruebas publicado por el SAT (EKU9003173C9)
+const (
+	cerPrueba   = "../../certificados/ABC123456DE7_cer.cer"
+	keyPrueba   = "../../certificados/ABC123456DE7_key.key"
+	clavePrueba = "12345678a"
+)
+
+// selloComprobante son los atributos del XML sellado que se necesitan para verificarlo
+type selloComprobante struct {
+	Sello         string `xml:"Sello,attr"`
+	NoCertificado string `xml:"NoCertificado,attr"`
+	Certificado   string `xml:"Certificado,attr"`
+}
+
+func facturaPrueba() models.Factura {
+	return models.Factura{
+		CerPath:               cerPrueba,
+		Serie:                 "A",
+		NumeroFolio:           "100",
+		FechaEmision:          "2023-06-01T12:00:00",
+		FormaPago:             "01",
+		MetodoPago:            "PUE",
+		Moneda:                "MXN",
+		EmisorRFC:             "EKU9003173C9",
+		EmisorRazonSocial:     "ESCUELA KEMPER URGATE",
+		EmisorRegimenFiscal:   "601",
+		EmisorCodigoPostal:    "42501",
+		ReceptorRFC:           "URE180429TM6",
+		ReceptorRazonSocial:   "UNIVERSIDAD ROBOTICA ESPAÑOLA",
+		ReceptorCodigoPostal:  "86991",
+		RegimenFiscalReceptor: "601",
+		UsoCFDI:               "G01",
+		Conceptos: []models.Concepto{{
+			ClaveProdServ: "01010101",
+			ClaveUnidad:   "H87",
+			Descripcion:   "Producto de prueba",
+			Cantidad:      2,
+			ValorUnitario: 50,
+			TasaIVA:       16,
+		}},
+	}
+}
+
+// TestSelloCFDIVerificable sella un CFDI con el CSD de pruebas y verifica el sello con el
+// certificado incluido en el XML sobre la cadena original del comprobante
+func TestSelloCFDIVerificable(t *testing.T) {
+	factura := facturaPrueba()
+	xmlSellado, err := ProcesarKeyYGenerarCFDI(factura, keyPrueba, clavePrueba)
+	if err != nil {
+		t.Fatalf("error al sellar el CFDI: %v", err)
+	}
+
+	var sellado selloComprobante
+	if err := xml.Unmarshal(xmlSellado, &sellado); err != nil {
+		t.Fatalf("XML sellado inválido: %v", err)
+	}
+	if sellado.Sello == "" || sellado.Certificado == "" || sellado.NoCertificado == "" {
+		t.Fatalf("faltan Sello, Certificado o NoCertificado en el XML: %+v", sellado)
+	}
+	// El número de serie del CSD de pruebas son los dígitos ASCII de su número de certificado
+	if sellado.NoCertificado != "30001000000400002434" {
+		t.Errorf("NoCertificado = %s, se esperaba 30001000000400002434", sellado.NoCertificado)
+	}
+
+	der, err := base64.StdEncoding.DecodeString(sellado.Certificado)
+	if err != nil {
+		t.Fatalf("Certificado no es base64: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Certificado inválido: %v", err)
+	}
+	publica, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		t.Fatalf("el certificado no tiene llave RSA")
+	}
+	firma, err := base64.StdEncoding.DecodeString(sellado.Sello)
+	if err != nil {
+		t.Fatalf("Sello no es base64: %v", err)
+	}
+
+	// La cadena original se reconstruye con los mismos datos que quedaron en el XML
+	factura.NoCertificado = sellado.NoCertificado
+	factura.Certificado = sellado.Certificado
+	cadena := GenerarCadenaOriginal(construirComprobante(factura))
+	digesto := sha256.Sum256([]byte(cadena))
+	if err := rsa.VerifyPKCS1v15(publica, crypto.SHA256, digesto[:], firma); err != nil {
+		t.Fatalf("el sello no corresponde a la cadena original: %v\ncadena: %s", err, cadena)
+	}
+
+	// Cualquier cambio en el comprobante invalida el sello
+	factura.Conceptos[0].ValorUnitario = 51
+	alterada := sha256.Sum256([]byte(GenerarCadenaOriginal(construirComprobante(factura))))
+	if err := rsa.VerifyPKCS1v15(publica, crypto.SHA256, alterada[:], firma); err == nil {
+		t.Fatalf("el sello se verificó con una cadena alterada")
+	}
+}
+
+func TestSelloCFDIContrasenaIncorrecta(t *testing.T) {
+	_, err := ProcesarKeyYGenerarCFDI(facturaPrueba(), keyPrueba, "incorrecta")
+	if err == nil {
+		t.Fatalf("se selló el CFDI con una contraseña incorrecta")
+	}
+	if !errors.Is(err, utils.ErrLlaveCSDContrasena) {
+		t.Errorf("se esperaba ErrLlaveCSDContrasena, se obtuvo: %v", err)
+	}
+}
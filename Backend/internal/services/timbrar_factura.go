@@ -1,19 +1,126 @@
 package services
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"Facts/internal/db"
 	"Facts/internal/models"
+	"Facts/internal/pac"
+)
+
+// Reintentos del timbrado ante fallas transitorias del PAC (red, timeout, 5xx)
+const (
+	intentosTimbrado      = 4
+	esperaInicialTimbrado = time.Second // Se duplica en cada reintento
+)
+
+// Errores del timbrado idempotente
+var (
+	// ErrTimbradoSinFolio indica un comprobante sin folio, que no se puede identificar para timbrarlo una sola vez
+	ErrTimbradoSinFolio = errors.New("el comprobante no tiene folio; no se puede timbrar")
+	// ErrTimbradoEnConflicto indica que el folio ya tiene un envío sin respuesta con otro XML
+	ErrTimbradoEnConflicto = errors.New("el folio ya tiene un timbrado pendiente con otro XML")
 )
 
-// TimbrarFactura envía el XML firmado al PAC, imprime el XML timbrado recibido y extrae el timbre fiscal digital
-func TimbrarFactura(xmlFirmado []byte, usuarioPAC, clavePAC, endpoint string) (*models.TimbreFiscalDigital, []byte, error) {
-	// 1. Envía el XML firmado al PAC
-	xmlTimbrado, err := EnviarXMLAlPAC(xmlFirmado, usuarioPAC, clavePAC, endpoint)
+// TimbrarXML timbra el XML firmado una sola vez por emisor+serie+folio. Reintenta con backoff
+// exponencial las fallas transitorias y, si el PAC ya lo había timbrado (respuesta perdida o
+// reenvío), recupera el timbre previo. El XML timbrado queda guardado antes de regresar. Rechaza
+// el comprobante sin folio y el que trae otro XML mientras su folio tiene un envío pendiente.
+func TimbrarXML(xmlFirmado []byte, proveedor pac.PACProvider) ([]byte, error) {
+	comprobante, err := LeerComprobante(xmlFirmado)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+	if comprobante.Folio == "" {
+		return nil, ErrTimbradoSinFolio
 	}
+	suma := sha256.Sum256(xmlFirmado)
+	hash := hex.EncodeToString(suma[:])
 
-	// Log: imprimir el XML timbrado recibido
-	println("[PAC_DEBUG] XML timbrado recibido:\n", string(xmlTimbrado))
+	registro, err := db.ReservarTimbrado(comprobante.Emisor.Rfc, comprobante.Serie, comprobante.Folio, hash, xmlFirmado)
+	if err != nil {
+		return nil, err
+	}
+	if registro.Estado == db.TimbradoCompletado {
+		log.Printf("[TIMBRADO] %s %s%s ya estaba timbrado (UUID %s)", comprobante.Emisor.Rfc, comprobante.Serie, comprobante.Folio, registro.UUID)
+		return []byte(registro.XMLTimbrado), nil
+	}
+
+	if registro.HashXML != hash {
+		// Un intento anterior quedó sin respuesta con otro contenido: reenviarlo timbraría un XML
+		// distinto al que pidió quien llama, y timbrar el nuevo podría duplicar el folio
+		return nil, fmt.Errorf("%w: %s %s%s", ErrTimbradoEnConflicto, comprobante.Emisor.Rfc, comprobante.Serie, comprobante.Folio)
+	}
+
+	xmlTimbrado, err := timbrarConReintentos(xmlFirmado, proveedor, registro.ID)
+	if err != nil {
+		// Tras una falla transitoria el registro queda pendiente y el siguiente intento reenvía el mismo XML
+		if !pac.EsTransitorio(err) {
+			db.MarcarTimbradoFallido(registro.ID, err.Error())
+		}
+		return nil, err
+	}
+
+	tfd, err := ExtraerTimbreFiscalDigital(xmlTimbrado)
+	if err != nil {
+		return nil, fmt.Errorf("el PAC devolvió un XML sin timbre: %w", err)
+	}
+	if err := db.CompletarTimbrado(registro.ID, tfd.UUID, xmlTimbrado); err != nil {
+		return nil, fmt.Errorf("CFDI timbrado con UUID %s pero no se pudo guardar: %w", tfd.UUID, err)
+	}
+	return xmlTimbrado, nil
+}
+
+// timbrarConReintentos envía el XML al PAC reintentando las fallas transitorias
+func timbrarConReintentos(xmlFirmado []byte, proveedor pac.PACProvider, idRegistro int64) ([]byte, error) {
+	espera := esperaInicialTimbrado
+	var err error
+	for intento := 1; intento <= intentosTimbrado; intento++ {
+		var xmlTimbrado []byte
+		xmlTimbrado, err = proveedor.Timbrar(xmlFirmado)
+		if err == nil {
+			return xmlTimbrado, nil
+		}
+		if errors.Is(err, pac.ErrTimbreDuplicado) {
+			return recuperarTimbre(xmlFirmado, proveedor, err)
+		}
+		db.RegistrarIntentoFallido(idRegistro, err.Error())
+		if !pac.EsTransitorio(err) || intento == intentosTimbrado {
+			break
+		}
+		log.Printf("[TIMBRADO] Intento %d con %s falló: %v; reintento en %s", intento, proveedor.Nombre(), err, espera)
+		time.Sleep(espera)
+		espera *= 2
+	}
+	return nil, err
+}
+
+// recuperarTimbre obtiene del PAC el XML que ya había timbrado
+func recuperarTimbre(xmlFirmado []byte, proveedor pac.PACProvider, errDuplicado error) ([]byte, error) {
+	recuperador, ok := proveedor.(pac.Recuperador)
+	if !ok {
+		return nil, fmt.Errorf("%w; %s no permite recuperar el timbre previo", errDuplicado, proveedor.Nombre())
+	}
+	log.Printf("[TIMBRADO] El PAC %s reporta el CFDI como timbrado; recuperando el timbre previo", proveedor.Nombre())
+	xmlTimbrado, err := recuperador.Recuperar(xmlFirmado)
+	if err != nil {
+		return nil, fmt.Errorf("error al recuperar el timbre previo: %w", err)
+	}
+	return xmlTimbrado, nil
+}
+
+// TimbrarFactura timbra el XML firmado de forma idempotente y extrae el timbre fiscal digital
+func TimbrarFactura(xmlFirmado []byte, proveedor pac.PACProvider) (*models.TimbreFiscalDigital, []byte, error) {
+	// 1. Envía el XML firmado al PAC (o recupera el timbre de un envío previo)
+	xmlTimbrado, err := TimbrarXML(xmlFirmado, proveedor)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	// 2. Extrae el timbre fiscal digital
 	tfd, err := ExtraerTimbreFiscalDigital(xmlTimbrado)
@@ -24,7 +131,7 @@ func TimbrarFactura(xmlFirmado []byte, usuarioPAC, clavePAC, endpoint string) (*
 	timbre := &models.TimbreFiscalDigital{
 		UUID:             tfd.UUID,
 		FechaTimbrado:    tfd.FechaTimbrado,
-		RfcProvCertif:    "", // No disponible en tfd, dejar vacío o asignar otro campo si aplica
+		RfcProvCertif:    tfd.RfcProvCertif,
 		SelloCFD:         tfd.SelloCFD,
 		NoCertificadoSAT: tfd.NoCertificadoSAT,
 		SelloSAT:         tfd.SelloSAT,
@@ -1,3 +0,0 @@
-package services
-
-// TimbrarConPAC realiza el POST real al endpoint del PAC y devuelve el XML timbrado
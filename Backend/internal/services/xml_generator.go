@@ -3,6 +3,8 @@ package services
 import (
 	"Facts/internal/models"
 	"Facts/internal/pac"
+	"Facts/internal/secretos"
+	"Facts/internal/utils"
 	"bytes"
 	"crypto"
 	"crypto/rand"
@@ -14,17 +16,11 @@ import (
 	"errors"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"time"
 )
 
-const (
-	outformPEM       = "-outform"
-	pemErrorBlockMsg = "[PEM_ERROR] Bloque PEM completo:\n%s\n"
-)
-
 // Extrae el certificado y número de certificado desde base64 o archivo local
 func asignarCertificadoCFDI(factura *models.Factura) error {
 	var cerBytes []byte
@@ -61,10 +57,7 @@ func asignarCertificadoCFDI(factura *models.Factura) error {
 	if err != nil {
 		return fmt.Errorf("no se pudo parsear el certificado: %v", err)
 	}
-	noCert := fmt.Sprintf("%X", cert.SerialNumber)
-	if len(noCert) < 20 {
-		noCert = fmt.Sprintf("%020s", noCert)
-	}
+	noCert := utils.NumeroCertificadoCSD(cert)
 	factura.NoCertificado = noCert
 	certBase64 := base64.StdEncoding.EncodeToString(cert.Raw)
 	factura.Certificado = certBase64
@@ -73,109 +66,86 @@ func asignarCertificadoCFDI(factura *models.Factura) error {
 	return nil
 }
 
-// Recibe el archivo .key cifrado y la clave, lo descifra, guarda el PEM en la base de datos y genera el XML CFDI firmado
-func ProcesarKeyYGenerarCFDI(factura models.Factura, keyPath string, claveCSD string, xsltPath string) ([]byte, error) {
+// Recibe la ruta del .key y la clave (selladas o en claro), abre la llave privada y genera el XML CFDI firmado
+func ProcesarKeyYGenerarCFDI(factura models.Factura, keyPath string, claveCSD string) ([]byte, error) {
 	// Asignar certificado y número de certificado
 	err := asignarCertificadoCFDI(&factura)
 	if err != nil {
 		return nil, fmt.Errorf("error obteniendo certificado: %w", err)
 	}
 
-	// Descifrar la llave .key como antes
-	keyPathNorm := strings.ReplaceAll(keyPath, "\\", "/")
-	absPath, err := filepath.Abs(keyPath)
-	if err != nil {
-		fmt.Printf("[KEY_DEBUG] Error obteniendo ruta absoluta: %v\n", err)
-		absPath = keyPath
-	}
-	fileInfo, err := os.Stat(absPath)
+	// Abrir la llave .key sellada y descifrarla en memoria (sin archivos temporales ni OpenSSL)
+	id := secretos.IdentidadCSD{RFC: factura.EmisorRFC, NoCertificado: factura.NoCertificado}
+	llave, err := secretos.LlavePrivadaCSD(keyPath, claveCSD, id)
 	if err != nil {
-		return nil, fmt.Errorf("no se pudo acceder al archivo .key en %s: %v", absPath, err)
-	}
-	fmt.Printf("[KEY_DEBUG] Ruta absoluta .key: %s, tamaño: %d bytes\n", absPath, fileInfo.Size())
-	fmt.Printf("[KEY_DEBUG] Ruta recibida para .key: %s\n", keyPath)
-	fmt.Printf("[KEY_DEBUG] Ruta normalizada para OpenSSL: %s\n", keyPathNorm)
-	pemTempPKCS8 := keyPath + "_pkcs8.pem"
-	pemTempPKCS8Norm := strings.ReplaceAll(pemTempPKCS8, "\\", "/")
-	pemTempRSA := keyPath + "_rsa.pem"
-	pemTempRSANorm := strings.ReplaceAll(pemTempRSA, "\\", "/")
-	fmt.Printf("[KEY_DEBUG] Archivo temporal PKCS#8: %s\n", pemTempPKCS8)
-	fmt.Printf("[KEY_DEBUG] Archivo temporal RSA: %s\n", pemTempRSA)
-
-	cmd1 := exec.Command("openssl", "pkcs8", "-in", keyPathNorm, "-inform", "DER", "-passin", "pass:"+claveCSD, "-out", pemTempPKCS8Norm, outformPEM, "PEM")
-	errCmd1 := cmd1.Run()
-	if errCmd1 != nil {
-		fmt.Printf("[KEY_DEBUG] Falló descifrado DER, intentando PEM...\n")
-		cmd1pem := exec.Command("openssl", "pkcs8", "-in", keyPathNorm, "-inform", "PEM", "-passin", "pass:"+claveCSD, "-out", pemTempPKCS8Norm, outformPEM, "PEM")
-		errCmd1pem := cmd1pem.Run()
-		if errCmd1pem != nil {
-			return nil, fmt.Errorf("error descifrando .key a PKCS#8 con OpenSSL (DER y PEM): %v | %v", errCmd1, errCmd1pem)
-		}
-	}
-
-	cmd2 := exec.Command("openssl", "rsa", "-in", pemTempPKCS8Norm, "-out", pemTempRSANorm, outformPEM, "PEM")
-	if err := cmd2.Run(); err != nil {
-		os.Remove(pemTempPKCS8)
-		return nil, fmt.Errorf("error convirtiendo PKCS#8 a RSA PRIVATE KEY con OpenSSL: %v", err)
-	}
-	defer os.Remove(pemTempPKCS8)
-	defer os.Remove(pemTempRSA)
-
-	pemBytes, err := os.ReadFile(pemTempRSA)
-	if err != nil {
-		return nil, fmt.Errorf("error leyendo PEM RSA descifrado: %v", err)
-	}
-	keyPEM := string(pemBytes)
-	fmt.Printf("[KEY_DEBUG] === CONTENIDO COMPLETO PEM DESCIFRADO (RSA PRIVATE KEY) ===\n%s\n[KEY_DEBUG] === FIN CONTENIDO PEM DESCIFRADO ===\n", keyPEM)
-	preview := keyPEM
-	if len(preview) > 100 {
-		preview = preview[:100]
-	}
-	fmt.Printf("[KEY_DEBUG] Inicio PEM descifrado: %s\n", preview)
-	block, _ := pem.Decode(pemBytes)
-	if block != nil {
-		fmt.Printf("[KEY_DEBUG] Tipo de bloque PEM descifrado: %s\n", block.Type)
+		return nil, err
 	}
-	return FlujoCFDIFirmado(factura, keyPEM, xsltPath)
+	return FlujoCFDIFirmado(factura, llave)
 }
 
 // Estructura exacta según el XML de ejemplo CFDI 4.0
 type CFDIComprobante struct {
-	XMLName           xml.Name      `xml:"cfdi:Comprobante"`
-	XMLNS             string        `xml:"xmlns:cfdi,attr"`
-	XMLNSXSI          string        `xml:"xmlns:xsi,attr"`
-	XSISchemaLocation string        `xml:"xsi:schemaLocation,attr"`
-	Version           string        `xml:"Version,attr"`
-	Serie             string        `xml:"Serie,attr,omitempty"`
-	Folio             string        `xml:"Folio,attr"`
-	Fecha             string        `xml:"Fecha,attr"`
-	Sello             string        `xml:"Sello,attr,omitempty"`
-	FormaPago         string        `xml:"FormaPago,attr"`
-	NoCertificado     string        `xml:"NoCertificado,attr"`
-	Certificado       string        `xml:"Certificado,attr"`
-	SubTotal          string        `xml:"SubTotal,attr"`
-	Descuento         string        `xml:"Descuento,attr,omitempty"`
-	Moneda            string        `xml:"Moneda,attr"`
-	Total             string        `xml:"Total,attr"`
-	TipoDeComprobante string        `xml:"TipoDeComprobante,attr"`
-	MetodoPago        string        `xml:"MetodoPago,attr"`
-	LugarExpedicion   string        `xml:"LugarExpedicion,attr"`
-	Emisor            CFDIEmisor    `xml:"cfdi:Emisor"`
-	Receptor          CFDIReceptor  `xml:"cfdi:Receptor"`
-	Conceptos         CFDIConceptos `xml:"cfdi:Conceptos"`
-	Impuestos         CFDIImpuestos `xml:"cfdi:Impuestos"`
+	XMLName           xml.Name               `xml:"cfdi:Comprobante"`
+	XMLNS             string                 `xml:"xmlns:cfdi,attr"`
+	XMLNSXSI          string                 `xml:"xmlns:xsi,attr"`
+	XMLNSPago20       string                 `xml:"xmlns:pago20,attr,omitempty"`
+	XSISchemaLocation string                 `xml:"xsi:schemaLocation,attr"`
+	Version           string                 `xml:"Version,attr"`
+	Serie             string                 `xml:"Serie,attr,omitempty"`
+	Folio             string                 `xml:"Folio,attr"`
+	Fecha             string                 `xml:"Fecha,attr"`
+	Sello             string                 `xml:"Sello,attr,omitempty"`
+	FormaPago         string                 `xml:"FormaPago,attr,omitempty"`
+	NoCertificado     string                 `xml:"NoCertificado,attr"`
+	Certificado       string                 `xml:"Certificado,attr"`
+	CondicionesDePago string                 `xml:"CondicionesDePago,attr,omitempty"`
+	SubTotal          string                 `xml:"SubTotal,attr"`
+	Descuento         string                 `xml:"Descuento,attr,omitempty"`
+	Moneda            string                 `xml:"Moneda,attr"`
+	TipoCambio        string                 `xml:"TipoCambio,attr,omitempty"`
+	Total             string                 `xml:"Total,attr"`
+	TipoDeComprobante string                 `xml:"TipoDeComprobante,attr"`
+	Exportacion       string                 `xml:"Exportacion,attr"`
+	MetodoPago        string                 `xml:"MetodoPago,attr,omitempty"`
+	LugarExpedicion   string                 `xml:"LugarExpedicion,attr"`
+	Confirmacion      string                 `xml:"Confirmacion,attr,omitempty"`
+	InformacionGlobal *CFDIInformacionGlobal `xml:"cfdi:InformacionGlobal,omitempty"`
+	CfdiRelacionados  *CFDIRelacionados      `xml:"cfdi:CfdiRelacionados,omitempty"`
+	Emisor            CFDIEmisor             `xml:"cfdi:Emisor"`
+	Receptor          CFDIReceptor           `xml:"cfdi:Receptor"`
+	Conceptos         CFDIConceptos          `xml:"cfdi:Conceptos"`
+	Impuestos         *CFDIImpuestos         `xml:"cfdi:Impuestos,omitempty"`
+	Complemento       *CFDIComplemento       `xml:"cfdi:Complemento,omitempty"`
+}
+
+type CFDIInformacionGlobal struct {
+	Periodicidad string `xml:"Periodicidad,attr"`
+	Meses        string `xml:"Meses,attr"`
+	Anio         string `xml:"Año,attr"`
+}
+
+type CFDIRelacionados struct {
+	TipoRelacion    string                `xml:"TipoRelacion,attr"`
+	CfdiRelacionado []CFDIRelacionadoUUID `xml:"cfdi:CfdiRelacionado"`
+}
+
+type CFDIRelacionadoUUID struct {
+	UUID string `xml:"UUID,attr"`
 }
 
 type CFDIEmisor struct {
-	Rfc           string `xml:"Rfc,attr"`
-	Nombre        string `xml:"Nombre,attr"`
-	RegimenFiscal string `xml:"RegimenFiscal,attr"`
+	Rfc              string `xml:"Rfc,attr"`
+	Nombre           string `xml:"Nombre,attr"`
+	RegimenFiscal    string `xml:"RegimenFiscal,attr"`
+	FacAtrAdquirente string `xml:"FacAtrAdquirente,attr,omitempty"`
 }
 
 type CFDIReceptor struct {
 	Rfc                     string `xml:"Rfc,attr"`
 	Nombre                  string `xml:"Nombre,attr"`
 	DomicilioFiscalReceptor string `xml:"DomicilioFiscalReceptor,attr"`
+	ResidenciaFiscal        string `xml:"ResidenciaFiscal,attr,omitempty"` // Solo receptores extranjeros
+	NumRegIdTrib            string `xml:"NumRegIdTrib,attr,omitempty"`
 	RegimenFiscalReceptor   string `xml:"RegimenFiscalReceptor,attr"`
 	UsoCFDI                 string `xml:"UsoCFDI,attr"`
 }
@@ -185,20 +155,52 @@ type CFDIConceptos struct {
 }
 
 type CFDIConcepto struct {
-	ClaveProdServ    string                `xml:"ClaveProdServ,attr"`
-	NoIdentificacion string                `xml:"NoIdentificacion,attr,omitempty"`
-	Cantidad         string                `xml:"Cantidad,attr"`
-	ClaveUnidad      string                `xml:"ClaveUnidad,attr"`
-	Unidad           string                `xml:"Unidad,attr,omitempty"`
-	Descripcion      string                `xml:"Descripcion,attr"`
-	ValorUnitario    string                `xml:"ValorUnitario,attr"`
-	Importe          string                `xml:"Importe,attr"`
-	ObjetoImp        string                `xml:"ObjetoImp,attr"`
-	Impuestos        CFDIConceptoImpuestos `xml:"cfdi:Impuestos"`
+	ClaveProdServ       string                    `xml:"ClaveProdServ,attr"`
+	NoIdentificacion    string                    `xml:"NoIdentificacion,attr,omitempty"`
+	Cantidad            string                    `xml:"Cantidad,attr"`
+	ClaveUnidad         string                    `xml:"ClaveUnidad,attr"`
+	Unidad              string                    `xml:"Unidad,attr,omitempty"`
+	Descripcion         string                    `xml:"Descripcion,attr"`
+	ValorUnitario       string                    `xml:"ValorUnitario,attr"`
+	Importe             string                    `xml:"Importe,attr"`
+	Descuento           string                    `xml:"Descuento,attr,omitempty"`
+	ObjetoImp           string                    `xml:"ObjetoImp,attr"`
+	Impuestos           *CFDIConceptoImpuestos    `xml:"cfdi:Impuestos,omitempty"`
+	ACuentaTerceros     *CFDIACuentaTerceros      `xml:"cfdi:ACuentaTerceros,omitempty"`
+	InformacionAduanera []CFDIInformacionAduanera `xml:"cfdi:InformacionAduanera,omitempty"`
+	CuentaPredial       []CFDICuentaPredial       `xml:"cfdi:CuentaPredial,omitempty"`
+	Parte               []CFDIParte               `xml:"cfdi:Parte,omitempty"`
+}
+
+type CFDIACuentaTerceros struct {
+	RfcACuentaTerceros             string `xml:"RfcACuentaTerceros,attr"`
+	NombreACuentaTerceros          string `xml:"NombreACuentaTerceros,attr"`
+	RegimenFiscalACuentaTerceros   string `xml:"RegimenFiscalACuentaTerceros,attr"`
+	DomicilioFiscalACuentaTerceros string `xml:"DomicilioFiscalACuentaTerceros,attr"`
+}
+
+type CFDIInformacionAduanera struct {
+	NumeroPedimento string `xml:"NumeroPedimento,attr"`
+}
+
+type CFDICuentaPredial struct {
+	Numero string `xml:"Numero,attr"`
+}
+
+type CFDIParte struct {
+	ClaveProdServ       string                    `xml:"ClaveProdServ,attr"`
+	NoIdentificacion    string                    `xml:"NoIdentificacion,attr,omitempty"`
+	Cantidad            string                    `xml:"Cantidad,attr"`
+	Unidad              string                    `xml:"Unidad,attr,omitempty"`
+	Descripcion         string                    `xml:"Descripcion,attr"`
+	ValorUnitario       string                    `xml:"ValorUnitario,attr,omitempty"`
+	Importe             string                    `xml:"Importe,attr,omitempty"`
+	InformacionAduanera []CFDIInformacionAduanera `xml:"cfdi:InformacionAduanera,omitempty"`
 }
 
 type CFDIConceptoImpuestos struct {
-	Traslados CFDIConceptoTraslados `xml:"cfdi:Traslados"`
+	Traslados   *CFDIConceptoTraslados   `xml:"cfdi:Traslados,omitempty"`
+	Retenciones *CFDIConceptoRetenciones `xml:"cfdi:Retenciones,omitempty"`
 }
 
 type CFDIConceptoTraslados struct {
@@ -206,6 +208,18 @@ type CFDIConceptoTraslados struct {
 }
 
 type CFDIConceptoTraslado struct {
+	Base       string `xml:"Base,attr"`
+	Impuesto   string `xml:"Impuesto,attr"`
+	TipoFactor string `xml:"TipoFactor,attr"`
+	TasaOCuota string `xml:"TasaOCuota,attr,omitempty"` // Vacío cuando TipoFactor es Exento
+	Importe    string `xml:"Importe,attr,omitempty"`
+}
+
+type CFDIConceptoRetenciones struct {
+	Retencion []CFDIConceptoRetencion `xml:"cfdi:Retencion"`
+}
+
+type CFDIConceptoRetencion struct {
 	Base       string `xml:"Base,attr"`
 	Impuesto   string `xml:"Impuesto,attr"`
 	TipoFactor string `xml:"TipoFactor,attr"`
@@ -214,8 +228,19 @@ type CFDIConceptoTraslado struct {
 }
 
 type CFDIImpuestos struct {
-	TotalImpuestosTrasladados string        `xml:"TotalImpuestosTrasladados,attr"`
-	Traslados                 CFDITraslados `xml:"cfdi:Traslados"`
+	TotalImpuestosRetenidos   string           `xml:"TotalImpuestosRetenidos,attr,omitempty"`
+	TotalImpuestosTrasladados string           `xml:"TotalImpuestosTrasladados,attr,omitempty"`
+	Retenciones               *CFDIRetenciones `xml:"cfdi:Retenciones,omitempty"`
+	Traslados                 *CFDITraslados   `xml:"cfdi:Traslados,omitempty"`
+}
+
+type CFDIRetenciones struct {
+	Retencion []CFDIRetencion `xml:"cfdi:Retencion"`
+}
+
+type CFDIRetencion struct {
+	Impuesto string `xml:"Impuesto,attr"`
+	Importe  string `xml:"Importe,attr"`
 }
 
 type CFDITraslados struct {
@@ -223,10 +248,11 @@ type CFDITraslados struct {
 }
 
 type CFDITraslado struct {
+	Base       string `xml:"Base,attr"`
 	Impuesto   string `xml:"Impuesto,attr"`
 	TipoFactor string `xml:"TipoFactor,attr"`
-	TasaOCuota string `xml:"TasaOCuota,attr"`
-	Importe    string `xml:"Importe,attr"`
+	TasaOCuota string `xml:"TasaOCuota,attr,omitempty"`
+	Importe    string `xml:"Importe,attr,omitempty"`
 }
 
 // Auxiliares
@@ -283,117 +309,32 @@ func safeReceptor(factura models.Factura) CFDIReceptor {
 	}
 }
 
-// Firma la cadena original usando la llave privada PEM (archivo_key_pem)
-func firmarCadenaOriginal(cadenaOriginal string, keyPEM string) (string, error) {
-	// Log de depuración para ver el contenido recibido
-	fmt.Println("[PEM_DEBUG] keyPEM recibido:\n" + keyPEM)
-	block, _ := pem.Decode([]byte(keyPEM))
-	if block == nil {
-		fmt.Println("[PEM_ERROR] No se pudo decodificar el PEM de la llave privada.\nContenido recibido:\n" + keyPEM)
-		return "", errors.New("no se pudo decodificar el PEM de la llave privada")
-	}
-	fmt.Printf("[PEM_DEBUG] Tipo de bloque PEM: %s\n", block.Type)
-	var rsaPriv *rsa.PrivateKey
-	var err error
-	if block.Type == "PRIVATE KEY" {
-		var key interface{}
-		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
-		if err != nil {
-			fmt.Printf("[PEM_ERROR] Error en x509.ParsePKCS8PrivateKey: %v\n", err)
-			fmt.Printf("[PEM_ERROR] Bytes del bloque PRIVATE KEY (hex): %x\n", block.Bytes)
-			fmt.Printf(pemErrorBlockMsg, string(pem.EncodeToMemory(block)))
-			return "", errors.New("la llave privada no es RSA o está dañada (PKCS8)")
-		}
-		var ok bool
-		rsaPriv, ok = key.(*rsa.PrivateKey)
-		if !ok {
-			fmt.Printf("[PEM_ERROR] La llave PKCS#8 no es RSA\n")
-			fmt.Printf(pemErrorBlockMsg, string(pem.EncodeToMemory(block)))
-			return "", errors.New("la llave PKCS#8 no es RSA")
-		}
-	} else if block.Type == "RSA PRIVATE KEY" {
-		rsaPriv, err = x509.ParsePKCS1PrivateKey(block.Bytes)
-		if err != nil {
-			fmt.Printf("[PEM_ERROR] Error en x509.ParsePKCS1PrivateKey: %v\n", err)
-			fmt.Printf("[PEM_ERROR] Bytes del bloque RSA PRIVATE KEY (hex): %x\n", block.Bytes)
-			fmt.Printf(pemErrorBlockMsg, string(pem.EncodeToMemory(block)))
-			return "", errors.New("la llave privada no es RSA o está dañada (PKCS1)")
-		}
-	}
-	if rsaPriv == nil {
-		fmt.Printf("[PEM_ERROR] La llave privada no es RSA o está dañada. Bloque tipo: %s\n", block.Type)
-		fmt.Printf(pemErrorBlockMsg, string(pem.EncodeToMemory(block)))
-		return "", errors.New("la llave privada no es RSA o está dañada")
+// Firma la cadena original (SHA256withRSA) con la llave privada del CSD
+func firmarCadenaOriginal(cadenaOriginal string, llave *rsa.PrivateKey) (string, error) {
+	if llave == nil {
+		return "", errors.New("no se proporcionó la llave privada del CSD")
 	}
 	hash := crypto.SHA256.New()
 	hash.Write([]byte(cadenaOriginal))
 	hashed := hash.Sum(nil)
-	signature, err := rsa.SignPKCS1v15(rand.Reader, rsaPriv, crypto.SHA256, hashed)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, llave, crypto.SHA256, hashed)
 	if err != nil {
 		return "", err
 	}
 	return base64.StdEncoding.EncodeToString(signature), nil
 }
 
-// GenerarCadenaOriginal ejecuta xsltproc para obtener la cadena original CFDI 4.0
-func GenerarCadenaOriginal(xmlPath, xsltPath string) (string, error) {
-	fmt.Printf("[XSLT_DEBUG] Ejecutando xsltproc con XSLT: %s y XML: %s\n", xsltPath, xmlPath)
-	cmd := exec.Command("xsltproc", xsltPath, xmlPath)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		fmt.Printf("[XSLT_ERROR] xsltproc error: %v\n", err)
-		fmt.Printf("[XSLT_ERROR] xsltproc output: %s\n", string(out))
-		return "", fmt.Errorf("xsltproc error: %v, output: %s", err, string(out))
-	}
-	// Limpia saltos de línea y espacios extra
-	return strings.TrimSpace(string(out)), nil
-}
-
-// Ejemplo de flujo completo: genera XML preliminar, obtiene cadena original y genera XML final firmado
-// Nota: Este es un ejemplo, puedes adaptarlo a tu flujo real
-func FlujoCFDIFirmado(factura models.Factura, keyPEM string, xsltPath string) ([]byte, error) {
-	// Si xsltPath está vacío, usar la ruta por defecto del XSLT oficial CFDI 4.0
-	if xsltPath == "" {
-		xsltPath = "internal/services/cadenaoriginal_4_0.xslt"
-	}
-	// Convertir a ruta absoluta para evitar errores de xsltproc
-	absXSLT, err := filepath.Abs(xsltPath)
-	if err == nil {
-		xsltPath = absXSLT
-	}
-
-	// 1. Generar XML preliminar (sin sello)
-	tmpFile, err := os.CreateTemp("", "cfdi_pre_*.xml")
-	if err != nil {
-		return nil, fmt.Errorf("error creando archivo temporal: %w", err)
-	}
-	defer os.Remove(tmpFile.Name())
-
-	xmlPre, err := GenerarXML(factura)
-	if err != nil {
-		return nil, fmt.Errorf("error generando XML preliminar: %w", err)
-	}
-	if _, err := tmpFile.Write(xmlPre); err != nil {
-		return nil, fmt.Errorf("error escribiendo XML temporal: %w", err)
-	}
-	tmpFile.Close()
-
-	// 2. Generar cadena original usando xsltproc
-	cadenaOriginal, err := GenerarCadenaOriginal(tmpFile.Name(), xsltPath)
-	if err != nil {
-		return nil, fmt.Errorf("error generando cadena original: %w", err)
-	}
-
-	// 3. Generar XML final con sello
-	xmlFinal, err := GenerarXMLConSello(factura, keyPEM, cadenaOriginal)
+// FlujoCFDIFirmado genera el XML final firmado: construye el comprobante, obtiene la cadena original y la sella
+func FlujoCFDIFirmado(factura models.Factura, llave *rsa.PrivateKey) ([]byte, error) {
+	xmlFinal, err := GenerarXMLConSello(factura, llave)
 	if err != nil {
 		return nil, fmt.Errorf("error generando XML final con sello: %w", err)
 	}
 	return xmlFinal, nil
 }
 
-// GenerarXML convierte los datos de la factura en XML compatible con CFDI 4.0
-func GenerarXML(factura models.Factura) ([]byte, error) {
+// construirComprobante arma la estructura CFDI 4.0 (sin sello) a partir de la factura
+func construirComprobante(factura models.Factura) CFDIComprobante {
 	// Si la fecha de emisión no viene, asígnala en formato RFC3339 recortado a 19 caracteres
 	if factura.FechaEmision == "" {
 		t := time.Now().Format(time.RFC3339)
@@ -407,41 +348,35 @@ func GenerarXML(factura models.Factura) ([]byte, error) {
 	if serie == "" || serie == "undefined" || serie == "null" {
 		serie = "A"
 	}
+	if factura.TipoComprobante == "P" {
+		return construirComprobantePago(factura, serie)
+	}
 
-	var subtotal, totalImpuestos, totalDescuento float64
+	var subtotal, totalDescuento float64
+	impuestos := &acumuladorImpuestos{}
 
 	conceptos := make([]CFDIConcepto, len(factura.Conceptos))
 	for i, c := range factura.Conceptos {
 		importe := c.Cantidad * c.ValorUnitario
-		impuestoConcepto := importe * (c.TasaIVA / 100)
 		subtotal += importe
-		totalImpuestos += impuestoConcepto
 		if c.Descuento > 0 {
 			totalDescuento += c.Descuento
 		}
+		objetoImp, impuestosConcepto := impuestos.agregarConcepto(c, importe-c.Descuento)
 		conceptos[i] = CFDIConcepto{
 			ClaveProdServ:    c.ClaveProdServ,
-			NoIdentificacion: "", // no existe en tu modelo
+			NoIdentificacion: c.NoIdentificacion,
 			Cantidad:         formatFloat(c.Cantidad),
 			ClaveUnidad:      c.ClaveUnidad,
 			Unidad:           "", // no existe en tu modelo
 			Descripcion:      c.Descripcion,
 			ValorUnitario:    formatFloat(c.ValorUnitario),
 			Importe:          formatFloat(importe),
-			ObjetoImp:        "02",
-			Impuestos: CFDIConceptoImpuestos{
-				Traslados: CFDIConceptoTraslados{
-					Traslado: []CFDIConceptoTraslado{
-						{
-							Base:       formatFloat(importe),
-							Impuesto:   "002",
-							TipoFactor: "Tasa",
-							TasaOCuota: formatTasa(c.TasaIVA),
-							Importe:    formatFloat(impuestoConcepto),
-						},
-					},
-				},
-			},
+			ObjetoImp:        objetoImp,
+			Impuestos:        impuestosConcepto,
+		}
+		if c.Descuento > 0 {
+			conceptos[i].Descuento = formatFloat(c.Descuento)
 		}
 	}
 
@@ -449,6 +384,7 @@ func GenerarXML(factura models.Factura) ([]byte, error) {
 		totalDescuento += factura.Descuento
 	}
 
+	moneda := ifEmpty(factura.Moneda, "MXN")
 	comprobante := CFDIComprobante{
 		XMLNS:             "http://www.sat.gob.mx/cfd/4",
 		XMLNSXSI:          "http://www.w3.org/2001/XMLSchema-instance",
@@ -457,14 +393,16 @@ func GenerarXML(factura models.Factura) ([]byte, error) {
 		Serie:             serie,
 		Folio:             factura.NumeroFolio,
 		Fecha:             factura.FechaEmision,
-		Sello:             "",
+		Sello:             "", // Se asigna al sellar
 		FormaPago:         ifEmpty(factura.FormaPago, "01"),
 		NoCertificado:     factura.NoCertificado,
 		Certificado:       factura.Certificado,
+		CondicionesDePago: factura.CondicionesPago,
 		SubTotal:          formatFloat(subtotal),
-		Moneda:            ifEmpty(factura.Moneda, "MXN"),
-		Total:             formatFloat(subtotal + totalImpuestos - totalDescuento),
-		TipoDeComprobante: "I",
+		Moneda:            moneda,
+		Total:             formatFloat(subtotal - totalDescuento + impuestos.totalTrasladados - impuestos.totalRetenidos),
+		TipoDeComprobante: ifEmpty(factura.TipoComprobante, "I"),
+		Exportacion:       "01",
 		MetodoPago:        ifEmpty(factura.MetodoPago, "PUE"),
 		LugarExpedicion:   factura.EmisorCodigoPostal,
 		Emisor: CFDIEmisor{
@@ -474,25 +412,34 @@ func GenerarXML(factura models.Factura) ([]byte, error) {
 		},
 		Receptor:  safeReceptor(factura),
 		Conceptos: CFDIConceptos{Concepto: conceptos},
-		Impuestos: CFDIImpuestos{
-			TotalImpuestosTrasladados: formatFloat(totalImpuestos),
-			Traslados: CFDITraslados{
-				Traslado: []CFDITraslado{
-					{
-						Impuesto:   "002",
-						TipoFactor: "Tasa",
-						TasaOCuota: "0.160000",
-						Importe:    formatFloat(totalImpuestos),
-					},
-				},
-			},
-		},
+		Impuestos: impuestos.nodo(),
 	}
 
+	if factura.TipoRelacion != "" && len(factura.UUIDsRelacionados) > 0 {
+		relacionados := &CFDIRelacionados{TipoRelacion: factura.TipoRelacion}
+		for _, uuid := range factura.UUIDsRelacionados {
+			relacionados.CfdiRelacionado = append(relacionados.CfdiRelacionado, CFDIRelacionadoUUID{UUID: strings.ToUpper(uuid)})
+		}
+		comprobante.CfdiRelacionados = relacionados
+	}
+	if g := factura.InformacionGlobal; g != nil {
+		comprobante.InformacionGlobal = &CFDIInformacionGlobal{
+			Periodicidad: g.Periodicidad,
+			Meses:        g.Meses,
+			Anio:         g.Anio,
+		}
+	}
+	if moneda != "MXN" && moneda != "XXX" && factura.TipoCambio > 0 {
+		comprobante.TipoCambio = fmt.Sprintf("%.6f", factura.TipoCambio)
+	}
 	if totalDescuento > 0 {
 		comprobante.Descuento = formatFloat(totalDescuento)
 	}
+	return comprobante
+}
 
+// serializarComprobante convierte el comprobante a XML con encabezado e indentación
+func serializarComprobante(comprobante CFDIComprobante) ([]byte, error) {
 	var buf bytes.Buffer
 	buf.WriteString(xml.Header)
 	encoder := xml.NewEncoder(&buf)
@@ -503,114 +450,24 @@ func GenerarXML(factura models.Factura) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-// GenerarXMLConSello genera el XML CFDI 4.0 y firma el sello usando el archivo_key_pem y la cadena original
-func GenerarXMLConSello(factura models.Factura, keyPEM string, cadenaOriginal string) ([]byte, error) {
-	// Si la fecha de emisión no viene, asígnala en formato RFC3339 recortado a 19 caracteres
-	if factura.FechaEmision == "" {
-		t := time.Now().Format(time.RFC3339)
-		if len(t) > 19 {
-			t = t[:19]
-		}
-		factura.FechaEmision = t
-	}
-	// Serie nunca debe ser "undefined", "null" o vacía
-	serie := factura.Serie
-	if serie == "" || serie == "undefined" || serie == "null" {
-		serie = "A"
-	}
+// GenerarXML convierte los datos de la factura en XML compatible con CFDI 4.0
+func GenerarXML(factura models.Factura) ([]byte, error) {
+	return serializarComprobante(construirComprobante(factura))
+}
 
-	var subtotal, totalImpuestos, totalDescuento float64
-	conceptos := make([]CFDIConcepto, len(factura.Conceptos))
-	for i, c := range factura.Conceptos {
-		importe := c.Cantidad * c.ValorUnitario
-		impuestoConcepto := importe * (c.TasaIVA / 100)
-		subtotal += importe
-		totalImpuestos += impuestoConcepto
-		if c.Descuento > 0 {
-			totalDescuento += c.Descuento
-		}
-		conceptos[i] = CFDIConcepto{
-			ClaveProdServ:    c.ClaveProdServ,
-			NoIdentificacion: "",
-			Cantidad:         formatFloat(c.Cantidad),
-			ClaveUnidad:      c.ClaveUnidad,
-			Unidad:           "",
-			Descripcion:      c.Descripcion,
-			ValorUnitario:    formatFloat(c.ValorUnitario),
-			Importe:          formatFloat(importe),
-			ObjetoImp:        "02",
-			Impuestos: CFDIConceptoImpuestos{
-				Traslados: CFDIConceptoTraslados{
-					Traslado: []CFDIConceptoTraslado{{
-						Base:       formatFloat(importe),
-						Impuesto:   "002",
-						TipoFactor: "Tasa",
-						TasaOCuota: formatTasa(c.TasaIVA),
-						Importe:    formatFloat(impuestoConcepto),
-					}},
-				},
-			},
-		}
-	}
-	if factura.Descuento > 0 {
-		totalDescuento += factura.Descuento
-	}
-	comprobante := CFDIComprobante{
-		XMLNS:             "http://www.sat.gob.mx/cfd/4",
-		XMLNSXSI:          "http://www.w3.org/2001/XMLSchema-instance",
-		XSISchemaLocation: "http://www.sat.gob.mx/cfd/4 http://www.sat.gob.mx/sitio_internet/cfd/4/cfdv40.xsd",
-		Version:           "4.0",
-		Serie:             serie,
-		Folio:             factura.NumeroFolio,
-		Fecha:             factura.FechaEmision,
-		Sello:             "", // Se asigna después
-		FormaPago:         ifEmpty(factura.FormaPago, "01"),
-		NoCertificado:     factura.NoCertificado,
-		Certificado:       factura.Certificado,
-		SubTotal:          formatFloat(subtotal),
-		Moneda:            ifEmpty(factura.Moneda, "MXN"),
-		Total:             formatFloat(subtotal + totalImpuestos - totalDescuento),
-		TipoDeComprobante: "I",
-		MetodoPago:        ifEmpty(factura.MetodoPago, "PUE"),
-		LugarExpedicion:   factura.EmisorCodigoPostal,
-		Emisor: CFDIEmisor{
-			Rfc:           factura.EmisorRFC,
-			Nombre:        factura.EmisorRazonSocial,
-			RegimenFiscal: factura.EmisorRegimenFiscal,
-		},
-		Receptor:  safeReceptor(factura),
-		Conceptos: CFDIConceptos{Concepto: conceptos},
-		Impuestos: CFDIImpuestos{
-			TotalImpuestosTrasladados: formatFloat(totalImpuestos),
-			Traslados: CFDITraslados{
-				Traslado: []CFDITraslado{{
-					Impuesto:   "002",
-					TipoFactor: "Tasa",
-					TasaOCuota: "0.160000",
-					Importe:    formatFloat(totalImpuestos),
-				}},
-			},
-		},
-	}
-	if totalDescuento > 0 {
-		comprobante.Descuento = formatFloat(totalDescuento)
-	}
+// GenerarXMLConSello genera el XML CFDI 4.0, calcula su cadena original y firma el sello con la llave del CSD
+func GenerarXMLConSello(factura models.Factura, llave *rsa.PrivateKey) ([]byte, error) {
+	comprobante := construirComprobante(factura)
 
-	// --- Generar el sello digital ---
-	sello, err := firmarCadenaOriginal(cadenaOriginal, keyPEM)
+	// --- Generar el sello digital sobre la cadena original ---
+	cadenaOriginal := GenerarCadenaOriginal(comprobante)
+	sello, err := firmarCadenaOriginal(cadenaOriginal, llave)
 	if err != nil {
 		return nil, fmt.Errorf("error generando sello digital: %w", err)
 	}
 	comprobante.Sello = sello
 
-	var buf bytes.Buffer
-	buf.WriteString(xml.Header)
-	encoder := xml.NewEncoder(&buf)
-	encoder.Indent("", "  ")
-	if err := encoder.Encode(comprobante); err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
+	return serializarComprobante(comprobante)
 }
 
 // --- PAC Integration & Timbre Extraction ---
@@ -621,20 +478,21 @@ type TimbreFiscalDigital struct {
 	SelloCFD         string
 	NoCertificadoSAT string
 	FechaTimbrado    string
+	RfcProvCertif    string
+	Leyenda          string
 	Version          string
 }
 
-// Genera el XML firmado, lo timbra con Solución Factible y retorna el XML timbrado y el timbre fiscal digital
-func GenerarYTimbrarCFDIConPAC(factura models.Factura, keyPath string, claveCSD string, xsltPath string, pacUser string, pacPass string) ([]byte, *TimbreFiscalDigital, error) {
+// Genera el XML firmado, lo timbra con el PAC indicado y retorna el XML timbrado y el timbre fiscal digital
+func GenerarYTimbrarCFDIConPAC(factura models.Factura, keyPath string, claveCSD string, proveedor pac.PACProvider) ([]byte, *TimbreFiscalDigital, error) {
 	// 1. Genera el XML firmado
-	xmlFirmado, err := ProcesarKeyYGenerarCFDI(factura, keyPath, claveCSD, xsltPath)
+	xmlFirmado, err := ProcesarKeyYGenerarCFDI(factura, keyPath, claveCSD)
 	if err != nil {
 		return nil, nil, fmt.Errorf("error generando XML firmado: %w", err)
 	}
 
-	// 2. Timbrar con Solución Factible (PAC)
-	endpoint := "https://demo-facturacion.solucionfactible.com/ws/rest/timbrado"
-	xmlTimbradoBytes, err := pac.TimbrarConPAC(string(xmlFirmado), factura.EmisorRFC, pacPass, endpoint)
+	// 2. Timbrar con el PAC
+	xmlTimbradoBytes, err := proveedor.Timbrar(xmlFirmado)
 	if err != nil {
 		return nil, nil, fmt.Errorf("error timbrando con PAC: %w", err)
 	}
@@ -651,44 +509,40 @@ func GenerarYTimbrarCFDIConPAC(factura models.Factura, keyPath string, claveCSD
 
 // Extrae el Timbre Fiscal Digital del XML timbrado
 func ExtraerTimbreFiscalDigital(xmlTimbrado []byte) (*TimbreFiscalDigital, error) {
-	type Timbre struct {
-		XMLName          xml.Name `xml:"tfd:TimbreFiscalDigital"`
-		UUID             string   `xml:"UUID,attr"`
-		SelloSAT         string   `xml:"SelloSAT,attr"`
-		SelloCFD         string   `xml:"SelloCFD,attr"`
-		NoCertificadoSAT string   `xml:"NoCertificadoSAT,attr"`
-		FechaTimbrado    string   `xml:"FechaTimbrado,attr"`
-		Version          string   `xml:"Version,attr"`
-	}
-	// Buscar el nodo TimbreFiscalDigital en el XML
-	var t Timbre
-	err := xml.Unmarshal(xmlTimbrado, &t)
-	if err == nil && t.UUID != "" {
-		return &TimbreFiscalDigital{
-			UUID:             t.UUID,
-			SelloSAT:         t.SelloSAT,
-			SelloCFD:         t.SelloCFD,
-			NoCertificadoSAT: t.NoCertificadoSAT,
-			FechaTimbrado:    t.FechaTimbrado,
-			Version:          t.Version,
-		}, nil
-	}
-	// Si falla el Unmarshal directo, buscar el nodo manualmente
-	tfdStart := bytes.Index(xmlTimbrado, []byte("<tfd:TimbreFiscalDigital"))
-	tfdEnd := bytes.Index(xmlTimbrado[tfdStart:], []byte("/>"))
-	if tfdStart >= 0 && tfdEnd > 0 {
-		tfdNode := xmlTimbrado[tfdStart : tfdStart+tfdEnd+2]
-		var t2 Timbre
-		err2 := xml.Unmarshal(tfdNode, &t2)
-		if err2 == nil && t2.UUID != "" {
-			return &TimbreFiscalDigital{
-				UUID:             t2.UUID,
-				SelloSAT:         t2.SelloSAT,
-				SelloCFD:         t2.SelloCFD,
-				NoCertificadoSAT: t2.NoCertificadoSAT,
-				FechaTimbrado:    t2.FechaTimbrado,
-				Version:          t2.Version,
-			}, nil
+	// Recorrer los tokens y tomar el primer nodo TimbreFiscalDigital sin importar el prefijo usado
+	decoder := xml.NewDecoder(bytes.NewReader(xmlTimbrado))
+	for {
+		tok, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		inicio, ok := tok.(xml.StartElement)
+		if !ok || inicio.Name.Local != "TimbreFiscalDigital" {
+			continue
+		}
+		timbre := &TimbreFiscalDigital{}
+		for _, attr := range inicio.Attr {
+			switch attr.Name.Local {
+			case "UUID":
+				timbre.UUID = attr.Value
+			case "SelloSAT":
+				timbre.SelloSAT = attr.Value
+			case "SelloCFD":
+				timbre.SelloCFD = attr.Value
+			case "NoCertificadoSAT":
+				timbre.NoCertificadoSAT = attr.Value
+			case "FechaTimbrado":
+				timbre.FechaTimbrado = attr.Value
+			case "RfcProvCertif":
+				timbre.RfcProvCertif = attr.Value
+			case "Leyenda":
+				timbre.Leyenda = attr.Value
+			case "Version":
+				timbre.Version = attr.Value
+			}
+		}
+		if timbre.UUID != "" {
+			return timbre, nil
 		}
 	}
 	return nil, errors.New("No se encontró el nodo TimbreFiscalDigital en el XML timbrado")
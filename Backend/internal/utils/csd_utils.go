@@ -2,9 +2,13 @@ package utils
 
 import (
 	"crypto/x509"
+	"encoding/asn1"
 	"encoding/hex"
+	"encoding/pem"
 	"errors"
+	"fmt"
 	"strings"
+	"time"
 )
 
 // ObtenerNoSerieCER extrae el número de serie del certificado CSD (.cer) recibido como []byte
@@ -16,5 +20,118 @@ func ObtenerNoSerieCER(cerBytes []byte) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	return strings.ToUpper(hex.EncodeToString(cert.SerialNumber.Bytes())), nil
+	return NumeroCertificadoCSD(cert), nil
+}
+
+// LeerCertificadoCSD interpreta el .cer en DER o en PEM
+func LeerCertificadoCSD(cerBytes []byte) (*x509.Certificate, error) {
+	cert, err := x509.ParseCertificate(cerBytes)
+	if err != nil {
+		if block, _ := pem.Decode(cerBytes); block != nil {
+			cert, err = x509.ParseCertificate(block.Bytes)
+		}
+	}
+	return cert, err
+}
+
+// NumeroCertificadoCSD es el número de certificado que se asienta en el atributo NoCertificado del CFDI.
+// El SAT guarda en el número de serie los códigos ASCII de los 20 dígitos del número de certificado.
+func NumeroCertificadoCSD(cert *x509.Certificate) string {
+	serie := cert.SerialNumber.Bytes()
+	for _, b := range serie {
+		if b < '0' || b > '9' {
+			// No es un certificado del SAT: se usa el número de serie en hexadecimal
+			return strings.ToUpper(hex.EncodeToString(serie))
+		}
+	}
+	return string(serie)
+}
+
+// Códigos de error de la validación de CSD
+const (
+	CSDArchivosIncompletos = "CSD_ARCHIVOS_INCOMPLETOS"
+	CSDCertificadoInvalido = "CSD_CERTIFICADO_INVALIDO"
+	CSDLlaveInvalida       = "CSD_LLAVE_INVALIDA"
+	CSDContrasenaInvalida  = "CSD_CONTRASENA_INVALIDA"
+	CSDLlaveNoCorresponde  = "CSD_LLAVE_NO_CORRESPONDE"
+	CSDRFCNoCoincide       = "CSD_RFC_NO_COINCIDE"
+	CSDNoVigente           = "CSD_NO_VIGENTE"
+	CSDEsFIEL              = "CSD_ES_FIEL"
+)
+
+// oidX500UniqueIdentifier es el atributo del sujeto donde el SAT guarda "RFC / RFC representante"
+var oidX500UniqueIdentifier = asn1.ObjectIdentifier{2, 5, 4, 45}
+
+// ErrorValidacionCSD describe por qué un par .cer/.key no puede usarse para sellar
+type ErrorValidacionCSD struct {
+	Codigo  string `json:"codigo"`
+	Mensaje string `json:"message"`
+}
+
+func (e *ErrorValidacionCSD) Error() string {
+	return e.Mensaje
+}
+
+func errorCSD(codigo, formato string, args ...interface{}) *ErrorValidacionCSD {
+	return &ErrorValidacionCSD{Codigo: codigo, Mensaje: fmt.Sprintf(formato, args...)}
+}
+
+// ObtenerRFCCertificado extrae el RFC del titular del sujeto del certificado
+func ObtenerRFCCertificado(cert *x509.Certificate) string {
+	for _, atributo := range cert.Subject.Names {
+		if !atributo.Type.Equal(oidX500UniqueIdentifier) {
+			continue
+		}
+		valor, _ := atributo.Value.(string)
+		// Personas morales: "RFC_EMPRESA / RFC_REPRESENTANTE"
+		rfc, _, _ := strings.Cut(valor, "/")
+		return strings.ToUpper(strings.TrimSpace(rfc))
+	}
+	return ""
+}
+
+// esCertificadoFIEL distingue la e.firma del CSD: el CSD solo permite firma digital y no repudio,
+// mientras que la FIEL además habilita cifrado de datos o acuerdo de llaves
+func esCertificadoFIEL(cert *x509.Certificate) bool {
+	return cert.KeyUsage&(x509.KeyUsageDataEncipherment|x509.KeyUsageKeyAgreement|x509.KeyUsageKeyEncipherment) != 0
+}
+
+// ValidarCSD verifica que el par .cer/.key sea un CSD vigente del RFC indicado y que la contraseña abra la llave
+func ValidarCSD(cerBytes, keyBytes []byte, claveCSD, rfc string, ahora time.Time) error {
+	if len(cerBytes) == 0 || len(keyBytes) == 0 {
+		return errorCSD(CSDArchivosIncompletos, "se requieren ambos archivos del CSD (.cer y .key)")
+	}
+
+	cert, err := LeerCertificadoCSD(cerBytes)
+	if err != nil {
+		return errorCSD(CSDCertificadoInvalido, "el archivo .cer no es un certificado válido: %v", err)
+	}
+
+	llave, err := DescifrarLlaveCSD(keyBytes, claveCSD)
+	if err != nil {
+		if errors.Is(err, ErrLlaveCSDContrasena) {
+			return errorCSD(CSDContrasenaInvalida, "la contraseña del CSD no abre el archivo .key")
+		}
+		return errorCSD(CSDLlaveInvalida, "el archivo .key no es una llave privada válida: %v", err)
+	}
+
+	if !llave.PublicKey.Equal(cert.PublicKey) {
+		return errorCSD(CSDLlaveNoCorresponde, "el archivo .key no corresponde al certificado .cer")
+	}
+
+	if esCertificadoFIEL(cert) {
+		return errorCSD(CSDEsFIEL, "el certificado es de e.firma (FIEL); se requiere un Certificado de Sello Digital (CSD)")
+	}
+
+	rfcCertificado := ObtenerRFCCertificado(cert)
+	if rfcCertificado != strings.ToUpper(strings.TrimSpace(rfc)) {
+		return errorCSD(CSDRFCNoCoincide, "el RFC del certificado (%s) no coincide con el RFC del emisor (%s)", rfcCertificado, rfc)
+	}
+
+	if ahora.Before(cert.NotBefore) || ahora.After(cert.NotAfter) {
+		return errorCSD(CSDNoVigente, "el certificado no está vigente (válido del %s al %s)",
+			cert.NotBefore.Format("2006-01-02"), cert.NotAfter.Format("2006-01-02"))
+	}
+
+	return nil
 }
@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+const (
+	cerPrueba   = "../../certificados/ABC123456DE7_cer.cer"
+	keyPrueba   = "../../certificados/ABC123456DE7_key.key"
+	clavePrueba = "12345678a"
+	rfcPrueba   = "EKU9003173C9"
+)
+
+func TestValidarCSD(t *testing.T) {
+	cer, err := os.ReadFile(cerPrueba)
+	if err != nil {
+		t.Fatalf("no se pudo leer el certificado de prueba: %v", err)
+	}
+	key, err := os.ReadFile(keyPrueba)
+	if err != nil {
+		t.Fatalf("no se pudo leer la llave de prueba: %v", err)
+	}
+	otra, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(otra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otraKey := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	// El certificado de prueba del SAT es válido de junio de 2019 a junio de 2023
+	vigente := time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)
+	casos := []struct {
+		nombre string
+		cer    []byte
+		key    []byte
+		clave  string
+		rfc    string
+		ahora  time.Time
+		codigo string // Vacío si el CSD es válido
+	}{
+		{"válido", cer, key, clavePrueba, rfcPrueba, vigente, ""},
+		{"RFC en minúsculas", cer, key, clavePrueba, " eku9003173c9 ", vigente, ""},
+		{"sin llave", cer, nil, clavePrueba, rfcPrueba, vigente, CSDArchivosIncompletos},
+		{"sin certificado", nil, key, clavePrueba, rfcPrueba, vigente, CSDArchivosIncompletos},
+		{"certificado inválido", []byte("no es un certificado"), key, clavePrueba, rfcPrueba, vigente, CSDCertificadoInvalido},
+		{"llave inválida", cer, []byte("no es una llave"), clavePrueba, rfcPrueba, vigente, CSDLlaveInvalida},
+		{"contraseña incorrecta", cer, key, "incorrecta", rfcPrueba, vigente, CSDContrasenaInvalida},
+		{"llave de otro certificado", cer, otraKey, "", rfcPrueba, vigente, CSDLlaveNoCorresponde},
+		{"RFC distinto", cer, key, clavePrueba, "URE180429TM6", vigente, CSDRFCNoCoincide},
+		{"vencido", cer, key, clavePrueba, rfcPrueba, time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC), CSDNoVigente},
+		{"aún no vigente", cer, key, clavePrueba, rfcPrueba, time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC), CSDNoVigente},
+	}
+	for _, c := range casos {
+		t.Run(c.nombre, func(t *testing.T) {
+			err := ValidarCSD(c.cer, c.key, c.clave, c.rfc, c.ahora)
+			if c.codigo == "" {
+				if err != nil {
+					t.Fatalf("se esperaba un CSD válido: %v", err)
+				}
+				return
+			}
+			var errCSD *ErrorValidacionCSD
+			if !errors.As(err, &errCSD) {
+				t.Fatalf("se esperaba el error %s, se obtuvo %v", c.codigo, err)
+			}
+			if errCSD.Codigo != c.codigo {
+				t.Errorf("código %s (%s), se esperaba %s", errCSD.Codigo, errCSD.Mensaje, c.codigo)
+			}
+		})
+	}
+}
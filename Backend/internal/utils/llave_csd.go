@@ -0,0 +1,196 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/pbkdf2"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+)
+
+// Descifrado en memoria de la llave privada del CSD (.key del SAT).
+// El SAT entrega la llave como EncryptedPrivateKeyInfo (PKCS#8) en DER, cifrada con
+// PBES2: PBKDF2 (HMAC-SHA1 por defecto) + DES-EDE3-CBC. Se soportan también AES-CBC
+// y PRF SHA-256/SHA-512 por si la llave fue re-cifrada con OpenSSL moderno.
+
+var (
+	ErrLlaveCSDContrasena = errors.New("contraseña de la llave privada incorrecta")
+	ErrLlaveCSDFormato    = errors.New("formato de llave privada no reconocido")
+)
+
+var (
+	oidPBES2      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidDESEDE3CBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+	oidAES128CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algoritmo     pkix.AlgorithmIdentifier
+	DatosCifrados []byte
+}
+
+type pbes2Params struct {
+	KeyDerivation pkix.AlgorithmIdentifier
+	Cifrado       pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt        []byte
+	Iteraciones int
+	LongitudKey int                      `asn1:"optional"`
+	PRF         pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// DescifrarLlaveCSD descifra la llave privada del CSD (DER o PEM) y regresa la llave RSA sin escribir nada a disco
+func DescifrarLlaveCSD(keyBytes []byte, contrasena string) (*rsa.PrivateKey, error) {
+	if len(keyBytes) == 0 {
+		return nil, errors.New("el archivo .key está vacío")
+	}
+
+	der := keyBytes
+	if block, _ := pem.Decode(keyBytes); block != nil {
+		switch block.Type {
+		case "PRIVATE KEY":
+			return llaveRSADesdePKCS8(block.Bytes)
+		case "RSA PRIVATE KEY":
+			llave, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrLlaveCSDFormato, err)
+			}
+			return llave, nil
+		case "ENCRYPTED PRIVATE KEY":
+			der = block.Bytes
+		default:
+			return nil, fmt.Errorf("%w: bloque PEM %q", ErrLlaveCSDFormato, block.Type)
+		}
+	}
+
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrLlaveCSDFormato, err)
+	}
+	if !info.Algoritmo.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("%w: algoritmo de cifrado %s no soportado", ErrLlaveCSDFormato, info.Algoritmo.Algorithm)
+	}
+
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algoritmo.Parameters.FullBytes, &params); err != nil {
+		return nil, fmt.Errorf("%w: parámetros PBES2 inválidos: %v", ErrLlaveCSDFormato, err)
+	}
+	if !params.KeyDerivation.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("%w: derivación %s no soportada", ErrLlaveCSDFormato, params.KeyDerivation.Algorithm)
+	}
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivation.Parameters.FullBytes, &kdf); err != nil {
+		return nil, fmt.Errorf("%w: parámetros PBKDF2 inválidos: %v", ErrLlaveCSDFormato, err)
+	}
+
+	nuevoBloque, longitudKey, err := cifradorPBES2(params.Cifrado.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.Cifrado.Parameters.FullBytes, &iv); err != nil {
+		return nil, fmt.Errorf("%w: IV inválido: %v", ErrLlaveCSDFormato, err)
+	}
+	prf, err := prfPBKDF2(kdf.PRF.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	clave, err := pbkdf2.Key(prf, contrasena, kdf.Salt, kdf.Iteraciones, longitudKey)
+	if err != nil {
+		return nil, fmt.Errorf("error derivando clave PBKDF2: %w", err)
+	}
+	bloque, err := nuevoBloque(clave)
+	if err != nil {
+		return nil, fmt.Errorf("error inicializando cifrador: %w", err)
+	}
+	if len(iv) != bloque.BlockSize() || len(info.DatosCifrados)%bloque.BlockSize() != 0 {
+		return nil, fmt.Errorf("%w: tamaño de IV o de datos cifrados inválido", ErrLlaveCSDFormato)
+	}
+
+	plano := make([]byte, len(info.DatosCifrados))
+	cipher.NewCBCDecrypter(bloque, iv).CryptBlocks(plano, info.DatosCifrados)
+
+	// Un relleno PKCS#7 inválido o un PKCS#8 ilegible indican contraseña incorrecta
+	plano, ok := quitarRellenoPKCS7(plano, bloque.BlockSize())
+	if !ok {
+		return nil, ErrLlaveCSDContrasena
+	}
+	llave, err := llaveRSADesdePKCS8(plano)
+	if err != nil {
+		return nil, ErrLlaveCSDContrasena
+	}
+	return llave, nil
+}
+
+func llaveRSADesdePKCS8(der []byte) (*rsa.PrivateKey, error) {
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrLlaveCSDFormato, err)
+	}
+	llave, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: la llave privada no es RSA", ErrLlaveCSDFormato)
+	}
+	return llave, nil
+}
+
+func cifradorPBES2(oid asn1.ObjectIdentifier) (func([]byte) (cipher.Block, error), int, error) {
+	switch {
+	case oid.Equal(oidDESEDE3CBC):
+		return des.NewTripleDESCipher, 24, nil
+	case oid.Equal(oidAES128CBC):
+		return aes.NewCipher, 16, nil
+	case oid.Equal(oidAES192CBC):
+		return aes.NewCipher, 24, nil
+	case oid.Equal(oidAES256CBC):
+		return aes.NewCipher, 32, nil
+	}
+	return nil, 0, fmt.Errorf("%w: cifrado %s no soportado", ErrLlaveCSDFormato, oid)
+}
+
+func prfPBKDF2(oid asn1.ObjectIdentifier) (func() hash.Hash, error) {
+	switch {
+	case len(oid) == 0, oid.Equal(oidHMACSHA1):
+		return sha1.New, nil
+	case oid.Equal(oidHMACSHA256):
+		return sha256.New, nil
+	case oid.Equal(oidHMACSHA512):
+		return sha512.New, nil
+	}
+	return nil, fmt.Errorf("%w: PRF %s no soportada", ErrLlaveCSDFormato, oid)
+}
+
+func quitarRellenoPKCS7(datos []byte, tamBloque int) ([]byte, bool) {
+	if len(datos) == 0 {
+		return nil, false
+	}
+	n := int(datos[len(datos)-1])
+	if n == 0 || n > tamBloque || n > len(datos) {
+		return nil, false
+	}
+	for _, b := range datos[len(datos)-n:] {
+		if int(b) != n {
+			return nil, false
+		}
+	}
+	return datos[:len(datos)-n], true
+}
@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"os"
+	"testing"
+)
+
+// cifrarPKCS8 cifra la llave como la re-cifra OpenSSL moderno: PBES2 con PBKDF2 HMAC-SHA256 y AES-256-CBC
+func cifrarPKCS8(t *testing.T, llave *rsa.PrivateKey, contrasena string) []byte {
+	t.Helper()
+	plano, err := x509.MarshalPKCS8PrivateKey(llave)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt, iv := make([]byte, 16), make([]byte, aes.BlockSize)
+	rand.Read(salt)
+	rand.Read(iv)
+	clave, err := pbkdf2.Key(sha256.New, contrasena, salt, 2048, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relleno := aes.BlockSize - len(plano)%aes.BlockSize
+	for i := 0; i < relleno; i++ {
+		plano = append(plano, byte(relleno))
+	}
+	bloque, _ := aes.NewCipher(clave)
+	cifrado := make([]byte, len(plano))
+	cipher.NewCBCEncrypter(bloque, iv).CryptBlocks(cifrado, plano)
+
+	parametro := func(v interface{}) asn1.RawValue {
+		der, err := asn1.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return asn1.RawValue{FullBytes: der}
+	}
+	kdf := pbkdf2Params{Salt: salt, Iteraciones: 2048, PRF: pkix.AlgorithmIdentifier{Algorithm: oidHMACSHA256, Parameters: asn1.NullRawValue}}
+	pbes2 := pbes2Params{
+		KeyDerivation: pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: parametro(kdf)},
+		Cifrado:       pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: parametro(iv)},
+	}
+	der, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algoritmo:     pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: parametro(pbes2)},
+		DatosCifrados: cifrado,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: der})
+}
+
+func TestDescifrarLlaveCSD(t *testing.T) {
+	sat := leerArchivo(t, keyPrueba)
+	cert, err := LeerCertificadoCSD(leerArchivo(t, cerPrueba))
+	if err != nil {
+		t.Fatal(err)
+	}
+	propia, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemCifrado := cifrarPKCS8(t, propia, "secreta")
+
+	casos := []struct {
+		nombre     string
+		llave      []byte
+		contrasena string
+		publica    *rsa.PublicKey
+		esperado   error // nil si debe abrir
+	}{
+		{"SAT en DER (3DES, HMAC-SHA1)", sat, clavePrueba, cert.PublicKey.(*rsa.PublicKey), nil},
+		{"SAT con contraseña incorrecta", sat, "incorrecta", nil, ErrLlaveCSDContrasena},
+		{"PEM cifrado (AES-256, HMAC-SHA256)", pemCifrado, "secreta", &propia.PublicKey, nil},
+		{"PEM cifrado con contraseña incorrecta", pemCifrado, "otra", nil, ErrLlaveCSDContrasena},
+		{"no es una llave", []byte("no es una llave"), clavePrueba, nil, ErrLlaveCSDFormato},
+	}
+	for _, c := range casos {
+		t.Run(c.nombre, func(t *testing.T) {
+			llave, err := DescifrarLlaveCSD(c.llave, c.contrasena)
+			if c.esperado != nil {
+				if !errors.Is(err, c.esperado) {
+					t.Fatalf("se esperaba %v, se obtuvo %v", c.esperado, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("no se pudo descifrar: %v", err)
+			}
+			if !llave.PublicKey.Equal(c.publica) {
+				t.Errorf("la llave descifrada no corresponde a su llave pública")
+			}
+		})
+	}
+	if _, err := DescifrarLlaveCSD(nil, clavePrueba); err == nil {
+		t.Errorf("se aceptó una llave vacía")
+	}
+}
+
+func leerArchivo(t *testing.T, ruta string) []byte {
+	t.Helper()
+	datos, err := os.ReadFile(ruta)
+	if err != nil {
+		t.Fatalf("no se pudo leer %s: %v", ruta, err)
+	}
+	return datos
+}
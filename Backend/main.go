@@ -3,10 +3,12 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -14,12 +16,18 @@ import (
 	"Facts/internal/db"
 	"Facts/internal/handlers"
 	"Facts/internal/models"
+	"Facts/internal/pac/simulado"
+	"Facts/internal/secretos"
 	"Facts/internal/utils"
 
 	_ "github.com/go-sql-driver/mysql"
 )
 
 func main() {
+	// Comandos de línea (p. ej. auditar-folios) se ejecutan sin levantar el servidor
+	if len(os.Args) > 1 {
+		os.Exit(ejecutarComando(os.Args[1:]))
+	}
 
 	http.Handle("/api/facturas-empresa-activa", utils.EnableCors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
@@ -103,6 +111,22 @@ func main() {
 	})))
 	// Inicializar la conexión a la base de datos
 	db.InitDB()
+	if err := db.EjecutarMigraciones(); err != nil {
+		log.Fatalf("Error al aplicar migraciones: %v", err)
+	}
+	// Cargar las llaves maestras y sellar los CSD y las contraseñas del PAC que sigan en claro
+	if err := secretos.Inicializar(); err != nil {
+		log.Fatalf("Error al cargar las llaves maestras: %v", err)
+	}
+	if err := db.RecifrarSecretosCSD(); err != nil {
+		log.Fatalf("Error al recifrar los CSD: %v", err)
+	}
+	if err := db.RecifrarContrasenasPAC(); err != nil {
+		log.Fatalf("Error al recifrar las contraseñas del PAC: %v", err)
+	}
+	if err := db.MigrarCertificadosCSD(); err != nil {
+		log.Fatalf("Error al registrar los certificados CSD: %v", err)
+	}
 
 	// Obtener conexión a optimus para los handlers que la necesitan
 	optimusDB, err := db.ConnectToOptimus()
@@ -140,10 +164,17 @@ func main() {
 	})))
 
 	// Endpoint robusto único para generar factura
-	http.Handle("/api/generar-factura", utils.EnableCors(http.HandlerFunc(handlers.GenerarFacturaHandler)))
+	http.Handle("/api/generar-factura", utils.EnableCors(http.HandlerFunc(handlers.GenerarFacturaHandler(optimusDB))))
 
 	http.HandleFunc("/api/historial-emisor", handlers.HistorialEmisorHandler)
 
+	// Notas de crédito (CFDI de egreso) relacionadas con una factura del historial
+	http.Handle("/api/nota-credito", utils.EnableCors(http.HandlerFunc(handlers.GenerarNotaCreditoHandler)))
+	http.Handle("/api/factura-relaciones", utils.EnableCors(http.HandlerFunc(handlers.RelacionesFacturaHandler)))
+
+	// Complemento de recepción de pagos 2.0 para facturas PPD
+	http.Handle("/api/complemento-pago", utils.EnableCors(http.HandlerFunc(handlers.ComplementoPagoHandler)))
+
 	// Endpoint que devuelve información sobre la factura generada
 	http.Handle("/api/generar-factura-info", utils.EnableCors(http.HandlerFunc(handlers.GenerarFacturaConInfoHandler)))
 
@@ -191,6 +222,42 @@ func main() {
 	// Endpoints para impuestos
 	http.Handle("/api/impuestos", utils.EnableCors(http.HandlerFunc(handlers.ImpuestosHandler(optimusDB))))
 	http.Handle("/api/productos-con-impuestos", utils.EnableCors(http.HandlerFunc(handlers.ProductosConImpuestosHandler(optimusDB))))
+	http.Handle("/api/factura-global", utils.EnableCors(http.HandlerFunc(handlers.FacturaGlobalHandler(optimusDB))))
+	http.Handle("/api/configuracion-pac", utils.EnableCors(http.HandlerFunc(handlers.ConfiguracionPACHandler)))
+
+	// Autofacturación: elegibilidad del ticket y plazo configurable por emisor
+	http.Handle("/api/tickets/elegibilidad", utils.EnableCors(http.HandlerFunc(handlers.ElegibilidadTicketHandler(optimusDB))))
+	http.Handle("/api/configuracion-autofactura", utils.EnableCors(http.HandlerFunc(handlers.ConfiguracionAutofacturaHandler)))
+
+	// Cola de timbrado asíncrono: estatus P (pendiente) → T (timbrando) → G (generada) / F (fallida)
+	http.Handle("/api/facturas/encolar", utils.EnableCors(http.HandlerFunc(handlers.EncolarFacturaHandler(optimusDB))))
+	http.Handle("/api/facturas/{id}/estado", utils.EnableCors(http.HandlerFunc(handlers.EstadoFacturaHandler)))
+	http.Handle("/api/facturas/{id}/eventos", utils.EnableCors(http.HandlerFunc(handlers.EventosFacturaHandler)))
+	http.Handle("/api/facturas/{id}/archivo", utils.EnableCors(http.HandlerFunc(handlers.ArchivoFacturaHandler)))
+
+	// Cancelación de la factura {id} del historial (motivos 01-04 del SAT) y consulta de su estado
+	http.Handle("/api/facturas/{id}/cancelar", utils.EnableCors(http.HandlerFunc(handlers.CancelarFacturaHandler)))
+	http.Handle("/api/facturas/{id}/cancelacion", utils.EnableCors(http.HandlerFunc(handlers.CancelacionFacturaHandler)))
+
+	// Verificación de estado ante el SAT (ConsultaCFDIService; URL en SAT_CONSULTA_URL)
+	http.Handle("/api/facturas/{id}/estado-sat", utils.EnableCors(http.HandlerFunc(handlers.EstadoSATFacturaHandler)))
+	http.Handle("/api/consulta-sat", utils.EnableCors(http.HandlerFunc(handlers.ConsultaSATHandler)))
+
+	// Representación impresa en PDF de cualquier CFDI 4.0 o 3.3 recibido como XML
+	http.Handle("/api/cfdi/visor", utils.EnableCors(http.HandlerFunc(handlers.VisorCFDIHandler)))
+
+	// Temas del PDF y marca (tema, colores y fuente) con la que imprime cada emisor
+	http.Handle("/api/emisores/{rfc}/marca", utils.EnableCors(http.HandlerFunc(handlers.MarcaEmisorHandler)))
+
+	// Certificados CSD del emisor: historial, alta de certificados (incluso por entrar en vigor) y revocación
+	http.Handle("/api/emisores/{rfc}/certificados", utils.EnableCors(http.HandlerFunc(handlers.CertificadosCSDHandler)))
+	http.Handle("/api/emisores/{rfc}/certificados/{id}/revocar", utils.EnableCors(http.HandlerFunc(handlers.RevocarCertificadoCSDHandler)))
+	http.Handle("/api/pdf/temas", utils.EnableCors(http.HandlerFunc(handlers.TemasPDFHandler)))
+
+	// Series de folios del emisor: alta, consulta y desactivación (por tipo de comprobante y sucursal)
+	http.Handle("/api/emisores/{rfc}/series", utils.EnableCors(http.HandlerFunc(handlers.SeriesFolioHandler)))
+	http.Handle("/api/emisores/{rfc}/series/{id}/desactivar", utils.EnableCors(http.HandlerFunc(handlers.DesactivarSerieFolioHandler)))
+	http.Handle("/api/emisores/{rfc}/folios/auditoria", utils.EnableCors(http.HandlerFunc(handlers.AuditoriaFoliosHandler)))
 
 	// Endpoint para registrar usuarios
 	http.Handle("/api/registrar_usuario", utils.EnableCors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -531,8 +598,8 @@ func main() {
 	// NUEVO: Endpoint para historial de facturas (formato con guión)
 	http.Handle("/api/historial-facturas", utils.EnableCors(http.HandlerFunc(handlers.HistorialFacturasHandler(db.GetDB()))))
 
-	// Endpoint para descargar una factura del historial
-	// ...existing code...
+	// Endpoint para descargar una factura del historial (XML archivado y PDF generado desde él)
+	http.Handle("/api/descargar-factura/{id}", utils.EnableCors(http.HandlerFunc(handlers.DescargarFacturaPorIDHandler)))
 
 	// Añadir nuevos endpoints (corregido)
 	http.Handle("/api/reset-password-request", utils.EnableCors(http.HandlerFunc(handlers.ResetPasswordRequestHandler(db.GetDB()))))
@@ -803,7 +870,7 @@ func main() {
 
 		// Obtener datos fiscales para el usuario específico
 		query := `SELECT id, rfc, razon_social, direccion_fiscal, direccion, 
-		  codigo_postal, clave_csd, regimen_fiscal,
+		  codigo_postal, COALESCE(clave_csd, '') <> '', regimen_fiscal,
 		  nombre_comercial, colonia, ciudad, estado, serie_df
 		  FROM datos_fiscales WHERE id_usuario = ?`
 
@@ -815,7 +882,7 @@ func main() {
 			Direccion       string `json:"direccion"`
 			CodigoPostal    string `json:"cp"`
 			// RutaCsdKey and RutaCsdCer removed (now handled as binary in DB)
-			ClaveCsd        string `json:"claveArchivoCSD"`
+			TieneClaveCSD   bool   `json:"tieneClaveCSD"` // la contraseña sellada no se envía al cliente
 			RegimenFiscal   string `json:"regimenFiscal"`
 			NombreComercial string `json:"nombreComercial"`
 			Colonia         string `json:"colonia"`
@@ -831,7 +898,7 @@ func main() {
 			&datosFiscales.DireccionFiscal,
 			&datosFiscales.Direccion,
 			&datosFiscales.CodigoPostal,
-			&datosFiscales.ClaveCsd,
+			&datosFiscales.TieneClaveCSD,
 			&datosFiscales.RegimenFiscal,
 			&datosFiscales.NombreComercial,
 			&datosFiscales.Colonia,
@@ -944,6 +1011,16 @@ func main() {
 			idUsuario,
 			"", // keyPath (ruta al archivo .key), se pasa vacío por defecto
 		)
+		var errCSD *utils.ErrorValidacionCSD
+		if errors.As(err, &errCSD) {
+			log.Printf("CSD rechazado: %v", err)
+			utils.RespondWithJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+				"status":  "error",
+				"codigo":  errCSD.Codigo,
+				"message": errCSD.Mensaje,
+			})
+			return
+		}
 		if err != nil {
 			log.Printf("Error al guardar datos fiscales: %v", err)
 			http.Error(w, "Error al guardar los datos fiscales", http.StatusInternalServerError)
@@ -958,6 +1035,27 @@ func main() {
 		})
 	})))
 
+	// Factura global mensual automática (usuarios en FACTURA_GLOBAL_USUARIOS)
+	go handlers.IniciarFacturaGlobalMensual(optimusDB)
+
+	// Workers de la cola de timbrado (retoman los trabajos pendientes al reiniciar)
+	handlers.IniciarColaFacturas()
+
+	// Seguimiento nocturno de cancelaciones que esperan la respuesta del receptor
+	go handlers.IniciarSeguimientoCancelaciones()
+
+	// Revisión diaria de vencimiento de los CSD (avisos a 30, 15 y 5 días)
+	go handlers.IniciarRevisionCSD()
+
+	// PAC simulado para demostraciones locales (ej. PAC_SIMULADO_ADDR=:8089)
+	if addr := os.Getenv("PAC_SIMULADO_ADDR"); addr != "" {
+		go func() {
+			if err := simulado.Escuchar(addr); err != nil {
+				log.Printf("[PAC_SIMULADO] Error: %v", err)
+			}
+		}()
+	}
+
 	// Iniciar limpieza programada de tokens de recuperación
 	go func() {
 		ticker := time.NewTicker(1 * time.Hour)
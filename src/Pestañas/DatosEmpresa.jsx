@@ -34,6 +34,8 @@ function DatosEmpresa() {
   // Estados para manejar los archivos
   const [csdKey, setCsdKey] = useState(null);
   const [csdCer, setCsdCer] = useState(null);
+  // El servidor no devuelve la contraseña del CSD, solo si ya hay una registrada
+  const [tieneClaveCSD, setTieneClaveCSD] = useState(false);
   
   // Estado para mensajes y carga
   const [mensaje, setMensaje] = useState(null);
@@ -83,7 +85,7 @@ function DatosEmpresa() {
             razonSocial: data.razonSocial || '',
             direccion1: data.direccionFiscal || data.direccion1 || '',
             cp: data.cp || data.codigo_postal || '',
-            claveArchivoCSD: data.claveArchivoCSD || data.clave_csd || '',
+            claveArchivoCSD: '',
             regimenFiscal: data.regimenFiscal || '',
             serie: data.serie_df || data.serie || '',
             // Mantener estos campos si no vienen del servidor (para preservar datos del buscador)
@@ -100,11 +102,12 @@ function DatosEmpresa() {
           };
           
           setDatosFiscales(nuevosData);
+          setTieneClaveCSD(Boolean(data.tieneClaveCSD || data.tiene_clave_csd));
           
           // Guardar en localStorage
           if (userData?.id) {
             try {
-              localStorage.setItem(`datosFiscales_${userData.id}`, JSON.stringify(nuevosData));
+              localStorage.setItem(`datosFiscales_${userData.id}`, JSON.stringify({ ...nuevosData, tieneClaveCSD: Boolean(data.tieneClaveCSD || data.tiene_clave_csd) }));
             } catch (error) {
               console.error('Error al guardar datos locales:', error);
             }
@@ -156,7 +159,8 @@ function DatosEmpresa() {
             if (datosGuardados) {
               const datosLocales = JSON.parse(datosGuardados);
               console.log("📂 Datos fiscales encontrados en localStorage, cargándolos...");
-              setDatosFiscales(datosLocales);
+              setTieneClaveCSD(Boolean(datosLocales.tieneClaveCSD || datosLocales.claveArchivoCSD));
+              setDatosFiscales({ ...datosLocales, claveArchivoCSD: '' });
               setIsEditing(false);
             } else {
               // Si no hay datos locales, cargar desde el servidor
@@ -417,8 +421,11 @@ function DatosEmpresa() {
         const responseData = await response.json();
         console.log("✅ Datos guardados exitosamente:", responseData);
         
-        // Guardar los datos en localStorage para persistencia entre recargas
-        guardarDatosLocales(datosFiscales);
+        // Guardar los datos en localStorage para persistencia entre recargas (sin la contraseña del CSD)
+        const claveRegistrada = tieneClaveCSD || Boolean(datosFiscales.claveArchivoCSD);
+        setTieneClaveCSD(claveRegistrada);
+        guardarDatosLocales({ ...datosFiscales, claveArchivoCSD: '', tieneClaveCSD: claveRegistrada });
+        setDatosFiscales(prev => ({ ...prev, claveArchivoCSD: '' }));
         
         // Mantener los datos actuales que el usuario acaba de guardar
         // NO recargar desde el servidor para mantener todos los campos
@@ -1255,11 +1262,11 @@ function DatosEmpresa() {
                       value={datosFiscales.claveArchivoCSD}
                       onChange={handleChange}
                       className={fieldErrors.claveArchivoCSD ? 'input-error' : ''}
-                      placeholder="Clave de los certificados CSD"
+                      placeholder={tieneClaveCSD ? 'Déjala vacía para conservar la registrada' : 'Clave de los certificados CSD'}
                     />
                   ) : (
                     <div className="read-only-field">
-                      {datosFiscales.claveArchivoCSD ? '••••••••' : '—'}
+                      {tieneClaveCSD || datosFiscales.claveArchivoCSD ? '••••••••' : '—'}
                     </div>
                   )}
                 </div>
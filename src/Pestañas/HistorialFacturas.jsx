@@ -385,6 +385,8 @@ function HistorialFacturas() {
         return 'Pendiente';
       case 'C':
         return 'Cancelada';
+      case 'S':
+        return 'En cancelación';
       case 'E':
         return 'Error';
       default: